@@ -2,23 +2,37 @@ package main
 
 import (
 	"context"
+	"os"
 
 	"distributed-backup/internal"
 	"distributed-backup/pkg/log"
 )
 
 func main() {
-	log.SetupLogger()
+	// Defaults are used until options are parsed (see: App.Setup()).
+	if err := log.SetupLogger(log.LoggerConfig{}); err != nil {
+		log.Fatal(err)
+	}
+	defer log.Close()
 
 	app := internal.NewApp()
 
 	if err := app.Setup(); err != nil {
-		log.Fatal(err)
+		exit(err)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
 	if err := app.Run(ctx, cancel); err != nil {
-		log.Fatal(err)
+		exit(err)
 	}
 }
+
+// exit logs an error a run has failed with and exits with a code telling why
+// (see: internal.ExitCode()).
+func exit(err error) {
+	log.Error(err)
+	log.Close()
+
+	os.Exit(internal.ExitCode(err))
+}
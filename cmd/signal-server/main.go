@@ -0,0 +1,94 @@
+// Command signal-server runs a rendezvous server of both the WebSocket and the
+// HTTP signaling (see: signal.NewRendezvousServer) without the rest of
+// distributed-backup, e.g. in a container of an organization hosting its own
+// signaling. It's the same server as the one run by the "signal-server" command
+// of distributed-backup.
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	ossignal "os/signal"
+	"syscall"
+	"time"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/signal"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+func main() {
+	var (
+		addr       string
+		token      string
+		backlogTTL time.Duration
+		logLevel   string
+		logFile    string
+		logCfg     log.RotatingFileConfig
+		logMaxSize uint
+	)
+
+	pflag.StringVar(&addr, "addr", ":8080", "Address the server listens on")
+	pflag.StringVar(&token, "token", os.Getenv("SIGNAL_TOKEN"), "Bearer token peers are required to send (see: --signal-token of distributed-backup), SIGNAL_TOKEN by default, any peer is accepted if it's empty")
+	pflag.DurationVar(&backlogTTL, "backlog-ttl", 10*time.Minute, "Time a message waiting for a peer is kept for")
+	pflag.StringVar(&logLevel, "log-level", "info", "Log level: panic, fatal, error, warn, info, debug or trace")
+	pflag.StringVar(&logFile, "log-file", "", "Path to a log file written instead of the standard output")
+	pflag.UintVar(&logMaxSize, "log-max-size", 100, "Size in megabytes a log file is rotated after, 0 means no limit")
+	pflag.DurationVar(&logCfg.MaxAge, "log-max-age", 0, "Duration a log file is rotated after (e.g. 24h, 0 means no limit)")
+	pflag.IntVar(&logCfg.MaxBackups, "log-max-backups", 5, "Number of rotated log files kept")
+	pflag.Parse()
+
+	cfg := log.LoggerConfig{Level: logLevel}
+
+	if len(logFile) != 0 {
+		logCfg.Path = logFile
+		logCfg.MaxSize = int64(logMaxSize) << 20
+		cfg.File = &logCfg
+	}
+
+	if err := log.SetupLogger(cfg); err != nil {
+		log.Fatal(err)
+	}
+	defer log.Close()
+
+	ctx, cancel := ossignal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	if err := run(ctx, addr, signal.RendezvousServerConfig{Token: token, BacklogTTL: backlogTTL}); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run serves requests on addr until ctx is done.
+func run(ctx context.Context, addr string, cfg signal.RendezvousServerConfig) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "signal server")
+	}
+
+	srv := &http.Server{
+		Handler:           signal.NewRendezvousServer(cfg),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.WithField(log.FieldAddr, l.Addr().String()).Info("signal server is listening")
+
+	if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		return errors.Wrap(err, "signal server")
+	}
+
+	return nil
+}
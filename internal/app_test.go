@@ -0,0 +1,24 @@
+package internal
+
+import "testing"
+
+// TestCheckVerbosityArgs checks that -v=N of command lines written when -v was
+// a shorthand of --versions is refused rather than taken for verbosity.
+func TestCheckVerbosityArgs(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"--dstdir=/dst", "-v"}, true},
+		{[]string{"--dstdir=/dst", "-vv"}, true},
+		{[]string{"--dstdir=/dst", "--verbose=2"}, true},
+		{[]string{"--dstdir=/dst", "--versions=2"}, true},
+		{[]string{"--", "-v=2"}, true},
+		{[]string{"--dstdir=/dst", "-v=1"}, false},
+		{[]string{"-v=2", "--dstdir=/dst"}, false},
+	} {
+		if err := checkVerbosityArgs(tt.args); (err == nil) != tt.ok {
+			t.Errorf("checkVerbosityArgs(%q) = %v", tt.args, err)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"distributed-backup/pkg/filemanager"
+	"distributed-backup/pkg/sync"
+
+	"github.com/pkg/errors"
+)
+
+// bandwidthLimiter returns a limiter of data sent to a peer by rules of
+// --bandwidth and a limit of --max-rate outside their windows, or nil if neither
+// is set.
+func (a *App) bandwidthLimiter() (filemanager.Limiter, error) {
+	if len(a.bandwidthRules) == 0 && len(a.maxRate) == 0 {
+		return nil, nil
+	}
+
+	var maxRate float64
+
+	if len(a.maxRate) != 0 {
+		var err error
+
+		if maxRate, err = sync.ParseRate(a.maxRate); err != nil {
+			return nil, errors.Wrap(err, "--max-rate")
+		}
+	}
+
+	rules := make([]sync.BandwidthRule, 0, len(a.bandwidthRules))
+
+	for _, s := range a.bandwidthRules {
+		r, err := sync.ParseBandwidthRule(s)
+		if err != nil {
+			return nil, errors.Wrap(err, "--bandwidth")
+		}
+
+		rules = append(rules, r)
+	}
+
+	return sync.NewBandwidthLimiter(sync.BandwidthLimiterConfig{
+		Rules: rules,
+		Rate:  maxRate,
+	}), nil
+}
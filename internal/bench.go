@@ -0,0 +1,400 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/peer"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	benchRole = "bench"
+
+	benchChunkSize = 16 << 10
+	benchReadSize  = 64 << 10
+	// benchMaxBuffered is an amount of data written but not sent yet the writer
+	// waits to drain, so that throughput is measured rather than buffering.
+	benchMaxBuffered = 1 << 20
+	// benchPings is a number of round trips RTT is averaged over.
+	benchPings       = 5
+	benchPingTimeout = 5 * time.Second
+	// benchFinishTimeout bounds waiting for the other peer to close a connection
+	// after both directions have been measured.
+	benchFinishTimeout = 2 * time.Second
+)
+
+// Types of benchmark messages given by the first byte. A peer sends pings, data
+// chunks, the end of data and a result of its download in this order, pongs are
+// sent whenever pings are received.
+const (
+	benchMsgPing   byte = 'p'
+	benchMsgPong   byte = 'q'
+	benchMsgData   byte = 'd'
+	benchMsgEnd    byte = 'e'
+	benchMsgResult byte = 'r'
+)
+
+// benchPeer is a connection a benchmark is run over.
+type benchPeer interface {
+	io.ReadWriter
+	OnEstablish(func())
+	BufferedAmount() uint64
+	ConnectionInfo() (*peer.ConnectionInfo, error)
+}
+
+// benchResult is an amount of data received from a direction and a time it took,
+// a peer sends its download result to the other one which considers it upload.
+type benchResult struct {
+	ReceivedBytes int64   `json:"received_bytes"`
+	Seconds       float64 `json:"seconds"`
+}
+
+func (r benchResult) throughput() float64 {
+	if r.Seconds == 0 {
+		return 0
+	}
+
+	return float64(r.ReceivedBytes) / r.Seconds
+}
+
+type benchReport struct {
+	Upload   benchResult
+	Download benchResult
+	// RTT is an average round trip time of pings sent over an idle connection.
+	RTT time.Duration
+	// Conn is nil if a connection description is unavailable.
+	Conn *peer.ConnectionInfo
+}
+
+// benchmark measures RTT and then streams synthetic data both ways at once for
+// a duration once a connection is established. Both peers run the same
+// benchmark, so there are no sender and receiver roles.
+type benchmark struct {
+	peer     benchPeer
+	duration time.Duration
+	log      log.Logger
+
+	done   chan struct{}
+	report benchReport
+	err    error
+}
+
+func newBenchmark(p benchPeer, duration time.Duration, logger log.Logger) *benchmark {
+	b := &benchmark{
+		peer:     p,
+		duration: duration,
+		log:      logger,
+		done:     make(chan struct{}),
+	}
+
+	p.OnEstablish(b.run)
+
+	return b
+}
+
+// Done is closed when both directions are measured or the benchmark fails.
+func (b *benchmark) Done() <-chan struct{} {
+	return b.done
+}
+
+// Report returns a result of a finished benchmark.
+func (b *benchmark) Report() (benchReport, error) {
+	return b.report, b.err
+}
+
+func (b *benchmark) run() {
+	defer close(b.done)
+
+	b.log.WithField(log.FieldDuration, b.duration.String()).Info("connection established, benchmarking...")
+
+	conn, err := b.peer.ConnectionInfo()
+	if err != nil {
+		b.log.Error(errors.Wrap(err, "connection info"))
+	}
+
+	b.report.Conn = conn
+
+	var (
+		wg       sync.WaitGroup
+		sendErr  error
+		recvErr  error
+		pongs    = make(chan time.Duration, benchPings)
+		received = make(chan struct{})
+	)
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+
+		sendErr = b.send(pongs, received)
+	}()
+
+	go func() {
+		defer wg.Done()
+
+		recvErr = b.receive(pongs, received)
+	}()
+
+	wg.Wait()
+
+	switch {
+	case sendErr != nil:
+		b.err = errors.Wrap(sendErr, "upload")
+	case recvErr != nil:
+		b.err = errors.Wrap(recvErr, "download")
+	}
+}
+
+// send measures RTT, writes synthetic data for the duration and then a download
+// result of this peer once received is closed.
+func (b *benchmark) send(pongs <-chan time.Duration, received <-chan struct{}) error {
+	if err := b.ping(pongs); err != nil {
+		return errors.Wrap(err, "ping")
+	}
+
+	chunk := make([]byte, benchChunkSize)
+
+	// Random data isn't shrunk by any compression along the way.
+	if _, err := rand.Read(chunk); err != nil {
+		return err
+	}
+
+	chunk[0] = benchMsgData
+
+	deadline := time.Now().Add(b.duration)
+
+	for time.Now().Before(deadline) {
+		if b.peer.BufferedAmount() > benchMaxBuffered {
+			time.Sleep(time.Millisecond)
+
+			continue
+		}
+
+		if _, err := b.peer.Write(chunk); err != nil {
+			return err
+		}
+	}
+
+	if _, err := b.peer.Write([]byte{benchMsgEnd}); err != nil {
+		return err
+	}
+
+	<-received
+
+	payload, err := json.Marshal(b.report.Download)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.peer.Write(append([]byte{benchMsgResult}, payload...))
+
+	return err
+}
+
+func (b *benchmark) ping(pongs <-chan time.Duration) error {
+	var total time.Duration
+
+	for i := 0; i < benchPings; i++ {
+		msg := binary.BigEndian.AppendUint64([]byte{benchMsgPing}, uint64(time.Now().UnixNano()))
+
+		if _, err := b.peer.Write(msg); err != nil {
+			return err
+		}
+
+		select {
+		case rtt := <-pongs:
+			total += rtt
+		case <-time.After(benchPingTimeout):
+			return errors.New("no pong received")
+		}
+	}
+
+	b.report.RTT = total / benchPings
+
+	return nil
+}
+
+// receive answers pings and measures synthetic data until its end, closes
+// received and then reads an upload result measured by the other peer.
+func (b *benchmark) receive(pongs chan<- time.Duration, received chan struct{}) error {
+	defer func() {
+		// The writer is released on failures as well.
+		select {
+		case <-received:
+		default:
+			close(received)
+		}
+	}()
+
+	buf := make([]byte, benchReadSize)
+
+	var (
+		start time.Time
+		total int64
+	)
+
+	for {
+		n, err := b.peer.Read(buf)
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			continue
+		}
+
+		switch msg := buf[:n]; msg[0] {
+		case benchMsgPing:
+			msg[0] = benchMsgPong
+
+			if _, err := b.peer.Write(msg); err != nil {
+				return err
+			}
+		case benchMsgPong:
+			if len(msg) != 9 {
+				return errors.New("malformed pong")
+			}
+
+			sentAt := time.Unix(0, int64(binary.BigEndian.Uint64(msg[1:])))
+			pongs <- time.Since(sentAt)
+		case benchMsgData:
+			if start.IsZero() {
+				start = time.Now()
+			}
+
+			total += int64(n)
+		case benchMsgEnd:
+			b.report.Download = benchResult{
+				ReceivedBytes: total,
+			}
+
+			if !start.IsZero() {
+				b.report.Download.Seconds = time.Since(start).Seconds()
+			}
+
+			close(received)
+		case benchMsgResult:
+			return errors.Wrap(json.Unmarshal(msg[1:], &b.report.Upload), "result")
+		default:
+			return errors.Errorf("unexpected message type: %q", msg[0])
+		}
+	}
+}
+
+func (a *App) setupBench() error {
+	// Peers with static descriptions or a direct transport connect without a
+	// session.
+	if len(a.staticSDP) == 0 && !a.directTransport() {
+		if len(a.sessionUUID) == 0 {
+			return errors.New("--bench requires --uuid")
+		}
+
+		if len(a.apiKey) == 0 && len(a.signalURL) == 0 && len(a.signalS3) == 0 && len(a.signalMQTT) == 0 && len(a.signalRedis) == 0 && !a.mdns {
+			return errors.New("--bench requires --apikey, --signal-url, --signal-s3, --signal-mqtt, --signal-redis or --mdns")
+		}
+	}
+
+	if a.benchDuration <= 0 {
+		return errors.New("--bench-duration should be positive")
+	}
+
+	return a.setupPeer(benchRole)
+}
+
+// runBench connects to the other peer of a session running the benchmark as
+// well and prints achievable throughput of the connection.
+func (a *App) runBench(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	bp, ok := a.peer.(benchPeer)
+	if !ok {
+		a.peer.Close()
+
+		return errors.Errorf("transport %s doesn't support the benchmark", a.transport)
+	}
+
+	b := newBenchmark(bp, a.benchDuration, a.logger)
+
+	if err := a.peer.Dial(); err != nil {
+		a.peer.Close()
+
+		return errors.Wrap(err, "peer connection")
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		a.signal.Listen(ctx)
+	}()
+
+	err := a.waitBench(ctx, b)
+
+	a.peer.Close()
+	cancel()
+
+	return err
+}
+
+func (a *App) waitBench(ctx context.Context, b *benchmark) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-a.peer.Done():
+	case <-b.Done():
+	}
+
+	select {
+	case <-b.Done():
+	default:
+		return errors.New("connection closed before a benchmark finished")
+	}
+
+	report, err := b.Report()
+	if err != nil {
+		return errors.Wrap(err, "bench")
+	}
+
+	// Both peers finish at about the same time, and the one closing a connection
+	// first shouldn't cut off the other one's last message.
+	select {
+	case <-a.peer.Done():
+	case <-time.After(benchFinishTimeout):
+	case <-ctx.Done():
+	}
+
+	printBenchReport(report)
+
+	return nil
+}
+
+func printBenchReport(r benchReport) {
+	const mb = 1 << 20
+
+	fmt.Printf("upload:   %.2f MB/s (%d bytes in %.1fs)\n", r.Upload.throughput()/mb, r.Upload.ReceivedBytes, r.Upload.Seconds)
+	fmt.Printf("download: %.2f MB/s (%d bytes in %.1fs)\n", r.Download.throughput()/mb, r.Download.ReceivedBytes, r.Download.Seconds)
+	fmt.Printf("rtt:      %s\n", r.RTT.Round(time.Microsecond))
+
+	if r.Conn == nil {
+		fmt.Println("pair:     n/a")
+
+		return
+	}
+
+	fmt.Printf("local:    %s\n", r.Conn.LocalCandidate)
+	fmt.Printf("remote:   %s\n", r.Conn.RemoteCandidate)
+}
@@ -0,0 +1,232 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"distributed-backup/pkg/filemanager"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// Commands selecting a mode and a role explicitly instead of inferring them
+// from given options (see: commandOptions), sync selects both roles at once
+// (see: --sync).
+const (
+	commandSend             = "send"
+	commandReceive          = "receive"
+	commandEncryptPasswords = "encrypt-passwords"
+	commandVerify           = "verify"
+	commandSync             = "sync"
+)
+
+// Options of the backup mode grouped by roles taking them. Every option is
+// listed in exactly one group, so that a new one is taken by no command until
+// it's placed in one.
+var (
+	// sessionOptions are taken by both roles of the backup mode.
+	sessionOptions = []string{
+		"uuid", "passfile", "apikey", "auth-secret", "code", "transport", "listen",
+		"connect", "tls-cert", "tls-key", "tls-ca", "dtls-cert", "expected-fingerprint",
+		"signal-url", "signal-token", "signal-s3", "signal-mqtt", "signal-redis", "mdns",
+		"fileio-request-interval", "fileio-request-burst", "fileio-request-timeout",
+		"static-sdp", "static-port", "remote-sdp", "stun", "stun-check-timeout", "turn",
+		"turn-username", "turn-credential", "turn-transport", "turn-only", "proxy",
+		"signal-timeout", "connect-timeout", "idle-timeout", "ice-restart-timeout",
+		"resume-timeout", "reconnect-attempts", "streams", "stream-key", "preserve-meta",
+		"delta", "incremental", "dedup", "announce-size", "cron", "interval",
+		"deadline", "summary-file", "progress", "post-hook", "metrics-addr", "otlp",
+		"statsd",
+	}
+	senderOptions = []string{
+		"zipdir", "srcentry", "serve", "outfile", "max-rate", "bandwidth",
+		"ack-timeout", "archive-format", "modified-retries", "follow-symlinks",
+		"archive-cache", "exclude", "include", "file-rule", "manifest", "recipient",
+		"escrow", "route", "forward", "fallback", "fallback-timeout", "zipcrypto",
+		"fallback-ssh-key", "fallback-host-key", "pre-hook", "watch", "watch-settle",
+		"compression-level", "outer-compression-level", "store-ext",
+		"compress-workers", "replica", "shards", "checkpoint",
+	}
+	receiverOptions = []string{
+		"dstdir", "dsturl", "dst-ssh-key", "dst-host-key", "versions", "retention",
+		"persistent", "daemon", "identity", "storage-key", "extract", "max-size",
+		"pull",
+	}
+	// modeOptions select a mode other than a single role of the backup mode.
+	modeOptions = []string{
+		"encrypt", "password1", "password2", "selftest", "bench", "bench-duration",
+		"rendezvous", "update-feed", "update-key", "sync",
+	}
+	// generalOptions are taken by every command.
+	generalOptions = []string{
+		"config", "log-level", "log-format", "quiet", "verbose", "log-output",
+		"syslog-addr", "log-file", "log-max-size", "log-max-age", "log-max-backups",
+		"passphrase", "passfile-backend", "vault-addr", "vault-token", "vault-role-id",
+		"vault-secret-id", "vault-namespace", "debug-addr", "cpuprofile", "memprofile",
+	}
+)
+
+// commandOptions lists options each command takes along with generalOptions,
+// a command line of a command is parsed with them only (see: commandFlagSet()).
+var commandOptions = map[string][][]string{
+	commandSend:             {sessionOptions, senderOptions},
+	commandReceive:          {sessionOptions, receiverOptions},
+	commandSync:             {sessionOptions, senderOptions, receiverOptions},
+	commandEncryptPasswords: {{"password1", "password2", "passfile"}},
+	commandRestore:          {{"passfile", "dstdir"}},
+	commandList:             {{"passfile"}},
+	commandVerify:           {{"passfile"}},
+	commandCatalog:          {{"dstdir", "uuid"}},
+}
+
+// takesOption tells whether a command of commandOptions takes an option.
+func takesOption(command, name string) bool {
+	if contains(generalOptions, name) {
+		return true
+	}
+
+	for _, names := range commandOptions[command] {
+		if contains(names, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scanCmdline parses a command line args with a flag set of its own to find a
+// command given in it before the command line is parsed with options the
+// command takes. Errors are left to be reported by the latter.
+func scanCmdline(args []string) *pflag.FlagSet {
+	fs := pflag.NewFlagSet("scan", pflag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Usage = func() {}
+
+	(&App{}).registerFlags(fs)
+	fs.Parse(args)
+
+	return fs
+}
+
+// checkCommandOptions makes sure that options given in a command line of fs
+// are ones a command takes, so that it fails with a reason rather than with an
+// unknown option. Options of a config file and environment variables aren't
+// checked, since they may be shared by runs of every command.
+func checkCommandOptions(fs *pflag.FlagSet, command string) error {
+	if _, ok := commandOptions[command]; !ok {
+		return nil
+	}
+
+	var names []string
+
+	fs.Visit(func(f *pflag.Flag) {
+		if !takesOption(command, f.Name) {
+			names = append(names, "--"+f.Name)
+		}
+	})
+
+	if len(names) != 0 {
+		return errors.Errorf("%s command doesn't take %s", command, strings.Join(names, ", "))
+	}
+
+	return nil
+}
+
+// commandFlagSet returns a flag set of options of fs a command of
+// commandOptions takes, which share values with fs and print usage of the
+// command, or fs itself for any other command.
+func commandFlagSet(fs *pflag.FlagSet, command string) *pflag.FlagSet {
+	if _, ok := commandOptions[command]; !ok {
+		return fs
+	}
+
+	taken := pflag.NewFlagSet(command, pflag.ExitOnError)
+
+	fs.VisitAll(func(f *pflag.Flag) {
+		if takesOption(command, f.Name) {
+			taken.AddFlag(f)
+		}
+	})
+
+	taken.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s %s:\n%s", os.Args[0], command, taken.FlagUsages())
+	}
+
+	return taken
+}
+
+// selectCommandMode turns the send, receive, sync and encrypt-passwords commands
+// into modes they select, so that they run as if the mode was inferred from
+// options.
+func (a *App) selectCommandMode() error {
+	switch a.command {
+	case commandSend:
+		if len(a.sourceEntry) == 0 && len(a.serve) == 0 {
+			return errors.New("usage: send --srcentry=<file|dir>|--serve=<name>=<path> [options]")
+		}
+	case commandReceive:
+		if len(a.destinationDir) == 0 && len(a.dstURL) == 0 {
+			return errors.New("usage: receive --dstdir=<dir>|--dsturl=<url> [options]")
+		}
+	case commandSync:
+		if len(a.sourceEntry) == 0 || (len(a.destinationDir) == 0 && len(a.dstURL) == 0) {
+			return errors.New("usage: sync --srcentry=<file|dir> --dstdir=<dir>|--dsturl=<url> [options]")
+		}
+
+		a.syncMode = true
+	case commandEncryptPasswords:
+		a.encryptionMode = true
+	default:
+		return nil
+	}
+
+	if len(a.commandArgs) != 0 {
+		return errors.Errorf("%s command takes no arguments", a.command)
+	}
+
+	a.command = ""
+
+	return nil
+}
+
+// runVerify reads zipped directories given as arguments, which are stored by a
+// receiver, with passwords of --passfile, and checks every file of them against
+// its checksum without extracting anything.
+func (a *App) runVerify() error {
+	if len(a.commandArgs) == 0 {
+		return errors.New("usage: verify [--passfile=<file>] <backup>...")
+	}
+
+	password1, password2, err := a.backupPasswords()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range a.commandArgs {
+		files, err := filemanager.List(path, password1, password2)
+		if err != nil {
+			if verificationFailure(err) {
+				return newExitError(exitVerification, errors.Wrap(err, path))
+			}
+
+			return errors.Wrap(err, path)
+		}
+
+		fmt.Printf("%s: %d entries verified\n", path, len(files))
+	}
+
+	return nil
+}
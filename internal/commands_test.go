@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+// TestOptionGroupsCoverEveryOption checks that every option is placed in
+// exactly one group, so that a new one isn't silently taken by commands of
+// both roles.
+func TestOptionGroupsCoverEveryOption(t *testing.T) {
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	(&App{}).registerFlags(fs)
+
+	groups := [][]string{sessionOptions, senderOptions, receiverOptions, modeOptions, generalOptions}
+
+	fs.VisitAll(func(f *pflag.Flag) {
+		n := 0
+
+		for _, names := range groups {
+			if contains(names, f.Name) {
+				n++
+			}
+		}
+
+		if n != 1 {
+			t.Errorf("--%s is listed in %d groups of options", f.Name, n)
+		}
+	})
+
+	for _, names := range groups {
+		for _, name := range names {
+			if fs.Lookup(name) == nil {
+				t.Errorf("--%s is listed but not registered", name)
+			}
+		}
+	}
+}
+
+func TestCommandFlagSet(t *testing.T) {
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	(&App{}).registerFlags(fs)
+
+	for _, tt := range []struct {
+		command        string
+		taken, refused []string
+	}{
+		{commandSend, []string{"srcentry", "uuid", "checkpoint", "log-level"}, []string{"dstdir", "versions", "retention", "persistent", "encrypt"}},
+		{commandReceive, []string{"dstdir", "uuid", "persistent", "quiet"}, []string{"srcentry", "checkpoint", "zipdir", "password1"}},
+		{commandSync, []string{"srcentry", "dstdir"}, []string{"sync", "selftest"}},
+		{commandRestore, []string{"dstdir", "passfile"}, []string{"srcentry", "uuid"}},
+	} {
+		cfs := commandFlagSet(fs, tt.command)
+
+		for _, name := range tt.taken {
+			if cfs.Lookup(name) == nil {
+				t.Errorf("%s command doesn't take --%s", tt.command, name)
+			}
+		}
+
+		for _, name := range tt.refused {
+			if cfs.Lookup(name) != nil {
+				t.Errorf("%s command takes --%s", tt.command, name)
+			}
+		}
+	}
+
+	if commandFlagSet(fs, "") != fs {
+		t.Error("a run without a command doesn't take every option")
+	}
+}
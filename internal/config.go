@@ -0,0 +1,874 @@
+// A config file is a YAML mapping whose keys are long names of CLI options (see:
+// registerFlags()) and values are scalars or, for list options such as "stun",
+// sequences of scalars. Keeping keys identical to CLI options makes every option
+// configurable in a file without maintaining a separate schema.
+//
+// A config file with the ".toml" extension is a flat TOML document instead, which
+// is parsed into the same nodes (see: parseTOML()). A config is loaded with
+// --config, options given in a command line or environment variables take
+// precedence over it.
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"distributed-backup/pkg/envelope"
+	"distributed-backup/pkg/filemanager"
+	"distributed-backup/pkg/pairing"
+	"distributed-backup/pkg/peer"
+	"distributed-backup/pkg/sync"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	configCommandValidate = "validate"
+	configCommandInit     = "init"
+)
+
+type configError struct {
+	Line    int
+	Key     string
+	Message string
+}
+
+func (e *configError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.Key, e.Message)
+	}
+
+	return fmt.Sprintf("line %d: %s: %s", e.Line, e.Key, e.Message)
+}
+
+func (a *App) runConfig() error {
+	if len(a.commandArgs) == 0 {
+		return errors.Errorf("config command required: %s or %s", configCommandValidate, configCommandInit)
+	}
+
+	switch a.commandArgs[0] {
+	case configCommandValidate:
+		if len(a.commandArgs) != 2 {
+			return errors.New("usage: config validate <file>")
+		}
+
+		return a.runConfigValidate(a.commandArgs[1])
+	case configCommandInit:
+		path := ""
+		if len(a.commandArgs) > 1 {
+			path = a.commandArgs[1]
+		}
+
+		return a.runConfigInit(path)
+	default:
+		return errors.Errorf("unknown config command: %s", a.commandArgs[0])
+	}
+}
+
+func (a *App) runConfigValidate(path string) error {
+	errs, err := validateConfig(path)
+	if err != nil {
+		return err
+	}
+
+	for _, err := range errs {
+		fmt.Printf("%s: %s\n", path, err)
+	}
+
+	if len(errs) != 0 {
+		return errors.Errorf("config is invalid: %d error(s)", len(errs))
+	}
+
+	fmt.Printf("%s: config is valid\n", path)
+
+	return nil
+}
+
+// validateConfig returns every error of a config file: unknown, duplicate and
+// malformed options along with missing required values and conflicts of ones
+// which are set, in order of lines they're found at.
+func validateConfig(path string) ([]*configError, error) {
+	doc, err := readConfigFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "config")
+	}
+
+	// Options are applied to a separate instance to leave the current one intact.
+	cfgApp := NewApp()
+	fs := pflag.NewFlagSet("config", pflag.ContinueOnError)
+	cfgApp.registerFlags(fs)
+
+	lines, errs := applyConfig(fs, doc)
+	errs = append(errs, cfgApp.validateOptions(lines)...)
+
+	// Errors of options which aren't in a file (e.g. missing required ones) are
+	// told last.
+	sort.SliceStable(errs, func(i, j int) bool {
+		if errs[i].Line == 0 || errs[j].Line == 0 {
+			return errs[j].Line == 0 && errs[i].Line != 0
+		}
+
+		return errs[i].Line < errs[j].Line
+	})
+
+	return errs, nil
+}
+
+func (a *App) runConfigInit(path string) error {
+	fs := pflag.NewFlagSet("config", pflag.ContinueOnError)
+	NewApp().registerFlags(fs)
+
+	if len(path) == 0 {
+		return writeExampleConfig(os.Stdout, fs)
+	}
+
+	// The config may contain passwords and API keys.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Wrap(err, "config")
+	}
+	defer f.Close()
+
+	return writeExampleConfig(f, fs)
+}
+
+// loadConfig sets flags that have not been set yet from a config file.
+func loadConfig(fs *pflag.FlagSet, path string) error {
+	doc, err := readConfigFile(path)
+	if err != nil {
+		return errors.Wrap(err, "config")
+	}
+
+	if _, errs := applyConfig(fs, doc); len(errs) != 0 {
+		msgs := make([]string, len(errs))
+
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+
+		return errors.Errorf("config %s: %s", path, strings.Join(msgs, "; "))
+	}
+
+	return nil
+}
+
+func readConfigFile(path string) (*yaml.Node, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		return parseTOML(b)
+	}
+
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(b, doc); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// applyConfig sets flags from a parsed config file. Flags that have already been
+// set (e.g. given in a command line) are left as is. It returns lines of keys
+// found in a config to refer to them in further errors.
+func applyConfig(fs *pflag.FlagSet, doc *yaml.Node) (map[string]int, []*configError) {
+	lines := make(map[string]int)
+
+	// An empty file has no content node at all.
+	if len(doc.Content) == 0 {
+		return lines, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return lines, []*configError{{Line: root.Line, Key: "config", Message: "mapping of options expected"}}
+	}
+
+	var errs []*configError
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+
+		if _, ok := lines[key.Value]; ok {
+			errs = append(errs, &configError{Line: key.Line, Key: key.Value, Message: "duplicate option"})
+
+			continue
+		}
+
+		lines[key.Value] = key.Line
+
+		// A config file can't refer to another one.
+		f := fs.Lookup(key.Value)
+		if f == nil || f.Name == "config" {
+			errs = append(errs, &configError{Line: key.Line, Key: key.Value, Message: "unknown option"})
+
+			continue
+		}
+
+		if f.Changed {
+			continue
+		}
+
+		if err := setFlagFromNode(fs, f, value); err != nil {
+			errs = append(errs, &configError{Line: value.Line, Key: key.Value, Message: err.Error()})
+		}
+	}
+
+	return lines, errs
+}
+
+func setFlagFromNode(fs *pflag.FlagSet, f *pflag.Flag, node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return fs.Set(f.Name, node.Value)
+	case yaml.SequenceNode:
+		sv, ok := f.Value.(pflag.SliceValue)
+		if !ok {
+			return errors.New("single value expected")
+		}
+
+		values := make([]string, len(node.Content))
+
+		for i, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return errors.New("list of values expected")
+			}
+
+			values[i] = item.Value
+		}
+
+		if err := sv.Replace(values); err != nil {
+			return err
+		}
+
+		f.Changed = true
+
+		return nil
+	default:
+		return errors.New("value or list of values expected")
+	}
+}
+
+// validateOptions checks options for missing required values and conflicts
+// between each other. Lines of keys in a config file are used in errors where known.
+func (a *App) validateOptions(lines map[string]int) []*configError {
+	var errs []*configError
+
+	add := func(key, format string, args ...any) {
+		errs = append(errs, &configError{Line: lines[key], Key: key, Message: fmt.Sprintf(format, args...)})
+	}
+
+	switch a.passwordStore {
+	case passwordStoreFile, passwordStoreKeyring:
+	case passwordStoreVault:
+		if len(a.vaultAddr) == 0 {
+			add("vault-addr", "required with the vault backend")
+		}
+
+		if len(a.vaultToken) == 0 && (len(a.vaultRoleID) == 0 || len(a.vaultSecretID) == 0) {
+			add("vault-token", "required with the vault backend unless vault-role-id and vault-secret-id are given")
+		}
+	default:
+		add("passfile-backend", "unknown backend %q", a.passwordStore)
+	}
+
+	if a.encryptionMode {
+		if len(a.passwordFile) == 0 {
+			add("passfile", "required in the encryption mode")
+		}
+
+		if len(a.sourceEntry) != 0 {
+			add("srcentry", "conflicts with encrypt")
+		}
+
+		if len(a.destinationDir) != 0 {
+			add("dstdir", "conflicts with encrypt")
+		}
+
+		return errs
+	}
+
+	if len(a.staticSDP) != 0 {
+		if len(a.remoteSDP) == 0 {
+			add("static-sdp", "requires remote-sdp")
+		}
+
+		if a.forward {
+			add("static-sdp", "conflicts with forward: a session is taken from an envelope")
+		}
+	} else if len(a.remoteSDP) != 0 {
+		add("remote-sdp", "requires static-sdp")
+	}
+
+	direct := a.directTransport()
+	known := false
+
+	for _, name := range peer.Transports() {
+		known = known || name == a.transport
+	}
+
+	switch {
+	case !known:
+		add("transport", "unknown transport %q", a.transport)
+	case direct && len(a.listenAddr) != 0 && len(a.connectAddr) != 0:
+		add("listen", "conflicts with connect")
+	case direct && len(a.listenAddr) == 0 && len(a.connectAddr) == 0:
+		add("transport", "requires either listen or connect")
+	case a.transport != peer.TransportWebRTC && len(a.staticSDP) != 0:
+		add("static-sdp", "requires the webrtc transport")
+	case a.transport == peer.TransportWebRTC && len(a.listenAddr)+len(a.connectAddr) != 0:
+		add("transport", "listen and connect require a direct transport")
+	}
+
+	if len(a.dtlsCert) != 0 && a.transport != peer.TransportWebRTC {
+		add("dtls-cert", "requires the webrtc transport")
+	} else if len(a.dtlsCert) != 0 && len(a.staticSDP) != 0 {
+		add("dtls-cert", "conflicts with static-sdp")
+	}
+
+	if len(a.expectedFP) != 0 {
+		if a.transport != peer.TransportWebRTC {
+			add("expected-fingerprint", "requires the webrtc transport")
+		}
+
+		if _, err := peer.ParseFingerprint(a.expectedFP); err != nil {
+			add("expected-fingerprint", "%s", err)
+		}
+	}
+
+	if len(a.tlsCert) != 0 && len(a.tlsKey) == 0 {
+		add("tls-cert", "requires tls-key")
+	} else if len(a.tlsKey) != 0 && len(a.tlsCert) == 0 {
+		add("tls-key", "requires tls-cert")
+	}
+
+	// Peers with static descriptions or a direct transport connect without
+	// signaling.
+	switch {
+	case direct:
+	case a.mdns && len(a.signalURL) != 0:
+		add("mdns", "conflicts with signal-url")
+	case a.mdns && len(a.signalS3) != 0:
+		add("mdns", "conflicts with signal-s3")
+	case a.mdns && len(a.signalMQTT) != 0:
+		add("mdns", "conflicts with signal-mqtt")
+	case a.mdns && len(a.signalRedis) != 0:
+		add("mdns", "conflicts with signal-redis")
+	case a.mdns && len(a.staticSDP) != 0:
+		add("mdns", "conflicts with static-sdp")
+	case a.mdns:
+	case len(a.signalRedis) != 0 && len(a.signalURL) != 0:
+		add("signal-redis", "conflicts with signal-url")
+	case len(a.signalRedis) != 0 && len(a.signalS3) != 0:
+		add("signal-redis", "conflicts with signal-s3")
+	case len(a.signalRedis) != 0 && len(a.signalMQTT) != 0:
+		add("signal-redis", "conflicts with signal-mqtt")
+	case len(a.signalRedis) != 0 && len(a.staticSDP) != 0:
+		add("signal-redis", "conflicts with static-sdp")
+	case len(a.signalRedis) != 0:
+		if u, err := url.Parse(a.signalRedis); err != nil || len(u.Host) == 0 || (u.Scheme != "redis" && u.Scheme != "rediss") {
+			add("signal-redis", "not a valid redis[s]:// URL")
+		}
+	case len(a.signalMQTT) != 0 && len(a.signalURL) != 0:
+		add("signal-mqtt", "conflicts with signal-url")
+	case len(a.signalMQTT) != 0 && len(a.signalS3) != 0:
+		add("signal-mqtt", "conflicts with signal-s3")
+	case len(a.signalMQTT) != 0 && len(a.staticSDP) != 0:
+		add("signal-mqtt", "conflicts with static-sdp")
+	case len(a.signalMQTT) != 0:
+		if u, err := url.Parse(a.signalMQTT); err != nil || len(u.Host) == 0 || (u.Scheme != "mqtt" && u.Scheme != "mqtts" && u.Scheme != "ws" && u.Scheme != "wss") {
+			add("signal-mqtt", "not a valid mqtt[s]:// or ws[s]:// URL")
+		}
+	case len(a.signalS3) != 0 && len(a.signalURL) != 0:
+		add("signal-s3", "conflicts with signal-url")
+	case len(a.signalS3) != 0 && len(a.staticSDP) != 0:
+		add("signal-s3", "conflicts with static-sdp")
+	case len(a.signalS3) != 0:
+		if u, err := url.Parse(a.signalS3); err != nil || len(u.Host) == 0 || (u.Scheme != "s3" && u.Scheme != "s3+http") {
+			add("signal-s3", "not a valid s3:// or s3+http:// URL")
+		}
+	case len(a.signalURL) != 0 && len(a.staticSDP) != 0:
+		add("signal-url", "conflicts with static-sdp")
+	case len(a.signalURL) != 0:
+		if u, err := url.Parse(a.signalURL); err != nil || (u.Scheme != "ws" && u.Scheme != "wss" && u.Scheme != "http" && u.Scheme != "https") {
+			add("signal-url", "not a valid ws[s]:// or http[s]:// URL")
+		}
+	case len(a.apiKey) == 0 && len(a.staticSDP) == 0:
+		add("apikey", "required in the backup mode unless signal-url, signal-s3, signal-mqtt, signal-redis or mdns is given")
+	}
+
+	switch {
+	case len(a.pairingCode) != 0:
+		// A session is derived from a pairing code.
+		if _, err := pairing.ParseCode(a.pairingCode); err != nil {
+			add("code", "%s", err)
+		}
+
+		if len(a.sessionUUID) != 0 {
+			add("uuid", "conflicts with code")
+		}
+
+		if len(a.authSecret) != 0 {
+			add("auth-secret", "conflicts with code")
+		}
+
+		if a.forward {
+			add("forward", "conflicts with code")
+		}
+
+		// A code is good for one session only (see: setupPairing()).
+		if a.persistent {
+			add("persistent", "conflicts with code")
+		}
+
+		if a.daemon {
+			add("daemon", "conflicts with code")
+		}
+
+		if len(a.cron) != 0 || a.interval != 0 || a.watch {
+			add("code", "conflicts with cron, interval and watch")
+		}
+	case a.forward:
+		// A session is taken from a forwarded envelope.
+		if len(a.sessionUUID) != 0 {
+			add("uuid", "conflicts with forward")
+		}
+	case len(a.staticSDP) != 0 || direct:
+		if len(a.sessionUUID) != 0 {
+			if _, err := uuid.Parse(a.sessionUUID); err != nil {
+				add("uuid", "not a valid UUID")
+			}
+		}
+	case len(a.sessionUUID) == 0:
+		add("uuid", "required in the backup mode")
+	default:
+		if _, err := uuid.Parse(a.sessionUUID); err != nil {
+			add("uuid", "not a valid UUID")
+		}
+	}
+
+	receiver := len(a.destinationDir) != 0 || len(a.dstURL) != 0
+
+	switch {
+	case len(a.destinationDir) != 0 && len(a.dstURL) != 0:
+		add("dsturl", "conflicts with dstdir")
+	case len(a.sourceEntry) != 0 && receiver && !a.syncMode:
+		add("dstdir", "conflicts with srcentry: an instance either sends or receives")
+	case len(a.sourceEntry) == 0 && len(a.serve) == 0 && !receiver:
+		add("srcentry", "either srcentry or serve (sender) or dstdir/dsturl (receiver) is required")
+	}
+
+	if a.stunTimeout < 0 {
+		add("stun-check-timeout", "must not be negative")
+	}
+
+	for _, server := range a.turnConfig() {
+		if err := server.Validate(); err != nil {
+			add("turn", "%s", err)
+		}
+	}
+
+	if a.turnOnly && len(a.turnServers) == 0 {
+		add("turn-only", "requires turn")
+	}
+
+	if a.persistent && !receiver {
+		add("persistent", "requires dstdir or dsturl")
+	}
+
+	if a.daemon && !receiver {
+		add("daemon", "requires dstdir or dsturl")
+	}
+
+	if a.daemon && len(a.checkpointFile) != 0 {
+		add("daemon", "conflicts with checkpoint")
+	}
+
+	if a.zipDir {
+		if len(a.sourceEntry) == 0 && len(a.serve) == 0 {
+			add("zipdir", "requires srcentry or serve")
+		}
+
+		if len(a.outputFilename) == 0 && len(a.serve) == 0 {
+			add("outfile", "required with zipdir")
+		}
+	} else if len(a.outputFilename) != 0 {
+		add("outfile", "requires zipdir")
+	}
+
+	if len(a.archiveCache) != 0 {
+		if !a.zipDir {
+			add("archive-cache", "requires zipdir")
+		}
+
+		if a.archiveFormat != filemanager.FormatZip {
+			add("archive-cache", "requires zip archive format")
+		}
+	}
+
+	if a.delta {
+		switch {
+		case receiver && !a.extract:
+			add("delta", "requires extract on a receiver")
+		case len(a.sourceEntry) != 0 && !a.zipDir:
+			add("delta", "requires zipdir on a sender")
+		case a.archiveFormat != filemanager.FormatZip:
+			add("delta", "requires zip archive format")
+		case len(a.archiveCache) != 0:
+			add("delta", "conflicts with archive-cache")
+		case len(a.recipient) != 0:
+			add("delta", "conflicts with recipient")
+		}
+	}
+
+	if a.incremental {
+		switch {
+		case receiver && !a.extract:
+			add("incremental", "requires extract on a receiver")
+		case len(a.sourceEntry) != 0 && !a.zipDir:
+			add("incremental", "requires zipdir on a sender")
+		case a.archiveFormat != filemanager.FormatZip:
+			add("incremental", "requires zip archive format")
+		case len(a.archiveCache) != 0:
+			add("incremental", "conflicts with archive-cache")
+		case len(a.recipient) != 0:
+			add("incremental", "conflicts with recipient")
+		case len(a.sourceEntry) != 0 && len(a.manifest) == 0:
+			add("manifest", "required with incremental on a sender")
+		}
+	} else if len(a.manifest) != 0 {
+		add("manifest", "requires incremental")
+	}
+
+	if a.dedup {
+		switch {
+		case len(a.dstURL) != 0:
+			add("dedup", "requires dstdir on a receiver")
+		case len(a.storageKey) != 0:
+			add("dedup", "conflicts with storage-key")
+		case len(a.sourceEntry) != 0 && !a.zipDir:
+			add("dedup", "requires zipdir on a sender")
+		case a.archiveFormat != filemanager.FormatZip:
+			add("dedup", "conflicts with archive-format")
+		case len(a.archiveCache) != 0:
+			add("dedup", "conflicts with archive-cache")
+		case len(a.recipient) != 0:
+			add("dedup", "conflicts with recipient")
+		case a.delta || a.incremental:
+			add("dedup", "conflicts with delta and incremental")
+		}
+	}
+
+	if len(a.maxSize) != 0 {
+		if !receiver {
+			add("max-size", "requires dstdir or dsturl")
+		} else if _, err := filemanager.ParseSize(a.maxSize); err != nil {
+			add("max-size", "%s", err)
+		}
+	}
+
+	if len(a.preHook) != 0 && len(a.sourceEntry) == 0 {
+		add("pre-hook", "requires srcentry")
+	}
+
+	if len(a.retention) != 0 {
+		switch {
+		case len(a.destinationDir) == 0:
+			add("retention", "requires dstdir")
+		case a.fileVersions != 1:
+			add("retention", "conflicts with versions")
+		}
+
+		if _, err := filemanager.ParseRetention(a.retention); err != nil {
+			add("retention", "%s", err)
+		}
+	}
+
+	if len(a.fileRules) != 0 && !a.zipDir {
+		add("file-rule", "requires zipdir")
+	}
+
+	for _, r := range a.fileRules {
+		if _, err := filemanager.ParseFileRule(r); err != nil {
+			add("file-rule", "%s", err)
+		}
+	}
+
+	for _, o := range []struct {
+		key   string
+		specs []string
+	}{{"exclude", a.exclude}, {"include", a.include}} {
+		if len(o.specs) != 0 && !a.zipDir {
+			add(o.key, "requires zipdir")
+		}
+
+		for _, spec := range o.specs {
+			if _, err := filemanager.ParsePathPattern(spec); err != nil {
+				add(o.key, "%s", err)
+			} else if o.key == "include" && strings.HasPrefix(spec, "!") {
+				add(o.key, "pattern %q can't be negated", spec)
+			}
+		}
+	}
+
+	if a.modRetries < 0 {
+		add("modified-retries", "must not be negative")
+	}
+
+	if len(a.streamKey) != 0 && (a.zipDir || a.forward || a.extract) {
+		add("stream-key", "conflicts with zipdir, forward and extract")
+	}
+
+	if a.resumeTimeout < 0 {
+		add("resume-timeout", "must not be negative")
+	}
+
+	if a.reconnects < 0 {
+		add("reconnect-attempts", "must not be negative")
+	} else if a.reconnects != 0 && a.resumeTimeout == 0 {
+		add("reconnect-attempts", "requires resume-timeout")
+	}
+
+	if a.iceRestart < 0 {
+		add("ice-restart-timeout", "must not be negative")
+	}
+
+	if a.signalTimeout < 0 {
+		add("signal-timeout", "must not be negative")
+	}
+
+	if a.connectTimeout < 0 {
+		add("connect-timeout", "must not be negative")
+	} else if a.connectTimeout != 0 && a.directTransport() {
+		add("connect-timeout", "has no effect with a direct transport, signal-timeout covers connecting")
+	}
+
+	if a.idleTimeout < 0 {
+		add("idle-timeout", "must not be negative")
+	}
+
+	if a.ackTimeout < 0 {
+		add("ack-timeout", "must not be negative")
+	}
+
+	if a.streams < 1 || a.streams > peer.MaxStreams {
+		add("streams", "must be from 1 to %d", peer.MaxStreams)
+	} else if a.streams > 1 && a.resumeTimeout != 0 {
+		add("streams", "conflicts with resume-timeout")
+	} else if a.streams > 1 && a.transport == peer.TransportTCPTLS {
+		add("streams", "not supported by the tcptls transport")
+	}
+
+	if err := a.checkSchedule(); err != nil {
+		key := "cron"
+		if a.watch {
+			key = "watch"
+		} else if len(a.cron) == 0 {
+			key = "interval"
+		}
+
+		add(key, "%s", err)
+	}
+
+	if err := a.checkSync(); err != nil {
+		add("sync", "%s", err)
+	}
+
+	if err := a.checkPull(); err != nil {
+		key := "pull"
+		if len(a.serve) != 0 {
+			key = "serve"
+		}
+
+		add(key, "%s", err)
+	}
+
+	if err := a.checkReplicas(); err != nil {
+		add("replica", "%s", err)
+	}
+
+	if err := a.checkShards(); err != nil {
+		add("shards", "%s", err)
+	}
+
+	for _, r := range a.bandwidthRules {
+		if _, err := sync.ParseBandwidthRule(r); err != nil {
+			add("bandwidth", "%s", err)
+		}
+	}
+
+	if len(a.maxRate) != 0 {
+		if _, err := sync.ParseRate(a.maxRate); err != nil {
+			add("max-rate", "%s", err)
+		}
+	}
+
+	if len(a.recipient) != 0 {
+		if len(a.sourceEntry) == 0 && len(a.serve) == 0 {
+			add("recipient", "requires srcentry or serve")
+		}
+
+		if _, err := envelope.ParseRecipient(a.recipient); err != nil {
+			add("recipient", "%s", err)
+		}
+	}
+
+	if len(a.escrow) != 0 {
+		if !a.zipDir {
+			add("escrow", "requires zipdir")
+		}
+
+		if a.archiveFormat != filemanager.FormatZip {
+			add("escrow", "requires zip archive format")
+		}
+
+		if _, err := envelope.ParseRecipient(a.escrow); err != nil {
+			add("escrow", "%s", err)
+		}
+	}
+
+	if a.level < -1 || a.level > 9 {
+		add("compression-level", "0..9 or -1 expected")
+	}
+
+	if a.outerLevel < -1 || a.outerLevel > 9 {
+		add("outer-compression-level", "0..9 or -1 expected")
+	}
+
+	if a.compressJobs < 0 || a.compressJobs > filemanager.MaxCompressWorkers {
+		add("compress-workers", "0..%d expected", filemanager.MaxCompressWorkers)
+	}
+
+	if a.zipCrypto {
+		if !a.zipDir {
+			add("zipcrypto", "requires zipdir")
+		}
+
+		if a.archiveFormat != filemanager.FormatZip {
+			add("zipcrypto", "requires zip archive format")
+		}
+	}
+
+	if len(a.route) != 0 && len(a.recipient) == 0 {
+		add("route", "requires recipient")
+	}
+
+	for _, hop := range a.route {
+		if _, err := uuid.Parse(hop); err != nil {
+			add("route", "%q is not a valid UUID", hop)
+		}
+	}
+
+	if a.forward {
+		if len(a.sourceEntry) == 0 {
+			add("forward", "requires srcentry")
+		}
+
+		if a.zipDir || len(a.recipient) != 0 {
+			add("forward", "conflicts with zipdir and recipient: an envelope is forwarded as is")
+		}
+	}
+
+	if len(a.identityFile) != 0 && !receiver {
+		add("identity", "requires dstdir or dsturl")
+	}
+
+	if len(a.storageKey) != 0 {
+		if !receiver {
+			add("storage-key", "requires dstdir or dsturl")
+		}
+
+		if a.extract {
+			add("storage-key", "conflicts with extract")
+		}
+
+		if _, err := envelope.ParseRecipient(a.storageKey); err != nil {
+			add("storage-key", "%s", err)
+		}
+	}
+
+	if len(a.fallback) != 0 {
+		if len(a.sourceEntry) == 0 {
+			add("fallback", "requires srcentry")
+		}
+
+		if a.fallbackWait <= 0 {
+			add("fallback-timeout", "must be positive")
+		}
+
+		if u, err := url.Parse(a.fallback); err != nil {
+			add("fallback", "not a valid URL")
+		} else if u.Scheme == "sftp" && len(a.fallbackHost) == 0 {
+			add("fallback-host-key", "required with an SFTP fallback")
+		}
+	}
+
+	if len(a.dstURL) != 0 {
+		if a.extract {
+			add("extract", "conflicts with dsturl: a tree is unpacked into a local directory")
+		}
+
+		if u, err := url.Parse(a.dstURL); err != nil {
+			add("dsturl", "not a valid URL")
+		} else if u.Scheme == "sftp" && len(a.dstHost) == 0 {
+			add("dst-host-key", "required with an SFTP destination")
+		}
+	}
+
+	switch a.archiveFormat {
+	case filemanager.FormatZip:
+	case filemanager.Format7z, filemanager.FormatTarGz, filemanager.FormatTarZst, filemanager.FormatTree:
+		if !a.zipDir {
+			add("archive-format", "%s requires zipdir", a.archiveFormat)
+		}
+
+		// A tree is made by a receiver rather than stored as a file.
+		if a.archiveFormat == filemanager.FormatTree && len(a.fallback) != 0 {
+			add("fallback", "conflicts with tree archive format")
+		}
+	default:
+		add("archive-format", "zip, 7z, tar.gz, tar.zst or tree expected")
+	}
+
+	return errs
+}
+
+// writeExampleConfig writes all options with their defaults commented out.
+func writeExampleConfig(w io.Writer, fs *pflag.FlagSet) error {
+	buf := &bytes.Buffer{}
+
+	buf.WriteString("# Distributed Backup configuration file.\n")
+	buf.WriteString("#\n")
+	buf.WriteString("# Keys are long names of CLI options, lists are YAML sequences. Uncomment\n")
+	buf.WriteString("# options you need.\n")
+
+	fs.VisitAll(func(f *pflag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+
+		value := f.DefValue
+
+		if f.Value.Type() == "string" {
+			value = fmt.Sprintf("%q", value)
+		}
+
+		fmt.Fprintf(buf, "\n# %s\n#%s: %s\n", f.Usage, f.Name, value)
+	})
+
+	_, err := io.Copy(w, buf)
+
+	return err
+}
@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestValidateConfigReportsAllErrors checks that unknown options don't hide
+// missing required values and conflicts of known ones.
+func TestValidateConfigReportsAllErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	config := "encrypt: true\nbogus: 1\nsrcentry: /src\nanother-bogus: x\n"
+
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	errs, err := validateConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+
+	want := []string{
+		"line 2: bogus: unknown option",
+		"line 3: srcentry: conflicts with encrypt",
+		"line 4: another-bogus: unknown option",
+		"passfile: required in the encryption mode",
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("validateConfig() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"time"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/metrics"
+
+	"github.com/pkg/errors"
+)
+
+// startProfiling starts a debug HTTP server and a CPU profile if requested. The
+// returned function stops both and writes a heap profile if requested.
+func (a *App) startProfiling() (func(), error) {
+	var stops []func()
+
+	stop := func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+	}
+
+	if len(a.debugAddr) != 0 {
+		stopServer, err := a.startDebugServer()
+		if err != nil {
+			return nil, errors.Wrap(err, "debug server")
+		}
+
+		stops = append(stops, stopServer)
+	}
+
+	if len(a.cpuProfile) != 0 {
+		f, err := os.Create(a.cpuProfile)
+		if err != nil {
+			stop()
+
+			return nil, errors.Wrap(err, "CPU profile")
+		}
+
+		if err := runtimepprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			stop()
+
+			return nil, errors.Wrap(err, "CPU profile")
+		}
+
+		stops = append(stops, func() {
+			runtimepprof.StopCPUProfile()
+			f.Close()
+		})
+	}
+
+	if len(a.memProfile) != 0 {
+		stops = append(stops, func() {
+			if err := a.writeHeapProfile(); err != nil {
+				log.Error(errors.Wrap(err, "heap profile"))
+			}
+		})
+	}
+
+	return stop, nil
+}
+
+// startDebugServer exposes pprof profiles at /debug/pprof/, runtime and memory
+// statistics at /debug/vars and recorded application metrics at /debug/metrics.
+func (a *App) startDebugServer() (func(), error) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(metrics.Snapshot()); err != nil {
+			log.Error(err)
+		}
+	})
+
+	// Blocking and lock contention profiles are empty unless sampling is enabled.
+	runtime.SetBlockProfileRate(int(time.Millisecond))
+	runtime.SetMutexProfileFraction(100)
+
+	l, err := net.Listen("tcp", a.debugAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error(errors.Wrap(err, "debug server"))
+		}
+	}()
+
+	log.WithField(log.FieldAddr, l.Addr().String()).Info("debug server is listening")
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Error(errors.Wrap(err, "debug server"))
+		}
+	}, nil
+}
+
+// startMetricsServer exposes recorded application metrics at /metrics in the
+// Prometheus text format.
+func (a *App) startMetricsServer() (func(), error) {
+	mux := http.NewServeMux()
+
+	mux.Handle("/metrics", metrics.PrometheusHandler())
+
+	l, err := net.Listen("tcp", a.metricsAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error(errors.Wrap(err, "metrics server"))
+		}
+	}()
+
+	log.WithField(log.FieldAddr, l.Addr().String()).Info("metrics server is listening")
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Error(errors.Wrap(err, "metrics server"))
+		}
+	}, nil
+}
+
+func (a *App) writeHeapProfile() error {
+	f, err := os.Create(a.memProfile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Up-to-date statistics of allocations.
+	runtime.GC()
+
+	return runtimepprof.WriteHeapProfile(f)
+}
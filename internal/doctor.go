@@ -0,0 +1,283 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"distributed-backup/pkg/filemanager"
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/netcheck"
+	"distributed-backup/pkg/signal"
+
+	"github.com/pkg/errors"
+)
+
+// runDoctor checks building blocks of a connection and a transfer without
+// establishing a connection, and prints a report. It fails if at least one of the
+// checks failed; skipped checks (e.g. no API key given) are not failures.
+func (a *App) runDoctor() error {
+	r := &doctorReport{}
+
+	a.checkSTUN(r)
+	a.checkSignaling(r)
+	a.checkPasswordFile(r)
+	a.checkPaths(r)
+
+	if r.failed != 0 {
+		return errors.Errorf("%d check(s) failed", r.failed)
+	}
+
+	return nil
+}
+
+func (a *App) checkSTUN(r *doctorReport) {
+	if len(a.stunServers) == 0 {
+		r.skip("STUN", "no STUN servers configured")
+
+		return
+	}
+
+	natType, results, errs := netcheck.DetectNAT(a.stunServers, 3*time.Second)
+
+	for i, server := range a.stunServers {
+		if errs[i] != nil {
+			r.fail("STUN "+server, errs[i])
+
+			continue
+		}
+
+		r.ok("STUN "+server, "mapped address %s, RTT %s", results[i].MappedAddr, results[i].RTT.Round(time.Millisecond))
+	}
+
+	switch natType {
+	case netcheck.NATTypeUnknown:
+		r.skip("NAT type", "at least two reachable STUN servers are required")
+	case netcheck.NATTypeSymmetric:
+		r.fail("NAT type", errors.Errorf("%s, a direct connection is unlikely", natType))
+	default:
+		r.ok("NAT type", "%s", natType)
+	}
+}
+
+func (a *App) checkSignaling(r *doctorReport) {
+	sessionID := a.sessionUUID
+	if len(sessionID) == 0 {
+		sessionID = a.instanceUUID
+	}
+
+	if len(a.signalURL) != 0 {
+		s, err := newRendezvousSignal(a.webSocketConfig(sessionID))
+		if err == nil {
+			err = s.CheckAuth()
+		}
+
+		if err != nil {
+			r.fail("signaling", err)
+
+			return
+		}
+
+		r.ok("signaling", "rendezvous server accepted a request")
+
+		return
+	}
+
+	if len(a.signalS3) != 0 {
+		s, err := signal.NewS3(a.s3Config(sessionID))
+		if err == nil {
+			err = s.CheckAuth()
+		}
+
+		if err != nil {
+			r.fail("signaling", err)
+
+			return
+		}
+
+		r.ok("signaling", "S3 bucket is listed")
+
+		return
+	}
+
+	if len(a.signalMQTT) != 0 {
+		s, err := signal.NewMQTT(a.mqttConfig(sessionID))
+		if err == nil {
+			err = s.CheckAuth()
+		}
+
+		if err != nil {
+			r.fail("signaling", err)
+
+			return
+		}
+
+		r.ok("signaling", "MQTT broker accepted a connection")
+
+		return
+	}
+
+	if len(a.signalRedis) != 0 {
+		s, err := signal.NewRedis(a.redisConfig(sessionID))
+		if err == nil {
+			err = s.CheckAuth()
+		}
+
+		if err != nil {
+			r.fail("signaling", err)
+
+			return
+		}
+
+		r.ok("signaling", "Redis server answered a ping")
+
+		return
+	}
+
+	if a.mdns {
+		s, err := signal.NewMDNS(a.mdnsConfig(sessionID))
+		if err != nil {
+			r.fail("signaling", err)
+
+			return
+		}
+
+		s.Close()
+
+		r.ok("signaling", "mDNS sockets are opened")
+
+		return
+	}
+
+	if len(a.apiKey) == 0 {
+		r.skip("signaling", "no API key given")
+
+		return
+	}
+
+	s, err := signal.NewFileIo(a.fileIoConfig(sessionID))
+	if err != nil {
+		r.fail("signaling", err)
+
+		return
+	}
+
+	if err := s.CheckAuth(); err != nil {
+		r.fail("signaling", errors.Wrap(err, "FILE.io API key"))
+
+		return
+	}
+
+	r.ok("signaling", "FILE.io API key accepted")
+}
+
+func (a *App) checkPasswordFile(r *doctorReport) {
+	if a.passwordManager == nil {
+		r.skip("password file", "no password file given")
+
+		return
+	}
+
+	if _, _, err := a.passwordManager.GetPasswords(); err != nil {
+		r.fail("password file", err)
+
+		return
+	}
+
+	switch a.passwordStore {
+	case passwordStoreKeyring:
+		r.ok("password file", "%s read from the keyring", a.passwordFile)
+
+		return
+	case passwordStoreVault:
+		r.ok("password file", "%s read from Vault", a.passwordFile)
+
+		return
+	}
+
+	r.ok("password file", "%s decrypted", a.passwordFile)
+}
+
+func (a *App) checkPaths(r *doctorReport) {
+	switch {
+	case len(a.serve) != 0:
+		a.checkSources(r)
+	case len(a.sourceEntry) == 0:
+		r.skip("source entry", "no source entry given")
+	default:
+		err := filemanager.ValidateConfig(filemanager.BackupperConfig{
+			ZipDir:         a.zipDir,
+			SourceEntry:    a.sourceEntry,
+			OutputFilename: a.outputFilename,
+			Format:         a.archiveFormat,
+		})
+		if err != nil {
+			r.fail("source entry", err)
+		} else {
+			r.ok("source entry", "%s", a.sourceEntry)
+		}
+	}
+
+	if len(a.destinationDir) == 0 {
+		r.skip("destination directory", "no destination directory given")
+
+		return
+	}
+
+	err := filemanager.ValidateConfig(filemanager.BackupperConfig{
+		DestinationDir: a.destinationDir,
+	})
+	if err != nil {
+		r.fail("destination directory", err)
+
+		return
+	}
+
+	f, err := os.CreateTemp(a.destinationDir, ".distributed-backup-doctor-*")
+	if err != nil {
+		r.fail("destination directory", errors.Wrap(err, "not writable"))
+
+		return
+	}
+
+	f.Close()
+	os.Remove(f.Name())
+
+	r.ok("destination directory", "%s is writable", a.destinationDir)
+}
+
+// checkSources checks source entries of --serve.
+func (a *App) checkSources(r *doctorReport) {
+	sources, err := parseSources(a.serve)
+	if err == nil {
+		err = filemanager.ValidateConfig(filemanager.BackupperConfig{
+			ZipDir:  a.zipDir,
+			Sources: sources,
+			Format:  a.archiveFormat,
+		})
+	}
+
+	if err != nil {
+		r.fail("served source entries", err)
+	} else {
+		r.ok("served source entries", "%d entries", len(sources))
+	}
+}
+
+type doctorReport struct {
+	failed int
+}
+
+func (r *doctorReport) ok(check, format string, args ...any) {
+	fmt.Printf("[ OK ] %s: %s\n", check, fmt.Sprintf(format, args...))
+}
+
+func (r *doctorReport) fail(check string, err error) {
+	r.failed++
+
+	fmt.Printf("[FAIL] %s: %s\n", check, log.Redact(err.Error()))
+}
+
+func (r *doctorReport) skip(check, reason string) {
+	fmt.Printf("[SKIP] %s: %s\n", check, reason)
+}
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// envPrefix is a prefix of environment variables options can be set with, e.g.
+// DISTRIBUTED_BACKUP_APIKEY for --apikey or DISTRIBUTED_BACKUP_UPDATE_FEED for
+// --update-feed. A variable with the "_FILE" suffix (e.g. DISTRIBUTED_BACKUP_APIKEY_FILE)
+// holds a path to a file an option value is read from, which is the way secrets
+// are usually mounted into containers.
+const envPrefix = "DISTRIBUTED_BACKUP_"
+
+// applyEnv sets flags that have not been given in a command line from
+// environment variables.
+func applyEnv(fs *pflag.FlagSet) error {
+	var err error
+
+	fs.VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed {
+			return
+		}
+
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+
+		value, ok := os.LookupEnv(name)
+
+		if path, fileOK := os.LookupEnv(name + "_FILE"); fileOK && !ok {
+			b, readErr := os.ReadFile(path)
+			if readErr != nil {
+				err = errors.Wrap(readErr, name+"_FILE")
+
+				return
+			}
+
+			// Secret files usually end with a newline.
+			value, ok = strings.TrimRight(string(b), "\r\n"), true
+		}
+
+		if !ok {
+			return
+		}
+
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = errors.Wrap(setErr, name)
+		}
+	})
+
+	return err
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"distributed-backup/pkg/crypto"
+	"distributed-backup/pkg/delta"
+	"distributed-backup/pkg/filemanager"
+
+	"github.com/TelenLiu/go-zip"
+	"github.com/pkg/errors"
+)
+
+// Exit codes a failed run ends with, so that a supervisor (e.g. a CronJob or
+// a wrapper script) can tell why it has failed without parsing logs. Any other
+// failure ends with exitFailure, and invalid command line options end with 2.
+const (
+	exitFailure = 1
+	// exitSignaling means that signaling has failed to be set up.
+	exitSignaling = 3
+	// exitConnection means that a connection to the other peer has failed, or
+	// has been lost before a transfer finished.
+	exitConnection = 4
+	// exitTransfer means that a transfer has failed (e.g. the other peer has
+	// aborted it, or a file can't be read or written).
+	exitTransfer = 5
+	// exitVerification means that received or stored data has failed to be
+	// verified against its checksum or digest.
+	exitVerification = 6
+	// exitSignalTimeout means that the other peer hasn't turned up in signaling
+	// in time (see: --signal-timeout).
+	exitSignalTimeout = 10
+	// exitConnectTimeout means that a connection to the other peer hasn't been
+	// established in time (see: --connect-timeout).
+	exitConnectTimeout = 11
+	// exitIdleTimeout means that an established connection has been idle for
+	// too long (see: --idle-timeout).
+	exitIdleTimeout = 12
+)
+
+// exitError is an error a run ends with a specific exit code for.
+type exitError struct {
+	code int
+	err  error
+}
+
+func newExitError(code int, err error) error {
+	return &exitError{code: code, err: err}
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+func (e *exitError) Cause() error {
+	return e.err
+}
+
+// ExitCode returns an exit code of a run which has failed with err.
+func ExitCode(err error) int {
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+
+	return exitFailure
+}
+
+// signalingError returns err signaling has failed to be set up with.
+func signalingError(err error) error {
+	return newExitError(exitSignaling, errors.Wrap(err, "signaling"))
+}
+
+// transferError returns err a transfer has failed with, telling a lost
+// connection and a verification failure apart from other failures.
+func transferError(err error) error {
+	switch {
+	case errors.Is(err, filemanager.ErrConnectionLost):
+		return newExitError(exitConnection, err)
+	case verificationFailure(err):
+		return newExitError(exitVerification, err)
+	}
+
+	return newExitError(exitTransfer, err)
+}
+
+// verificationFailure tells whether err means that data has failed to be
+// verified, rather than to be transferred or read.
+func verificationFailure(err error) bool {
+	for _, target := range []error{
+		filemanager.ErrCorruptedChunk,
+		filemanager.ErrDigestMismatch,
+		crypto.ErrStreamCorrupted,
+		delta.ErrMismatch,
+		zip.ErrChecksum,
+		zip.ErrAuthentication,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+// Kinds of hooks told to a hook command in envHook.
+const (
+	hookPre  = "pre"
+	hookPost = "post"
+)
+
+// Environment variables a hook command is run with along with the environment of
+// this process.
+const (
+	envHook      = envPrefix + "HOOK"
+	envRole      = envPrefix + "ROLE"
+	envSessionID = envPrefix + "SESSION_ID"
+	envStatus    = envPrefix + "STATUS"
+	envFilename  = envPrefix + "FILENAME"
+	envError     = envPrefix + "ERROR"
+)
+
+// runHookedSession runs a session between --pre-hook and --post-hook. A session
+// isn't run if the pre-hook fails, e.g. since a database dump or a snapshot
+// a source entry is made of is missing, and the post-hook is run anyway with a
+// status of a session, so that it can clean up after the pre-hook or notify of
+// a failure.
+func (a *App) runHookedSession(ctx context.Context) error {
+	var err error
+
+	if len(a.preHook) != 0 {
+		err = a.runHook(ctx, hookPre, a.preHook, nil)
+	}
+
+	if err == nil {
+		err = a.runReplicatedSession(ctx)
+	}
+
+	if len(a.postHook) == 0 {
+		return err
+	}
+
+	r := a.fileManager.Result()
+
+	status, statusErr := a.runStatus(ctx, err, &r)
+
+	env := []string{envStatus + "=" + status, envFilename + "=" + r.Filename}
+	if statusErr != nil {
+		env = append(env, envError+"="+log.Redact(statusErr.Error()))
+	}
+
+	// The post-hook cleans up after an interrupted or timed out session as well.
+	if hookErr := a.runHook(context.Background(), hookPost, a.postHook, env); hookErr != nil {
+		a.logger.Error(hookErr)
+	}
+
+	return err
+}
+
+// runHook runs a hook command with the shell of the platform, output of which is
+// logged at the debug level. An error of a failed command ends with the last line
+// of its output, which usually tells why it has failed.
+func (a *App) runHook(ctx context.Context, kind, command string, env []string) error {
+	name, arg := "sh", "-c"
+	if runtime.GOOS == "windows" {
+		name, arg = "cmd", "/C"
+	}
+
+	cmd := exec.CommandContext(ctx, name, arg, command)
+	cmd.Env = append(os.Environ(), envHook+"="+kind, envRole+"="+a.role(), envSessionID+"="+a.sessionUUID)
+	cmd.Env = append(cmd.Env, env...)
+
+	logger := a.logger.WithField(log.FieldHook, kind)
+	logger.Info("running hook")
+
+	out, err := cmd.CombinedOutput()
+
+	var last string
+
+	for s := bufio.NewScanner(bytes.NewReader(out)); s.Scan(); {
+		if line := strings.TrimSpace(s.Text()); len(line) != 0 {
+			logger.Debug(line)
+			last = line
+		}
+	}
+
+	switch {
+	case err == nil:
+		return nil
+	case len(last) != 0:
+		return errors.Errorf("%s-hook: %s: %s", kind, err, last)
+	default:
+		return errors.Wrap(err, kind+"-hook")
+	}
+}
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"fmt"
+
+	"distributed-backup/pkg/signal"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/skip2/go-qrcode"
+)
+
+// runNewSession generates a session UUID and prints it together with a QR code
+// to pass it to another machine. If requested, it also pre-creates a signaling
+// rendezvous so that whichever peer is run first makes an offer and a strict
+// order of running a receiver and a sender is no longer required.
+func (a *App) runNewSession() error {
+	sessionUUID := uuid.New().String()
+
+	qr, err := qrcode.New(sessionUUID, qrcode.Medium)
+	if err != nil {
+		return errors.Wrap(err, "QR code")
+	}
+
+	fmt.Printf("Session UUID: %s\n\n", sessionUUID)
+	fmt.Print(qr.ToSmallString(false))
+	fmt.Printf("\nRun both peers with: -u=%s\n", sessionUUID)
+
+	if !a.rendezvous {
+		return nil
+	}
+
+	// A rendezvous server pairs peers whichever of them connects first.
+	if len(a.signalURL) != 0 {
+		fmt.Println("No signaling rendezvous is needed with a rendezvous server, run peers in any order")
+
+		return nil
+	}
+
+	// A ping is retained by a broker until the other peer takes it.
+	if len(a.signalMQTT) != 0 {
+		fmt.Println("No signaling rendezvous is needed with an MQTT broker, run peers in any order")
+
+		return nil
+	}
+
+	// A ping is kept by a server for 10 minutes, as a FILE.io file.
+	if len(a.signalRedis) != 0 {
+		fmt.Println("No signaling rendezvous is needed with a Redis server, run peers in any order within 10 minutes")
+
+		return nil
+	}
+
+	// A peer waiting on the local network answers queries of the other one.
+	if a.mdns {
+		fmt.Println("No signaling rendezvous is needed with mDNS, run peers in any order")
+
+		return nil
+	}
+
+	// A ping is kept in a bucket until the other peer removes it, while FILE.io
+	// expires files in 10 minutes.
+	var (
+		s      interface{ Ping() error }
+		within = " within 10 minutes"
+	)
+
+	if len(a.signalS3) != 0 {
+		s, err = signal.NewS3(a.s3Config(sessionUUID))
+		within = ""
+	} else {
+		s, err = signal.NewFileIo(a.fileIoConfig(sessionUUID))
+	}
+
+	if err != nil {
+		return signalingError(err)
+	}
+
+	// An initial ping is uploaded if no one has pinged a fresh session yet,
+	// which is always the case.
+	if err := s.Ping(); err != nil && !errors.Is(err, signal.ErrNoCandidatesFound) {
+		return signalingError(err)
+	}
+
+	fmt.Printf("Signaling rendezvous is created, run both peers%s\n", within)
+
+	return nil
+}
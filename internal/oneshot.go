@@ -0,0 +1,376 @@
+package internal
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"distributed-backup/pkg/filemanager"
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+// Statuses of a finished run reported in an exit summary.
+const (
+	statusSuccess          = "success"
+	statusFailure          = "failure"
+	statusInterrupted      = "interrupted"
+	statusDeadlineExceeded = "deadline_exceeded"
+)
+
+// summaryStdout is a name of a summary file which makes a summary printed to
+// the standard output, log entries are written to the standard error then.
+const summaryStdout = "-"
+
+// runSummary is written to a summary file on exit, so that an orchestrator (e.g.
+// a Kubernetes CronJob) can tell results of runs apart without parsing logs.
+type runSummary struct {
+	Status          string    `json:"status"`
+	Error           string    `json:"error,omitempty"`
+	ExitCode        int       `json:"exit_code"`
+	Role            string    `json:"role,omitempty"`
+	SessionID       string    `json:"session_id,omitempty"`
+	InstanceID      string    `json:"instance_id,omitempty"`
+	Phase           string    `json:"phase,omitempty"`
+	Filename        string    `json:"filename,omitempty"`
+	Quarantined     string    `json:"quarantined,omitempty"`
+	Fallback        string    `json:"fallback,omitempty"`
+	SentBytes       int64     `json:"sent_bytes"`
+	ReceivedBytes   int64     `json:"received_bytes"`
+	StartedAt       time.Time `json:"started_at"`
+	FinishedAt      time.Time `json:"finished_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Stats           *runStats `json:"stats,omitempty"`
+	// Replicas are results of receivers of --replica.
+	Replicas []replicaSummary `json:"replicas,omitempty"`
+	// Received is a name of a file received from the other peer of --sync.
+	Received string `json:"received,omitempty"`
+	// SHA256 is a SHA-256 checksum of a transfer stream, which is the same on
+	// both peers of a successful transfer (see: filemanager.Result.Digest).
+	SHA256 string `json:"sha256,omitempty"`
+	// StoredSHA256 is a SHA-256 checksum of a file a receiver has stored.
+	StoredSHA256 string `json:"stored_sha256,omitempty"`
+}
+
+// runStats is feedback on a transfer for tuning of what and how is archived.
+type runStats struct {
+	Files            int64   `json:"files"`
+	SourceBytes      int64   `json:"source_bytes"`
+	ArchiveBytes     int64   `json:"archive_bytes"`
+	CompressionRatio float64 `json:"compression_ratio"`
+	SkippedFiles     int64   `json:"skipped_files"`
+	SkippedBytes     int64   `json:"skipped_bytes"`
+	ModifiedFiles    int64   `json:"modified_files"`
+	DeltaFiles       int64   `json:"delta_files"`
+	DeltaBytes       int64   `json:"delta_bytes"`
+	DedupChunks      int64   `json:"dedup_chunks"`
+	DedupBytes       int64   `json:"dedup_bytes"`
+	// Extensions break source files down by extensions.
+	Extensions map[string]runExtensionStats `json:"extensions,omitempty"`
+	// TransferSeconds is a time since a connection was established, which
+	// effective throughput of sent and received bytes is measured over.
+	TransferSeconds          float64 `json:"transfer_seconds"`
+	ThroughputBytesPerSecond float64 `json:"throughput_bytes_per_second"`
+}
+
+type runExtensionStats struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+func newRunStats(r filemanager.Result, now time.Time) *runStats {
+	s := &runStats{
+		Files:            r.Stats.Files,
+		SourceBytes:      r.Stats.SourceBytes,
+		ArchiveBytes:     r.Stats.ArchiveBytes,
+		CompressionRatio: r.Stats.CompressionRatio(),
+		SkippedFiles:     r.Stats.SkippedFiles,
+		SkippedBytes:     r.Stats.SkippedBytes,
+		ModifiedFiles:    r.Stats.ModifiedFiles,
+		DeltaFiles:       r.Stats.DeltaFiles,
+		DeltaBytes:       r.Stats.DeltaBytes,
+		DedupChunks:      r.Stats.DedupChunks,
+		DedupBytes:       r.Stats.DedupBytes,
+	}
+
+	if len(r.Stats.Extensions) != 0 {
+		s.Extensions = make(map[string]runExtensionStats, len(r.Stats.Extensions))
+
+		for ext, e := range r.Stats.Extensions {
+			s.Extensions[ext] = runExtensionStats{Files: e.Files, Bytes: e.Bytes}
+		}
+	}
+
+	if r.StartedAt.IsZero() {
+		return s
+	}
+
+	finishedAt := r.FinishedAt
+	if finishedAt.IsZero() {
+		finishedAt = now
+	}
+
+	s.TransferSeconds = finishedAt.Sub(r.StartedAt).Seconds()
+
+	if s.TransferSeconds > 0 {
+		s.ThroughputBytesPerSecond = float64(r.SentBytes+r.ReceivedBytes) / s.TransferSeconds
+	}
+
+	return s
+}
+
+// runCheckpoint is persisted when a backup run doesn't succeed (e.g. it's killed
+// by SIGTERM or hits the deadline) and is removed after a successful one. The next
+// run of the same session resumes with the same instance ID, which lets it tell
+// signaling files left by the interrupted run apart and remove them instead of
+// taking them for another peer's ones.
+type runCheckpoint struct {
+	SessionID     string    `json:"session_id"`
+	InstanceID    string    `json:"instance_id"`
+	Role          string    `json:"role"`
+	Status        string    `json:"status"`
+	Phase         string    `json:"phase"`
+	Filename      string    `json:"filename,omitempty"`
+	SentBytes     int64     `json:"sent_bytes"`
+	ReceivedBytes int64     `json:"received_bytes"`
+	Attempts      int       `json:"attempts"`
+	StoppedAt     time.Time `json:"stopped_at"`
+}
+
+// loadCheckpoint resumes an instance ID of an unsuccessful run of the same session.
+func (a *App) loadCheckpoint() error {
+	b, err := os.ReadFile(a.checkpointFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	c := &runCheckpoint{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return err
+	}
+
+	if c.SessionID != a.sessionUUID {
+		log.WithField(log.FieldSessionID, c.SessionID).Info("checkpoint of another session is ignored")
+
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		log.FieldAttempt:   c.Attempts + 1,
+		log.FieldStatus:    c.Status,
+		log.FieldPhase:     c.Phase,
+		log.FieldSentBytes: c.SentBytes,
+		log.FieldRecvBytes: c.ReceivedBytes,
+	}).Info("resuming stopped run")
+
+	a.instanceUUID = c.InstanceID
+	a.checkpoint = c
+
+	return nil
+}
+
+// finishRun determines a status of a run, writes an exit summary and updates
+// a checkpoint if requested. It returns an error a run should end up with.
+func (a *App) finishRun(ctx context.Context, startedAt time.Time, runErr error) error {
+	summary := &runSummary{
+		Status:     statusSuccess,
+		SessionID:  a.sessionUUID,
+		InstanceID: a.instanceUUID,
+		StartedAt:  startedAt,
+		FinishedAt: time.Now(),
+	}
+	summary.DurationSeconds = summary.FinishedAt.Sub(startedAt).Seconds()
+
+	var result *filemanager.Result
+
+	if a.fileManager != nil {
+		r := a.fileManager.Result()
+		result = &r
+
+		summary.Role = r.Role
+		summary.Phase = string(r.Phase)
+		summary.Filename = r.Filename
+		summary.Quarantined = r.Quarantined
+		summary.SHA256 = hex.EncodeToString(r.Digest)
+		summary.StoredSHA256 = hex.EncodeToString(r.StoredDigest)
+
+		if r.Reverse != nil {
+			summary.Received = r.Reverse.Filename
+		}
+
+		if a.fellBack.Load() {
+			summary.Fallback = a.fallbackURL()
+		}
+		summary.SentBytes = r.SentBytes
+		summary.ReceivedBytes = r.ReceivedBytes
+		summary.Stats = newRunStats(r, summary.FinishedAt)
+		summary.Replicas = a.replicaSummaries(ctx)
+	}
+
+	var statusErr error
+
+	summary.Status, statusErr = a.runStatus(ctx, runErr, result)
+
+	// A run fails along with its transfer, so that an exit code tells that it
+	// has (see: ExitCode()).
+	if summary.Status == statusDeadlineExceeded || summary.Status == statusFailure {
+		runErr = statusErr
+	}
+
+	if statusErr != nil {
+		summary.Error = log.Redact(statusErr.Error())
+	}
+
+	if runErr != nil {
+		summary.ExitCode = ExitCode(runErr)
+	}
+
+	if result != nil {
+		a.reportSummary(summary)
+	}
+
+	switch a.summaryFile {
+	case "":
+	case summaryStdout:
+		if err := json.NewEncoder(os.Stdout).Encode(summary); err != nil {
+			log.Error(errors.Wrap(err, "summary"))
+		}
+	default:
+		if err := writeJSONFile(a.summaryFile, summary); err != nil {
+			log.Error(errors.Wrap(err, "summary file"))
+		}
+	}
+
+	if len(a.checkpointFile) != 0 && result != nil {
+		if err := a.updateCheckpoint(summary); err != nil {
+			log.Error(errors.Wrap(err, "checkpoint"))
+		}
+	}
+
+	return runErr
+}
+
+// runStatus tells a status of a run (or a session of it) which has ended with
+// runErr and a transfer result, if any, along with an error it has failed with.
+func (a *App) runStatus(ctx context.Context, runErr error, result *filemanager.Result) (string, error) {
+	switch {
+	case a.interrupted.Load():
+		return statusInterrupted, runErr
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return statusDeadlineExceeded, errors.Errorf("run deadline of %s exceeded", a.deadline)
+	case runErr != nil:
+		return statusFailure, runErr
+	case result != nil && result.Err != nil:
+		return statusFailure, transferError(result.Err)
+	case result != nil && result.Phase != filemanager.PhaseFinished:
+		return statusFailure, newExitError(exitConnection, errors.New("connection closed before a transfer finished"))
+	}
+
+	return statusSuccess, nil
+}
+
+// reportSummary logs a finished backup run, or prints a line on it in the quiet
+// mode where info entries are not logged.
+func (a *App) reportSummary(summary *runSummary) {
+	// A summary printed in JSON takes place of a line.
+	if a.quiet && a.summaryFile == summaryStdout {
+		return
+	}
+
+	if a.quiet {
+		line := summary.Status + ": " + summary.Role
+		if len(summary.Filename) != 0 {
+			line += " " + strconv.Quote(summary.Filename)
+		}
+
+		fmt.Printf("%s, %d bytes sent, %d bytes received in %.1fs, %d files, compression ratio %.2f, %.2f MB/s\n", line,
+			summary.SentBytes, summary.ReceivedBytes, summary.DurationSeconds, summary.Stats.Files,
+			summary.Stats.CompressionRatio, summary.Stats.ThroughputBytesPerSecond/(1<<20))
+
+		return
+	}
+
+	a.logger.WithFields(log.Fields{
+		log.FieldStatus:     summary.Status,
+		log.FieldPhase:      summary.Phase,
+		log.FieldFile:       summary.Filename,
+		log.FieldSentBytes:  summary.SentBytes,
+		log.FieldRecvBytes:  summary.ReceivedBytes,
+		log.FieldDuration:   summary.DurationSeconds,
+		log.FieldFiles:      summary.Stats.Files,
+		log.FieldRatio:      summary.Stats.CompressionRatio,
+		log.FieldThroughput: summary.Stats.ThroughputBytesPerSecond,
+	}).Info("run finished")
+}
+
+func (a *App) updateCheckpoint(summary *runSummary) error {
+	if summary.Status == statusSuccess {
+		err := os.Remove(a.checkpointFile)
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	attempts := 1
+	if a.checkpoint != nil {
+		attempts = a.checkpoint.Attempts + 1
+	}
+
+	return writeJSONFile(a.checkpointFile, &runCheckpoint{
+		SessionID:     summary.SessionID,
+		InstanceID:    summary.InstanceID,
+		Role:          summary.Role,
+		Status:        summary.Status,
+		Phase:         summary.Phase,
+		Filename:      summary.Filename,
+		SentBytes:     summary.SentBytes,
+		ReceivedBytes: summary.ReceivedBytes,
+		Attempts:      attempts,
+		StoppedAt:     summary.FinishedAt,
+	})
+}
+
+// writeJSONFile writes a file atomically so that a reader never sees a partially
+// written one even if the process is killed meanwhile.
+func writeJSONFile(path string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(b, '\n'))
+	if err == nil {
+		err = f.Chmod(0664)
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
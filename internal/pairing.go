@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"fmt"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/pairing"
+
+	"github.com/pkg/errors"
+)
+
+// runNewCode generates a pairing code and prints it to be typed on another
+// machine, which is shorter than a session UUID and authenticates peers too.
+func (a *App) runNewCode() error {
+	code, err := pairing.NewCode()
+	if err != nil {
+		return errors.Wrap(err, "pairing code")
+	}
+
+	fmt.Printf("Pairing code: %s\n", code)
+	fmt.Printf("\nRun both peers with: --code=%s\n", code)
+
+	return nil
+}
+
+// setupPairing takes a session of a pairing code (see: --code), which replaces
+// both a session UUID and an auth secret. A code is good for one session only:
+// its secret part is short, and a peer which keeps taking sessions would let
+// whoever watches signaling guess it one connection at a time.
+func (a *App) setupPairing() error {
+	code, err := pairing.ParseCode(a.pairingCode)
+	if err != nil {
+		return errors.Wrap(err, "--code")
+	}
+
+	if len(a.sessionUUID) != 0 {
+		return errors.New("--uuid conflicts with --code: a session is derived from a code")
+	}
+
+	if len(a.authSecret) != 0 {
+		return errors.New("--auth-secret conflicts with --code: peers are authenticated by a code")
+	}
+
+	if a.forward {
+		return errors.New("--forward conflicts with --code: a session is taken from an envelope")
+	}
+
+	if a.persistent || a.daemon || len(a.cron) != 0 || a.interval != 0 || a.watch {
+		return errors.New("--code conflicts with --persistent, --daemon, --cron, --interval and --watch: a code is good for one session only")
+	}
+
+	a.pairingCode = code
+	a.sessionUUID = pairing.SessionID(code)
+
+	log.AddSecret(code)
+
+	return nil
+}
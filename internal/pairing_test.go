@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"distributed-backup/pkg/pairing"
+)
+
+// TestPairingCodeIsSingleSession checks that a pairing code isn't taken by a
+// peer which would accept a second session with it, since every session gives
+// whoever watches signaling another guess of the code.
+func TestPairingCodeIsSingleSession(t *testing.T) {
+	code, err := pairing.NewCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &App{pairingCode: code}
+
+	if err := a.setupPairing(); err != nil {
+		t.Fatalf("setupPairing() of a single session: %v", err)
+	}
+
+	for name, setup := range map[string]func(a *App){
+		"persistent": func(a *App) { a.persistent = true },
+		"daemon":     func(a *App) { a.daemon = true },
+		"cron":       func(a *App) { a.cron = "@daily" },
+		"interval":   func(a *App) { a.interval = time.Hour },
+		"watch":      func(a *App) { a.watch = true },
+	} {
+		a := &App{pairingCode: code}
+		setup(a)
+
+		if err := a.setupPairing(); err == nil {
+			t.Errorf("setupPairing() with --%s has succeeded", name)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	if err := os.WriteFile(path, []byte("code: "+code+"\ndstdir: /dst\npersistent: true\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	errs, err := validateConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refused := false
+
+	for _, err := range errs {
+		if err.Key == "persistent" && err.Line == 3 {
+			refused = true
+		}
+	}
+
+	if !refused {
+		t.Errorf("validateConfig() of a persistent receiver with a code = %v", errs)
+	}
+}
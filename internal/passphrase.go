@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"distributed-backup/pkg/crypto"
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/passwordmanager"
+
+	"github.com/pkg/errors"
+	"golang.org/x/term"
+)
+
+// Legacy password files are encrypted with a key and an IV built into earlier
+// versions, they're still read but never written.
+var (
+	legacyPasswordKey = []byte("AES-128-key-1234")
+	legacyPasswordIV  = []byte("IV-1234567890123")
+)
+
+// Stores passwords of --passfile are kept in (see: --passfile-backend).
+const (
+	passwordStoreFile    = "file"
+	passwordStoreKeyring = "keyring"
+	passwordStoreVault   = "vault"
+)
+
+func (a *App) setupPasswordManager() (err error) {
+	switch a.passwordStore {
+	case passwordStoreFile:
+	case passwordStoreKeyring:
+		// A keyring protects passwords with a login of a user instead of a
+		// passphrase.
+		keyring, err := passwordmanager.NewKeyring(passwordmanager.KeyringConfig{
+			Account: a.passwordFile,
+		})
+		if err != nil {
+			return errors.Wrap(err, "password manager")
+		}
+
+		a.passwordManager = keyring
+
+		return nil
+	case passwordStoreVault:
+		vault, err := passwordmanager.NewVault(passwordmanager.VaultConfig{
+			Address:   a.vaultAddr,
+			Path:      a.passwordFile,
+			Namespace: a.vaultNamespace,
+			Token:     a.vaultToken,
+			RoleID:    a.vaultRoleID,
+			SecretID:  a.vaultSecretID,
+			Proxy:     a.proxyURL,
+		})
+		if err != nil {
+			return errors.Wrap(err, "password manager")
+		}
+
+		a.passwordManager = vault
+
+		return nil
+	default:
+		return errors.Errorf("unknown passfile backend: %s", a.passwordStore)
+	}
+
+	payload, err := os.ReadFile(a.passwordFile)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "password manager")
+	}
+
+	exists := err == nil
+
+	if exists && !crypto.IsPassphrasePayload(payload) {
+		log.WithField(log.FieldFile, a.passwordFile).
+			Info("password file is encrypted with the legacy built-in key, re-create it with --encrypt to protect it with a passphrase")
+	}
+
+	// A passphrase of a new file is asked twice, since a mistyped one makes
+	// the file useless.
+	passphrase, err := a.masterPassphrase(!exists)
+	if err != nil {
+		return err
+	}
+
+	legacy, err := crypto.NewAesCbc(crypto.AesCbcConfig{
+		Key: legacyPasswordKey,
+		IV:  legacyPasswordIV,
+	})
+	if err != nil {
+		return errors.Wrap(err, "password manager crypto")
+	}
+
+	a.crypto, err = crypto.NewPassphrase(crypto.PassphraseConfig{
+		Passphrase: passphrase,
+		Legacy:     legacy,
+	})
+	if err != nil {
+		return errors.Wrap(err, "password manager crypto")
+	}
+
+	a.passwordManager = passwordmanager.NewLocalSaver(passwordmanager.LocalSaverConfig{
+		PasswordFile: a.passwordFile,
+	}, a.crypto)
+
+	return nil
+}
+
+// passwordsSaved tells whether passwords of --passfile have been saved, so that
+// saved ones aren't replaced and missing ones aren't saved anew with a new
+// passphrase by mistake.
+func (a *App) passwordsSaved() (bool, error) {
+	if a.passwordStore == passwordStoreFile {
+		_, err := os.Stat(a.passwordFile)
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return err == nil, err
+	}
+
+	if err := a.setupPasswordManager(); err != nil {
+		return false, err
+	}
+
+	_, _, err := a.passwordManager.GetPasswords()
+	if errors.Is(err, passwordmanager.ErrNotFound) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// setupTransferKey takes --auth-secret from a password manager which keeps a
+// transfer key (see: passwordmanager.TransferKeyManager) if it's not given, so
+// that peers of a team are authenticated by a key kept along with passwords.
+// A pairing code authenticates peers instead.
+func (a *App) setupTransferKey() error {
+	m, ok := a.passwordManager.(passwordmanager.TransferKeyManager)
+	if !ok || len(a.authSecret) != 0 || len(a.pairingCode) != 0 {
+		return nil
+	}
+
+	key, err := m.TransferKey()
+	if err != nil {
+		return errors.Wrap(err, "password manager")
+	}
+
+	log.AddSecret(key)
+
+	a.authSecret = key
+
+	return nil
+}
+
+// masterPassphrase returns --passphrase, or prompts for it if a terminal is
+// attached.
+func (a *App) masterPassphrase(confirm bool) ([]byte, error) {
+	if len(a.passphrase) != 0 {
+		return []byte(a.passphrase), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+
+	if !term.IsTerminal(fd) {
+		return nil, errors.Errorf("passphrase of %s required (see: --passphrase)", a.passwordFile)
+	}
+
+	fmt.Fprintf(os.Stderr, "Passphrase of %s: ", a.passwordFile)
+
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "passphrase")
+	}
+
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase is empty")
+	}
+
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+
+		repeated, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "passphrase")
+		}
+
+		if !bytes.Equal(passphrase, repeated) {
+			return nil, errors.New("passphrases don't match")
+		}
+	}
+
+	return passphrase, nil
+}
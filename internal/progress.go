@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-backup/pkg/filemanager"
+)
+
+const (
+	progressRefreshInterval = 500 * time.Millisecond
+	progressBarWidth        = 30
+)
+
+// progressBar renders progress of a transfer on a terminal in a single line,
+// which is redrawn below log entries written through it (see: --progress).
+type progressBar struct {
+	out  io.Writer
+	logs io.Writer
+
+	mx   sync.Mutex
+	line string
+}
+
+func newProgressBar(out, logs io.Writer) *progressBar {
+	return &progressBar{
+		out:  out,
+		logs: logs,
+	}
+}
+
+// Write writes a log entry, clearing a bar before and redrawing it after.
+func (b *progressBar) Write(p []byte) (int, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.clear()
+	defer b.draw()
+
+	return b.logs.Write(p)
+}
+
+// run redraws a bar with progress of m until ctx is done or a transfer finishes.
+func (b *progressBar) run(ctx context.Context, m *filemanager.Backupper) {
+	ticker := time.NewTicker(progressRefreshInterval)
+	defer ticker.Stop()
+
+	defer b.set("")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if r := m.Result(); r.Phase == filemanager.PhaseTransferring {
+			b.set(formatProgress(r))
+		}
+	}
+}
+
+func (b *progressBar) set(line string) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.clear()
+	b.line = line
+	b.draw()
+}
+
+func (b *progressBar) clear() {
+	if len(b.line) != 0 {
+		fmt.Fprint(b.out, "\r\033[K")
+	}
+}
+
+func (b *progressBar) draw() {
+	if len(b.line) != 0 {
+		fmt.Fprint(b.out, b.line)
+	}
+}
+
+// formatProgress formats a bar of a sender which knows a size of a source entry,
+// and an amount of transferred data otherwise.
+func formatProgress(r filemanager.Result) string {
+	p := r.Progress
+	transferred := filemanager.FormatBytes(r.SentBytes + r.ReceivedBytes)
+	rate := filemanager.FormatBytes(int64(p.Rate)) + "/s"
+
+	if p.TotalBytes == 0 {
+		return fmt.Sprintf("%s %s, %s", r.Role, transferred, rate)
+	}
+
+	filled := int(float64(progressBarWidth) * p.Percent() / 100)
+	if filled > progressBarWidth {
+		filled = progressBarWidth
+	}
+
+	eta := "--"
+	if p.ETA != 0 {
+		eta = p.ETA.String()
+	}
+
+	return fmt.Sprintf("[%s%s] %5.1f%% %s/%s, %s sent, %s, ETA %s",
+		strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled), p.Percent(),
+		filemanager.FormatBytes(p.Bytes), filemanager.FormatBytes(p.TotalBytes), transferred, rate, eta)
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// checkPull checks options of a sender which serves source entries and of a
+// receiver which pulls one of them (see: --serve, --pull).
+func (a *App) checkPull() error {
+	if len(a.pull) != 0 {
+		switch {
+		case len(a.destinationDir) == 0 && len(a.dstURL) == 0:
+			return errors.New("--pull is supported by a receiver only")
+		case len(a.sourceEntry) != 0 || len(a.serve) != 0:
+			return errors.New("--pull conflicts with --srcentry and --serve")
+		}
+	}
+
+	if len(a.serve) == 0 {
+		return nil
+	}
+
+	switch {
+	case len(a.sourceEntry) != 0:
+		return errors.New("--serve conflicts with --srcentry: a requested source entry is sent")
+	case len(a.destinationDir) != 0 || len(a.dstURL) != 0:
+		return errors.New("--serve is supported by a sender only")
+	case len(a.outputFilename) != 0:
+		return errors.New("--serve conflicts with --outfile: a served directory is sent as ${name}.zip")
+	case a.forward:
+		return errors.New("--serve conflicts with --forward")
+	case len(a.replicaIDs) != 0:
+		return errors.New("--serve conflicts with --replica")
+	case len(a.fallback) != 0:
+		return errors.New("--serve conflicts with --fallback: no source entry is requested")
+	case len(a.checkpointFile) != 0:
+		return errors.New("--serve conflicts with --checkpoint")
+	case a.incremental:
+		return errors.New("--serve conflicts with --incremental")
+	case len(a.cron) != 0 || a.interval != 0 || a.watch:
+		return errors.New("--serve conflicts with --cron, --interval and --watch: a receiver of --pull is scheduled instead")
+	}
+
+	_, err := parseSources(a.serve)
+
+	return errors.Wrap(err, "--serve")
+}
+
+// parseSources returns source entries of --serve by their names.
+func parseSources(entries []string) (map[string]string, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	sources := make(map[string]string, len(entries))
+
+	for _, entry := range entries {
+		name, path, ok := strings.Cut(entry, "=")
+		if !ok || len(name) == 0 || len(path) == 0 {
+			return nil, errors.Errorf("%q: ${name}=${path} is expected", entry)
+		}
+
+		if _, ok := sources[name]; ok {
+			return nil, errors.Errorf("%q: name is given twice", name)
+		}
+
+		sources[name] = path
+	}
+
+	return sources, nil
+}
@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"distributed-backup/pkg/envelope"
+	"distributed-backup/pkg/filemanager"
+
+	"github.com/pkg/errors"
+)
+
+// runNewIdentity generates an identity envelopes are sealed for and saves its
+// private key to --identity, the public one is printed to pass it to senders.
+func (a *App) runNewIdentity() error {
+	if len(a.identityFile) == 0 {
+		return errors.New("--identity required")
+	}
+
+	id, err := envelope.GenerateIdentity()
+	if err != nil {
+		return errors.Wrap(err, "identity")
+	}
+
+	if err := id.Save(a.identityFile); err != nil {
+		return errors.Wrap(err, "identity")
+	}
+
+	fmt.Printf("Identity is saved to %s, keep it secret\n\n", a.identityFile)
+	fmt.Printf("Recipient: %s\n", id.Recipient())
+	fmt.Printf("\nSend backups to it with: --recipient=%s\n", id.Recipient())
+
+	return nil
+}
+
+// setupForward takes a session of the next hop of a stored envelope (see:
+// --forward), which is the session a forwarding sender joins.
+func (a *App) setupForward() error {
+	if len(a.sessionUUID) != 0 {
+		return errors.New("--uuid conflicts with --forward: a session is taken from an envelope")
+	}
+
+	f, err := os.Open(a.sourceEntry)
+	if err != nil {
+		return errors.Wrap(err, "envelope")
+	}
+	defer f.Close()
+
+	h, err := envelope.ReadHeader(bufio.NewReader(f))
+	if err != nil {
+		return errors.Wrap(err, a.sourceEntry)
+	}
+
+	a.sessionUUID = h.NextHop()
+	if len(a.sessionUUID) == 0 {
+		return errors.Errorf("%s: envelope has already reached its recipient", a.sourceEntry)
+	}
+
+	return nil
+}
+
+// envelopeOptions sets options of sealing sent files, opening received envelopes
+// and re-encrypting stored files to a config of the file manager.
+func (a *App) envelopeOptions(cfg *filemanager.BackupperConfig) error {
+	cfg.Forward = a.forward
+	cfg.Route = a.route
+
+	if len(a.recipient) != 0 {
+		recipient, err := envelope.ParseRecipient(a.recipient)
+		if err != nil {
+			return errors.Wrap(err, "--recipient")
+		}
+
+		cfg.Recipient = recipient
+	}
+
+	if len(a.escrow) != 0 {
+		key, err := envelope.ParseRecipient(a.escrow)
+		if err != nil {
+			return errors.Wrap(err, "--escrow")
+		}
+
+		cfg.Escrow = key
+	}
+
+	if len(a.storageKey) != 0 {
+		key, err := envelope.ParseRecipient(a.storageKey)
+		if err != nil {
+			return errors.Wrap(err, "--storage-key")
+		}
+
+		cfg.StorageKey = key
+	}
+
+	if len(a.identityFile) != 0 {
+		id, err := envelope.LoadIdentity(a.identityFile)
+		if err != nil {
+			return errors.Wrap(err, "--identity")
+		}
+
+		cfg.Identity = id
+	}
+
+	return nil
+}
+
+// finishForward removes a forwarded envelope once it's delivered to the next hop,
+// it's kept to be forwarded again otherwise.
+func (a *App) finishForward() {
+	r := a.fileManager.Result()
+	if r.Err != nil || r.Phase != filemanager.PhaseFinished {
+		return
+	}
+
+	if err := os.Remove(a.sourceEntry); err != nil {
+		a.logger.Error(errors.Wrap(err, "forwarded envelope"))
+	}
+}
+
+// runUnseal decrypts files stored re-encrypted by a receiver (see: --storage-key)
+// given as arguments with --identity into --dstdir.
+func (a *App) runUnseal() error {
+	if len(a.identityFile) == 0 || len(a.destinationDir) == 0 || len(a.commandArgs) == 0 {
+		return errors.New("usage: unseal --identity=<file> --dstdir=<dir> <file>...")
+	}
+
+	id, err := envelope.LoadIdentity(a.identityFile)
+	if err != nil {
+		return errors.Wrap(err, "--identity")
+	}
+
+	for _, path := range a.commandArgs {
+		target, err := filemanager.Unseal(path, id, a.destinationDir)
+		if err != nil {
+			return errors.Wrap(err, path)
+		}
+
+		fmt.Printf("%s -> %s\n", path, target)
+	}
+
+	return nil
+}
+
+// runDecrypt decrypts files given as arguments, which are stored by a receiver
+// of a sender with --stream-key, into --dstdir.
+func (a *App) runDecrypt() error {
+	if len(a.streamKey) == 0 || len(a.destinationDir) == 0 || len(a.commandArgs) == 0 {
+		return errors.New("usage: decrypt --stream-key=<key> --dstdir=<dir> <file>...")
+	}
+
+	for _, path := range a.commandArgs {
+		target, err := filemanager.DecryptStream(path, a.streamKey, a.destinationDir)
+		if err != nil {
+			return errors.Wrap(err, path)
+		}
+
+		fmt.Printf("%s -> %s\n", path, target)
+	}
+
+	return nil
+}
+
+// runRecoverKey opens passwords of a backup given as an argument, which are
+// sealed for an escrow identity (see: --escrow), with --identity. Passwords are
+// saved to --passfile if it's given and doesn't exist, or printed otherwise.
+func (a *App) runRecoverKey() error {
+	if len(a.identityFile) == 0 || len(a.commandArgs) != 1 {
+		return errors.New("usage: recover-key --identity=<file> [--passfile=<file>] <backup>")
+	}
+
+	id, err := envelope.LoadIdentity(a.identityFile)
+	if err != nil {
+		return errors.Wrap(err, "--identity")
+	}
+
+	password1, password2, err := filemanager.RecoverKey(a.commandArgs[0], id)
+	if err != nil {
+		return errors.Wrap(err, a.commandArgs[0])
+	}
+
+	if len(a.passwordFile) == 0 {
+		fmt.Printf("First-level password: %s\n", password1)
+		fmt.Printf("Second-level password: %s\n", password2)
+
+		return nil
+	}
+
+	// A password file of other backups must not be replaced by mistake.
+	saved, err := a.passwordsSaved()
+	if err != nil {
+		return errors.Wrap(err, "--passfile")
+	}
+
+	if saved {
+		return errors.Errorf("%s already exists", a.passwordFile)
+	}
+
+	if err := a.setupPasswordManager(); err != nil {
+		return err
+	}
+
+	if err := a.passwordManager.SavePasswords(password1, password2); err != nil {
+		return errors.Wrap(err, "password manager")
+	}
+
+	fmt.Printf("Passwords are saved to %s\n", a.passwordFile)
+
+	return nil
+}
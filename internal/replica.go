@@ -0,0 +1,259 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// checkReplicas checks options of a sender which sends a backup to receivers of
+// other sessions as well (see: --replica).
+func (a *App) checkReplicas() error {
+	if len(a.replicaIDs) == 0 {
+		return nil
+	}
+
+	switch {
+	case len(a.sourceEntry) == 0:
+		return errors.New("--replica is supported by a sender only")
+	case a.forward:
+		return errors.New("--replica conflicts with --forward")
+	case len(a.pairingCode) != 0:
+		return errors.New("--replica conflicts with --code: a code pairs a single receiver")
+	case len(a.staticSDP) != 0 || a.directTransport():
+		return errors.New("--replica requires a signaling: receivers are told apart by sessions")
+	case len(a.fallback) != 0:
+		return errors.New("--replica conflicts with --fallback")
+	case len(a.checkpointFile) != 0:
+		return errors.New("--replica conflicts with --checkpoint")
+	case len(a.archiveCache) != 0:
+		return errors.New("--replica conflicts with --archive-cache")
+	case a.incremental:
+		return errors.New("--replica conflicts with --incremental: each receiver has a version of its own")
+	}
+
+	seen := map[string]bool{a.sessionUUID: true}
+
+	for _, id := range a.replicaIDs {
+		if len(id) == 0 || seen[id] {
+			return errors.Errorf("--replica: session %q is empty or given twice", id)
+		}
+
+		seen[id] = true
+	}
+
+	return nil
+}
+
+// checkShards checks a number of data shards of --shards, which are sent to
+// receivers of --uuid and --replica.
+func (a *App) checkShards() error {
+	if a.shards == 0 {
+		return nil
+	}
+
+	n := 1 + len(a.replicaIDs)
+
+	switch {
+	case len(a.replicaIDs) == 0:
+		return errors.New("--shards requires --replica: shards are sent to receivers of several sessions")
+	case a.shards < 1 || a.shards >= n:
+		return errors.Errorf("--shards=%d: 1 to %d data shards of %d receivers are expected", a.shards, n-1, n)
+	}
+
+	return nil
+}
+
+// setupReplicas sets up sessions of receivers of --replica, each one along with
+// a file manager of its own, which archives a backup for its receiver. Replicas
+// are made once and set up again for every run of a repeated sender.
+func (a *App) setupReplicas() error {
+	if len(a.replicaIDs) == 0 {
+		return nil
+	}
+
+	if err := a.checkReplicas(); err != nil {
+		return err
+	}
+
+	again := a.replicas != nil
+
+	if !again {
+		for _, id := range a.replicaIDs {
+			r, err := a.newReplica(id)
+			if err != nil {
+				return errors.Wrap(err, "--replica")
+			}
+
+			a.replicas = append(a.replicas, r)
+		}
+	}
+
+	for i, r := range a.replicas {
+		r.shardSet = a.shardSet
+		r.shardIndex = i + 1
+
+		if err := r.setupBackupMode(); err != nil {
+			return errors.Wrapf(err, "replica %s", r.sessionUUID)
+		}
+
+		// Signaling messages of the previous run would confuse negotiation
+		// otherwise.
+		if again {
+			if err := r.signal.CleanUpInstance(); err != nil {
+				r.logger.Error(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// newReplica returns an app which sends the same source entry as a does with
+// the same options to a receiver of a session sessionID. Options are copied
+// from a command line, which holds ones of a config file and the environment
+// as well (see: parseCmdline()), and state a has set up is shared.
+func (a *App) newReplica(sessionID string) (*App, error) {
+	r := NewApp()
+
+	fs := pflag.NewFlagSet(sessionID, pflag.ContinueOnError)
+	r.registerFlags(fs)
+
+	var err error
+
+	pflag.CommandLine.VisitAll(func(f *pflag.Flag) {
+		if err != nil || !f.Changed {
+			return
+		}
+
+		if v, ok := f.Value.(pflag.SliceValue); ok {
+			err = fs.Lookup(f.Name).Value.(pflag.SliceValue).Replace(v.GetSlice())
+		} else {
+			err = fs.Set(f.Name, f.Value.String())
+		}
+
+		err = errors.Wrap(err, f.Name)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.sessionUUID = sessionID
+	r.replicaIDs = nil
+	r.shards = 0
+	r.stunServers = a.stunServers
+	r.natType = a.natType
+	r.proxyURL = a.proxyURL
+	r.passwordManager = a.passwordManager
+	r.crypto = a.crypto
+
+	return r, nil
+}
+
+// runReplicatedSession runs a session along with sessions of replicas at once,
+// once shards of --shards are prepared. It fails unless every receiver has stored
+// a backup (or a shard of it).
+func (a *App) runReplicatedSession(ctx context.Context) error {
+	if len(a.replicas) == 0 {
+		return a.runSession(ctx)
+	}
+
+	if a.shardSet != nil {
+		defer a.shardSet.Remove()
+
+		if err := a.fileManager.PrepareShards(ctx); err != nil {
+			return err
+		}
+	}
+
+	errs := make([]error, len(a.replicas))
+
+	var wg sync.WaitGroup
+
+	for i, r := range a.replicas {
+		wg.Add(1)
+		go func(i int, r *App) {
+			defer wg.Done()
+
+			errs[i] = r.runSession(ctx)
+		}(i, r)
+	}
+
+	err := a.runSession(ctx)
+
+	wg.Wait()
+
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+
+	for i, r := range a.replicas {
+		result := r.fileManager.Result()
+
+		status, err := a.runStatus(ctx, errs[i], &result)
+		if status == statusSuccess {
+			continue
+		}
+
+		if err == nil {
+			err = errors.New(status)
+		}
+
+		failed = append(failed, r.sessionUUID+": "+err.Error())
+	}
+
+	if len(failed) != 0 {
+		return errors.Errorf("%d of %d replicas failed: %s", len(failed), len(a.replicas), strings.Join(failed, "; "))
+	}
+
+	return nil
+}
+
+// replicaSummaries returns results of replicas for an exit summary.
+func (a *App) replicaSummaries(ctx context.Context) []replicaSummary {
+	var summaries []replicaSummary
+
+	for _, r := range a.replicas {
+		if r.fileManager == nil {
+			continue
+		}
+
+		result := r.fileManager.Result()
+
+		s := replicaSummary{
+			SessionID:  r.sessionUUID,
+			InstanceID: r.instanceUUID,
+			Phase:      string(result.Phase),
+			SentBytes:  result.SentBytes,
+		}
+
+		var err error
+
+		s.Status, err = a.runStatus(ctx, nil, &result)
+		if err != nil {
+			s.Error = log.Redact(err.Error())
+		}
+
+		summaries = append(summaries, s)
+	}
+
+	return summaries
+}
+
+// replicaSummary is a result of a replica in an exit summary.
+type replicaSummary struct {
+	SessionID  string `json:"session_id"`
+	InstanceID string `json:"instance_id"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	Phase      string `json:"phase,omitempty"`
+	SentBytes  int64  `json:"sent_bytes"`
+}
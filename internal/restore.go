@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"distributed-backup/pkg/filemanager"
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+// runRestore extracts both levels of zipped directories given as arguments,
+// which are stored by a receiver, with passwords of --passfile into --dstdir.
+// Deduplicated backups are restored without passwords. Shards of a backup are
+// joined into it in --dstdir first, which is then extracted if it's a zipped
+// directory.
+func (a *App) runRestore() error {
+	if len(a.destinationDir) == 0 || len(a.commandArgs) == 0 {
+		return errors.New("usage: restore [--passfile=<file>] --dstdir=<dir> <backup>...")
+	}
+
+	backups, err := a.joinShards()
+	if err != nil {
+		return err
+	}
+
+	if len(backups) == 0 {
+		return nil
+	}
+
+	password1, password2, err := a.backupPasswords()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range backups {
+		target, err := filemanager.Restore(path, password1, password2, a.destinationDir, a.logger)
+		if err != nil {
+			return errors.Wrap(err, path)
+		}
+
+		fmt.Printf("%s -> %s\n", path, target)
+	}
+
+	return nil
+}
+
+// joinShards joins shards given as arguments into a backup in --dstdir, and
+// returns the rest of arguments along with a joined zipped directory, which are
+// to be extracted.
+func (a *App) joinShards() ([]string, error) {
+	var backups, shards []string
+
+	for _, path := range a.commandArgs {
+		shard, err := filemanager.IsShard(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if shard {
+			shards = append(shards, path)
+		} else {
+			backups = append(backups, path)
+		}
+	}
+
+	if len(shards) == 0 {
+		return backups, nil
+	}
+
+	joined, err := filemanager.JoinShards(shards, a.destinationDir, a.logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "shards")
+	}
+
+	fmt.Printf("%d shards -> %s\n", len(shards), joined)
+
+	if strings.HasSuffix(joined, ".zip") {
+		backups = append(backups, joined)
+	}
+
+	return backups, nil
+}
+
+// runList prints files of zipped directories given as arguments, which are
+// stored by a receiver, with their modes, sizes and modification times. Both
+// levels are read with passwords of --passfile, but nothing is extracted.
+func (a *App) runList() error {
+	if len(a.commandArgs) == 0 {
+		return errors.New("usage: list [--passfile=<file>] <backup>...")
+	}
+
+	password1, password2, err := a.backupPasswords()
+	if err != nil {
+		return err
+	}
+
+	for i, path := range a.commandArgs {
+		files, err := filemanager.List(path, password1, password2)
+		if err != nil {
+			return errors.Wrap(err, path)
+		}
+
+		if i != 0 {
+			fmt.Println()
+		}
+
+		fmt.Printf("%s:\n", path)
+
+		var (
+			count int
+			total int64
+		)
+
+		for _, f := range files {
+			name := f.Name
+			if len(f.Link) != 0 {
+				name += " -> " + f.Link
+			}
+
+			fmt.Printf("%s %12d %s %s\n", f.Mode, f.Size, f.ModTime.Local().Format("2006-01-02 15:04:05"), name)
+
+			if f.Mode.IsRegular() {
+				count++
+				total += f.Size
+			}
+		}
+
+		fmt.Printf("%d files, %s\n", count, filemanager.FormatBytes(total))
+	}
+
+	return nil
+}
+
+// runCatalog prints backups a receiver has recorded in a catalog of --dstdir,
+// only ones of --uuid and names matching patterns given as arguments if they're
+// given, followed by a number of them and their total size.
+func (a *App) runCatalog() error {
+	if len(a.destinationDir) == 0 {
+		return errors.New("usage: catalog --dstdir=<dir> [--uuid=<session>] [<pattern>...]")
+	}
+
+	for _, pattern := range a.commandArgs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrap(err, pattern)
+		}
+	}
+
+	records, err := filemanager.ReadCatalog(a.destinationDir)
+	if err != nil {
+		return err
+	}
+
+	var (
+		count int
+		total int64
+	)
+
+	for _, r := range records {
+		if len(a.sessionUUID) != 0 && r.SessionID != a.sessionUUID || !matchesAny(a.commandArgs, r.Filename) {
+			continue
+		}
+
+		line := fmt.Sprintf("%s %10s %s #%d", r.ReceivedAt.Local().Format("2006-01-02 15:04:05"), filemanager.FormatBytes(r.Size), r.Filename, r.Version)
+
+		for _, field := range []struct{ name, value string }{
+			{"sha256", r.SHA256},
+			{"session", r.SessionID},
+			{"source", r.Source},
+		} {
+			if len(field.value) != 0 {
+				line += fmt.Sprintf(" %s=%s", field.name, field.value)
+			}
+		}
+
+		fmt.Println(line)
+
+		count++
+		total += r.Size
+	}
+
+	fmt.Printf("%d backups, %s\n", count, filemanager.FormatBytes(total))
+
+	return nil
+}
+
+// matchesAny tells whether name matches any of patterns, or there are none.
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return len(patterns) == 0
+}
+
+// backupPasswords returns passwords of --passfile a stored backup is opened
+// with.
+func (a *App) backupPasswords() (password1, password2 string, err error) {
+	// Manifests of deduplicated backups aren't protected with passwords.
+	if len(a.passwordFile) == 0 {
+		return "", "", nil
+	}
+
+	// A missing password file would be created with a new passphrase.
+	saved, err := a.passwordsSaved()
+	if err != nil {
+		return "", "", errors.Wrap(err, "--passfile")
+	}
+
+	if !saved {
+		return "", "", errors.Errorf("--passfile: %s doesn't exist", a.passwordFile)
+	}
+
+	if err := a.setupPasswordManager(); err != nil {
+		return "", "", err
+	}
+
+	password1, password2, err = a.passwordManager.GetPasswords()
+	if err != nil {
+		return "", "", errors.Wrap(err, "password manager")
+	}
+
+	log.AddSecret(password1, password2)
+
+	return password1, password2, nil
+}
@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"distributed-backup/pkg/filemanager"
+	"distributed-backup/pkg/scheduler"
+
+	"github.com/pkg/errors"
+)
+
+// checkSchedule checks options of a scheduled or a watching sender (see: --cron,
+// --interval, --watch), or of a receiver which pulls a backup at times of a
+// schedule (see: --pull).
+func (a *App) checkSchedule() error {
+	if len(a.cron) == 0 && a.interval == 0 && !a.watch {
+		return nil
+	}
+
+	switch {
+	case len(a.cron) != 0 && a.interval != 0:
+		return errors.New("--cron conflicts with --interval")
+	case a.watch && (len(a.cron) != 0 || a.interval != 0):
+		return errors.New("--watch conflicts with --cron and --interval")
+	case a.interval < 0:
+		return errors.New("--interval must not be negative")
+	case a.watchSettle < 0:
+		return errors.New("--watch-settle must not be negative")
+	}
+
+	name := "schedule"
+	if a.watch {
+		name = "--watch"
+	}
+
+	switch {
+	case len(a.sourceEntry) == 0 && a.watch:
+		return errors.New("--watch is supported by a sender only")
+	case len(a.sourceEntry) == 0 && len(a.pull) == 0:
+		return errors.New("schedule is supported by a sender or a receiver of --pull only")
+	case a.persistent:
+		return errors.Errorf("%s conflicts with --persistent and --daemon", name)
+	case a.forward:
+		return errors.Errorf("%s conflicts with --forward", name)
+	case len(a.checkpointFile) != 0:
+		return errors.Errorf("%s conflicts with --checkpoint", name)
+	}
+
+	return nil
+}
+
+func (a *App) setupSchedule() (err error) {
+	if err := a.checkSchedule(); err != nil {
+		return err
+	}
+
+	switch {
+	case len(a.cron) != 0:
+		a.schedule, err = scheduler.ParseCron(a.cron, time.Local)
+		if err != nil {
+			return errors.Wrap(err, "--cron")
+		}
+	case a.interval != 0:
+		a.schedule = scheduler.Every(a.interval)
+	}
+
+	return nil
+}
+
+// runScheduled sends a fresh backup (or pulls one, see: --pull) at times of a
+// schedule until ctx is done. Each run is a session of its own with the same
+// session ID, which a persistent receiver (or a serving sender) waits for, and
+// --deadline bounds every run rather than the process. A failed run is logged
+// and the next one is made as scheduled.
+func (a *App) runScheduled(ctx context.Context) {
+	first := true
+
+	s := scheduler.New(scheduler.Config{
+		Schedule:   a.schedule,
+		RunAtStart: len(a.cron) == 0,
+		Log:        a.logger,
+	})
+
+	s.Run(ctx, func(ctx context.Context) {
+		a.runRepeated(ctx, !first, "scheduled run")
+		first = false
+	})
+}
+
+// runWatched sends a fresh backup at once and then every time changes of a
+// source entry settle for --watch-settle until ctx is done, so that a working
+// directory is replicated in near real time. Runs are made just like scheduled
+// ones are (see: runScheduled()).
+func (a *App) runWatched(ctx context.Context) error {
+	first := true
+
+	err := scheduler.Watch(ctx, scheduler.WatchConfig{
+		Path:   a.sourceEntry,
+		Settle: a.watchSettle,
+		Log:    a.logger,
+	}, func(ctx context.Context) {
+		a.runRepeated(ctx, !first, "watched run")
+		first = false
+	})
+
+	return errors.Wrap(err, "--watch")
+}
+
+// runRepeated makes one of repeated runs of a sender named by name. A run other
+// than the first one, which uses the session made by Setup(), sets up a session
+// of its own. A failed run is logged only, so that the next one is made anyway.
+func (a *App) runRepeated(ctx context.Context, again bool, name string) {
+	if again {
+		if err := a.setupBackupMode(); err != nil {
+			a.logger.Error(errors.Wrap(err, name))
+
+			return
+		}
+
+		// Signaling messages of the previous run would confuse negotiation
+		// otherwise.
+		if err := a.signal.CleanUpInstance(); err != nil {
+			a.logger.Error(err)
+		}
+	}
+
+	a.fellBack.Store(false)
+
+	if a.deadline != 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, a.deadline)
+		defer cancel()
+	}
+
+	if err := a.runHookedSession(ctx); err != nil {
+		a.logger.Error(errors.Wrap(err, name))
+
+		return
+	}
+
+	r := a.fileManager.Result()
+
+	switch {
+	case a.fellBack.Load():
+		a.logger.Info(name + " uploaded a backup to the fallback destination")
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		a.logger.Error(errors.Errorf("%s: deadline of %s exceeded", name, a.deadline))
+	case r.Err != nil:
+		a.logger.Error(errors.Wrap(r.Err, name))
+	case r.Phase != filemanager.PhaseFinished:
+		a.logger.Error(errors.Errorf("%s: connection closed before a transfer finished", name))
+	default:
+		a.logger.Info(name + " finished")
+	}
+}
@@ -0,0 +1,396 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-backup/pkg/crypto"
+	"distributed-backup/pkg/filemanager"
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/passwordmanager"
+	"distributed-backup/pkg/peer"
+	"distributed-backup/pkg/signal"
+
+	"github.com/TelenLiu/go-zip"
+	"github.com/pkg/errors"
+)
+
+// Files of a source directory generated by the self-test.
+var selftestFiles = map[string]string{
+	"file.txt":            "Distributed Backup self-test\n",
+	"dir/nested.txt":      "nested file content\n",
+	"dir/subdir/data.bin": string(bytes.Repeat([]byte{0, 1, 2, 3, 254, 255}, 64*1024)),
+}
+
+// runSelftest runs a sender and a receiver within the process connected by the
+// in-memory signaling against a temporary directory, and checks the way of a
+// backup: passwords encryption, archiving, transferring, versioning and
+// restoring of it. Features beyond it are covered by tests of their packages.
+func (a *App) runSelftest(ctx context.Context) error {
+	tmpDir, err := os.MkdirTemp("", "distributed-backup-selftest-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var (
+		srcDir      = filepath.Join(tmpDir, "src")
+		dstDir      = filepath.Join(tmpDir, "dst")
+		restoredDir = filepath.Join(tmpDir, "restored")
+		outFile     = "selftest.zip"
+	)
+
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"prepare source directory", func() error {
+			return a.selftestPrepare(srcDir, dstDir, restoredDir)
+		}},
+		{"encrypt passwords", func() error {
+			return a.selftestPasswords(filepath.Join(tmpDir, "passwords"))
+		}},
+		{"archive and transfer", func() error {
+			return a.selftestTransfer(ctx, srcDir, dstDir, outFile)
+		}},
+		{"transfer another version", func() error {
+			return a.selftestTransfer(ctx, srcDir, dstDir, outFile)
+		}},
+		{"shift versions", func() error {
+			return a.selftestVersions(filepath.Join(dstDir, outFile))
+		}},
+		{"restore", func() error {
+			return a.selftestRestore(filepath.Join(dstDir, outFile), restoredDir)
+		}},
+		{"restore previous version in one step", func() error {
+			return a.selftestRestoreVersion(filepath.Join(dstDir, outFile+".1"), restoredDir)
+		}},
+	}
+
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			fmt.Printf("[FAIL] %s: %s\n", step.name, err)
+
+			return errors.Wrap(err, "self-test")
+		}
+
+		fmt.Printf("[ OK ] %s\n", step.name)
+	}
+
+	return nil
+}
+
+const (
+	selftestPassword1 = "selftest-password-1"
+	selftestPassword2 = "selftest-password-2"
+
+	selftestAuthSecret = "selftest-auth-secret"
+)
+
+func (a *App) selftestPrepare(srcDir, dstDir, restoredDir string) error {
+	for _, dir := range []string{srcDir, dstDir, restoredDir} {
+		if err := os.MkdirAll(dir, 0775); err != nil {
+			return err
+		}
+	}
+
+	for name, content := range selftestFiles {
+		path := filepath.Join(srcDir, filepath.FromSlash(name))
+
+		if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(path, []byte(content), 0664); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *App) selftestPasswords(path string) error {
+	// Cheap key derivation parameters keep the self-test fast.
+	c, err := crypto.NewPassphrase(crypto.PassphraseConfig{
+		Passphrase: []byte("selftest-passphrase"),
+		Time:       1,
+		Memory:     8 << 10,
+	})
+	if err != nil {
+		return err
+	}
+
+	m := passwordmanager.NewLocalSaver(passwordmanager.LocalSaverConfig{
+		PasswordFile: path,
+	}, c)
+
+	if err := m.SavePasswords(selftestPassword1, selftestPassword2); err != nil {
+		return err
+	}
+
+	p1, p2, err := m.GetPasswords()
+	if err != nil {
+		return err
+	}
+
+	if p1 != selftestPassword1 || p2 != selftestPassword2 {
+		return errors.New("decrypted passwords mismatch")
+	}
+
+	wrong, err := crypto.NewPassphrase(crypto.PassphraseConfig{
+		Passphrase: []byte("wrong-passphrase"),
+	})
+	if err != nil {
+		return err
+	}
+
+	p1, p2, err = passwordmanager.NewLocalSaver(passwordmanager.LocalSaverConfig{
+		PasswordFile: path,
+	}, wrong).GetPasswords()
+	if err == nil && p1 == selftestPassword1 && p2 == selftestPassword2 {
+		return errors.New("passwords are decrypted with a wrong passphrase")
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	b[len(b)-1] ^= 1
+
+	if err := os.WriteFile(path, b, 0664); err != nil {
+		return err
+	}
+
+	if _, _, err := m.GetPasswords(); err == nil {
+		return errors.New("tampered password file is decrypted")
+	}
+
+	return nil
+}
+
+// selftestTransfer sends a backup between peers and returns an error of either
+// of them if the transfer fails.
+func (a *App) selftestTransfer(ctx context.Context, srcDir, dstDir, outFile string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	receiverLog := log.WithField(log.FieldRole, filemanager.RoleReceiver)
+	senderLog := log.WithField(log.FieldRole, filemanager.RoleSender)
+
+	receiverSignal, senderSignal := signal.NewMemoryPair()
+
+	receiverPeer, err := peer.NewWebRTC(peer.WebRTCConfig{Log: receiverLog}, receiverSignal)
+	if err != nil {
+		return err
+	}
+	defer receiverPeer.Close()
+
+	senderPeer, err := peer.NewWebRTC(peer.WebRTCConfig{Log: senderLog}, senderSignal)
+	if err != nil {
+		return err
+	}
+	defer senderPeer.Close()
+
+	receiver, err := filemanager.NewBackupper(filemanager.BackupperConfig{
+		DestinationDir: dstDir,
+		Versions:       2,
+		AuthSecret:     selftestAuthSecret,
+		Log:            receiverLog,
+	}, receiverPeer)
+	if err != nil {
+		return err
+	}
+
+	sender, err := filemanager.NewBackupper(filemanager.BackupperConfig{
+		ZipDir:         true,
+		SourceEntry:    srcDir,
+		OutputFilename: outFile,
+		Password1:      selftestPassword1,
+		Password2:      selftestPassword2,
+		AuthSecret:     selftestAuthSecret,
+		Log:            senderLog,
+	}, senderPeer)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	for _, s := range []*signal.Memory{receiverSignal, senderSignal} {
+		s := s
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			s.Listen(ctx)
+		}()
+	}
+
+	if err := receiverPeer.Dial(); err != nil {
+		return err
+	}
+
+	if err := senderPeer.Dial(); err != nil {
+		return err
+	}
+
+	for _, m := range []*filemanager.Backupper{sender, receiver} {
+		select {
+		case <-m.Done():
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "transfer")
+		}
+	}
+
+	cancel()
+
+	for _, m := range []*filemanager.Backupper{sender, receiver} {
+		if r := m.Result(); r.Err != nil {
+			return errors.Wrap(r.Err, r.Role)
+		}
+	}
+
+	if digest := sender.Result().Digest; len(digest) == 0 || !bytes.Equal(digest, receiver.Result().Digest) {
+		return errors.New("peers report different digests of a transfer stream")
+	}
+
+	return nil
+}
+
+func (a *App) selftestVersions(path string) error {
+	for _, p := range []string{path, path + ".1"} {
+		if _, err := os.Stat(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *App) selftestRestore(path, restoredDir string) error {
+	if err := extractBackup(path, selftestPassword1, selftestPassword2, restoredDir); err != nil {
+		return err
+	}
+
+	return a.selftestVerify(restoredDir)
+}
+
+// selftestRestoreVersion extracts a stored version of a backup with passwords
+// of a sender as the restore command does, and checks that it's extracted into
+// a directory named after the version, which isn't overwritten by restoring it
+// again, and that nothing is left of a backup restored with wrong passwords.
+func (a *App) selftestRestoreVersion(path, restoredDir string) error {
+	_, err := filemanager.Restore(path, selftestPassword2, selftestPassword1, restoredDir, a.logger)
+	if err == nil {
+		return errors.New("backup is restored with wrong passwords")
+	}
+
+	target, err := filemanager.Restore(path, selftestPassword1, selftestPassword2, restoredDir, a.logger)
+	if err != nil {
+		return err
+	}
+
+	if filepath.Base(target) != strings.TrimSuffix(filepath.Base(path), ".zip.1")+".1" {
+		return errors.Errorf("%s: unexpected restored directory", target)
+	}
+
+	if err := a.selftestVerify(target); err != nil {
+		return err
+	}
+
+	if _, err := filemanager.Restore(path, selftestPassword1, selftestPassword2, restoredDir, a.logger); err == nil {
+		return errors.New("restored directory is overwritten")
+	}
+
+	return nil
+}
+
+// selftestVerify checks that dir contains files of a source directory.
+func (a *App) selftestVerify(dir string) error {
+	for name, content := range selftestFiles {
+		b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+
+		if string(b) != content {
+			return errors.Errorf("%s: restored content mismatch", name)
+		}
+	}
+
+	return nil
+}
+
+// extractBackup extracts both archive levels of a received backup into dir.
+func extractBackup(path, password1, password2, dir string) error {
+	outer, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer outer.Close()
+
+	if len(outer.File) != 1 {
+		return errors.Errorf("%s: single inner archive expected", path)
+	}
+
+	inner, err := readArchivedFile(outer.File[0], password2)
+	if err != nil {
+		return err
+	}
+
+	return extractArchive(inner, password1, dir)
+}
+
+// extractArchive extracts a single archive level into dir.
+func extractArchive(b []byte, password, dir string) error {
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range z.File {
+		content, err := readArchivedFile(f, password)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(f.Name))
+
+		if err := os.MkdirAll(filepath.Dir(target), 0775); err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(target, content, 0664); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readArchivedFile(f *zip.File, password string) ([]byte, error) {
+	if f.IsEncrypted() {
+		f.SetPassword(password)
+	}
+
+	r, err := f.Open()
+	if err != nil {
+		return nil, errors.Wrap(err, f.Name)
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+
+	return b, errors.Wrap(err, f.Name)
+}
@@ -0,0 +1,20 @@
+package internal
+
+import (
+	"context"
+	"testing"
+)
+
+// TestSelftest runs the way of a backup the --selftest option checks, features
+// beyond it are covered by tests of their packages.
+func TestSelftest(t *testing.T) {
+	if testing.Short() {
+		t.Skip("peers are connected over the network stack")
+	}
+
+	a := &App{}
+
+	if err := a.runSelftest(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
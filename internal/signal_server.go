@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/signal"
+
+	"github.com/pkg/errors"
+)
+
+const defaultSignalServerAddr = ":8080"
+
+// runSignalServer runs a rendezvous server of both the WebSocket and the HTTP
+// signaling (see: --signal-url) on an address given as an argument until ctx is
+// done. Clients are required to send --signal-token if it's given.
+func (a *App) runSignalServer(ctx context.Context) error {
+	if len(a.commandArgs) > 1 {
+		return errors.New("usage: signal-server [--signal-token=<token>] [host:port]")
+	}
+
+	addr := defaultSignalServerAddr
+	if len(a.commandArgs) != 0 {
+		addr = a.commandArgs[0]
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "signal server")
+	}
+
+	srv := &http.Server{
+		Handler: signal.NewRendezvousServer(signal.RendezvousServerConfig{
+			Token: a.signalToken,
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.WithField(log.FieldAddr, l.Addr().String()).Info("signal server is listening")
+
+	if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		return errors.Wrap(err, "signal server")
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/peer"
+	"distributed-backup/pkg/signal"
+
+	"github.com/pkg/errors"
+)
+
+// setupStaticSignal loads a static description of this peer (see: --static-sdp),
+// which is generated on the first run, and of a remote one (see: --remote-sdp),
+// and sets up the static signaling between them.
+func (a *App) setupStaticSignal(cfg *peer.WebRTCConfig) error {
+	local, err := a.staticDescription()
+	if err != nil {
+		return errors.Wrap(err, "--static-sdp")
+	}
+
+	remote, err := peer.LoadStaticDescription(a.remoteSDP)
+	if err != nil {
+		return errors.Wrap(err, "--remote-sdp")
+	}
+
+	a.signal, err = signal.NewStatic(signal.StaticConfig{
+		LocalSDP:  local.SDP,
+		RemoteSDP: remote.SDP,
+		Log:       a.logger,
+	})
+	if err != nil {
+		return errors.Wrap(err, "static signaling")
+	}
+
+	cfg.Static = local
+
+	return nil
+}
+
+// staticDescription loads a static description of this peer, or generates one
+// and saves it along with its public part to give to a remote peer.
+func (a *App) staticDescription() (*peer.StaticDescription, error) {
+	d, err := peer.LoadStaticDescription(a.staticSDP)
+	if err == nil || !os.IsNotExist(err) {
+		return d, err
+	}
+
+	a.logger.WithField(log.FieldFile, a.staticSDP).Info("generating static description")
+
+	d, err = peer.GenerateStaticDescription(peer.WebRTCConfig{
+		STUN:  a.stunServers,
+		Proxy: a.proxyURL,
+		Log:   a.logger,
+	}, a.staticPort)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.Save(a.staticSDP); err != nil {
+		return nil, err
+	}
+
+	public := publicDescriptionPath(a.staticSDP)
+
+	if err := d.Public().Save(public); err != nil {
+		return nil, err
+	}
+
+	a.logger.WithField(log.FieldFile, public).Info("static description is generated, give this file to the remote peer as --remote-sdp")
+
+	return d, nil
+}
+
+// setupFingerprint sets a DTLS certificate of --dtls-cert, which is generated on
+// the first run, and a fingerprint of --expected-fingerprint the other peer's
+// one is checked against.
+func (a *App) setupFingerprint(cfg *peer.WebRTCConfig) error {
+	if len(a.dtlsCert) == 0 && len(a.expectedFP) == 0 {
+		return nil
+	}
+
+	if a.transport != peer.TransportWebRTC {
+		return errors.Errorf("--dtls-cert and --expected-fingerprint require --transport=%s", peer.TransportWebRTC)
+	}
+
+	if len(a.expectedFP) != 0 {
+		fp, err := peer.ParseFingerprint(a.expectedFP)
+		if err != nil {
+			return errors.Wrap(err, "--expected-fingerprint")
+		}
+
+		cfg.ExpectedFingerprint = fp
+	}
+
+	if len(a.dtlsCert) == 0 {
+		return nil
+	}
+
+	// A static description keeps a certificate of its own.
+	if len(a.staticSDP) != 0 {
+		return errors.New("--dtls-cert conflicts with --static-sdp")
+	}
+
+	b, err := os.ReadFile(a.dtlsCert)
+	if err == nil {
+		cfg.Certificate = string(b)
+
+		return nil
+	}
+
+	if !os.IsNotExist(err) {
+		return errors.Wrap(err, "--dtls-cert")
+	}
+
+	cert, err := peer.GenerateDTLSCertificate()
+	if err != nil {
+		return errors.Wrap(err, "--dtls-cert")
+	}
+
+	// A certificate the other peer has pinned is never replaced by mistake.
+	f, err := os.OpenFile(a.dtlsCert, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Wrap(err, "--dtls-cert")
+	}
+
+	_, err = f.WriteString(cert)
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "--dtls-cert")
+	}
+
+	fp, err := peer.DTLSFingerprint(cert)
+	if err != nil {
+		return errors.Wrap(err, "--dtls-cert")
+	}
+
+	a.logger.WithFields(log.Fields{
+		log.FieldFile:        a.dtlsCert,
+		log.FieldFingerprint: fp,
+	}).Info("DTLS certificate is generated, give its fingerprint to the other peer as --expected-fingerprint")
+
+	cfg.Certificate = cert
+
+	return nil
+}
+
+// publicDescriptionPath returns a path of a public part of a static description
+// at path, e.g. "local.pub.json" for "local.json".
+func publicDescriptionPath(path string) string {
+	ext := filepath.Ext(path)
+
+	return strings.TrimSuffix(path, ext) + ".pub" + ext
+}
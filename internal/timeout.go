@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"time"
+
+	"distributed-backup/pkg/filemanager"
+
+	"github.com/pkg/errors"
+)
+
+// sessionWatchInterval is an interval session timeouts are checked at.
+const sessionWatchInterval = time.Second
+
+// sessionWatch times a session out while it waits for the other peer in
+// signaling (see: --signal-timeout), while a connection to it is established
+// (see: --connect-timeout) and while an established connection is idle (see:
+// --idle-timeout). A transport which doesn't negotiate a connection through
+// signaling (see: directTransport()) waits for the other peer until a connection is
+// established.
+type sessionWatch struct {
+	app       *App
+	startedAt time.Time
+	activeAt  time.Time
+	bytes     int64
+}
+
+func (a *App) newSessionWatch() *sessionWatch {
+	return &sessionWatch{app: a, startedAt: time.Now()}
+}
+
+// sessionTimeouts tells whether any session timeout is set.
+func (a *App) sessionTimeouts() bool {
+	return a.signalTimeout != 0 || a.connectTimeout != 0 || a.idleTimeout != 0
+}
+
+// check returns an error a session which has timed out by now fails with.
+func (w *sessionWatch) check(now time.Time) error {
+	a := w.app
+	r := a.fileManager.Result()
+
+	switch {
+	case r.Phase == filemanager.PhaseFinished:
+		return nil
+	case r.Phase == filemanager.PhaseTransferring:
+		if bytes := r.SentBytes + r.ReceivedBytes; bytes != w.bytes || w.activeAt.IsZero() {
+			w.bytes = bytes
+			w.activeAt = now
+		}
+
+		if a.idleTimeout != 0 && now.Sub(w.activeAt) >= a.idleTimeout {
+			return newExitError(exitIdleTimeout, errors.Errorf("no data has been transferred for %s", a.idleTimeout))
+		}
+	case a.signalSeen.Load() == 0:
+		if a.signalTimeout != 0 && now.Sub(w.startedAt) >= a.signalTimeout {
+			return newExitError(exitSignalTimeout, errors.Errorf("the other peer hasn't turned up within %s", a.signalTimeout))
+		}
+	default:
+		seenAt := time.Unix(0, a.signalSeen.Load())
+
+		if a.connectTimeout != 0 && now.Sub(seenAt) >= a.connectTimeout {
+			return newExitError(exitConnectTimeout, errors.Errorf("connection hasn't been established within %s since the other peer turned up", a.connectTimeout))
+		}
+	}
+
+	return nil
+}
+
+// resumed restarts an idle time of a transfer resumed over a new connection,
+// since time spent reconnecting is bounded by --resume-timeout instead.
+func (w *sessionWatch) resumed(now time.Time) {
+	w.activeAt = now
+}
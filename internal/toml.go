@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// parseTOML parses a config file in TOML into the same nodes a YAML one is parsed
+// into (see: applyConfig()). Only top-level keys are supported, since keys are
+// long names of CLI options, so tables are rejected. Values are strings, other
+// scalars (numbers, booleans, durations given as strings) and arrays of them,
+// which may span lines.
+func parseTOML(b []byte) (*yaml.Node, error) {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	lines := strings.Split(string(b), "\n")
+
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		line := strings.TrimSpace(stripTOMLComment(lines[i]))
+
+		if len(line) == 0 {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			return nil, errors.Errorf("line %d: tables are not supported, options are top-level keys", lineNo)
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, errors.Errorf("line %d: key = value expected", lineNo)
+		}
+
+		key, err := parseTOMLKey(strings.TrimSpace(line[:eq]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineNo)
+		}
+
+		value := strings.TrimSpace(line[eq+1:])
+
+		// An array goes on until its brackets are balanced.
+		for strings.HasPrefix(value, "[") && !tomlArrayClosed(value) {
+			i++
+
+			if i == len(lines) {
+				return nil, errors.Errorf("line %d: unterminated array", lineNo)
+			}
+
+			value += " " + strings.TrimSpace(stripTOMLComment(lines[i]))
+		}
+
+		node, err := parseTOMLValue(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineNo)
+		}
+
+		node.Line = lineNo
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key, Line: lineNo}, node)
+	}
+
+	return &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{root}}, nil
+}
+
+func parseTOMLKey(s string) (string, error) {
+	if len(s) == 0 {
+		return "", errors.New("key is empty")
+	}
+
+	if s[0] == '"' || s[0] == '\'' {
+		return parseTOMLString(s)
+	}
+
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return "", errors.Errorf("invalid key: %s", s)
+		}
+	}
+
+	return s, nil
+}
+
+func parseTOMLValue(s string) (*yaml.Node, error) {
+	switch {
+	case len(s) == 0:
+		return nil, errors.New("value is empty")
+	case s[0] == '[':
+		items, err := splitTOMLArray(s[1 : len(s)-1])
+		if err != nil {
+			return nil, err
+		}
+
+		node := &yaml.Node{Kind: yaml.SequenceNode}
+
+		for _, item := range items {
+			if strings.HasPrefix(item, "[") {
+				return nil, errors.New("nested arrays are not supported")
+			}
+
+			v, err := parseTOMLValue(item)
+			if err != nil {
+				return nil, err
+			}
+
+			node.Content = append(node.Content, v)
+		}
+
+		return node, nil
+	case s[0] == '{':
+		return nil, errors.New("inline tables are not supported")
+	case s[0] == '"' || s[0] == '\'':
+		v, err := parseTOMLString(s)
+		if err != nil {
+			return nil, err
+		}
+
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: v}, nil
+	default:
+		// Numbers and booleans are passed to options as they are written, except
+		// for underscores separating digits.
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: strings.ReplaceAll(s, "_", "")}, nil
+	}
+}
+
+// parseTOMLString parses a basic ("...") or a literal ('...') string, escapes of
+// a basic one are the same as Go ones but for rarely used \e.
+func parseTOMLString(s string) (string, error) {
+	if len(s) < 2 || s[len(s)-1] != s[0] {
+		return "", errors.Errorf("unterminated string: %s", s)
+	}
+
+	if s[0] == '\'' {
+		if strings.ContainsRune(s[1:len(s)-1], '\'') {
+			return "", errors.Errorf("invalid string: %s", s)
+		}
+
+		return s[1 : len(s)-1], nil
+	}
+
+	v, err := strconv.Unquote(s)
+	if err != nil {
+		return "", errors.Errorf("invalid string: %s", s)
+	}
+
+	return v, nil
+}
+
+// splitTOMLArray splits items of an array separated by commas outside strings,
+// a trailing comma is allowed.
+func splitTOMLArray(s string) ([]string, error) {
+	var (
+		items []string
+		start int
+		quote byte
+		depth int
+	)
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			items = append(items, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.New("unterminated string in array")
+	}
+
+	if last := strings.TrimSpace(s[start:]); len(last) != 0 {
+		items = append(items, last)
+	}
+
+	for _, item := range items {
+		if len(item) == 0 {
+			return nil, errors.New("empty array item")
+		}
+	}
+
+	return items, nil
+}
+
+// tomlArrayClosed tells whether brackets outside strings are balanced.
+func tomlArrayClosed(s string) bool {
+	var (
+		quote byte
+		depth int
+	)
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+
+	return depth == 0
+}
+
+// stripTOMLComment cuts a comment off a line unless "#" is within a string.
+func stripTOMLComment(line string) string {
+	var quote byte
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+
+	return line
+}
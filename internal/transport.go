@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+
+	"distributed-backup/pkg/peer"
+
+	"github.com/pkg/errors"
+)
+
+// directSignal stands for signaling of a transport which connects peers
+// directly (see: --transport), there's nothing to negotiate through it.
+type directSignal struct{}
+
+func (directSignal) Ping() error                { return nil }
+func (directSignal) SendSDP([]byte) error       { return nil }
+func (directSignal) SendCandidate([]byte) error { return nil }
+func (directSignal) OnSDP(func([]byte))         {}
+func (directSignal) OnCandidate(func([]byte))   {}
+func (directSignal) CleanUpInstance() error     { return nil }
+func (directSignal) Listen(ctx context.Context) { <-ctx.Done() }
+
+// directTransport tells if peers connect directly without signaling, i.e. over
+// a transport other than WebRTC and QUIC, or over QUIC with --listen or
+// --connect.
+func (a *App) directTransport() bool {
+	switch a.transport {
+	case peer.TransportWebRTC:
+		return false
+	case peer.TransportQUIC:
+		return len(a.listenAddr)+len(a.connectAddr) != 0
+	}
+
+	return true
+}
+
+// setupDirectConnection sets up a connection of a direct transport (see:
+// directTransport()), which listens on --listen or connects to --connect.
+func (a *App) setupDirectConnection() (err error) {
+	cfg := peer.TCPTLSConfig{
+		Addr:   a.connectAddr,
+		Listen: len(a.listenAddr) != 0,
+		Proxy:  a.proxyURL,
+		Log:    a.logger,
+	}
+
+	switch {
+	case cfg.Listen && len(a.connectAddr) != 0:
+		return errors.New("--listen conflicts with --connect")
+	case cfg.Listen:
+		cfg.Addr = a.listenAddr
+	case len(a.connectAddr) == 0:
+		return errors.Errorf("transport %s requires either --listen or --connect", a.transport)
+	}
+
+	if cfg.Certificate, cfg.RootCAs, err = a.tlsCredentials(); err != nil {
+		return err
+	}
+
+	a.signal = directSignal{}
+
+	a.peer, err = peer.NewConn(a.transport, peer.TransportConfig{
+		TCPTLS: cfg,
+		QUIC: peer.QUICConfig{
+			Addr:        cfg.Addr,
+			Listen:      cfg.Listen,
+			Streams:     a.streams,
+			Certificate: cfg.Certificate,
+			RootCAs:     cfg.RootCAs,
+			Log:         a.logger,
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "peer connection")
+	}
+
+	return nil
+}
+
+// tlsCredentials loads a certificate of --tls-cert and --tls-key and a CA of
+// --tls-ca, either of them is nil if it's not set.
+func (a *App) tlsCredentials() (*tls.Certificate, *x509.CertPool, error) {
+	var (
+		cert *tls.Certificate
+		cas  *x509.CertPool
+	)
+
+	if len(a.tlsCert) != 0 || len(a.tlsKey) != 0 {
+		c, err := tls.LoadX509KeyPair(a.tlsCert, a.tlsKey)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "--tls-cert")
+		}
+
+		cert = &c
+	}
+
+	if len(a.tlsCA) != 0 {
+		b, err := os.ReadFile(a.tlsCA)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "--tls-ca")
+		}
+
+		cas = x509.NewCertPool()
+
+		if !cas.AppendCertsFromPEM(b) {
+			return nil, nil, errors.Errorf("--tls-ca: no certificate in %s", a.tlsCA)
+		}
+	}
+
+	return cert, cas, nil
+}
@@ -0,0 +1,148 @@
+// Package chunker splits data into content-defined chunks, so that data which
+// is inserted or removed only changes chunks around it and the rest of chunks
+// stay the same, which makes them worth deduplicating.
+//
+// A boundary is found with a gear rolling hash, in the way FastCDC does: a hash
+// is shifted a bit left and a random value of a next byte is added, so that it
+// depends on the last 64 bytes, and a chunk is cut after a byte the hash of
+// which has all bits of a mask unset. Chunks are at least MinSize long, and a
+// stricter mask is used until a chunk reaches AvgSize and a looser one after
+// it, so that sizes of chunks gather around AvgSize. A chunk is cut at MaxSize
+// anyway.
+
+package chunker
+
+const (
+	// MinSize and MaxSize bound sizes of chunks but the last one of data, which
+	// are AvgSize on average.
+	MinSize = 256 << 10
+	AvgSize = 1 << 20
+	MaxSize = 4 << 20
+
+	// Masks have 2 bits more and 2 bits less than log2(AvgSize) set (see:
+	// Cut()), which are spread over the upper bits of a hash, since they depend
+	// on more bytes.
+	maskS uint64 = 0x5555555555500000
+	maskL uint64 = 0x5555555550000000
+)
+
+var gear [256]uint64
+
+func init() {
+	// SplitMix64 of a fixed seed, so that chunks are the same everywhere.
+	x := uint64(0x6462636463686e6b)
+
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		gear[i] = z ^ z>>31
+	}
+}
+
+// Cut returns a length of the first chunk of b, which is all of b if it's not
+// longer than MinSize, or if it's shorter than MaxSize and no boundary is found,
+// so that a chunk at the end of data is only cut with all of it at hand.
+func Cut(b []byte) int {
+	n := len(b)
+
+	if n <= MinSize {
+		return n
+	}
+
+	if n > MaxSize {
+		n = MaxSize
+	}
+
+	avg := AvgSize
+
+	if avg > n {
+		avg = n
+	}
+
+	var h uint64
+
+	i := MinSize
+
+	for ; i < avg; i++ {
+		h = h<<1 + gear[b[i]]
+
+		if h&maskS == 0 {
+			return i + 1
+		}
+	}
+
+	for ; i < n; i++ {
+		h = h<<1 + gear[b[i]]
+
+		if h&maskL == 0 {
+			return i + 1
+		}
+	}
+
+	return n
+}
+
+// Writer splits data written to it into chunks and passes them to a function,
+// a chunk is only valid until the function returns.
+type Writer struct {
+	fn  func(chunk []byte) error
+	buf []byte
+	err error
+}
+
+// NewWriter returns a writer which passes chunks of data to fn.
+func NewWriter(fn func(chunk []byte) error) *Writer {
+	return &Writer{fn: fn}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) != 0 && w.err == nil {
+		if w.buf == nil {
+			w.buf = make([]byte, 0, MaxSize)
+		}
+
+		k := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+k]
+		p = p[k:]
+
+		if len(w.buf) == cap(w.buf) {
+			w.flush(false)
+		}
+	}
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	return n, nil
+}
+
+// Close passes the rest of data to a function.
+func (w *Writer) Close() error {
+	w.flush(true)
+
+	return w.err
+}
+
+// flush passes chunks which are cut before the end of buffered data, or all
+// chunks if it's the end of data.
+func (w *Writer) flush(end bool) {
+	b := w.buf
+
+	for len(b) != 0 && w.err == nil {
+		n := Cut(b)
+
+		if n == len(b) && !end && n < MaxSize {
+			break
+		}
+
+		w.err = w.fn(b[:n])
+		b = b[n:]
+	}
+
+	w.buf = w.buf[:copy(w.buf, b)]
+}
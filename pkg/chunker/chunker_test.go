@@ -0,0 +1,190 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func random(n int, seed int64) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+
+	return b
+}
+
+// cuts returns sizes of chunks of b.
+func cuts(b []byte) []int {
+	var sizes []int
+
+	for len(b) != 0 {
+		n := Cut(b)
+		sizes = append(sizes, n)
+		b = b[n:]
+	}
+
+	return sizes
+}
+
+// TestCutStable checks sizes of chunks of fixed data, which must not change
+// since chunks stored by receivers are found by hashes of them.
+func TestCutStable(t *testing.T) {
+	expected := []int{1216807, 1220045, 349555, 1203775, 1202832, 1417894, 760199, 1219170}
+
+	sizes := cuts(random(16<<20, 1))
+
+	for i, size := range expected {
+		if i >= len(sizes) || sizes[i] != size {
+			t.Fatalf("chunks of %v bytes are cut, %v expected first", sizes, expected)
+		}
+	}
+}
+
+func TestCutBounds(t *testing.T) {
+	for _, n := range []int{0, 1, MinSize} {
+		if size := Cut(random(n, 1)); size != n {
+			t.Errorf("chunk of %d bytes is cut of %d, all of them expected", size, n)
+		}
+	}
+
+	// A hash of a run of the same byte never matches a mask.
+	if size := Cut(make([]byte, MaxSize+1)); size != MaxSize {
+		t.Errorf("chunk of %d bytes is cut of zeros, %d expected", size, MaxSize)
+	}
+
+	b := random(64<<20, 2)
+	sizes := cuts(b)
+
+	for i, size := range sizes[:len(sizes)-1] {
+		if size <= MinSize || size > MaxSize {
+			t.Fatalf("chunk %d of %d bytes", i, size)
+		}
+	}
+
+	if avg := len(b) / len(sizes); avg < AvgSize/2 || avg > 2*AvgSize {
+		t.Errorf("chunks of %d bytes on average, %d expected", avg, AvgSize)
+	}
+}
+
+// TestCutShift checks that chunks but ones around data inserted and removed
+// stay the same.
+func TestCutShift(t *testing.T) {
+	b := random(32<<20, 3)
+
+	hashes := func(b []byte) map[[32]byte]bool {
+		m := map[[32]byte]bool{}
+
+		for _, n := range cuts(b) {
+			m[sha256.Sum256(b[:n])] = true
+			b = b[n:]
+		}
+
+		return m
+	}
+
+	original := hashes(b)
+
+	for name, changed := range map[string][]byte{
+		"prepended": append(random(1000, 4), b...),
+		"inserted":  append(append(append([]byte(nil), b[:10<<20]...), random(10, 5)...), b[10<<20:]...),
+		"removed":   append(append([]byte(nil), b[:10<<20]...), b[10<<20+12345:]...),
+	} {
+		changedHashes := hashes(changed)
+
+		same := 0
+
+		for h := range changedHashes {
+			if original[h] {
+				same++
+			}
+		}
+
+		if same < len(changedHashes)-2 {
+			t.Errorf("%s: %d of %d chunks are the same, %d at least expected", name, same, len(changedHashes), len(changedHashes)-2)
+		}
+	}
+}
+
+// TestWriter checks that a writer passes the same chunks as Cut() cuts,
+// whatever sizes of writes are.
+func TestWriter(t *testing.T) {
+	for _, n := range []int{0, 1, MinSize, MaxSize, MaxSize + 1, 20 << 20} {
+		b := random(n, int64(n))
+		expected := cuts(b)
+
+		for _, writeSize := range []int{n + 1, MaxSize, 100000} {
+			var sizes []int
+
+			chunks := &bytes.Buffer{}
+
+			w := NewWriter(func(chunk []byte) error {
+				sizes = append(sizes, len(chunk))
+				chunks.Write(chunk)
+
+				return nil
+			})
+
+			for p := b; len(p) > 0; {
+				k := writeSize
+				if k > len(p) {
+					k = len(p)
+				}
+
+				if _, err := w.Write(p[:k]); err != nil {
+					t.Fatal(err)
+				}
+
+				p = p[k:]
+			}
+
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(chunks.Bytes(), b) {
+				t.Fatalf("%d bytes, writes of %d: chunks mismatch data", n, writeSize)
+			}
+
+			if len(sizes) != len(expected) {
+				t.Fatalf("%d bytes, writes of %d: chunks of %v bytes, %v expected", n, writeSize, sizes, expected)
+			}
+
+			for i := range sizes {
+				if sizes[i] != expected[i] {
+					t.Fatalf("%d bytes, writes of %d: chunks of %v bytes, %v expected", n, writeSize, sizes, expected)
+				}
+			}
+		}
+	}
+}
+
+func TestWriterError(t *testing.T) {
+	errTest := errors.New("test error")
+
+	calls := 0
+
+	w := NewWriter(func(chunk []byte) error {
+		calls++
+
+		return errTest
+	})
+
+	if _, err := w.Write(random(3*MaxSize, 1)); !errors.Is(err, errTest) {
+		t.Errorf("write: %v, %v expected", err, errTest)
+	}
+
+	if _, err := w.Write([]byte("data")); !errors.Is(err, errTest) {
+		t.Errorf("write after an error: %v, %v expected", err, errTest)
+	}
+
+	if err := w.Close(); !errors.Is(err, errTest) {
+		t.Errorf("close: %v, %v expected", err, errTest)
+	}
+
+	if calls != 1 {
+		t.Errorf("function is called %d times, no more after an error expected", calls)
+	}
+}
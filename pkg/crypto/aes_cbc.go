@@ -4,6 +4,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 
+	"github.com/pkg/errors"
 	"github.com/zenazn/pkcs7pad"
 )
 
@@ -42,6 +43,10 @@ func (c *AesCbc) Encrypt(payload []byte) []byte {
 }
 
 func (c *AesCbc) Decrypt(payload []byte) ([]byte, error) {
+	if len(payload)%c.cipher.BlockSize() != 0 {
+		return nil, errors.New("payload is not a multiple of the block size")
+	}
+
 	decrypter := cipher.NewCBCDecrypter(c.cipher, c.cfg.IV)
 	decrypted := make([]byte, len(payload))
 
@@ -0,0 +1,66 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+
+	"github.com/pkg/errors"
+)
+
+// AesGcm encrypts and authenticates payloads with AES-GCM, so that a tampered
+// payload fails to be decrypted. A random nonce is generated for every payload
+// and prepended to its ciphertext as "${nonce}${ciphertext}${tag}".
+type AesGcm struct {
+	cfg AesGcmConfig
+
+	aead cipher.AEAD
+}
+
+type AesGcmConfig struct {
+	// Key is 16, 24 or 32 bytes long for AES-128, AES-192 or AES-256.
+	Key []byte
+}
+
+func NewAesGcm(cfg AesGcmConfig) (*AesGcm, error) {
+	block, err := aes.NewCipher(cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AesGcm{
+		cfg:  cfg,
+		aead: aead,
+	}, nil
+}
+
+func (c *AesGcm) Encrypt(payload []byte) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+
+	// The system random source doesn't fail on supported platforms.
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+
+	return c.aead.Seal(nonce, nonce, payload, nil)
+}
+
+func (c *AesGcm) Decrypt(payload []byte) ([]byte, error) {
+	if len(payload) < c.aead.NonceSize()+c.aead.Overhead() {
+		return nil, errors.New("payload is truncated")
+	}
+
+	nonce, ciphertext := payload[:c.aead.NonceSize()], payload[c.aead.NonceSize():]
+
+	decrypted, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("payload fails to be authenticated")
+	}
+
+	return decrypted, nil
+}
@@ -0,0 +1,13 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package nistec implements the P-256 elliptic curve with constant-time,
+// allocation-free, byte slice-based safe APIs.
+//
+// It is a copy of P-256 of crypto/internal/fips140/nistec of Go 1.27.1 (the
+// code filippo.io/nistec is made of), which isn't importable. The pure Go
+// backend is kept, internal packages of the standard library are replaced with
+// crypto/subtle and encoding/binary, and ScalarBaseMult with its precomputed
+// tables is left out, as ScalarMult of the generator does the same.
+package nistec
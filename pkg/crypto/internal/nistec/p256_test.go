@@ -0,0 +1,74 @@
+package nistec
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+)
+
+// TestP256ScalarMult checks the copy against crypto/ecdh of the standard
+// library.
+func TestP256ScalarMult(t *testing.T) {
+	for i := 0; i < 32; i++ {
+		priv, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pub, err := NewP256Point().ScalarMult(NewP256Point().SetGenerator(), priv.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(pub.Bytes(), priv.PublicKey().Bytes()) {
+			t.Fatalf("x·G = %x, want %x", pub.Bytes(), priv.PublicKey().Bytes())
+		}
+
+		peer, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q, err := NewP256Point().SetBytes(peer.PublicKey().Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		shared, err := priv.ECDH(peer.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		x, err := q.ScalarMult(q, priv.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if b, _ := x.BytesX(); !bytes.Equal(b, shared) {
+			t.Fatalf("x·Q = %x, want %x", b, shared)
+		}
+	}
+}
+
+func TestP256AddNegate(t *testing.T) {
+	g := NewP256Point().SetGenerator()
+
+	two := make([]byte, 32)
+	two[31] = 2
+
+	g2, err := NewP256Point().ScalarMult(g, two)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sum := NewP256Point().Add(g, g); !bytes.Equal(sum.Bytes(), g2.Bytes()) {
+		t.Errorf("G+G = %x, want %x", sum.Bytes(), g2.Bytes())
+	}
+
+	neg := NewP256Point().Set(g).Negate(1)
+
+	if zero := NewP256Point().Add(g, neg); !bytes.Equal(zero.Bytes(), []byte{0}) {
+		t.Errorf("G-G = %x, want the point at infinity", zero.Bytes())
+	}
+}
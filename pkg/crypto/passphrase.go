@@ -0,0 +1,171 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+)
+
+// passphraseMagic starts a payload encrypted with a passphrase-derived key, it's
+// followed by a version telling a cipher, Argon2id parameters and a salt the key
+// is derived with.
+var passphraseMagic = []byte("DBK")
+
+const (
+	// passphraseVersionCBC payloads are encrypted with AES-256-CBC keyed by a key
+	// and an IV derived from a passphrase, which are still decrypted but never
+	// encrypted, since they aren't authenticated.
+	passphraseVersionCBC = 1
+	// passphraseVersionGCM payloads are encrypted and authenticated with
+	// AES-256-GCM (see: AesGcm).
+	passphraseVersionGCM = 2
+
+	passphraseSaltSize   = 16
+	passphraseHeaderSize = 3 + 1 + 4 + 4 + 1 + passphraseSaltSize
+
+	// Defaults are the second recommended option of RFC 9106.
+	defaultArgon2Time    = 3
+	defaultArgon2Memory  = 64 << 10
+	defaultArgon2Threads = 4
+
+	// Parameters of a header are bounded, so that a forged one can't make key
+	// derivation exhaust memory.
+	maxArgon2Time   = 64
+	maxArgon2Memory = 1 << 20
+)
+
+var ErrLegacyPayload = errors.New("payload is not encrypted with a passphrase")
+
+// Passphrase encrypts payloads with AES-256-GCM keyed by a key derived from a
+// passphrase with Argon2id, so that both a wrong passphrase and a tampered payload
+// are detected. A random salt is generated for every payload and stored in its
+// header together with Argon2id parameters as
+// "DBK${version}${time}${memory}${threads}${salt}${ciphertext}".
+type Passphrase struct {
+	cfg PassphraseConfig
+}
+
+type PassphraseConfig struct {
+	Passphrase []byte
+	// Time, Memory (in KiB) and Threads are Argon2id parameters of encrypted
+	// payloads, RFC 9106 recommended ones are used by default. Payloads are
+	// decrypted with parameters of their headers.
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	// Legacy decrypts payloads without a header, e.g. ones encrypted with a fixed
+	// key before passphrases were introduced. ErrLegacyPayload is returned for
+	// them if it's nil.
+	Legacy interface {
+		Decrypt([]byte) ([]byte, error)
+	}
+}
+
+func NewPassphrase(cfg PassphraseConfig) (*Passphrase, error) {
+	if len(cfg.Passphrase) == 0 {
+		return nil, errors.New("passphrase is empty")
+	}
+
+	if cfg.Time == 0 {
+		cfg.Time = defaultArgon2Time
+	}
+
+	if cfg.Memory == 0 {
+		cfg.Memory = defaultArgon2Memory
+	}
+
+	if cfg.Threads == 0 {
+		cfg.Threads = defaultArgon2Threads
+	}
+
+	return &Passphrase{cfg: cfg}, nil
+}
+
+// IsPassphrasePayload tells whether a payload is encrypted with a passphrase
+// rather than a legacy key.
+func IsPassphrasePayload(payload []byte) bool {
+	return bytes.HasPrefix(payload, passphraseMagic)
+}
+
+func (c *Passphrase) Encrypt(payload []byte) []byte {
+	salt := make([]byte, passphraseSaltSize)
+
+	// The system random source doesn't fail on supported platforms.
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+
+	header := &bytes.Buffer{}
+	header.Write(passphraseMagic)
+	header.WriteByte(passphraseVersionGCM)
+	binary.Write(header, binary.BigEndian, c.cfg.Time)
+	binary.Write(header, binary.BigEndian, c.cfg.Memory)
+	header.WriteByte(c.cfg.Threads)
+	header.Write(salt)
+
+	gcm := c.cipher(passphraseVersionGCM, salt, c.cfg.Time, c.cfg.Memory, c.cfg.Threads)
+
+	return append(header.Bytes(), gcm.Encrypt(payload)...)
+}
+
+func (c *Passphrase) Decrypt(payload []byte) ([]byte, error) {
+	if !IsPassphrasePayload(payload) {
+		if c.cfg.Legacy == nil {
+			return nil, ErrLegacyPayload
+		}
+
+		return c.cfg.Legacy.Decrypt(payload)
+	}
+
+	if len(payload) < passphraseHeaderSize {
+		return nil, errors.New("payload header is truncated")
+	}
+
+	header := payload[len(passphraseMagic):passphraseHeaderSize]
+
+	version := header[0]
+	time := binary.BigEndian.Uint32(header[1:5])
+	memory := binary.BigEndian.Uint32(header[5:9])
+	threads := header[9]
+	salt := header[10:]
+
+	if version != passphraseVersionCBC && version != passphraseVersionGCM {
+		return nil, errors.Errorf("unsupported payload version: %d", version)
+	}
+
+	if time == 0 || time > maxArgon2Time || memory == 0 || memory > maxArgon2Memory || threads == 0 {
+		return nil, errors.New("invalid key derivation parameters")
+	}
+
+	decrypted, err := c.cipher(version, salt, time, memory, threads).Decrypt(payload[passphraseHeaderSize:])
+	if err != nil {
+		return nil, errors.Wrap(err, "wrong passphrase or corrupted payload")
+	}
+
+	return decrypted, nil
+}
+
+func (c *Passphrase) cipher(version byte, salt []byte, time, memory uint32, threads uint8) interface {
+	Encrypt([]byte) []byte
+	Decrypt([]byte) ([]byte, error)
+} {
+	// Keys of a valid size never fail.
+	if version == passphraseVersionCBC {
+		key := argon2.IDKey(c.cfg.Passphrase, salt, time, memory, threads, 32+16)
+		cbc, _ := NewAesCbc(AesCbcConfig{
+			Key: key[:32],
+			IV:  key[32:],
+		})
+
+		return cbc
+	}
+
+	gcm, _ := NewAesGcm(AesGcmConfig{
+		Key: argon2.IDKey(c.cfg.Passphrase, salt, time, memory, threads, 32),
+	})
+
+	return gcm
+}
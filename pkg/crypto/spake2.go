@@ -0,0 +1,155 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+
+	"distributed-backup/pkg/crypto/internal/nistec"
+
+	"github.com/pkg/errors"
+)
+
+// spake2Label binds SPAKE2 points and keys to this protocol.
+const spake2Label = "distributed-backup SPAKE2 P-256 v2"
+
+// spake2M and spake2N are points sides A and B mask their shares with, derived
+// from spake2Label so that nobody knows their discrete logarithms.
+var (
+	spake2M = spake2Point("M")
+	spake2N = spake2Point("N")
+)
+
+// SPAKE2 is a side of a password-authenticated key exchange (see: RFC 9382)
+// over P-256. Both sides get the same key if they've used the same password,
+// and neither a peer nor an eavesdropper learns anything to guess a password
+// offline, so a short one (e.g. a pairing code) is enough as long as the other
+// side can try a single guess per exchange.
+//
+// Group operations are constant-time (see: nistec), and a key covers a whole
+// transcript of an exchange along with a context both sides must agree on, e.g.
+// fingerprints of certificates of a connection an exchange runs over, so that
+// a key got by relaying messages between two other connections doesn't match.
+type SPAKE2 struct {
+	sideA   bool
+	context []byte
+	w       []byte
+	x       []byte
+	msg     []byte
+}
+
+// NewSPAKE2 starts an exchange of either side A or side B, which must be taken
+// by the other peer, within context.
+func NewSPAKE2(password, context []byte, sideA bool) (*SPAKE2, error) {
+	h := sha256.New()
+	writeSPAKE2Field(h, []byte(spake2Label))
+	writeSPAKE2Field(h, password)
+
+	// Scalars are reduced modulo a group order by ScalarMult, which biases a
+	// 256 bits long value by less than 2^-32.
+	w := h.Sum(nil)
+
+	x := make([]byte, 32)
+	if _, err := rand.Read(x); err != nil {
+		return nil, err
+	}
+
+	mask := spake2N
+	if sideA {
+		mask = spake2M
+	}
+
+	// T = x·G + w·M, where M is a mask of this side.
+	t, err := nistec.NewP256Point().ScalarMult(nistec.NewP256Point().SetGenerator(), x)
+	if err != nil {
+		return nil, err
+	}
+
+	wm, err := nistec.NewP256Point().ScalarMult(mask, w)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SPAKE2{
+		sideA:   sideA,
+		context: context,
+		w:       w,
+		x:       x,
+		msg:     t.Add(t, wm).Bytes(),
+	}, nil
+}
+
+// Message returns a share of this side to send to the other one.
+func (s *SPAKE2) Message() []byte {
+	return s.msg
+}
+
+// Finish takes a share of the other side and returns a 32 bytes long key. Keys
+// of both sides are equal only if they've used the same password and context,
+// which is to be confirmed by proving knowledge of a key.
+func (s *SPAKE2) Finish(peerMsg []byte) ([]byte, error) {
+	// Only an uncompressed point is a share, which also refuses the point at
+	// infinity.
+	if len(peerMsg) != len(s.msg) {
+		return nil, errors.New("malformed SPAKE2 message")
+	}
+
+	peer, err := nistec.NewP256Point().SetBytes(peerMsg)
+	if err != nil {
+		return nil, errors.New("malformed SPAKE2 message")
+	}
+
+	mask := spake2M
+	if s.sideA {
+		mask = spake2N
+	}
+
+	// K = x·(T' - w·M'), where M' is a mask of the other side.
+	wm, err := nistec.NewP256Point().ScalarMult(mask, s.w)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := nistec.NewP256Point().ScalarMult(peer.Add(peer, wm.Negate(1)), s.x)
+	if err != nil {
+		return nil, err
+	}
+
+	kb := k.Bytes()
+	if len(kb) == 1 {
+		return nil, errors.New("malformed SPAKE2 message")
+	}
+
+	msgA, msgB := s.msg, peerMsg
+	if !s.sideA {
+		msgA, msgB = peerMsg, s.msg
+	}
+
+	h := sha256.New()
+
+	for _, field := range [][]byte{[]byte(spake2Label), s.context, msgA, msgB, kb, s.w} {
+		writeSPAKE2Field(h, field)
+	}
+
+	return h.Sum(nil), nil
+}
+
+// writeSPAKE2Field writes a length-prefixed field of a transcript to h.
+func writeSPAKE2Field(h hash.Hash, field []byte) {
+	h.Write(binary.LittleEndian.AppendUint64(nil, uint64(len(field))))
+	h.Write(field)
+}
+
+// spake2Point hashes a seed until a hash is an x coordinate of a point of P-256.
+func spake2Point(seed string) *nistec.P256Point {
+	for i := 0; ; i++ {
+		h := sha256.Sum256([]byte(fmt.Sprintf("%s %s %d", spake2Label, seed, i)))
+
+		p, err := nistec.NewP256Point().SetBytes(append([]byte{2}, h[:]...))
+		if err == nil {
+			return p
+		}
+	}
+}
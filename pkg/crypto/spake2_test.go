@@ -0,0 +1,80 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func exchangeSPAKE2(t *testing.T, passwordA, contextA, passwordB, contextB string) (keyA, keyB []byte) {
+	t.Helper()
+
+	a, err := NewSPAKE2([]byte(passwordA), []byte(contextA), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewSPAKE2([]byte(passwordB), []byte(contextB), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keyA, err = a.Finish(b.Message()); err != nil {
+		t.Fatal(err)
+	}
+
+	if keyB, err = b.Finish(a.Message()); err != nil {
+		t.Fatal(err)
+	}
+
+	return keyA, keyB
+}
+
+func TestSPAKE2(t *testing.T) {
+	for _, tt := range []struct {
+		name                                     string
+		passwordA, contextA, passwordB, contextB string
+		equal                                    bool
+	}{
+		{"same password and context", "code", "certs", "code", "certs", true},
+		{"other password", "code", "certs", "cod3", "certs", false},
+		{"other context", "code", "certs", "code", "other certs", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			keyA, keyB := exchangeSPAKE2(t, tt.passwordA, tt.contextA, tt.passwordB, tt.contextB)
+
+			if bytes.Equal(keyA, keyB) != tt.equal {
+				t.Errorf("keys are equal: %v, want %v", !tt.equal, tt.equal)
+			}
+		})
+	}
+}
+
+func TestSPAKE2KeysDifferPerExchange(t *testing.T) {
+	key1, _ := exchangeSPAKE2(t, "code", "certs", "code", "certs")
+	key2, _ := exchangeSPAKE2(t, "code", "certs", "code", "certs")
+
+	if bytes.Equal(key1, key2) {
+		t.Error("keys of two exchanges are equal")
+	}
+}
+
+func TestSPAKE2RefusesMalformedMessages(t *testing.T) {
+	s, err := NewSPAKE2([]byte("code"), nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offCurve := append([]byte(nil), s.Message()...)
+	offCurve[len(offCurve)-1] ^= 1
+
+	for name, msg := range map[string][]byte{
+		"empty":     nil,
+		"infinity":  {0},
+		"truncated": s.Message()[:33],
+		"off curve": offCurve,
+	} {
+		if _, err := s.Finish(msg); err == nil {
+			t.Errorf("%s message is taken", name)
+		}
+	}
+}
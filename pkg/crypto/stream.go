@@ -0,0 +1,239 @@
+package crypto
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	streamMagic = "DBSTRM1"
+	// streamHeaderSize is a size of a magic, Argon2id parameters and a salt a key
+	// of a stream is derived with.
+	streamHeaderSize = len(streamMagic) + 4 + 4 + 1 + passphraseSaltSize
+
+	// streamChunkSize is a size of a plain chunk, a sealed one fits a single
+	// message of a data channel.
+	streamChunkSize = 32 << 10
+
+	// StreamExt is an extension of names encrypted streams are sent and stored
+	// with.
+	StreamExt = ".enc"
+)
+
+var ErrStreamCorrupted = errors.New("encrypted stream is corrupted, truncated or has another key")
+
+// NewStreamWriter writes a header of a stream encrypted with a key derived from
+// a pre-shared key with Argon2id to w, and returns a writer of plain data which
+// must be closed to seal the last chunk. Data is sealed with ChaCha20-Poly1305 in
+// chunks like envelopes (see: envelope.NewWriter()), so that a stream can be
+// neither modified, reordered nor cut off unnoticed.
+func NewStreamWriter(w io.Writer, psk []byte) (io.WriteCloser, error) {
+	if len(psk) == 0 {
+		return nil, errors.New("stream key is empty")
+	}
+
+	header := make([]byte, streamHeaderSize)
+	copy(header, streamMagic)
+
+	params := header[len(streamMagic):]
+	binary.BigEndian.PutUint32(params[0:4], defaultArgon2Time)
+	binary.BigEndian.PutUint32(params[4:8], defaultArgon2Memory)
+	params[8] = defaultArgon2Threads
+
+	if _, err := rand.Read(params[9:]); err != nil {
+		return nil, err
+	}
+
+	aead, err := streamAEAD(psk, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &streamWriter{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, streamChunkSize),
+	}, nil
+}
+
+// NewStreamReader reads a header of an encrypted stream from r, and returns a
+// reader of plain data which fails with ErrStreamCorrupted if the stream is
+// modified, truncated or encrypted with another key.
+func NewStreamReader(r io.Reader, psk []byte) (io.Reader, error) {
+	header := make([]byte, streamHeaderSize)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrStreamCorrupted
+		}
+
+		return nil, err
+	}
+
+	if string(header[:len(streamMagic)]) != streamMagic {
+		return nil, errors.New("not an encrypted stream")
+	}
+
+	aead, err := streamAEAD(psk, header[len(streamMagic):])
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamReader{
+		r:     bufio.NewReaderSize(r, streamChunkSize+chacha20poly1305.Overhead),
+		aead:  aead,
+		chunk: make([]byte, streamChunkSize+chacha20poly1305.Overhead),
+	}, nil
+}
+
+// streamAEAD derives a key from psk with Argon2id parameters and a salt of a
+// header.
+func streamAEAD(psk, params []byte) (cipher.AEAD, error) {
+	time := binary.BigEndian.Uint32(params[0:4])
+	memory := binary.BigEndian.Uint32(params[4:8])
+	threads := params[8]
+	salt := params[9:]
+
+	if time == 0 || time > maxArgon2Time || memory == 0 || memory > maxArgon2Memory || threads == 0 {
+		return nil, errors.New("invalid key derivation parameters")
+	}
+
+	return chacha20poly1305.New(argon2.IDKey(psk, salt, time, memory, threads, chacha20poly1305.KeySize))
+}
+
+// streamNonce returns a nonce of a chunk: its big-endian number followed by a
+// flag of the last chunk.
+func streamNonce(counter uint64, last bool) []byte {
+	n := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(n[3:11], counter)
+
+	if last {
+		n[len(n)-1] = 1
+	}
+
+	return n
+}
+
+type streamWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	closed  bool
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to a closed stream")
+	}
+
+	n := len(p)
+
+	for len(p) > 0 {
+		// A full chunk is sealed only once more data comes, since the last one
+		// is sealed differently.
+		if len(w.buf) == streamChunkSize {
+			if err := w.seal(false); err != nil {
+				return n - len(p), err
+			}
+		}
+
+		k := copy(w.buf[len(w.buf):streamChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+k]
+		p = p[k:]
+	}
+
+	return n, nil
+}
+
+// Close seals the last chunk. It does not close the underlying writer.
+func (w *streamWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+
+	return w.seal(true)
+}
+
+func (w *streamWriter) seal(last bool) error {
+	sealed := w.aead.Seal(nil, streamNonce(w.counter, last), w.buf, nil)
+	w.counter++
+	w.buf = w.buf[:0]
+
+	_, err := w.w.Write(sealed)
+
+	return err
+}
+
+type streamReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	chunk   []byte
+	plain   []byte
+	counter uint64
+	done    bool
+	err     error
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		if r.done {
+			return 0, io.EOF
+		}
+
+		r.err = r.open()
+	}
+
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+
+	return n, nil
+}
+
+// open reads and opens the next chunk. A chunk is the last one if it's shorter
+// than a full one or nothing follows it.
+func (r *streamReader) open() error {
+	n, err := io.ReadFull(r.r, r.chunk)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return ErrStreamCorrupted
+		}
+
+		return err
+	}
+
+	last := n < len(r.chunk)
+	if !last {
+		if _, err := r.r.Peek(1); err == io.EOF {
+			last = true
+		}
+	}
+
+	plain, err := r.aead.Open(r.chunk[:0], streamNonce(r.counter, last), r.chunk[:n], nil)
+	if err != nil {
+		return ErrStreamCorrupted
+	}
+
+	r.counter++
+	r.plain = plain
+	r.done = last
+
+	return nil
+}
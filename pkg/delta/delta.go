@@ -0,0 +1,572 @@
+// Package delta transfers only changed parts of a file whose previous version a
+// receiver already has, in the way rsync does.
+//
+// A receiver splits its version of a file into blocks and sends a signature of
+// them (see: Sign()): a weak rolling checksum and a strong hash of every block. A
+// sender slides a window of a block size over a new version of a file, rolling
+// the weak checksum a byte at a time, and compares it with the signature, so
+// that blocks are found at any offset. A delta made by an encoder (see:
+// NewEncoder()) references blocks which match and carries the rest literally, and
+// a receiver reconstructs a new version of a file of its previous version and a
+// delta (see: Patch()). A delta ends with a SHA-256 hash of a new version, which
+// is checked after reconstruction.
+//
+// Data appended to a file costs its own size plus a block at most, so large
+// append-mostly files (logs, mail stores, databases) are transferred in a
+// fraction of their size.
+
+package delta
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MinBlockSize and MaxBlockSize bound a block size which grows as a square
+	// root of a file size, so that a signature stays small for large files.
+	MinBlockSize = 2 << 10
+	MaxBlockSize = 128 << 10
+
+	// StrongLen is a length of a truncated SHA-256 hash of a block.
+	StrongLen = 16
+
+	// maxLiteral bounds a literal of a delta, so that an encoder buffers a
+	// limited amount of data.
+	maxLiteral = 64 << 10
+
+	opEnd     = 0
+	opCopy    = 1
+	opLiteral = 2
+)
+
+var (
+	// ErrMismatch means that a file reconstructed of a delta differs from one a
+	// delta was made of, e.g. since a delta was made against another version.
+	ErrMismatch = errors.New("delta: reconstructed file mismatch")
+
+	errFormat = errors.New("delta: malformed data")
+)
+
+// Signature describes blocks of a previous version of a file. The last block
+// is shorter than BlockSize unless Size is a multiple of it.
+type Signature struct {
+	BlockSize int
+	Size      int64
+	Blocks    []Block
+}
+
+type Block struct {
+	Weak   uint32
+	Strong [StrongLen]byte
+}
+
+// BlockSize returns a block size of a file of size.
+func BlockSize(size int64) int {
+	bs := int(math.Sqrt(float64(size)))
+
+	switch {
+	case bs < MinBlockSize:
+		return MinBlockSize
+	case bs > MaxBlockSize:
+		return MaxBlockSize
+	}
+
+	// A multiple of 1 KiB keeps block boundaries aligned with pages.
+	return bs &^ (1<<10 - 1)
+}
+
+// Sign reads a file of size from r and returns its signature.
+func Sign(r io.Reader, size int64) (*Signature, error) {
+	sig := &Signature{
+		BlockSize: BlockSize(size),
+	}
+
+	buf := make([]byte, sig.BlockSize)
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, newBlock(buf[:n]))
+			sig.Size += int64(n)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func newBlock(b []byte) Block {
+	block := Block{
+		Weak: weakSum(b),
+	}
+
+	sum := sha256.Sum256(b)
+	copy(block.Strong[:], sum[:])
+
+	return block
+}
+
+// WriteTo writes a signature as a block size, a file size and blocks.
+func (s *Signature) WriteTo(w io.Writer) (int64, error) {
+	b := binary.AppendUvarint(nil, uint64(s.BlockSize))
+	b = binary.AppendUvarint(b, uint64(s.Size))
+
+	n, err := w.Write(b)
+	if err != nil {
+		return int64(n), err
+	}
+
+	written := int64(n)
+	buf := make([]byte, 4+StrongLen)
+
+	for _, block := range s.Blocks {
+		binary.BigEndian.PutUint32(buf, block.Weak)
+		copy(buf[4:], block.Strong[:])
+
+		n, err := w.Write(buf)
+		written += int64(n)
+
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// Reader is a reader a signature or a delta is read from.
+type Reader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// ReadSignature reads a signature written by WriteTo().
+func ReadSignature(r Reader) (*Signature, error) {
+	bs, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if bs < MinBlockSize || bs > MaxBlockSize || size > math.MaxInt64 {
+		return nil, errFormat
+	}
+
+	sig := &Signature{
+		BlockSize: int(bs),
+		Size:      int64(size),
+		Blocks:    make([]Block, 0, (size+bs-1)/bs),
+	}
+
+	buf := make([]byte, 4+StrongLen)
+
+	for i := uint64(0); i < (size+bs-1)/bs; i++ {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		block := Block{
+			Weak: binary.BigEndian.Uint32(buf),
+		}
+
+		copy(block.Strong[:], buf[4:])
+
+		sig.Blocks = append(sig.Blocks, block)
+	}
+
+	return sig, nil
+}
+
+// lastLen returns a length of the last block.
+func (s *Signature) lastLen() int {
+	if len(s.Blocks) == 0 {
+		return 0
+	}
+
+	return int(s.Size - int64(len(s.Blocks)-1)*int64(s.BlockSize))
+}
+
+// weakSum returns the rsync rolling checksum of b: a sum of bytes and a sum of
+// the running sums, both modulo 2^16.
+func weakSum(b []byte) uint32 {
+	var s1, s2 uint32
+
+	for i, c := range b {
+		s1 += uint32(c)
+		s2 += uint32(len(b)-i) * uint32(c)
+	}
+
+	return s1&0xffff | s2<<16
+}
+
+// Encoder writes a delta of data written to it against a signature.
+type Encoder struct {
+	sig   *Signature
+	index map[uint32][]int
+	w     io.Writer
+	hash  hash.Hash
+
+	buf []byte
+	// pos is a start of a window within buf, and lit is a start of a literal
+	// which isn't written yet.
+	pos int
+	lit int
+
+	// s1 and s2 are parts of a weak checksum of a window if valid is set.
+	s1, s2 uint32
+	valid  bool
+
+	// copyFrom and copyCount are a run of consecutive blocks which isn't written
+	// yet.
+	copyFrom  int
+	copyCount int
+
+	matched int64
+	err     error
+}
+
+// NewEncoder returns an encoder which writes a delta to w.
+func NewEncoder(sig *Signature, w io.Writer) *Encoder {
+	e := &Encoder{
+		sig:   sig,
+		index: make(map[uint32][]int, len(sig.Blocks)),
+		w:     w,
+		hash:  sha256.New(),
+	}
+
+	// The last short block can match the tail of a file only.
+	full := len(sig.Blocks)
+	if sig.lastLen() != sig.BlockSize {
+		full--
+	}
+
+	for i := 0; i < full; i++ {
+		weak := sig.Blocks[i].Weak
+		e.index[weak] = append(e.index[weak], i)
+	}
+
+	e.writeUvarint(uint64(sig.BlockSize))
+	e.writeUvarint(uint64(sig.Size))
+
+	return e
+}
+
+// Matched returns a number of bytes found in a previous version, which aren't
+// carried by a delta.
+func (e *Encoder) Matched() int64 {
+	return e.matched
+}
+
+func (e *Encoder) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+
+	e.hash.Write(p)
+	e.buf = append(e.buf, p...)
+	e.encode()
+
+	return len(p), e.err
+}
+
+// Close writes the rest of a delta, it doesn't close an underlying writer.
+func (e *Encoder) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+
+	e.encode()
+
+	tail := e.buf[e.pos:]
+	last := len(e.sig.Blocks) - 1
+
+	if last >= 0 && len(tail) > 0 && len(tail) == e.sig.lastLen() && e.sig.Blocks[last] == newBlock(tail) {
+		e.copyBlock(last)
+	} else {
+		e.pos = len(e.buf)
+	}
+
+	e.flushLiteral()
+	e.flushCopy()
+
+	e.write([]byte{opEnd})
+	e.write(e.hash.Sum(nil))
+
+	return e.err
+}
+
+// encode slides a window over buffered data until less than a block is left.
+func (e *Encoder) encode() {
+	bs := e.sig.BlockSize
+
+	for e.err == nil && len(e.buf)-e.pos >= bs {
+		window := e.buf[e.pos : e.pos+bs]
+
+		if !e.valid {
+			weak := weakSum(window)
+			e.s1, e.s2 = weak&0xffff, weak>>16
+			e.valid = true
+		}
+
+		if i, ok := e.match(window); ok {
+			e.copyBlock(i)
+
+			continue
+		}
+
+		// The next byte is needed to roll a checksum.
+		if len(e.buf)-e.pos == bs {
+			break
+		}
+
+		out, in := uint32(window[0]), uint32(e.buf[e.pos+bs])
+		e.s1 = (e.s1 - out + in) & 0xffff
+		e.s2 = (e.s2 - uint32(bs)*out + e.s1) & 0xffff
+		e.pos++
+
+		if e.pos-e.lit >= maxLiteral {
+			e.flushLiteral()
+		}
+	}
+
+	// Data before a literal is written, so it's dropped.
+	if e.lit > maxLiteral {
+		n := copy(e.buf, e.buf[e.lit:])
+		e.buf = e.buf[:n]
+		e.pos -= e.lit
+		e.lit = 0
+	}
+}
+
+// match looks a window up in a signature, a block continuing a run is preferred.
+func (e *Encoder) match(window []byte) (int, bool) {
+	candidates := e.index[e.s1|e.s2<<16]
+	if len(candidates) == 0 {
+		return 0, false
+	}
+
+	block := newBlock(window)
+	found := -1
+
+	for _, i := range candidates {
+		if e.sig.Blocks[i].Strong != block.Strong {
+			continue
+		}
+
+		if e.copyCount != 0 && i == e.copyFrom+e.copyCount {
+			return i, true
+		}
+
+		if found < 0 {
+			found = i
+		}
+	}
+
+	return found, found >= 0
+}
+
+// copyBlock references block i in place of a window.
+func (e *Encoder) copyBlock(i int) {
+	e.flushLiteral()
+
+	if e.copyCount != 0 && i != e.copyFrom+e.copyCount {
+		e.flushCopy()
+	}
+
+	if e.copyCount == 0 {
+		e.copyFrom = i
+	}
+
+	e.copyCount++
+
+	n := e.sig.BlockSize
+	if i == len(e.sig.Blocks)-1 {
+		n = e.sig.lastLen()
+	}
+
+	e.matched += int64(n)
+	e.pos += n
+	e.lit = e.pos
+	e.valid = false
+}
+
+func (e *Encoder) flushCopy() {
+	if e.copyCount == 0 {
+		return
+	}
+
+	e.write([]byte{opCopy})
+	e.writeUvarint(uint64(e.copyFrom))
+	e.writeUvarint(uint64(e.copyCount))
+
+	e.copyCount = 0
+}
+
+func (e *Encoder) flushLiteral() {
+	if e.pos == e.lit {
+		return
+	}
+
+	e.flushCopy()
+
+	for e.lit < e.pos {
+		n := e.pos - e.lit
+		if n > maxLiteral {
+			n = maxLiteral
+		}
+
+		e.write([]byte{opLiteral})
+		e.writeUvarint(uint64(n))
+		e.write(e.buf[e.lit : e.lit+n])
+
+		e.lit += n
+	}
+}
+
+func (e *Encoder) writeUvarint(v uint64) {
+	e.write(binary.AppendUvarint(nil, v))
+}
+
+func (e *Encoder) write(b []byte) {
+	if e.err != nil {
+		return
+	}
+
+	_, e.err = e.w.Write(b)
+}
+
+// Patch reconstructs a new version of a file of its previous version base and a
+// delta read from r, and writes it to w. It returns a number of bytes written and
+// a number of them copied from base. A delta must be followed by the end of r.
+func Patch(base io.ReaderAt, r Reader, w io.Writer) (int64, int64, error) {
+	bs, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, 0, unexpectedEOF(err)
+	}
+
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, 0, unexpectedEOF(err)
+	}
+
+	if bs < MinBlockSize || bs > MaxBlockSize || size > math.MaxInt64 {
+		return 0, 0, errFormat
+	}
+
+	h := sha256.New()
+	cw := &countingWriter{w: io.MultiWriter(w, h)}
+
+	var copied int64
+
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return cw.n, copied, unexpectedEOF(err)
+		}
+
+		switch op {
+		case opCopy:
+			from, err := binary.ReadUvarint(r)
+			if err != nil {
+				return cw.n, copied, unexpectedEOF(err)
+			}
+
+			count, err := binary.ReadUvarint(r)
+			if err != nil {
+				return cw.n, copied, unexpectedEOF(err)
+			}
+
+			blocks := (size + bs - 1) / bs
+
+			if count == 0 || from >= blocks || count > blocks-from {
+				return cw.n, copied, errFormat
+			}
+
+			offset := int64(from * bs)
+			n := int64(count * bs)
+
+			if offset+n > int64(size) {
+				n = int64(size) - offset
+			}
+
+			if _, err := io.Copy(cw, io.NewSectionReader(base, offset, n)); err != nil {
+				return cw.n, copied, err
+			}
+
+			copied += n
+		case opLiteral:
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return cw.n, copied, unexpectedEOF(err)
+			}
+
+			if n > maxLiteral {
+				return cw.n, copied, errFormat
+			}
+
+			if _, err := io.CopyN(cw, r, int64(n)); err != nil {
+				return cw.n, copied, unexpectedEOF(err)
+			}
+		case opEnd:
+			sum := make([]byte, sha256.Size)
+
+			if _, err := io.ReadFull(r, sum); err != nil {
+				return cw.n, copied, unexpectedEOF(err)
+			}
+
+			if !bytes.Equal(sum, h.Sum(nil)) {
+				return cw.n, copied, ErrMismatch
+			}
+
+			// Reading the end of r lets it verify its own checksum if it has
+			// one.
+			if _, err := r.ReadByte(); err != io.EOF {
+				if err == nil {
+					err = errFormat
+				}
+
+				return cw.n, copied, err
+			}
+
+			return cw.n, copied, nil
+		default:
+			return cw.n, copied, errFormat
+		}
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+
+	return n, err
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
@@ -0,0 +1,257 @@
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func random(n int, seed int64) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+
+	return b
+}
+
+// makeDelta returns a delta of data against a signature of base, written to an
+// encoder writeSize bytes at a time, and a number of bytes it matched.
+func makeDelta(t *testing.T, base, data []byte, writeSize int) ([]byte, int64) {
+	t.Helper()
+
+	sig, err := Sign(bytes.NewReader(base), int64(len(base)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+
+	e := NewEncoder(sig, &b)
+
+	for p := data; len(p) > 0; {
+		n := writeSize
+		if n > len(p) {
+			n = len(p)
+		}
+
+		if _, err := e.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+
+		p = p[n:]
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes(), e.Matched()
+}
+
+// TestDelta makes deltas of changes of a file and reconstructs its new version
+// of each of them. A delta is checked to carry no more than changed data and
+// a few blocks.
+func TestDelta(t *testing.T) {
+	base := random(300<<10, 1)
+	bs := BlockSize(int64(len(base)))
+	small := random(1000, 2)
+
+	for _, tt := range []struct {
+		name string
+		base []byte
+		data []byte
+		// changed is a size of data which isn't found in a base.
+		changed int
+	}{
+		{"empty", nil, nil, 0},
+		{"empty base", nil, small, len(small)},
+		{"empty version", base, nil, 0},
+		{"small", small, small, 0},
+		{"same", base, base, 0},
+		{"appended", base, concat(base, random(5000, 3)), 5000},
+		{"prepended", base, concat(random(777, 4), base), 777},
+		{"inserted", base, concat(base[:100000], random(10, 5), base[100000:]), 10},
+		{"removed", base, concat(base[:100000], base[150000:]), 0},
+		{"byte changed", base, concat(base[:12345], []byte{^base[12345]}, base[12346:]), 1},
+		{"truncated", base, base[:len(base)-bs/2], 0},
+		{"reordered", base, concat(base[200000:], base[:200000]), 0},
+		{"replaced", base, random(len(base), 6), len(base)},
+		{"longer than literals", small, random(3*maxLiteral+1, 7), 3*maxLiteral + 1},
+	} {
+		for _, writeSize := range []int{len(tt.data) + 1, 1000, 1} {
+			if writeSize == 1 && len(tt.data) > 100<<10 {
+				continue
+			}
+
+			d, matched := makeDelta(t, tt.base, tt.data, writeSize)
+
+			var out bytes.Buffer
+
+			n, copied, err := Patch(bytes.NewReader(tt.base), bufio.NewReader(bytes.NewReader(d)), &out)
+			if err != nil {
+				t.Fatalf("%s, writes of %d bytes: %v", tt.name, writeSize, err)
+			}
+
+			if !bytes.Equal(out.Bytes(), tt.data) || n != int64(len(tt.data)) {
+				t.Fatalf("%s, writes of %d bytes: reconstructed file mismatch", tt.name, writeSize)
+			}
+
+			if copied != matched {
+				t.Errorf("%s, writes of %d bytes: %d bytes are copied, %d are matched", tt.name, writeSize, copied, matched)
+			}
+
+			// Changed data costs a block around it at most, and the last short
+			// block of a base is only found at the end of a file.
+			if limit := int64(len(tt.data) - tt.changed - 2*bs); matched < limit {
+				t.Errorf("%s, writes of %d bytes: %d bytes are matched, %d at least expected", tt.name, writeSize, matched, limit)
+			}
+
+			if limit := tt.changed + 2*bs + 100; len(d) > limit && tt.changed != len(tt.data) {
+				t.Errorf("%s, writes of %d bytes: delta of %d bytes, %d at most expected", tt.name, writeSize, len(d), limit)
+			}
+		}
+	}
+}
+
+// TestDeltaAppended checks that all of a base is matched once data is appended
+// to it, as it is to logs.
+func TestDeltaAppended(t *testing.T) {
+	base := random(10*MinBlockSize, 1)
+	appended := random(100, 2)
+
+	d, matched := makeDelta(t, base, concat(base, appended), 4096)
+
+	if matched != int64(len(base)) {
+		t.Errorf("%d bytes are matched, %d expected", matched, len(base))
+	}
+
+	if len(d) > len(appended)+64 {
+		t.Errorf("delta of %d bytes, %d appended", len(d), len(appended))
+	}
+}
+
+// TestPatchMismatch applies a delta to a base which isn't the one it's made
+// against.
+func TestPatchMismatch(t *testing.T) {
+	base := random(100<<10, 1)
+	data := concat(base, random(100, 2))
+
+	d, _ := makeDelta(t, base, data, len(data))
+
+	other := append([]byte(nil), base...)
+	other[5000] ^= 1
+
+	_, _, err := Patch(bytes.NewReader(other), bufio.NewReader(bytes.NewReader(d)), io.Discard)
+	if !errors.Is(err, ErrMismatch) {
+		t.Errorf("delta is applied to another base: %v", err)
+	}
+}
+
+// TestPatchRefusesMalformed checks that truncated and malformed deltas are
+// refused.
+func TestPatchRefusesMalformed(t *testing.T) {
+	base := random(100<<10, 1)
+	data := concat(base[:50000], random(100, 2), base[50000:])
+
+	d, _ := makeDelta(t, base, data, len(data))
+
+	patch := func(d []byte) error {
+		_, _, err := Patch(bytes.NewReader(base), bufio.NewReader(bytes.NewReader(d)), io.Discard)
+
+		return err
+	}
+
+	for i := 0; i < len(d); i += len(d)/50 + 1 {
+		if err := patch(d[:i]); err == nil {
+			t.Fatalf("delta truncated to %d of %d bytes is applied", i, len(d))
+		}
+	}
+
+	if err := patch(append(d, 0)); err == nil {
+		t.Error("delta followed by data is applied")
+	}
+
+	for _, tt := range []struct {
+		name  string
+		delta []byte
+	}{
+		{"small block", []byte{0x80, 0x08, 0x00}},
+		{"big block", []byte{0x80, 0x80, 0x10, 0x00}},
+		{"unknown operation", []byte{0x80, 0x10, 0x00, 0x7F}},
+		{"copy beyond a base", []byte{0x80, 0x10, 0x80, 0x10, opCopy, 1, 1}},
+		{"empty copy", []byte{0x80, 0x10, 0x80, 0x10, opCopy, 0, 0}},
+		{"long literal", []byte{0x80, 0x10, 0x00, opLiteral, 0x81, 0x80, 0x04}},
+	} {
+		if err := patch(tt.delta); !errors.Is(err, errFormat) {
+			t.Errorf("%s: %v, %v expected", tt.name, err, errFormat)
+		}
+	}
+}
+
+func TestSignature(t *testing.T) {
+	for _, size := range []int{0, 1, MinBlockSize, MinBlockSize + 1, 1 << 20} {
+		sig, err := Sign(bytes.NewReader(random(size, int64(size))), int64(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+
+		if _, err := sig.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+
+		encoded := b.Bytes()
+
+		read, err := ReadSignature(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if read.BlockSize != sig.BlockSize || read.Size != sig.Size || len(read.Blocks) != len(sig.Blocks) {
+			t.Fatalf("signature of %d bytes: %d blocks of %d bytes are read, %d of %d expected",
+				size, len(read.Blocks), read.BlockSize, len(sig.Blocks), sig.BlockSize)
+		}
+
+		for i := range sig.Blocks {
+			if read.Blocks[i] != sig.Blocks[i] {
+				t.Fatalf("signature of %d bytes: block %d mismatch", size, i)
+			}
+		}
+
+		if size != 0 {
+			if _, err := ReadSignature(bytes.NewReader(encoded[:len(encoded)-1])); !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("truncated signature of %d bytes: %v", size, err)
+			}
+		}
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	for _, tt := range []struct {
+		size      int64
+		blockSize int
+	}{
+		{0, MinBlockSize},
+		{1 << 20, MinBlockSize},
+		{100 << 20, 10 << 10},
+		{1 << 40, MaxBlockSize},
+	} {
+		if bs := BlockSize(tt.size); bs != tt.blockSize {
+			t.Errorf("block size of %d bytes is %d, %d expected", tt.size, bs, tt.blockSize)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+// Package envelope seals a stream for a recipient identity, so that it can be
+// stored and forwarded by intermediate peers which can't read it. An envelope is
+// a plain header routing it to the next hops followed by a payload encrypted end
+// to end: a key is agreed with X25519 between an ephemeral key of a sender and a
+// recipient's identity, and data is sealed with AES-256-GCM in chunks.
+package envelope
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	magic = "DBENVLP1"
+	// maxHeaderLen bounds a header read from a stream which isn't trusted.
+	maxHeaderLen = 64 << 10
+
+	// chunkSize is a size of a payload chunk, a sealed one fits a single message
+	// of a data channel.
+	chunkSize = 32 << 10
+	tagSize   = 16
+	nonceSize = 12
+
+	keyInfo = "distributed-backup envelope v1"
+
+	// Ext is an extension of names envelopes are sent and stored with.
+	Ext = ".envelope"
+)
+
+var (
+	ErrNotEnvelope = errors.New("envelope: not an envelope")
+	// ErrNotRecipient means that an envelope is addressed to another identity.
+	ErrNotRecipient = errors.New("envelope: addressed to another recipient")
+	errCorrupted    = errors.New("envelope: payload is corrupted or truncated")
+)
+
+// Header is a plain part of an envelope, which intermediate peers read to route
+// it. Route is a list of session IDs of the next hops, the last one is a session
+// of a recipient. Recipient and Ephemeral are public keys a payload key is agreed
+// between.
+type Header struct {
+	Route     []string `json:"route"`
+	Recipient string   `json:"recipient"`
+	Ephemeral string   `json:"ephemeral"`
+}
+
+// NextHop returns a session ID of a peer an envelope should be forwarded to, or
+// an empty string if it has reached a recipient.
+func (h *Header) NextHop() string {
+	if len(h.Route) == 0 {
+		return ""
+	}
+
+	return h.Route[0]
+}
+
+// ReadHeader reads a header of an envelope, a payload follows it in r.
+func ReadHeader(r io.Reader) (*Header, error) {
+	var prefix [len(magic) + 4]byte
+
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotEnvelope
+		}
+
+		return nil, err
+	}
+
+	if string(prefix[:len(magic)]) != magic {
+		return nil, ErrNotEnvelope
+	}
+
+	n := binary.BigEndian.Uint32(prefix[len(magic):])
+	if n > maxHeaderLen {
+		return nil, errors.New("envelope: header is too long")
+	}
+
+	b := make([]byte, n)
+
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, errors.Wrap(err, "envelope header")
+	}
+
+	h := &Header{}
+	if err := json.Unmarshal(b, h); err != nil {
+		return nil, errors.Wrap(err, "envelope header")
+	}
+
+	return h, nil
+}
+
+// WriteHeader writes a header of an envelope, which is also used to forward an
+// envelope with a route shortened by a hop.
+func WriteHeader(w io.Writer, h *Header) error {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+
+	buf := append([]byte(magic), binary.BigEndian.AppendUint32(nil, uint32(len(b)))...)
+
+	_, err = w.Write(append(buf, b...))
+
+	return err
+}
+
+// Identity is a private key envelopes are opened with, a public part of it is
+// given to senders as a recipient.
+type Identity struct {
+	key *ecdh.PrivateKey
+}
+
+func GenerateIdentity() (*Identity, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{key: key}, nil
+}
+
+// LoadIdentity reads an identity saved with Save().
+func LoadIdentity(path string) (*Identity, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, errors.Wrap(err, "identity")
+	}
+
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "identity")
+	}
+
+	return &Identity{key: key}, nil
+}
+
+// Save writes an identity to a file readable by an owner only, it fails if the
+// file exists so that an identity is never replaced by mistake.
+func (i *Identity) Save(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(base64.RawURLEncoding.EncodeToString(i.key.Bytes()) + "\n")
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Recipient returns a public key of an identity encoded for --recipient.
+func (i *Identity) Recipient() string {
+	return encodeKey(i.key.PublicKey())
+}
+
+// ParseRecipient parses a public key of an identity (see: Identity.Recipient()).
+func ParseRecipient(s string) (*ecdh.PublicKey, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.Wrap(err, "recipient")
+	}
+
+	key, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "recipient")
+	}
+
+	return key, nil
+}
+
+func encodeKey(k *ecdh.PublicKey) string {
+	return base64.RawURLEncoding.EncodeToString(k.Bytes())
+}
+
+// NewWriter writes a header of an envelope for a recipient routed through route
+// to w, and returns a writer of a payload which must be closed to seal it.
+func NewWriter(w io.Writer, recipient *ecdh.PublicKey, route []string) (io.WriteCloser, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(shared, ephemeral.PublicKey(), recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Header{
+		Route:     route,
+		Recipient: encodeKey(recipient),
+		Ephemeral: encodeKey(ephemeral.PublicKey()),
+	}
+
+	if err := WriteHeader(w, h); err != nil {
+		return nil, err
+	}
+
+	return &writer{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, chunkSize),
+	}, nil
+}
+
+// Open returns a reader of a payload following a header in r, which fails if the
+// payload is modified or truncated.
+func Open(r io.Reader, h *Header, id *Identity) (io.Reader, error) {
+	if h.Recipient != id.Recipient() {
+		return nil, ErrNotRecipient
+	}
+
+	ephemeral, err := ParseRecipient(h.Ephemeral)
+	if err != nil {
+		return nil, errors.Wrap(err, "envelope ephemeral key")
+	}
+
+	shared, err := id.key.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(shared, ephemeral, id.key.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	return &reader{
+		r:     bufio.NewReaderSize(r, chunkSize+tagSize),
+		aead:  aead,
+		chunk: make([]byte, chunkSize+tagSize),
+	}, nil
+}
+
+// newAEAD derives a payload key from a shared secret with HKDF-SHA256, which is
+// bound to both public keys.
+func newAEAD(shared []byte, ephemeral, recipient *ecdh.PublicKey) (cipher.AEAD, error) {
+	salt := append(ephemeral.Bytes(), recipient.Bytes()...)
+
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(shared)
+
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(keyInfo))
+	expand.Write([]byte{1})
+
+	block, err := aes.NewCipher(expand.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// nonce returns a nonce of a chunk: its big-endian number followed by a flag of
+// the last chunk, so that chunks can be neither reordered nor cut off.
+func nonce(counter uint64, last bool) []byte {
+	n := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(n[3:11], counter)
+
+	if last {
+		n[nonceSize-1] = 1
+	}
+
+	return n
+}
+
+type writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	closed  bool
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("envelope: write to a closed envelope")
+	}
+
+	n := len(p)
+
+	for len(p) > 0 {
+		// A full chunk is sealed only once more data comes, since the last one
+		// is sealed differently.
+		if len(w.buf) == chunkSize {
+			if err := w.seal(false); err != nil {
+				return n - len(p), err
+			}
+		}
+
+		k := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+k]
+		p = p[k:]
+	}
+
+	return n, nil
+}
+
+// Close seals the last chunk. It does not close the underlying writer.
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+
+	return w.seal(true)
+}
+
+func (w *writer) seal(last bool) error {
+	sealed := w.aead.Seal(nil, nonce(w.counter, last), w.buf, nil)
+	w.counter++
+	w.buf = w.buf[:0]
+
+	_, err := w.w.Write(sealed)
+
+	return err
+}
+
+type reader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	chunk   []byte
+	plain   []byte
+	counter uint64
+	done    bool
+	err     error
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		if r.done {
+			return 0, io.EOF
+		}
+
+		r.err = r.open()
+	}
+
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+
+	return n, nil
+}
+
+// open reads and opens the next chunk. A chunk is the last one if it's shorter
+// than a full one or nothing follows it.
+func (r *reader) open() error {
+	n, err := io.ReadFull(r.r, r.chunk)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return errCorrupted
+		}
+
+		return err
+	}
+
+	last := n < len(r.chunk)
+	if !last {
+		if _, err := r.r.Peek(1); err == io.EOF {
+			last = true
+		}
+	}
+
+	plain, err := r.aead.Open(r.chunk[:0], nonce(r.counter, last), r.chunk[:n], nil)
+	if err != nil {
+		return errCorrupted
+	}
+
+	r.counter++
+	r.plain = plain
+	r.done = last
+
+	return nil
+}
+
+// IsEnvelope tells whether a name is one an envelope is sent with.
+func IsEnvelope(name string) bool {
+	return strings.HasSuffix(name, Ext)
+}
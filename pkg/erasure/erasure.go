@@ -0,0 +1,222 @@
+// Package erasure splits data into shards with a systematic Reed–Solomon code, so
+// that data is reconstructed of any k shards of n.
+//
+// Arithmetic is done in GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1 (0x11d).
+// An encoding matrix is a Vandermonde matrix of n rows and k columns multiplied by
+// an inverse of its top square, so that the top k rows are an identity ones
+// (data shards are data itself) and any k rows are still invertible. Parity
+// shards are the rest of rows multiplied by data shards, and missing data shards
+// are found by inverting rows of shards which are present.
+
+package erasure
+
+import (
+	"github.com/pkg/errors"
+)
+
+// MaxShards is the most shards of a code, which is a size of a field.
+const MaxShards = 256
+
+var (
+	expTable [2 * 255]byte
+	logTable [256]byte
+	// mulTable is a product of every pair of elements.
+	mulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			mulTable[a][b] = expTable[int(logTable[a])+int(logTable[b])]
+		}
+	}
+}
+
+func inv(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+// Code encodes k data shards into n shards.
+type Code struct {
+	k, n   int
+	matrix [][]byte
+}
+
+// New returns a code of k data shards and n-k parity shards.
+func New(k, n int) (*Code, error) {
+	if k < 1 || n <= k || n > MaxShards {
+		return nil, errors.Errorf("%d of %d shards: 1 to %d shards are expected, more of them than data ones", k, n, MaxShards)
+	}
+
+	vandermonde := make([][]byte, n)
+
+	for r := range vandermonde {
+		vandermonde[r] = make([]byte, k)
+
+		p := byte(1)
+
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = p
+			p = mulTable[p][byte(r)]
+		}
+	}
+
+	top, err := invert(vandermonde[:k])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Code{k: k, n: n, matrix: multiply(vandermonde, top)}, nil
+}
+
+// DataShards returns k.
+func (c *Code) DataShards() int {
+	return c.k
+}
+
+// Shards returns n.
+func (c *Code) Shards() int {
+	return c.n
+}
+
+// Encode computes parity shards shards[k:] of data shards shards[:k], which are
+// all of the same size.
+func (c *Code) Encode(shards [][]byte) {
+	for r := c.k; r < c.n; r++ {
+		combine(shards[r], c.matrix[r], shards[:c.k])
+	}
+}
+
+// Reconstruct restores missing data shards, which are nil, of at least k shards
+// which are present, all of the same size. Missing parity shards are left nil.
+func (c *Code) Reconstruct(shards [][]byte) error {
+	var (
+		rows    [][]byte
+		present [][]byte
+		size    int
+	)
+
+	for r, shard := range shards {
+		if shard != nil && len(rows) < c.k {
+			rows = append(rows, c.matrix[r])
+			present = append(present, shard)
+			size = len(shard)
+		}
+	}
+
+	if len(rows) < c.k {
+		return errors.Errorf("%d of %d shards are present, %d are needed", len(rows), c.n, c.k)
+	}
+
+	decode, err := invert(rows)
+	if err != nil {
+		return err
+	}
+
+	for r := 0; r < c.k; r++ {
+		if shards[r] == nil {
+			shards[r] = make([]byte, size)
+			combine(shards[r], decode[r], present)
+		}
+	}
+
+	return nil
+}
+
+// combine sets out to a sum of shards multiplied by coefficients.
+func combine(out, coefficients []byte, shards [][]byte) {
+	for i := range out {
+		out[i] = 0
+	}
+
+	for j, shard := range shards {
+		t := &mulTable[coefficients[j]]
+
+		for i, b := range shard {
+			out[i] ^= t[b]
+		}
+	}
+}
+
+func multiply(a, b [][]byte) [][]byte {
+	product := make([][]byte, len(a))
+
+	for r := range a {
+		product[r] = make([]byte, len(b[0]))
+
+		for c := range product[r] {
+			var sum byte
+
+			for i := range b {
+				sum ^= mulTable[a[r][i]][b[i][c]]
+			}
+
+			product[r][c] = sum
+		}
+	}
+
+	return product
+}
+
+// invert returns an inverse of a square matrix with Gauss–Jordan elimination.
+func invert(m [][]byte) ([][]byte, error) {
+	k := len(m)
+	work := make([][]byte, k)
+
+	for r := range m {
+		work[r] = make([]byte, 2*k)
+		copy(work[r], m[r])
+		work[r][k+r] = 1
+	}
+
+	for c := 0; c < k; c++ {
+		pivot := c
+
+		for pivot < k && work[pivot][c] == 0 {
+			pivot++
+		}
+
+		if pivot == k {
+			return nil, errors.New("matrix is singular")
+		}
+
+		work[c], work[pivot] = work[pivot], work[c]
+
+		t := &mulTable[inv(work[c][c])]
+
+		for i := range work[c] {
+			work[c][i] = t[work[c][i]]
+		}
+
+		for r := 0; r < k; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+
+			t := &mulTable[work[r][c]]
+
+			for i := range work[r] {
+				work[r][i] ^= t[work[c][i]]
+			}
+		}
+	}
+
+	for r := range work {
+		work[r] = work[r][k:]
+	}
+
+	return work, nil
+}
@@ -0,0 +1,154 @@
+package erasure
+
+import (
+	"bytes"
+	"math/bits"
+	"math/rand"
+	"testing"
+)
+
+func newTestShards(t *testing.T, c *Code, size int, seed int64) [][]byte {
+	t.Helper()
+
+	r := rand.New(rand.NewSource(seed))
+	shards := make([][]byte, c.Shards())
+
+	for i := range shards {
+		shards[i] = make([]byte, size)
+
+		if i < c.DataShards() {
+			r.Read(shards[i])
+		}
+	}
+
+	c.Encode(shards)
+
+	return shards
+}
+
+// TestReconstruct drops every combination of up to n-k shards of codes of small
+// k and n, and checks that data shards are reconstructed of the rest.
+func TestReconstruct(t *testing.T) {
+	for k := 1; k <= 5; k++ {
+		for n := k + 1; n <= k+4; n++ {
+			c, err := New(k, n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			shards := newTestShards(t, c, 61, int64(k*n))
+
+			for dropped := uint(0); dropped < 1<<n; dropped++ {
+				missing := bits.OnesCount(dropped)
+				if missing > n-k {
+					continue
+				}
+
+				present := make([][]byte, n)
+
+				for i := range shards {
+					if dropped&(1<<i) == 0 {
+						present[i] = append([]byte(nil), shards[i]...)
+					}
+				}
+
+				if err := c.Reconstruct(present); err != nil {
+					t.Fatalf("%d of %d shards, dropped %b: %v", k, n, dropped, err)
+				}
+
+				for i := 0; i < k; i++ {
+					if !bytes.Equal(present[i], shards[i]) {
+						t.Fatalf("%d of %d shards, dropped %b: data shard %d mismatch", k, n, dropped, i)
+					}
+				}
+
+				for i := k; i < n; i++ {
+					if dropped&(1<<i) != 0 && present[i] != nil {
+						t.Fatalf("%d of %d shards, dropped %b: parity shard %d is restored", k, n, dropped, i)
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestReconstructRefusesTooFewShards drops more shards than there are parity
+// ones.
+func TestReconstructRefusesTooFewShards(t *testing.T) {
+	c, err := New(3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shards := newTestShards(t, c, 16, 1)
+	shards[0], shards[2], shards[4] = nil, nil, nil
+
+	if err := c.Reconstruct(shards); err == nil {
+		t.Error("data is reconstructed of 2 of 5 shards, 3 are needed")
+	}
+}
+
+// TestEncodeSystematic checks that data shards are kept as they are, and that
+// the parity shard of a single data shard is its copy.
+func TestEncodeSystematic(t *testing.T) {
+	c, err := New(1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shards := newTestShards(t, c, 100, 2)
+
+	for i := 1; i < 3; i++ {
+		if !bytes.Equal(shards[i], shards[0]) {
+			t.Errorf("parity shard %d of a single data shard isn't its copy", i)
+		}
+	}
+
+	c, err = New(4, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := [][]byte{[]byte("abcd"), []byte("efgh"), []byte("ijkl"), []byte("mnop")}
+	shards = append(append([][]byte(nil), data...), make([]byte, 4), make([]byte, 4))
+
+	c.Encode(shards)
+
+	for i := range data {
+		if !bytes.Equal(shards[i], data[i]) {
+			t.Errorf("data shard %d is changed by encoding", i)
+		}
+	}
+}
+
+func TestNewRefusesBadShards(t *testing.T) {
+	for _, tt := range [][2]int{{0, 1}, {2, 2}, {3, 2}, {1, MaxShards + 1}} {
+		if _, err := New(tt[0], tt[1]); err == nil {
+			t.Errorf("code of %d of %d shards is made", tt[0], tt[1])
+		}
+	}
+
+	if _, err := New(MaxShards-1, MaxShards); err != nil {
+		t.Errorf("code of %d of %d shards: %v", MaxShards-1, MaxShards, err)
+	}
+}
+
+// TestField checks that every nonzero element has an inverse and that
+// multiplication distributes over addition.
+func TestField(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if p := mulTable[a][inv(byte(a))]; p != 1 {
+			t.Fatalf("%d * inv(%d) = %d", a, a, p)
+		}
+	}
+
+	r := rand.New(rand.NewSource(3))
+
+	for i := 0; i < 10000; i++ {
+		a, b, c := byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256))
+
+		if mulTable[a][b^c] != mulTable[a][b]^mulTable[a][c] {
+			t.Fatalf("%d * (%d + %d) isn't distributed", a, b, c)
+		}
+	}
+}
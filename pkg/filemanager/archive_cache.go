@@ -0,0 +1,487 @@
+package filemanager
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// archiveCacheSuffix is appended to OutputFilename to name a subdirectory of
+	// ArchiveCache files of a backup are cached in.
+	archiveCacheSuffix = ".cache"
+	// archiveCacheJournal is a file of a cache which lists cached files, one JSON
+	// object per line after a header.
+	archiveCacheJournal = "journal"
+
+	zipLocalHeaderLen   = 30
+	zipCentralHeaderLen = 46
+	zipEndLen           = 22
+	zip64EndLen         = 56
+	zip64LocatorLen     = 20
+	zip64ExtraLen       = 28
+
+	zipLocalSignature     = 0x04034b50
+	zipCentralSignature   = 0x02014b50
+	zipEndSignature       = 0x06054b50
+	zip64EndSignature     = 0x06064b50
+	zip64LocatorSignature = 0x07064b50
+
+	zip64ExtraID = 0x0001
+	zipVersion45 = 45
+)
+
+// archiveCacheHeader tells whether cached files belong to the same backup, files
+// archived from another source directory or protected with another password are
+// discarded.
+type archiveCacheHeader struct {
+	Source string `json:"source"`
+	Key    string `json:"key"`
+}
+
+type archiveCacheFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Chunk   string    `json:"chunk"`
+}
+
+type archiveCache struct {
+	dir     string
+	journal *os.File
+	files   map[string]archiveCacheFile
+}
+
+// archiveDirCached writes an inner archive of a source directory to w like
+// archiveDir() does, but every file is archived into a single entry archive of a
+// cache directory first, which is listed in a journal once it's complete. A
+// sender which is killed while it archives a directory reuses cached archives of
+// files which haven't changed since, so a restarted run resumes where the
+// previous one stopped instead of compressing a directory from scratch. An inner
+// archive is assembled of local entries of cached archives followed by their
+// central directory headers, which are moved to actual offsets. Like zip.Writer
+// does, zip64 records are written once an archive exceeds limits of the classic
+// ones, i.e. 65535 entries or 4 GiB.
+func (m *Backupper) archiveDirCached(w io.Writer) error {
+	c, err := m.openArchiveCache()
+	if err != nil {
+		return errors.Wrap(err, "archive cache")
+	}
+	defer c.journal.Close()
+
+	var (
+		offset  int64
+		entries int
+		dir     bytes.Buffer
+	)
+
+	err = m.walkSourceDir(func(path, relPath string, fi fs.FileInfo, rule *FileRule) error {
+		chunk, err := m.cachedArchive(c, path, relPath, fi, rule)
+		if err != nil {
+			return err
+		}
+
+		n, header, err := copyLocalEntry(w, chunk, offset)
+		if err != nil {
+			return errors.Wrapf(err, "cached archive of %s", relPath)
+		}
+
+		offset += n
+		entries++
+		dir.Write(header)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	dirLen := int64(dir.Len())
+
+	if _, err := dir.WriteTo(w); err != nil {
+		return err
+	}
+
+	if entries > 0xffff || offset > uint32max || dirLen > uint32max {
+		end64 := make([]byte, zip64EndLen+zip64LocatorLen)
+		binary.LittleEndian.PutUint32(end64, zip64EndSignature)
+		binary.LittleEndian.PutUint64(end64[4:], zip64EndLen-12)
+		binary.LittleEndian.PutUint16(end64[12:], zipVersion45)
+		binary.LittleEndian.PutUint16(end64[14:], zipVersion45)
+		binary.LittleEndian.PutUint64(end64[24:], uint64(entries))
+		binary.LittleEndian.PutUint64(end64[32:], uint64(entries))
+		binary.LittleEndian.PutUint64(end64[40:], uint64(dirLen))
+		binary.LittleEndian.PutUint64(end64[48:], uint64(offset))
+
+		locator := end64[zip64EndLen:]
+		binary.LittleEndian.PutUint32(locator, zip64LocatorSignature)
+		binary.LittleEndian.PutUint64(locator[8:], uint64(offset+dirLen))
+		binary.LittleEndian.PutUint32(locator[16:], 1)
+
+		if _, err := w.Write(end64); err != nil {
+			return err
+		}
+
+		// The classic record tells that the zip64 one is to be used instead.
+		entries, dirLen, offset = 0xffff, uint32max, uint32max
+	}
+
+	end := make([]byte, zipEndLen)
+	binary.LittleEndian.PutUint32(end, zipEndSignature)
+	binary.LittleEndian.PutUint16(end[8:], uint16(entries))
+	binary.LittleEndian.PutUint16(end[10:], uint16(entries))
+	binary.LittleEndian.PutUint32(end[12:], uint32(dirLen))
+	binary.LittleEndian.PutUint32(end[16:], uint32(offset))
+
+	_, err = w.Write(end)
+
+	return err
+}
+
+// openArchiveCache loads a cache of a backup, and starts a new one if there is
+// none or it's of another backup.
+func (m *Backupper) openArchiveCache() (*archiveCache, error) {
+	source, err := filepath.Abs(m.cfg.SourceEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, []byte(m.cfg.Password1))
+	mac.Write([]byte("distributed-backup archive cache"))
+
+	if m.cfg.ZipCrypto {
+		mac.Write([]byte("\nzipcrypto"))
+	}
+
+	// Files are archived as rules and levels tell, so a cache of other ones is
+	// stale.
+	for _, r := range m.cfg.FileRules {
+		mac.Write([]byte("\n" + r.String()))
+	}
+
+	if m.cfg.Level != nil {
+		fmt.Fprintf(mac, "\nlevel:%d", *m.cfg.Level)
+	}
+
+	fmt.Fprintf(mac, "\nstore:%s", strings.ToLower(strings.Join(m.cfg.StoreExtensions, ",")))
+
+	header := archiveCacheHeader{
+		Source: source,
+		Key:    hex.EncodeToString(mac.Sum(nil)),
+	}
+
+	c := &archiveCache{
+		dir:   m.archiveCacheDir(),
+		files: map[string]archiveCacheFile{},
+	}
+
+	journal := filepath.Join(c.dir, archiveCacheJournal)
+
+	if f, err := os.Open(journal); err == nil {
+		ok := readArchiveCacheJournal(f, header, c.files)
+		f.Close()
+
+		if ok {
+			c.journal, err = os.OpenFile(journal, os.O_WRONLY|os.O_APPEND, 0664)
+			if err != nil {
+				return nil, err
+			}
+
+			m.log.WithFields(log.Fields{
+				log.FieldDir:   c.dir,
+				log.FieldFiles: len(c.files),
+			}).Info("resuming archiving from a cache")
+
+			return c, nil
+		}
+
+		m.log.WithField(log.FieldDir, c.dir).Info("cache of another backup is discarded")
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := os.RemoveAll(c.dir); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(c.dir, 0775); err != nil {
+		return nil, err
+	}
+
+	c.journal, err = os.Create(journal)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.NewEncoder(c.journal).Encode(&header); err != nil {
+		c.journal.Close()
+
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// readArchiveCacheJournal reads files listed in a journal of a cache into files.
+// It returns false if a journal is of another backup. A line which is torn by a
+// killed process ends a journal.
+func readArchiveCacheJournal(r io.Reader, header archiveCacheHeader, files map[string]archiveCacheFile) bool {
+	scanner := bufio.NewScanner(r)
+
+	if !scanner.Scan() {
+		return false
+	}
+
+	var h archiveCacheHeader
+
+	if err := json.Unmarshal(scanner.Bytes(), &h); err != nil || h != header {
+		return false
+	}
+
+	for scanner.Scan() {
+		var f archiveCacheFile
+
+		if err := json.Unmarshal(scanner.Bytes(), &f); err != nil {
+			break
+		}
+
+		files[f.Path] = f
+	}
+
+	return true
+}
+
+// cachedArchive returns a path to a single entry archive of a file, which is
+// archived into a cache unless it's cached already and hasn't changed since.
+func (m *Backupper) cachedArchive(c *archiveCache, path, relPath string, fi fs.FileInfo, rule *FileRule) (string, error) {
+	if f, ok := c.files[relPath]; ok && f.Size == fi.Size() && f.ModTime.Equal(fi.ModTime()) {
+		chunk := filepath.Join(c.dir, f.Chunk)
+
+		if _, err := os.Stat(chunk); err == nil {
+			m.log.WithField(log.FieldFile, relPath).Debug("reusing cached archive of file")
+
+			return chunk, nil
+		}
+	}
+
+	sum := sha256.Sum256([]byte(relPath))
+	name := hex.EncodeToString(sum[:16]) + ".zip"
+	chunk := filepath.Join(c.dir, name)
+
+	if err := m.archiveChunk(chunk+partialSuffix, path, relPath, fi, rule); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(chunk+partialSuffix, chunk); err != nil {
+		return "", err
+	}
+
+	f := archiveCacheFile{
+		Path:    relPath,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+		Chunk:   name,
+	}
+
+	if err := json.NewEncoder(c.journal).Encode(&f); err != nil {
+		return "", errors.Wrap(err, "archive cache")
+	}
+
+	c.files[relPath] = f
+
+	return chunk, nil
+}
+
+// archiveChunk archives a file of a source directory into a single entry
+// archive at chunk.
+func (m *Backupper) archiveChunk(chunk, path, relPath string, fi fs.FileInfo, rule *FileRule) error {
+	f, err := os.Create(chunk)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	z := newInnerWriter(f, m.cfg.CompressWorkers)
+
+	if err := m.archiveEntry(z, path, relPath, fi, rule); err != nil {
+		return err
+	}
+
+	if err := z.Close(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// copyLocalEntry copies a local entry of a single entry archive at path to w and
+// returns its length along with its central directory header pointing at offset.
+func copyLocalEntry(w io.Writer, path string, offset int64) (int64, []byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if fi.Size() < zipLocalHeaderLen+zipCentralHeaderLen+zipEndLen {
+		return 0, nil, errMalformedArchive
+	}
+
+	end := make([]byte, zipEndLen)
+
+	if _, err := f.ReadAt(end, fi.Size()-zipEndLen); err != nil {
+		return 0, nil, err
+	}
+
+	if binary.LittleEndian.Uint32(end) != zipEndSignature {
+		return 0, nil, errMalformedArchive
+	}
+
+	entries := uint64(binary.LittleEndian.Uint16(end[10:]))
+	dirLen := int64(binary.LittleEndian.Uint32(end[12:]))
+	dirOffset := int64(binary.LittleEndian.Uint32(end[16:]))
+	dirEnd := fi.Size() - zipEndLen
+
+	// An archive of a file over 4 GiB has its central directory located by
+	// zip64 records, which precede the classic one.
+	if dirOffset == uint32max {
+		if dirEnd < zipLocalHeaderLen+zipCentralHeaderLen+zip64EndLen+zip64LocatorLen {
+			return 0, nil, errMalformedArchive
+		}
+
+		end64 := make([]byte, zip64EndLen+zip64LocatorLen)
+
+		if _, err := f.ReadAt(end64, dirEnd-int64(len(end64))); err != nil {
+			return 0, nil, err
+		}
+
+		if binary.LittleEndian.Uint32(end64) != zip64EndSignature ||
+			binary.LittleEndian.Uint32(end64[zip64EndLen:]) != zip64LocatorSignature {
+			return 0, nil, errMalformedArchive
+		}
+
+		entries = binary.LittleEndian.Uint64(end64[32:])
+		dirLen = int64(binary.LittleEndian.Uint64(end64[40:]))
+		dirOffset = int64(binary.LittleEndian.Uint64(end64[48:]))
+		dirEnd -= int64(len(end64))
+	}
+
+	if entries != 1 || dirLen < zipCentralHeaderLen || dirOffset < 0 || dirOffset+dirLen != dirEnd {
+		return 0, nil, errMalformedArchive
+	}
+
+	header := make([]byte, dirLen)
+
+	if _, err := f.ReadAt(header, dirOffset); err != nil {
+		return 0, nil, err
+	}
+
+	if binary.LittleEndian.Uint32(header) != zipCentralSignature {
+		return 0, nil, errMalformedArchive
+	}
+
+	header, err = moveCentralHeader(header, offset)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	n, err := io.Copy(w, io.NewSectionReader(f, 0, dirOffset))
+
+	return n, header, err
+}
+
+// moveCentralHeader points a central directory header at a local entry at
+// offset. An offset over 4 GiB is put into a zip64 extra field, which is added
+// unless a header has one already. Like zip.Writer, a field holds both sizes and
+// an offset, since go-zip reads them regardless of which ones are needed.
+func moveCentralHeader(header []byte, offset int64) ([]byte, error) {
+	nameLen := int(binary.LittleEndian.Uint16(header[28:]))
+	extraLen := int(binary.LittleEndian.Uint16(header[30:]))
+	extraEnd := zipCentralHeaderLen + nameLen + extraLen
+
+	if extraEnd > len(header) {
+		return nil, errMalformedArchive
+	}
+
+	offset32 := uint32(offset)
+	if offset > uint32max {
+		offset32 = uint32max
+	}
+
+	for b := header[zipCentralHeaderLen+nameLen : extraEnd]; len(b) >= 4; {
+		id := binary.LittleEndian.Uint16(b)
+		size := int(binary.LittleEndian.Uint16(b[2:]))
+
+		if size > len(b)-4 {
+			return nil, errMalformedArchive
+		}
+
+		if id == zip64ExtraID && size >= 24 {
+			binary.LittleEndian.PutUint64(b[20:], uint64(offset))
+			binary.LittleEndian.PutUint32(header[42:], offset32)
+
+			return header, nil
+		}
+
+		b = b[4+size:]
+	}
+
+	binary.LittleEndian.PutUint32(header[42:], offset32)
+
+	if offset <= uint32max {
+		return header, nil
+	}
+
+	if extraLen+zip64ExtraLen > 0xffff {
+		return nil, errMalformedArchive
+	}
+
+	extra := make([]byte, zip64ExtraLen)
+	binary.LittleEndian.PutUint16(extra, zip64ExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], zip64ExtraLen-4)
+	binary.LittleEndian.PutUint64(extra[4:], uint64(binary.LittleEndian.Uint32(header[24:])))
+	binary.LittleEndian.PutUint64(extra[12:], uint64(binary.LittleEndian.Uint32(header[20:])))
+	binary.LittleEndian.PutUint64(extra[20:], uint64(offset))
+
+	binary.LittleEndian.PutUint16(header[6:], zipVersion45)
+	binary.LittleEndian.PutUint32(header[20:], uint32max)
+	binary.LittleEndian.PutUint32(header[24:], uint32max)
+	binary.LittleEndian.PutUint16(header[30:], uint16(extraLen+zip64ExtraLen))
+
+	moved := make([]byte, 0, len(header)+zip64ExtraLen)
+	moved = append(moved, header[:extraEnd]...)
+	moved = append(moved, extra...)
+
+	return append(moved, header[extraEnd:]...), nil
+}
+
+func (m *Backupper) archiveCacheDir() string {
+	return filepath.Join(m.cfg.ArchiveCache, m.cfg.OutputFilename+archiveCacheSuffix)
+}
+
+// removeArchiveCache removes a cache of a backup which has been sent.
+func (m *Backupper) removeArchiveCache() {
+	if err := os.RemoveAll(m.archiveCacheDir()); err != nil {
+		m.log.Error(errors.Wrap(err, "archive cache"))
+	}
+}
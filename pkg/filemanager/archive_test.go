@@ -0,0 +1,467 @@
+package filemanager
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/TelenLiu/go-zip"
+)
+
+// parseTestFileRules parses rules of a transfer.
+func parseTestFileRules(t *testing.T, rules ...string) []FileRule {
+	t.Helper()
+
+	parsed := make([]FileRule, 0, len(rules))
+
+	for _, s := range rules {
+		r, err := ParseFileRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed = append(parsed, r)
+	}
+
+	return parsed
+}
+
+// TestTransferFileRules sends a backup archived with rules which skip a file,
+// store one unencrypted with Password1 and compress another at the best level,
+// and checks files extracted by a receiver.
+func TestTransferFileRules(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+
+	mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{
+		Extract:   true,
+		FileRules: parseTestFileRules(t, "file.txt=skip", "*.bin,size>1KiB=store,plain", "dir/*.txt=level:9"),
+	})
+
+	extracted := extractedDir(dstDir, testOutFile)
+
+	if _, err := os.Stat(filepath.Join(extracted, "file.txt")); !os.IsNotExist(err) {
+		t.Error("file.txt: skipped file is extracted")
+	}
+
+	for _, name := range []string{"dir/nested.txt", "dir/subdir/data.bin"} {
+		b, err := os.ReadFile(filepath.Join(extracted, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != testFiles[name] {
+			t.Errorf("%s: content mismatch", name)
+		}
+	}
+}
+
+// TestTransferStore sends a backup an inner archive of which is stored in an
+// outer one, and a file of which is stored by its extension, checks that both
+// are stored uncompressed and restores the backup.
+func TestTransferStore(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+
+	store := 0
+
+	mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{
+		OuterLevel:      &store,
+		StoreExtensions: []string{".BIN"},
+	})
+
+	path := filepath.Join(dstDir, testOutFile)
+
+	outer, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outer.Close()
+
+	if len(outer.File) != 1 {
+		t.Fatalf("%s: single inner archive expected", path)
+	}
+
+	// Data stored at the deflate level of 0 takes a bit more than it does.
+	if f := outer.File[0]; f.CompressedSize64 < f.UncompressedSize64 {
+		t.Errorf("%s: inner archive is compressed", f.Name)
+	}
+
+	b, err := readTestArchivedFile(outer.File[0], testPassword2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inner, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range inner.File {
+		if f.Name == "dir/subdir/data.bin" && f.CompressedSize64 < f.UncompressedSize64 {
+			t.Errorf("%s: file is compressed", f.Name)
+		}
+	}
+
+	restoreTestBackup(t, path, t.TempDir())
+}
+
+// TestTransferParallelDeflate sends a backup of a file which spans several
+// chunks deflated concurrently, checks that the file is compressed and restores
+// it.
+func TestTransferParallelDeflate(t *testing.T) {
+	_, dstDir := newTestDirs(t)
+	srcDir := t.TempDir()
+
+	var content bytes.Buffer
+
+	for i := 0; content.Len() < 3<<20+12345; i++ {
+		fmt.Fprintf(&content, "line %d of a file deflated by chunks %x\n", i, i*i)
+	}
+
+	if err := os.WriteFile(filepath.Join(srcDir, "large.txt"), content.Bytes(), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{CompressWorkers: 4})
+
+	path := filepath.Join(dstDir, testOutFile)
+
+	outer, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outer.Close()
+
+	if len(outer.File) != 1 {
+		t.Fatalf("%s: single inner archive expected", path)
+	}
+
+	if f := outer.File[0]; f.UncompressedSize64 > uint64(content.Len())/2 {
+		t.Errorf("%s: file is not compressed", f.Name)
+	}
+
+	restoredDir := t.TempDir()
+
+	if err := extractTestBackup(path, testPassword1, testPassword2, restoredDir); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(restoredDir, "large.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, content.Bytes()) {
+		t.Error("large.txt: restored content mismatch")
+	}
+}
+
+// TestTransferZipCrypto checks that a stored backup is protected with AES
+// unless a sender is told to use ZipCrypto, and that a receiver extracts a
+// backup protected with ZipCrypto.
+func TestTransferZipCrypto(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+
+	for _, zipCrypto := range []bool{false, true} {
+		mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{ZipCrypto: zipCrypto})
+
+		f, err := os.Open(filepath.Join(dstDir, testOutFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header := make([]byte, 30)
+		_, err = io.ReadFull(f, header)
+		f.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// An entry protected with AES has the method of 99, and its actual one
+		// is kept in an extra field.
+		method, expected := binary.LittleEndian.Uint16(header[8:]), uint16(99)
+		if zipCrypto {
+			expected = zip.Deflate
+		}
+
+		if method != expected {
+			t.Errorf("outer archive has the method of %d, %d expected", method, expected)
+		}
+	}
+
+	mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{Extract: true, ZipCrypto: true})
+
+	verifyTestFiles(t, extractedDir(dstDir, testOutFile))
+}
+
+// TestTransferExclude sends a backup excluding a directory and including files
+// by patterns, and checks files extracted by a receiver.
+func TestTransferExclude(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+
+	mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{
+		Extract: true,
+		Exclude: []string{"subdir/"},
+		Include: []string{"*.txt"},
+	})
+
+	extracted := extractedDir(dstDir, testOutFile)
+
+	if _, err := os.Stat(filepath.Join(extracted, "dir", "subdir")); !os.IsNotExist(err) {
+		t.Error("dir/subdir: excluded directory is extracted")
+	}
+
+	for _, name := range []string{"file.txt", "dir/nested.txt"} {
+		b, err := os.ReadFile(filepath.Join(extracted, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != testFiles[name] {
+			t.Errorf("%s: content mismatch", name)
+		}
+	}
+}
+
+// TestTransferMeta sends a backup with a file of a distinct mode and a
+// modification time finer than a ZIP header keeps, and checks that an
+// extracted file has them.
+func TestTransferMeta(t *testing.T) {
+	const name = "file.txt"
+
+	srcDir, dstDir := newTestDirs(t)
+
+	path := filepath.Join(srcDir, name)
+	modTime := time.Date(2001, 2, 3, 4, 5, 7, 123456789, time.UTC)
+
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{Extract: true, PreserveMeta: true})
+
+	fi, err := os.Stat(filepath.Join(extractedDir(dstDir, testOutFile), name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0600 {
+		t.Errorf("%s: mode %s isn't restored", name, fi.Mode())
+	}
+
+	if !fi.ModTime().Equal(modTime) {
+		t.Errorf("%s: modification time %s isn't restored", name, fi.ModTime())
+	}
+}
+
+// TestTransferSymlinks sends a backup of a source directory with a symbolic
+// link and an empty directory, and checks that both are extracted as they are.
+// Then it sends the backup following links and checks that a file a link points
+// to is extracted in place of it.
+func TestTransferSymlinks(t *testing.T) {
+	const (
+		linkName  = "link.txt"
+		emptyName = "empty"
+		target    = "file.txt"
+	)
+
+	if runtime.GOOS == "windows" {
+		t.Skip("making symbolic links takes a privilege")
+	}
+
+	srcDir, dstDir := newTestDirs(t)
+
+	if err := os.Symlink(target, filepath.Join(srcDir, linkName)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(filepath.Join(srcDir, emptyName), 0775); err != nil {
+		t.Fatal(err)
+	}
+
+	extracted := extractedDir(dstDir, testOutFile)
+
+	mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{Extract: true})
+
+	link, err := os.Readlink(filepath.Join(extracted, linkName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if link != target {
+		t.Errorf("%s: link target %s mismatch", linkName, link)
+	}
+
+	fi, err := os.Stat(filepath.Join(extracted, emptyName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !fi.IsDir() {
+		t.Errorf("%s: not a directory", emptyName)
+	}
+
+	mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{Extract: true, FollowSymlinks: true})
+
+	fi, err = os.Lstat(filepath.Join(extracted, linkName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !fi.Mode().IsRegular() {
+		t.Fatalf("%s: followed link isn't extracted as a file", linkName)
+	}
+
+	b, err := os.ReadFile(filepath.Join(extracted, linkName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != testFiles[target] {
+		t.Errorf("%s: content mismatch", linkName)
+	}
+}
+
+// TestTransferTarGz sends a backup in a tar.gz archive, and checks that it
+// keeps content and permissions of files.
+func TestTransferTarGz(t *testing.T) {
+	const outFile = "backup.tar.gz"
+
+	srcDir, dstDir := newTestDirs(t)
+
+	mustTransfer(t, srcDir, dstDir, outFile, transferOptions{Format: FormatTarGz})
+
+	f, err := os.Open(filepath.Join(dstDir, outFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(gz)
+	found := 0
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, ok := testFiles[hdr.Name]
+		if !ok {
+			t.Fatalf("%s: unexpected file", hdr.Name)
+		}
+
+		fi, err := os.Stat(filepath.Join(srcDir, filepath.FromSlash(hdr.Name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hdr.FileInfo().Mode().Perm() != fi.Mode().Perm() {
+			t.Errorf("%s: permissions mismatch", hdr.Name)
+		}
+
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != content {
+			t.Errorf("%s: archived content mismatch", hdr.Name)
+		}
+
+		found++
+	}
+
+	if found != len(testFiles) {
+		t.Error("files are missing in an archive")
+	}
+}
+
+// TestTransferTree sends a source directory file by file, and checks that a
+// receiver makes the same tree with content and permissions of files.
+func TestTransferTree(t *testing.T) {
+	const outFile = "backup"
+
+	srcDir, dstDir := newTestDirs(t)
+
+	mustTransfer(t, srcDir, dstDir, outFile, transferOptions{Format: FormatTree})
+
+	found := 0
+	root := filepath.Join(dstDir, outFile)
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(relPath)
+
+		content, ok := testFiles[name]
+		if !ok {
+			t.Errorf("%s: unexpected file", name)
+
+			return nil
+		}
+
+		src, err := os.Stat(filepath.Join(srcDir, relPath))
+		if err != nil {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode().Perm() != src.Mode().Perm() {
+			t.Errorf("%s: permissions mismatch", name)
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if string(b) != content {
+			t.Errorf("%s: replicated content mismatch", name)
+		}
+
+		found++
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found != len(testFiles) {
+		t.Error("files are missing in a replicated tree")
+	}
+}
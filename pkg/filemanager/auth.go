@@ -0,0 +1,231 @@
+package filemanager
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+
+	"distributed-backup/pkg/crypto"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// frameChallenge is "${challenge}" a peer with AuthSecret starts every
+	// connection with.
+	frameChallenge byte = 'C'
+	// framePairing is "${spake2_message}" a peer with PairingCode starts every
+	// connection with.
+	framePairing byte = 'P'
+
+	authNonceLen = 32
+	// authLabel binds proofs to this protocol, so that they can't be taken for
+	// MACs computed with the same secret elsewhere.
+	authLabel = "distributed-backup peer auth v2"
+)
+
+var (
+	// ErrAuthFailed means that a peer has failed to prove knowledge of the auth
+	// secret, or has proved it over another connection than this one (see:
+	// ChannelBinder).
+	ErrAuthFailed = errors.New("peer doesn't know the auth secret")
+	// ErrPairingFailed means that a peer has failed to prove knowledge of the
+	// pairing code, or has proved it over another connection than this one.
+	ErrPairingFailed = errors.New("peer doesn't know the pairing code")
+	// ErrAuthRequired means that a peer without AuthSecret or PairingCode has
+	// met one which authenticates peers.
+	ErrAuthRequired = errors.New("peer requires authentication")
+)
+
+// ChannelBinder is a Peer whose connection is secured by (D)TLS with
+// certificates of both peers (e.g. peer.WebRTC). Proofs of authentication cover
+// fingerprints of both certificates as a peer sees them (see: channelBinding()),
+// so that a man in the middle (e.g. one which controls signaling), which
+// terminates (D)TLS with each peer with a certificate of its own, can't relay
+// proofs between them: they don't match.
+type ChannelBinder interface {
+	CertificateFingerprints() (local, remote string, err error)
+}
+
+// authenticate runs a challenge-response handshake proving that both peers know
+// AuthSecret before any file data is sent or received. Each peer sends a random
+// challenge and answers the other one's with an HMAC-SHA256 of both challenges,
+// its role and certificates of a connection binder secures (see: ChannelBinder),
+// so a proof can be neither replayed in another session, reflected back to the
+// peer it came from nor relayed over another connection. Every connection a
+// transfer is resumed over is authenticated as well. Peers with PairingCode run
+// a PAKE instead (see: authenticatePairing()). Nothing is done if neither is
+// set, and a peer which authenticates otherwise than the other one is told of it
+// (see: readAuthFrame()).
+func (m *Backupper) authenticate(conn io.ReadWriter, binder ChannelBinder) error {
+	if len(m.cfg.PairingCode) == 0 && len(m.cfg.AuthSecret) == 0 {
+		return nil
+	}
+
+	binding, err := m.channelBinding(binder)
+	if err != nil {
+		return err
+	}
+
+	if len(m.cfg.PairingCode) != 0 {
+		return m.authenticatePairing(conn, binding)
+	}
+
+	role, peerRole := m.roles()
+
+	nonce := make([]byte, authNonceLen)
+
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	if _, err := conn.Write(append([]byte{frameChallenge}, nonce...)); err != nil {
+		return err
+	}
+
+	peerNonce, err := readAuthFrame(conn, frameChallenge, authNonceLen, ErrAuthFailed)
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Write(authProof([]byte(m.cfg.AuthSecret), role, peerNonce, nonce, binding)); err != nil {
+		return err
+	}
+
+	peerProof := make([]byte, sha256.Size)
+
+	if _, err := io.ReadFull(conn, peerProof); err != nil {
+		return err
+	}
+
+	if !hmac.Equal(peerProof, authProof([]byte(m.cfg.AuthSecret), peerRole, nonce, peerNonce, binding)) {
+		return ErrAuthFailed
+	}
+
+	m.log.Info("peer authenticated")
+
+	return nil
+}
+
+// authenticatePairing runs SPAKE2 with PairingCode as a password, a sender takes
+// side A of it, and makes both peers prove that they've got the same key. A
+// code is short, but a peer which doesn't know it gets a single guess per
+// connection, and nothing observed lets it be guessed offline. Certificates of
+// a connection (see: ChannelBinder) are a context of an exchange, so a key
+// differs at both ends of a connection a man in the middle terminates.
+func (m *Backupper) authenticatePairing(conn io.ReadWriter, binding []byte) error {
+	role, peerRole := m.roles()
+
+	pake, err := crypto.NewSPAKE2([]byte(m.cfg.PairingCode), binding, role == RoleSender)
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Write(append([]byte{framePairing}, pake.Message()...)); err != nil {
+		return err
+	}
+
+	peerMsg, err := readAuthFrame(conn, framePairing, len(pake.Message()), ErrPairingFailed)
+	if err != nil {
+		return err
+	}
+
+	key, err := pake.Finish(peerMsg)
+	if err != nil {
+		return errors.Wrap(ErrPairingFailed, err.Error())
+	}
+
+	if _, err := conn.Write(authProof(key, role, nil, nil, binding)); err != nil {
+		return err
+	}
+
+	peerProof := make([]byte, sha256.Size)
+
+	if _, err := io.ReadFull(conn, peerProof); err != nil {
+		return err
+	}
+
+	if !hmac.Equal(peerProof, authProof(key, peerRole, nil, nil, binding)) {
+		return ErrPairingFailed
+	}
+
+	m.log.Info("peer authenticated with pairing code")
+
+	return nil
+}
+
+// readAuthFrame reads the first frame of the other peer, which is expected to
+// be of kind and to carry size bytes. A peer which authenticates otherwise or
+// doesn't at all fails with failure, which tells what it lacks.
+func readAuthFrame(conn io.Reader, kind byte, size int, failure error) ([]byte, error) {
+	buf := make([]byte, maxMessageSize)
+
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := buf[:n]
+
+	switch {
+	case len(frame) == 1+size && frame[0] == kind:
+		return frame[1:], nil
+	case len(frame) == 0:
+		return nil, errMalformedFrame
+	case frame[0] == frameChallenge:
+		return nil, errors.Wrap(failure, "peer authenticates with an auth secret")
+	case frame[0] == framePairing:
+		return nil, errors.Wrap(failure, "peer authenticates with a pairing code")
+	case frame[0] == frameVersion || frame[0] == frameHello:
+		return nil, errors.Wrap(failure, "peer isn't authenticated")
+	default:
+		return nil, errMalformedFrame
+	}
+}
+
+// roles returns a role of this peer and one of the other peer.
+func (m *Backupper) roles() (role, peerRole string) {
+	if m.result.Role == RoleSender {
+		return RoleSender, RoleReceiver
+	}
+
+	return RoleReceiver, RoleSender
+}
+
+// channelBinding returns fingerprints of certificates of a sender and a receiver
+// as this peer sees them, which are the same at both ends of a connection only
+// if nobody sits in between (see: ChannelBinder). It's empty for a peer which
+// isn't a binder (e.g. a connection within a process).
+func (m *Backupper) channelBinding(binder ChannelBinder) ([]byte, error) {
+	if binder == nil {
+		return nil, nil
+	}
+
+	local, remote, err := binder.CertificateFingerprints()
+	if err != nil {
+		return nil, errors.Wrap(err, "certificates of a connection")
+	}
+
+	if m.result.Role == RoleSender {
+		return []byte(local + " " + remote), nil
+	}
+
+	return []byte(remote + " " + local), nil
+}
+
+// authProof returns a proof of knowledge of a secret of a peer of the role
+// answering the challenge, which it has sent its own one along with, over a
+// connection of binding.
+func authProof(secret []byte, role string, challenge, own, binding []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+
+	mac.Write([]byte(authLabel))
+	mac.Write([]byte{byte(len(role))})
+	mac.Write([]byte(role))
+	mac.Write(challenge)
+	mac.Write(own)
+	mac.Write(binding)
+
+	return mac.Sum(nil)
+}
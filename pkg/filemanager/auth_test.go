@@ -0,0 +1,178 @@
+package filemanager
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/pairing"
+)
+
+// msgConn is an end of an in-memory connection which keeps boundaries of
+// messages, as peers do.
+type msgConn struct {
+	in, out chan []byte
+}
+
+func newMsgConns() (*msgConn, *msgConn) {
+	a, b := make(chan []byte, 8), make(chan []byte, 8)
+
+	return &msgConn{in: a, out: b}, &msgConn{in: b, out: a}
+}
+
+func (c *msgConn) Read(p []byte) (int, error) {
+	msg, ok := <-c.in
+	if !ok {
+		return 0, io.EOF
+	}
+
+	return copy(p, msg), nil
+}
+
+func (c *msgConn) Write(p []byte) (int, error) {
+	c.out <- append([]byte(nil), p...)
+
+	return len(p), nil
+}
+
+// fingerprints is a binder of certificates a peer sees at ends of a connection.
+type fingerprints struct {
+	local, remote string
+}
+
+func (f fingerprints) CertificateFingerprints() (string, string, error) {
+	return f.local, f.remote, nil
+}
+
+func TestAuthenticateIsBoundToConnection(t *testing.T) {
+	for _, tt := range []struct {
+		name           string
+		cfg            BackupperConfig
+		sender         fingerprints
+		receiver       fingerprints
+		authenticated  bool
+		expectedFailed error
+	}{
+		{
+			name:          "auth secret",
+			cfg:           BackupperConfig{AuthSecret: "secret"},
+			sender:        fingerprints{local: "S", remote: "R"},
+			receiver:      fingerprints{local: "R", remote: "S"},
+			authenticated: true,
+		},
+		{
+			// A man in the middle terminates (D)TLS with each peer with its
+			// own certificate M and relays messages between them.
+			name:           "relayed auth secret",
+			cfg:            BackupperConfig{AuthSecret: "secret"},
+			sender:         fingerprints{local: "S", remote: "M"},
+			receiver:       fingerprints{local: "R", remote: "M"},
+			expectedFailed: ErrAuthFailed,
+		},
+		{
+			name:          "pairing code",
+			cfg:           BackupperConfig{PairingCode: "7-guitar-eclipse"},
+			sender:        fingerprints{local: "S", remote: "R"},
+			receiver:      fingerprints{local: "R", remote: "S"},
+			authenticated: true,
+		},
+		{
+			name:           "relayed pairing code",
+			cfg:            BackupperConfig{PairingCode: "7-guitar-eclipse"},
+			sender:         fingerprints{local: "S", remote: "M"},
+			receiver:       fingerprints{local: "R", remote: "M"},
+			expectedFailed: ErrPairingFailed,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			senderConn, receiverConn := newMsgConns()
+
+			sender := &Backupper{cfg: tt.cfg, log: log.New(), result: Result{Role: RoleSender}}
+			receiver := &Backupper{cfg: tt.cfg, log: log.New(), result: Result{Role: RoleReceiver}}
+
+			errc := make(chan error, 1)
+
+			go func() {
+				errc <- receiver.authenticate(receiverConn, tt.receiver)
+			}()
+
+			senderErr := sender.authenticate(senderConn, tt.sender)
+			receiverErr := <-errc
+
+			for _, err := range []error{senderErr, receiverErr} {
+				switch {
+				case tt.authenticated && err != nil:
+					t.Errorf("authentication failed: %v", err)
+				case !tt.authenticated && !errors.Is(err, tt.expectedFailed):
+					t.Errorf("authentication = %v, want %v", err, tt.expectedFailed)
+				}
+			}
+		})
+	}
+}
+
+// TestTransferRefusesUnauthenticatedSender checks that a transfer fails if a
+// sender doesn't know the auth secret or doesn't authenticate at all, and the
+// receiver doesn't save anything.
+func TestTransferRefusesUnauthenticatedSender(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+
+	for _, tt := range []struct {
+		name string
+		opts transferOptions
+		err  error
+	}{
+		{"a wrong auth secret", transferOptions{SenderAuthSecret: "wrong-" + testAuthSecret}, ErrAuthFailed},
+		{"no auth secret", transferOptions{SenderUnauthenticated: true}, ErrAuthRequired},
+	} {
+		if err := testTransfer(srcDir, dstDir, testOutFile, tt.opts); !errors.Is(err, tt.err) {
+			t.Errorf("transfer with %s = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	assertDirUnchanged(t, dstDir, nil)
+}
+
+// TestTransferPairingCode checks that peers with the same pairing code transfer
+// a backup, and that peers with codes of the same nameplate, which share a
+// session, fail to authenticate each other.
+func TestTransferPairingCode(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+
+	code, err := pairing.NewCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{PairingCode: code})
+
+	// A wrong code has the same nameplate, as if the last words were mistyped.
+	parts := strings.SplitN(code, "-", 3)
+
+	var wrongCode string
+
+	for len(wrongCode) == 0 {
+		other, err := pairing.NewCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if otherParts := strings.SplitN(other, "-", 3); otherParts[2] != parts[2] {
+			wrongCode = parts[0] + "-" + parts[1] + "-" + otherParts[2]
+		}
+	}
+
+	if pairing.SessionID(code) != pairing.SessionID(wrongCode) {
+		t.Fatal("codes of the same nameplate have different sessions")
+	}
+
+	err = testTransfer(srcDir, dstDir, testOutFile, transferOptions{
+		PairingCode:       code,
+		SenderPairingCode: wrongCode,
+	})
+	if !errors.Is(err, ErrPairingFailed) {
+		t.Errorf("transfer with a wrong pairing code = %v, want %v", err, ErrPairingFailed)
+	}
+}
@@ -4,34 +4,100 @@
 // (see: sendSourceEntry()).
 //
 // It also receives a file from Peer and saves it to a destination directory named
-// DestinationDir if it is set (see: receiveFile()).
+// DestinationDir if it is set (see: receiveFile()), or to Storage which is
+// located elsewhere (see: Storage), or, if Extract is set, unpacks a received
+// double ZIP into a directory tree in DestinationDir (see: extractFile()). Every
+// backup stored in DestinationDir is recorded in its catalog (see:
+// catalogBackup()).
 //
 // Saving a received file follows specific rules of versioning. If Versions value
 // is greater than 1, other files with the same name get their names being appended
 // by a version number: the older the file, the greater the value. If amount of
 // files with the same name is already equal to Versions then the oldest one is
 // deleted and others' version numbers are incremented (see: shiftFileVersions()).
+// If Retention is set, versions are kept by their age instead (see: Retention).
+// Versions are shifted only once a file is received completely, a file which fails
+// to be received or verified is moved to QuarantineDir instead (see: quarantine()).
 //
 // An inner archive contains all files and subdirectories from SourceEntry recursively
 // and has the name of "${SourceEntry}.zip". It is protected with Password1.
 //
+// A file which is modified while it's archived is re-read up to ModifiedRetries
+// times, and is flagged in an archive if it's still inconsistent (see:
+// archiveFile()).
+//
 // An outer archive contains the first archive only and has the name of OutputFilename.
 // It is protected with Password2.
 //
+// Entries of both archives are encrypted with AES-256, or with ZipCrypto if
+// ZipCrypto is set (see: setArchivedFilePassword()).
+//
+// If ArchiveCache is set, files are archived into a cache first, which survives a
+// restart of a sender (see: archiveDirCached()).
+//
+// If Delta is set, a receiver sends signatures of files of its previous extracted
+// version, and a sender archives deltas of changed files against them (see:
+// requestSignatures()).
+//
+// If Dedup is set, files of a source directory are sent as content-defined
+// chunks, only ones a receiver hasn't stored are sent, and a receiver stores a
+// manifest of a backup instead of an archive (see: sendChunks() and
+// receiveDedup()).
+//
+// If Format is Format7z, a source directory is archived into a single 7z archive
+// protected with Password1 instead (see: sendSourceDir7z()). If it's FormatTarGz
+// or FormatTarZst, the directory is archived into a single compressed tar archive
+// which keeps permissions and symbolic links but isn't encrypted (see:
+// sendSourceDirTar()). If it's FormatTree, files of the directory are sent one by
+// one, and a receiver makes the same directory tree of them rather than saving an
+// archive (see: sendSourceDirTree() and receiveTree()).
+//
+// If AuthSecret or PairingCode is set, peers authenticate each other before any
+// file data flows (see: authenticate()).
+//
+// If Recipient is set, a sent file is sealed into an envelope for a final recipient
+// which is routed through intermediate peers (see: sendSealed()). A receiver stores
+// an envelope which isn't addressed to its Identity as is, and a stored envelope is
+// sent further with Forward (see: receiveEnvelope() and forwardEnvelope()).
+//
+// If Sources is set, a sender sends a source entry of them a receiver requests
+// by its name with Pull instead of SourceEntry (see: serveRequest()).
+//
+// If StorageKey is set, a receiver stores received files re-encrypted under it
+// instead of protected by a sender's passwords (see: receiveReencrypted()).
+//
+// If StreamKey is set, a single sent file is encrypted with it end to end and
+// stored encrypted as "${name}.enc", a receiver which knows it verifies a file
+// while storing it (see: writeFile() and verifyStream()).
+//
 // Sent or received data is presented as "${len(filename)}${filename}${file_content}"
-// (see: sendSourceDirArchived() and sendSourceFile()).
+// (see: sendSourceDirArchived() and sendSourceFile()), which is carried in chunks
+// of sequence numbers and checksums verified by a receiver. If ResumeTimeout is
+// set, a transfer which has lost its connection goes on over another one from
+// where a receiver has got to (see: transferStream and Resume()).
 
 package filemanager
 
 import (
+	"bufio"
+	"compress/flate"
+	"context"
+	"crypto/ecdh"
+	"crypto/sha256"
 	"encoding/binary"
-	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
+	"distributed-backup/pkg/crypto"
+	"distributed-backup/pkg/delta"
+	"distributed-backup/pkg/envelope"
 	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/metrics"
 
 	"github.com/TelenLiu/go-zip"
 	"github.com/pkg/errors"
@@ -39,8 +105,49 @@ import (
 
 type Backupper struct {
 	cfg BackupperConfig
-
-	peer Peer
+	log log.Logger
+
+	peer    *countingPeer
+	stream  *transferStream
+	storage Storage
+	// streamsPeer is a peer if it carries streams a transfer is spread over
+	// (see: lanes()).
+	streamsPeer StreamsPeer
+	// binder is a peer if its connection is secured by (D)TLS (see:
+	// authenticate()).
+	binder ChannelBinder
+	// features are ones of the transfer protocol peers have agreed on over the
+	// first connection (see: negotiate()).
+	features map[string]bool
+
+	// signatures are of files of a receiver's previous version by slash-separated
+	// paths (see: requestSignatures()).
+	signatures map[string]*delta.Signature
+	// chunks are hashes of chunks a receiver of a deduplicated backup has or
+	// has been sent (see: requestChunks()).
+	chunks map[[sha256.Size]byte]bool
+	// manifest lists files of a sent version, and base is a version a receiver
+	// has extracted which only changed files are sent against (see:
+	// requestBase()).
+	manifest *manifest
+	base     *manifest
+	// sourceBytes is an estimated size of a source entry once it's found (see:
+	// sourceSize()).
+	sourceBytes *int64
+	// stored is a backup a receiver has stored (see: catalogBackup()).
+	stored *storedBackup
+	// reverse is a receiver a sender of two-way sync carries, and syncDone is
+	// closed once both are done (see: Sync).
+	reverse  *Backupper
+	syncDone chan struct{}
+
+	result   Result
+	resultMx sync.Mutex
+
+	// ctx is done once a transfer is canceled, which fails reads and writes of
+	// it (see: Cancel()).
+	ctx       context.Context
+	cancelCtx context.CancelFunc
 
 	shutdownChan chan struct{}
 }
@@ -53,19 +160,302 @@ type BackupperConfig struct {
 	Versions       uint16
 	Password1      string
 	Password2      string
+	// Level is a deflate level from 0 (stored uncompressed) to 9 files of an
+	// inner archive are compressed at unless a rule sets one, and OuterLevel is
+	// one an inner archive is compressed at in an outer one. The default level is
+	// used if nil, though encrypted entries of an inner archive don't compress,
+	// so it's worth storing it unless files are archived plain.
+	Level      *int
+	OuterLevel *int
+	// StoreExtensions are extensions of names of files which are compressed
+	// already (e.g. ".jpg" or "mp4", in any case) and so are stored in an inner
+	// archive uncompressed unless a rule sets a level.
+	StoreExtensions []string
+	// CompressWorkers is a number of chunks of a file deflated at once, so that
+	// archiving keeps up with a fast link on a multi-core sender. Files are
+	// deflated by the archiving goroutine if it's less than 2.
+	CompressWorkers int
+	// ZipCrypto protects zip archives with the legacy standard (ZipCrypto)
+	// encryption instead of AES-256 for tools which don't support the latter. A
+	// receiver reads either.
+	ZipCrypto bool
+	// Retention keeps versions of received files by their age instead of
+	// Versions of them if set (see: Retention), it requires DestinationDir.
+	Retention *Retention
+	// Format is a format of an archive a source directory is sent in: FormatZip
+	// (by default), Format7z, FormatTarGz, FormatTarZst or FormatTree.
+	Format string
+	// AuthSecret is a pre-shared secret both peers prove knowledge of before a
+	// transfer (see: authenticate()), peers aren't authenticated if it's empty.
+	AuthSecret string
+	// PairingCode is a short code (see: pairing.NewCode()) both peers prove
+	// knowledge of with a PAKE instead of AuthSecret (see:
+	// authenticatePairing()).
+	PairingCode string
+	// ModifiedRetries is a number of times a file of a source directory which is
+	// modified while it's archived is re-read (see: archiveFile()).
+	ModifiedRetries int
+	// ArchiveCache is a directory archived files of a source directory are kept
+	// in until a backup is sent, so that a sender which is restarted while it
+	// archives resumes where it stopped (see: archiveDirCached()).
+	ArchiveCache string
+	// Delta makes a sender archive only changed blocks of files which a receiver
+	// has in its previous extracted version, and a receiver reconstruct them (see:
+	// requestSignatures()). Both peers must set it.
+	Delta bool
+	// Incremental makes a sender archive only files changed since the previous
+	// version a receiver has extracted, which is listed in a manifest saved at
+	// Manifest once a backup is sent, and a receiver take the rest of files from
+	// that version (see: requestBase() and completeVersion()). Both peers must set
+	// it.
+	Incremental bool
+	Manifest    string
+	// Dedup makes a sender send files of a source directory as content-defined
+	// chunks, only ones a receiver hasn't stored in ChunksDir of DestinationDir
+	// are sent, and a receiver store them along with a manifest of a backup
+	// (see: requestChunks() and receiveDedup()). Both peers must set it.
+	Dedup bool
+	// AnnounceSize makes a sender tell a receiver an estimated size of a source
+	// entry before a transfer starts, and a receiver refuse a transfer which
+	// doesn't fit free space of DestinationDir or MaxSize (see: announceSize()).
+	// Both peers must set it.
+	AnnounceSize bool
+	// MaxSize is a quota in bytes of a transfer a receiver takes, a transfer
+	// which exceeds it fails as soon as it does. There is no quota if it's 0.
+	MaxSize int64
+	// Escrow is a public key of an identity of a trusted third party passwords
+	// of a zipped directory are sealed for and sent along with a backup, so that
+	// it remains recoverable if a password file is lost (see: writeEscrow()).
+	Escrow *ecdh.PublicKey
+	// FileRules control how files of a source directory are archived, the first
+	// rule a file matches applies (see: FileRule). Only skipping applies to the
+	// 7z and tar formats.
+	FileRules []FileRule
+	// Exclude and Include are patterns of paths of a source directory which are
+	// left out of an archive and the only ones archived if set respectively (see:
+	// excluded()), excluded directories aren't walked into.
+	Exclude []PathPattern
+	Include []PathPattern
+	// Limiter limits a rate of data sent to Peer if set.
+	Limiter Limiter
+	// ResumeTimeout is a time a transfer which has lost its connection waits for
+	// another one to be resumed over (see: Resume()), it fails at once if 0.
+	ResumeTimeout time.Duration
+	// PreserveMeta makes a sender send permissions, an owner and a modification
+	// time of a plain file and files of a zip archive along with them, and a
+	// receiver restore them where it stores files in a directory (see:
+	// fileMeta). Tar archives keep them anyway.
+	PreserveMeta bool
+	// FollowSymlinks makes a sender archive files and directories symbolic links
+	// of a source directory point to instead of the links themselves.
+	FollowSymlinks bool
+	// AckTimeout is a time a sender waits for a receiver to confirm that it has
+	// stored a sent file once all of it is sent (see: transferStream.Close()),
+	// there's no limit if 0.
+	AckTimeout time.Duration
+	// Recipient is a public key of an identity a sent file is sealed for end to
+	// end, so that peers of Route (session IDs of hops after Peer, the last one is
+	// of the recipient) can't read it. A file is sent as is if it's nil.
+	Recipient *ecdh.PublicKey
+	Route     []string
+	// Forward makes a sender send a stored envelope named SourceEntry to the next
+	// hop of its route.
+	Forward bool
+	// Sync makes a peer send SourceEntry and receive a file of the other peer
+	// into DestinationDir (or Storage) over the same connection at once (two-way
+	// sync), which the other peer does as well. Options of a receiver apply to a
+	// received file only. Both peers must set it.
+	Sync bool
+	// Sources are source entries by names a sender serves instead of
+	// SourceEntry: it sends the one a receiver requests by Pull (see:
+	// serveRequest()), so that a receiver pulls a backup when it's due rather
+	// than waits for a sender to push it. Both peers must set them.
+	Sources map[string]string
+	Pull    string
+	// Shards makes a sender send a shard ShardIndex of a set a source entry is
+	// split into (see: PrepareShards()) instead of all of it, Backuppers of the
+	// same set send the rest of shards to other receivers.
+	Shards     *ShardSet
+	ShardIndex int
+	// Identity opens envelopes addressed to a receiver, other envelopes are stored
+	// as is.
+	Identity *envelope.Identity
+	// Extract makes a receiver unpack both levels of a received archive into a
+	// directory tree instead of saving the archive (see: extractFile()).
+	Extract bool
+	// Storage is where a receiver stores received files instead of
+	// DestinationDir (e.g. a remote directory or a bucket), extraction requires a
+	// local directory though.
+	Storage Storage
+	// StorageKey is a public key of an identity a receiver re-encrypts received
+	// files for before storing them (see: receiveReencrypted()), so that its
+	// private key can be kept offline until a backup is restored.
+	StorageKey *ecdh.PublicKey
+	// StreamKey is a pre-shared key a single sent file (rather than a zipped
+	// directory) is encrypted with, so that it's protected at rest as archives
+	// are with passwords. A receiver which has it verifies received files.
+	StreamKey string
+	// SessionID is an ID of a session a receiver records received backups under
+	// in CatalogFile of DestinationDir (see: catalogBackup()).
+	SessionID string
+	// HideProgress disables periodic progress entries, e.g. when progress is
+	// rendered from Result() instead.
+	HideProgress bool
+	// Log is a logger entries are written with (e.g. with session fields attached),
+	// the global logger is used if nil.
+	Log log.Logger
 }
 
 func NewBackupper(cfg BackupperConfig, peer Peer) (*Backupper, error) {
+	if err := ValidateConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.Sync {
+		if cfg.Log == nil {
+			cfg.Log = log.New()
+		}
+
+		return newSyncBackupper(cfg, peer)
+	}
+
+	role := RoleReceiver
+	if len(cfg.SourceEntry) != 0 || len(cfg.Sources) != 0 {
+		role = RoleSender
+	}
+
+	if cfg.Log == nil {
+		cfg.Log = log.New()
+	}
+
+	stream, err := newTransferStream(role, cfg.ResumeTimeout, cfg.AckTimeout, cfg.Log)
+	if err != nil {
+		return nil, err
+	}
+
+	stream.quota = cfg.MaxSize
+
+	storage := cfg.Storage
+	if storage == nil {
+		storage = DirStorage(cfg.DestinationDir)
+	}
+
+	m := &Backupper{
+		cfg:     cfg,
+		log:     cfg.Log,
+		peer:    newCountingPeer(limitPeer(peer, cfg), cfg.Log, !cfg.HideProgress),
+		stream:  stream,
+		storage: storage,
+		result: Result{
+			Role:  role,
+			Phase: PhaseWaiting,
+		},
+		shutdownChan: make(chan struct{}),
+	}
+
+	m.ctx, m.cancelCtx = context.WithCancel(context.Background())
+
+	if cfg.Incremental && role == RoleSender {
+		m.manifest = newManifest()
+	}
+
+	m.streamsPeer, _ = peer.(StreamsPeer)
+	m.binder, _ = peer.(ChannelBinder)
+
+	m.peer.OnEstablish(m.onEstablish)
+
+	return m, nil
+}
+
+// ValidateConfig checks that a source entry and a destination directory exist and
+// match the requested mode.
+func ValidateConfig(cfg BackupperConfig) error {
+	if cfg.Sync {
+		return validateSyncConfig(cfg)
+	}
+
+	if len(cfg.Sources) != 0 {
+		return validateSources(cfg)
+	}
+
+	if cfg.Extract && cfg.StorageKey != nil {
+		return errors.New("extraction conflicts with re-encryption")
+	}
+
+	if cfg.ResumeTimeout < 0 {
+		return errors.New("resume timeout is negative")
+	}
+
+	if cfg.AckTimeout < 0 {
+		return errors.New("ack timeout is negative")
+	}
+
+	if cfg.MaxSize < 0 {
+		return errors.New("max size is negative")
+	}
+
+	if len(cfg.Pull) > maxRefusal {
+		return errors.New("name of a pulled source entry is too long")
+	}
+
+	if len(cfg.AuthSecret) != 0 && len(cfg.PairingCode) != 0 {
+		return errors.New("auth secret conflicts with pairing code")
+	}
+
+	if cfg.CompressWorkers < 0 {
+		return errors.New("compress workers are negative")
+	}
+
+	for _, level := range []*int{cfg.Level, cfg.OuterLevel} {
+		if level != nil && (*level < flate.NoCompression || *level > flate.BestCompression) {
+			return errors.Errorf("compression level %d is out of range 0..9", *level)
+		}
+	}
+
+	if len(cfg.StreamKey) != 0 && (cfg.ZipDir || cfg.Forward || cfg.Extract) {
+		return errors.New("stream key applies to a single file sent or stored as is")
+	}
+
+	if cfg.Delta && len(cfg.DestinationDir) != 0 && !cfg.Extract {
+		return errors.New("delta requires extraction on a receiver")
+	}
+
+	if cfg.Incremental && len(cfg.DestinationDir) != 0 && !cfg.Extract {
+		return errors.New("incremental backup requires extraction on a receiver")
+	}
+
+	if cfg.Extract && cfg.Storage != nil {
+		return errors.New("extraction requires a local destination directory")
+	}
+
+	if cfg.Dedup && cfg.Storage != nil {
+		return errors.New("deduplication requires a local destination directory")
+	}
+
+	if cfg.Dedup && cfg.StorageKey != nil {
+		return errors.New("deduplication conflicts with re-encryption")
+	}
+
+	if cfg.Retention != nil {
+		if err := cfg.Retention.validate(); err != nil {
+			return err
+		}
+
+		if cfg.Storage != nil {
+			return errors.New("retention requires a local destination directory")
+		}
+	}
+
 	// Incorrect path might be critical since the error would be given only after
 	// a connection was already established.
-	if len(cfg.DestinationDir) != 0 {
+	if len(cfg.DestinationDir) != 0 && cfg.Storage == nil {
 		fi, err := os.Stat(cfg.DestinationDir)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		if !fi.IsDir() {
-			return nil, errors.Wrap(errNotDirectory, cfg.DestinationDir)
+			return errors.Wrap(errNotDirectory, cfg.DestinationDir)
 		}
 	}
 
@@ -73,82 +463,334 @@ func NewBackupper(cfg BackupperConfig, peer Peer) (*Backupper, error) {
 	if len(cfg.SourceEntry) != 0 {
 		fi, err := os.Stat(cfg.SourceEntry)
 		if err != nil {
-			return nil, err
+			return err
+		}
+
+		if cfg.Extract {
+			return errors.New("extraction is supported by a receiver only")
+		}
+
+		if cfg.StorageKey != nil {
+			return errors.New("re-encryption is supported by a receiver only")
+		}
+
+		if cfg.MaxSize != 0 {
+			return errors.New("quota is supported by a receiver only")
+		}
+
+		if len(cfg.Pull) != 0 {
+			return errors.New("pulling is supported by a receiver only")
+		}
+
+		if cfg.Retention != nil {
+			return errors.New("retention is supported by a receiver only")
+		}
+
+		if cfg.Forward {
+			if cfg.ZipDir || cfg.Recipient != nil {
+				return errors.New("forwarded envelope is sent as is")
+			}
+
+			if !envelope.IsEnvelope(cfg.SourceEntry) {
+				return errors.Errorf("forwarded file is not an envelope: %s", cfg.SourceEntry)
+			}
+		}
+
+		if cfg.Shards != nil {
+			if cfg.ShardIndex < 0 || cfg.ShardIndex >= cfg.Shards.code.Shards() {
+				return errors.Errorf("shard %d is out of range", cfg.ShardIndex)
+			}
+
+			if cfg.Forward || cfg.Recipient != nil || len(cfg.StreamKey) != 0 {
+				return errors.New("shards are sent as is")
+			}
+
+			if cfg.Delta || cfg.Incremental || cfg.Dedup || len(cfg.ArchiveCache) != 0 || cfg.Format == FormatTree {
+				return errors.New("shards require a backup archived as a whole")
+			}
+		}
+
+		if len(cfg.Route) != 0 && cfg.Recipient == nil {
+			return errors.New("route requires a recipient")
+		}
+
+		switch cfg.Format {
+		case "", FormatZip:
+		case Format7z, FormatTarGz, FormatTarZst, FormatTree:
+			if !cfg.ZipDir {
+				return errors.Errorf("%s format requires a zipped directory", cfg.Format)
+			}
+		default:
+			return errors.Errorf("unknown archive format: %s", cfg.Format)
+		}
+
+		if cfg.Delta && (!cfg.ZipDir || !isZipFormat(cfg.Format) || cfg.Recipient != nil || len(cfg.ArchiveCache) != 0) {
+			return errors.New("delta requires a zipped directory in zip format sent as is")
+		}
+
+		if cfg.Incremental && (!cfg.ZipDir || !isZipFormat(cfg.Format) || cfg.Recipient != nil || len(cfg.ArchiveCache) != 0) {
+			return errors.New("incremental backup requires a zipped directory in zip format sent as is")
+		}
+
+		if cfg.Dedup && (!cfg.ZipDir || !isZipFormat(cfg.Format) || cfg.Recipient != nil || len(cfg.ArchiveCache) != 0) {
+			return errors.New("deduplication requires a directory sent as is in the default format")
+		}
+
+		if cfg.Dedup && (cfg.Delta || cfg.Incremental) {
+			return errors.New("deduplication conflicts with delta and incremental backup")
+		}
+
+		if cfg.Incremental && len(cfg.Manifest) == 0 {
+			return errors.New("incremental backup requires a manifest path")
+		}
+
+		if len(cfg.ArchiveCache) != 0 && (!cfg.ZipDir || !isZipFormat(cfg.Format)) {
+			return errors.New("archive cache requires a zipped directory in zip format")
+		}
+
+		if cfg.Escrow != nil && (!cfg.ZipDir || !isZipFormat(cfg.Format)) {
+			return errors.New("key escrow requires a zipped directory in zip format")
+		}
+
+		if len(cfg.FileRules) != 0 && !cfg.ZipDir {
+			return errors.New("file rules require a zipped directory")
+		}
+
+		if (len(cfg.Exclude) != 0 || len(cfg.Include) != 0) && !cfg.ZipDir {
+			return errors.New("path patterns require a zipped directory")
+		}
+
+		for _, p := range cfg.Include {
+			if p.negate {
+				return errors.Errorf("include pattern %q is negated", p)
+			}
+		}
+
+		if cfg.ModifiedRetries < 0 {
+			return errors.New("number of retries of modified files is negative")
 		}
 
 		if cfg.ZipDir {
 			if !fi.IsDir() {
-				return nil, errors.Wrap(errNotDirectory, cfg.SourceEntry)
+				return errors.Wrap(errNotDirectory, cfg.SourceEntry)
 			}
 
 			if len(cfg.OutputFilename) == 0 {
-				return nil, errors.New("output filename is empty")
+				return errors.New("output filename is empty")
 			}
 		} else {
 			if fi.IsDir() {
-				return nil, errors.Wrap(errIsDirectory, cfg.SourceEntry)
+				return errors.Wrap(errIsDirectory, cfg.SourceEntry)
 			}
 		}
 	}
 
-	m := &Backupper{
-		cfg:          cfg,
-		peer:         peer,
-		shutdownChan: make(chan struct{}),
+	return nil
+}
+
+func (m *Backupper) Done() <-chan struct{} {
+	if m.syncDone != nil {
+		return m.syncDone
 	}
 
-	m.peer.OnEstablish(m.onEstablish)
+	return m.shutdownChan
+}
 
-	return m, nil
+// Result returns a snapshot of a transfer's progress that is safe to be called
+// at any time.
+func (m *Backupper) Result() Result {
+	m.resultMx.Lock()
+	defer m.resultMx.Unlock()
+
+	result := m.result
+	result.Stats = result.Stats.clone()
+	result.SentBytes = m.peer.sent.Load()
+	result.ReceivedBytes = m.peer.received.Load()
+	result.Progress = m.peer.progress()
+
+	if m.reverse != nil {
+		return m.syncResult(result)
+	}
+
+	return result
 }
 
-func (m *Backupper) Done() <-chan struct{} {
-	return m.shutdownChan
+func (m *Backupper) setFilename(name string) {
+	m.resultMx.Lock()
+	defer m.resultMx.Unlock()
+
+	m.result.Filename = name
+}
+
+func (m *Backupper) setDigest(sum []byte) {
+	m.resultMx.Lock()
+	defer m.resultMx.Unlock()
+
+	m.result.Digest = sum
 }
 
 func (m *Backupper) onEstablish() {
-	if len(m.cfg.SourceEntry) != 0 {
-		if err := m.sendSourceEntry(); err != nil {
-			log.Error(err)
-		} else {
-			log.Info("file sent")
-		}
+	// A sender may have fallen back to an upload meanwhile (see: Upload()).
+	if !m.startTransfer() {
+		m.peer.Shutdown()
 
+		return
+	}
+
+	err := m.authenticate(m.peer, m.binder)
+	if err != nil {
+		err = errors.Wrap(err, "authentication")
+	} else {
+		err = m.handshake(m.peer, true)
+	}
+
+	switch {
+	case err != nil:
+		m.log.Error(err)
+
+		// An unauthenticated peer is cut off at once, as is one which fails to
+		// agree on a transfer.
 		m.peer.Shutdown()
+	case m.result.Role == RoleSender:
+		if err = m.sendSourceEntry(&contextWriter{ctx: m.ctx, w: m.stream}); err != nil {
+			m.log.Error(err)
+			m.stream.abort(err)
+		} else if err = m.stream.Close(); err != nil {
+			m.log.Error(err)
+
+			// A receiver is told that a transfer is canceled while it's
+			// storing a file.
+			if errors.Is(err, ErrCanceled) {
+				m.stream.abort(err)
+			}
+		} else {
+			m.log.Info("file sent")
+			m.setDigest(m.stream.Sum())
+			m.saveManifest()
+		}
 
-		if _, err := io.ReadAll(m.peer); err != nil {
-			log.Error(err)
+		m.stream.shutdown()
+	default:
+		err = m.receiveFile()
+		if err == nil {
+			err = m.stream.finish()
 		}
-	} else {
-		if err := m.receiveFile(); err != nil {
-			log.Error(err)
+
+		if err != nil {
+			m.log.Error(err)
+
+			// A sender is cut off rather than left sending data which is
+			// discarded anyway.
+			m.stream.abort(err)
 		} else {
-			log.Info("file received")
+			m.log.Info("file received")
+			m.setDigest(m.stream.Sum())
+			m.catalogBackup()
 		}
 	}
 
-	m.shutdownChan <- struct{}{}
+	m.finishTransfer(err)
+}
+
+// startTransfer moves a transfer from the waiting phase to the transferring one.
+// It returns false if a transfer has already started.
+func (m *Backupper) startTransfer() bool {
+	m.resultMx.Lock()
+	defer m.resultMx.Unlock()
+
+	if m.result.Phase != PhaseWaiting {
+		return false
+	}
+
+	m.result.Phase = PhaseTransferring
+	m.result.StartedAt = time.Now()
+
+	return true
+}
+
+func (m *Backupper) finishTransfer(err error) {
+	role := m.result.Role
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	metrics.Count("transfers", 1, "role", role, "result", result)
+	metrics.Timing("transfer", time.Since(m.result.StartedAt), "role", role, "result", result)
+	metrics.SetGauge("transfer_last_finished_timestamp_seconds", float64(time.Now().Unix()), "role", role, "result", result)
+
+	m.resultMx.Lock()
+	m.result.Phase = PhaseFinished
+	m.result.FinishedAt = time.Now()
+	m.result.Err = err
+	m.resultMx.Unlock()
+
+	// See: peer.WebRTC.onConnStateChange().
+	close(m.shutdownChan)
 }
 
-func (m *Backupper) sendSourceEntry() error {
+// sendSourceEntry writes a source entry to w, which is either Peer or an upload
+// to a fallback destination (see: Upload()).
+func (m *Backupper) sendSourceEntry(w io.Writer) error {
+	switch {
+	case m.cfg.Forward:
+		return m.forwardEnvelope(w)
+	case m.cfg.Recipient != nil:
+		return m.sendSealed(w)
+	case m.cfg.Shards != nil:
+		return m.sendShard(w)
+	}
+
+	return m.sendEntry(w)
+}
+
+// sendEntry writes a source entry to w, which is either a destination or an
+// envelope.
+func (m *Backupper) sendEntry(w io.Writer) error {
+	m.startProgress()
+
 	if m.cfg.ZipDir {
-		return m.sendSourceDirArchived()
+		return m.sendSourceDirArchived(w)
 	}
 
-	return m.sendSourceFile()
+	return m.sendSourceFile(w)
 }
 
-func (m *Backupper) sendSourceDirArchived() error {
-	if err := m.writeFilename(m.cfg.OutputFilename, m.peer); err != nil {
+func (m *Backupper) sendSourceDirArchived(w io.Writer) error {
+	switch {
+	case m.cfg.Format == Format7z:
+		return m.sendSourceDir7z(w)
+	case isTarFormat(m.cfg.Format):
+		return m.sendSourceDirTar(w)
+	case m.cfg.Format == FormatTree || m.cfg.Dedup:
+		return m.sendSourceDirTree(w)
+	}
+
+	if err := m.writeHeader(m.cfg.OutputFilename, nil, w); err != nil {
+		return err
+	}
+
+	m.log.WithField(log.FieldFile, m.cfg.OutputFilename).Info("sending file")
+
+	m.setFilename(m.cfg.OutputFilename)
+
+	cw := &countingWriter{Writer: w}
+
+	if err := m.sendSourceDirContentArchived(cw); err != nil {
 		return err
 	}
 
-	log.Info("sending file: ", m.cfg.OutputFilename)
+	m.setArchiveBytes(cw.n)
+
+	if len(m.cfg.ArchiveCache) != 0 {
+		m.removeArchiveCache()
+	}
 
-	return m.sendSourceDirContentArchived()
+	return nil
 }
 
-func (m *Backupper) sendSourceDirContentArchived() error {
+func (m *Backupper) sendSourceDirContentArchived(w io.Writer) error {
 	fi, err := os.Stat(m.cfg.SourceEntry)
 	if err != nil {
 		return err
@@ -164,81 +806,318 @@ func (m *Backupper) sendSourceDirContentArchived() error {
 	// for the second archive level makes more sense but it gives the io.ErrShortWrite
 	// error in future trying to write a file from a source directory unlike the
 	// standard Golang zip package. However the last one does NOT support archive
-	// encryption.
+	// encryption. An inner archive is stored at the deflate level of 0 instead.
 	fh.Method = zip.Deflate
 	fh.SetMode(fh.Mode() &^ fs.ModeDir)
 
 	m.setArchivedFilePassword(fh, m.cfg.Password2)
 
-	z2 := zip.NewWriter(m.peer)
+	z2 := newInnerWriter(w, m.cfg.CompressWorkers)
 	defer z2.Close()
 
-	w, err := z2.CreateHeader(fh)
+	w2, err := z2.CreateLevelHeader(fh, m.cfg.OuterLevel)
 	if err != nil {
 		return err
 	}
 
-	z1 := zip.NewWriter(w)
-	defer z1.Close()
+	m.log.WithField(log.FieldDir, m.cfg.SourceEntry).Info("archiving directory")
 
-	log.Info("archiving directory: ", m.cfg.SourceEntry)
+	if len(m.cfg.ArchiveCache) != 0 {
+		if err := m.archiveDirCached(w2); err != nil {
+			return err
+		}
+	} else {
+		z1 := newInnerWriter(w2, m.cfg.CompressWorkers)
 
-	return m.archiveDir(z1)
+		if err := m.archiveDir(z1); err != nil {
+			z1.Close()
+
+			return err
+		}
+
+		if m.manifest != nil {
+			if err := m.writeManifest(z1); err != nil {
+				z1.Close()
+
+				return errors.Wrap(err, "manifest")
+			}
+		}
+
+		if err := z1.Close(); err != nil {
+			return err
+		}
+	}
+
+	if m.cfg.Escrow != nil {
+		if err := m.writeEscrow(z2.Writer); err != nil {
+			return errors.Wrap(err, "key escrow")
+		}
+	}
+
+	// A cache is removed once an archive is sent, so a failure to flush it must
+	// not be missed.
+	return z2.Close()
+}
+
+func (m *Backupper) archiveDir(z *innerWriter) error {
+	return m.walkSourceDir(func(path, relPath string, fi fs.FileInfo, rule *FileRule) error {
+		return m.archiveEntry(z, path, relPath, fi, rule)
+	})
+}
+
+// archiveEntry writes a file of a source directory at path to z as an entry
+// protected with Password1, unless a rule it matches tells otherwise. An empty
+// directory is written as an entry named with a trailing slash, and a symbolic
+// link as an entry carrying its target (see: archiveSymlink()).
+func (m *Backupper) archiveEntry(z *innerWriter, path, relPath string, fi fs.FileInfo, rule *FileRule) error {
+	fh, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+
+	fh.Name = relPath
+	fh.Method = zip.Deflate
+
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		return m.archiveSymlink(z, fh, path, rule)
+	}
+
+	if m.cfg.PreserveMeta {
+		fh.Extra = append(fh.Extra, metaExtra(statMeta(fi))...)
+	}
+
+	if fi.IsDir() {
+		m.log.WithField(log.FieldFile, relPath).Debug("archiving empty directory")
+
+		fh.Name += "/"
+
+		_, err := z.CreateHeader(fh)
+
+		return err
+	}
+
+	m.log.WithField(log.FieldFile, relPath).Debug("archiving file")
+
+	level := m.fileLevel(relPath, rule)
+
+	if rule == nil || !rule.Plain {
+		m.setArchivedFilePassword(fh, m.cfg.Password1)
+	}
+
+	sig := m.signature(fh)
+
+	w, err := z.CreateLevelHeader(fh, level)
+	if err != nil {
+		return err
+	}
+
+	var consistent bool
+
+	if sig != nil {
+		consistent, err = m.archiveDelta(sig, path, relPath, fi, w)
+	} else {
+		consistent, err = m.archiveFile(path, relPath, fi, w)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// The central directory is written once all files are archived, so an entry
+	// is flagged there.
+	if !consistent {
+		fh.Comment = InconsistentComment
+	}
+
+	return nil
 }
 
-func (m *Backupper) archiveDir(z *zip.Writer) error {
-	return filepath.Walk(m.cfg.SourceEntry, func(path string, fi fs.FileInfo, err error) error {
+// walkSourceDir calls fn for every file of a source directory recursively with
+// its path relative to the directory and the first of FileRules it matches, if
+// any. Files which are excluded by patterns (see: excluded()) or match a rule to
+// skip them aren't passed to fn. Empty directories are passed to fn as well, so
+// that they're kept. Symbolic links are passed as they are, unless FollowSymlinks
+// is set, in which case files they point to are passed instead and directories
+// they point to are walked.
+func (m *Backupper) walkSourceDir(fn func(path, relPath string, fi fs.FileInfo, rule *FileRule) error) error {
+	return m.walkDir(m.cfg.SourceEntry, ".", nil, fn)
+}
+
+// walkDir walks a directory root found at rootRel of a source directory (see:
+// walkSourceDir()). Parents are real paths of directories of links followed to
+// reach root, so that a link pointing to one of them isn't walked forever.
+func (m *Backupper) walkDir(root, rootRel string, parents []string, fn func(path, relPath string, fi fs.FileInfo, rule *FileRule) error) error {
+	if m.cfg.FollowSymlinks {
+		real, err := filepath.EvalSymlinks(root)
+		if err == nil {
+			real, err = filepath.Abs(real)
+		}
+
 		if err != nil {
 			return err
 		}
 
-		if fi.IsDir() {
+		// A link within a directory it points to makes a loop as well.
+		loop := len(parents) != 0 && strings.HasPrefix(root, real+string(filepath.Separator))
+
+		for _, parent := range parents {
+			loop = loop || real == parent
+		}
+
+		if loop {
+			m.log.WithField(log.FieldFile, rootRel).Info("symbolic link loop skipped")
+
 			return nil
 		}
 
-		fh, err := zip.FileInfoHeader(fi)
+		root = real
+		parents = append(parents, real)
+	}
+
+	return filepath.Walk(root, func(path string, fi fs.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		relPath, err := filepath.Rel(m.cfg.SourceEntry, path)
+		relPath, err := filepath.Rel(root, path)
 		if err != nil {
 			return err
 		}
 
-		fh.Name = relPath
-		fh.Method = zip.Deflate
+		relPath = filepath.Join(rootRel, relPath)
 
-		m.setArchivedFilePassword(fh, m.cfg.Password1)
+		if relPath == "." {
+			return nil
+		}
 
-		w, err := z.CreateHeader(fh)
-		if err != nil {
-			return err
+		// A manifest of an extracted version which is backed up again is
+		// replaced.
+		if m.manifest != nil && relPath == ManifestName {
+			return nil
+		}
+
+		var linked bool
+
+		if fi.Mode()&fs.ModeSymlink != 0 && m.cfg.FollowSymlinks {
+			target, err := os.Stat(path)
+			if err != nil {
+				m.log.WithField(log.FieldFile, relPath).Info("broken symbolic link skipped")
+
+				return nil
+			}
+
+			fi, linked = target, true
+		}
+
+		if m.excluded(filepath.ToSlash(relPath), fi.IsDir()) {
+			m.log.WithField(log.FieldFile, relPath).Debug("excluded by pattern")
+
+			// Skipping a link would skip the rest of its directory.
+			if fi.IsDir() && !linked {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if fi.IsDir() {
+			if linked {
+				return m.walkDir(path, relPath, parents, fn)
+			}
+
+			// A directory which has files is made along with them.
+			empty, err := emptyDir(path)
+			if err != nil || !empty {
+				return err
+			}
+
+			return fn(path, relPath, fi, nil)
+		}
+
+		rule := m.fileRule(path, filepath.ToSlash(relPath), fi)
+
+		if rule != nil && rule.Skip {
+			m.log.WithField(log.FieldFile, relPath).Debug("file skipped by rule")
+
+			m.addSkippedStats(fi.Size())
+
+			return nil
+		}
+
+		if m.unchanged(filepath.ToSlash(relPath), fi) {
+			m.log.WithField(log.FieldFile, relPath).Debug("file unchanged since previous version")
+
+			m.addSkippedStats(fi.Size())
+
+			return nil
 		}
 
-		return m.writeFile(path, w)
+		m.addFileStats(filepath.ToSlash(relPath), fi.Size())
+
+		return fn(path, relPath, fi, rule)
 	})
 }
 
+// emptyDir tells whether a directory at path has no entries.
+func emptyDir(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if _, err := f.Readdirnames(1); err != io.EOF {
+		return false, err
+	}
+
+	return true, nil
+}
+
 func (m *Backupper) setArchivedFilePassword(fh *zip.FileHeader, password string) {
 	if len(password) == 0 {
 		return
 	}
 
 	fh.SetPassword(password)
-	fh.SetEncryptionType(zip.StandardEncryption)
+
+	if m.cfg.ZipCrypto {
+		fh.SetEncryptionType(zip.StandardEncryption)
+	} else {
+		fh.SetEncryptionType(zip.AES256Encryption)
+	}
 }
 
-func (m *Backupper) sendSourceFile() error {
+func (m *Backupper) sendSourceFile(w io.Writer) error {
 	name := filepath.Base(m.cfg.SourceEntry)
 
-	if err := m.writeFilename(name, m.peer); err != nil {
+	if len(m.cfg.StreamKey) != 0 {
+		name += crypto.StreamExt
+	}
+
+	fi, err := os.Stat(m.cfg.SourceEntry)
+	if err != nil {
+		return err
+	}
+
+	if err := m.writeHeader(name, statMeta(fi), w); err != nil {
+		return err
+	}
+
+	m.log.WithField(log.FieldFile, m.cfg.SourceEntry).Info("sending file")
+
+	m.setFilename(name)
+
+	cw := &countingWriter{Writer: w}
+
+	if err := m.writeFile(m.cfg.SourceEntry, cw); err != nil {
 		return err
 	}
 
-	log.Info("sending file: ", m.cfg.SourceEntry)
+	// A single file is sent as is, even if encrypted.
+	m.addFileStats(name, cw.n)
+	m.setArchiveBytes(cw.n)
 
-	return m.writeFile(m.cfg.SourceEntry, m.peer)
+	return nil
 }
 
 func (m *Backupper) writeFilename(name string, w io.Writer) error {
@@ -252,6 +1131,7 @@ func (m *Backupper) writeFilename(name string, w io.Writer) error {
 	return binary.Write(w, binary.BigEndian, b)
 }
 
+// writeFile writes content of a file to w, it's encrypted if StreamKey is set.
 func (m *Backupper) writeFile(path string, w io.Writer) error {
 	f, err := os.Open(path)
 	if err != nil {
@@ -259,75 +1139,194 @@ func (m *Backupper) writeFile(path string, w io.Writer) error {
 	}
 	defer f.Close()
 
-	_, err = io.Copy(w, f)
+	r := io.TeeReader(f, m.peer.meter)
 
-	return err
+	if len(m.cfg.StreamKey) == 0 {
+		_, err = io.Copy(w, r)
+
+		return err
+	}
+
+	sw, err := crypto.NewStreamWriter(w, []byte(m.cfg.StreamKey))
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(sw, r); err != nil {
+		return err
+	}
+
+	return sw.Close()
 }
 
 func (m *Backupper) receiveFile() error {
-	var nameLen uint8
+	r := &contextReader{ctx: m.ctx, r: m.stream}
 
-	if err := binary.Read(m.peer, binary.BigEndian, &nameLen); err != nil {
+	name, meta, err := m.readHeader(r)
+	if err != nil {
 		return err
 	}
 
-	name := make([]byte, nameLen)
+	start := m.stream.offset()
+
+	defer func() {
+		m.setArchiveBytes(m.stream.offset() - start)
+	}()
+
+	if envelope.IsEnvelope(name) {
+		return m.receiveEnvelope(name)
+	}
+
+	return m.receiveNamed(name, meta, r)
+}
 
-	if err := binary.Read(m.peer, binary.BigEndian, name); err != nil {
+// receiveNamed receives content of a file named name with metadata meta from r,
+// which is either Peer or an opened envelope.
+func (m *Backupper) receiveNamed(name string, meta *fileMeta, r io.Reader) error {
+	br := bufio.NewReader(r)
+
+	tree, err := isTree(br)
+	if err != nil {
 		return err
 	}
 
-	path := m.cfg.DestinationDir + string(os.PathSeparator) + string(name)
+	if tree {
+		return m.receiveTree(name, br)
+	}
+
+	dedup, err := isDedup(br)
+	if err != nil {
+		return err
+	}
+
+	if dedup {
+		return m.receiveDedup(name, br)
+	}
+
+	r = br
+
+	if m.cfg.Extract {
+		return m.extractFile(name, meta, r)
+	}
+
+	if m.cfg.StorageKey != nil {
+		return m.receiveReencrypted(name, r)
+	}
+
+	m.log.WithField(log.FieldFile, name).Info("receiving file")
+
+	m.setFilename(name)
+
+	if len(m.cfg.StreamKey) != 0 && strings.HasSuffix(name, crypto.StreamExt) {
+		v := m.verifyStream(r)
+		defer v.Close()
+
+		r = v
+	}
+
+	if err := m.receiveToFile(name, name, r); err != nil {
+		return err
+	}
+
+	m.restoreMeta(name, meta)
+
+	return nil
+}
+
+func (m *Backupper) readFilename(r io.Reader) (string, error) {
+	var nameLen uint8
 
-	m.shiftFileVersions(path)
+	if err := binary.Read(r, binary.BigEndian, &nameLen); err != nil {
+		return "", err
+	}
 
-	log.Info("receiving file: ", string(name))
+	name := make([]byte, nameLen)
 
-	return m.saveFile(path)
+	if err := binary.Read(r, binary.BigEndian, name); err != nil {
+		return "", err
+	}
+
+	return string(name), nil
 }
 
-func (m *Backupper) shiftFileVersions(path string) {
+// shiftFileVersions shifts versions of a stored file named name (see: Storage),
+// or thins them out by Retention if it's set (see: retainFileVersions()). Tree
+// tells that versions are directories a receiver makes (see: extractFile() and
+// receiveTree()).
+func (m *Backupper) shiftFileVersions(name string, tree bool) {
+	// A name is checked before anything is removed, even though it's checked
+	// once received (see: readHeader()).
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		m.log.Error(errors.Wrap(ErrUnsafeName, name))
+
+		return
+	}
+
+	if m.cfg.Retention != nil {
+		m.retainFileVersions(name, tree)
+
+		return
+	}
+
 	oldestVersion := int(m.cfg.Versions) - 1
 
 	for i := oldestVersion; i >= 0; i-- {
-		oldVersionPath := path
+		oldVersion := versionName(name, i)
 
-		if i != 0 {
-			oldVersionPath += fmt.Sprintf(".%d", i)
+		exists, err := m.storage.Exists(oldVersion)
+		if err != nil {
+			m.log.Error(err)
 		}
 
-		if _, err := os.Stat(oldVersionPath); err != nil {
-			if os.IsNotExist(err) {
-				continue
-			}
-
-			log.Error(err)
+		if !exists {
+			continue
 		}
 
 		if i == oldestVersion {
-			if err := os.Remove(oldVersionPath); err != nil {
-				log.Error(err)
+			m.log.WithField(log.FieldFile, m.storage.Location(oldVersion)).Debug("removing the oldest file version")
+
+			if err := m.removeStored(oldVersion, tree); err != nil {
+				m.log.Error(err)
 			}
 
 			continue
 		}
 
-		newVersionPath := path + fmt.Sprintf(".%d", i+1)
+		newVersion := versionName(name, i+1)
 
-		if err := os.Rename(oldVersionPath, newVersionPath); err != nil {
-			log.Error(err)
+		m.log.WithFields(log.Fields{
+			log.FieldFile:    m.storage.Location(oldVersion),
+			log.FieldVersion: i + 1,
+		}).Debug("shifting file version")
+
+		if err := m.storage.Rename(oldVersion, newVersion); err != nil {
+			m.log.Error(err)
+		}
+	}
+}
+
+// removeStored removes a stored file named name. Only a directory of a tree
+// (see: shiftFileVersions()) is removed with its contents, anything else is
+// removed as a file, so that a directory isn't removed recursively unless a
+// receiver has made it.
+func (m *Backupper) removeStored(name string, tree bool) error {
+	if dir, ok := m.storage.(DirStorage); ok && tree {
+		if fi, err := os.Lstat(dir.Location(name)); err == nil && fi.IsDir() {
+			return dir.RemoveAll(name)
 		}
 	}
+
+	return m.storage.Remove(name)
 }
 
-func (m *Backupper) saveFile(path string) error {
+func (m *Backupper) saveFile(path string, r io.Reader) error {
 	f, err := os.Create(path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	_, err = io.Copy(f, m.peer)
+	_, err = io.Copy(f, r)
 
 	return err
 }
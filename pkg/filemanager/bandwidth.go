@@ -0,0 +1,58 @@
+package filemanager
+
+import (
+	"context"
+	"time"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/sync"
+)
+
+// Limiter limits a rate of data written to Peer (see: sync.BandwidthLimiter).
+type Limiter interface {
+	Wait(ctx context.Context, n int) error
+	// Rate returns a limit in bytes per second applied at t, 0 means no limit.
+	Rate(t time.Time) float64
+}
+
+// limitedPeer waits for a limiter before every write, and logs a limit whenever
+// it changes during a transfer.
+type limitedPeer struct {
+	Peer
+
+	limiter Limiter
+	log     log.Logger
+
+	rate    float64
+	started bool
+}
+
+// limitPeer wraps peer with Limiter of cfg if it's set.
+func limitPeer(peer Peer, cfg BackupperConfig) Peer {
+	if cfg.Limiter == nil {
+		return peer
+	}
+
+	return &limitedPeer{
+		Peer:    peer,
+		limiter: cfg.Limiter,
+		log:     cfg.Log,
+	}
+}
+
+func (p *limitedPeer) Write(payload []byte) (int, error) {
+	if rate := p.limiter.Rate(time.Now()); rate != p.rate || !p.started {
+		p.rate = rate
+		p.started = true
+
+		p.log.WithField(log.FieldRate, sync.FormatRate(rate)).Info("bandwidth limit applied")
+	}
+
+	// Writes are never cancelled: they are as long as a chunk of data takes to
+	// be sent at the limit.
+	if err := p.limiter.Wait(context.Background(), len(payload)); err != nil {
+		return 0, err
+	}
+
+	return p.Peer.Write(payload)
+}
@@ -0,0 +1,74 @@
+package filemanager
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ErrCanceled means that a transfer has been canceled (see: Cancel()).
+var ErrCanceled = errors.New("transfer canceled")
+
+// Cancel aborts a transfer: reads and writes of it fail at once, the other peer
+// is told that it's aborted, and a file received partially is removed rather
+// than quarantined. A transfer which hasn't started yet finishes at once, and a
+// finished one is left as is.
+func (m *Backupper) Cancel() {
+	if m.reverse != nil {
+		m.reverse.Cancel()
+	}
+
+	m.cancelCtx()
+
+	if m.startTransfer() {
+		m.log.Info("transfer canceled before it started")
+		m.finishTransfer(ErrCanceled)
+
+		return
+	}
+
+	m.resultMx.Lock()
+	finished := m.result.Phase == PhaseFinished
+	m.resultMx.Unlock()
+
+	if finished {
+		return
+	}
+
+	m.log.Info("canceling transfer")
+
+	// A connection in the middle of a handshake isn't attached to a stream yet,
+	// it's closed by an owner of Peer.
+	m.stream.abort(ErrCanceled)
+}
+
+// contextReader fails reads once ctx is done, so that copying from it stops
+// between pieces of data.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if r.ctx.Err() != nil {
+		return 0, ErrCanceled
+	}
+
+	return r.r.Read(p)
+}
+
+// contextWriter fails writes once ctx is done, so that archiving into it stops
+// between pieces of data.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *contextWriter) Write(p []byte) (int, error) {
+	if w.ctx.Err() != nil {
+		return 0, ErrCanceled
+	}
+
+	return w.w.Write(p)
+}
@@ -0,0 +1,194 @@
+package filemanager
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/peer"
+
+	"github.com/pkg/errors"
+)
+
+// CatalogFile is a file of a destination directory a receiver records every
+// backup it has stored in, as a JSON line of CatalogRecord each.
+const CatalogFile = ".catalog.jsonl"
+
+// CatalogRecord describes a received backup.
+type CatalogRecord struct {
+	SessionID string `json:"session_id,omitempty"`
+	// Source is a remote address of a connection a backup came over.
+	Source   string `json:"source,omitempty"`
+	Filename string `json:"filename"`
+	// Stored is a name a backup is stored as when it's received (e.g. a
+	// directory it's extracted into), which is shifted with its versions later.
+	Stored string `json:"stored"`
+	// Size is a size of a stored file, or of received data if a backup isn't
+	// stored as is, and SHA256 is a hash of a stored file.
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256,omitempty"`
+	ReceivedAt time.Time `json:"received_at"`
+	// Version is a number of backups named Filename received so far, this one
+	// included.
+	Version int `json:"version"`
+}
+
+// storedBackup is a backup named name a receiver has stored as target, size
+// and sum are of a stored file, they are unset if it's a directory.
+type storedBackup struct {
+	name   string
+	target string
+	size   int64
+	sum    []byte
+}
+
+// catalogMx serializes records of backups received concurrently, so that their
+// versions are numbered in order.
+var catalogMx sync.Mutex
+
+// connInfoPeer is a peer which describes a connection to the other one.
+type connInfoPeer interface {
+	ConnectionInfo() (*peer.ConnectionInfo, error)
+}
+
+// setStored remembers a backup named name which is stored as target for its
+// catalog record (see: catalogBackup()).
+func (m *Backupper) setStored(name, target string, size int64, sum []byte) {
+	m.stored = &storedBackup{name: name, target: target, size: size, sum: sum}
+
+	m.resultMx.Lock()
+	m.result.StoredDigest = sum
+	m.resultMx.Unlock()
+}
+
+// catalogBackup records a stored backup in CatalogFile of a destination
+// directory. A backup is kept even if it fails to be recorded.
+func (m *Backupper) catalogBackup() {
+	dir, ok := m.storage.(DirStorage)
+	if !ok || m.stored == nil {
+		return
+	}
+
+	record := CatalogRecord{
+		SessionID:  m.cfg.SessionID,
+		Source:     m.source(),
+		Filename:   m.stored.name,
+		Stored:     m.stored.target,
+		Size:       m.Result().Stats.ArchiveBytes,
+		ReceivedAt: time.Now().UTC(),
+	}
+
+	if m.stored.sum != nil {
+		record.Size = m.stored.size
+		record.SHA256 = hex.EncodeToString(m.stored.sum)
+	}
+
+	if err := appendCatalog(string(dir), &record); err != nil {
+		m.log.Error(errors.Wrap(err, "catalog"))
+
+		return
+	}
+
+	m.log.WithFields(log.Fields{
+		log.FieldFile:    record.Filename,
+		log.FieldVersion: record.Version,
+	}).Debug("backup is recorded in catalog")
+}
+
+// source returns a remote address of a connection a transfer goes over, if a
+// peer tells it.
+func (m *Backupper) source() string {
+	conn, err := m.stream.current()
+	if err != nil || conn == nil {
+		return ""
+	}
+
+	p, ok := conn.Peer.(connInfoPeer)
+	if !ok {
+		return ""
+	}
+
+	info, err := p.ConnectionInfo()
+	if err != nil {
+		return ""
+	}
+
+	return info.RemoteAddr
+}
+
+// appendCatalog numbers a version of a record after ones of CatalogFile of dir
+// and appends it there.
+func appendCatalog(dir string, record *CatalogRecord) error {
+	catalogMx.Lock()
+	defer catalogMx.Unlock()
+
+	records, err := ReadCatalog(dir)
+	if err != nil {
+		return err
+	}
+
+	record.Version = 1
+
+	for _, r := range records {
+		if r.Filename == record.Filename && r.Version >= record.Version {
+			record.Version = r.Version + 1
+		}
+	}
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, CatalogFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0664)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+
+		return err
+	}
+
+	return f.Close()
+}
+
+// ReadCatalog returns records of CatalogFile of a destination directory dir in
+// order they're received, there are none if it's missing.
+func ReadCatalog(dir string) ([]CatalogRecord, error) {
+	f, err := os.Open(filepath.Join(dir, CatalogFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []CatalogRecord
+
+	s := bufio.NewScanner(f)
+
+	for line := 1; s.Scan(); line++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+
+		var r CatalogRecord
+
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", CatalogFile, line)
+		}
+
+		records = append(records, r)
+	}
+
+	return records, s.Err()
+}
@@ -0,0 +1,251 @@
+package filemanager
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/TelenLiu/go-zip"
+)
+
+const (
+	// compressChunkSize is a size of chunks of an entry deflated concurrently.
+	compressChunkSize = 1 << 20
+	// compressDictSize is a size of a deflate window, the tail of a chunk a next
+	// one is deflated with as a preset dictionary.
+	compressDictSize = 32 << 10
+	// MaxCompressWorkers is the most chunks of an entry deflated at once.
+	MaxCompressWorkers = 0xff
+)
+
+// parallelMethodBase is a base of private compression method IDs go-zip deflates
+// entries with concurrently, the ID holds a number of workers and a level (see:
+// parallelMethod()). Such compressors are registered once they're used.
+const parallelMethodBase = 0xe000
+
+var parallelMethods = struct {
+	sync.Mutex
+	registered map[uint16]bool
+}{registered: map[uint16]bool{}}
+
+// parallelMethod returns a private method ID of entries deflated at level by
+// workers, it registers a compressor of the ID if it isn't yet.
+func parallelMethod(level, workers int) uint16 {
+	if workers > MaxCompressWorkers {
+		workers = MaxCompressWorkers
+	}
+
+	method := parallelMethodBase | uint16(workers)<<4 | uint16(level-flate.DefaultCompression)
+
+	parallelMethods.Lock()
+	defer parallelMethods.Unlock()
+
+	if !parallelMethods.registered[method] {
+		zip.RegisterCompressor(method, func(w io.Writer) (io.WriteCloser, error) {
+			return newParallelWriter(w, level, workers), nil
+		})
+
+		parallelMethods.registered[method] = true
+	}
+
+	return method
+}
+
+// parallelWriter deflates data written to it in chunks by up to workers at once
+// and writes them in order as a single deflate stream: each chunk but the last
+// one ends with a sync flush, so that the next one starts at a byte boundary,
+// and is deflated with the tail of a previous one as a dictionary, so that its
+// back-references resolve to data an inflater has just produced.
+type parallelWriter struct {
+	w       io.Writer
+	level   int
+	workers int
+	chunk   []byte
+	dict    []byte
+	queue   []chan compressedChunk
+	err     error
+}
+
+type compressedChunk struct {
+	data []byte
+	err  error
+}
+
+func newParallelWriter(w io.Writer, level, workers int) *parallelWriter {
+	return &parallelWriter{
+		w:       w,
+		level:   level,
+		workers: workers,
+	}
+}
+
+func (w *parallelWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) != 0 && w.err == nil {
+		if w.chunk == nil {
+			w.chunk = make([]byte, 0, compressChunkSize)
+		}
+
+		k := copy(w.chunk[len(w.chunk):cap(w.chunk)], p)
+		w.chunk = w.chunk[:len(w.chunk)+k]
+		p = p[k:]
+
+		if len(w.chunk) == cap(w.chunk) {
+			w.dispatch(false)
+		}
+	}
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	return n, nil
+}
+
+// Close deflates the last chunk and writes the ones left. An entry which fits a
+// single chunk is deflated right away.
+func (w *parallelWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	if w.dict == nil {
+		fw, err := flate.NewWriter(w.w, w.level)
+		if err != nil {
+			return err
+		}
+
+		if _, err := fw.Write(w.chunk); err != nil {
+			return err
+		}
+
+		return fw.Close()
+	}
+
+	w.dispatch(true)
+
+	for len(w.queue) != 0 && w.err == nil {
+		w.writeNext()
+	}
+
+	return w.err
+}
+
+// dispatch deflates a filled chunk in a separate goroutine once fewer than
+// workers chunks are in flight.
+func (w *parallelWriter) dispatch(final bool) {
+	for len(w.queue) >= w.workers && w.err == nil {
+		w.writeNext()
+	}
+
+	if w.err != nil {
+		return
+	}
+
+	chunk, dict := w.chunk, w.dict
+	done := make(chan compressedChunk, 1)
+
+	go func() {
+		data, err := deflateChunk(chunk, dict, w.level, final)
+		done <- compressedChunk{data: data, err: err}
+	}()
+
+	w.queue = append(w.queue, done)
+	w.dict = chunk
+	w.chunk = nil
+
+	if len(chunk) > compressDictSize {
+		w.dict = chunk[len(chunk)-compressDictSize:]
+	}
+}
+
+func (w *parallelWriter) writeNext() {
+	c := <-w.queue[0]
+	w.queue = w.queue[1:]
+
+	if c.err == nil {
+		_, c.err = w.w.Write(c.data)
+	}
+
+	if c.err != nil {
+		w.err = c.err
+	}
+}
+
+func deflateChunk(chunk, dict []byte, level int, final bool) ([]byte, error) {
+	var buf bytes.Buffer
+
+	fw, err := flate.NewWriterDict(&buf, level, dict)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := fw.Write(chunk); err != nil {
+		return nil, err
+	}
+
+	if final {
+		err = fw.Close()
+	} else {
+		err = fw.Flush()
+	}
+
+	return buf.Bytes(), err
+}
+
+// gzipWriter writes a gzip stream of data written to it deflated by workers
+// concurrently (see: parallelWriter).
+type gzipWriter struct {
+	w    io.Writer
+	fw   *parallelWriter
+	crc  hash.Hash32
+	size uint32
+	err  error
+}
+
+func newGzipWriter(w io.Writer, workers int) *gzipWriter {
+	// A header without a name nor a time, of an unknown OS.
+	_, err := w.Write([]byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 0xff})
+
+	return &gzipWriter{
+		w:   w,
+		fw:  newParallelWriter(w, flate.DefaultCompression, workers),
+		crc: crc32.NewIEEE(),
+		err: err,
+	}
+}
+
+func (w *gzipWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	w.crc.Write(p)
+	w.size += uint32(len(p))
+
+	return w.fw.Write(p)
+}
+
+func (w *gzipWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	if err := w.fw.Close(); err != nil {
+		return err
+	}
+
+	var trailer [8]byte
+
+	binary.LittleEndian.PutUint32(trailer[:], w.crc.Sum32())
+	binary.LittleEndian.PutUint32(trailer[4:], w.size)
+
+	_, err := w.w.Write(trailer[:])
+
+	return err
+}
@@ -0,0 +1,145 @@
+package filemanager
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"distributed-backup/pkg/log"
+)
+
+const (
+	// InconsistentComment is a comment of an archive entry of a file which was
+	// modified while it was archived, so its content may be torn.
+	InconsistentComment = "inconsistent: modified during archiving"
+
+	// modifiedRetryDelay is a delay a modified file is re-read after, so that a
+	// writer has a chance to finish.
+	modifiedRetryDelay = time.Second
+)
+
+// archiveFile writes a file of a source directory at path to w and tells whether
+// it stayed consistent, i.e. its size and modification time didn't change while
+// it was read and as many bytes as its size were read. If ModifiedRetries is set,
+// a file is read into a temporary file first and is re-read until it's
+// consistent or retries are exhausted, so that a torn copy isn't archived while a
+// file is being written. A file which is still inconsistent is archived as is
+// and counted in Stats (see: Stats.ModifiedFiles). An archived file is listed in
+// a manifest if it's made (see: Incremental).
+func (m *Backupper) archiveFile(path, relPath string, fi fs.FileInfo, w io.Writer) (bool, error) {
+	var (
+		consistent bool
+		err        error
+	)
+
+	w = io.MultiWriter(w, m.peer.meter)
+
+	h := m.hashFile()
+	if h != nil {
+		w = io.MultiWriter(w, h)
+	}
+
+	if m.cfg.ModifiedRetries == 0 {
+		consistent, err = m.copyChecked(path, fi, w)
+	} else {
+		consistent, err = m.copySpooled(path, relPath, w)
+	}
+
+	if err == nil && h != nil {
+		m.addManifestFile(relPath, fi, h, consistent)
+	}
+
+	if err != nil || consistent {
+		return consistent, err
+	}
+
+	m.log.WithField(log.FieldFile, relPath).Info("file was modified during archiving, its copy may be inconsistent")
+
+	m.resultMx.Lock()
+	m.result.Stats.ModifiedFiles++
+	m.resultMx.Unlock()
+
+	return false, nil
+}
+
+// copySpooled reads a file into a temporary file until it's consistent or
+// ModifiedRetries are exhausted, and then copies the last read content to w.
+func (m *Backupper) copySpooled(path, relPath string, w io.Writer) (bool, error) {
+	spool, err := os.CreateTemp("", "distributed-backup-*")
+	if err != nil {
+		return false, err
+	}
+
+	defer func() {
+		spool.Close()
+
+		if err := os.Remove(spool.Name()); err != nil {
+			m.log.Error(err)
+		}
+	}()
+
+	var consistent bool
+
+	for attempt := 0; ; attempt++ {
+		if err := spool.Truncate(0); err != nil {
+			return false, err
+		}
+
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+
+		if consistent, err = m.copyChecked(path, fi, spool); err != nil {
+			return false, err
+		}
+
+		if consistent || attempt == m.cfg.ModifiedRetries {
+			break
+		}
+
+		m.log.WithFields(log.Fields{
+			log.FieldFile:    relPath,
+			log.FieldAttempt: attempt + 1,
+		}).Debug("file was modified during archiving, re-reading")
+
+		time.Sleep(modifiedRetryDelay)
+	}
+
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	_, err = io.Copy(w, spool)
+
+	return consistent, err
+}
+
+// copyChecked copies a file at path to w and compares its state after reading
+// with fi taken before.
+func (m *Backupper) copyChecked(path string, fi fs.FileInfo, w io.Writer) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(w, f)
+	if err != nil {
+		return false, err
+	}
+
+	after, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	consistent := n == fi.Size() && after.Size() == fi.Size() && after.ModTime().Equal(fi.ModTime())
+
+	return consistent, nil
+}
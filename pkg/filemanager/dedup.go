@@ -0,0 +1,886 @@
+package filemanager
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"distributed-backup/pkg/chunker"
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+// ChunksDir is a subdirectory of a destination directory chunks of deduplicated
+// backups are stored in, each one deflated in a file named after a SHA-256 hash
+// of its content in a subdirectory of the first 2 hex digits of the hash.
+const ChunksDir = ".chunks"
+
+// dedupMagic starts a dedup stream, which is a tree stream (see:
+// sendSourceDirTree()) files of which are chunked, and a manifest a receiver
+// stores of it.
+var dedupMagic = []byte("DBDEDUP\x00\x01")
+
+const (
+	// treeChunked is a type of an entry of a file whose content is a list of
+	// records of its chunks ending with chunksEnd.
+	treeChunked = 'c'
+
+	// chunkKnown is "${sha256}${size}" of a chunk a receiver has, and chunkNew
+	// is "${sha256}${size}${len(data)}${data}" of one it hasn't, which is sent
+	// deflated. A manifest only has records of chunkKnown.
+	chunkKnown = 'r'
+	chunkNew   = 'n'
+	chunksEnd  = 0
+)
+
+var errMalformedChunk = errors.New("malformed chunk record")
+
+// chunksMx is held for reading while chunks are stored and for writing while
+// unused ones are removed (see: removeUnusedChunks()), so that chunks of a
+// backup being received aren't removed before its manifest is stored.
+var chunksMx sync.RWMutex
+
+// requestChunks receives hashes of chunks a receiver has stored (see:
+// sendChunkIndex()), so that they're referenced rather than sent again (see:
+// sendChunks()).
+func (m *Backupper) requestChunks() error {
+	r := bufio.NewReader(&messageReader{r: m.peer, buf: make([]byte, maxMessageSize)})
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+
+	m.chunks = map[[sha256.Size]byte]bool{}
+
+	for i := uint64(0); i < n; i++ {
+		var id [sha256.Size]byte
+
+		if _, err := io.ReadFull(r, id[:]); err != nil {
+			return err
+		}
+
+		m.chunks[id] = true
+	}
+
+	m.log.WithField(log.FieldChunks, n).Info("received index of stored chunks")
+
+	return nil
+}
+
+// sendChunkIndex answers a sender with a number and hashes of chunks stored in
+// ChunksDir.
+func (m *Backupper) sendChunkIndex() error {
+	dir, err := m.chunksDir()
+	if err != nil {
+		return err
+	}
+
+	ids, err := storedChunks(dir)
+	if err != nil {
+		return errors.Wrap(err, "chunks")
+	}
+
+	w := bufio.NewWriterSize(m.peer, maxSignatureMessage)
+
+	w.Write(binary.AppendUvarint(nil, uint64(len(ids))))
+
+	for id := range ids {
+		w.Write(id[:])
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	m.log.WithField(log.FieldChunks, len(ids)).Info("sent index of stored chunks")
+
+	return nil
+}
+
+// sendChunks writes content of a file of a source directory at path to w as
+// records of its content-defined chunks (see: chunker), which end with
+// chunksEnd.
+func (m *Backupper) sendChunks(w io.Writer, path, relPath string, fi fs.FileInfo) error {
+	level := flate.DefaultCompression
+
+	if l := m.fileLevel(relPath, nil); l != nil {
+		level = *l
+	}
+
+	cw := chunker.NewWriter(func(chunk []byte) error {
+		return m.sendChunk(w, chunk, level)
+	})
+
+	if _, err := m.archiveFile(path, relPath, fi, cw); err != nil {
+		return err
+	}
+
+	if err := cw.Close(); err != nil {
+		return err
+	}
+
+	_, err := w.Write([]byte{chunksEnd})
+
+	return err
+}
+
+// sendChunk writes a record of a chunk, which is referenced if a receiver has
+// it or has been sent it already, and is deflated at level otherwise.
+func (m *Backupper) sendChunk(w io.Writer, chunk []byte, level int) error {
+	c := dedupChunk{
+		id:   sha256.Sum256(chunk),
+		size: int64(len(chunk)),
+	}
+
+	if m.chunks[c.id] {
+		m.addDedupStats(c.size)
+
+		_, err := w.Write(c.record())
+
+		return err
+	}
+
+	var buf bytes.Buffer
+
+	fw, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fw.Write(chunk); err != nil {
+		return err
+	}
+
+	if err := fw.Close(); err != nil {
+		return err
+	}
+
+	c.data = buf.Bytes()
+	m.chunks[c.id] = true
+
+	_, err = w.Write(c.record())
+
+	return err
+}
+
+// isDedup tells whether a received file coming from r is a dedup stream.
+func isDedup(r *bufio.Reader) (bool, error) {
+	return hasMagic(r, dedupMagic)
+}
+
+// receiveDedup stores chunks of a dedup stream coming from r which a receiver
+// hasn't had in ChunksDir, and a manifest of the stream, which references all of
+// them, as a file named name (see: receiveToFile()), so that versions of a
+// manifest are kept as ones of any received file are. Chunks no manifest
+// references are removed then (see: removeUnusedChunks()).
+func (m *Backupper) receiveDedup(name string, r io.Reader) error {
+	dir, err := m.chunksDir()
+	if err != nil {
+		return err
+	}
+
+	// Chunks aren't protected with passwords to be re-encrypted.
+	if m.cfg.StorageKey != nil {
+		return errors.New("deduplicated backup conflicts with re-encryption")
+	}
+
+	if filepath.Base(name) != name || !filepath.IsLocal(name) {
+		return errors.Errorf("unsafe manifest name: %s", name)
+	}
+
+	m.log.WithFields(log.Fields{
+		log.FieldFile: name,
+		log.FieldDir:  dir,
+	}).Info("receiving deduplicated backup")
+
+	m.setFilename(name)
+
+	chunksMx.RLock()
+
+	pr, pw := io.Pipe()
+	stored := make(chan error, 1)
+
+	go func() {
+		err := m.storeChunks(r, pw, dir)
+		pw.CloseWithError(err)
+		stored <- err
+	}()
+
+	err = m.receiveToFile(name, name, pr)
+	pr.CloseWithError(errors.New("manifest is not stored"))
+
+	if storeErr := <-stored; err == nil {
+		err = storeErr
+	}
+
+	chunksMx.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	m.removeUnusedChunks(dir)
+
+	return nil
+}
+
+// storeChunks stores new chunks of a dedup stream coming from r in dir, and
+// writes a manifest of the stream to w.
+func (m *Backupper) storeChunks(r io.Reader, w io.Writer, dir string) error {
+	d, err := newDedupReader(r)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.Write(dedupMagic)
+
+	for {
+		e, err := d.next()
+		if err != nil {
+			return errors.Wrap(err, "deduplicated backup")
+		}
+
+		if e == nil {
+			break
+		}
+
+		// Entries must not be restored outside a directory whatever a sender
+		// puts into a stream.
+		if !filepath.IsLocal(filepath.FromSlash(e.name)) {
+			return errors.Errorf("%s: unsafe entry path", e.name)
+		}
+
+		bw.Write(e.header())
+
+		if e.typ != treeChunked {
+			continue
+		}
+
+		m.log.WithField(log.FieldFile, e.name).Debug("receiving file")
+
+		var size int64
+
+		for {
+			c, err := d.nextChunk()
+			if err != nil {
+				return errors.Wrap(err, e.name)
+			}
+
+			if c == nil {
+				break
+			}
+
+			if err := m.storeChunk(dir, c); err != nil {
+				return errors.Wrap(err, e.name)
+			}
+
+			c.data = nil
+			size += c.size
+
+			bw.Write(c.record())
+		}
+
+		bw.WriteByte(chunksEnd)
+
+		m.addFileStats(e.name, size)
+	}
+
+	bw.WriteByte(treeEnd)
+
+	if n, err := io.Copy(io.Discard, d.r); err != nil {
+		return err
+	} else if n != 0 {
+		return errors.New("deduplicated backup: data after the end")
+	}
+
+	return bw.Flush()
+}
+
+// storeChunk verifies a new chunk and stores it in dir, or checks that a known
+// one is stored there.
+func (m *Backupper) storeChunk(dir string, c *dedupChunk) error {
+	path := chunkPath(dir, c.id)
+
+	if c.data == nil {
+		if _, err := os.Stat(path); err != nil {
+			return errors.Wrap(err, "stored chunk")
+		}
+
+		m.addDedupStats(c.size)
+
+		return nil
+	}
+
+	if err := verifyChunk(bytes.NewReader(c.data), c, io.Discard); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+		return err
+	}
+
+	// A chunk is written to a temporary file first, so that a stored chunk is
+	// always complete.
+	f, err := os.CreateTemp(filepath.Dir(path), ".chunk-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(c.data)
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// removeUnusedChunks removes chunks from dir which no manifest stored in a
+// destination directory references, e.g. since versions which did are removed
+// or since a backup they were sent in has failed. Nothing is removed while other
+// backups are being received, the next one does it.
+func (m *Backupper) removeUnusedChunks(dir string) {
+	if !chunksMx.TryLock() {
+		return
+	}
+	defer chunksMx.Unlock()
+
+	used, err := usedChunks(filepath.Dir(dir))
+	if err == nil {
+		var stored map[[sha256.Size]byte]bool
+
+		stored, err = storedChunks(dir)
+
+		removed := 0
+
+		for id := range stored {
+			if used[id] {
+				continue
+			}
+
+			if err := os.Remove(chunkPath(dir, id)); err != nil {
+				m.log.Error(err)
+
+				continue
+			}
+
+			removed++
+		}
+
+		if removed != 0 {
+			m.log.WithField(log.FieldChunks, removed).Info("removed unused chunks")
+		}
+	}
+
+	if err != nil {
+		m.log.Error(errors.Wrap(err, "unused chunks"))
+	}
+}
+
+func (m *Backupper) chunksDir() (string, error) {
+	if _, ok := m.storage.(DirStorage); !ok {
+		return "", errors.New("deduplication requires a local destination directory")
+	}
+
+	return m.storage.Location(ChunksDir), nil
+}
+
+func (m *Backupper) addDedupStats(n int64) {
+	m.resultMx.Lock()
+	defer m.resultMx.Unlock()
+
+	m.result.Stats.DedupChunks++
+	m.result.Stats.DedupBytes += n
+}
+
+// storedChunks returns hashes of chunks stored in dir.
+func storedChunks(dir string) (map[[sha256.Size]byte]bool, error) {
+	ids := map[[sha256.Size]byte]bool{}
+
+	subdirs, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return ids, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, subdir := range subdirs {
+		if !subdir.IsDir() {
+			continue
+		}
+
+		entries, err := os.ReadDir(filepath.Join(dir, subdir.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			var id [sha256.Size]byte
+
+			// Temporary files of chunks being stored aren't hex.
+			if n, err := hex.Decode(id[:], []byte(e.Name())); err == nil && n == len(id) && e.Type().IsRegular() {
+				ids[id] = true
+			}
+		}
+	}
+
+	return ids, nil
+}
+
+// usedChunks returns hashes of chunks manifests stored in dir reference.
+func usedChunks(dir string) (map[[sha256.Size]byte]bool, error) {
+	ids := map[[sha256.Size]byte]bool{}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+
+		err := readDedupManifest(filepath.Join(dir, e.Name()), func(_ *dedupEntry, c *dedupChunk) error {
+			if c != nil {
+				ids[c.id] = true
+			}
+
+			return nil
+		})
+		if err != nil && err != errNotDedupManifest {
+			return nil, errors.Wrap(err, e.Name())
+		}
+	}
+
+	return ids, nil
+}
+
+func chunkPath(dir string, id [sha256.Size]byte) string {
+	name := hex.EncodeToString(id[:])
+
+	return filepath.Join(dir, name[:2], name)
+}
+
+// verifyChunk inflates deflated data of a chunk coming from r to w and checks it
+// against a size and a hash of the chunk.
+func verifyChunk(r io.Reader, c *dedupChunk, w io.Writer) error {
+	fr := flate.NewReader(r)
+	defer fr.Close()
+
+	h := sha256.New()
+
+	n, err := io.Copy(io.MultiWriter(w, h), io.LimitReader(fr, c.size+1))
+	if err != nil {
+		return errors.Wrap(err, "chunk")
+	}
+
+	if n != c.size || !bytes.Equal(h.Sum(nil), c.id[:]) {
+		return errors.Wrapf(ErrDigestMismatch, "chunk %x", c.id)
+	}
+
+	return nil
+}
+
+var errNotDedupManifest = errors.New("not a manifest of a deduplicated backup")
+
+// readDedupManifest calls fn with every entry of a manifest stored at path, and
+// with every chunk of an entry of a file after it.
+func readDedupManifest(path string, fn func(e *dedupEntry, c *dedupChunk) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	d, err := newDedupReader(f)
+	if err != nil {
+		return err
+	}
+
+	for {
+		e, err := d.next()
+		if err != nil || e == nil {
+			return err
+		}
+
+		if err := fn(e, nil); err != nil {
+			return err
+		}
+
+		if e.typ != treeChunked {
+			continue
+		}
+
+		for {
+			c, err := d.nextChunk()
+			if err != nil {
+				return errors.Wrap(err, e.name)
+			}
+
+			if c == nil {
+				break
+			}
+
+			if c.data != nil {
+				return errors.Wrap(errMalformedChunk, e.name)
+			}
+
+			if err := fn(e, c); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// dedupReader reads entries of a dedup stream or a manifest.
+type dedupReader struct {
+	r *bufio.Reader
+}
+
+// dedupEntry is an entry of a dedup stream, content of a file follows it (see:
+// nextChunk()).
+type dedupEntry struct {
+	typ  byte
+	name string
+	meta []byte
+	link string
+}
+
+// dedupChunk is a record of a chunk, data is deflated content of a new one.
+type dedupChunk struct {
+	id   [sha256.Size]byte
+	size int64
+	data []byte
+}
+
+// newDedupReader returns a reader of a dedup stream coming from r, or
+// errNotDedupManifest if it doesn't start with dedupMagic.
+func newDedupReader(r io.Reader) (*dedupReader, error) {
+	br := bufio.NewReader(r)
+
+	ok, err := isDedup(br)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, errNotDedupManifest
+	}
+
+	br.Discard(len(dedupMagic))
+
+	return &dedupReader{r: br}, nil
+}
+
+// next returns a next entry, or nil at the end of a stream.
+func (d *dedupReader) next() (*dedupEntry, error) {
+	typ, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	if typ == treeEnd {
+		return nil, nil
+	}
+
+	e := &dedupEntry{typ: typ}
+
+	if e.name, err = readTreeString(d.r); err != nil {
+		return nil, err
+	}
+
+	metaLen, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	e.meta = make([]byte, metaLen)
+
+	if _, err := io.ReadFull(d.r, e.meta); err != nil {
+		return nil, err
+	}
+
+	switch typ {
+	case treeSymlink:
+		if e.link, err = readTreeString(d.r); err != nil {
+			return nil, err
+		}
+	case treeDir, treeChunked:
+	default:
+		return nil, errors.Errorf("%s: unknown entry type %q", e.name, typ)
+	}
+
+	return e, nil
+}
+
+// nextChunk returns a next chunk of a file, or nil at the end of its content.
+func (d *dedupReader) nextChunk() (*dedupChunk, error) {
+	typ, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch typ {
+	case chunksEnd:
+		return nil, nil
+	case chunkKnown, chunkNew:
+	default:
+		return nil, errMalformedChunk
+	}
+
+	c := &dedupChunk{}
+
+	if _, err := io.ReadFull(d.r, c.id[:]); err != nil {
+		return nil, err
+	}
+
+	size, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return nil, err
+	}
+
+	if size == 0 || size > chunker.MaxSize {
+		return nil, errMalformedChunk
+	}
+
+	c.size = int64(size)
+
+	if typ == chunkKnown {
+		return c, nil
+	}
+
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Deflate adds a few bytes to data it can't compress.
+	if n > size+size/16+64 {
+		return nil, errMalformedChunk
+	}
+
+	c.data = make([]byte, n)
+
+	if _, err := io.ReadFull(d.r, c.data); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// header returns an entry as it's written to a stream.
+func (e *dedupEntry) header() []byte {
+	return treeHeader(e.typ, e.name, e.meta, e.link)
+}
+
+// record returns a record of a chunk, which is of a new one if it has data.
+func (c *dedupChunk) record() []byte {
+	typ := byte(chunkKnown)
+	if c.data != nil {
+		typ = chunkNew
+	}
+
+	b := append([]byte{typ}, c.id[:]...)
+	b = binary.AppendUvarint(b, uint64(c.size))
+
+	if c.data != nil {
+		b = binary.AppendUvarint(b, uint64(len(c.data)))
+		b = append(b, c.data...)
+	}
+
+	return b
+}
+
+// isDedupManifest tells whether a file stored at path is a manifest of a
+// deduplicated backup.
+func isDedupManifest(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	return isDedup(bufio.NewReader(f))
+}
+
+// restoreDedup makes a directory tree target of a manifest stored at path and
+// chunks stored next to it, by turning the manifest into a tree stream which is
+// read as a received one is (see: readTree()). Entries are logged with l.
+func restoreDedup(path, target string, l log.Logger) error {
+	dir := filepath.Join(filepath.Dir(path), ChunksDir)
+
+	m := &Backupper{
+		cfg: BackupperConfig{
+			PreserveMeta: true,
+		},
+		log: l.WithField(log.FieldFile, path),
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(expandDedupManifest(path, dir, pw))
+	}()
+
+	links, err := m.readTree(pr, target)
+	pr.CloseWithError(errors.New("tree is not made"))
+
+	if err == nil {
+		err = m.makeSymlinks(target, links)
+	}
+
+	return err
+}
+
+// expandDedupManifest writes a tree stream of a manifest stored at path and chunks
+// stored in dir to w.
+func expandDedupManifest(path, dir string, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.Write(treeMagic)
+
+	var (
+		file   *dedupEntry
+		chunks []*dedupChunk
+	)
+
+	// Content of a file follows its size, which is a sum of sizes of its chunks,
+	// so chunks are written once a next entry starts.
+	flush := func() error {
+		if file == nil {
+			return nil
+		}
+
+		var size int64
+
+		for _, c := range chunks {
+			size += c.size
+		}
+
+		bw.Write(treeHeader(treeFile, file.name, file.meta, ""))
+		bw.Write(binary.BigEndian.AppendUint64(nil, uint64(size)))
+
+		for _, c := range chunks {
+			if err := copyChunk(bw, dir, c); err != nil {
+				return errors.Wrap(err, file.name)
+			}
+		}
+
+		file, chunks = nil, nil
+
+		return nil
+	}
+
+	err := readDedupManifest(path, func(e *dedupEntry, c *dedupChunk) error {
+		if c != nil {
+			chunks = append(chunks, c)
+
+			return nil
+		}
+
+		if err := flush(); err != nil {
+			return err
+		}
+
+		if e.typ == treeChunked {
+			file = e
+
+			return nil
+		}
+
+		_, err := bw.Write(e.header())
+
+		return err
+	})
+	if err == nil {
+		err = flush()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	bw.WriteByte(treeEnd)
+
+	return bw.Flush()
+}
+
+// copyChunk writes content of a chunk stored in dir to w.
+func copyChunk(w io.Writer, dir string, c *dedupChunk) error {
+	f, err := os.Open(chunkPath(dir, c.id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return verifyChunk(bufio.NewReader(f), c, w)
+}
+
+// listDedup describes files of a manifest stored at path, and verifies chunks
+// of them.
+func listDedup(path string) ([]ArchivedFile, error) {
+	dir := filepath.Join(filepath.Dir(path), ChunksDir)
+
+	var files []ArchivedFile
+
+	err := readDedupManifest(path, func(e *dedupEntry, c *dedupChunk) error {
+		if c != nil {
+			files[len(files)-1].Size += c.size
+
+			return errors.Wrap(copyChunk(io.Discard, dir, c), e.name)
+		}
+
+		file := ArchivedFile{Name: e.name}
+
+		switch e.typ {
+		case treeDir:
+			file.Name += "/"
+			file.Mode = fs.ModeDir
+		case treeSymlink:
+			file.Link = e.link
+			file.Size = int64(len(e.link))
+			file.Mode = fs.ModeSymlink | fs.ModePerm
+		}
+
+		meta, err := parseMeta(e.meta)
+		if err != nil {
+			return errors.Wrap(err, e.name)
+		}
+
+		if meta != nil {
+			file.Mode = file.Mode.Type() | meta.mode
+			file.ModTime = meta.modTime
+		}
+
+		files = append(files, file)
+
+		return nil
+	})
+
+	return files, err
+}
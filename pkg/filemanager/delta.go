@@ -0,0 +1,228 @@
+package filemanager
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"distributed-backup/pkg/delta"
+	"distributed-backup/pkg/log"
+
+	"github.com/TelenLiu/go-zip"
+	"github.com/pkg/errors"
+)
+
+const (
+	// deltaMinSize is a minimum size of a file of a previous version a receiver
+	// signs, smaller files are sent whole since a delta wouldn't save much.
+	deltaMinSize = 64 << 10
+	// deltaExtraID is an ID of an empty extra field of an archive entry which
+	// carries a delta of a file instead of its content.
+	deltaExtraID = 0x6264
+
+	// maxSignatureMessage bounds messages signatures are sent in.
+	maxSignatureMessage = 32 << 10
+)
+
+// requestSignatures asks a receiver for signatures of files of the previous
+// version of a backup it has extracted (see: sendSignatures()), so that only
+// changed blocks of them are archived (see: archiveEntry()). A request is a name
+// of a backup presented as a file name is.
+func (m *Backupper) requestSignatures() error {
+	if err := m.writeFilename(m.cfg.OutputFilename, m.peer); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(&messageReader{r: m.peer, buf: make([]byte, maxMessageSize)})
+	m.signatures = map[string]*delta.Signature{}
+
+	for {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+
+		// An empty name ends signatures.
+		if n == 0 {
+			break
+		}
+
+		if n > 1<<16 {
+			return errors.New("malformed signature")
+		}
+
+		name := make([]byte, n)
+
+		if _, err := io.ReadFull(r, name); err != nil {
+			return err
+		}
+
+		sig, err := delta.ReadSignature(r)
+		if err != nil {
+			return errors.Wrap(err, "signature")
+		}
+
+		m.signatures[string(name)] = sig
+	}
+
+	m.log.WithField(log.FieldFiles, len(m.signatures)).Info("received signatures of previous version")
+
+	return nil
+}
+
+// sendSignatures answers a request of a sender with signatures of files of the
+// previous version of a requested backup extracted to a destination directory.
+// Only an end of signatures is sent if there is no previous version.
+func (m *Backupper) sendSignatures() error {
+	name, err := m.readFilename(m.peer)
+	if err != nil {
+		return err
+	}
+
+	if filepath.Base(name) != name || !filepath.IsLocal(name) {
+		return errors.Errorf("unsafe backup name: %s", name)
+	}
+
+	dir := filepath.Join(m.cfg.DestinationDir, strings.TrimSuffix(name, ".zip"))
+	w := bufio.NewWriterSize(m.peer, maxSignatureMessage)
+	files := 0
+
+	err = filepath.Walk(dir, func(path string, fi fs.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return filepath.SkipDir
+			}
+
+			return err
+		}
+
+		if !fi.Mode().IsRegular() || fi.Size() < deltaMinSize {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		sig, err := delta.Sign(bufio.NewReader(f), fi.Size())
+		if err != nil {
+			return errors.Wrap(err, relPath)
+		}
+
+		relPath = filepath.ToSlash(relPath)
+
+		w.Write(binary.AppendUvarint(nil, uint64(len(relPath))))
+		w.WriteString(relPath)
+
+		if _, err := sig.WriteTo(w); err != nil {
+			return err
+		}
+
+		files++
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "signatures")
+	}
+
+	w.Write(binary.AppendUvarint(nil, 0))
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	m.log.WithFields(log.Fields{
+		log.FieldDir:   dir,
+		log.FieldFiles: files,
+	}).Info("sent signatures of previous version")
+
+	return nil
+}
+
+// archiveDelta writes a delta of a file against its signature to w.
+func (m *Backupper) archiveDelta(sig *delta.Signature, path, relPath string, fi fs.FileInfo, w io.Writer) (bool, error) {
+	enc := delta.NewEncoder(sig, w)
+
+	consistent, err := m.archiveFile(path, relPath, fi, enc)
+	if err != nil {
+		return false, err
+	}
+
+	if err := enc.Close(); err != nil {
+		return false, err
+	}
+
+	m.log.WithField(log.FieldFile, relPath).Debug("file archived as delta")
+
+	m.addDeltaStats(enc.Matched())
+
+	return consistent, nil
+}
+
+// extractDelta reconstructs a file at path of its previous version at base and
+// a delta read from an entry, and returns its size.
+func (m *Backupper) extractDelta(entry *zipStreamEntry, base, path string) (int64, error) {
+	b, err := os.Open(base)
+	if err != nil {
+		return 0, errors.Wrap(err, "previous version")
+	}
+	defer b.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n, copied, err := delta.Patch(b, bufio.NewReader(entry), f)
+	if err != nil {
+		return 0, err
+	}
+
+	m.addDeltaStats(copied)
+
+	return n, f.Close()
+}
+
+func (m *Backupper) addDeltaStats(n int64) {
+	m.resultMx.Lock()
+	defer m.resultMx.Unlock()
+
+	m.result.Stats.DeltaFiles++
+	m.result.Stats.DeltaBytes += n
+}
+
+// deltaExtra returns an extra field marking an entry carrying a delta.
+func deltaExtra() []byte {
+	return binary.LittleEndian.AppendUint32(nil, deltaExtraID)
+}
+
+// isDelta tells whether an extra field of an entry has a delta marker.
+func isDelta(extra []byte) bool {
+	return hasExtra(extra, deltaExtraID)
+}
+
+// signature returns a signature of a previous version of a file of an entry, if
+// a receiver has sent one, and marks the entry to carry a delta.
+func (m *Backupper) signature(fh *zip.FileHeader) *delta.Signature {
+	sig, ok := m.signatures[filepath.ToSlash(fh.Name)]
+	if !ok {
+		return nil
+	}
+
+	fh.Extra = append(fh.Extra, deltaExtra()...)
+
+	return sig
+}
@@ -0,0 +1,171 @@
+package filemanager
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+
+	"distributed-backup/pkg/envelope"
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+// maxMessageSize is a maximum size of a message of a data channel, a read with a
+// smaller buffer fails if a message doesn't fit it.
+const maxMessageSize = 64 << 10
+
+// sendSealed seals a source entry for Recipient into an envelope routed through
+// Route. An envelope is sent with a random name, so that peers it's routed
+// through learn nothing of its content but a size.
+func (m *Backupper) sendSealed(dst io.Writer) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	name := hex.EncodeToString(id) + envelope.Ext
+
+	if err := m.writeHeader(name, nil, dst); err != nil {
+		return err
+	}
+
+	m.log.WithFields(log.Fields{
+		log.FieldFile:  name,
+		log.FieldRoute: m.cfg.Route,
+	}).Info("sending sealed envelope")
+
+	w, err := envelope.NewWriter(dst, m.cfg.Recipient, m.cfg.Route)
+	if err != nil {
+		return err
+	}
+
+	if err := m.sendEntry(w); err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+// forwardEnvelope sends an envelope named SourceEntry, which was stored by a
+// receiver, to its next hop with the hop taken off its route.
+func (m *Backupper) forwardEnvelope(w io.Writer) error {
+	f, err := os.Open(m.cfg.SourceEntry)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	h, err := envelope.ReadHeader(r)
+	if err != nil {
+		return err
+	}
+
+	if len(h.NextHop()) == 0 {
+		return errors.New("envelope has already reached its recipient")
+	}
+
+	h.Route = h.Route[1:]
+	name := filepath.Base(m.cfg.SourceEntry)
+
+	if err := m.writeHeader(name, nil, w); err != nil {
+		return err
+	}
+
+	m.log.WithFields(log.Fields{
+		log.FieldFile:  name,
+		log.FieldRoute: h.Route,
+	}).Info("forwarding envelope")
+
+	m.setFilename(name)
+
+	cw := &countingWriter{Writer: w}
+
+	if err := envelope.WriteHeader(cw, h); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(cw, r)
+	m.setArchiveBytes(cw.n)
+
+	return err
+}
+
+// receiveEnvelope stores an envelope which is routed further or isn't addressed
+// to Identity as is, so that it can be forwarded later (see: forwardEnvelope()).
+// An envelope which has reached its recipient is opened, and a file sealed into
+// it is received as if it came from Peer directly.
+func (m *Backupper) receiveEnvelope(name string) error {
+	r := &messageReader{r: m.stream, buf: make([]byte, maxMessageSize)}
+
+	h, err := envelope.ReadHeader(r)
+	if err != nil {
+		return err
+	}
+
+	if len(h.NextHop()) != 0 || m.cfg.Identity == nil {
+		m.log.WithFields(log.Fields{
+			log.FieldFile:  name,
+			log.FieldRoute: h.Route,
+		}).Info("storing envelope to forward")
+
+		m.setFilename(name)
+
+		var header bytes.Buffer
+
+		if err := envelope.WriteHeader(&header, h); err != nil {
+			return err
+		}
+
+		return m.receiveToFile(name, name, io.MultiReader(&header, r))
+	}
+
+	sealed, err := envelope.Open(r, h, m.cfg.Identity)
+	if err != nil {
+		return err
+	}
+
+	m.log.WithField(log.FieldFile, name).Info("opening envelope")
+
+	name, meta, err := m.readHeader(sealed)
+	if err != nil {
+		return errors.Wrap(err, "envelope")
+	}
+
+	if envelope.IsEnvelope(name) {
+		return errors.New("envelope is nested into another one")
+	}
+
+	return m.receiveNamed(name, meta, sealed)
+}
+
+// messageReader reads messages of a data channel into a buffer which fits any of
+// them, so that a stream can be read by pieces boundaries of which don't match
+// ones of messages.
+type messageReader struct {
+	r   io.Reader
+	buf []byte
+	b   []byte
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		n, err := r.r.Read(r.buf)
+		r.b = r.buf[:n]
+
+		if n == 0 {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+
+	return n, nil
+}
@@ -6,3 +6,4 @@ import (
 
 var errIsDirectory = errors.New("is a directory")
 var errNotDirectory = errors.New("not a directory")
+var errMalformedArchive = errors.New("malformed archive")
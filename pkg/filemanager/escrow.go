@@ -0,0 +1,202 @@
+package filemanager
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+
+	"distributed-backup/pkg/envelope"
+	"distributed-backup/pkg/log"
+
+	"github.com/TelenLiu/go-zip"
+	"github.com/pkg/errors"
+)
+
+const (
+	// EscrowEntry is a name of an entry of an outer archive which holds passwords
+	// of a backup sealed for Escrow (see: writeEscrow()).
+	EscrowEntry = "key.escrow"
+	// EscrowExt is an extension of a file a receiver which re-encrypts a backup
+	// stores an escrowed key in next to a sealed backup.
+	EscrowExt = ".escrow"
+
+	// maxEscrowSize bounds an escrowed key read from a stream.
+	maxEscrowSize = 64 << 10
+)
+
+// escrowedKey is a payload of an envelope sealed for Escrow.
+type escrowedKey struct {
+	Password1 string `json:"password1"`
+	Password2 string `json:"password2"`
+}
+
+// writeEscrow adds an entry to an outer archive which holds Password1 and
+// Password2 sealed for Escrow, so that a backup remains recoverable by a holder
+// of the escrow identity if a password file is lost (see: RecoverKey()). The
+// entry isn't protected with Password2, since it's useless without the identity.
+func (m *Backupper) writeEscrow(z *zip.Writer) error {
+	w, err := z.CreateHeader(&zip.FileHeader{
+		Name:   EscrowEntry,
+		Method: zip.Deflate,
+	})
+	if err != nil {
+		return err
+	}
+
+	sealed, err := envelope.NewWriter(w, m.cfg.Escrow, nil)
+	if err != nil {
+		return err
+	}
+
+	key := escrowedKey{
+		Password1: m.cfg.Password1,
+		Password2: m.cfg.Password2,
+	}
+
+	if err := json.NewEncoder(sealed).Encode(&key); err != nil {
+		return err
+	}
+
+	m.log.Debug("key escrow added")
+
+	return sealed.Close()
+}
+
+// readEscrow reads an escrow entry which may follow an inner archive, and
+// returns io.EOF if an outer archive ends instead.
+func readEscrow(outer *zipStreamReader) ([]byte, error) {
+	entry, err := outer.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.Name != EscrowEntry {
+		return nil, errors.New("single inner archive expected")
+	}
+
+	b, err := io.ReadAll(io.LimitReader(entry, maxEscrowSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, entry.Name)
+	}
+
+	if len(b) > maxEscrowSize {
+		return nil, errors.Wrap(errMalformedArchive, entry.Name)
+	}
+
+	if _, err := outer.Next(); err != io.EOF {
+		if err == nil {
+			return nil, errors.New("escrowed key is expected to be the last entry")
+		}
+
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// saveEscrow stores an escrowed key of a backup as target next to it, a version
+// of a key is shifted with versions of a backup even if there is none, so that
+// they stay in line.
+func (m *Backupper) saveEscrow(target string, escrow []byte) error {
+	m.shiftFileVersions(target, false)
+
+	if escrow == nil {
+		return nil
+	}
+
+	m.log.WithField(log.FieldFile, m.storage.Location(target)).Info("storing escrowed key")
+
+	return m.store(target, bytes.NewReader(escrow))
+}
+
+// RecoverKey opens passwords of a backup sealed for an escrow identity, a path
+// is either of a stored backup or of an escrowed key stored next to a sealed one.
+func RecoverKey(path string, id *envelope.Identity) (password1, password2 string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	sig, err := r.Peek(4)
+	if err != nil && err != io.EOF {
+		return "", "", err
+	}
+
+	var escrow io.Reader = r
+
+	if len(sig) == 4 && binary.LittleEndian.Uint32(sig) == zipFileHeaderSignature {
+		if escrow, err = openEscrowEntry(f); err != nil {
+			return "", "", err
+		}
+	}
+
+	er := bufio.NewReader(escrow)
+
+	h, err := envelope.ReadHeader(er)
+	if err != nil {
+		return "", "", err
+	}
+
+	sealed, err := envelope.Open(er, h, id)
+	if err != nil {
+		return "", "", err
+	}
+
+	var key escrowedKey
+
+	if err := json.NewDecoder(io.LimitReader(sealed, maxEscrowSize)).Decode(&key); err != nil {
+		return "", "", errors.Wrap(err, "escrowed key")
+	}
+
+	// A payload is authenticated once it's read till the end.
+	if _, err := io.Copy(io.Discard, sealed); err != nil {
+		return "", "", err
+	}
+
+	return key.Password1, key.Password2, nil
+}
+
+// openEscrowEntry returns a reader of an escrow entry of a stored backup.
+func openEscrowEntry(f *os.File) (io.Reader, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	z, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range z.File {
+		if file.Name != EscrowEntry {
+			continue
+		}
+
+		r, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := io.ReadAll(io.LimitReader(r, maxEscrowSize+1))
+		r.Close()
+
+		if err != nil {
+			return nil, errors.Wrap(err, file.Name)
+		}
+
+		if len(b) > maxEscrowSize {
+			return nil, errors.Wrap(errMalformedArchive, file.Name)
+		}
+
+		return bytes.NewReader(b), nil
+	}
+
+	return nil, errors.New("backup has no escrowed key")
+}
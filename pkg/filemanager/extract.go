@@ -0,0 +1,211 @@
+package filemanager
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+// extractFile unpacks both levels of a double ZIP coming from src into a
+// directory named after the archive without the ".zip" extension. Neither archive
+// is saved to a disk: entries are decrypted, decompressed and verified against
+// their checksums on the fly. The tree is extracted to a temporary directory
+// first and then replaces the previous version which is shifted just like a
+// received file (see: shiftFileVersions()), or is quarantined if extraction
+// fails (see: quarantine()). A received file which isn't an archive is saved as
+// is with its metadata meta.
+func (m *Backupper) extractFile(name string, meta *fileMeta, src io.Reader) error {
+	r := bufio.NewReader(src)
+
+	sig, err := r.Peek(4)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if len(sig) < 4 || binary.LittleEndian.Uint32(sig) != zipFileHeaderSignature {
+		m.log.WithField(log.FieldFile, name).Info("receiving file, which is not an archive to extract")
+
+		if err := m.receiveToFile(name, name, r); err != nil {
+			return err
+		}
+
+		m.restoreMeta(name, meta)
+
+		return nil
+	}
+
+	// Extraction requires DirStorage (see: ValidateConfig()).
+	dir := strings.TrimSuffix(name, ".zip")
+	path := m.storage.Location(dir)
+	tmpPath := path + partialSuffix
+
+	m.log.WithFields(log.Fields{
+		log.FieldFile: name,
+		log.FieldDir:  path,
+	}).Info("receiving and extracting file")
+
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(tmpPath, 0775); err != nil {
+		return err
+	}
+
+	links, err := m.extractArchive(r, tmpPath, path)
+	if err == nil {
+		err = m.completeVersion(tmpPath, path)
+	}
+
+	if err == nil {
+		err = m.makeSymlinks(tmpPath, links)
+	}
+
+	if err != nil {
+		m.quarantine(dir+partialSuffix, name, err)
+
+		return err
+	}
+
+	m.shiftFileVersions(dir, true)
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	m.setStored(name, dir, 0, nil)
+
+	return nil
+}
+
+// extractArchive extracts entries of an inner archive contained by an outer one
+// into dir. Files of entries carrying deltas are reconstructed of their versions
+// in a previous directory prev. Symbolic links aren't made but returned (see:
+// makeSymlinks()).
+func (m *Backupper) extractArchive(r io.Reader, dir, prev string) ([]archivedSymlink, error) {
+	outer := newZipStreamReader(r, m.cfg.Password2)
+
+	archive, err := outer.Next()
+	if err == io.EOF {
+		return nil, errors.New("empty archive")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	inner := newZipStreamReader(archive, m.cfg.Password1)
+
+	var links []archivedSymlink
+
+	for {
+		entry, err := inner.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, errors.Wrap(err, archive.Name)
+		}
+
+		if isSymlink(entry.Extra) {
+			link, err := readSymlink(entry)
+			if err != nil {
+				return nil, errors.Wrap(err, entry.Name)
+			}
+
+			links = append(links, link)
+
+			continue
+		}
+
+		if err := m.extractEntry(entry, dir, prev); err != nil {
+			return nil, errors.Wrap(err, entry.Name)
+		}
+	}
+
+	// The rest of the inner archive is its central directory, which is read so
+	// that the whole inner archive is verified as well.
+	if _, err := io.Copy(io.Discard, archive); err != nil {
+		return nil, errors.Wrap(err, archive.Name)
+	}
+
+	// An escrowed key is of no use for an extracted backup, which isn't
+	// protected with passwords anymore.
+	if _, err := readEscrow(outer); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	// The outer archive's central directory is left until a connection is closed.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, err
+	}
+
+	return links, nil
+}
+
+func (m *Backupper) extractEntry(entry *zipStreamEntry, dir, prev string) error {
+	name := filepath.FromSlash(entry.Name)
+
+	// Entries must not be written outside a destination directory whatever a
+	// sender puts into an archive.
+	if !filepath.IsLocal(name) {
+		return errors.New("unsafe entry path")
+	}
+
+	path := filepath.Join(dir, name)
+
+	if strings.HasSuffix(entry.Name, "/") {
+		if err := os.MkdirAll(path, 0775); err != nil {
+			return err
+		}
+
+		meta, err := entryMeta(entry.Extra)
+		if err != nil || meta == nil || !m.cfg.PreserveMeta {
+			return err
+		}
+
+		return meta.restore(path)
+	}
+
+	m.log.WithField(log.FieldFile, entry.Name).Debug("extracting file")
+
+	if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+		return err
+	}
+
+	size := int64(entry.size)
+
+	if isDelta(entry.Extra) {
+		n, err := m.extractDelta(entry, filepath.Join(prev, name), path)
+		if err != nil {
+			return err
+		}
+
+		size = n
+	} else if err := m.saveFile(path, entry); err != nil {
+		return err
+	}
+
+	m.addFileStats(entry.Name, size)
+
+	meta, err := entryMeta(entry.Extra)
+	if err != nil {
+		return err
+	}
+
+	if meta != nil && m.cfg.PreserveMeta {
+		return meta.restore(path)
+	}
+
+	modTime := entry.ModTime()
+
+	return os.Chtimes(path, modTime, modTime)
+}
@@ -0,0 +1,199 @@
+package filemanager
+
+import (
+	"encoding/binary"
+	"io"
+
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+// StreamsPeer is a Peer which carries streams along with its own one (e.g. data
+// channels of peer.WebRTC), chunks of a transfer are spread over all of them so
+// that they're sent in parallel. Streams are used by a transfer which isn't
+// resumed only (see: ResumeTimeout), since they're lost with a connection, and
+// only if the other peer has streams as well (see: negotiate()).
+type StreamsPeer interface {
+	Peer
+	Streams() []io.ReadWriter
+}
+
+// streamPeer is a stream of StreamsPeer, which is shut down along with it.
+type streamPeer struct {
+	io.ReadWriter
+}
+
+func (streamPeer) Shutdown() {}
+
+func (streamPeer) OnEstablish(func()) {}
+
+// lanes returns streams of a peer a transfer is spread over, which are counted
+// and limited as a peer is.
+func (m *Backupper) lanes() []*countingPeer {
+	if m.streamsPeer == nil || !m.features[featureStreams] || m.features[featureResume] {
+		return nil
+	}
+
+	var lanes []*countingPeer
+
+	for _, rw := range m.streamsPeer.Streams() {
+		lanes = append(lanes, m.peer.with(limitPeer(streamPeer{rw}, m.cfg)))
+	}
+
+	if len(lanes) != 0 {
+		m.log.WithField(log.FieldStreams, len(lanes)+1).Info("transfer is spread over parallel streams")
+	}
+
+	return lanes
+}
+
+// setLanes spreads chunks over lanes along with a connection: chunk i goes over
+// lanes[i%(len(lanes)+1)-1], or over a connection if it's 0. A receiver reads
+// all of them concurrently and reorders chunks (see: readLane()), while other
+// frames are carried by a connection only.
+func (s *transferStream) setLanes(lanes []*countingPeer) {
+	if len(lanes) == 0 {
+		return
+	}
+
+	s.lanes = lanes
+
+	if s.role != RoleSender {
+		s.early = map[uint64][]byte{}
+		s.connClosed = make(chan struct{})
+	}
+}
+
+// laneOf returns a lane or a connection a chunk at offset is sent over.
+func (s *transferStream) laneOf(conn *countingPeer, offset int64) *countingPeer {
+	if len(s.lanes) == 0 {
+		return conn
+	}
+
+	i := int(offset/chunkSize) % (len(s.lanes) + 1)
+	if i == 0 {
+		return conn
+	}
+
+	return s.lanes[i-1]
+}
+
+// readLanes starts reading conn and lanes of a receiver.
+func (s *transferStream) readLanes(conn *countingPeer) {
+	go func() {
+		defer close(s.connClosed)
+
+		s.readLane(conn, conn, true)
+	}()
+
+	for _, lane := range s.lanes {
+		go s.readLane(conn, lane, false)
+	}
+}
+
+// readLane reads frames of a lane or of a connection itself until it fails, and
+// keeps chunks until they're read in order (see: readLaneFrame()). A lane which
+// fails before an end of a stream is verified loses a connection.
+func (s *transferStream) readLane(conn, lane *countingPeer, main bool) {
+	buf := make([]byte, maxMessageSize)
+
+	for {
+		n, err := lane.Read(buf)
+		if err != nil {
+			s.mx.Lock()
+			eof := s.eof
+			s.mx.Unlock()
+
+			if !eof {
+				s.lose(conn, err)
+			}
+
+			return
+		}
+
+		if err := s.putFrame(buf[:n], main); err != nil {
+			s.fail(err)
+			conn.Shutdown()
+
+			return
+		}
+	}
+}
+
+// putFrame keeps a chunk which hasn't been read yet or an end of a stream.
+func (s *transferStream) putFrame(frame []byte, main bool) error {
+	switch {
+	case main && len(frame) != 0 && frame[0] == frameAbort:
+		return errors.Errorf("sender aborted transfer: %s", frame[1:])
+	case len(frame) >= chunkHeaderLen && frame[0] == frameData:
+		seq, data, err := parseChunk(frame)
+		if err != nil {
+			return err
+		}
+
+		s.mx.Lock()
+		defer s.mx.Unlock()
+
+		if seq >= uint64(s.received/chunkSize) {
+			s.early[seq] = append([]byte(nil), data...)
+			s.cond.Broadcast()
+		}
+	case main && isEndFrame(frame):
+		s.mx.Lock()
+		defer s.mx.Unlock()
+
+		s.end = append([]byte(nil), frame...)
+		s.cond.Broadcast()
+	default:
+		return errMalformedFrame
+	}
+
+	return nil
+}
+
+// readLaneFrame waits for the next chunk or for an end of a stream once all
+// chunks before it are read.
+func (s *transferStream) readLaneFrame() error {
+	conn, err := s.connection()
+	if err != nil {
+		return err
+	}
+
+	s.mx.Lock()
+
+	for s.err == nil {
+		next := uint64(s.received / chunkSize)
+
+		if data, ok := s.early[next]; ok {
+			delete(s.early, next)
+
+			// Only the last chunk is short, and nothing but an end follows it.
+			if s.received%chunkSize != 0 {
+				s.mx.Unlock()
+
+				return s.fail(errMalformedFrame)
+			}
+
+			s.mx.Unlock()
+
+			return s.acceptChunk(conn, data)
+		}
+
+		// Chunks before an end may still be on their way over other lanes, but
+		// nothing follows a short one.
+		if s.end != nil && (int64(binary.BigEndian.Uint64(s.end[1:])) <= s.received || s.received%chunkSize != 0) {
+			end, received := s.end, s.received
+			s.mx.Unlock()
+
+			return s.readEnd(end, received)
+		}
+
+		s.cond.Wait()
+	}
+
+	err = s.err
+	s.mx.Unlock()
+
+	return err
+}
@@ -0,0 +1,130 @@
+package filemanager
+
+import (
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ArchivedFile is a file of a stored zipped directory (see: List()).
+type ArchivedFile struct {
+	// Name is a slash-separated path relative to a source directory, a name of
+	// a directory ends with a slash.
+	Name    string
+	Size    int64
+	Mode    fs.FileMode
+	ModTime time.Time
+	// Link is a target of a symbolic link.
+	Link string
+}
+
+// List reads both levels of a zipped directory stored by a receiver at path
+// with passwords of a sender, and returns its files in the order they're
+// archived in. Nothing is written to a disk, but every file is decrypted and
+// verified against its checksum as it's extracted (see: Restore()). A mode and
+// a modification time of a file are ones it's archived with (see: fileMeta), or
+// ones of a ZIP header if it's archived without them. Files of a manifest of a
+// deduplicated backup are listed as it describes them, and their chunks stored
+// next to it are verified.
+func List(path, password1, password2 string) ([]ArchivedFile, error) {
+	if ok, err := isDedupManifest(path); err != nil {
+		return nil, err
+	} else if ok {
+		return listDedup(path)
+	}
+
+	f, r, err := openStoredArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	outer := newZipStreamReader(r, password2)
+
+	archive, err := outer.Next()
+	if err == io.EOF {
+		return nil, errors.New("empty archive")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	inner := newZipStreamReader(archive, password1)
+
+	var files []ArchivedFile
+
+	for {
+		entry, err := inner.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, errors.Wrap(err, archive.Name)
+		}
+
+		file, err := listEntry(entry)
+		if err != nil {
+			return nil, errors.Wrap(err, entry.Name)
+		}
+
+		files = append(files, file)
+	}
+
+	// The rest of the inner archive is read so that it's verified as a whole,
+	// as an escrowed key is (see: extractArchive()).
+	if _, err := io.Copy(io.Discard, archive); err != nil {
+		return nil, errors.Wrap(err, archive.Name)
+	}
+
+	if _, err := readEscrow(outer); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// listEntry reads an entry of an inner archive through and describes its file.
+func listEntry(entry *zipStreamEntry) (ArchivedFile, error) {
+	file := ArchivedFile{
+		Name:    entry.Name,
+		Mode:    entry.Mode(),
+		ModTime: entry.ModTime(),
+	}
+
+	meta, err := entryMeta(entry.Extra)
+	if err != nil {
+		return file, err
+	}
+
+	switch {
+	case isSymlink(entry.Extra):
+		link, err := readSymlink(entry)
+		if err != nil {
+			return file, err
+		}
+
+		file.Link = link.target
+		file.Size = int64(len(link.target))
+		file.Mode = fs.ModeSymlink | fs.ModePerm
+	case strings.HasSuffix(entry.Name, "/"):
+		file.Mode |= fs.ModeDir
+	default:
+		if _, err := io.Copy(io.Discard, entry); err != nil {
+			return file, err
+		}
+
+		file.Size = int64(entry.size)
+	}
+
+	if meta != nil {
+		file.Mode = file.Mode.Type() | meta.mode
+		file.ModTime = meta.modTime
+	}
+
+	return file, nil
+}
@@ -0,0 +1,356 @@
+package filemanager
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"distributed-backup/pkg/log"
+
+	"github.com/TelenLiu/go-zip"
+	"github.com/pkg/errors"
+)
+
+// ManifestName is a name of a manifest of files of a version of a backup, which
+// a sender adds to an inner archive in the incremental mode and a receiver keeps
+// in an extracted directory, so that it tells which version it has.
+const ManifestName = ".distributed-backup-manifest.json"
+
+var errBaseCorrupted = errors.New("file of previous version is missing or corrupted")
+
+// manifest lists files of a version of a backup. An incremental version carries
+// files changed since its base version only, and a receiver takes the rest of
+// them from there (see: completeVersion()).
+type manifest struct {
+	// Generation is a random ID of a version, and Base is one of a version an
+	// incremental version is based on.
+	Generation string                  `json:"generation"`
+	Base       string                  `json:"base,omitempty"`
+	Files      map[string]manifestFile `json:"files"`
+}
+
+type manifestFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	// SHA256 is a hash of archived content, it's empty if a file was modified
+	// while it was archived, so that it's sent again.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+func newManifest() *manifest {
+	id := make([]byte, 16)
+
+	// The system random source doesn't fail on supported platforms.
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+
+	return &manifest{
+		Generation: hex.EncodeToString(id),
+		Files:      map[string]manifestFile{},
+	}
+}
+
+// readManifest reads a manifest at path, it returns nil if there is none.
+func readManifest(path string) (*manifest, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	mf := &manifest{}
+
+	if err := json.Unmarshal(b, mf); err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+
+	if len(mf.Generation) == 0 || len(mf.Generation) > 255 {
+		return nil, errors.Errorf("%s: malformed generation", path)
+	}
+
+	return mf, nil
+}
+
+// save writes a manifest to a temporary file first, so that a sender killed
+// meanwhile keeps the previous one.
+func (mf *manifest) save(path string) error {
+	b, err := json.Marshal(mf)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + partialSuffix
+
+	if err := os.WriteFile(tmpPath, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// requestBase asks a receiver for a generation of the previous version of a
+// backup it has extracted (see: sendBase()). Only files changed since then are
+// archived if it's the generation of the last manifest a sender has saved, and
+// all of them are archived otherwise. A request is a name of a backup presented
+// as a file name is, and so is an answer, which is empty if there is no previous
+// version.
+func (m *Backupper) requestBase() error {
+	if err := m.writeFilename(m.cfg.OutputFilename, m.peer); err != nil {
+		return err
+	}
+
+	generation, err := m.readFilename(&messageReader{r: m.peer, buf: make([]byte, maxMessageSize)})
+	if err != nil {
+		return err
+	}
+
+	base, err := readManifest(m.cfg.Manifest)
+	if err != nil {
+		m.log.Error(errors.Wrap(err, "manifest"))
+	}
+
+	switch {
+	case base == nil:
+		m.log.Info("no manifest of previous backup, sending full backup")
+	case base.Generation != generation:
+		m.log.Info("previous version of receiver doesn't match manifest, sending full backup")
+	default:
+		m.base = base
+		m.manifest.Base = base.Generation
+
+		m.log.WithField(log.FieldFiles, len(base.Files)).Info("sending files changed since previous version")
+	}
+
+	return nil
+}
+
+// sendBase answers a request of a sender with a generation of the previous
+// version of a requested backup extracted to a destination directory.
+func (m *Backupper) sendBase() error {
+	name, err := m.readFilename(m.peer)
+	if err != nil {
+		return err
+	}
+
+	if filepath.Base(name) != name || !filepath.IsLocal(name) {
+		return errors.Errorf("unsafe backup name: %s", name)
+	}
+
+	dir := filepath.Join(m.cfg.DestinationDir, strings.TrimSuffix(name, ".zip"))
+
+	var generation string
+
+	mf, err := readManifest(filepath.Join(dir, ManifestName))
+	if err != nil {
+		m.log.Error(errors.Wrap(err, "manifest of previous version"))
+	} else if mf != nil {
+		generation = mf.Generation
+	}
+
+	// An answer is sent in a single message, which a sender reads as a whole.
+	if _, err := m.peer.Write(append([]byte{byte(len(generation))}, generation...)); err != nil {
+		return err
+	}
+
+	m.log.WithField(log.FieldDir, dir).Info("sent generation of previous version")
+
+	return nil
+}
+
+// unchanged tells whether a file of a source directory at a slash-separated
+// relPath has the same size and modification time as in the base version, and
+// takes its entry into a manifest if so.
+func (m *Backupper) unchanged(relPath string, fi fs.FileInfo) bool {
+	if m.base == nil {
+		return false
+	}
+
+	f, ok := m.base.Files[relPath]
+	if !ok || len(f.SHA256) == 0 || f.Size != fi.Size() || !f.ModTime.Equal(fi.ModTime()) {
+		return false
+	}
+
+	m.manifest.Files[relPath] = f
+
+	return true
+}
+
+// hashFile returns a writer archived content of a file is hashed with if a
+// manifest is made, or nil.
+func (m *Backupper) hashFile() hash.Hash {
+	if m.manifest == nil {
+		return nil
+	}
+
+	return sha256.New()
+}
+
+// addManifestFile lists an archived file in a manifest.
+func (m *Backupper) addManifestFile(relPath string, fi fs.FileInfo, h hash.Hash, consistent bool) {
+	f := manifestFile{
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}
+
+	if consistent {
+		f.SHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+
+	m.manifest.Files[filepath.ToSlash(relPath)] = f
+}
+
+// writeManifest adds a manifest to an inner archive protected with Password1.
+func (m *Backupper) writeManifest(z *innerWriter) error {
+	b, err := json.Marshal(m.manifest)
+	if err != nil {
+		return err
+	}
+
+	fh := &zip.FileHeader{
+		Name:   ManifestName,
+		Method: zip.Deflate,
+	}
+
+	fh.SetModTime(time.Now())
+	m.setArchivedFilePassword(fh, m.cfg.Password1)
+
+	w, err := z.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+
+	return err
+}
+
+// saveManifest saves a manifest of a backup a receiver has acknowledged, which
+// the next one is based on.
+func (m *Backupper) saveManifest() {
+	if m.manifest == nil {
+		return
+	}
+
+	if err := m.manifest.save(m.cfg.Manifest); err != nil {
+		m.log.Error(errors.Wrap(err, "manifest"))
+
+		return
+	}
+
+	m.log.WithField(log.FieldFile, m.cfg.Manifest).Debug("manifest saved")
+}
+
+// completeVersion takes files of an incremental version extracted to dir which
+// haven't changed since its base version from the previous version at prev, and
+// verifies them against hashes of a manifest. Files which aren't listed there
+// are deleted from a source directory and are left out. A manifest of a previous
+// version which fails to be verified is removed, so that the next backup is a
+// full one.
+func (m *Backupper) completeVersion(dir, prev string) error {
+	mf, err := readManifest(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return errors.Wrap(err, "manifest")
+	}
+
+	if mf == nil || len(mf.Base) == 0 {
+		return nil
+	}
+
+	prevManifest := filepath.Join(prev, ManifestName)
+
+	base, err := readManifest(prevManifest)
+	if err != nil {
+		return errors.Wrap(err, "manifest of previous version")
+	}
+
+	if base == nil || base.Generation != mf.Base {
+		return errors.New("previous version is not a base of an incremental one")
+	}
+
+	files := 0
+
+	for relPath, f := range mf.Files {
+		name := filepath.FromSlash(relPath)
+
+		if !filepath.IsLocal(name) {
+			return errors.Errorf("%s: unsafe manifest path", relPath)
+		}
+
+		path := filepath.Join(dir, name)
+
+		if _, err := os.Lstat(path); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		if err := m.copyUnchanged(filepath.Join(prev, name), path, f); err != nil {
+			if errors.Is(err, errBaseCorrupted) {
+				if err := os.Remove(prevManifest); err != nil {
+					m.log.Error(err)
+				}
+			}
+
+			return errors.Wrap(err, relPath)
+		}
+
+		m.addFileStats(relPath, f.Size)
+
+		files++
+	}
+
+	m.log.WithField(log.FieldFiles, files).Info("took unchanged files from previous version")
+
+	return nil
+}
+
+func (m *Backupper) copyUnchanged(src, dst string, f manifestFile) error {
+	in, err := os.Open(src)
+	if os.IsNotExist(err) {
+		return errBaseCorrupted
+	}
+
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0775); err != nil {
+		return err
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	h := sha256.New()
+
+	n, err := io.Copy(io.MultiWriter(out, h), in)
+	if err != nil {
+		return err
+	}
+
+	if n != f.Size || hex.EncodeToString(h.Sum(nil)) != f.SHA256 {
+		return errBaseCorrupted
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dst, f.ModTime, f.ModTime)
+}
@@ -0,0 +1,183 @@
+package filemanager
+
+import (
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// metaExtraID is an ID of an extra field of an archive entry which carries
+	// metadata of a file (see: fileMeta), since local headers a receiver reads
+	// have no mode of a file.
+	metaExtraID = 0x6d64
+	// metaLen is a length of encoded metadata.
+	metaLen = 20
+	// metaNoOwner is an owner of a file which isn't known.
+	metaNoOwner = 0xffffffff
+)
+
+// fileMeta is metadata of a sent file a receiver restores (see: PreserveMeta):
+// permissions with setuid, setgid and sticky bits, an owner and a group where a
+// platform has them, and a modification time.
+type fileMeta struct {
+	mode     fs.FileMode
+	uid, gid uint32
+	modTime  time.Time
+}
+
+// statMeta returns metadata of a file described by fi.
+func statMeta(fi fs.FileInfo) *fileMeta {
+	uid, gid := fileOwner(fi)
+
+	return &fileMeta{
+		mode:    fi.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky),
+		uid:     uid,
+		gid:     gid,
+		modTime: fi.ModTime(),
+	}
+}
+
+// marshal encodes metadata as a mode, an owner, a group and a modification time
+// in nanoseconds since the Unix epoch.
+func (f *fileMeta) marshal() []byte {
+	b := make([]byte, 0, metaLen)
+	b = binary.BigEndian.AppendUint32(b, uint32(f.mode))
+	b = binary.BigEndian.AppendUint32(b, f.uid)
+	b = binary.BigEndian.AppendUint32(b, f.gid)
+
+	return binary.BigEndian.AppendUint64(b, uint64(f.modTime.UnixNano()))
+}
+
+// parseMeta decodes metadata, it's nil if b is empty.
+func parseMeta(b []byte) (*fileMeta, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	if len(b) < metaLen {
+		return nil, errors.New("malformed file metadata")
+	}
+
+	return &fileMeta{
+		mode:    fs.FileMode(binary.BigEndian.Uint32(b)) & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky),
+		uid:     binary.BigEndian.Uint32(b[4:]),
+		gid:     binary.BigEndian.Uint32(b[8:]),
+		modTime: time.Unix(0, int64(binary.BigEndian.Uint64(b[12:]))),
+	}, nil
+}
+
+// restore applies metadata to a file at path. An owner is restored only where
+// it's permitted (e.g. a receiver run by root), so a failure to change it is
+// ignored.
+func (f *fileMeta) restore(path string) error {
+	if f.uid != metaNoOwner && f.gid != metaNoOwner {
+		_ = os.Lchown(path, int(f.uid), int(f.gid))
+	}
+
+	// Changing an owner clears setuid and setgid bits, so a mode is changed
+	// after it.
+	if err := os.Chmod(path, f.mode); err != nil {
+		return err
+	}
+
+	return os.Chtimes(path, f.modTime, f.modTime)
+}
+
+// metaExtra returns an extra field of an archive entry carrying metadata.
+func metaExtra(f *fileMeta) []byte {
+	b := binary.LittleEndian.AppendUint16(nil, metaExtraID)
+	b = binary.LittleEndian.AppendUint16(b, metaLen)
+
+	return append(b, f.marshal()...)
+}
+
+// entryMeta returns metadata an extra field of an entry carries, or nil if it
+// carries none.
+func entryMeta(extra []byte) (*fileMeta, error) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+
+		if len(extra) < 4+size {
+			break
+		}
+
+		if id == metaExtraID {
+			return parseMeta(extra[4 : 4+size])
+		}
+
+		extra = extra[4+size:]
+	}
+
+	return nil, nil
+}
+
+// writeHeader writes a header of a sent file: its name followed by metadata,
+// which is empty if a file has none (e.g. an archive) or it isn't preserved.
+func (m *Backupper) writeHeader(name string, meta *fileMeta, w io.Writer) error {
+	if err := m.writeFilename(name, w); err != nil {
+		return err
+	}
+
+	var b []byte
+
+	if meta != nil && m.cfg.PreserveMeta {
+		b = meta.marshal()
+	}
+
+	_, err := w.Write(append([]byte{uint8(len(b))}, b...))
+
+	return err
+}
+
+// readHeader reads a header of a received file (see: writeHeader()).
+func (m *Backupper) readHeader(r io.Reader) (string, *fileMeta, error) {
+	name, err := m.readFilename(r)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// A name is joined to DestinationDir and versions of a file of it are
+	// removed, so that it mustn't lead out of the directory.
+	if filepath.Base(name) != name || !filepath.IsLocal(name) {
+		return "", nil, errors.Errorf("unsafe file name: %s", name)
+	}
+
+	var metaLen [1]byte
+
+	if _, err := io.ReadFull(r, metaLen[:]); err != nil {
+		return "", nil, err
+	}
+
+	b := make([]byte, metaLen[0])
+
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", nil, err
+	}
+
+	meta, err := parseMeta(b)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return name, meta, nil
+}
+
+// restoreMeta restores metadata of a received file stored as name, if it's
+// stored in a directory and metadata is preserved.
+func (m *Backupper) restoreMeta(name string, meta *fileMeta) {
+	dir, ok := m.storage.(DirStorage)
+	if !ok || meta == nil || !m.cfg.PreserveMeta {
+		return
+	}
+
+	if err := meta.restore(dir.Location(name)); err != nil {
+		m.log.Error(errors.Wrap(err, "file metadata"))
+	}
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package filemanager
+
+import "io/fs"
+
+// fileOwner returns no owner, since files of a platform have no numeric ones.
+func fileOwner(fs.FileInfo) (uint32, uint32) {
+	return metaNoOwner, metaNoOwner
+}
@@ -0,0 +1,18 @@
+//go:build !windows && !plan9
+
+package filemanager
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileOwner returns an owner and a group of a file.
+func fileOwner(fi fs.FileInfo) (uint32, uint32) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return metaNoOwner, metaNoOwner
+	}
+
+	return st.Uid, st.Gid
+}
@@ -0,0 +1,164 @@
+package filemanager
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PathPattern is a gitignore-style pattern of a slash-separated path relative to
+// a source directory (see: ParsePathPattern()).
+type PathPattern struct {
+	// segments are globs of path components (see: path.Match()), "**" matches
+	// any number of them.
+	segments []string
+	dirOnly  bool
+	negate   bool
+
+	spec string
+}
+
+// ParsePathPattern parses a pattern as gitignore does: a pattern without a slash
+// but a trailing one matches a name at any depth, otherwise it's anchored to a
+// source directory; a trailing slash matches directories only; "*" doesn't match
+// a slash while "**" matches any number of directories (e.g. "**/cache/" or
+// "logs/**/*.gz"); a leading "!" negates an exclude pattern, re-including paths
+// an earlier one excludes. E.g. "node_modules/", "*.tmp" or "/build".
+func ParsePathPattern(s string) (PathPattern, error) {
+	p := PathPattern{spec: s}
+
+	if strings.HasPrefix(s, "!") {
+		p.negate = true
+		s = s[1:]
+	}
+
+	if strings.HasSuffix(s, "/") {
+		p.dirOnly = true
+		s = strings.TrimSuffix(s, "/")
+	}
+
+	anchored := strings.Contains(s, "/")
+	s = strings.TrimPrefix(s, "/")
+
+	if len(s) == 0 {
+		return p, errors.Errorf("pattern %q: empty path", p.spec)
+	}
+
+	if !anchored {
+		p.segments = append(p.segments, "**")
+	}
+
+	for _, seg := range strings.Split(s, "/") {
+		if len(seg) == 0 {
+			return p, errors.Errorf("pattern %q: empty path component", p.spec)
+		}
+
+		if _, err := path.Match(seg, ""); err != nil {
+			return p, errors.Errorf("pattern %q: malformed glob %q", p.spec, seg)
+		}
+
+		p.segments = append(p.segments, seg)
+	}
+
+	return p, nil
+}
+
+// ParsePathPatterns parses a list of patterns (see: ParsePathPattern()).
+func ParsePathPatterns(specs []string) ([]PathPattern, error) {
+	patterns := make([]PathPattern, 0, len(specs))
+
+	for _, s := range specs {
+		p, err := ParsePathPattern(s)
+		if err != nil {
+			return nil, err
+		}
+
+		patterns = append(patterns, p)
+	}
+
+	return patterns, nil
+}
+
+func (p PathPattern) String() string {
+	return p.spec
+}
+
+// match tells whether an entry at a slash-separated relPath matches a pattern.
+func (p *PathPattern) match(relPath string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+
+	return matchSegments(p.segments, strings.Split(relPath, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) != 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+
+			// A trailing "**" matches everything inside a directory, but not the
+			// directory itself.
+			if len(pattern) == 0 {
+				return len(name) != 0
+			}
+
+			for i := range name {
+				if matchSegments(pattern, name[i:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
+
+// excluded tells whether an entry of a source directory at a slash-separated
+// relPath is left out of an archive. The last of Exclude patterns an entry
+// matches decides, and a file which isn't excluded is still left out if Include
+// patterns are set and neither it nor any of its parent directories matches any
+// of them. Include patterns don't apply to directories, which are walked into
+// unless they're excluded, so that files inside them can match.
+func (m *Backupper) excluded(relPath string, isDir bool) bool {
+	excluded := false
+
+	for i := range m.cfg.Exclude {
+		if p := &m.cfg.Exclude[i]; p.match(relPath, isDir) {
+			excluded = !p.negate
+		}
+	}
+
+	if excluded || isDir || len(m.cfg.Include) == 0 {
+		return excluded
+	}
+
+	for i := range m.cfg.Include {
+		p := &m.cfg.Include[i]
+
+		if p.match(relPath, false) {
+			return false
+		}
+
+		for dir := path.Dir(relPath); dir != "."; dir = path.Dir(dir) {
+			if p.match(dir, true) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,204 @@
+package filemanager
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"distributed-backup/pkg/log"
+)
+
+// rateInterval is a minimum period a transfer rate is measured over, so that it
+// doesn't jump with every chunk.
+const rateInterval = 2 * time.Second
+
+// Progress is an estimate of how far a transfer has got.
+type Progress struct {
+	// Rate is a number of bytes per second sent and received recently.
+	Rate float64
+	// Bytes is an amount of a source entry a sender has archived or found
+	// unchanged, and TotalBytes is its size found before archiving, which is 0
+	// if it's unknown, as it is for a receiver.
+	Bytes      int64
+	TotalBytes int64
+	// ETA is an estimated time left until a sender has read a source entry,
+	// which is 0 if it's unknown.
+	ETA time.Duration
+}
+
+// Percent returns a share of TotalBytes done, or 0 if it's unknown.
+func (p Progress) Percent() float64 {
+	if p.TotalBytes == 0 {
+		return 0
+	}
+
+	return 100 * float64(p.Bytes) / float64(p.TotalBytes)
+}
+
+// progressMeter measures a rate of a transfer and counts bytes of a source entry
+// which are read, so that time left is estimated by a share of them. It's shared
+// by connections a transfer is resumed over, as counters of countingPeer are.
+type progressMeter struct {
+	// sampler limits frequency of progress entries, it's nil if they aren't
+	// logged.
+	sampler *log.Sampler
+
+	done  atomic.Int64
+	total atomic.Int64
+
+	mx        sync.Mutex
+	startedAt time.Time
+	sampledAt time.Time
+	sampled   int64
+	rate      float64
+}
+
+func newProgressMeter(logged bool) *progressMeter {
+	p := &progressMeter{}
+
+	if logged {
+		p.sampler = log.NewSampler(log.SamplerConfig{
+			Interval: progressLogInterval,
+			Bytes:    progressLogBytes,
+		})
+	}
+
+	return p
+}
+
+// start sets a total size of a source entry which is about to be read.
+func (p *progressMeter) start(total int64) {
+	p.mx.Lock()
+	p.startedAt = time.Now()
+	p.mx.Unlock()
+
+	p.done.Store(0)
+	p.total.Store(total)
+}
+
+// Write counts bytes of a source entry which are read.
+func (p *progressMeter) Write(b []byte) (int, error) {
+	p.done.Add(int64(len(b)))
+
+	return len(b), nil
+}
+
+// progress returns progress of a transfer which has sent and received the
+// transferred number of bytes so far.
+func (p *progressMeter) progress(transferred int64) Progress {
+	now := time.Now()
+
+	p.mx.Lock()
+
+	// A rate is measured from the first byte, not from the moment a transfer
+	// starts waiting for a peer.
+	if p.sampledAt.IsZero() {
+		if transferred != 0 {
+			p.sampledAt = now
+			p.sampled = transferred
+		}
+	} else if d := now.Sub(p.sampledAt); d >= rateInterval {
+		p.rate = float64(transferred-p.sampled) / d.Seconds()
+		p.sampledAt = now
+		p.sampled = transferred
+	}
+
+	pr := Progress{
+		Rate:       p.rate,
+		Bytes:      p.done.Load(),
+		TotalBytes: p.total.Load(),
+	}
+
+	elapsed := now.Sub(p.startedAt)
+
+	p.mx.Unlock()
+
+	if pr.Bytes > 0 && pr.TotalBytes > pr.Bytes {
+		eta := float64(elapsed) * float64(pr.TotalBytes-pr.Bytes) / float64(pr.Bytes)
+		pr.ETA = time.Duration(eta).Round(time.Second)
+	}
+
+	return pr
+}
+
+// startProgress starts measuring progress of a source entry of an estimated size
+// (see: sourceSize()).
+func (m *Backupper) startProgress() {
+	m.peer.meter.start(m.sourceSize())
+}
+
+// sourceSize estimates a size of a source entry, which is a sum of sizes of
+// regular files of a source directory which aren't excluded, once before it's
+// sent. It's 0 if it's unknown.
+func (m *Backupper) sourceSize() int64 {
+	if m.sourceBytes != nil {
+		return *m.sourceBytes
+	}
+
+	var total int64
+
+	defer func() {
+		m.sourceBytes = &total
+	}()
+
+	if !m.cfg.ZipDir {
+		if fi, err := os.Stat(m.cfg.SourceEntry); err == nil {
+			total = fi.Size()
+		}
+
+		return total
+	}
+
+	err := filepath.Walk(m.cfg.SourceEntry, func(path string, fi fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(m.cfg.SourceEntry, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+
+		if m.excluded(filepath.ToSlash(relPath), fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if fi.Mode().IsRegular() {
+			total += fi.Size()
+		}
+
+		return nil
+	})
+	if err != nil {
+		// Archiving reports an error itself, a size is just left unknown.
+		total = 0
+	}
+
+	return total
+}
+
+// FormatBytes formats a size in bytes with a binary unit, e.g. "1.5 GiB".
+func FormatBytes(n int64) string {
+	const unit = 1 << 10
+
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+
+	for v := n / unit; v >= unit && exp < 4; v /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTP"[exp])
+}
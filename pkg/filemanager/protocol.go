@@ -0,0 +1,218 @@
+package filemanager
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+// frameVersion is "${offer}" of a protocol version and features a peer starts
+// every connection with once it's authenticated (see: negotiate()).
+const frameVersion byte = 'V'
+
+const (
+	// protocolVersion is a version of the transfer protocol, which is raised
+	// only by a change a peer of an older version can't follow at all. Changes
+	// which can be left unused are told by features instead.
+	protocolVersion = 1
+	// minProtocolVersion is the oldest version of the other peer a transfer goes
+	// on with.
+	minProtocolVersion = 1
+)
+
+// Features of the transfer protocol peers agree on before a transfer. A feature
+// is offered by a peer which supports it and doesn't turn it off, and is used
+// only if both peers offer it. A peer which can't do without a feature requires
+// it, and a transfer fails at once if the other peer doesn't offer it.
+const (
+	// featureChecksums is of chunks carrying CRC-32C checksums and of a stream
+	// ending with a SHA-256 digest (see: transferStream), every transfer
+	// requires it.
+	featureChecksums = "checksums"
+	// featureResume is of a transfer going on over another connection once one
+	// is lost, it's offered with ResumeTimeout.
+	featureResume = "resume"
+	// featureStreams is of chunks spread over parallel streams (see: lanes()),
+	// it's offered by StreamsPeer.
+	featureStreams = "streams"
+	// featureFormat prefixes a format of an archive of a source directory (e.g.
+	// "format-tar.zst"), which a sender requires.
+	featureFormat = "format-"
+	// featureEnvelope is of sealed and forwarded envelopes, which a sender of
+	// one requires.
+	featureEnvelope = "envelope"
+	// Features of options both peers must set are offered and required by
+	// peers which set them, so that a peer which sets one alone fails at once
+	// rather than misreads a transfer.
+	featurePull         = "pull"
+	featureDelta        = "delta"
+	featureDedup        = "dedup"
+	featureIncremental  = "incremental"
+	featureAnnounceSize = "announce-size"
+)
+
+// supportedFormats are formats of archives a receiver takes.
+var supportedFormats = []string{FormatZip, Format7z, FormatTarGz, FormatTarZst, FormatTree}
+
+// ErrIncompatiblePeer means that peers haven't agreed on the transfer protocol,
+// e.g. the other peer is of an older version or lacks a feature a transfer
+// requires.
+var ErrIncompatiblePeer = errors.New("incompatible peer")
+
+// protocolOffer is a protocol version and features a peer offers and requires,
+// unknown fields and features of a newer version are ignored.
+type protocolOffer struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+	Required []string `json:"required,omitempty"`
+}
+
+// offer returns a protocol version and features of a peer.
+func (m *Backupper) offer() protocolOffer {
+	o := protocolOffer{
+		Version:  protocolVersion,
+		Features: []string{featureChecksums, featureEnvelope},
+		Required: []string{featureChecksums},
+	}
+
+	for _, format := range supportedFormats {
+		o.Features = append(o.Features, featureFormat+format)
+	}
+
+	if m.cfg.ResumeTimeout != 0 {
+		o.Features = append(o.Features, featureResume)
+	}
+
+	if m.streamsPeer != nil {
+		o.Features = append(o.Features, featureStreams)
+	}
+
+	if m.result.Role == RoleSender {
+		switch {
+		case m.cfg.Recipient != nil || m.cfg.Forward:
+			o.Required = append(o.Required, featureEnvelope)
+		case m.cfg.ZipDir && isZipFormat(m.cfg.Format):
+			o.Required = append(o.Required, featureFormat+FormatZip)
+		case m.cfg.ZipDir:
+			o.Required = append(o.Required, featureFormat+m.cfg.Format)
+		}
+	}
+
+	for feature, set := range map[string]bool{
+		featurePull:         len(m.cfg.Sources) != 0 || len(m.cfg.Pull) != 0,
+		featureDelta:        m.cfg.Delta,
+		featureDedup:        m.cfg.Dedup,
+		featureIncremental:  m.cfg.Incremental,
+		featureAnnounceSize: m.cfg.AnnounceSize,
+	} {
+		if set {
+			o.Features = append(o.Features, feature)
+			o.Required = append(o.Required, feature)
+		}
+	}
+
+	sort.Strings(o.Features)
+	sort.Strings(o.Required)
+
+	return o
+}
+
+// negotiate exchanges offers of peers and returns features both of them offer,
+// or fails if either peer requires one of the other ones. Offers are exchanged
+// over every connection, including ones a transfer is resumed over, so that a
+// peer is told of a mismatch before it reads anything else of the other one.
+func (m *Backupper) negotiate(conn io.ReadWriter) (map[string]bool, error) {
+	own := m.offer()
+
+	b, err := json.Marshal(&own)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(append([]byte{frameVersion}, b...)); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, maxMessageSize)
+
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := buf[:n]
+
+	switch {
+	case len(frame) != 0 && (frame[0] == frameChallenge || frame[0] == framePairing):
+		return nil, ErrAuthRequired
+	case len(frame) != 0 && frame[0] == frameHello:
+		return nil, errors.Wrap(ErrIncompatiblePeer, "other peer doesn't negotiate the protocol, it's of an older version")
+	case len(frame) == 0 || frame[0] != frameVersion:
+		return nil, errMalformedFrame
+	}
+
+	var other protocolOffer
+
+	if err := json.Unmarshal(frame[1:], &other); err != nil {
+		return nil, errors.Wrap(errMalformedFrame, err.Error())
+	}
+
+	if other.Version < minProtocolVersion {
+		return nil, errors.Wrapf(ErrIncompatiblePeer, "protocol version %d of the other peer isn't supported", other.Version)
+	}
+
+	offered := make(map[string]bool, len(other.Features))
+
+	for _, feature := range other.Features {
+		offered[feature] = true
+	}
+
+	agreed := make(map[string]bool, len(own.Features))
+
+	for _, feature := range own.Features {
+		if offered[feature] {
+			agreed[feature] = true
+		}
+	}
+
+	for _, feature := range own.Required {
+		if !agreed[feature] {
+			return nil, errors.Wrapf(ErrIncompatiblePeer, "other peer doesn't offer %s", feature)
+		}
+	}
+
+	for _, feature := range other.Required {
+		if !agreed[feature] {
+			return nil, errors.Wrapf(ErrIncompatiblePeer, "other peer requires %s, which isn't offered", feature)
+		}
+	}
+
+	version := other.Version
+	if version > protocolVersion {
+		version = protocolVersion
+	}
+
+	m.log.WithFields(log.Fields{
+		log.FieldProtocol: version,
+		log.FieldFeatures: strings.Join(sortedFeatures(agreed), ","),
+	}).Info("protocol negotiated")
+
+	return agreed, nil
+}
+
+func sortedFeatures(features map[string]bool) []string {
+	var names []string
+
+	for name := range features {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,126 @@
+package filemanager
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotServed means that a sender doesn't serve a source entry a receiver has
+// requested (see: requestEntry()).
+var ErrNotServed = errors.New("source entry isn't served")
+
+// validateSources checks source entries a sender serves, each one is checked as
+// SourceEntry would be (see: servedConfig()).
+func validateSources(cfg BackupperConfig) error {
+	switch {
+	case len(cfg.SourceEntry) != 0:
+		return errors.New("served source entries conflict with a source entry")
+	case len(cfg.DestinationDir) != 0 || cfg.Storage != nil:
+		return errors.New("source entries are served by a sender only")
+	case len(cfg.Pull) != 0:
+		return errors.New("pulling is supported by a receiver only")
+	case cfg.Forward || cfg.Shards != nil || cfg.Incremental:
+		return errors.New("served source entries conflict with forwarding, shards and incremental backup")
+	case cfg.ZipDir && !isZipFormat(cfg.Format):
+		return errors.New("served directories are sent in zip format")
+	}
+
+	for name := range cfg.Sources {
+		if len(name) == 0 || len(name) > maxRefusal || filepath.Base(name) != name || !filepath.IsLocal(name) {
+			return errors.Errorf("unsafe name of a served source entry: %q", name)
+		}
+
+		if err := ValidateConfig(servedConfig(cfg, name)); err != nil {
+			return errors.Wrap(err, name)
+		}
+	}
+
+	return nil
+}
+
+// servedConfig returns a config of a sender of a served source entry name. A
+// directory is sent as "${name}.zip".
+func servedConfig(cfg BackupperConfig, name string) BackupperConfig {
+	cfg.SourceEntry = cfg.Sources[name]
+	cfg.Sources = nil
+
+	if cfg.ZipDir {
+		cfg.OutputFilename = name + ".zip"
+	}
+
+	return cfg
+}
+
+// requestEntry asks a sender for a source entry named Pull before a transfer
+// starts (see: serveRequest()). A request is a name presented as a file name
+// is, and an answer is a reason a sender refuses it for, which is empty if a
+// source entry is sent.
+func (m *Backupper) requestEntry() error {
+	// A request is sent in a single message, which a sender reads as a whole.
+	if _, err := m.peer.Write(append([]byte{byte(len(m.cfg.Pull))}, m.cfg.Pull...)); err != nil {
+		return err
+	}
+
+	reason, err := m.readFilename(&messageReader{r: m.peer, buf: make([]byte, maxMessageSize)})
+	if err != nil {
+		return err
+	}
+
+	if len(reason) != 0 {
+		return m.stream.fail(errors.Wrap(ErrNotServed, reason))
+	}
+
+	m.log.WithField(log.FieldFile, m.cfg.Pull).Info("sender accepted request")
+
+	return nil
+}
+
+// serveRequest answers a request of a receiver and sends a requested source
+// entry of Sources from then on, a request of any other one is refused.
+func (m *Backupper) serveRequest() error {
+	name, err := m.readFilename(&messageReader{r: m.peer, buf: make([]byte, maxMessageSize)})
+	if err != nil {
+		return err
+	}
+
+	var reason string
+
+	if _, ok := m.cfg.Sources[name]; !ok {
+		reason = fmt.Sprintf("%q is not one of served source entries", name)
+	}
+
+	if len(reason) > maxRefusal {
+		reason = reason[:maxRefusal]
+	}
+
+	// See above.
+	if _, err := m.peer.Write(append([]byte{byte(len(reason))}, reason...)); err != nil {
+		return err
+	}
+
+	if len(reason) != 0 {
+		// A refusal would be lost with a connection shut down at once, so a
+		// receiver hangs up first.
+		closed := make(chan struct{})
+
+		go m.stream.drain(m.peer, closed)
+
+		select {
+		case <-closed:
+		case <-time.After(finishWait):
+		}
+
+		return errors.Wrapf(ErrNotServed, "requested %q", name)
+	}
+
+	m.cfg = servedConfig(m.cfg, name)
+
+	m.log.WithField(log.FieldFile, name).Info("serving requested source entry")
+
+	return nil
+}
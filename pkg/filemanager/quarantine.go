@@ -0,0 +1,129 @@
+package filemanager
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"path"
+	"path/filepath"
+	"time"
+
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// QuarantineDir is a subdirectory of a destination directory received files
+	// which can't be trusted are moved to, apart from versions of good ones.
+	QuarantineDir = "quarantine"
+	// QuarantineReasonExt is an extension of a file describing why a file next to
+	// it is quarantined (see: QuarantineReason).
+	QuarantineReasonExt = ".reason"
+
+	// partialSuffix is a suffix of a file or a directory being received until
+	// it's received completely and verified.
+	partialSuffix = ".partial"
+)
+
+// QuarantineReason is written next to a quarantined file.
+type QuarantineReason struct {
+	Name          string    `json:"name"`
+	Reason        string    `json:"reason"`
+	QuarantinedAt time.Time `json:"quarantined_at"`
+}
+
+// receiveToFile stores a file named name coming from r as target (see: Storage).
+// It's written to a partial file first, which replaces the current version only
+// once the file is received completely, and is quarantined otherwise (see:
+// quarantine()).
+func (m *Backupper) receiveToFile(target, name string, r io.Reader) error {
+	tmp := target + partialSuffix
+	sum := sha256.New()
+	cw := &countingWriter{Writer: sum}
+
+	if err := m.store(tmp, io.TeeReader(r, cw)); err != nil {
+		m.quarantine(tmp, name, err)
+
+		return err
+	}
+
+	m.shiftFileVersions(target, false)
+
+	if err := m.storage.Rename(tmp, target); err != nil {
+		return err
+	}
+
+	m.setStored(name, target, cw.n, sum.Sum(nil))
+
+	return nil
+}
+
+// store writes content of r to a stored file named name.
+func (m *Backupper) store(name string, r io.Reader) error {
+	w, err := m.storage.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, r)
+
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// quarantine moves a stored file or a directory tmp, which is an incomplete,
+// corrupted or rejected receive of name, to QuarantineDir along with a reason
+// file. Nothing is done if nothing has been stored as tmp yet, and a receive
+// canceled by a receiver itself is removed instead (see: Cancel()).
+func (m *Backupper) quarantine(tmp, name string, reason error) {
+	if exists, _ := m.storage.Exists(tmp); !exists {
+		return
+	}
+
+	if errors.Is(reason, ErrCanceled) && m.ctx.Err() != nil {
+		// A partial directory is one a receiver has made (see: extractFile()
+		// and receiveTree()).
+		if err := m.removeStored(tmp, true); err != nil {
+			m.log.Error(errors.Wrap(err, "partially received file"))
+		}
+
+		m.log.WithField(log.FieldFile, m.storage.Location(tmp)).Info("partially received file is removed")
+
+		return
+	}
+
+	now := time.Now().UTC()
+	target := path.Join(QuarantineDir, now.Format("20060102T150405.000000000Z")+"-"+filepath.Base(name))
+
+	if err := m.storage.Rename(tmp, target); err != nil {
+		m.log.Error(errors.Wrap(err, "quarantine"))
+
+		return
+	}
+
+	b, err := json.MarshalIndent(&QuarantineReason{
+		Name:          name,
+		Reason:        log.Redact(reason.Error()),
+		QuarantinedAt: now,
+	}, "", "  ")
+	if err == nil {
+		err = m.store(target+QuarantineReasonExt, bytes.NewReader(append(b, '\n')))
+	}
+
+	if err != nil {
+		m.log.Error(errors.Wrap(err, "quarantine reason"))
+	}
+
+	location := m.storage.Location(target)
+
+	m.log.WithField(log.FieldFile, location).Info("received file is quarantined")
+
+	m.resultMx.Lock()
+	m.result.Quarantined = location
+	m.resultMx.Unlock()
+}
@@ -0,0 +1,160 @@
+package filemanager
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// assertDirUnchanged checks that dir has as many entries as it had before.
+func assertDirUnchanged(t *testing.T, dir string, before []os.DirEntry) {
+	t.Helper()
+
+	after, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(after) != len(before) {
+		t.Error("destination directory changed")
+	}
+}
+
+// TestCatalog sends a backup twice and checks that a receiver records both
+// versions of it in a catalog along with a hash of the stored file.
+func TestCatalog(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+
+	for i := 0; i < 2; i++ {
+		mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{})
+	}
+
+	records, err := ReadCatalog(dstDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 || records[0].Version != 1 || records[1].Version != 2 {
+		t.Fatalf("catalog has %d records, versions 1 and 2 expected", len(records))
+	}
+
+	b, err := os.ReadFile(filepath.Join(dstDir, testOutFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := records[1]; r.Filename != testOutFile || r.Size != int64(len(b)) || r.SHA256 != fmt.Sprintf("%x", sha256.Sum256(b)) {
+		t.Errorf("catalog record doesn't match stored file: %+v", r)
+	}
+}
+
+// TestRetention seeds versions of a backup received at noon a day and three
+// days ago and an hour earlier the former day, and checks that a receiver
+// keeping the latest version of each of 2 days removes the older versions of
+// both days and renumbers the kept one after a new version.
+func TestRetention(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+
+	y, m, d := time.Now().Date()
+	noon := time.Date(y, m, d, 12, 0, 0, 0, time.Local)
+
+	seeded := []time.Time{noon.AddDate(0, 0, -1), noon.AddDate(0, 0, -1).Add(-time.Hour), noon.AddDate(0, 0, -3)}
+
+	for i := range seeded {
+		version := testOutFile
+		if i != 0 {
+			version += fmt.Sprintf(".%d", i)
+		}
+
+		if err := os.WriteFile(filepath.Join(dstDir, version), []byte(version), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := json.Marshal(map[string]any{"received_at": seeded})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dstDir, "."+testOutFile+".versions"), b, 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{
+		ReceiverRetention: &Retention{Daily: 2},
+	})
+
+	restoreTestBackup(t, filepath.Join(dstDir, testOutFile), t.TempDir())
+
+	b, err = os.ReadFile(filepath.Join(dstDir, testOutFile+".1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != testOutFile {
+		t.Errorf("%s.1 isn't the latest version of a day ago", testOutFile)
+	}
+
+	for _, version := range []string{testOutFile + ".2", testOutFile + ".3"} {
+		if _, err := os.Stat(filepath.Join(dstDir, version)); !os.IsNotExist(err) {
+			t.Errorf("%s isn't removed", version)
+		}
+	}
+}
+
+// TestQuota checks that a receiver refuses a transfer whose announced size
+// exceeds its quota before anything is sent, that a transfer which isn't
+// announced fails once it exceeds a quota, and that a transfer within a quota
+// succeeds. The receiver doesn't save anything of failed transfers.
+func TestQuota(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+
+	before, err := os.ReadDir(dstDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testTransfer(srcDir, dstDir, testOutFile, transferOptions{
+		AnnounceSize:    true,
+		ReceiverMaxSize: 1 << 10,
+	})
+	if !errors.Is(err, ErrSizeRefused) {
+		t.Fatalf("transfer of announced size exceeding quota: %v", err)
+	}
+
+	err = testTransfer(srcDir, dstDir, testOutFile, transferOptions{ReceiverMaxSize: 100})
+	if err == nil {
+		t.Fatal("transfer exceeding quota succeeded")
+	}
+
+	assertDirUnchanged(t, dstDir, before)
+
+	mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{
+		AnnounceSize:    true,
+		ReceiverMaxSize: 1 << 20,
+	})
+}
+
+// TestIncompatiblePeer makes a sender send deltas to a receiver which doesn't
+// take them, both peers are expected to fail before anything is sent.
+func TestIncompatiblePeer(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+
+	before, err := os.ReadDir(dstDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testTransfer(srcDir, dstDir, testOutFile, transferOptions{Delta: true})
+	if !errors.Is(err, ErrIncompatiblePeer) {
+		t.Fatalf("transfer to a receiver which doesn't take deltas: %v", err)
+	}
+
+	assertDirUnchanged(t, dstDir, before)
+}
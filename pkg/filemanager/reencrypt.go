@@ -0,0 +1,176 @@
+package filemanager
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+
+	"distributed-backup/pkg/envelope"
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+// SealedExt is an extension of a received file which is stored re-encrypted
+// under StorageKey (see: receiveReencrypted()).
+const SealedExt = ".sealed"
+
+// receiveReencrypted stores a file coming from r sealed for StorageKey instead of
+// the file itself, so that stored backups are protected by a key a receiver holds
+// rather than by passwords a sender chooses. The outer archive of a double ZIP is
+// decrypted with Password2 and verified on the fly, and the inner one is sealed in
+// its place, other files are sealed as is. A sealed file contains a name of a
+// stored file followed by its content, just like data sent to Peer, and is saved
+// as "${name}.sealed" versioned as usual.
+func (m *Backupper) receiveReencrypted(name string, r io.Reader) error {
+	m.log.WithField(log.FieldFile, name).Info("receiving file to re-encrypt")
+
+	m.setFilename(name)
+
+	pr, pw := io.Pipe()
+
+	var escrow []byte
+
+	go func() {
+		var err error
+
+		escrow, err = m.reencrypt(name, r, pw)
+		pw.CloseWithError(err)
+	}()
+
+	err := m.receiveToFile(name+SealedExt, name, pr)
+
+	// The rest of a stream is discarded if a file fails to be saved, so that
+	// the goroutine doesn't block on a pipe.
+	pr.CloseWithError(errors.New("re-encrypted file is not saved"))
+
+	if err != nil {
+		return err
+	}
+
+	// A sealed backup is still protected with Password1, so an escrowed key of
+	// it is kept as "${name}.escrow".
+	return m.saveEscrow(name+EscrowExt, escrow)
+}
+
+// reencrypt seals a file coming from r for StorageKey into w, and returns an
+// escrowed key of a backup if there is one (see: writeEscrow()).
+func (m *Backupper) reencrypt(name string, r io.Reader, w io.Writer) ([]byte, error) {
+	sealed, err := envelope.NewWriter(w, m.cfg.StorageKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(r)
+
+	sig, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if len(sig) < 4 || binary.LittleEndian.Uint32(sig) != zipFileHeaderSignature {
+		if err := m.writeFilename(name, sealed); err != nil {
+			return nil, err
+		}
+
+		if _, err := io.Copy(sealed, br); err != nil {
+			return nil, err
+		}
+
+		return nil, sealed.Close()
+	}
+
+	outer := newZipStreamReader(br, m.cfg.Password2)
+
+	inner, err := outer.Next()
+	if err == io.EOF {
+		return nil, errors.New("empty archive")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.writeFilename(inner.Name, sealed); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(sealed, inner); err != nil {
+		return nil, errors.Wrap(err, inner.Name)
+	}
+
+	escrow, err := readEscrow(outer)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	// The outer archive's central directory is left until a connection is closed.
+	if _, err := io.Copy(io.Discard, br); err != nil {
+		return nil, err
+	}
+
+	return escrow, sealed.Close()
+}
+
+// Unseal decrypts a file stored by a receiver with StorageKey (see:
+// receiveReencrypted()) with a private key of its identity, and saves the sealed
+// file into dir. It returns a path of the saved file.
+func Unseal(path string, id *envelope.Identity, dir string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	h, err := envelope.ReadHeader(r)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := envelope.Open(r, h, id)
+	if err != nil {
+		return "", err
+	}
+
+	var nameLen uint8
+
+	if err := binary.Read(sealed, binary.BigEndian, &nameLen); err != nil {
+		return "", err
+	}
+
+	name := make([]byte, nameLen)
+
+	if _, err := io.ReadFull(sealed, name); err != nil {
+		return "", err
+	}
+
+	if !filepath.IsLocal(string(name)) {
+		return "", errors.New("unsafe sealed file name")
+	}
+
+	target := filepath.Join(dir, string(name))
+
+	// A partially decrypted file is removed, since it can't be trusted.
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0664)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(out, sealed)
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(target)
+
+		return "", err
+	}
+
+	return target, nil
+}
@@ -0,0 +1,128 @@
+package filemanager
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+// storedArchiveName matches a name of a stored zipped directory or of its
+// version (see: shiftFileVersions()).
+var storedArchiveName = regexp.MustCompile(`^(.+)\.zip(\.[0-9]+)?$`)
+
+// Restore extracts both levels of a zipped directory stored by a receiver at
+// path with passwords of a sender into a directory in dir named after the
+// archive without the ".zip" extension (e.g. "backup" for "backup.zip" and
+// "backup.1" for "backup.zip.1"), as a receiver with Extract does. A manifest of
+// a deduplicated backup is restored of chunks stored next to it instead, and
+// passwords aren't used (see: restoreDedup()). Files get metadata they're
+// archived with. An existing directory is never overwritten, and a tree which
+// fails to be verified is removed. It returns a path of the extracted directory.
+// Entries are logged with l, the global logger is used if nil.
+func Restore(path, password1, password2, dir string, l log.Logger) (string, error) {
+	if l == nil {
+		l = log.New()
+	}
+
+	name := filepath.Base(path)
+
+	dedup, err := isDedupManifest(path)
+	if err != nil {
+		return "", err
+	}
+
+	match := storedArchiveName.FindStringSubmatch(name)
+
+	switch {
+	case match != nil:
+		name = match[1] + match[2]
+	case !dedup:
+		return "", errors.Errorf("not a zipped directory: %s", name)
+	}
+
+	target := filepath.Join(dir, name)
+
+	if _, err := os.Lstat(target); !os.IsNotExist(err) {
+		return "", errors.Errorf("%s already exists", target)
+	}
+
+	tmpPath := target + partialSuffix
+
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(tmpPath, 0775); err != nil {
+		return "", err
+	}
+
+	if dedup {
+		err = restoreDedup(path, tmpPath, l)
+	} else {
+		err = restoreArchive(path, password1, password2, tmpPath, l)
+	}
+
+	if err == nil {
+		err = os.Rename(tmpPath, target)
+	}
+
+	if err != nil {
+		os.RemoveAll(tmpPath)
+
+		return "", err
+	}
+
+	return target, nil
+}
+
+// restoreArchive extracts a zipped directory stored at path into dir, logging
+// with l.
+func restoreArchive(path, password1, password2, dir string, l log.Logger) error {
+	f, r, err := openStoredArchive(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	m := &Backupper{
+		cfg: BackupperConfig{
+			Password1:    password1,
+			Password2:    password2,
+			PreserveMeta: true,
+		},
+		log: l.WithField(log.FieldFile, path),
+	}
+
+	links, err := m.extractArchive(r, dir, "")
+	if err == nil {
+		err = m.makeSymlinks(dir, links)
+	}
+
+	return err
+}
+
+// openStoredArchive opens a zipped directory stored at path, and returns a
+// reader of it which is checked to begin with a zip entry.
+func openStoredArchive(path string) (*os.File, *bufio.Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := bufio.NewReader(f)
+
+	sig, err := r.Peek(4)
+	if err != nil || binary.LittleEndian.Uint32(sig) != zipFileHeaderSignature {
+		f.Close()
+
+		return nil, nil, errors.Errorf("not a zip archive: %s", filepath.Base(path))
+	}
+
+	return f, r, nil
+}
@@ -0,0 +1,142 @@
+package filemanager
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"distributed-backup/pkg/log"
+)
+
+const (
+	// progressLogInterval and progressLogBytes limit frequency of progress
+	// entries logged during a transfer.
+	progressLogInterval = 10 * time.Second
+	progressLogBytes    = 256 << 20
+)
+
+const (
+	RoleSender   = "sender"
+	RoleReceiver = "receiver"
+)
+
+type Phase string
+
+const (
+	// PhaseWaiting means a connection has not been established yet.
+	PhaseWaiting      Phase = "waiting"
+	PhaseTransferring Phase = "transferring"
+	PhaseFinished     Phase = "finished"
+)
+
+// Result is a snapshot of a transfer's progress. Err is set only if a transfer
+// has finished with an error, and Quarantined is a path a file failed to be
+// received is moved to then (see: quarantine()).
+type Result struct {
+	Role          string
+	Phase         Phase
+	Filename      string
+	SentBytes     int64
+	ReceivedBytes int64
+	StartedAt     time.Time
+	FinishedAt    time.Time
+	Stats         Stats
+	Progress      Progress
+	Err           error
+	Quarantined   string
+	// Digest is a SHA-256 digest of a transfer stream, which both peers have
+	// verified and which is the same on both of them. It's set once a transfer
+	// has succeeded.
+	Digest []byte
+	// StoredDigest is a SHA-256 digest of a file a receiver has stored, it's
+	// unset if a directory is stored (see: Extract).
+	StoredDigest []byte
+	// Reverse is a result of a transfer a peer of two-way sync receives, its
+	// role is RoleSync then and Err is of either transfer (see: Sync).
+	Reverse *Result
+}
+
+// countingPeer counts bytes that are read from and written to Peer, and logs
+// progress of a transfer measured by meter. Counters are shared by connections
+// a transfer is resumed over (see: with()).
+type countingPeer struct {
+	Peer
+
+	sent     *atomic.Int64
+	received *atomic.Int64
+
+	log   log.Logger
+	meter *progressMeter
+}
+
+func newCountingPeer(peer Peer, logger log.Logger, logProgress bool) *countingPeer {
+	return &countingPeer{
+		Peer:     peer,
+		sent:     new(atomic.Int64),
+		received: new(atomic.Int64),
+		log:      logger,
+		meter:    newProgressMeter(logProgress),
+	}
+}
+
+// with returns a peer which counts bytes of peer along with ones of p.
+func (p *countingPeer) with(peer Peer) *countingPeer {
+	c := *p
+	c.Peer = peer
+
+	return &c
+}
+
+func (p *countingPeer) Read(payload []byte) (int, error) {
+	n, err := p.Peer.Read(payload)
+
+	p.received.Add(int64(n))
+	p.logProgress(n)
+
+	return n, err
+}
+
+func (p *countingPeer) Write(payload []byte) (int, error) {
+	n, err := p.Peer.Write(payload)
+
+	p.sent.Add(int64(n))
+	p.logProgress(n)
+
+	return n, err
+}
+
+func (p *countingPeer) progress() Progress {
+	return p.meter.progress(p.sent.Load() + p.received.Load())
+}
+
+// logProgress logs a rate of a transfer, and a share of a source entry sent and
+// time left if its size is known.
+func (p *countingPeer) logProgress(n int) {
+	if n == 0 {
+		return
+	}
+
+	// A rate is measured even if progress isn't logged, so that it's reported
+	// by Result() over the latest interval.
+	pr := p.progress()
+
+	if p.meter.sampler == nil || !p.meter.sampler.Allow(int64(n)) {
+		return
+	}
+
+	fields := log.Fields{
+		log.FieldSentBytes: p.sent.Load(),
+		log.FieldRecvBytes: p.received.Load(),
+		log.FieldRate:      FormatBytes(int64(pr.Rate)) + "/s",
+	}
+
+	if pr.TotalBytes != 0 {
+		fields[log.FieldProgress] = fmt.Sprintf("%.1f%%", pr.Percent())
+	}
+
+	if pr.ETA != 0 {
+		fields[log.FieldETA] = pr.ETA.String()
+	}
+
+	p.log.WithFields(fields).Info("transfer progress")
+}
@@ -0,0 +1,1047 @@
+package filemanager
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sync"
+	"time"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/metrics"
+
+	"github.com/pkg/errors"
+)
+
+// Frames a transfer is carried in, each one is a message of a data channel
+// starting with its type.
+const (
+	// frameHello is "${id}${fresh}" a sender starts every connection with.
+	frameHello byte = 'H'
+	// frameOffset is "${offset}" a receiver answers a hello with.
+	frameOffset byte = 'O'
+	// frameData is "${sequence_number}${crc32c}${data}" of a chunk of a transfer
+	// stream.
+	frameData byte = 'D'
+	// frameEnd is "${offset}${sha256}" of an end of a transfer stream, with a
+	// SHA-256 digest of all of its data.
+	frameEnd byte = 'E'
+	// frameAck is "${offset}" of data a receiver has got.
+	frameAck byte = 'K'
+	// frameDone is "${offset}" of an end of a transfer stream a receiver has
+	// verified and stored a file of.
+	frameDone byte = 'F'
+	// frameAbort is "${reason}" of a peer which has failed a transfer, e.g. of a
+	// receiver which has failed to verify or store a file.
+	frameAbort byte = 'A'
+)
+
+const (
+	transferIDLen  = 16
+	frameHeaderLen = 9
+	chunkHeaderLen = 13
+	// chunkSize is a size of chunks of a transfer stream but the last one, so that
+	// a sequence number of a chunk tells its offset.
+	chunkSize = 32 << 10
+	// maxAbortReason bounds a reason of an abort sent to the other peer.
+	maxAbortReason = 1 << 10
+	// resumeWindow bounds data a sender keeps until a receiver acknowledges it,
+	// writes block once it's reached.
+	resumeWindow = 16 << 20
+	// ackInterval is an amount of data a receiver acknowledges once per.
+	ackInterval = 1 << 20
+	// finishWait bounds a time a receiver waits for a sender to close a connection
+	// once a transfer ends, so that the last acknowledgement isn't lost with a
+	// connection closed too early.
+	finishWait = 10 * time.Second
+)
+
+var errMalformedFrame = errors.New("malformed frame")
+
+// ErrCorruptedChunk means that a chunk has been received with a checksum which
+// doesn't match its data.
+var ErrCorruptedChunk = errors.New("checksum mismatch")
+
+// ErrDigestMismatch means that data of a transfer stream a receiver has got
+// doesn't match a SHA-256 digest of data a sender has sent.
+var ErrDigestMismatch = errors.New("SHA-256 digest mismatch")
+
+// ErrConnectionLost means that a connection has been lost in the middle of a
+// transfer, and the transfer hasn't been resumed over a new one.
+var ErrConnectionLost = errors.New("connection lost")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// transferStream carries data of a transfer over connections to the same peer,
+// so that a connection which is lost can be replaced with another one (see:
+// Resume()) without starting a transfer over.
+//
+// A sender splits data into chunks of chunkSize carrying sequence numbers and
+// CRC-32C checksums, which a receiver verifies, so that corrupted data fails a
+// transfer rather than makes a broken file. A sender keeps chunks until a
+// receiver acknowledges them, and a receiver tells an offset it has got to when another
+// connection is attached, so that a sender continues from there. A transfer fails
+// if no connection is attached within ResumeTimeout after one is lost.
+//
+// A sender ends a stream with a SHA-256 digest of all of its data, which a
+// receiver compares with a digest of data it has got, and a receiver confirms
+// an end only once it has stored a file (see: finish()), so that a sender which
+// closes a stream successfully knows that a complete and valid file is stored.
+type transferStream struct {
+	role       string
+	timeout    time.Duration
+	ackTimeout time.Duration
+	log        log.Logger
+
+	// wmx serializes frames written to a connection, so that retransmitted ones
+	// aren't interleaved with new ones.
+	wmx sync.Mutex
+
+	// digest hashes data a sender has written or a receiver has got.
+	digest hash.Hash
+
+	mx       sync.Mutex
+	cond     *sync.Cond
+	id       []byte
+	conn     *countingPeer
+	attached bool
+	losses   int
+	err      error
+
+	// A sender's data from acked up to sent is kept in pending, and chunk is
+	// data written after it.
+	sent    int64
+	acked   int64
+	pending []byte
+	chunk   []byte
+	sum     []byte
+	closed  bool
+	done    bool
+
+	// A receiver's data up to received is got, and buf is a part of it which
+	// hasn't been read yet.
+	received int64
+	lastAck  int64
+	buf      []byte
+	// quota bounds data a receiver gets if it isn't 0 (see: MaxSize).
+	quota int64
+	frame []byte
+	eof   bool
+
+	// lanes carry chunks along with a connection (see: setLanes()). A receiver
+	// keeps chunks which haven't been read yet in early, and an end of a stream
+	// in end until all of them are read, connClosed is closed once a connection
+	// fails to be read.
+	lanes      []*countingPeer
+	early      map[uint64][]byte
+	end        []byte
+	connClosed chan struct{}
+	// acksRead is closed once acknowledgements of the current connection of a
+	// sender stop being read, i.e. a receiver has hung up (see: abort()).
+	acksRead chan struct{}
+}
+
+func newTransferStream(role string, timeout, ackTimeout time.Duration, logger log.Logger) (*transferStream, error) {
+	s := &transferStream{
+		role:       role,
+		timeout:    timeout,
+		ackTimeout: ackTimeout,
+		log:        logger,
+		digest:     sha256.New(),
+	}
+
+	s.cond = sync.NewCond(&s.mx)
+
+	if role == RoleSender {
+		s.id = make([]byte, transferIDLen)
+
+		if _, err := rand.Read(s.id); err != nil {
+			return nil, err
+		}
+
+		s.chunk = make([]byte, 0, chunkSize)
+	} else {
+		s.frame = make([]byte, maxMessageSize)
+	}
+
+	return s, nil
+}
+
+// sendHello tells a receiver which transfer a connection carries and returns an
+// offset the receiver has got to. A transfer is failed if a receiver rejects it,
+// since it would be rejected again.
+func (m *Backupper) sendHello(conn io.ReadWriter, fresh bool) (int64, error) {
+	hello := append([]byte{frameHello}, m.stream.id...)
+
+	if fresh {
+		hello = append(hello, 1)
+	} else {
+		hello = append(hello, 0)
+	}
+
+	if _, err := conn.Write(hello); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, maxMessageSize)
+
+	n, err := conn.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+
+	frame := buf[:n]
+
+	switch {
+	case len(frame) == frameHeaderLen && frame[0] == frameOffset:
+		return int64(binary.BigEndian.Uint64(frame[1:])), nil
+	case len(frame) != 0 && frame[0] == frameAbort:
+		return 0, m.stream.fail(errors.Errorf("receiver rejected transfer: %s", frame[1:]))
+	case len(frame) != 0 && (frame[0] == frameChallenge || frame[0] == framePairing):
+		return 0, ErrAuthRequired
+	default:
+		return 0, errMalformedFrame
+	}
+}
+
+// receiveHello answers a hello of a sender with an offset of its transfer. A
+// fresh transfer is taken on the first connection only, and other connections
+// must carry the same one.
+func (m *Backupper) receiveHello(conn io.ReadWriter, fresh bool) error {
+	buf := make([]byte, maxMessageSize)
+
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+
+	frame := buf[:n]
+
+	if len(frame) != 0 && (frame[0] == frameChallenge || frame[0] == framePairing) {
+		return ErrAuthRequired
+	}
+
+	if len(frame) != 2+transferIDLen || frame[0] != frameHello {
+		return errMalformedFrame
+	}
+
+	offset, err := m.stream.accept(frame[1:1+transferIDLen], frame[1+transferIDLen] == 1, fresh)
+	if err != nil {
+		conn.Write(append([]byte{frameAbort}, err.Error()...))
+
+		return err
+	}
+
+	return writeFrame(conn, frameOffset, offset)
+}
+
+// accept takes a transfer of a hello and returns an offset a receiver has got to.
+func (s *transferStream) accept(id []byte, helloFresh, fresh bool) (int64, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	switch {
+	case fresh && !helloFresh:
+		return 0, errors.New("transfer to resume is unknown")
+	case !fresh && (helloFresh || string(id) != string(s.id)):
+		return 0, errors.New("another transfer is in progress")
+	}
+
+	s.id = append([]byte(nil), id...)
+
+	return s.received, nil
+}
+
+// attach makes a transfer go on over conn from offset, which a receiver has got
+// to. A sender retransmits data a receiver hasn't got.
+func (s *transferStream) attach(conn *countingPeer, offset int64) error {
+	s.wmx.Lock()
+	defer s.wmx.Unlock()
+
+	s.mx.Lock()
+
+	if s.err != nil {
+		s.mx.Unlock()
+
+		return s.err
+	}
+
+	if s.role == RoleSender {
+		if offset < s.acked || offset > s.sent {
+			s.mx.Unlock()
+
+			return s.fail(errors.Errorf("receiver has lost acknowledged data: offset %d of %d", offset, s.acked))
+		}
+
+		s.pending = s.pending[offset-s.acked:]
+		s.acked = offset
+	} else {
+		offset = s.received
+	}
+
+	resumed := s.losses != 0
+
+	// A receiver may learn that a connection is lost only once another one is
+	// made.
+	if s.conn != nil && s.conn != conn {
+		s.conn.Shutdown()
+	}
+
+	s.conn = conn
+	s.attached = true
+	s.cond.Broadcast()
+
+	if s.role == RoleSender {
+		s.acksRead = make(chan struct{})
+	}
+
+	pending, sent, sum, closed, acksRead := s.pending, s.sent, s.sum, s.closed, s.acksRead
+
+	s.mx.Unlock()
+
+	if resumed {
+		s.log.WithField(log.FieldOffset, offset).Info("transfer resumed")
+
+		metrics.Count("transfer_resumes", 1, "role", s.role)
+	}
+
+	if s.role != RoleSender {
+		if s.early != nil {
+			s.readLanes(conn)
+		}
+
+		return nil
+	}
+
+	go s.readAcks(conn, acksRead)
+
+	for len(pending) != 0 {
+		n := len(pending)
+		if n > chunkSize {
+			n = chunkSize
+		}
+
+		if err := writeChunk(conn, offset, pending[:n]); err != nil {
+			s.lose(conn, err)
+
+			return nil
+		}
+
+		pending = pending[n:]
+		offset += int64(n)
+	}
+
+	if closed {
+		if err := writeEnd(conn, sent, sum); err != nil {
+			s.lose(conn, err)
+		}
+	}
+
+	return nil
+}
+
+// Write sends data in chunks to the current connection, they are kept if there
+// is none until another one is attached.
+func (s *transferStream) Write(p []byte) (int, error) {
+	var written int
+
+	s.digest.Write(p)
+
+	for len(p) != 0 {
+		n := chunkSize - len(s.chunk)
+		if n > len(p) {
+			n = len(p)
+		}
+
+		s.chunk = append(s.chunk, p[:n]...)
+		written += n
+		p = p[n:]
+
+		if len(s.chunk) == chunkSize {
+			if err := s.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// flush sends data written since the last chunk as a chunk.
+func (s *transferStream) flush() error {
+	if len(s.chunk) == 0 {
+		return nil
+	}
+
+	if err := s.waitWindow(); err != nil {
+		return err
+	}
+
+	s.wmx.Lock()
+	defer s.wmx.Unlock()
+
+	s.mx.Lock()
+
+	offset := s.sent
+	s.pending = append(s.pending, s.chunk...)
+	s.sent += int64(len(s.chunk))
+	conn := s.conn
+
+	s.mx.Unlock()
+
+	if conn != nil {
+		if err := writeChunk(s.laneOf(conn, offset), offset, s.chunk); err != nil {
+			s.lose(conn, err)
+		}
+	}
+
+	s.chunk = s.chunk[:0]
+
+	return nil
+}
+
+func (s *transferStream) waitWindow() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for s.err == nil && len(s.pending) >= resumeWindow {
+		s.cond.Wait()
+	}
+
+	return s.err
+}
+
+// Close sends the last chunk and an end of data, and waits for a receiver to
+// confirm that it has verified and stored all of it for ackTimeout at most, so
+// that a connection isn't shut down while data is still buffered on its way.
+func (s *transferStream) Close() error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+
+	s.wmx.Lock()
+	s.mx.Lock()
+
+	s.closed = true
+	s.sum = s.digest.Sum(nil)
+	conn, sent, sum := s.conn, s.sent, s.sum
+
+	s.mx.Unlock()
+
+	if conn != nil {
+		if err := writeEnd(conn, sent, sum); err != nil {
+			s.lose(conn, err)
+		}
+	}
+
+	s.wmx.Unlock()
+
+	if s.ackTimeout != 0 {
+		t := time.AfterFunc(s.ackTimeout, func() {
+			s.fail(errors.Errorf("receiver hasn't confirmed transfer within %s", s.ackTimeout))
+		})
+		defer t.Stop()
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for s.err == nil && !s.done {
+		s.cond.Wait()
+	}
+
+	if s.done {
+		return nil
+	}
+
+	return s.err
+}
+
+// readAcks reads acknowledgements of a receiver from conn until it fails, and
+// closes done then.
+func (s *transferStream) readAcks(conn *countingPeer, done chan struct{}) {
+	defer close(done)
+
+	buf := make([]byte, maxMessageSize)
+
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			s.lose(conn, err)
+
+			return
+		}
+
+		if err := s.handleAck(buf[:n]); err != nil {
+			s.fail(err)
+			conn.Shutdown()
+
+			return
+		}
+	}
+}
+
+func (s *transferStream) handleAck(frame []byte) error {
+	if len(frame) != 0 && frame[0] == frameAbort {
+		return errors.Errorf("receiver aborted transfer: %s", frame[1:])
+	}
+
+	if len(frame) != frameHeaderLen || (frame[0] != frameAck && frame[0] != frameDone) {
+		return errMalformedFrame
+	}
+
+	offset := int64(binary.BigEndian.Uint64(frame[1:]))
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if offset < s.acked || offset > s.sent {
+		return errors.Errorf("acknowledged offset is out of range: %d", offset)
+	}
+
+	s.pending = s.pending[offset-s.acked:]
+	s.acked = offset
+
+	if frame[0] == frameDone {
+		if !s.closed || offset != s.sent {
+			return errors.New("receiver has ended transfer too early")
+		}
+
+		s.done = true
+	}
+
+	s.cond.Broadcast()
+
+	return nil
+}
+
+// Read returns data of frames read from the current connection, it waits for
+// another one to be attached once the current one is lost.
+func (s *transferStream) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.eof {
+			return 0, io.EOF
+		}
+
+		if err := s.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+
+	return n, nil
+}
+
+func (s *transferStream) readFrame() error {
+	if s.early != nil {
+		return s.readLaneFrame()
+	}
+
+	conn, err := s.connection()
+	if err != nil {
+		return err
+	}
+
+	n, err := conn.Read(s.frame)
+	if err != nil {
+		s.lose(conn, err)
+
+		return nil
+	}
+
+	frame := s.frame[:n]
+
+	if len(frame) != 0 && frame[0] == frameAbort {
+		return s.fail(errors.Errorf("sender aborted transfer: %s", frame[1:]))
+	}
+
+	s.mx.Lock()
+	received := s.received
+	s.mx.Unlock()
+
+	switch {
+	case len(frame) >= chunkHeaderLen && frame[0] == frameData:
+		return s.readChunk(conn, frame, received)
+	case isEndFrame(frame):
+		return s.readEnd(frame, received)
+	default:
+		return s.fail(errMalformedFrame)
+	}
+}
+
+func isEndFrame(frame []byte) bool {
+	return len(frame) == frameHeaderLen+sha256.Size && frame[0] == frameEnd
+}
+
+// readEnd verifies an end of a stream against data got so far.
+func (s *transferStream) readEnd(frame []byte, received int64) error {
+	if offset := int64(binary.BigEndian.Uint64(frame[1:])); offset != received {
+		return s.fail(errors.Errorf("data is missing at offset %d of %d", received, offset))
+	}
+
+	if !bytes.Equal(frame[frameHeaderLen:], s.digest.Sum(nil)) {
+		return s.fail(ErrDigestMismatch)
+	}
+
+	s.mx.Lock()
+	s.eof = true
+	s.sum = s.digest.Sum(nil)
+	s.mx.Unlock()
+
+	s.log.Debug("transfer stream verified by SHA-256 digest")
+
+	return nil
+}
+
+// readChunk verifies a chunk of a frame and makes its data read next. A chunk
+// retransmitted after a reconnect may be one already got, it's skipped then.
+func (s *transferStream) readChunk(conn *countingPeer, frame []byte, received int64) error {
+	seq, data, err := parseChunk(frame)
+	if err != nil {
+		return s.fail(err)
+	}
+
+	// Only the last chunk is short, and nothing but an end follows it.
+	if received%chunkSize != 0 {
+		return s.fail(errMalformedFrame)
+	}
+
+	switch next := uint64(received / chunkSize); {
+	case seq < next:
+		return nil
+	case seq > next:
+		return s.fail(errors.Errorf("chunk %d is missing", next))
+	}
+
+	return s.acceptChunk(conn, data)
+}
+
+// parseChunk returns a sequence number and data of a chunk of a frame, and
+// verifies its checksum.
+func parseChunk(frame []byte) (uint64, []byte, error) {
+	seq := binary.BigEndian.Uint64(frame[1:])
+	sum := binary.BigEndian.Uint32(frame[frameHeaderLen:])
+	data := frame[chunkHeaderLen:]
+
+	if len(data) == 0 || len(data) > chunkSize {
+		return 0, nil, errMalformedFrame
+	}
+
+	if crc32.Checksum(data, crcTable) != sum {
+		return 0, nil, errors.Wrapf(ErrCorruptedChunk, "chunk %d", seq)
+	}
+
+	return seq, data, nil
+}
+
+// acceptChunk makes data of the next chunk read next, and acknowledges data
+// got every ackInterval over conn.
+func (s *transferStream) acceptChunk(conn *countingPeer, data []byte) error {
+	s.buf = data
+	s.digest.Write(data)
+
+	s.mx.Lock()
+	s.received += int64(len(data))
+	received := s.received
+	s.mx.Unlock()
+
+	if s.quota != 0 && received > s.quota {
+		return s.fail(errors.Errorf("transfer exceeds quota of %s", FormatBytes(s.quota)))
+	}
+
+	if received-s.lastAck >= ackInterval {
+		s.lastAck = received
+		s.writeAck(conn, frameAck, received)
+	}
+
+	return nil
+}
+
+// writeAck writes an acknowledgement, a connection which fails to be written is
+// lost as if it has failed to be read.
+func (s *transferStream) writeAck(conn *countingPeer, frameType byte, offset int64) {
+	s.wmx.Lock()
+	defer s.wmx.Unlock()
+
+	if err := writeFrame(conn, frameType, offset); err != nil {
+		s.lose(conn, err)
+	}
+}
+
+// finish reads data a consumer may have left unread and verifies it, tells a
+// sender that a file is stored once a consumer has stored it, and waits for a
+// sender to close a connection for finishWait at most. A consumer which fails
+// aborts a stream instead (see: abort()).
+func (s *transferStream) finish() error {
+	if _, err := io.Copy(io.Discard, s); err != nil {
+		return err
+	}
+
+	conn, _ := s.current()
+	if conn == nil {
+		return nil
+	}
+
+	s.mx.Lock()
+	received := s.received
+	s.mx.Unlock()
+
+	s.writeAck(conn, frameDone, received)
+
+	closed := s.connClosed
+
+	if closed == nil {
+		closed = make(chan struct{})
+
+		go s.drain(conn, closed)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(finishWait):
+	}
+
+	return nil
+}
+
+// drain reads conn until it fails and closes closed then.
+func (s *transferStream) drain(conn *countingPeer, closed chan struct{}) {
+	defer close(closed)
+
+	buf := make([]byte, maxMessageSize)
+
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+// resumable tells whether a transfer has started, still needs a connection and
+// can be resumed over another one.
+func (s *transferStream) resumable() bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.timeout != 0 && s.attached && s.err == nil && !s.done && !s.eof
+}
+
+// disableResume makes a transfer fail at once if its connection is lost, since
+// the other peer wouldn't resume it.
+func (s *transferStream) disableResume() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.timeout = 0
+}
+
+// offset returns an amount of data read by a receiver.
+func (s *transferStream) offset() int64 {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.received - int64(len(s.buf))
+}
+
+// connection returns the current connection, it waits for one to be attached if
+// there is none.
+func (s *transferStream) connection() (*countingPeer, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for s.conn == nil && s.err == nil {
+		s.cond.Wait()
+	}
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return s.conn, nil
+}
+
+// Sum returns a SHA-256 digest of all data of a stream, once a sender has closed
+// it or a receiver has verified its end.
+func (s *transferStream) Sum() []byte {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.sum
+}
+
+func (s *transferStream) current() (*countingPeer, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.conn, s.err
+}
+
+// lose drops a connection which has failed, a transfer fails at once unless
+// ResumeTimeout is set, or waits for another connection for it otherwise.
+func (s *transferStream) lose(conn *countingPeer, err error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.conn != conn || s.err != nil || s.done {
+		return
+	}
+
+	s.conn = nil
+	s.losses++
+
+	conn.Shutdown()
+
+	if s.timeout == 0 {
+		s.err = errors.Wrap(ErrConnectionLost, err.Error())
+		s.cond.Broadcast()
+
+		return
+	}
+
+	s.log.Error(errors.Wrap(err, "connection lost, waiting for it to be resumed"))
+
+	losses := s.losses
+
+	time.AfterFunc(s.timeout, func() {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+
+		if s.conn == nil && s.losses == losses && s.err == nil {
+			s.err = errors.Wrapf(ErrConnectionLost, "%s (not resumed within %s)", err, s.timeout)
+			s.cond.Broadcast()
+		}
+	})
+}
+
+// fail fails a transfer with err unless it has already failed, and returns an
+// error it has failed with.
+func (s *transferStream) fail(err error) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.err == nil {
+		s.err = err
+		s.cond.Broadcast()
+	}
+
+	return s.err
+}
+
+// abort tells the other peer that a transfer has failed with err and shuts the
+// current connection down. A sender waits for a receiver to hang up for
+// finishWait at most first, so that a reason isn't lost behind data which is
+// still on its way.
+func (s *transferStream) abort(err error) {
+	s.fail(err)
+
+	reason := err.Error()
+	if len(reason) > maxAbortReason {
+		reason = reason[:maxAbortReason]
+	}
+
+	s.wmx.Lock()
+
+	conn, _ := s.current()
+	if conn != nil {
+		conn.Write(append([]byte{frameAbort}, reason...))
+	}
+
+	s.wmx.Unlock()
+
+	if conn == nil {
+		return
+	}
+
+	s.mx.Lock()
+	acksRead := s.acksRead
+	s.mx.Unlock()
+
+	if s.role == RoleSender && acksRead != nil {
+		select {
+		case <-acksRead:
+		case <-time.After(finishWait):
+		}
+	}
+
+	conn.Shutdown()
+}
+
+// shutdown shuts the current connection down once a transfer ends.
+func (s *transferStream) shutdown() {
+	if conn, _ := s.current(); conn != nil {
+		conn.Shutdown()
+	}
+}
+
+// writeChunk writes a chunk of data at offset.
+func writeChunk(w io.Writer, offset int64, data []byte) error {
+	frame := make([]byte, chunkHeaderLen, chunkHeaderLen+len(data))
+	frame[0] = frameData
+	binary.BigEndian.PutUint64(frame[1:], uint64(offset/chunkSize))
+	binary.BigEndian.PutUint32(frame[frameHeaderLen:], crc32.Checksum(data, crcTable))
+
+	_, err := w.Write(append(frame, data...))
+
+	return err
+}
+
+// writeEnd writes an end of a transfer stream at offset with a digest of its
+// data.
+func writeEnd(w io.Writer, offset int64, sum []byte) error {
+	frame := make([]byte, frameHeaderLen, frameHeaderLen+len(sum))
+	frame[0] = frameEnd
+	binary.BigEndian.PutUint64(frame[1:], uint64(offset))
+
+	_, err := w.Write(append(frame, sum...))
+
+	return err
+}
+
+// writeFrame writes a frame of an offset.
+func writeFrame(w io.Writer, frameType byte, offset int64) error {
+	frame := make([]byte, frameHeaderLen)
+	frame[0] = frameType
+	binary.BigEndian.PutUint64(frame[1:], uint64(offset))
+
+	_, err := w.Write(frame)
+
+	return err
+}
+
+// Resume carries on a transfer which has lost its connection over peer, which
+// is connected to the same other peer again. It must be called before peer is
+// established, and a transfer fails unless it's resumed within ResumeTimeout.
+func (m *Backupper) Resume(peer Peer) {
+	conn := m.peer.with(limitPeer(peer, m.cfg))
+	binder, _ := peer.(ChannelBinder)
+
+	conn.OnEstablish(func() {
+		m.onResume(conn, binder)
+	})
+}
+
+// Resumable tells whether a transfer is in the middle of data, so that it can be
+// resumed once its connection is lost (see: Resume()).
+func (m *Backupper) Resumable() bool {
+	return m.stream.resumable()
+}
+
+func (m *Backupper) onResume(conn *countingPeer, binder ChannelBinder) {
+	err := m.authenticate(conn, binder)
+	if err != nil {
+		err = errors.Wrap(err, "authentication")
+	} else {
+		err = m.handshake(conn, false)
+	}
+
+	if err != nil {
+		m.log.Error(errors.Wrap(err, "resume"))
+
+		conn.Shutdown()
+	}
+}
+
+// handshake agrees on the transfer protocol (see: negotiate()) and on a transfer
+// a connection carries, and attaches it to a transfer stream. Signatures and a
+// generation of a previous version are exchanged only once a transfer starts
+// (see: requestSignatures() and requestBase()), and so is an index of stored
+// chunks (see: requestChunks()).
+func (m *Backupper) handshake(conn *countingPeer, fresh bool) (err error) {
+	features, err := m.negotiate(conn)
+	if err != nil {
+		return errors.Wrap(err, "protocol")
+	}
+
+	if fresh {
+		m.features = features
+
+		if !features[featureResume] {
+			m.stream.disableResume()
+		}
+	}
+
+	var offset int64
+
+	if m.result.Role == RoleSender {
+		offset, err = m.sendHello(conn, fresh)
+	} else {
+		err = m.receiveHello(conn, fresh)
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "handshake")
+	}
+
+	// A requested source entry is known before anything else is done of it.
+	if fresh && (len(m.cfg.Sources) != 0 || len(m.cfg.Pull) != 0) {
+		if m.result.Role == RoleSender {
+			err = m.serveRequest()
+		} else {
+			err = m.requestEntry()
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "pull request")
+		}
+	}
+
+	if fresh && m.cfg.Delta {
+		if m.result.Role == RoleSender {
+			err = m.requestSignatures()
+		} else {
+			err = m.sendSignatures()
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "signatures")
+		}
+	}
+
+	if fresh && m.cfg.Dedup {
+		if m.result.Role == RoleSender {
+			err = m.requestChunks()
+		} else {
+			err = m.sendChunkIndex()
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "chunk index")
+		}
+	}
+
+	if fresh && m.cfg.Incremental {
+		if m.result.Role == RoleSender {
+			err = m.requestBase()
+		} else {
+			err = m.sendBase()
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "incremental backup")
+		}
+	}
+
+	if fresh && m.cfg.AnnounceSize {
+		if m.result.Role == RoleSender {
+			err = m.announceSize()
+		} else {
+			err = m.checkSize()
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "transfer size")
+		}
+	}
+
+	if fresh {
+		m.stream.setLanes(m.lanes())
+	}
+
+	return m.stream.attach(conn, offset)
+}
@@ -0,0 +1,290 @@
+package filemanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+// versionsJournalExt is an extension of a hidden file next to a stored file
+// which lists times its versions were received at (see: versionsJournal).
+const versionsJournalExt = ".versions"
+
+// Retention keeps versions of a stored file by their age rather than a number
+// of them (see: retainFileVersions()), grandfather-father-son style: the Last
+// versions are kept along with the newest version of each of the last Daily
+// days, Weekly weeks and Monthly months which have versions. Periods are of a
+// local time of a receiver, and weeks are ISO ones starting on Monday.
+type Retention struct {
+	Last    int
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
+// ParseRetention parses a policy presented as a comma-separated list of
+// "${period}=${count}", where a period is either "last", "daily", "weekly" or
+// "monthly", e.g. "last=3,daily=7,weekly=4,monthly=12".
+func ParseRetention(s string) (Retention, error) {
+	var r Retention
+
+	for _, p := range strings.Split(s, ",") {
+		period, count, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if !ok {
+			return r, errors.Errorf("retention %q: ${period}=${count} expected", s)
+		}
+
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 0 {
+			return r, errors.Errorf("retention %q: non-negative count of %s expected", s, period)
+		}
+
+		switch period {
+		case "last":
+			r.Last = n
+		case "daily":
+			r.Daily = n
+		case "weekly":
+			r.Weekly = n
+		case "monthly":
+			r.Monthly = n
+		default:
+			return r, errors.Errorf("retention %q: unknown period %q", s, period)
+		}
+	}
+
+	return r, r.validate()
+}
+
+func (r Retention) validate() error {
+	if r.Last < 0 || r.Daily < 0 || r.Weekly < 0 || r.Monthly < 0 {
+		return errors.New("retention count is negative")
+	}
+
+	if r.Last+r.Daily+r.Weekly+r.Monthly == 0 {
+		return errors.New("retention keeps no versions")
+	}
+
+	return nil
+}
+
+func (r Retention) String() string {
+	return fmt.Sprintf("last=%d,daily=%d,weekly=%d,monthly=%d", r.Last, r.Daily, r.Weekly, r.Monthly)
+}
+
+// keep tells which of versions received at times, the newest first, are kept.
+// The newest one is always kept as long as any count is positive.
+func (r Retention) keep(times []time.Time) []bool {
+	kept := make([]bool, len(times))
+
+	for i := 0; i < len(times) && i < r.Last; i++ {
+		kept[i] = true
+	}
+
+	keepPeriods(times, kept, r.Daily, func(t time.Time) int {
+		y, m, d := t.Date()
+
+		return (y*100+int(m))*100 + d
+	})
+
+	keepPeriods(times, kept, r.Weekly, func(t time.Time) int {
+		y, w := t.ISOWeek()
+
+		return y*100 + w
+	})
+
+	keepPeriods(times, kept, r.Monthly, func(t time.Time) int {
+		y, m, _ := t.Date()
+
+		return y*100 + int(m)
+	})
+
+	return kept
+}
+
+// keepPeriods marks the newest of times within each of n periods which have
+// any of them as kept.
+func keepPeriods(times []time.Time, kept []bool, n int, period func(time.Time) int) {
+	last := 0
+
+	for i, t := range times {
+		if n == 0 {
+			return
+		}
+
+		p := period(t.Local())
+		if i != 0 && p == last {
+			continue
+		}
+
+		kept[i] = true
+		last = p
+		n--
+	}
+}
+
+// versionsJournal lists times versions of a stored file were received at, by
+// their numbers, since a modification time of a file may be restored from a
+// sender (see: restoreMeta()). It's kept only under Retention.
+type versionsJournal struct {
+	ReceivedAt []time.Time `json:"received_at"`
+}
+
+// versionSlot is a version number of a stored file, there may be no version
+// of an escrowed key of a backup under a number (see: saveEscrow()).
+type versionSlot struct {
+	receivedAt time.Time
+	exists     bool
+}
+
+// versionName returns a name of a version of a stored file named name.
+func versionName(name string, version int) string {
+	if version == 0 {
+		return name
+	}
+
+	return name + fmt.Sprintf(".%d", version)
+}
+
+// retainFileVersions makes room for a new version of a stored file named name
+// (see: Storage) under Retention. Versions the policy doesn't keep along with
+// the new one are removed, and the rest are renumbered after it. The new one is
+// taken as received when a transfer started, so that an escrowed key of a
+// backup gets the same versions as the backup does.
+func (m *Backupper) retainFileVersions(name string, tree bool) {
+	// Retention requires DirStorage (see: ValidateConfig()).
+	dir := m.storage.(DirStorage)
+
+	journalPath := versionsJournalPath(dir.Location(name))
+
+	var journal versionsJournal
+
+	if b, err := os.ReadFile(journalPath); err == nil {
+		if err := json.Unmarshal(b, &journal); err != nil {
+			m.log.Error(errors.Wrap(err, "versions journal"))
+		}
+	} else if !os.IsNotExist(err) {
+		m.log.Error(err)
+	}
+
+	var slots []versionSlot
+
+	for i := 0; ; i++ {
+		exists, err := m.storage.Exists(versionName(name, i))
+		if err != nil {
+			m.log.Error(err)
+		}
+
+		if i < len(journal.ReceivedAt) {
+			slots = append(slots, versionSlot{receivedAt: journal.ReceivedAt[i], exists: exists})
+
+			continue
+		}
+
+		if !exists {
+			break
+		}
+
+		// A version received before Retention was set is as old as its file.
+		var receivedAt time.Time
+
+		if fi, err := os.Lstat(dir.Location(versionName(name, i))); err == nil {
+			receivedAt = fi.ModTime()
+		}
+
+		slots = append(slots, versionSlot{receivedAt: receivedAt, exists: true})
+	}
+
+	receivedAt := m.result.StartedAt
+	if receivedAt.IsZero() {
+		receivedAt = time.Now()
+	}
+
+	times := []time.Time{receivedAt}
+
+	for _, s := range slots {
+		times = append(times, s.receivedAt)
+	}
+
+	kept := m.cfg.Retention.keep(times)
+
+	type move struct {
+		from, to int
+	}
+
+	var (
+		down, up []move
+		keptAt   = []time.Time{receivedAt}
+	)
+
+	for i, s := range slots {
+		if !kept[i+1] {
+			if s.exists {
+				m.log.WithFields(log.Fields{
+					log.FieldFile:    m.storage.Location(versionName(name, i)),
+					log.FieldVersion: i,
+				}).Debug("removing file version by retention policy")
+
+				if err := m.removeStored(versionName(name, i), tree); err != nil {
+					m.log.Error(err)
+				}
+			}
+
+			continue
+		}
+
+		keptAt = append(keptAt, s.receivedAt)
+
+		if !s.exists {
+			continue
+		}
+
+		switch to := len(keptAt) - 1; {
+		case to < i:
+			down = append(down, move{from: i, to: to})
+		case to > i:
+			up = append(up, move{from: i, to: to})
+		}
+	}
+
+	// Versions before the first removed one are shifted up into its place and
+	// the rest are moved down to fill gaps, so that no version is renamed onto
+	// another one: moves down go from the newest and moves up from the oldest.
+	for i := len(up) - 1; i >= 0; i-- {
+		down = append(down, up[i])
+	}
+
+	for _, mv := range down {
+		m.log.WithFields(log.Fields{
+			log.FieldFile:    m.storage.Location(versionName(name, mv.from)),
+			log.FieldVersion: mv.to,
+		}).Debug("shifting file version")
+
+		if err := m.storage.Rename(versionName(name, mv.from), versionName(name, mv.to)); err != nil {
+			m.log.Error(err)
+		}
+	}
+
+	b, err := json.Marshal(&versionsJournal{ReceivedAt: keptAt})
+	if err == nil {
+		err = os.WriteFile(journalPath, b, 0664)
+	}
+
+	if err != nil {
+		m.log.Error(errors.Wrap(err, "versions journal"))
+	}
+}
+
+// versionsJournalPath returns a path of a journal of versions of a file stored
+// as path.
+func versionsJournalPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+versionsJournalExt)
+}
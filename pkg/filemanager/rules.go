@@ -0,0 +1,459 @@
+package filemanager
+
+import (
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"distributed-backup/pkg/log"
+
+	"github.com/TelenLiu/go-zip"
+	"github.com/pkg/errors"
+)
+
+// Actions of a file rule (see: ParseFileRule()).
+const (
+	FileActionSkip  = "skip"
+	FileActionStore = "store"
+	FileActionLevel = "level"
+	FileActionPlain = "plain"
+)
+
+// DefaultStoreExtensions are extensions of names of files which are usually
+// compressed already, so that compressing them again takes time for nothing
+// (see: BackupperConfig.StoreExtensions).
+var DefaultStoreExtensions = []string{
+	"jpg", "jpeg", "png", "gif", "webp", "heic", "avif",
+	"mp3", "aac", "m4a", "ogg", "opus", "flac",
+	"mp4", "m4v", "mkv", "mov", "avi", "webm",
+	"zip", "gz", "tgz", "bz2", "xz", "zst", "7z", "rar",
+	"jar", "apk", "docx", "xlsx", "pptx", "odt", "ods", "odp", "epub",
+}
+
+// levelMethodBase is a base of private compression method IDs go-zip deflates
+// entries with at levels from 0 to 9, since it has a single compressor of the
+// deflate method. Entries are presented as deflated in headers anyway (see:
+// innerWriter).
+const levelMethodBase = 0xdb00
+
+func init() {
+	for level := flate.NoCompression; level <= flate.BestCompression; level++ {
+		level := level
+
+		zip.RegisterCompressor(levelMethodBase+uint16(level), func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		})
+	}
+}
+
+// FileRule controls how files of a source directory which match it are archived.
+// A file matches a rule if it matches any of Globs (if set) and all of the other
+// conditions.
+type FileRule struct {
+	// Globs are patterns of a slash-separated path relative to a source
+	// directory (see: path.Match()), a pattern without a slash is matched against
+	// a file name.
+	Globs []string
+	// Larger and Smaller bound a file size in bytes exclusively if set.
+	Larger  *int64
+	Smaller *int64
+	// MIME is a media type of file content sniffed from its beginning (see:
+	// http.DetectContentType()), it may end with "/*" to match any subtype.
+	MIME string
+
+	// Skip leaves a file out of an archive.
+	Skip bool
+	// Level is a deflate level from 0 (stored uncompressed) to 9, the default
+	// one is used if it's nil.
+	Level *int
+	// Plain leaves a file unprotected with Password1 in an inner archive, it's
+	// still protected with Password2 by an outer one.
+	Plain bool
+
+	spec string
+}
+
+// ParseFileRule parses a rule presented as "${conditions}=${actions}", both are
+// comma-separated lists. A condition is either "size>${size}", "size<${size}"
+// (e.g. 10MB, 512KiB), "mime:${type}" (e.g. image/*) or a glob. An action is
+// either "skip", "store" (same as "level:0"), "level:${0..9}" or "plain" (no
+// first-level encryption). E.g. "*.jpg,*.mp4,*.zip=store" or "size>1GB=skip".
+func ParseFileRule(s string) (FileRule, error) {
+	r := FileRule{spec: s}
+
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return r, errors.Errorf("rule %q: ${conditions}=${actions} expected", s)
+	}
+
+	for _, cond := range strings.Split(s[:i], ",") {
+		cond = strings.TrimSpace(cond)
+
+		switch {
+		case len(cond) == 0:
+			return r, errors.Errorf("rule %q: empty condition", s)
+		case strings.HasPrefix(cond, "size>"), strings.HasPrefix(cond, "size<"):
+			size, err := ParseSize(cond[len("size>"):])
+			if err != nil {
+				return r, errors.Wrapf(err, "rule %q", s)
+			}
+
+			if cond[4] == '>' {
+				r.Larger = &size
+			} else {
+				r.Smaller = &size
+			}
+		case strings.HasPrefix(cond, "mime:"):
+			r.MIME = strings.ToLower(strings.TrimPrefix(cond, "mime:"))
+
+			if !strings.Contains(r.MIME, "/") {
+				return r, errors.Errorf("rule %q: media type %q expected as type/subtype", s, r.MIME)
+			}
+		default:
+			if _, err := path.Match(cond, ""); err != nil {
+				return r, errors.Errorf("rule %q: malformed glob %q", s, cond)
+			}
+
+			r.Globs = append(r.Globs, cond)
+		}
+	}
+
+	for _, action := range strings.Split(s[i+1:], ",") {
+		action = strings.TrimSpace(action)
+
+		switch {
+		case action == FileActionSkip:
+			r.Skip = true
+		case action == FileActionStore:
+			level := flate.NoCompression
+			r.Level = &level
+		case action == FileActionPlain:
+			r.Plain = true
+		case strings.HasPrefix(action, FileActionLevel+":"):
+			level, err := strconv.Atoi(strings.TrimPrefix(action, FileActionLevel+":"))
+			if err != nil || level < flate.NoCompression || level > flate.BestCompression {
+				return r, errors.Errorf("rule %q: level from 0 to 9 expected", s)
+			}
+
+			r.Level = &level
+		default:
+			return r, errors.Errorf("rule %q: unknown action %q", s, action)
+		}
+	}
+
+	return r, nil
+}
+
+func (r FileRule) String() string {
+	return r.spec
+}
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  float64
+}{
+	// Longer suffixes go first so that "MiB" isn't taken for "B".
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"TiB", 1 << 40},
+	{"KB", 1e3},
+	{"kB", 1e3},
+	{"MB", 1e6},
+	{"GB", 1e9},
+	{"TB", 1e12},
+	{"B", 1},
+}
+
+// ParseSize parses a size in bytes with an optional unit (e.g. "10MB", "512KiB").
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	unit := 1.0
+
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			unit = u.bytes
+
+			break
+		}
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, errors.Errorf("size %q: non-negative number expected", s)
+	}
+
+	return int64(v * unit), nil
+}
+
+// match tells whether a file at a slash-separated relPath matches a rule. Its
+// content type is sniffed by contentType only if a rule has a MIME condition.
+func (r *FileRule) match(relPath string, fi fs.FileInfo, contentType func() string) bool {
+	if len(r.Globs) != 0 && !r.matchGlob(relPath) {
+		return false
+	}
+
+	if r.Larger != nil && fi.Size() <= *r.Larger {
+		return false
+	}
+
+	if r.Smaller != nil && fi.Size() >= *r.Smaller {
+		return false
+	}
+
+	if len(r.MIME) != 0 {
+		t := contentType()
+
+		if strings.HasSuffix(r.MIME, "/*") {
+			return strings.HasPrefix(t, strings.TrimSuffix(r.MIME, "*"))
+		}
+
+		return t == r.MIME
+	}
+
+	return true
+}
+
+func (r *FileRule) matchGlob(relPath string) bool {
+	for _, glob := range r.Globs {
+		name := relPath
+		if !strings.Contains(glob, "/") {
+			name = path.Base(relPath)
+		}
+
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fileRule returns the first of FileRules a file of a source directory matches,
+// or nil if there is none.
+func (m *Backupper) fileRule(path, relPath string, fi fs.FileInfo) *FileRule {
+	var sniffed *string
+
+	contentType := func() string {
+		if sniffed == nil {
+			t := sniffContentType(path)
+			sniffed = &t
+
+			m.log.WithFields(log.Fields{
+				log.FieldFile: relPath,
+				log.FieldType: t,
+			}).Trace("content type sniffed")
+		}
+
+		return *sniffed
+	}
+
+	for i := range m.cfg.FileRules {
+		if r := &m.cfg.FileRules[i]; r.match(relPath, fi, contentType) {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// sniffContentType returns a media type of a file without parameters, a file
+// which can't be read is taken for binary data.
+func sniffContentType(path string) string {
+	const binary = "application/octet-stream"
+
+	f, err := os.Open(path)
+	if err != nil {
+		return binary
+	}
+	defer f.Close()
+
+	buf := make([]byte, 512)
+
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return binary
+	}
+
+	t, _, _ := strings.Cut(http.DetectContentType(buf[:n]), ";")
+
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+// innerWriter writes an inner archive, entries of which are deflated at levels
+// chosen by file rules and by workers concurrently if there are more than one.
+// go-zip writes a local header of such an entry with a private method ID of a
+// level (see: levelMethodBase, parallelMethodBase), which is held back and
+// rewritten before it reaches an underlying writer, and a central directory
+// header is written with the deflate method set back after an entry is created.
+// The method of an entry protected with AES is the one of its extra field.
+type innerWriter struct {
+	*zip.Writer
+	w       *headerWriter
+	workers int
+}
+
+func newInnerWriter(w io.Writer, workers int) *innerWriter {
+	hw := &headerWriter{Writer: w}
+
+	return &innerWriter{
+		Writer:  zip.NewWriter(hw),
+		w:       hw,
+		workers: workers,
+	}
+}
+
+// CreateLevelHeader creates an entry deflated at level, or at the default one if
+// it's nil.
+func (z *innerWriter) CreateLevelHeader(fh *zip.FileHeader, level *int) (io.Writer, error) {
+	if fh.Method != zip.Deflate {
+		return z.CreateHeader(fh)
+	}
+
+	var method uint16
+
+	switch {
+	case z.workers > 1 && (level == nil || *level != flate.NoCompression):
+		l := flate.DefaultCompression
+
+		if level != nil {
+			l = *level
+		}
+
+		method = parallelMethod(l, z.workers)
+	case level != nil:
+		method = levelMethodBase + uint16(*level)
+	default:
+		return z.CreateHeader(fh)
+	}
+
+	// Data written so far passes through, so that only a previous entry's
+	// trailer and a header are held.
+	if err := z.Flush(); err != nil {
+		return nil, err
+	}
+
+	fh.Method = method
+	z.w.hold = true
+
+	w, err := z.CreateHeader(fh)
+
+	if fh.Method == zipMethodAES {
+		setZipAESMethod(fh.Extra, zip.Deflate)
+	} else {
+		fh.Method = zip.Deflate
+	}
+
+	if err == nil {
+		err = z.Flush()
+	}
+
+	if err == nil {
+		// A header is the last data written, its content is written once the
+		// first data of an entry is.
+		err = z.w.release(zipLocalHeaderLen + len(fh.Name) + len(fh.Extra))
+	}
+
+	return w, err
+}
+
+// headerWriter holds data written through it while hold is set, so that a local
+// file header can be rewritten (see: release()).
+type headerWriter struct {
+	io.Writer
+	hold bool
+	held []byte
+}
+
+func (w *headerWriter) Write(p []byte) (int, error) {
+	if w.hold {
+		w.held = append(w.held, p...)
+
+		return len(p), nil
+	}
+
+	return w.Writer.Write(p)
+}
+
+// release presents a local file header which is the last n held bytes as one of
+// a deflated entry and writes held data.
+func (w *headerWriter) release(n int) error {
+	held := w.held
+
+	w.hold = false
+	w.held = nil
+
+	if len(held) < n || binary.LittleEndian.Uint32(held[len(held)-n:]) != zipLocalSignature {
+		return errors.New("zip: local file header expected")
+	}
+
+	header := held[len(held)-n:]
+
+	if binary.LittleEndian.Uint16(header[8:]) == zipMethodAES {
+		setZipAESMethod(header[zipLocalHeaderLen+int(binary.LittleEndian.Uint16(header[26:])):], zip.Deflate)
+	} else {
+		binary.LittleEndian.PutUint16(header[8:], zip.Deflate)
+	}
+
+	_, err := w.Writer.Write(held)
+
+	return err
+}
+
+// setZipAESMethod sets a compression method of an AES extra field found among
+// extra fields.
+func setZipAESMethod(extra []byte, method uint16) {
+	for len(extra) >= 4 {
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+
+		if size > len(extra)-4 {
+			return
+		}
+
+		if binary.LittleEndian.Uint16(extra) == zipAESExtraID && size >= 7 {
+			binary.LittleEndian.PutUint16(extra[9:], method)
+
+			return
+		}
+
+		extra = extra[4+size:]
+	}
+}
+
+// fileLevel returns a deflate level a file of a source directory is archived at:
+// the one of a rule it matches, no compression if it has one of
+// StoreExtensions, or Level.
+func (m *Backupper) fileLevel(relPath string, rule *FileRule) *int {
+	if rule != nil && rule.Level != nil {
+		return rule.Level
+	}
+
+	if ext := strings.TrimPrefix(path.Ext(relPath), "."); len(ext) != 0 {
+		for _, e := range m.cfg.StoreExtensions {
+			if strings.EqualFold(strings.TrimPrefix(e, "."), ext) {
+				level := flate.NoCompression
+
+				return &level
+			}
+		}
+	}
+
+	return m.cfg.Level
+}
+
+func (m *Backupper) addSkippedStats(size int64) {
+	m.resultMx.Lock()
+	defer m.resultMx.Unlock()
+
+	m.result.Stats.SkippedFiles++
+	m.result.Stats.SkippedBytes += size
+
+	m.peer.meter.done.Add(size)
+}
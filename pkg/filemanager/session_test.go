@@ -0,0 +1,472 @@
+package filemanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/peer"
+	"distributed-backup/pkg/signal"
+
+	"github.com/pkg/errors"
+)
+
+// randomFileSize is a size of a file sent by tests of sessions, it's a few
+// times as big as data a receiver acknowledges at once.
+const randomFileSize = 4 << 20
+
+// droppingPeer runs drop once data read from it reaches a half of
+// randomFileSize, as if a network were lost in the middle of a transfer.
+type droppingPeer struct {
+	*peer.WebRTC
+
+	drop func()
+	once sync.Once
+	read atomic.Int64
+}
+
+func (p *droppingPeer) Read(payload []byte) (int, error) {
+	n, err := p.WebRTC.Read(payload)
+
+	if p.read.Add(int64(n)) >= randomFileSize/2 {
+		p.once.Do(p.drop)
+	}
+
+	return n, err
+}
+
+// corruptingPeer flips the last byte of a message read from it once data read
+// reaches a half of randomFileSize, as if a chunk were corrupted. With digest
+// set, it flips the last byte of an end of a transfer stream instead, which is
+// of a digest of its data ("E${offset}${sha256}").
+type corruptingPeer struct {
+	*peer.WebRTC
+
+	digest bool
+	once   sync.Once
+	read   atomic.Int64
+}
+
+func (p *corruptingPeer) Read(payload []byte) (int, error) {
+	n, err := p.WebRTC.Read(payload)
+
+	if p.digest {
+		if n == 1+8+sha256.Size && payload[0] == 'E' {
+			payload[n-1] ^= 0xff
+		}
+
+		return n, err
+	}
+
+	if n != 0 && p.read.Add(int64(n)) >= randomFileSize/2 {
+		p.once.Do(func() {
+			payload[n-1] ^= 0xff
+		})
+	}
+
+	return n, err
+}
+
+// newRandomFile writes a file of randomFileSize random bytes to a temporary
+// directory of a test. Peers of a session are connected over the network
+// stack, so a test is skipped in short mode.
+func newRandomFile(t *testing.T) (string, []byte) {
+	t.Helper()
+
+	if testing.Short() {
+		t.Skip("peers are connected over the network stack")
+	}
+
+	data := make([]byte, randomFileSize)
+
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "random.bin")
+
+	if err := os.WriteFile(path, data, 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	return path, data
+}
+
+// newTestPeers makes a receiver's and a sender's peers negotiating through the
+// in-memory signaling, which is listened to until ctx is done. Peers are closed
+// once a test finishes.
+func newTestPeers(t *testing.T, ctx context.Context, wg *sync.WaitGroup, receiverLog, senderLog log.Logger) (*peer.WebRTC, *peer.WebRTC) {
+	t.Helper()
+
+	receiverSignal, senderSignal := signal.NewMemoryPair()
+
+	listenTestSignals(ctx, wg, receiverSignal, senderSignal)
+
+	receiverPeer, err := peer.NewWebRTC(peer.WebRTCConfig{Log: receiverLog}, receiverSignal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(receiverPeer.Close)
+
+	senderPeer, err := peer.NewWebRTC(peer.WebRTCConfig{Log: senderLog}, senderSignal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(senderPeer.Close)
+
+	return receiverPeer, senderPeer
+}
+
+// newTestSession returns a context of a session of a test along with a group
+// of goroutines listening to signaling, which is waited for once the context
+// is canceled at the end of a test.
+func newTestSession(t *testing.T) (context.Context, *sync.WaitGroup) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+
+	var wg sync.WaitGroup
+
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	return ctx, &wg
+}
+
+// assertResults checks that transfers of managers have succeeded.
+func assertResults(t *testing.T, managers ...*Backupper) {
+	t.Helper()
+
+	for _, m := range managers {
+		if r := m.Result(); r.Err != nil {
+			t.Fatalf("%s: %v", r.Role, r.Err)
+		}
+	}
+}
+
+// assertReceivedFile checks that a file named after path is received into
+// dstDir with data.
+func assertReceivedFile(t *testing.T, dstDir, path string, data []byte) {
+	t.Helper()
+
+	received, err := os.ReadFile(filepath.Join(dstDir, filepath.Base(path)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(received, data) {
+		t.Error("received file differs from sent one")
+	}
+}
+
+// TestResume drops connections of peers in the middle of a transfer of a
+// random file, resumes the transfer over new ones and checks a received file.
+func TestResume(t *testing.T) {
+	srcFile, data := newRandomFile(t)
+	dstDir := t.TempDir()
+
+	ctx, wg := newTestSession(t)
+
+	receiverLog := log.WithField(log.FieldRole, RoleReceiver)
+	senderLog := log.WithField(log.FieldRole, RoleSender)
+
+	receiverPeer, senderPeer := newTestPeers(t, ctx, wg, receiverLog, senderLog)
+
+	dropped := make(chan struct{})
+
+	receiver, err := NewBackupper(BackupperConfig{
+		DestinationDir: dstDir,
+		AuthSecret:     testAuthSecret,
+		ResumeTimeout:  30 * time.Second,
+		Log:            receiverLog,
+	}, &droppingPeer{
+		WebRTC: receiverPeer,
+		drop: func() {
+			receiverPeer.Close()
+			senderPeer.Close()
+			close(dropped)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := NewBackupper(BackupperConfig{
+		SourceEntry:   srcFile,
+		AuthSecret:    testAuthSecret,
+		ResumeTimeout: 30 * time.Second,
+		Log:           senderLog,
+	}, senderPeer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dialTestPeers(ctx, receiverPeer, senderPeer); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-dropped:
+	case <-sender.Done():
+		t.Fatal("transfer finished before connection was dropped")
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+
+	newReceiverPeer, newSenderPeer := newTestPeers(t, ctx, wg, receiverLog, senderLog)
+
+	receiver.Resume(newReceiverPeer)
+	sender.Resume(newSenderPeer)
+
+	if err := dialTestPeers(ctx, newReceiverPeer, newSenderPeer, sender, receiver); err != nil {
+		t.Fatal(err)
+	}
+
+	assertResults(t, sender, receiver)
+	assertReceivedFile(t, dstDir, srcFile, data)
+}
+
+// TestSync swaps random files between two peers of two-way sync over a single
+// connection and checks files each of them has received.
+func TestSync(t *testing.T) {
+	var (
+		srcFiles [2]string
+		data     [2][]byte
+		dstDirs  [2]string
+	)
+
+	for i := range srcFiles {
+		srcFiles[i], data[i] = newRandomFile(t)
+		dstDirs[i] = t.TempDir()
+	}
+
+	ctx, wg := newTestSession(t)
+
+	peerLogs := [2]log.Logger{log.WithField(log.FieldInstanceID, "a"), log.WithField(log.FieldInstanceID, "b")}
+
+	peerA, peerB := newTestPeers(t, ctx, wg, peerLogs[0], peerLogs[1])
+
+	var managers [2]*Backupper
+
+	for i, p := range []Peer{peerA, peerB} {
+		var err error
+
+		managers[i], err = NewBackupper(BackupperConfig{
+			SourceEntry:    srcFiles[i],
+			DestinationDir: dstDirs[i],
+			AuthSecret:     testAuthSecret,
+			Sync:           true,
+			Log:            peerLogs[i],
+		}, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := dialTestPeers(ctx, peerA, peerB, managers[:]...); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, m := range managers {
+		r := m.Result()
+
+		if r.Err != nil {
+			t.Fatalf("peer %d: %v", i, r.Err)
+		}
+
+		if r.Role != RoleSync || r.Reverse == nil {
+			t.Fatalf("peer %d: result of role %q isn't one of sync", i, r.Role)
+		}
+
+		assertReceivedFile(t, dstDirs[i], srcFiles[1-i], data[1-i])
+	}
+}
+
+// TestPull serves two random files, pulls one of them by its name and checks
+// it, and makes sure that a request of a name which isn't served is refused.
+func TestPull(t *testing.T) {
+	sources := make(map[string]string)
+
+	var data []byte
+
+	for _, name := range []string{"first", "second"} {
+		sources[name], data = newRandomFile(t)
+	}
+
+	dstDir := t.TempDir()
+
+	ctx, wg := newTestSession(t)
+
+	for _, pull := range []string{"second", "third"} {
+		receiverLog := log.WithField(log.FieldRole, RoleReceiver)
+		senderLog := log.WithField(log.FieldRole, RoleSender)
+
+		receiverPeer, senderPeer := newTestPeers(t, ctx, wg, receiverLog, senderLog)
+
+		receiver, err := NewBackupper(BackupperConfig{
+			DestinationDir: dstDir,
+			Pull:           pull,
+			AuthSecret:     testAuthSecret,
+			Log:            receiverLog,
+		}, receiverPeer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sender, err := NewBackupper(BackupperConfig{
+			Sources:    sources,
+			AuthSecret: testAuthSecret,
+			Log:        senderLog,
+		}, senderPeer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := dialTestPeers(ctx, receiverPeer, senderPeer, sender, receiver); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := sources[pull]; !ok {
+			if err := receiver.Result().Err; !errors.Is(err, ErrNotServed) {
+				t.Errorf("request of %q which isn't served: %v", pull, err)
+			}
+
+			continue
+		}
+
+		assertResults(t, sender, receiver)
+		assertReceivedFile(t, dstDir, sources[pull], data)
+	}
+}
+
+// TestCancel cancels a receiver in the middle of a transfer of a random file
+// and checks that a sender is told that a transfer is aborted and that nothing
+// of a partially received file is left.
+func TestCancel(t *testing.T) {
+	srcFile, _ := newRandomFile(t)
+	dstDir := t.TempDir()
+
+	ctx, wg := newTestSession(t)
+
+	receiverLog := log.WithField(log.FieldRole, RoleReceiver)
+	senderLog := log.WithField(log.FieldRole, RoleSender)
+
+	receiverPeer, senderPeer := newTestPeers(t, ctx, wg, receiverLog, senderLog)
+
+	var receiver *Backupper
+
+	receiver, err := NewBackupper(BackupperConfig{
+		DestinationDir: dstDir,
+		AuthSecret:     testAuthSecret,
+		Log:            receiverLog,
+	}, &droppingPeer{
+		WebRTC: receiverPeer,
+		drop: func() {
+			go receiver.Cancel()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := NewBackupper(BackupperConfig{
+		SourceEntry: srcFile,
+		AuthSecret:  testAuthSecret,
+		Log:         senderLog,
+	}, senderPeer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dialTestPeers(ctx, receiverPeer, senderPeer, sender, receiver); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := receiver.Result().Err; !errors.Is(err, ErrCanceled) {
+		t.Errorf("receiver hasn't been canceled: %v", err)
+	}
+
+	if err := sender.Result().Err; err == nil || !strings.Contains(err.Error(), ErrCanceled.Error()) {
+		t.Errorf("sender hasn't been told that transfer is canceled: %v", err)
+	}
+
+	entries, err := os.ReadDir(dstDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("%s is left of canceled transfer", entries[0].Name())
+	}
+}
+
+// TestCorruptedTransfer corrupts a chunk of a transfer of a random file, or a
+// digest of its data, and checks that a receiver detects it, quarantines a
+// file and tells a sender of it.
+func TestCorruptedTransfer(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		digest bool
+		err    error
+	}{
+		{"chunk", false, ErrCorruptedChunk},
+		{"digest", true, ErrDigestMismatch},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srcFile, _ := newRandomFile(t)
+			dstDir := t.TempDir()
+
+			ctx, wg := newTestSession(t)
+
+			receiverLog := log.WithField(log.FieldRole, RoleReceiver)
+			senderLog := log.WithField(log.FieldRole, RoleSender)
+
+			receiverPeer, senderPeer := newTestPeers(t, ctx, wg, receiverLog, senderLog)
+
+			receiver, err := NewBackupper(BackupperConfig{
+				DestinationDir: dstDir,
+				Log:            receiverLog,
+			}, &corruptingPeer{WebRTC: receiverPeer, digest: tt.digest})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sender, err := NewBackupper(BackupperConfig{
+				SourceEntry: srcFile,
+				Log:         senderLog,
+			}, senderPeer)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := dialTestPeers(ctx, receiverPeer, senderPeer, sender, receiver); err != nil {
+				t.Fatal(err)
+			}
+
+			r := receiver.Result()
+
+			if !errors.Is(r.Err, tt.err) {
+				t.Fatalf("receiver = %v, want %v", r.Err, tt.err)
+			}
+
+			if len(r.Quarantined) == 0 {
+				t.Error("corrupted file isn't quarantined")
+			}
+
+			if sender.Result().Err == nil {
+				t.Error("sender isn't told of corrupted data")
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package filemanager
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/sevenzip"
+)
+
+// Formats of an archive a source directory is sent in.
+const (
+	FormatZip = "zip"
+	Format7z  = "7z"
+)
+
+// sendSourceDir7z archives a source directory into a single 7z archive, which
+// is compressed with LZMA2 and protected with Password1 (AES-256 encrypts both
+// content and names of files, so there is no second level). The archive is built
+// in a temporary file since its header is written last and referred to from the
+// beginning, and then is sent as a whole.
+func (m *Backupper) sendSourceDir7z(w io.Writer) error {
+	f, err := os.CreateTemp("", "distributed-backup-*.7z")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		f.Close()
+
+		if err := os.Remove(f.Name()); err != nil {
+			m.log.Error(err)
+		}
+	}()
+
+	m.log.WithField(log.FieldDir, m.cfg.SourceEntry).Info("archiving directory")
+
+	z, err := sevenzip.NewWriter(f, m.cfg.Password1)
+	if err != nil {
+		return err
+	}
+
+	err = m.walkSourceDir(func(path, relPath string, fi fs.FileInfo, _ *FileRule) error {
+		m.log.WithField(log.FieldFile, relPath).Debug("archiving file")
+
+		fh := &sevenzip.FileHeader{
+			Name:     filepath.ToSlash(relPath),
+			Modified: fi.ModTime(),
+			Mode:     fi.Mode(),
+		}
+
+		if fi.IsDir() {
+			fh.Name += "/"
+		}
+
+		w, err := z.Create(fh)
+		if err != nil || fi.IsDir() {
+			return err
+		}
+
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.WriteString(w, target)
+
+			return err
+		}
+
+		_, err = m.archiveFile(path, relPath, fi, w)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := z.Close(); err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := m.writeHeader(m.cfg.OutputFilename, nil, w); err != nil {
+		return err
+	}
+
+	m.log.WithField(log.FieldFile, m.cfg.OutputFilename).Info("sending file")
+
+	m.setFilename(m.cfg.OutputFilename)
+
+	n, err := io.Copy(w, f)
+	m.setArchiveBytes(n)
+
+	return err
+}
@@ -0,0 +1,557 @@
+package filemanager
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"distributed-backup/pkg/erasure"
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+// ShardExt is an extension of names of shards of a backup (see: ShardSet).
+const ShardExt = ".shard"
+
+const (
+	// shardMagic starts a shard, which is followed by a header of a set, pieces
+	// of every stripe and a trailer (see: ShardSet).
+	shardMagic = "DBSHARD\x00\x01"
+	// shardPieceSize is a size of a piece of a stripe each shard holds, a stripe
+	// is a piece of data of every data shard.
+	shardPieceSize = 64 << 10
+	// shardTrailerLen is a length of a size and a SHA-256 hash of data.
+	shardTrailerLen = 8 + sha256.Size
+)
+
+var errMalformedShard = errors.New("malformed shard")
+
+// ShardSet is a backup split into n erasure-coded shards any k of which restore
+// it, each one sent to a receiver of its own by a Backupper of the set (see:
+// Shards). A backup is prepared once (see: PrepareShards()) and kept in a
+// temporary directory until the set is removed.
+//
+// Data is cut into stripes of k pieces of shardPieceSize (the last one is padded
+// with zeros), n-k parity pieces of a stripe are computed with a Reed–Solomon
+// code (see: erasure), and a shard is a header followed by a piece of every
+// stripe along with its CRC-32C checksum and a trailer of a size and a SHA-256
+// hash of data. A header holds a random ID of a set, k, n, an index of a shard, a
+// size of pieces and a name of a backup. A piece which fails its checksum is
+// taken for a missing one, so shards may be damaged partly as long as k pieces of
+// every stripe are good.
+type ShardSet struct {
+	code *erasure.Code
+	id   [16]byte
+	// dir holds shards once they're prepared, and name is a name of a backup.
+	dir  string
+	name string
+}
+
+// NewShardSet returns a set of n shards any k of which restore a backup.
+func NewShardSet(k, n int) (*ShardSet, error) {
+	code, err := erasure.New(k, n)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ShardSet{code: code}
+
+	if _, err := rand.Read(s.id[:]); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Remove removes prepared shards.
+func (s *ShardSet) Remove() error {
+	if len(s.dir) == 0 {
+		return nil
+	}
+
+	return os.RemoveAll(s.dir)
+}
+
+func (s *ShardSet) path(index int) string {
+	return filepath.Join(s.dir, strconv.Itoa(index)+ShardExt)
+}
+
+// shardName returns a name a shard of a backup named name is sent as, e.g.
+// "backup.zip.2-of-5.shard".
+func shardName(name string, index, n int) string {
+	return fmt.Sprintf("%s.%d-of-%d%s", name, index+1, n, ShardExt)
+}
+
+// shardHeader is a header of a shard.
+type shardHeader struct {
+	id        [16]byte
+	k, n      int
+	index     int
+	pieceSize int
+	name      string
+}
+
+func (h *shardHeader) marshal() []byte {
+	b := append([]byte(shardMagic), h.id[:]...)
+	b = binary.BigEndian.AppendUint16(b, uint16(h.k))
+	b = binary.BigEndian.AppendUint16(b, uint16(h.n))
+	b = binary.BigEndian.AppendUint16(b, uint16(h.index))
+	b = binary.BigEndian.AppendUint32(b, uint32(h.pieceSize))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(h.name)))
+
+	return append(b, h.name...)
+}
+
+// readShardHeader reads a header of a shard coming from r.
+func readShardHeader(r io.Reader) (*shardHeader, error) {
+	b := make([]byte, len(shardMagic)+16+2*3+4+2)
+
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	if string(b[:len(shardMagic)]) != shardMagic {
+		return nil, errMalformedShard
+	}
+
+	b = b[len(shardMagic):]
+
+	h := &shardHeader{
+		k:         int(binary.BigEndian.Uint16(b[16:])),
+		n:         int(binary.BigEndian.Uint16(b[18:])),
+		index:     int(binary.BigEndian.Uint16(b[20:])),
+		pieceSize: int(binary.BigEndian.Uint32(b[22:])),
+	}
+	copy(h.id[:], b)
+
+	name := make([]byte, binary.BigEndian.Uint16(b[26:]))
+
+	if _, err := io.ReadFull(r, name); err != nil {
+		return nil, err
+	}
+
+	h.name = string(name)
+
+	if h.index >= h.n || h.pieceSize == 0 || len(h.name) == 0 {
+		return nil, errMalformedShard
+	}
+
+	return h, nil
+}
+
+// PrepareShards archives a source entry just like it's sent to Peer and splits
+// it into shards of Shards in a temporary directory, which Backuppers of the
+// set send then (see: sendShard()). Archiving stops once ctx is done.
+func (m *Backupper) PrepareShards(ctx context.Context) error {
+	s := m.cfg.Shards
+
+	dir, err := os.MkdirTemp("", "distributed-backup-shards-")
+	if err != nil {
+		return err
+	}
+
+	s.dir = dir
+
+	pr, pw := io.Pipe()
+	prepared := make(chan struct{})
+
+	go func() {
+		defer close(prepared)
+
+		pw.CloseWithError(m.sendEntry(&contextWriter{ctx: ctx, w: pw}))
+	}()
+
+	err = func() error {
+		name, _, err := m.readHeader(pr)
+		if err != nil {
+			return err
+		}
+
+		m.log.WithFields(log.Fields{
+			log.FieldFile:   name,
+			log.FieldShards: s.code.Shards(),
+		}).Info("splitting file into shards")
+
+		s.name = name
+
+		return s.write(pr)
+	}()
+
+	// Archiving is stopped if splitting fails.
+	pr.CloseWithError(errors.New("splitting is stopped"))
+	<-prepared
+
+	return errors.Wrap(err, "shards")
+}
+
+// write splits data coming from r into shards.
+func (s *ShardSet) write(r io.Reader) error {
+	k, n := s.code.DataShards(), s.code.Shards()
+
+	files := make([]*os.File, n)
+	writers := make([]*bufio.Writer, n)
+
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+
+	for i := range files {
+		f, err := os.Create(s.path(i))
+		if err != nil {
+			return err
+		}
+
+		files[i] = f
+		writers[i] = bufio.NewWriter(f)
+
+		h := shardHeader{id: s.id, k: k, n: n, index: i, pieceSize: shardPieceSize, name: s.name}
+
+		if _, err := writers[i].Write(h.marshal()); err != nil {
+			return err
+		}
+	}
+
+	stripe := make([]byte, n*shardPieceSize)
+	pieces := make([][]byte, n)
+
+	for i := range pieces {
+		pieces[i] = stripe[i*shardPieceSize : (i+1)*shardPieceSize]
+	}
+
+	var (
+		size int64
+		sum  = sha256.New()
+		crc  [4]byte
+	)
+
+	for {
+		data := stripe[:k*shardPieceSize]
+
+		nr, err := io.ReadFull(r, data)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		size += int64(nr)
+		sum.Write(data[:nr])
+
+		for i := nr; i < len(data); i++ {
+			data[i] = 0
+		}
+
+		s.code.Encode(pieces)
+
+		for i, piece := range pieces {
+			binary.BigEndian.PutUint32(crc[:], crc32.Checksum(piece, crcTable))
+
+			if _, err := writers[i].Write(piece); err != nil {
+				return err
+			}
+
+			if _, err := writers[i].Write(crc[:]); err != nil {
+				return err
+			}
+		}
+
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	trailer := binary.BigEndian.AppendUint64(nil, uint64(size))
+	trailer = sum.Sum(trailer)
+
+	for i, w := range writers {
+		if _, err := w.Write(trailer); err != nil {
+			return err
+		}
+
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		if err := files[i].Close(); err != nil {
+			return err
+		}
+
+		files[i] = nil
+	}
+
+	return nil
+}
+
+// sendShard writes a shard of ShardIndex of a prepared set to w.
+func (m *Backupper) sendShard(w io.Writer) error {
+	s := m.cfg.Shards
+
+	if len(s.name) == 0 {
+		return errors.New("shards aren't prepared")
+	}
+
+	f, err := os.Open(s.path(m.cfg.ShardIndex))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	m.peer.meter.start(fi.Size())
+
+	name := shardName(s.name, m.cfg.ShardIndex, s.code.Shards())
+
+	if err := m.writeHeader(name, nil, w); err != nil {
+		return err
+	}
+
+	m.log.WithField(log.FieldFile, name).Info("sending shard")
+
+	m.setFilename(name)
+
+	cw := &countingWriter{Writer: w}
+
+	if _, err := io.Copy(cw, io.TeeReader(f, m.peer.meter)); err != nil {
+		return err
+	}
+
+	m.setArchiveBytes(cw.n)
+
+	return nil
+}
+
+// IsShard tells whether a file stored at path is a shard of a backup.
+func IsShard(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(shardMagic))
+
+	if _, err := io.ReadFull(f, magic); err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+
+	return bytes.Equal(magic, []byte(shardMagic)), nil
+}
+
+// shardFile is a shard being read for a backup to be joined.
+type shardFile struct {
+	*shardHeader
+	f       *os.File
+	r       *bufio.Reader
+	path    string
+	stripes int64
+}
+
+// JoinShards reconstructs a backup of its shards stored at paths, at least k of
+// which are required, into a directory dir under a name it was sent with, and
+// returns a path of it. A backup is verified against its SHA-256 hash, and an
+// existing file is never overwritten. Corrupted pieces are logged with l, the
+// global logger is used if nil.
+func JoinShards(paths []string, dir string, l log.Logger) (string, error) {
+	if l == nil {
+		l = log.New()
+	}
+
+	shards, err := openShards(paths)
+
+	defer func() {
+		for _, s := range shards {
+			s.f.Close()
+		}
+	}()
+
+	if err != nil {
+		return "", err
+	}
+
+	h := shards[0].shardHeader
+
+	if filepath.Base(h.name) != h.name || !filepath.IsLocal(h.name) {
+		return "", errors.Errorf("unsafe backup name: %s", h.name)
+	}
+
+	code, err := erasure.New(h.k, h.n)
+	if err != nil {
+		return "", err
+	}
+
+	trailer := make([]byte, shardTrailerLen)
+
+	if _, err := shards[0].f.ReadAt(trailer, int64(len(h.marshal()))+shards[0].stripes*int64(h.pieceSize+4)); err != nil {
+		return "", err
+	}
+
+	size := int64(binary.BigEndian.Uint64(trailer))
+
+	target := filepath.Join(dir, h.name)
+	tmp := target + partialSuffix
+
+	if _, err := os.Lstat(target); err == nil {
+		return "", errors.Wrap(os.ErrExist, target)
+	}
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0664)
+	if err != nil {
+		return "", err
+	}
+
+	err = joinStripes(shards, code, f, size, trailer[8:], l)
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, target)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+
+		return "", err
+	}
+
+	return target, nil
+}
+
+// openShards opens shards stored at paths and checks that they're of the same
+// set, and that there are enough of them.
+func openShards(paths []string) ([]*shardFile, error) {
+	var shards []*shardFile
+
+	indexes := map[int]bool{}
+
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return shards, err
+		}
+
+		s := &shardFile{f: f, r: bufio.NewReaderSize(f, shardPieceSize+4), path: path}
+		shards = append(shards, s)
+
+		if s.shardHeader, err = readShardHeader(s.r); err != nil {
+			return shards, errors.Wrap(err, path)
+		}
+
+		fi, err := f.Stat()
+		if err != nil {
+			return shards, err
+		}
+
+		pieces := fi.Size() - int64(len(s.marshal())) - shardTrailerLen
+		if pieces < 0 || pieces%int64(s.pieceSize+4) != 0 {
+			return shards, errors.Wrap(errMalformedShard, path)
+		}
+
+		s.stripes = pieces / int64(s.pieceSize+4)
+
+		first := shards[0]
+
+		if s.id != first.id || s.k != first.k || s.n != first.n || s.pieceSize != first.pieceSize || s.name != first.name || s.stripes != first.stripes {
+			return shards, errors.Errorf("%s and %s are shards of different backups", first.path, path)
+		}
+
+		if indexes[s.index] {
+			return shards, errors.Errorf("%s: shard %d is given twice", path, s.index+1)
+		}
+
+		indexes[s.index] = true
+	}
+
+	if len(shards) == 0 || len(shards) < shards[0].k {
+		return shards, errors.Errorf("%d shards are given, %d are needed", len(shards), shards[0].k)
+	}
+
+	return shards, nil
+}
+
+// joinStripes writes size bytes of data of stripes of shards to w and checks it
+// against sum. Pieces which fail their checksums are logged with l and
+// reconstructed of the rest.
+func joinStripes(shards []*shardFile, code *erasure.Code, w io.Writer, size int64, sum []byte, l log.Logger) error {
+	h := shards[0].shardHeader
+	bw := bufio.NewWriter(w)
+	hash := sha256.New()
+	out := io.MultiWriter(bw, hash)
+	pieces := make([][]byte, h.n)
+	bufs := make([][]byte, len(shards))
+
+	for i := range bufs {
+		bufs[i] = make([]byte, h.pieceSize+4)
+	}
+
+	left := size
+
+	for stripe := int64(0); stripe < shards[0].stripes; stripe++ {
+		for i := range pieces {
+			pieces[i] = nil
+		}
+
+		for i, s := range shards {
+			if _, err := io.ReadFull(s.r, bufs[i]); err != nil {
+				return errors.Wrap(err, s.path)
+			}
+
+			piece := bufs[i][:h.pieceSize]
+
+			if crc32.Checksum(piece, crcTable) != binary.BigEndian.Uint32(bufs[i][h.pieceSize:]) {
+				l.WithField(log.FieldFile, s.path).Error(errors.Errorf("piece of stripe %d is corrupted", stripe))
+
+				continue
+			}
+
+			pieces[s.index] = piece
+		}
+
+		if err := code.Reconstruct(pieces); err != nil {
+			return errors.Wrapf(err, "stripe %d", stripe)
+		}
+
+		for _, piece := range pieces[:h.k] {
+			if left < int64(len(piece)) {
+				piece = piece[:left]
+			}
+
+			if _, err := out.Write(piece); err != nil {
+				return err
+			}
+
+			left -= int64(len(piece))
+		}
+	}
+
+	if left != 0 {
+		return errors.Wrap(errMalformedShard, "data is missing")
+	}
+
+	if !bytes.Equal(hash.Sum(nil), sum) {
+		return errors.New("joined backup doesn't match its SHA-256 hash")
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,100 @@
+package filemanager
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+// ErrSizeRefused means that a receiver has refused a transfer of an announced
+// size (see: announceSize()).
+var ErrSizeRefused = errors.New("receiver refused transfer")
+
+// maxRefusal bounds a reason of a refused transfer, which is sent as a file
+// name is.
+const maxRefusal = 0xff
+
+// announceSize tells a receiver an estimated size of a source entry (see:
+// sourceSize()) as an 8-byte big-endian number before a transfer starts. A
+// receiver answers with a reason it refuses a transfer for presented as a file
+// name is, which is empty if a transfer is accepted (see: checkSize()).
+func (m *Backupper) announceSize() error {
+	size := m.sourceSize()
+
+	if _, err := m.peer.Write(binary.BigEndian.AppendUint64(nil, uint64(size))); err != nil {
+		return err
+	}
+
+	reason, err := m.readFilename(&messageReader{r: m.peer, buf: make([]byte, maxMessageSize)})
+	if err != nil {
+		return err
+	}
+
+	if len(reason) != 0 {
+		return m.stream.fail(errors.Wrap(ErrSizeRefused, reason))
+	}
+
+	m.log.WithField(log.FieldSize, size).Debug("receiver accepted transfer size")
+
+	return nil
+}
+
+// checkSize answers an announced size of a transfer, which is refused if it
+// exceeds MaxSize or free space of DestinationDir.
+func (m *Backupper) checkSize() error {
+	var b [8]byte
+
+	if _, err := io.ReadFull(m.peer, b[:]); err != nil {
+		return err
+	}
+
+	size := int64(binary.BigEndian.Uint64(b[:]))
+	reason := m.refusal(size)
+
+	if len(reason) > maxRefusal {
+		reason = reason[:maxRefusal]
+	}
+
+	// An answer is sent in a single message, which a sender reads as a whole.
+	if _, err := m.peer.Write(append([]byte{byte(len(reason))}, reason...)); err != nil {
+		return err
+	}
+
+	if len(reason) != 0 {
+		return errors.Errorf("transfer refused: %s", reason)
+	}
+
+	m.log.WithField(log.FieldSize, size).Info("transfer size accepted")
+
+	return nil
+}
+
+// refusal returns a reason a transfer of size is refused for, or an empty
+// string if it fits.
+func (m *Backupper) refusal(size int64) string {
+	if m.cfg.MaxSize != 0 && size > m.cfg.MaxSize {
+		return fmt.Sprintf("size %s exceeds quota of %s", FormatBytes(size), FormatBytes(m.cfg.MaxSize))
+	}
+
+	// Free space of a storage other than a local directory isn't known.
+	if len(m.cfg.DestinationDir) == 0 || m.cfg.Storage != nil {
+		return ""
+	}
+
+	free, err := freeSpace(m.cfg.DestinationDir)
+	if err != nil {
+		m.log.Error(errors.Wrap(err, "free space"))
+
+		return ""
+	}
+
+	if free >= 0 && size > free {
+		return fmt.Sprintf("size %s exceeds free space of %s in destination directory", FormatBytes(size), FormatBytes(free))
+	}
+
+	return ""
+}
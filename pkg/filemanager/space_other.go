@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly
+
+package filemanager
+
+// freeSpace returns -1, since free space isn't found out on this platform.
+func freeSpace(string) (int64, error) {
+	return -1, nil
+}
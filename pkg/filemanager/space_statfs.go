@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package filemanager
+
+import "syscall"
+
+// freeSpace returns a number of bytes available to an unprivileged user on a
+// file system of a directory at path.
+func freeSpace(path string) (int64, error) {
+	var st syscall.Statfs_t
+
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,112 @@
+package filemanager
+
+import (
+	"io"
+	"path"
+	"strings"
+)
+
+// Stats describes content of a transfer: files a sender archives or a receiver
+// extracts, and a size of a file which is actually transferred.
+type Stats struct {
+	// Files and SourceBytes are a number and a total size of files before
+	// archiving.
+	Files       int64
+	SourceBytes int64
+	// ArchiveBytes is a size of a sent or received file, which is an archive
+	// of SourceBytes if a directory is transferred.
+	ArchiveBytes int64
+	// SkippedFiles and SkippedBytes are files of a source directory which are
+	// left out of an archive, e.g. being unchanged or duplicates, which is a
+	// saving against SourceBytes.
+	SkippedFiles int64
+	SkippedBytes int64
+	// ModifiedFiles is a number of files which were modified while they were
+	// archived, so their archived copies may be inconsistent.
+	ModifiedFiles int64
+	// DeltaFiles is a number of files transferred as deltas against a
+	// receiver's previous version, and DeltaBytes is a size of their content
+	// found there, which isn't transferred.
+	DeltaFiles int64
+	DeltaBytes int64
+	// DedupChunks is a number of chunks of files a receiver of a deduplicated
+	// backup has already, and DedupBytes is a size of them, which isn't
+	// transferred.
+	DedupChunks int64
+	DedupBytes  int64
+	// Extensions breaks SourceBytes down by lower-cased extensions of files
+	// including the dot, files without one are counted under an empty string.
+	Extensions map[string]ExtensionStats
+}
+
+type ExtensionStats struct {
+	Files int64
+	Bytes int64
+}
+
+// CompressionRatio returns a ratio of ArchiveBytes to SourceBytes, or 0 if no
+// files were archived.
+func (s Stats) CompressionRatio() float64 {
+	if s.SourceBytes == 0 {
+		return 0
+	}
+
+	return float64(s.ArchiveBytes) / float64(s.SourceBytes)
+}
+
+func (s Stats) clone() Stats {
+	if s.Extensions != nil {
+		extensions := make(map[string]ExtensionStats, len(s.Extensions))
+
+		for ext, e := range s.Extensions {
+			extensions[ext] = e
+		}
+
+		s.Extensions = extensions
+	}
+
+	return s
+}
+
+// addFileStats counts a file of a slash-separated name which is archived or
+// extracted.
+func (m *Backupper) addFileStats(name string, size int64) {
+	ext := strings.ToLower(path.Ext(name))
+
+	m.resultMx.Lock()
+	defer m.resultMx.Unlock()
+
+	s := &m.result.Stats
+	s.Files++
+	s.SourceBytes += size
+
+	if s.Extensions == nil {
+		s.Extensions = make(map[string]ExtensionStats)
+	}
+
+	e := s.Extensions[ext]
+	e.Files++
+	e.Bytes += size
+	s.Extensions[ext] = e
+}
+
+func (m *Backupper) setArchiveBytes(n int64) {
+	m.resultMx.Lock()
+	defer m.resultMx.Unlock()
+
+	m.result.Stats.ArchiveBytes = n
+}
+
+// countingWriter counts bytes of a sent file, which are its ArchiveBytes whether
+// it's written to Peer directly or sealed into an envelope.
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+
+	return n, err
+}
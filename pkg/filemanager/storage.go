@@ -0,0 +1,126 @@
+package filemanager
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// ErrUnsafeName means that a name of a stored file leads out of a root of a
+// storage (e.g. "../name" or an absolute path).
+var ErrUnsafeName = errors.New("unsafe name")
+
+// Storage is where a receiver stores received files, so that they can be written
+// directly to a remote location (e.g. an object storage) with the same versioning
+// and quarantine as in a local directory (see: upload.NewStorage()). Names are
+// slash-separated paths relative to a root of a storage. A receiver stores files
+// in DestinationDir (see: DirStorage) unless Storage is set.
+type Storage interface {
+	// Create returns a writer of a file which replaces an existing one once the
+	// writer is closed. A file written partially may remain if writing fails, it's
+	// quarantined then (see: quarantine()).
+	Create(name string) (io.WriteCloser, error)
+	// Rename renames a file replacing an existing one.
+	Rename(oldName, newName string) error
+	// Remove removes a file, it's not an error if there is none. A directory tree
+	// is removed only by DirStorage.RemoveAll().
+	Remove(name string) error
+	// Exists tells whether there is a file or a directory.
+	Exists(name string) (bool, error)
+	// Location returns where a file is (e.g. a path or a URL) to be logged and
+	// reported.
+	Location(name string) string
+}
+
+// DirStorage stores files in a local directory. Names which lead out of it are
+// refused.
+type DirStorage string
+
+func (d DirStorage) Create(name string) (io.WriteCloser, error) {
+	p, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0775); err != nil {
+		return nil, err
+	}
+
+	return os.Create(p)
+}
+
+func (d DirStorage) Rename(oldName, newName string) error {
+	oldPath, err := d.path(oldName)
+	if err != nil {
+		return err
+	}
+
+	newPath, err := d.path(newName)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(newPath), 0775); err != nil {
+		return err
+	}
+
+	return os.Rename(oldPath, newPath)
+}
+
+func (d DirStorage) Remove(name string) error {
+	p, err := d.path(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// RemoveAll removes a file or a directory tree, it's not an error if there is
+// nothing to remove.
+func (d DirStorage) RemoveAll(name string) error {
+	p, err := d.path(name)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(p)
+}
+
+func (d DirStorage) Exists(name string) (bool, error) {
+	p, err := d.path(name)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Lstat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Location returns a path of a file in a directory. A name which leads out of
+// it is refused by being resolved as if the directory were a root (as
+// http.Dir does), so that a location is never outside of it.
+func (d DirStorage) Location(name string) string {
+	return filepath.Join(string(d), filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// path returns a path of a file in a directory, or ErrUnsafeName if a name
+// leads out of it.
+func (d DirStorage) path(name string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", errors.Wrap(ErrUnsafeName, name)
+	}
+
+	return filepath.Join(string(d), filepath.FromSlash(name)), nil
+}
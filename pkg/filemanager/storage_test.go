@@ -0,0 +1,127 @@
+package filemanager
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"distributed-backup/pkg/log"
+)
+
+var unsafeNames = []string{"../victim", "sub/../../victim", "/victim", "..", ""}
+
+// newVictim makes a directory next to a destination one, which a receiver must
+// never touch.
+func newVictim(t *testing.T) (dst, victim string) {
+	t.Helper()
+
+	root := t.TempDir()
+	dst = filepath.Join(root, "dst")
+	victim = filepath.Join(root, "victim")
+
+	for _, dir := range []string{dst, filepath.Join(victim, "sub")} {
+		if err := os.MkdirAll(dir, 0775); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(victim, "sub", "file"), []byte("victim"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	return dst, victim
+}
+
+func assertVictim(t *testing.T, victim string) {
+	t.Helper()
+
+	b, err := os.ReadFile(filepath.Join(victim, "sub", "file"))
+	if err != nil || string(b) != "victim" {
+		t.Fatalf("directory outside of a destination one is changed: %v", err)
+	}
+}
+
+func TestDirStorageRefusesUnsafeNames(t *testing.T) {
+	dst, victim := newVictim(t)
+	s := DirStorage(dst)
+
+	for _, name := range unsafeNames {
+		if err := s.Remove(name); !errors.Is(err, ErrUnsafeName) {
+			t.Errorf("Remove(%q) = %v, want ErrUnsafeName", name, err)
+		}
+
+		if _, err := s.Exists(name); !errors.Is(err, ErrUnsafeName) {
+			t.Errorf("Exists(%q) = %v, want ErrUnsafeName", name, err)
+		}
+
+		if w, err := s.Create(name); !errors.Is(err, ErrUnsafeName) {
+			if err == nil {
+				w.Close()
+			}
+
+			t.Errorf("Create(%q) = %v, want ErrUnsafeName", name, err)
+		}
+
+		if err := s.Rename("file", name); !errors.Is(err, ErrUnsafeName) {
+			t.Errorf("Rename(file, %q) = %v, want ErrUnsafeName", name, err)
+		}
+
+		if err := s.Rename(name, "file"); !errors.Is(err, ErrUnsafeName) {
+			t.Errorf("Rename(%q, file) = %v, want ErrUnsafeName", name, err)
+		}
+
+		if loc := s.Location(name); loc != dst && !strings.HasPrefix(loc, dst+string(filepath.Separator)) {
+			t.Errorf("Location(%q) = %s is outside of %s", name, loc, dst)
+		}
+	}
+
+	assertVictim(t, victim)
+}
+
+func TestReadHeaderRefusesUnsafeNames(t *testing.T) {
+	m := &Backupper{}
+
+	for _, name := range append(unsafeNames, "sub/backup.zip") {
+		var buf bytes.Buffer
+
+		if err := m.writeHeader(name, nil, &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := m.readHeader(&buf); err == nil {
+			t.Errorf("unsafe name %q is read", name)
+		}
+	}
+
+	var buf bytes.Buffer
+
+	if err := m.writeHeader("backup.zip", nil, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if name, _, err := m.readHeader(&buf); err != nil || name != "backup.zip" {
+		t.Errorf("readHeader() = %q, %v, want backup.zip", name, err)
+	}
+}
+
+// TestReceiveUnsafeNameKeepsVersions checks that a file named by a sender to
+// lead out of a destination directory neither removes an oldest version there
+// nor is stored.
+func TestReceiveUnsafeNameKeepsVersions(t *testing.T) {
+	dst, victim := newVictim(t)
+
+	m := &Backupper{
+		cfg:     BackupperConfig{DestinationDir: dst, Versions: 1},
+		log:     log.New(),
+		storage: DirStorage(dst),
+	}
+
+	if err := m.receiveToFile("../victim", "../victim", strings.NewReader("sender")); err == nil {
+		t.Error("file of an unsafe name is received")
+	}
+
+	assertVictim(t, victim)
+}
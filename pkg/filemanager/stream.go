@@ -0,0 +1,116 @@
+package filemanager
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"distributed-backup/pkg/crypto"
+
+	"github.com/pkg/errors"
+)
+
+// streamVerifier passes an encrypted stream through as is, while decrypting a
+// copy of it to check that it's intact. Reaching the end of a stream fails if
+// verification does, so that a tampered file is quarantined rather than stored.
+type streamVerifier struct {
+	r    io.Reader
+	pw   *io.PipeWriter
+	done chan error
+}
+
+// verifyStream returns a reader of an encrypted stream r which is verified with
+// StreamKey as it's read.
+func (m *Backupper) verifyStream(r io.Reader) *streamVerifier {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+
+	go func() {
+		plain, err := crypto.NewStreamReader(pr, []byte(m.cfg.StreamKey))
+		if err == nil {
+			_, err = io.Copy(io.Discard, plain)
+		}
+
+		// The rest is drained, so that passing a stream through never blocks.
+		io.Copy(io.Discard, pr)
+
+		done <- err
+	}()
+
+	return &streamVerifier{
+		r:    r,
+		pw:   pw,
+		done: done,
+	}
+}
+
+func (v *streamVerifier) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+
+	if n > 0 {
+		v.pw.Write(p[:n])
+	}
+
+	if err == nil {
+		return n, nil
+	}
+
+	v.pw.CloseWithError(err)
+
+	if err == io.EOF {
+		if verr := <-v.done; verr != nil {
+			return n, errors.Wrap(verr, "stream verification")
+		}
+	}
+
+	return n, err
+}
+
+// Close stops verification of a stream which isn't read to the end.
+func (v *streamVerifier) Close() {
+	v.pw.Close()
+}
+
+// DecryptStream decrypts a file stored by a receiver of a sender with StreamKey
+// (see: writeFile()) with psk, and saves it into dir without the ".enc"
+// extension. It returns a path of the saved file.
+func DecryptStream(path, psk, dir string) (string, error) {
+	name := filepath.Base(path)
+	if !strings.HasSuffix(name, crypto.StreamExt) {
+		return "", errors.Errorf("not an encrypted file: %s", name)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	plain, err := crypto.NewStreamReader(f, []byte(psk))
+	if err != nil {
+		return "", err
+	}
+
+	target := filepath.Join(dir, strings.TrimSuffix(name, crypto.StreamExt))
+
+	// A partially decrypted file is removed, since it can't be trusted.
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0664)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(out, plain)
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(target)
+
+		return "", err
+	}
+
+	return target, nil
+}
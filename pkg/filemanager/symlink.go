@@ -0,0 +1,154 @@
+package filemanager
+
+import (
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"distributed-backup/pkg/log"
+
+	"github.com/TelenLiu/go-zip"
+	"github.com/pkg/errors"
+)
+
+const (
+	// symlinkExtraID is an ID of an empty extra field of an archive entry which
+	// carries a target of a symbolic link instead of content of a file, since
+	// local headers a receiver reads have no mode of a file.
+	symlinkExtraID = 0x6c64
+	// maxSymlinkTarget bounds a target of a received symbolic link.
+	maxSymlinkTarget = 4096
+)
+
+// archivedSymlink is a symbolic link of an extracted archive, which is made
+// once everything else is extracted.
+type archivedSymlink struct {
+	name   string
+	target string
+}
+
+// archiveSymlink writes a symbolic link of a source directory at path to z as
+// an entry of fh whose content is a target of the link.
+func (m *Backupper) archiveSymlink(z *innerWriter, fh *zip.FileHeader, path string, rule *FileRule) error {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return err
+	}
+
+	m.log.WithField(log.FieldFile, fh.Name).Debug("archiving symbolic link")
+
+	if rule == nil || !rule.Plain {
+		m.setArchivedFilePassword(fh, m.cfg.Password1)
+	}
+
+	fh.Extra = append(fh.Extra, symlinkExtra()...)
+
+	w, err := z.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, target)
+
+	return err
+}
+
+func symlinkExtra() []byte {
+	return binary.LittleEndian.AppendUint32(nil, symlinkExtraID)
+}
+
+// isSymlink tells whether an extra field of an entry has a symbolic link
+// marker.
+func isSymlink(extra []byte) bool {
+	return hasExtra(extra, symlinkExtraID)
+}
+
+// hasExtra tells whether an extra field of an entry has a field of id.
+func hasExtra(extra []byte, id uint16) bool {
+	for len(extra) >= 4 {
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+
+		if binary.LittleEndian.Uint16(extra) == id {
+			return true
+		}
+
+		if len(extra) < 4+size {
+			break
+		}
+
+		extra = extra[4+size:]
+	}
+
+	return false
+}
+
+// readSymlink reads a target of a symbolic link an entry carries.
+func readSymlink(entry *zipStreamEntry) (archivedSymlink, error) {
+	if !filepath.IsLocal(filepath.FromSlash(entry.Name)) {
+		return archivedSymlink{}, errors.New("unsafe entry path")
+	}
+
+	b, err := io.ReadAll(io.LimitReader(entry, maxSymlinkTarget+1))
+	if err != nil {
+		return archivedSymlink{}, err
+	}
+
+	if len(b) == 0 || len(b) > maxSymlinkTarget {
+		return archivedSymlink{}, errors.New("malformed symbolic link")
+	}
+
+	return archivedSymlink{
+		name:   entry.Name,
+		target: string(b),
+	}, nil
+}
+
+// makeSymlinks makes symbolic links of an archive extracted into dir. They are
+// made last, so that no file is written through them, and a link within a
+// directory another link takes place of isn't made.
+func (m *Backupper) makeSymlinks(dir string, links []archivedSymlink) error {
+	for _, link := range links {
+		name := filepath.FromSlash(link.name)
+
+		if err := checkNoSymlinks(dir, filepath.Dir(name)); err != nil {
+			return errors.Wrap(err, link.name)
+		}
+
+		path := filepath.Join(dir, name)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+			return err
+		}
+
+		if err := os.Symlink(link.target, path); err != nil {
+			return err
+		}
+
+		m.addFileStats(link.name, int64(len(link.target)))
+	}
+
+	return nil
+}
+
+// checkNoSymlinks makes sure no directory of a relative path within dir is a
+// symbolic link.
+func checkNoSymlinks(dir, relPath string) error {
+	for p := relPath; p != "."; p = filepath.Dir(p) {
+		fi, err := os.Lstat(filepath.Join(dir, p))
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return errors.New("entry path crosses a symbolic link")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,193 @@
+package filemanager
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/zstd"
+)
+
+// Formats of a tar archive a source directory is sent in.
+const (
+	FormatTarGz  = "tar.gz"
+	FormatTarZst = "tar.zst"
+)
+
+// isZipFormat tells whether a source directory is sent in a double ZIP.
+func isZipFormat(format string) bool {
+	return len(format) == 0 || format == FormatZip
+}
+
+func isTarFormat(format string) bool {
+	return format == FormatTarGz || format == FormatTarZst
+}
+
+// sendSourceDirTar archives a source directory into a single tar archive
+// compressed with gzip or Zstandard, which keeps permissions, owners and symbolic
+// links of files. The archive is streamed as it's built. Neither format is
+// encrypted, so passwords aren't used and an archive is only as confidential as
+// a way it's sent in (see: Recipient).
+func (m *Backupper) sendSourceDirTar(w io.Writer) error {
+	if err := m.writeHeader(m.cfg.OutputFilename, nil, w); err != nil {
+		return err
+	}
+
+	m.log.WithField(log.FieldFile, m.cfg.OutputFilename).Info("sending file")
+
+	m.setFilename(m.cfg.OutputFilename)
+
+	cw := &countingWriter{Writer: w}
+
+	var zw io.WriteCloser
+
+	switch {
+	case m.cfg.Format == FormatTarZst:
+		zw = zstd.NewWriter(cw)
+	case m.cfg.CompressWorkers > 1:
+		zw = newGzipWriter(cw, m.cfg.CompressWorkers)
+	default:
+		zw = gzip.NewWriter(cw)
+	}
+
+	tw := tar.NewWriter(zw)
+
+	m.log.WithField(log.FieldDir, m.cfg.SourceEntry).Info("archiving directory")
+
+	if m.cfg.Recipient == nil {
+		m.log.Info("tar archive is not encrypted, passwords are not used")
+	}
+
+	err := m.walkSourceDir(func(path, relPath string, fi fs.FileInfo, _ *FileRule) error {
+		return m.archiveTarEntry(tw, path, relPath, fi)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	m.setArchiveBytes(cw.n)
+
+	return nil
+}
+
+// archiveTarEntry writes a file of a source directory at path to tw. A symbolic
+// link is archived as a link, an empty directory as a directory, other special
+// files are skipped. A file whose size
+// changes while it's archived is cut or padded with zeros to the size in its
+// header, which is written first, and is counted as modified.
+func (m *Backupper) archiveTarEntry(tw *tar.Writer, path, relPath string, fi fs.FileInfo) error {
+	var link string
+
+	switch {
+	case fi.Mode().IsRegular(), fi.IsDir():
+	case fi.Mode()&fs.ModeSymlink != 0:
+		var err error
+
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	default:
+		m.log.WithField(log.FieldFile, relPath).Info("special file skipped")
+
+		return nil
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+
+	hdr.Name = filepath.ToSlash(relPath)
+
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+
+	m.log.WithField(log.FieldFile, relPath).Debug("archiving file")
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if len(link) != 0 || fi.IsDir() {
+		return nil
+	}
+
+	fw := &fixedSizeWriter{w: tw, left: hdr.Size}
+
+	consistent, err := m.archiveFile(path, relPath, fi, fw)
+	if err != nil {
+		return err
+	}
+
+	resized := fw.cut || fw.left != 0
+
+	if err := fw.pad(); err != nil {
+		return err
+	}
+
+	if consistent && resized {
+		m.log.WithField(log.FieldFile, relPath).Info("file was modified during archiving, its copy may be inconsistent")
+
+		m.resultMx.Lock()
+		m.result.Stats.ModifiedFiles++
+		m.resultMx.Unlock()
+	}
+
+	return nil
+}
+
+// fixedSizeWriter writes at most left bytes to w, and drops the rest.
+type fixedSizeWriter struct {
+	w    io.Writer
+	left int64
+	cut  bool
+}
+
+func (w *fixedSizeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	if int64(len(p)) > w.left {
+		p = p[:w.left]
+		w.cut = true
+	}
+
+	k, err := w.w.Write(p)
+	w.left -= int64(k)
+
+	if err != nil {
+		return k, err
+	}
+
+	return n, nil
+}
+
+// pad writes zeros up to the size.
+func (w *fixedSizeWriter) pad() error {
+	_, err := io.CopyN(w.w, zeroReader{}, w.left)
+	w.left = 0
+
+	return err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,963 @@
+package filemanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"distributed-backup/pkg/crypto"
+	"distributed-backup/pkg/envelope"
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/peer"
+	"distributed-backup/pkg/signal"
+
+	"github.com/TelenLiu/go-zip"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// testFiles are files of a source directory a backup of a test is made of.
+var testFiles = map[string]string{
+	"file.txt":            "Distributed Backup test\n",
+	"dir/nested.txt":      "nested file content\n",
+	"dir/subdir/data.bin": string(bytes.Repeat([]byte{0, 1, 2, 3, 254, 255}, 64*1024)),
+}
+
+const (
+	testPassword1 = "test-password-1"
+	testPassword2 = "test-password-2"
+
+	testAuthSecret = "test-auth-secret"
+	testStreamKey  = "test-stream-key"
+
+	testOutFile = "backup.zip"
+)
+
+// newTestDirs writes testFiles to a source directory and makes an empty
+// destination one in a temporary directory of a test. Peers of a transfer are
+// connected over the network stack, so a test is skipped in short mode.
+func newTestDirs(t *testing.T) (srcDir, dstDir string) {
+	t.Helper()
+
+	if testing.Short() {
+		t.Skip("peers are connected over the network stack")
+	}
+
+	dir := t.TempDir()
+	srcDir = filepath.Join(dir, "src")
+	dstDir = filepath.Join(dir, "dst")
+
+	for name, content := range testFiles {
+		path := filepath.Join(srcDir, filepath.FromSlash(name))
+
+		if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(content), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.MkdirAll(dstDir, 0775); err != nil {
+		t.Fatal(err)
+	}
+
+	return srcDir, dstDir
+}
+
+type transferOptions struct {
+	// Extract makes a receiver extract a backup instead of saving it.
+	Extract bool
+	// Delta makes peers transfer deltas of files against an extracted previous
+	// version, at least one file is expected to be sent as a delta.
+	Delta bool
+	// Escrow makes a sender seal passwords of a backup for an escrow identity.
+	Escrow *ecdh.PublicKey
+	// FileRules are rules a sender archives files with.
+	FileRules []FileRule
+	// ReceiverPassword1 overrides the first-level password a receiver extracts
+	// a backup with, which is the sender's one (testPassword1) by default.
+	ReceiverPassword1 string
+	// SenderAuthSecret overrides the auth secret of a sender, which is the
+	// receiver's one (testAuthSecret) by default.
+	SenderAuthSecret string
+	// SenderUnauthenticated makes a sender authenticate neither with an auth
+	// secret nor with a pairing code.
+	SenderUnauthenticated bool
+	// PairingCode makes peers authenticate each other with a pairing code
+	// instead of the auth secret, SenderPairingCode overrides the sender's one.
+	PairingCode       string
+	SenderPairingCode string
+	// Recipient and Route make a sender seal a backup into an envelope.
+	Recipient *ecdh.PublicKey
+	Route     []string
+	// ForwardEnvelope makes a sender forward a stored envelope instead of
+	// sending a source directory.
+	ForwardEnvelope string
+	// ReceiverIdentity opens envelopes addressed to a receiver.
+	ReceiverIdentity *envelope.Identity
+	// ReceiverStorageKey makes a receiver re-encrypt a backup before storing it.
+	ReceiverStorageKey *ecdh.PublicKey
+	// ReceiverStorage makes a receiver store a backup in a storage instead of a
+	// destination directory.
+	ReceiverStorage Storage
+	// StreamFile makes a sender send a single file encrypted with testStreamKey
+	// instead of a source directory, which a receiver verifies.
+	StreamFile string
+	// Format is a format of an archive a sender sends a source directory in.
+	Format string
+	// Exclude and Include are patterns of paths a sender archives.
+	Exclude []string
+	Include []string
+	// PreserveMeta makes peers send and restore metadata of files.
+	PreserveMeta bool
+	// FollowSymlinks makes a sender archive files symbolic links point to.
+	FollowSymlinks bool
+	// AnnounceSize makes a sender announce a size of a backup, which a receiver
+	// checks against ReceiverMaxSize.
+	AnnounceSize    bool
+	ReceiverMaxSize int64
+	// ReceiverRetention makes a receiver keep versions by a retention policy.
+	ReceiverRetention *Retention
+	// Manifest makes peers send a backup incrementally, a sender keeps its
+	// manifest at the path. A receiver is expected to extract a backup.
+	Manifest string
+	// Skipped is a number of files a sender is expected to skip if it's set.
+	Skipped int64
+	// Streams is a number of data channels peers spread a transfer over.
+	Streams int
+	// ZipCrypto makes a sender protect archives with ZipCrypto instead of AES.
+	ZipCrypto bool
+	// OuterLevel and StoreExtensions make a sender compress an inner archive
+	// and files of it as they tell.
+	OuterLevel      *int
+	StoreExtensions []string
+	// CompressWorkers is a number of chunks of a file a sender deflates at once.
+	CompressWorkers int
+	// Dedup makes peers transfer a deduplicated backup, a sender is expected to
+	// reference DedupChunks chunks a receiver has if it's set.
+	Dedup       bool
+	DedupChunks int64
+	// Shards makes a sender send a shard ShardIndex of a set, a sender of the
+	// first one prepares the set.
+	Shards     *ShardSet
+	ShardIndex int
+}
+
+// testTransfer sends a backup between WebRTC peers negotiating through the
+// in-memory signaling, and returns an error of either of them if the transfer
+// fails.
+func testTransfer(srcDir, dstDir, outFile string, opts transferOptions) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	receiverLog := log.WithField(log.FieldRole, RoleReceiver)
+	senderLog := log.WithField(log.FieldRole, RoleSender)
+
+	receiverSignal, senderSignal := signal.NewMemoryPair()
+
+	receiverPeer, err := peer.NewWebRTC(peer.WebRTCConfig{Log: receiverLog, Streams: opts.Streams}, receiverSignal)
+	if err != nil {
+		return err
+	}
+	defer receiverPeer.Close()
+
+	senderPeer, err := peer.NewWebRTC(peer.WebRTCConfig{Log: senderLog, Streams: opts.Streams}, senderSignal)
+	if err != nil {
+		return err
+	}
+	defer senderPeer.Close()
+
+	receiverCfg := BackupperConfig{
+		DestinationDir: dstDir,
+		Versions:       2,
+		AuthSecret:     testAuthSecret,
+		Identity:       opts.ReceiverIdentity,
+		PreserveMeta:   opts.PreserveMeta,
+		AnnounceSize:   opts.AnnounceSize,
+		MaxSize:        opts.ReceiverMaxSize,
+		Retention:      opts.ReceiverRetention,
+		Dedup:          opts.Dedup,
+		Log:            receiverLog,
+	}
+
+	if len(opts.PairingCode) != 0 {
+		receiverCfg.AuthSecret = ""
+		receiverCfg.PairingCode = opts.PairingCode
+	}
+
+	if opts.ReceiverStorage != nil {
+		receiverCfg.DestinationDir = ""
+		receiverCfg.Storage = opts.ReceiverStorage
+	}
+
+	if opts.ReceiverStorageKey != nil {
+		receiverCfg.StorageKey = opts.ReceiverStorageKey
+		receiverCfg.Password2 = testPassword2
+	}
+
+	if len(opts.StreamFile) != 0 {
+		receiverCfg.StreamKey = testStreamKey
+	}
+
+	if opts.Extract {
+		receiverCfg.Extract = true
+		receiverCfg.Delta = opts.Delta
+		receiverCfg.Incremental = len(opts.Manifest) != 0
+		receiverCfg.Password1 = testPassword1
+		receiverCfg.Password2 = testPassword2
+
+		if len(opts.ReceiverPassword1) != 0 {
+			receiverCfg.Password1 = opts.ReceiverPassword1
+		}
+	}
+
+	receiver, err := NewBackupper(receiverCfg, receiverPeer)
+	if err != nil {
+		return err
+	}
+
+	senderAuthSecret := opts.SenderAuthSecret
+	if len(senderAuthSecret) == 0 {
+		senderAuthSecret = testAuthSecret
+	}
+
+	senderPairingCode := opts.SenderPairingCode
+	if len(senderPairingCode) == 0 {
+		senderPairingCode = opts.PairingCode
+	}
+
+	if len(senderPairingCode) != 0 || opts.SenderUnauthenticated {
+		senderAuthSecret = ""
+	}
+
+	exclude, err := ParsePathPatterns(opts.Exclude)
+	if err != nil {
+		return err
+	}
+
+	include, err := ParsePathPatterns(opts.Include)
+	if err != nil {
+		return err
+	}
+
+	senderCfg := BackupperConfig{
+		ZipDir:          true,
+		SourceEntry:     srcDir,
+		OutputFilename:  outFile,
+		Password1:       testPassword1,
+		Password2:       testPassword2,
+		AuthSecret:      senderAuthSecret,
+		PairingCode:     senderPairingCode,
+		Recipient:       opts.Recipient,
+		Route:           opts.Route,
+		Delta:           opts.Delta,
+		Escrow:          opts.Escrow,
+		FileRules:       opts.FileRules,
+		Format:          opts.Format,
+		ZipCrypto:       opts.ZipCrypto,
+		OuterLevel:      opts.OuterLevel,
+		StoreExtensions: opts.StoreExtensions,
+		CompressWorkers: opts.CompressWorkers,
+		Dedup:           opts.Dedup,
+		Exclude:         exclude,
+		Include:         include,
+		Incremental:     len(opts.Manifest) != 0,
+		Manifest:        opts.Manifest,
+		PreserveMeta:    opts.PreserveMeta,
+		FollowSymlinks:  opts.FollowSymlinks,
+		AnnounceSize:    opts.AnnounceSize,
+		Shards:          opts.Shards,
+		ShardIndex:      opts.ShardIndex,
+		Log:             senderLog,
+	}
+
+	if len(opts.ForwardEnvelope) != 0 {
+		senderCfg.ZipDir = false
+		senderCfg.SourceEntry = opts.ForwardEnvelope
+		senderCfg.OutputFilename = ""
+		senderCfg.Forward = true
+	}
+
+	if len(opts.StreamFile) != 0 {
+		senderCfg.ZipDir = false
+		senderCfg.SourceEntry = opts.StreamFile
+		senderCfg.OutputFilename = ""
+		senderCfg.StreamKey = testStreamKey
+	}
+
+	sender, err := NewBackupper(senderCfg, senderPeer)
+	if err != nil {
+		return err
+	}
+
+	if opts.Shards != nil && opts.ShardIndex == 0 {
+		if err := sender.PrepareShards(ctx); err != nil {
+			return err
+		}
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	listenTestSignals(ctx, &wg, receiverSignal, senderSignal)
+
+	if err := dialTestPeers(ctx, receiverPeer, senderPeer, sender, receiver); err != nil {
+		return err
+	}
+
+	for _, m := range []*Backupper{sender, receiver} {
+		if r := m.Result(); r.Err != nil {
+			return errors.Wrap(r.Err, r.Role)
+		}
+	}
+
+	if digest := sender.Result().Digest; len(digest) == 0 || !bytes.Equal(digest, receiver.Result().Digest) {
+		return errors.New("peers report different digests of a transfer stream")
+	}
+
+	if opts.Delta && sender.Result().Stats.DeltaFiles == 0 {
+		return errors.New("no file is sent as a delta")
+	}
+
+	if chunks := sender.Result().Stats.DedupChunks; opts.DedupChunks != 0 && chunks != opts.DedupChunks {
+		return errors.Errorf("%d chunks are deduplicated, %d expected", chunks, opts.DedupChunks)
+	}
+
+	if len(opts.FileRules) != 0 && sender.Result().Stats.SkippedFiles == 0 {
+		return errors.New("no file is skipped by rules")
+	}
+
+	if skipped := sender.Result().Stats.SkippedFiles; opts.Skipped != 0 && skipped != opts.Skipped {
+		return errors.Errorf("%d files are skipped, %d expected", skipped, opts.Skipped)
+	}
+
+	return nil
+}
+
+// mustTransfer is testTransfer which fails a test if a transfer fails.
+func mustTransfer(t *testing.T, srcDir, dstDir, outFile string, opts transferOptions) {
+	t.Helper()
+
+	if err := testTransfer(srcDir, dstDir, outFile, opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// listenTestSignals listens to signals until ctx is done.
+func listenTestSignals(ctx context.Context, wg *sync.WaitGroup, signals ...*signal.Memory) {
+	for _, s := range signals {
+		s := s
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			s.Listen(ctx)
+		}()
+	}
+}
+
+// dialTestPeers dials peers and waits for transfers over them to finish.
+func dialTestPeers(ctx context.Context, receiverPeer, senderPeer peer.Conn, managers ...*Backupper) error {
+	if err := receiverPeer.Dial(); err != nil {
+		return err
+	}
+
+	if err := senderPeer.Dial(); err != nil {
+		return err
+	}
+
+	for _, m := range managers {
+		select {
+		case <-m.Done():
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "transfer")
+		}
+	}
+
+	return nil
+}
+
+// verifyTestFiles checks that dir contains testFiles.
+func verifyTestFiles(t *testing.T, dir string) {
+	t.Helper()
+
+	for name, content := range testFiles {
+		b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != content {
+			t.Fatalf("%s: restored content mismatch", name)
+		}
+	}
+}
+
+// extractTestBackup extracts both archive levels of a received backup into dir.
+func extractTestBackup(path, password1, password2, dir string) error {
+	outer, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer outer.Close()
+
+	if len(outer.File) != 1 {
+		return errors.Errorf("%s: single inner archive expected", path)
+	}
+
+	inner, err := readTestArchivedFile(outer.File[0], password2)
+	if err != nil {
+		return err
+	}
+
+	return extractTestArchive(inner, password1, dir)
+}
+
+// extractTestArchive extracts a single archive level into dir.
+func extractTestArchive(b []byte, password, dir string) error {
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range z.File {
+		content, err := readTestArchivedFile(f, password)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(f.Name))
+
+		if err := os.MkdirAll(filepath.Dir(target), 0775); err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(target, content, 0664); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readTestArchivedFile(f *zip.File, password string) ([]byte, error) {
+	if f.IsEncrypted() {
+		f.SetPassword(password)
+	}
+
+	r, err := f.Open()
+	if err != nil {
+		return nil, errors.Wrap(err, f.Name)
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+
+	return b, errors.Wrap(err, f.Name)
+}
+
+// restoreTestBackup extracts a received backup into restoredDir and checks
+// files of it.
+func restoreTestBackup(t *testing.T, path, restoredDir string) {
+	t.Helper()
+
+	if err := extractTestBackup(path, testPassword1, testPassword2, restoredDir); err != nil {
+		t.Fatal(err)
+	}
+
+	verifyTestFiles(t, restoredDir)
+}
+
+// extractedDir is a directory a receiver extracts a backup of outFile into.
+func extractedDir(dstDir, outFile string) string {
+	return filepath.Join(dstDir, strings.TrimSuffix(outFile, ".zip"))
+}
+
+func TestTransferVersions(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+
+	for i := 0; i < 2; i++ {
+		mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{})
+	}
+
+	path := filepath.Join(dstDir, testOutFile)
+
+	for _, p := range []string{path, path + ".1"} {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restoreTestBackup(t, path, filepath.Join(t.TempDir(), "restored"))
+}
+
+// TestRestoreVersion checks that a stored version of a backup is extracted into
+// a directory named after the version, which isn't overwritten by restoring it
+// again, and that nothing is left of a backup restored with wrong passwords.
+func TestRestoreVersion(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+
+	for i := 0; i < 2; i++ {
+		mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{})
+	}
+
+	path := filepath.Join(dstDir, testOutFile+".1")
+	restoredDir := t.TempDir()
+
+	if _, err := Restore(path, testPassword2, testPassword1, restoredDir, nil); err == nil {
+		t.Fatal("backup is restored with wrong passwords")
+	}
+
+	target, err := Restore(path, testPassword1, testPassword2, restoredDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filepath.Base(target) != strings.TrimSuffix(testOutFile, ".zip")+".1" {
+		t.Fatalf("%s: unexpected restored directory", target)
+	}
+
+	verifyTestFiles(t, target)
+
+	if _, err := Restore(path, testPassword1, testPassword2, restoredDir, nil); err == nil {
+		t.Fatal("restored directory is overwritten")
+	}
+}
+
+// TestList checks that files of a stored backup are listed with their sizes
+// without it being extracted.
+func TestList(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+
+	mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{})
+
+	files, err := List(filepath.Join(dstDir, testOutFile), testPassword1, testPassword2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listed := 0
+
+	for _, f := range files {
+		content, ok := testFiles[f.Name]
+		if !ok {
+			continue
+		}
+
+		if f.Size != int64(len(content)) {
+			t.Errorf("%s: listed size %d mismatch", f.Name, f.Size)
+		}
+
+		listed++
+	}
+
+	if listed != len(testFiles) {
+		t.Errorf("%d of %d files listed", listed, len(testFiles))
+	}
+}
+
+func TestTransferExtract(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+
+	mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{Extract: true})
+
+	verifyTestFiles(t, extractedDir(dstDir, testOutFile))
+}
+
+// TestQuarantine checks that a backup which fails to be verified on extraction
+// is quarantined along with a reason, and the previous version is kept intact.
+func TestQuarantine(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+
+	mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{Extract: true})
+
+	err := testTransfer(srcDir, dstDir, testOutFile, transferOptions{
+		Extract:           true,
+		ReceiverPassword1: "wrong-" + testPassword1,
+	})
+	if err == nil {
+		t.Fatal("backup extracted with a wrong password")
+	}
+
+	reasons, err := filepath.Glob(filepath.Join(dstDir, QuarantineDir, "*"+QuarantineReasonExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reasons) != 1 {
+		t.Fatalf("single quarantined backup expected, %d found", len(reasons))
+	}
+
+	if _, err := os.Stat(strings.TrimSuffix(reasons[0], QuarantineReasonExt)); err != nil {
+		t.Fatal(err)
+	}
+
+	verifyTestFiles(t, extractedDir(dstDir, testOutFile))
+}
+
+// TestTransferDelta changes a large file of a source directory in the middle
+// and at the end, sends it as a delta against a version extracted by a
+// receiver, and checks the reconstructed file.
+func TestTransferDelta(t *testing.T) {
+	const name = "dir/subdir/data.bin"
+
+	srcDir, dstDir := newTestDirs(t)
+
+	mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{Extract: true})
+
+	changed := []byte(testFiles[name])
+	copy(changed[len(changed)/2:], "changed in the middle")
+	changed = append(changed, "appended at the end\n"...)
+
+	if err := os.WriteFile(filepath.Join(srcDir, filepath.FromSlash(name)), changed, 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{Extract: true, Delta: true})
+
+	b, err := os.ReadFile(filepath.Join(extractedDir(dstDir, testOutFile), filepath.FromSlash(name)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, changed) {
+		t.Fatalf("%s: reconstructed content mismatch", name)
+	}
+}
+
+// TestTransferIncremental sends a full backup saving a manifest, then changes
+// one file and deletes another one, and sends only the changed file against the
+// version extracted by a receiver. It checks that unchanged files are skipped
+// and taken from the previous version, and that the deleted one is left out.
+func TestTransferIncremental(t *testing.T) {
+	const (
+		changedName = "file.txt"
+		deletedName = "dir/nested.txt"
+	)
+
+	srcDir, dstDir := newTestDirs(t)
+
+	opts := transferOptions{Extract: true, Manifest: filepath.Join(t.TempDir(), "manifest.json")}
+
+	mustTransfer(t, srcDir, dstDir, testOutFile, opts)
+
+	changed := testFiles[changedName] + "changed since the previous version\n"
+
+	if err := os.WriteFile(filepath.Join(srcDir, filepath.FromSlash(changedName)), []byte(changed), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(filepath.Join(srcDir, filepath.FromSlash(deletedName))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only data.bin is unchanged.
+	opts.Skipped = 1
+
+	mustTransfer(t, srcDir, dstDir, testOutFile, opts)
+
+	extracted := extractedDir(dstDir, testOutFile)
+
+	if _, err := os.Stat(filepath.Join(extracted, filepath.FromSlash(deletedName))); !os.IsNotExist(err) {
+		t.Errorf("%s: deleted file is extracted", deletedName)
+	}
+
+	for _, name := range []string{changedName, "dir/subdir/data.bin"} {
+		b, err := os.ReadFile(filepath.Join(extracted, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := testFiles[name]
+		if name == changedName {
+			want = changed
+		}
+
+		if string(b) != want {
+			t.Errorf("%s: content mismatch", name)
+		}
+	}
+}
+
+// TestTransferStreams sends a backup over several data channels, storing a
+// large file as is so that its chunks are spread over all of them, and checks
+// files extracted by a receiver. Rules of a transfer have to skip a file, which
+// is the smallest one.
+func TestTransferStreams(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+
+	mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{
+		Extract:   true,
+		FileRules: parseTestFileRules(t, "file.txt=skip", "*.bin=store"),
+		Streams:   4,
+	})
+
+	extracted := extractedDir(dstDir, testOutFile)
+
+	for _, name := range []string{"dir/nested.txt", "dir/subdir/data.bin"} {
+		b, err := os.ReadFile(filepath.Join(extracted, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != testFiles[name] {
+			t.Errorf("%s: content mismatch", name)
+		}
+	}
+}
+
+// TestTransferDedup sends a deduplicated backup twice, checks that every chunk
+// of the second one is referenced rather than sent, and restores the backup.
+func TestTransferDedup(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+
+	// A manifest isn't a zip archive.
+	outFile := strings.TrimSuffix(testOutFile, ".zip")
+
+	var chunks int64
+
+	for _, content := range testFiles {
+		if len(content) != 0 {
+			chunks++
+		}
+	}
+
+	for _, expected := range []int64{0, chunks} {
+		mustTransfer(t, srcDir, dstDir, outFile, transferOptions{
+			Dedup:       true,
+			DedupChunks: expected,
+		})
+	}
+
+	target, err := Restore(filepath.Join(dstDir, outFile), "", "", t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifyTestFiles(t, target)
+}
+
+// TestTransferShards sends 3 shards of a backup to receivers of their own, any
+// 2 of which restore it, and restores it of the first and the last one.
+func TestTransferShards(t *testing.T) {
+	srcDir, _ := newTestDirs(t)
+
+	set, err := NewShardSet(2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.Remove()
+
+	var shards []string
+
+	for i := 0; i < 3; i++ {
+		dstDir := t.TempDir()
+
+		err := testTransfer(srcDir, dstDir, testOutFile, transferOptions{
+			Shards:     set,
+			ShardIndex: i,
+		})
+		if err != nil {
+			t.Fatalf("shard %d: %v", i+1, err)
+		}
+
+		shards = append(shards, filepath.Join(dstDir, fmt.Sprintf("%s.%d-of-3%s", testOutFile, i+1, ShardExt)))
+	}
+
+	restoredDir := t.TempDir()
+
+	joined, err := JoinShards([]string{shards[0], shards[2]}, restoredDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := Restore(joined, testPassword1, testPassword2, restoredDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifyTestFiles(t, target)
+}
+
+// TestTransferStreamKey sends a single file encrypted with a stream key, and
+// checks that it's stored encrypted and decrypted with the key only.
+func TestTransferStreamKey(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+	restoredDir := t.TempDir()
+
+	mustTransfer(t, srcDir, dstDir, "", transferOptions{StreamFile: filepath.Join(srcDir, "file.txt")})
+
+	stored := filepath.Join(dstDir, "file.txt"+crypto.StreamExt)
+
+	b, err := os.ReadFile(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(b, []byte(testFiles["file.txt"])) {
+		t.Fatal("file is stored in plain")
+	}
+
+	if _, err := DecryptStream(stored, "wrong-"+testStreamKey, restoredDir); err == nil {
+		t.Fatal("file is decrypted with a wrong key")
+	}
+
+	target, err := DecryptStream(stored, testStreamKey, restoredDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != testFiles["file.txt"] {
+		t.Fatal("decrypted file mismatch")
+	}
+}
+
+// TestTransferReencrypt checks that a receiver stores a backup sealed for a
+// storage key without its outer archive, and that it's unsealed into the inner
+// archive.
+func TestTransferReencrypt(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+
+	id, key := newTestIdentity(t)
+
+	mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{ReceiverStorageKey: key})
+
+	sealed := filepath.Join(dstDir, testOutFile+SealedExt)
+
+	b, err := os.ReadFile(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(b, []byte("dir/nested.txt")) {
+		t.Fatal("stored backup is readable")
+	}
+
+	inner, err := Unseal(sealed, id, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = os.ReadFile(inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restoredDir := t.TempDir()
+
+	if err := extractTestArchive(b, testPassword1, restoredDir); err != nil {
+		t.Fatal(err)
+	}
+
+	verifyTestFiles(t, restoredDir)
+}
+
+// TestTransferEscrow sends a backup with passwords sealed for an escrow
+// identity to a receiver which stores it as is, to one which re-encrypts it and
+// to one which extracts it, and checks that passwords are recovered from both
+// stored backups.
+func TestTransferEscrow(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+
+	id, key := newTestIdentity(t)
+
+	mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{Escrow: key})
+	mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{Escrow: key, ReceiverStorageKey: key})
+
+	// An extracting receiver drops an escrowed key.
+	mustTransfer(t, srcDir, dstDir, testOutFile, transferOptions{Escrow: key, Extract: true})
+
+	for _, name := range []string{testOutFile, testOutFile + EscrowExt} {
+		password1, password2, err := RecoverKey(filepath.Join(dstDir, name), id)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if password1 != testPassword1 || password2 != testPassword2 {
+			t.Errorf("%s: recovered passwords mismatch", name)
+		}
+	}
+}
+
+// TestTransferRelay seals a backup for a recipient and sends it to a relay,
+// which can't open the envelope and stores it, and then forwards the envelope
+// to the recipient which extracts the backup.
+func TestTransferRelay(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+	relayDir := t.TempDir()
+
+	id, recipient := newTestIdentity(t)
+
+	// Sessions of hops don't matter within the process, a hop is only needed
+	// for the relay to keep the envelope.
+	err := testTransfer(srcDir, relayDir, testOutFile, transferOptions{
+		Recipient: recipient,
+		Route:     []string{uuid.New().String()},
+	})
+	if err != nil {
+		t.Fatalf("relay: %v", err)
+	}
+
+	stored, err := filepath.Glob(filepath.Join(relayDir, "*"+envelope.Ext))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != 1 {
+		t.Fatalf("relay: single envelope expected, %d found", len(stored))
+	}
+
+	b, err := os.ReadFile(stored[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(b, []byte(testOutFile)) {
+		t.Fatal("relay: envelope is readable")
+	}
+
+	err = testTransfer("", dstDir, testOutFile, transferOptions{
+		Extract:          true,
+		ForwardEnvelope:  stored[0],
+		ReceiverIdentity: id,
+	})
+	if err != nil {
+		t.Fatalf("recipient: %v", err)
+	}
+
+	verifyTestFiles(t, extractedDir(dstDir, testOutFile))
+}
+
+// newTestIdentity generates an envelope identity and parses its recipient key.
+func newTestIdentity(t *testing.T) (*envelope.Identity, *ecdh.PublicKey) {
+	t.Helper()
+
+	id, err := envelope.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := envelope.ParseRecipient(id.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id, key
+}
@@ -0,0 +1,395 @@
+package filemanager
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+// FormatTree is a format a source directory is sent in file by file rather than
+// as an archive, so that a receiver makes the same directory tree (see:
+// sendSourceDirTree()).
+const FormatTree = "tree"
+
+// treeMagic starts a tree stream, so that a receiver tells it apart from a file.
+var treeMagic = []byte("DBTREE\x00\x01")
+
+// Types of entries of a tree stream.
+const (
+	treeFile    = 'f'
+	treeDir     = 'd'
+	treeSymlink = 'l'
+	treeEnd     = 'e'
+)
+
+// sendSourceDirTree sends files of a source directory one by one as a tree
+// stream named OutputFilename, which a receiver makes a directory of (see:
+// receiveTree()). A stream starts with treeMagic and consists of entries of a
+// type, a slash-separated relative path, metadata (see: fileMeta) and either a
+// size and content of a file or a target of a symbolic link, and it ends with
+// an entry of treeEnd. Empty directories are sent as entries as well. Like tar,
+// a tree isn't encrypted other than by a connection it's sent over, and it's
+// verified by the checksums a transfer is carried with. If Dedup is set, a
+// dedup stream is sent instead, files of which are chunked (see: sendChunks()).
+func (m *Backupper) sendSourceDirTree(w io.Writer) error {
+	if err := m.writeHeader(m.cfg.OutputFilename, nil, w); err != nil {
+		return err
+	}
+
+	magic := treeMagic
+
+	if m.cfg.Dedup {
+		magic = dedupMagic
+
+		m.log.WithField(log.FieldFile, m.cfg.OutputFilename).Info("sending deduplicated backup")
+	} else {
+		m.log.WithField(log.FieldFile, m.cfg.OutputFilename).Info("sending directory tree")
+	}
+
+	m.setFilename(m.cfg.OutputFilename)
+
+	cw := &countingWriter{Writer: w}
+
+	if _, err := cw.Write(magic); err != nil {
+		return err
+	}
+
+	m.log.Info("directory tree is not encrypted, passwords are not used")
+
+	err := m.walkSourceDir(func(path, relPath string, fi fs.FileInfo, _ *FileRule) error {
+		return m.sendTreeEntry(cw, path, relPath, fi)
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := cw.Write([]byte{treeEnd}); err != nil {
+		return err
+	}
+
+	m.setArchiveBytes(cw.n)
+
+	return nil
+}
+
+// sendTreeEntry writes a file of a source directory at path to w. Special files
+// are skipped. A file whose size changes while it's sent is cut or padded with
+// zeros to the size written first, and is counted as modified.
+func (m *Backupper) sendTreeEntry(w io.Writer, path, relPath string, fi fs.FileInfo) error {
+	var (
+		typ  byte
+		meta []byte
+		link string
+	)
+
+	switch {
+	case fi.Mode().IsRegular():
+		typ = treeFile
+
+		if m.cfg.Dedup {
+			typ = treeChunked
+		}
+	case fi.IsDir():
+		typ = treeDir
+	case fi.Mode()&fs.ModeSymlink != 0:
+		var err error
+
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+
+		typ = treeSymlink
+	default:
+		m.log.WithField(log.FieldFile, relPath).Info("special file skipped")
+
+		return nil
+	}
+
+	name := filepath.ToSlash(relPath)
+
+	if len(name) > math.MaxUint16 || len(link) > math.MaxUint16 {
+		return errors.Errorf("%s: path is too long", relPath)
+	}
+
+	// Metadata of a link would be restored on its target.
+	if m.cfg.PreserveMeta && typ != treeSymlink {
+		meta = statMeta(fi).marshal()
+	}
+
+	hdr := treeHeader(typ, name, meta, link)
+
+	if typ == treeFile {
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(fi.Size()))
+	}
+
+	m.log.WithField(log.FieldFile, relPath).Debug("sending file")
+
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+
+	if typ == treeChunked {
+		return m.sendChunks(w, path, relPath, fi)
+	}
+
+	if typ != treeFile {
+		return nil
+	}
+
+	fw := &fixedSizeWriter{w: w, left: fi.Size()}
+
+	consistent, err := m.archiveFile(path, relPath, fi, fw)
+	if err != nil {
+		return err
+	}
+
+	resized := fw.cut || fw.left != 0
+
+	if err := fw.pad(); err != nil {
+		return err
+	}
+
+	if consistent && resized {
+		m.log.WithField(log.FieldFile, relPath).Info("file was modified during archiving, its copy may be inconsistent")
+
+		m.resultMx.Lock()
+		m.result.Stats.ModifiedFiles++
+		m.resultMx.Unlock()
+	}
+
+	return nil
+}
+
+// treeHeader returns a header of an entry of a type, a name and metadata, which
+// is followed by a target of a symbolic link.
+func treeHeader(typ byte, name string, meta []byte, link string) []byte {
+	hdr := []byte{typ}
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(name)))
+	hdr = append(hdr, name...)
+	hdr = append(hdr, uint8(len(meta)))
+	hdr = append(hdr, meta...)
+
+	if typ == treeSymlink {
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(link)))
+		hdr = append(hdr, link...)
+	}
+
+	return hdr
+}
+
+// isTree tells whether a received file coming from r is a tree stream.
+func isTree(r *bufio.Reader) (bool, error) {
+	return hasMagic(r, treeMagic)
+}
+
+func hasMagic(r *bufio.Reader, magic []byte) (bool, error) {
+	b, err := r.Peek(len(magic))
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+
+	return bytes.Equal(b, magic), nil
+}
+
+// receiveTree makes a directory named name of a tree stream coming from r (see:
+// sendSourceDirTree()). Just like an extracted archive (see: extractFile()), a
+// tree is made in a temporary directory first and then replaces the previous
+// version which is shifted, or is quarantined if it fails to be received.
+func (m *Backupper) receiveTree(name string, r io.Reader) error {
+	if _, ok := m.storage.(DirStorage); !ok {
+		return errors.New("directory tree requires a local destination directory")
+	}
+
+	// A tree isn't protected with passwords to be re-encrypted.
+	if m.cfg.StorageKey != nil {
+		return errors.New("directory tree conflicts with re-encryption")
+	}
+
+	if filepath.Base(name) != name || !filepath.IsLocal(name) {
+		return errors.Errorf("unsafe directory tree name: %s", name)
+	}
+
+	path := m.storage.Location(name)
+	tmpPath := path + partialSuffix
+
+	m.log.WithFields(log.Fields{
+		log.FieldFile: name,
+		log.FieldDir:  path,
+	}).Info("receiving directory tree")
+
+	m.setFilename(name)
+
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(tmpPath, 0775); err != nil {
+		return err
+	}
+
+	links, err := m.readTree(r, tmpPath)
+	if err == nil {
+		err = m.makeSymlinks(tmpPath, links)
+	}
+
+	if err != nil {
+		m.quarantine(name+partialSuffix, name, err)
+
+		return err
+	}
+
+	m.shiftFileVersions(name, true)
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	m.setStored(name, name, 0, nil)
+
+	return nil
+}
+
+// readTree makes entries of a tree stream in dir. Symbolic links aren't made but
+// returned (see: makeSymlinks()).
+func (m *Backupper) readTree(r io.Reader, dir string) ([]archivedSymlink, error) {
+	if _, err := io.ReadFull(r, make([]byte, len(treeMagic))); err != nil {
+		return nil, err
+	}
+
+	var links []archivedSymlink
+
+	for {
+		var typ [1]byte
+
+		if _, err := io.ReadFull(r, typ[:]); err != nil {
+			return nil, errors.Wrap(err, "directory tree")
+		}
+
+		if typ[0] == treeEnd {
+			break
+		}
+
+		name, err := readTreeString(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "directory tree")
+		}
+
+		if err := m.readTreeEntry(r, typ[0], name, dir, &links); err != nil {
+			return nil, errors.Wrap(err, name)
+		}
+	}
+
+	// The rest of a stream is empty unless a sender has written something
+	// after the end entry.
+	if n, err := io.Copy(io.Discard, r); err != nil {
+		return nil, err
+	} else if n != 0 {
+		return nil, errors.New("directory tree: data after the end")
+	}
+
+	return links, nil
+}
+
+func (m *Backupper) readTreeEntry(r io.Reader, typ byte, name, dir string, links *[]archivedSymlink) error {
+	// Entries must not be written outside a destination directory whatever a
+	// sender puts into a stream.
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return errors.New("unsafe entry path")
+	}
+
+	var metaLen [1]byte
+
+	if _, err := io.ReadFull(r, metaLen[:]); err != nil {
+		return err
+	}
+
+	b := make([]byte, metaLen[0])
+
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+
+	meta, err := parseMeta(b)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, filepath.FromSlash(name))
+
+	switch typ {
+	case treeSymlink:
+		target, err := readTreeString(r)
+		if err != nil {
+			return err
+		}
+
+		*links = append(*links, archivedSymlink{name: name, target: target})
+
+		return nil
+	case treeDir:
+		if err := os.MkdirAll(path, 0775); err != nil {
+			return err
+		}
+	case treeFile:
+		var size uint64
+
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return err
+		}
+
+		m.log.WithField(log.FieldFile, name).Debug("receiving file")
+
+		if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+			return err
+		}
+
+		if err := m.saveFile(path, io.LimitReader(r, int64(size))); err != nil {
+			return err
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		if uint64(fi.Size()) != size {
+			return io.ErrUnexpectedEOF
+		}
+
+		m.addFileStats(name, fi.Size())
+	default:
+		return errors.Errorf("unknown entry type %q", typ)
+	}
+
+	if meta != nil && m.cfg.PreserveMeta {
+		return meta.restore(path)
+	}
+
+	return nil
+}
+
+// readTreeString reads a string prefixed with its 2 bytes long length.
+func readTreeString(r io.Reader) (string, error) {
+	var n uint16
+
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return "", err
+	}
+
+	b := make([]byte, n)
+
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
@@ -0,0 +1,369 @@
+package filemanager
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/peer"
+
+	"github.com/pkg/errors"
+)
+
+// RoleSync is a role of a peer which both sends and receives (see: Sync).
+const RoleSync = "sync"
+
+// Tags of messages of halves of a connection of two-way sync, which tell a half
+// of the other peer a message is for: frames of a sender are read by a receiver
+// and the other way round. A message of a tag alone closes a half.
+const (
+	syncSenderTag   byte = 's'
+	syncReceiverTag byte = 'r'
+)
+
+// syncMessages is a number of messages a half keeps until they're read.
+const syncMessages = 64
+
+var errHalfShutdown = errors.New("half of a connection is shut down")
+
+// newSyncBackupper returns a sender of a source entry which carries a receiver
+// into a destination directory along with it (see: Sync). Both transfers go over
+// halves of conn at once and are independent of each other, so that either one
+// may fail while the other succeeds.
+func newSyncBackupper(cfg BackupperConfig, conn Peer) (*Backupper, error) {
+	mux := newSyncMux(conn)
+
+	senderCfg, receiverCfg := splitSyncConfig(cfg)
+	senderCfg.Log = cfg.Log.WithField(log.FieldRole, RoleSender)
+	receiverCfg.Log = cfg.Log.WithField(log.FieldRole, RoleReceiver)
+
+	m, err := NewBackupper(senderCfg, mux.halves[0])
+	if err != nil {
+		return nil, err
+	}
+
+	m.reverse, err = NewBackupper(receiverCfg, mux.halves[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "receiver")
+	}
+
+	m.syncDone = make(chan struct{})
+
+	go func() {
+		<-m.shutdownChan
+		<-m.reverse.shutdownChan
+
+		// Both halves are shut down, and so is a connection.
+		for _, h := range mux.halves {
+			h.Shutdown()
+		}
+
+		close(m.syncDone)
+	}()
+
+	return m, nil
+}
+
+// splitSyncConfig returns configs of a sender and a receiver of two-way sync,
+// options of a receiver are left out of a sender's one.
+func splitSyncConfig(cfg BackupperConfig) (BackupperConfig, BackupperConfig) {
+	sender := cfg
+	sender.Sync = false
+	sender.DestinationDir = ""
+	sender.Versions = 0
+	sender.Retention = nil
+	sender.Storage = nil
+	sender.StorageKey = nil
+	sender.Identity = nil
+	sender.Extract = false
+	sender.MaxSize = 0
+
+	receiver := cfg
+	receiver.Sync = false
+	receiver.SourceEntry = ""
+
+	return sender, receiver
+}
+
+// validateSyncConfig checks configs of both a sender and a receiver of two-way
+// sync.
+func validateSyncConfig(cfg BackupperConfig) error {
+	if len(cfg.SourceEntry) == 0 || (len(cfg.DestinationDir) == 0 && cfg.Storage == nil) {
+		return errors.New("sync requires a source entry and a destination")
+	}
+
+	if cfg.ResumeTimeout != 0 || cfg.Forward || cfg.Shards != nil || len(cfg.Sources) != 0 || len(cfg.Pull) != 0 {
+		return errors.New("sync conflicts with resuming, forwarding, shards and pulling")
+	}
+
+	sender, receiver := splitSyncConfig(cfg)
+
+	if err := ValidateConfig(sender); err != nil {
+		return err
+	}
+
+	return errors.Wrap(ValidateConfig(receiver), "receiver")
+}
+
+// syncResult merges a result of a receiver of two-way sync into one of a
+// sender: it has the role of RoleSync, a transfer is finished once both are,
+// and either one fails it.
+func (m *Backupper) syncResult(result Result) Result {
+	reverse := m.reverse.Result()
+
+	result.Role = RoleSync
+	result.SentBytes += reverse.SentBytes
+	result.ReceivedBytes += reverse.ReceivedBytes
+	result.Reverse = &reverse
+
+	switch {
+	case result.Phase == PhaseFinished && reverse.Phase == PhaseFinished:
+		if reverse.FinishedAt.After(result.FinishedAt) {
+			result.FinishedAt = reverse.FinishedAt
+		}
+	case result.Phase == PhaseWaiting && reverse.Phase == PhaseWaiting:
+	default:
+		result.Phase = PhaseTransferring
+		result.FinishedAt = time.Time{}
+	}
+
+	if result.StartedAt.IsZero() || (!reverse.StartedAt.IsZero() && reverse.StartedAt.Before(result.StartedAt)) {
+		result.StartedAt = reverse.StartedAt
+	}
+
+	switch {
+	case result.Err != nil && reverse.Err != nil:
+		result.Err = errors.Errorf("sending: %s; receiving: %s", result.Err, reverse.Err)
+	case reverse.Err != nil:
+		result.Err = errors.Wrap(reverse.Err, "receiving")
+	case result.Err != nil:
+		result.Err = errors.Wrap(result.Err, "sending")
+	}
+
+	if len(reverse.Quarantined) != 0 {
+		result.Quarantined = reverse.Quarantined
+	}
+
+	return result
+}
+
+// syncMux splits a connection into halves of a sender and a receiver (see:
+// syncHalf), messages of which are tagged.
+type syncMux struct {
+	peer   Peer
+	halves [2]*syncHalf
+
+	mx       sync.Mutex
+	shutdown int
+}
+
+func newSyncMux(conn Peer) *syncMux {
+	mux := &syncMux{peer: conn}
+
+	for i, tag := range []byte{syncSenderTag, syncReceiverTag} {
+		mux.halves[i] = &syncHalf{
+			mux:      mux,
+			tag:      tag,
+			messages: make(chan []byte, syncMessages),
+			done:     make(chan struct{}),
+		}
+	}
+
+	conn.OnEstablish(mux.onEstablish)
+
+	return mux
+}
+
+// onEstablish starts transfers of both halves once a connection is established.
+func (mux *syncMux) onEstablish() {
+	var wg sync.WaitGroup
+
+	for _, h := range mux.halves {
+		mux.mx.Lock()
+		f := h.onEstablish
+		mux.mx.Unlock()
+
+		if f == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			f()
+		}()
+	}
+
+	go mux.read()
+
+	wg.Wait()
+}
+
+// read passes messages of a connection to halves they're tagged for until it
+// fails, and fails both halves then.
+func (mux *syncMux) read() {
+	buf := make([]byte, maxMessageSize+1)
+
+	for {
+		n, err := mux.peer.Read(buf)
+		if err != nil {
+			for _, h := range mux.halves {
+				h.fail(err)
+			}
+
+			return
+		}
+
+		if n == 0 {
+			continue
+		}
+
+		h := mux.halves[0]
+		if buf[0] == syncSenderTag {
+			h = mux.halves[1]
+		}
+
+		// A message alone closes a half, it's passed in order with others.
+		var message []byte
+
+		if n > 1 {
+			message = append([]byte(nil), buf[1:n]...)
+		}
+
+		select {
+		case h.messages <- message:
+		case <-h.done:
+		}
+	}
+}
+
+// syncHalf is a half of a connection of two-way sync, which carries either a
+// transfer a peer sends or one it receives.
+type syncHalf struct {
+	mux *syncMux
+	tag byte
+
+	// messages are ones of the other peer's half of the other role, nil closes
+	// it.
+	messages    chan []byte
+	onEstablish func()
+	// shut is set once a half is shut down, it's guarded by a mutex of mux.
+	shut bool
+
+	mx   sync.Mutex
+	err  error
+	done chan struct{}
+}
+
+func (h *syncHalf) Read(payload []byte) (int, error) {
+	h.mx.Lock()
+	err := h.err
+	h.mx.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	select {
+	case message := <-h.messages:
+		if message == nil {
+			h.fail(io.EOF)
+
+			return 0, io.EOF
+		}
+
+		return copy(payload, message), nil
+	case <-h.done:
+		h.mx.Lock()
+		defer h.mx.Unlock()
+
+		return 0, h.err
+	}
+}
+
+func (h *syncHalf) Write(payload []byte) (int, error) {
+	h.mx.Lock()
+	err := h.err
+	h.mx.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := h.mux.peer.Write(append([]byte{h.tag}, payload...)); err != nil {
+		return 0, err
+	}
+
+	return len(payload), nil
+}
+
+// Shutdown closes a half of the other peer, and shuts a connection down once
+// both halves are.
+func (h *syncHalf) Shutdown() {
+	h.fail(errHalfShutdown)
+
+	h.mux.mx.Lock()
+	shut := h.shut
+	h.shut = true
+
+	if !shut {
+		h.mux.shutdown++
+	}
+
+	last := !shut && h.mux.shutdown == len(h.mux.halves)
+	h.mux.mx.Unlock()
+
+	if shut {
+		return
+	}
+
+	h.mux.peer.Write([]byte{h.tag})
+
+	if last {
+		h.mux.peer.Shutdown()
+	}
+}
+
+func (h *syncHalf) OnEstablish(f func()) {
+	h.mux.mx.Lock()
+	defer h.mux.mx.Unlock()
+
+	h.onEstablish = f
+}
+
+// ConnectionInfo describes a connection halves share, if its peer tells it.
+func (h *syncHalf) ConnectionInfo() (*peer.ConnectionInfo, error) {
+	p, ok := h.mux.peer.(connInfoPeer)
+	if !ok {
+		return nil, errors.New("connection isn't described")
+	}
+
+	return p.ConnectionInfo()
+}
+
+// CertificateFingerprints returns ones of a connection halves share, if its
+// peer is a binder (see: ChannelBinder).
+func (h *syncHalf) CertificateFingerprints() (local, remote string, err error) {
+	p, ok := h.mux.peer.(ChannelBinder)
+	if !ok {
+		return "", "", nil
+	}
+
+	return p.CertificateFingerprints()
+}
+
+// fail makes reads and writes of a half fail with err unless it has failed
+// already.
+func (h *syncHalf) fail(err error) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	if h.err != nil {
+		return
+	}
+
+	h.err = err
+	close(h.done)
+}
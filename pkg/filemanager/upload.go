@@ -0,0 +1,65 @@
+package filemanager
+
+import (
+	"context"
+	"io"
+
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+// ErrTransferStarted means that a sender can't fall back to an upload since a
+// peer has connected.
+var ErrTransferStarted = errors.New("transfer to a peer has already started")
+
+// Uploader uploads a file to a fallback destination (see: upload.Uploader).
+type Uploader interface {
+	Upload(ctx context.Context, name string, r io.Reader) error
+}
+
+// Upload sends a source entry to u instead of Peer, which a sender falls back to
+// when no peer connects in time. A file is prepared just like it's sent to Peer,
+// and its name is taken off the beginning of sent data. It fails with
+// ErrTransferStarted if a peer has connected, and a transfer finishes once the
+// upload does.
+func (m *Backupper) Upload(ctx context.Context, u Uploader) error {
+	if !m.startTransfer() {
+		return ErrTransferStarted
+	}
+
+	pr, pw := io.Pipe()
+	prepared := make(chan struct{})
+
+	go func() {
+		defer close(prepared)
+
+		pw.CloseWithError(m.sendSourceEntry(&contextWriter{ctx: ctx, w: pw}))
+	}()
+
+	err := func() error {
+		name, _, err := m.readHeader(pr)
+		if err != nil {
+			return err
+		}
+
+		m.log.WithField(log.FieldFile, name).Info("uploading file to a fallback destination")
+
+		return u.Upload(ctx, name, pr)
+	}()
+
+	// Preparing a file is stopped if an upload fails.
+	pr.CloseWithError(errors.New("upload is stopped"))
+	<-prepared
+
+	if err != nil {
+		err = errors.Wrap(err, "upload")
+		m.log.Error(err)
+	} else {
+		m.log.Info("file uploaded")
+	}
+
+	m.finishTransfer(err)
+
+	return err
+}
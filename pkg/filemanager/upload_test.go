@@ -0,0 +1,203 @@
+package filemanager
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/peer"
+	"distributed-backup/pkg/signal"
+	"distributed-backup/pkg/upload"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/webdav"
+)
+
+// interruptedUpload fails once files are being archived through a cache with
+// a journal, as if a sender was killed in the middle of a backup.
+type interruptedUpload struct {
+	journal string
+}
+
+func (u interruptedUpload) Upload(_ context.Context, _ string, r io.Reader) error {
+	b := make([]byte, 1)
+
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+
+		if _, err := os.Stat(u.journal); err == nil {
+			return errors.New("upload is interrupted")
+		}
+	}
+}
+
+// testUpload uploads a backup of a sender configured with cfg to u.
+func testUpload(cfg BackupperConfig, u Uploader) error {
+	// A sender isn't dialed, so no peer ever connects to it.
+	_, senderSignal := signal.NewMemoryPair()
+
+	senderPeer, err := peer.NewWebRTC(peer.WebRTCConfig{}, senderSignal)
+	if err != nil {
+		return err
+	}
+	defer senderPeer.Close()
+
+	cfg.Log = log.WithField(log.FieldRole, RoleSender)
+
+	sender, err := NewBackupper(cfg, senderPeer)
+	if err != nil {
+		return err
+	}
+
+	return sender.Upload(context.Background(), u)
+}
+
+// newTestWebDAV runs a server of PUT and MOVE requests of a WebDAV collection
+// "/backups" stored in dir, and returns an uploader to it.
+func newTestWebDAV(t *testing.T, dir string) Uploader {
+	t.Helper()
+
+	path := func(p string) string {
+		return filepath.Join(dir, filepath.Base(p))
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		switch r.Method {
+		case http.MethodPut:
+			var f *os.File
+
+			if f, err = os.Create(path(r.URL.Path)); err == nil {
+				_, err = io.Copy(f, r.Body)
+				f.Close()
+			}
+		case "MOVE":
+			var dst *url.URL
+
+			if dst, err = url.Parse(r.Header.Get("Destination")); err == nil {
+				err = os.Rename(path(r.URL.Path), path(dst.Path))
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	t.Cleanup(server.Close)
+
+	u, err := upload.New(upload.Config{
+		URL: strings.Replace(server.URL, "http", "webdav", 1) + "/backups",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u
+}
+
+// TestUploadFallback uploads a backup to a WebDAV server as a sender does when
+// no peer connects, and restores it.
+func TestUploadFallback(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+
+	err := testUpload(BackupperConfig{
+		ZipDir:         true,
+		SourceEntry:    srcDir,
+		OutputFilename: testOutFile,
+		Password1:      testPassword1,
+		Password2:      testPassword2,
+	}, newTestWebDAV(t, dstDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restoreTestBackup(t, filepath.Join(dstDir, testOutFile), t.TempDir())
+}
+
+// TestUploadArchiveCache interrupts an upload of a backup archived through a
+// cache, checks that the cache is kept for the next run, and resumes the
+// backup.
+func TestUploadArchiveCache(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+	cacheDir := t.TempDir()
+
+	cfg := BackupperConfig{
+		ZipDir:         true,
+		SourceEntry:    srcDir,
+		OutputFilename: testOutFile,
+		Password1:      testPassword1,
+		Password2:      testPassword2,
+		ArchiveCache:   cacheDir,
+	}
+
+	journal := filepath.Join(cacheDir, testOutFile+".cache", "journal")
+
+	if err := testUpload(cfg, interruptedUpload{journal}); err == nil {
+		t.Fatal("interrupted upload succeeded")
+	}
+
+	if _, err := os.Stat(journal); err != nil {
+		t.Fatalf("cache of interrupted backup: %v", err)
+	}
+
+	if err := testUpload(cfg, newTestWebDAV(t, dstDir)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Dir(journal)); !os.IsNotExist(err) {
+		t.Error("cache of sent backup is not removed")
+	}
+
+	restoreTestBackup(t, filepath.Join(dstDir, testOutFile), t.TempDir())
+}
+
+// TestRemoteStorage makes a receiver store two versions of a backup in a WebDAV
+// storage, and restores the last one.
+func TestRemoteStorage(t *testing.T) {
+	srcDir, dstDir := newTestDirs(t)
+
+	server := httptest.NewServer(&webdav.Handler{
+		FileSystem: webdav.Dir(dstDir),
+		LockSystem: webdav.NewMemLS(),
+	})
+	defer server.Close()
+
+	storage, err := upload.NewStorage(upload.Config{
+		URL: strings.Replace(server.URL, "http", "webdav", 1) + "/backups",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	for i := 0; i < 2; i++ {
+		mustTransfer(t, srcDir, "", testOutFile, transferOptions{ReceiverStorage: storage})
+	}
+
+	path := filepath.Join(dstDir, "backups", testOutFile)
+
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+
+	restoreTestBackup(t, path, t.TempDir())
+}
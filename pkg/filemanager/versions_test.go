@@ -0,0 +1,47 @@
+package filemanager
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"distributed-backup/pkg/log"
+)
+
+func TestShiftFileVersionsRemovesOnlyTrees(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		tree    bool
+		removed bool
+	}{
+		{name: "file", tree: false, removed: false},
+		{name: "tree", tree: true, removed: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := t.TempDir()
+
+			// The oldest version is a directory with contents whatever a file
+			// stored by its name is.
+			if err := os.MkdirAll(filepath.Join(dst, "backup", "sub"), 0775); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.WriteFile(filepath.Join(dst, "backup", "sub", "file"), nil, 0664); err != nil {
+				t.Fatal(err)
+			}
+
+			m := &Backupper{
+				cfg:     BackupperConfig{DestinationDir: dst, Versions: 1},
+				log:     log.New(),
+				storage: DirStorage(dst),
+			}
+
+			m.shiftFileVersions("backup", tt.tree)
+
+			_, err := os.Stat(filepath.Join(dst, "backup", "sub", "file"))
+			if removed := os.IsNotExist(err); removed != tt.removed {
+				t.Errorf("directory removed = %t, want %t", removed, tt.removed)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package filemanager
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"distributed-backup/pkg/log"
+
+	"github.com/TelenLiu/go-zip"
+)
+
+// zip64Size is a size of a file which takes zip64 records to be archived, a
+// source file of it is sparse, so only its tail takes space on a disk.
+const zip64Size = 4<<30 + 1<<20
+
+var zip64Tail = []byte("end of a file over 4 GiB")
+
+// newZip64Backupper returns a sender of a directory with a file over 4 GiB
+// followed by a small one. The large file is stored (see: StoreExtensions), so
+// that the small one is at an offset over 4 GiB of an archive as well.
+func newZip64Backupper(t *testing.T) *Backupper {
+	t.Helper()
+
+	if testing.Short() {
+		t.Skip("a file over 4 GiB is archived")
+	}
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+
+	if err := os.Mkdir(src, 0775); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(filepath.Join(src, "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.WriteAt(zip64Tail, zip64Size-int64(len(zip64Tail))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(src, "small.txt"), []byte("small"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	l := log.New()
+
+	return &Backupper{
+		cfg: BackupperConfig{
+			SourceEntry:     src,
+			OutputFilename:  "big.zip",
+			StoreExtensions: []string{"bin"},
+			ArchiveCache:    filepath.Join(dir, "cache"),
+		},
+		log:  l,
+		peer: newCountingPeer(nil, l, false),
+	}
+}
+
+// sparseWriter writes to a file skipping blocks of zeros, which are left holes
+// of it, so that an archive of a sparse file doesn't take its size on a disk.
+type sparseWriter struct {
+	f   *os.File
+	off int64
+}
+
+const sparseBlockLen = 4096
+
+var sparseZeros [sparseBlockLen]byte
+
+func newSparseWriter(t *testing.T, path string) *sparseWriter {
+	t.Helper()
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	return &sparseWriter{f: f}
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		block := p
+		if len(block) > sparseBlockLen {
+			block = block[:sparseBlockLen]
+		}
+
+		if !bytes.Equal(block, sparseZeros[:len(block)]) {
+			if _, err := w.f.WriteAt(block, w.off); err != nil {
+				return 0, err
+			}
+		}
+
+		w.off += int64(len(block))
+		p = p[len(block):]
+	}
+
+	return n, nil
+}
+
+// Close extends a file over a trailing hole.
+func (w *sparseWriter) Close() error {
+	if err := w.f.Truncate(w.off); err != nil {
+		return err
+	}
+
+	return w.f.Close()
+}
+
+// zip64TailWriter counts bytes written to it and keeps the last ones.
+type zip64TailWriter struct {
+	n    int64
+	tail []byte
+}
+
+func (w *zip64TailWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	w.tail = append(w.tail, p...)
+
+	if len(w.tail) > len(zip64Tail) {
+		w.tail = w.tail[len(w.tail)-len(zip64Tail):]
+	}
+
+	return len(p), nil
+}
+
+func assertZip64Entry(t *testing.T, name string, r io.Reader) {
+	t.Helper()
+
+	var w zip64TailWriter
+
+	if _, err := io.Copy(&w, r); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+
+	if w.n != zip64Size || !bytes.Equal(w.tail, zip64Tail) {
+		t.Fatalf("%s: read %d bytes ending with %q, want %d ending with %q", name, w.n, w.tail, int64(zip64Size), zip64Tail)
+	}
+}
+
+// assertZip64Archive reads an archive of a zip64 backupper both with go-zip,
+// which locates entries by the central directory, and as a stream.
+func assertZip64Archive(t *testing.T, path string) {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(zr.File) != 2 || zr.File[0].Name != "big.bin" || zr.File[1].Name != "small.txt" {
+		t.Fatalf("unexpected entries: %v", zr.File)
+	}
+
+	if off, err := zr.File[1].DataOffset(); err != nil || off <= uint32max {
+		t.Fatalf("small.txt is at %d, %v, want an offset over 4 GiB", off, err)
+	}
+
+	big, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertZip64Entry(t, "big.bin", big)
+	big.Close()
+
+	small, err := zr.File[1].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := io.ReadAll(small); err != nil || string(b) != "small" {
+		t.Fatalf("small.txt = %q, %v", b, err)
+	}
+	small.Close()
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	zs := newZipStreamReader(f, "")
+
+	e, err := zs.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertZip64Entry(t, "streamed "+e.Name, e)
+
+	if e, err = zs.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := io.ReadAll(e); err != nil || string(b) != "small" {
+		t.Fatalf("streamed %s = %q, %v", e.Name, b, err)
+	}
+
+	if _, err := zs.Next(); err != io.EOF {
+		t.Fatalf("Next() = %v after the last entry, want io.EOF", err)
+	}
+}
+
+// TestArchiveDirZip64 archives a file over 4 GiB with go-zip directly.
+func TestArchiveDirZip64(t *testing.T) {
+	m := newZip64Backupper(t)
+	path := filepath.Join(t.TempDir(), "inner.zip")
+	w := newSparseWriter(t, path)
+
+	z := newInnerWriter(w, 0)
+
+	if err := m.archiveDir(z); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertZip64Archive(t, path)
+}
+
+// TestArchiveDirCachedZip64 assembles an archive of cached ones of a file over
+// 4 GiB, the central directory header of the file following it is moved to an
+// offset over 4 GiB, and the central directory is located by zip64 records.
+func TestArchiveDirCachedZip64(t *testing.T) {
+	m := newZip64Backupper(t)
+	path := filepath.Join(t.TempDir(), "inner.zip")
+	w := newSparseWriter(t, path)
+
+	if err := m.archiveDirCached(w); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertZip64Archive(t, path)
+}
@@ -0,0 +1,605 @@
+package filemanager
+
+import (
+	"bufio"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/TelenLiu/go-zip"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	zipFileHeaderSignature      = 0x04034b50
+	zipDirectoryHeaderSignature = 0x02014b50
+	zipDirectoryEndSignature    = 0x06054b50
+	zipDataDescriptorSignature  = 0x08074b50
+
+	zipFileHeaderLen  = 30
+	zipCryptHeaderLen = 12
+
+	zipFlagEncrypted      = 0x1
+	zipFlagDataDescriptor = 0x8
+
+	zipMethodAES = 99
+
+	// zipAESExtraID is an ID of an extra field of an entry protected with the
+	// WinZip AES encryption, which holds its actual compression method.
+	zipAESExtraID = 0x9901
+	// zipAESVerifierLen and zipAESAuthLen are lengths of a password verifier
+	// following a salt and an authentication code following encrypted data.
+	zipAESVerifierLen = 2
+	zipAESAuthLen     = 10
+
+	uint32max = 1<<32 - 1
+)
+
+var (
+	errZipFormat    = errors.New("zip: not a valid zip stream")
+	errZipChecksum  = errors.New("zip: checksum error")
+	errZipPassword  = errors.New("zip: invalid password")
+	errZipAlgorithm = errors.New("zip: unsupported compression or encryption method")
+	errZipAuth      = errors.New("zip: authentication failed")
+)
+
+// zipStreamReader reads entries of a ZIP archive one by one as they come from a
+// stream, unlike zip.Reader which needs random access to a central directory at
+// the end of a file. It supports archives written by zip.Writer: entries which
+// are deflated or stored with known sizes, and protected with either the WinZip
+// AES or the standard (ZipCrypto) encryption.
+type zipStreamReader struct {
+	r        *bufio.Reader
+	password string
+
+	cur *zipStreamEntry
+}
+
+// newZipStreamReader returns a reader of a stream. The password is used to
+// decrypt entries which are encrypted.
+func newZipStreamReader(r io.Reader, password string) *zipStreamReader {
+	return &zipStreamReader{
+		r:        bufio.NewReader(r),
+		password: password,
+	}
+}
+
+// zipStreamEntry is an entry content of which is read and verified against its
+// checksum and sizes on the fly, the last Read returns an error if they mismatch.
+type zipStreamEntry struct {
+	zip.FileHeader
+
+	r          io.Reader
+	compressed *countingByteReader
+	crc        hash.Hash32
+	size       uint64
+	err        error
+
+	// aes decrypts an entry protected with the WinZip AES encryption, an
+	// authentication code of which follows its data.
+	aes *zipAESReader
+}
+
+// Next skips the rest of the current entry and returns the next one, or io.EOF
+// if there are no entries left.
+func (z *zipStreamReader) Next() (*zipStreamEntry, error) {
+	if z.cur != nil {
+		if _, err := io.Copy(io.Discard, z.cur); err != nil {
+			return nil, err
+		}
+
+		z.cur = nil
+	}
+
+	var buf [zipFileHeaderLen]byte
+
+	if _, err := io.ReadFull(z.r, buf[:4]); err != nil {
+		return nil, errors.Wrap(unexpectedEOF(err), "zip")
+	}
+
+	switch binary.LittleEndian.Uint32(buf[:4]) {
+	case zipFileHeaderSignature:
+	case zipDirectoryHeaderSignature, zipDirectoryEndSignature:
+		// The central directory duplicates local headers, so there is nothing
+		// to read there.
+		return nil, io.EOF
+	default:
+		return nil, errZipFormat
+	}
+
+	if _, err := io.ReadFull(z.r, buf[4:]); err != nil {
+		return nil, errors.Wrap(unexpectedEOF(err), "zip")
+	}
+
+	e := &zipStreamEntry{
+		crc: crc32.NewIEEE(),
+	}
+
+	b := buf[4:]
+	e.ReaderVersion = binary.LittleEndian.Uint16(b[0:])
+	e.Flags = binary.LittleEndian.Uint16(b[2:])
+	e.Method = binary.LittleEndian.Uint16(b[4:])
+	e.ModifiedTime = binary.LittleEndian.Uint16(b[6:])
+	e.ModifiedDate = binary.LittleEndian.Uint16(b[8:])
+	e.CRC32 = binary.LittleEndian.Uint32(b[10:])
+	e.CompressedSize64 = uint64(binary.LittleEndian.Uint32(b[14:]))
+	e.UncompressedSize64 = uint64(binary.LittleEndian.Uint32(b[18:]))
+
+	nameLen := int(binary.LittleEndian.Uint16(b[22:]))
+	extraLen := int(binary.LittleEndian.Uint16(b[24:]))
+
+	name := make([]byte, nameLen+extraLen)
+
+	if _, err := io.ReadFull(z.r, name); err != nil {
+		return nil, errors.Wrap(unexpectedEOF(err), "zip")
+	}
+
+	e.Name = string(name[:nameLen])
+	e.Extra = name[nameLen:]
+
+	if err := z.open(e); err != nil {
+		return nil, errors.Wrap(err, e.Name)
+	}
+
+	z.cur = e
+
+	return e, nil
+}
+
+func (z *zipStreamReader) open(e *zipStreamEntry) error {
+	e.compressed = &countingByteReader{r: z.r}
+
+	var r byteReader = e.compressed
+
+	method := e.Method
+
+	// An actual method of an entry protected with AES is kept in an extra field.
+	var aesExtra *zipAESExtra
+
+	if e.Flags&zipFlagEncrypted != 0 && e.Method == zipMethodAES {
+		var err error
+
+		if aesExtra, err = parseZipAESExtra(e.Extra); err != nil {
+			return err
+		}
+
+		method = aesExtra.method
+	}
+
+	if method == zip.Store {
+		// A size of stored data can't be found out otherwise.
+		if e.Flags&zipFlagDataDescriptor != 0 {
+			return errZipAlgorithm
+		}
+
+		n := int64(e.CompressedSize64)
+		if aesExtra != nil {
+			n -= zipAESAuthLen
+		}
+
+		r = &limitedByteReader{r: r, n: n}
+	}
+
+	if e.Flags&zipFlagEncrypted != 0 {
+		var (
+			d   byteReader
+			err error
+		)
+
+		if aesExtra != nil {
+			e.aes, err = newZipAESReader(r, z.password, aesExtra)
+			d = e.aes
+		} else {
+			d, err = newZipCryptoReader(r, z.password, e.checkByte())
+		}
+
+		if err != nil {
+			return err
+		}
+
+		r = d
+	}
+
+	switch method {
+	case zip.Store:
+		e.r = r
+	case zip.Deflate:
+		// The decompressor reads exactly as much as compressed data takes given
+		// an io.ByteReader, so the rest of a stream is left intact.
+		e.r = flate.NewReader(r)
+	default:
+		return errZipAlgorithm
+	}
+
+	return nil
+}
+
+// checkByte returns a byte an encryption header is verified with.
+func (e *zipStreamEntry) checkByte() byte {
+	if e.Flags&zipFlagDataDescriptor != 0 {
+		return byte(e.ModifiedTime >> 8)
+	}
+
+	return byte(e.CRC32 >> 24)
+}
+
+func (e *zipStreamEntry) Read(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+
+	n, err := e.r.Read(p)
+	e.crc.Write(p[:n])
+	e.size += uint64(n)
+
+	if err == io.EOF {
+		if verr := e.verify(); verr != nil {
+			err = verr
+		}
+	}
+
+	if err != nil {
+		e.err = err
+	}
+
+	return n, err
+}
+
+// verify reads a data descriptor if any and checks read content against it.
+// Content protected with AES is checked against its authentication code, and a
+// checksum of an AE-2 entry isn't kept.
+func (e *zipStreamEntry) verify() error {
+	if e.aes != nil {
+		if err := e.aes.authenticate(e.compressed); err != nil {
+			return err
+		}
+	}
+
+	if e.Flags&zipFlagDataDescriptor != 0 {
+		if err := e.readDataDescriptor(); err != nil {
+			return err
+		}
+	}
+
+	if e.CompressedSize64 != uint64(e.compressed.n) || e.UncompressedSize64 != e.size {
+		return errors.Wrap(errZipFormat, "size mismatch")
+	}
+
+	if e.CRC32 != e.crc.Sum32() && (e.aes == nil || e.aes.version != 2) {
+		return errZipChecksum
+	}
+
+	return nil
+}
+
+func (e *zipStreamEntry) readDataDescriptor() error {
+	r := e.compressed.r
+
+	var buf [8]byte
+
+	if _, err := io.ReadFull(r, buf[:4]); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	// The signature is optional.
+	if binary.LittleEndian.Uint32(buf[:4]) == zipDataDescriptorSignature {
+		if _, err := io.ReadFull(r, buf[:4]); err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+
+	e.CRC32 = binary.LittleEndian.Uint32(buf[:4])
+
+	// Sizes are 8 bytes long if any of them doesn't fit 4 ones (see:
+	// zip.fileWriter.close()), go-zip still writes 4 bytes for a size of
+	// exactly 0xffffffff unlike archive/zip.
+	if uint64(e.compressed.n) > uint32max || e.size > uint32max {
+		if _, err := io.ReadFull(r, buf[:8]); err != nil {
+			return unexpectedEOF(err)
+		}
+		e.CompressedSize64 = binary.LittleEndian.Uint64(buf[:8])
+
+		if _, err := io.ReadFull(r, buf[:8]); err != nil {
+			return unexpectedEOF(err)
+		}
+		e.UncompressedSize64 = binary.LittleEndian.Uint64(buf[:8])
+
+		return nil
+	}
+
+	if _, err := io.ReadFull(r, buf[:8]); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	e.CompressedSize64 = uint64(binary.LittleEndian.Uint32(buf[0:]))
+	e.UncompressedSize64 = uint64(binary.LittleEndian.Uint32(buf[4:]))
+
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// countingByteReader counts bytes read, which is a compressed size of an entry.
+type countingByteReader struct {
+	r byteReader
+	n int64
+}
+
+func (r *countingByteReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+
+	return n, err
+}
+
+func (r *countingByteReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.n++
+	}
+
+	return b, err
+}
+
+type limitedByteReader struct {
+	r byteReader
+	n int64
+}
+
+func (r *limitedByteReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+
+	return n, err
+}
+
+func (r *limitedByteReader) ReadByte() (byte, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.n--
+	}
+
+	return b, err
+}
+
+// zipCryptoReader decrypts data protected with the standard (ZipCrypto)
+// encryption. Unlike zip.ZipCrypto, it decrypts a stream without allocations and
+// never reads ahead.
+type zipCryptoReader struct {
+	r    byteReader
+	keys [3]uint32
+}
+
+func newZipCryptoReader(r byteReader, password string, checkByte byte) (*zipCryptoReader, error) {
+	z := &zipCryptoReader{
+		r:    r,
+		keys: [3]uint32{0x12345678, 0x23456789, 0x34567890},
+	}
+
+	for i := 0; i < len(password); i++ {
+		z.updateKeys(password[i])
+	}
+
+	var header [zipCryptHeaderLen]byte
+
+	if _, err := io.ReadFull(z, header[:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	if header[zipCryptHeaderLen-1] != checkByte {
+		return nil, errZipPassword
+	}
+
+	return z, nil
+}
+
+func (z *zipCryptoReader) Read(p []byte) (int, error) {
+	n, err := z.r.Read(p)
+
+	for i := 0; i < n; i++ {
+		p[i] = z.decrypt(p[i])
+	}
+
+	return n, err
+}
+
+func (z *zipCryptoReader) ReadByte() (byte, error) {
+	b, err := z.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	return z.decrypt(b), nil
+}
+
+func (z *zipCryptoReader) decrypt(c byte) byte {
+	t := z.keys[2] | 2
+	b := c ^ byte((t*(t^1))>>8)
+	z.updateKeys(b)
+
+	return b
+}
+
+func (z *zipCryptoReader) updateKeys(b byte) {
+	z.keys[0] = crc32.IEEETable[byte(z.keys[0])^b] ^ (z.keys[0] >> 8)
+	z.keys[1] += z.keys[0] & 0xff
+	z.keys[1] = z.keys[1]*134775813 + 1
+	z.keys[2] = crc32.IEEETable[byte(z.keys[2])^byte(z.keys[1]>>24)] ^ (z.keys[2] >> 8)
+}
+
+// zipAESExtra is an extra field of an entry protected with the WinZip AES
+// encryption.
+type zipAESExtra struct {
+	version uint16
+	keyLen  int
+	method  uint16
+}
+
+func parseZipAESExtra(extra []byte) (*zipAESExtra, error) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+
+		if size > len(extra)-4 {
+			break
+		}
+
+		if id == zipAESExtraID && size >= 7 {
+			b := extra[4:]
+			a := &zipAESExtra{
+				version: binary.LittleEndian.Uint16(b),
+				method:  binary.LittleEndian.Uint16(b[5:]),
+			}
+
+			// Strengths 1, 2 and 3 are of 128, 192 and 256 bits long keys.
+			if b[4] < 1 || b[4] > 3 {
+				return nil, errZipAlgorithm
+			}
+
+			a.keyLen = 8 + 8*int(b[4])
+
+			return a, nil
+		}
+
+		extra = extra[4+size:]
+	}
+
+	return nil, errors.Wrap(errZipFormat, "no AES extra field")
+}
+
+// zipAESReader decrypts data protected with the WinZip AES encryption (AES in
+// the counter mode with a little-endian counter starting at 1) and computes its
+// HMAC-SHA1. Like zipCryptoReader, it never reads ahead, so that an
+// authentication code following data is left intact.
+type zipAESReader struct {
+	r       byteReader
+	block   cipher.Block
+	mac     hash.Hash
+	version uint16
+
+	counter [aes.BlockSize]byte
+	stream  [aes.BlockSize]byte
+	used    int
+	b       [1]byte
+}
+
+// newZipAESReader reads a salt and a password verifier from r, and derives keys
+// of the password with PBKDF2 as WinZip does.
+func newZipAESReader(r byteReader, password string, extra *zipAESExtra) (*zipAESReader, error) {
+	keyLen := extra.keyLen
+	salt := make([]byte, keyLen/2+zipAESVerifierLen)
+
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	verifier := salt[keyLen/2:]
+	salt = salt[:keyLen/2]
+
+	key := pbkdf2.Key([]byte(password), salt, 1000, 2*keyLen+zipAESVerifierLen, sha1.New)
+
+	if subtle.ConstantTimeCompare(key[2*keyLen:], verifier) != 1 {
+		return nil, errZipPassword
+	}
+
+	block, err := aes.NewCipher(key[:keyLen])
+	if err != nil {
+		return nil, err
+	}
+
+	return &zipAESReader{
+		r:       r,
+		block:   block,
+		mac:     hmac.New(sha1.New, key[keyLen:2*keyLen]),
+		version: extra.version,
+		used:    aes.BlockSize,
+	}, nil
+}
+
+func (z *zipAESReader) Read(p []byte) (int, error) {
+	n, err := z.r.Read(p)
+
+	z.mac.Write(p[:n])
+	z.decrypt(p[:n])
+
+	return n, err
+}
+
+func (z *zipAESReader) ReadByte() (byte, error) {
+	b, err := z.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	z.b[0] = b
+	z.mac.Write(z.b[:])
+	z.decrypt(z.b[:])
+
+	return z.b[0], nil
+}
+
+func (z *zipAESReader) decrypt(p []byte) {
+	for i := range p {
+		if z.used == aes.BlockSize {
+			for j := range z.counter {
+				z.counter[j]++
+				if z.counter[j] != 0 {
+					break
+				}
+			}
+
+			z.block.Encrypt(z.stream[:], z.counter[:])
+			z.used = 0
+		}
+
+		p[i] ^= z.stream[z.used]
+		z.used++
+	}
+}
+
+// authenticate reads an authentication code following decrypted data from r and
+// checks it against one of the data.
+func (z *zipAESReader) authenticate(r io.Reader) error {
+	var code [zipAESAuthLen]byte
+
+	if _, err := io.ReadFull(r, code[:]); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	if !hmac.Equal(z.mac.Sum(nil)[:zipAESAuthLen], code[:]) {
+		return errZipAuth
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package log
+
+import (
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Names of fields attached to log entries. Values are passed as fields rather than
+// embedded into messages, so that logs can be queried by them, and the names are
+// kept stable across packages for the same reason.
+const (
+	FieldSessionID   = "session_id"
+	FieldInstanceID  = "instance_id"
+	FieldRole        = "role"
+	FieldTransferID  = "transfer_id"
+	FieldFile        = "file"
+	FieldDir         = "dir"
+	FieldState       = "state"
+	FieldAddr        = "addr"
+	FieldURL         = "url"
+	FieldVersion     = "version"
+	FieldAttempt     = "attempt"
+	FieldStatus      = "status"
+	FieldPhase       = "phase"
+	FieldSentBytes   = "sent_bytes"
+	FieldRecvBytes   = "received_bytes"
+	FieldMethod      = "method"
+	FieldType        = "type"
+	FieldPayload     = "payload"
+	FieldDuration    = "duration"
+	FieldFiles       = "files"
+	FieldRatio       = "compression_ratio"
+	FieldThroughput  = "throughput_bytes_per_second"
+	FieldRate        = "rate"
+	FieldProgress    = "progress"
+	FieldETA         = "eta"
+	FieldRoute       = "route"
+	FieldNAT         = "nat"
+	FieldRemoteNAT   = "remote_nat"
+	FieldPrognosis   = "prognosis"
+	FieldOffset      = "offset"
+	FieldNextRun     = "next_run"
+	FieldStreams     = "streams"
+	FieldSize        = "size"
+	FieldFingerprint = "fingerprint"
+	FieldPeerState   = "peer_state"
+	FieldHook        = "hook"
+	FieldChunks      = "chunks"
+	FieldShards      = "shards"
+	FieldProtocol    = "protocol"
+	FieldFeatures    = "features"
+)
+
+type Fields map[string]any
+
+// Var is a field value which changes after a logger is made with it, e.g. a
+// state of a connection. Entries tell its value at the time they are written,
+// since fields which are fmt.Stringer are turned into strings then (see:
+// redactHook).
+type Var struct {
+	v atomic.Value
+}
+
+func NewVar(value string) *Var {
+	v := &Var{}
+	v.Set(value)
+
+	return v
+}
+
+func (v *Var) Set(value string) {
+	v.v.Store(value)
+}
+
+func (v *Var) String() string {
+	s, _ := v.v.Load().(string)
+
+	return s
+}
+
+// Entry is a log entry with fields attached.
+type Entry struct {
+	entry *logrus.Entry
+}
+
+// New returns an entry of the global logger without fields, which is a root of
+// logger contexts passed down to components.
+func New() *Entry {
+	return &Entry{
+		entry: logrus.NewEntry(logrus.StandardLogger()),
+	}
+}
+
+func WithField(key string, value any) *Entry {
+	return &Entry{
+		entry: logrus.WithField(key, value),
+	}
+}
+
+func WithFields(fields Fields) *Entry {
+	return &Entry{
+		entry: logrus.WithFields(logrus.Fields(fields)),
+	}
+}
+
+func (e *Entry) WithField(key string, value any) Logger {
+	return &Entry{
+		entry: e.entry.WithField(key, value),
+	}
+}
+
+func (e *Entry) WithFields(fields Fields) Logger {
+	return &Entry{
+		entry: e.entry.WithFields(logrus.Fields(fields)),
+	}
+}
+
+func (e *Entry) Trace(args ...any) {
+	e.entry.Trace(args...)
+}
+
+func (e *Entry) Tracef(format string, args ...any) {
+	e.entry.Tracef(format, args...)
+}
+
+func (e *Entry) Debug(args ...any) {
+	e.entry.Debug(args...)
+}
+
+func (e *Entry) Debugf(format string, args ...any) {
+	e.entry.Debugf(format, args...)
+}
+
+func (e *Entry) Info(args ...any) {
+	e.entry.Info(args...)
+}
+
+func (e *Entry) Infof(format string, args ...any) {
+	e.entry.Infof(format, args...)
+}
+
+func (e *Entry) Error(args ...any) {
+	e.entry.Error(args...)
+}
+
+func (e *Entry) Errorf(format string, args ...any) {
+	e.entry.Errorf(format, args...)
+}
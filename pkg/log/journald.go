@@ -0,0 +1,120 @@
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// journaldSocket is a socket of the systemd journal accepting entries presented
+// in the native protocol (see: https://systemd.io/JOURNAL_NATIVE_PROTOCOL/).
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldHook writes entries to the systemd journal with priorities matching
+// their levels, and entry fields are kept as journal fields (e.g. session_id
+// becomes SESSION_ID), so entries can be filtered by them with journalctl.
+type journaldHook struct {
+	conn       *net.UnixConn
+	identifier string
+}
+
+func newJournaldHook() (*journaldHook, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{
+		Name: journaldSocket,
+		Net:  "unixgram",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &journaldHook{
+		conn:       conn,
+		identifier: filepath.Base(os.Args[0]),
+	}, nil
+}
+
+func (h *journaldHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *journaldHook) Fire(entry *logrus.Entry) error {
+	var b bytes.Buffer
+
+	writeJournaldField(&b, "MESSAGE", entry.Message)
+	writeJournaldField(&b, "PRIORITY", strconv.Itoa(journaldPriority(entry.Level)))
+	writeJournaldField(&b, "SYSLOG_IDENTIFIER", h.identifier)
+
+	for k, v := range entry.Data {
+		writeJournaldField(&b, journaldFieldName(k), fmt.Sprint(v))
+	}
+
+	// NOTE: Entries exceeding a datagram size limit are dropped, they should be
+	// passed in a memfd otherwise which is never the case for these logs.
+	_, err := h.conn.Write(b.Bytes())
+
+	return err
+}
+
+func (h *journaldHook) Close() error {
+	return h.conn.Close()
+}
+
+// journaldPriority returns a syslog priority of a level.
+func journaldPriority(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	default:
+		return 7
+	}
+}
+
+// journaldFieldName converts a field name to the journal field name that may
+// consist of uppercase letters, digits and underscores only.
+func journaldFieldName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+
+	// Leading underscores are reserved for trusted fields set by journald.
+	return strings.TrimLeft(name, "_")
+}
+
+func writeJournaldField(b *bytes.Buffer, name, value string) {
+	if len(name) == 0 {
+		return
+	}
+
+	b.WriteString(name)
+
+	// A multiline value is written as a binary one prefixed with its size.
+	if strings.ContainsRune(value, '\n') {
+		b.WriteByte('\n')
+		binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	} else {
+		b.WriteByte('=')
+	}
+
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
@@ -0,0 +1,16 @@
+package log
+
+// Logger is a logger components of pkg/* are given in their configs, so that
+// library consumers can route logs into their own logging stack. *Entry is the
+// default implementation writing logs with logrus.
+type Logger interface {
+	WithField(key string, value any) Logger
+	WithFields(fields Fields) Logger
+
+	Trace(args ...any)
+	Debug(args ...any)
+	Info(args ...any)
+	Error(args ...any)
+}
+
+var _ Logger = (*Entry)(nil)
@@ -0,0 +1,106 @@
+package log
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const redacted = "[REDACTED]"
+
+// minSecretLen is a length secrets shorter than are not registered, since
+// replacing them would mangle unrelated text.
+const minSecretLen = 4
+
+var (
+	secrets   []string
+	secretsMx sync.RWMutex
+)
+
+// secretPatterns match secrets which are not known in advance: SDP ICE
+// credentials, Authorization header values, URL passwords (e.g. of TURN
+// servers) and secret query parameters. The first group of a pattern is kept,
+// the rest is replaced. SDP lines may be escaped within JSON, so values end at
+// a backslash as well.
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(a=ice-(?:ufrag|pwd):)[^\s\\"]+`),
+	regexp.MustCompile(`(?i)(authorization:\s*(?:bearer\s+|basic\s+)?)[^\s\\"]+`),
+	regexp.MustCompile(`(\w+://[^/\s:@]+:)[^/\s@]+@`),
+	regexp.MustCompile(`(?i)((?:password|passwd|apikey|api_key|credential|token|secret)=)[^&\s\\"]+`),
+}
+
+// AddSecret registers secrets (e.g. API keys and passwords) which are replaced
+// in all log entries written after that.
+func AddSecret(values ...string) {
+	secretsMx.Lock()
+	defer secretsMx.Unlock()
+
+	for _, v := range values {
+		if len(v) >= minSecretLen {
+			secrets = append(secrets, v)
+		}
+	}
+}
+
+// Redact replaces registered secrets and ones matching known patterns in s. It
+// should be used for text leaving the process other than log entries, which are
+// redacted anyway (e.g. errors written in a summary file).
+func Redact(s string) string {
+	secretsMx.RLock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	secretsMx.RUnlock()
+
+	for _, re := range secretPatterns {
+		s = re.ReplaceAllStringFunc(s, func(match string) string {
+			prefix := re.FindStringSubmatch(match)[1]
+
+			// A URL password is followed by a host which is kept.
+			if strings.HasSuffix(match, "@") {
+				return prefix + redacted + "@"
+			}
+
+			return prefix + redacted
+		})
+	}
+
+	return s
+}
+
+// redactHook redacts messages and text fields of entries before they are
+// written by any output.
+type redactHook struct{}
+
+func (redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (redactHook) Fire(entry *logrus.Entry) error {
+	entry.Message = Redact(entry.Message)
+
+	// Fields are copied by logrus for every written entry.
+	for k, v := range entry.Data {
+		switch v := v.(type) {
+		case string:
+			entry.Data[k] = Redact(v)
+		case error:
+			entry.Data[k] = Redact(v.Error())
+		case fmt.Stringer:
+			entry.Data[k] = Redact(v.String())
+		}
+	}
+
+	return nil
+}
+
+// newHooks returns hooks every output is written through.
+func newHooks() logrus.LevelHooks {
+	hooks := make(logrus.LevelHooks)
+	hooks.Add(redactHook{})
+
+	return hooks
+}
@@ -0,0 +1,148 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RotatingFile is a log file which is rotated when it exceeds MaxSize or gets
+// older than MaxAge. Rotated files are named just like versions of received
+// files: the current file is renamed to "${Path}.1", "${Path}.1" is renamed to
+// "${Path}.2" and so on, and the oldest one beyond MaxBackups is deleted.
+type RotatingFile struct {
+	cfg RotatingFileConfig
+
+	mx       sync.Mutex
+	f        *os.File
+	size     int64
+	openedAt time.Time
+}
+
+type RotatingFileConfig struct {
+	Path string
+	// MaxSize is a size in bytes a file is rotated after, 0 means no limit.
+	MaxSize int64
+	// MaxAge is a duration a file is rotated after, 0 means no limit.
+	MaxAge time.Duration
+	// MaxBackups is a number of rotated files kept, 0 means they are deleted at once.
+	MaxBackups int
+}
+
+func NewRotatingFile(cfg RotatingFileConfig) (*RotatingFile, error) {
+	r := &RotatingFile{
+		cfg: cfg,
+	}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	if r.needsRotation(len(p)) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+
+	return n, err
+}
+
+func (r *RotatingFile) Close() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+
+	err := r.f.Close()
+	r.f = nil
+
+	return err
+}
+
+func (r *RotatingFile) needsRotation(n int) bool {
+	// An entry is never split, so an empty file takes it whatever its size is.
+	if r.size == 0 {
+		return false
+	}
+
+	if r.cfg.MaxSize > 0 && r.size+int64(n) > r.cfg.MaxSize {
+		return true
+	}
+
+	return r.cfg.MaxAge > 0 && time.Since(r.openedAt) > r.cfg.MaxAge
+}
+
+func (r *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.cfg.Path), 0775); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(r.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+
+		return err
+	}
+
+	r.f = f
+	r.size = fi.Size()
+	r.openedAt = time.Now()
+
+	return nil
+}
+
+func (r *RotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+
+	backupName := func(i int) string {
+		return fmt.Sprintf("%s.%d", r.cfg.Path, i)
+	}
+
+	if r.cfg.MaxBackups > 0 {
+		if err := os.Remove(backupName(r.cfg.MaxBackups)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	for i := r.cfg.MaxBackups - 1; i > 0; i-- {
+		if err := os.Rename(backupName(i), backupName(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if r.cfg.MaxBackups > 0 {
+		if err := os.Rename(r.cfg.Path, backupName(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.cfg.Path); err != nil {
+		return err
+	}
+
+	return r.open()
+}
@@ -0,0 +1,53 @@
+package log
+
+import (
+	"sync"
+	"time"
+)
+
+// Sampler thins out frequent events (e.g. progress of a transfer made of many
+// small writes) so that they don't flood logs: an event is passed if Interval
+// has passed or Bytes of progress have been made since the last passed one.
+type Sampler struct {
+	cfg SamplerConfig
+
+	mx    sync.Mutex
+	last  time.Time
+	bytes int64
+}
+
+type SamplerConfig struct {
+	// Interval is a period events are passed once per, 0 disables the condition.
+	Interval time.Duration
+	// Bytes is an amount of progress events are passed once per, 0 disables the
+	// condition.
+	Bytes int64
+}
+
+func NewSampler(cfg SamplerConfig) *Sampler {
+	return &Sampler{
+		cfg:  cfg,
+		last: time.Now(),
+	}
+}
+
+// Allow adds n bytes of progress made by an event and reports whether the event
+// should be logged.
+func (s *Sampler) Allow(n int64) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.bytes += n
+
+	now := time.Now()
+
+	if (s.cfg.Interval > 0 && now.Sub(s.last) >= s.cfg.Interval) ||
+		(s.cfg.Bytes > 0 && s.bytes >= s.cfg.Bytes) {
+		s.last = now
+		s.bytes = 0
+
+		return true
+	}
+
+	return false
+}
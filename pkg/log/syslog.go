@@ -0,0 +1,79 @@
+//go:build !windows && !plan9
+
+package log
+
+import (
+	"log/syslog"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// syslogHook writes entries to a syslog daemon with priorities matching their
+// levels.
+type syslogHook struct {
+	w         *syslog.Writer
+	formatter logrus.Formatter
+}
+
+// newSyslogHook connects to a local syslog daemon if addr is empty, otherwise to
+// a remote one located by addr presented as "udp://host:port" or "tcp://host:port".
+func newSyslogHook(addr string, formatter logrus.Formatter) (*syslogHook, error) {
+	var network, raddr string
+
+	if len(addr) != 0 {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if u.Scheme != "udp" && u.Scheme != "tcp" {
+			return nil, errors.Errorf("unsupported syslog network: %s", u.Scheme)
+		}
+
+		network, raddr = u.Scheme, u.Host
+	}
+
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, filepath.Base(os.Args[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	return &syslogHook{
+		w:         w,
+		formatter: formatter,
+	}, nil
+}
+
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	b, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+
+	msg := string(b)
+
+	switch entry.Level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return h.w.Crit(msg)
+	case logrus.ErrorLevel:
+		return h.w.Err(msg)
+	case logrus.WarnLevel:
+		return h.w.Warning(msg)
+	case logrus.InfoLevel:
+		return h.w.Info(msg)
+	default:
+		return h.w.Debug(msg)
+	}
+}
+
+func (h *syslogHook) Close() error {
+	return h.w.Close()
+}
@@ -0,0 +1,20 @@
+//go:build windows || plan9
+
+package log
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type syslogHook struct {
+	logrus.Hook
+}
+
+func newSyslogHook(string, logrus.Formatter) (*syslogHook, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+func (h *syslogHook) Close() error {
+	return nil
+}
@@ -1,18 +1,167 @@
 package log
 
 import (
+	"io"
 	"os"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
-func SetupLogger() {
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+const (
+	OutputStdout   = "stdout"
+	OutputSyslog   = "syslog"
+	OutputJournald = "journald"
+)
+
+type LoggerConfig struct {
+	// Level is one of the logrus levels: "panic", "fatal", "error", "warn",
+	// "info", "debug" or "trace". Default is "info".
+	Level string
+	// Format is either FormatText (default) or FormatJSON.
+	Format string
+	// File is a rotated log file written instead of Output if set.
+	File *RotatingFileConfig
+	// Output is either OutputStdout (default), OutputSyslog or OutputJournald.
+	Output string
+	// Stdout replaces the standard output for OutputStdout if set, e.g. to keep
+	// a progress bar below entries.
+	Stdout io.Writer
+	// SyslogAddr is an address of a remote syslog daemon presented as
+	// "udp://host:port" or "tcp://host:port", a local one is used if empty.
+	SyslogAddr string
+}
+
+// output is a log file or a connection to a log daemon opened by SetupLogger, if any.
+var output io.Closer
+
+func SetupLogger(cfg LoggerConfig) error {
+	level := logrus.InfoLevel
+
+	if len(cfg.Level) != 0 {
+		var err error
+
+		level, err = logrus.ParseLevel(cfg.Level)
+		if err != nil {
+			return err
+		}
+	}
+
+	var formatter logrus.Formatter
+
+	switch cfg.Format {
+	case "", FormatText:
+		formatter = &logrus.TextFormatter{
+			TimestampFormat: "15:04:05.000000000",
+			FullTimestamp:   true,
+		}
+	case FormatJSON:
+		formatter = &logrus.JSONFormatter{
+			TimestampFormat: time.RFC3339Nano,
+		}
+	default:
+		return errors.Errorf("unknown log format: %s", cfg.Format)
+	}
+
+	var (
+		out    io.Writer = os.Stdout
+		closer io.Closer
+		hooks  = newHooks()
+	)
+
+	switch {
+	case cfg.File != nil:
+		f, err := NewRotatingFile(*cfg.File)
+		if err != nil {
+			return errors.Wrap(err, "log file")
+		}
+
+		out, closer = f, f
+	case cfg.Output == OutputSyslog:
+		// A syslog daemon timestamps entries itself.
+		syslogFormatter := formatter
+		if _, ok := formatter.(*logrus.TextFormatter); ok {
+			syslogFormatter = &logrus.TextFormatter{
+				DisableTimestamp: true,
+				DisableColors:    true,
+			}
+		}
+
+		h, err := newSyslogHook(cfg.SyslogAddr, syslogFormatter)
+		if err != nil {
+			return errors.Wrap(err, "syslog")
+		}
+
+		// Entries are written by the hook keeping their priorities.
+		out, closer = io.Discard, h
+		hooks.Add(h)
+	case cfg.Output == OutputJournald:
+		h, err := newJournaldHook()
+		if err != nil {
+			return errors.Wrap(err, "journald")
+		}
+
+		out, closer = io.Discard, h
+		hooks.Add(h)
+	case len(cfg.Output) == 0, cfg.Output == OutputStdout:
+		if cfg.Stdout != nil {
+			out = cfg.Stdout
+		}
+	default:
+		return errors.Errorf("unknown log output: %s", cfg.Output)
+	}
+
+	// An output opened by a previous call is replaced.
+	if err := Close(); err != nil {
+		Error(errors.Wrap(err, "log output"))
+	}
+
+	logrus.SetOutput(out)
+	logrus.SetLevel(level)
+	logrus.SetFormatter(formatter)
+	logrus.StandardLogger().ReplaceHooks(hooks)
+
+	output = closer
+
+	return nil
+}
+
+// Close closes a log file or a connection to a log daemon opened by SetupLogger.
+// Logs are written to the standard output after that.
+func Close() error {
+	if output == nil {
+		return nil
+	}
+
 	logrus.SetOutput(os.Stdout)
-	logrus.SetLevel(logrus.TraceLevel)
-	logrus.SetFormatter(&logrus.TextFormatter{
-		TimestampFormat: "15:04:05.000000000",
-		FullTimestamp:   true,
-	})
+	logrus.StandardLogger().ReplaceHooks(newHooks())
+
+	err := output.Close()
+	output = nil
+
+	return err
+}
+
+func Trace(args ...any) {
+	logrus.Trace(args...)
+}
+
+func Tracef(format string, args ...any) {
+	logrus.Tracef(format, args...)
+}
+
+func Debug(args ...any) {
+	logrus.Debug(args...)
+}
+
+func Debugf(format string, args ...any) {
+	logrus.Debugf(format, args...)
 }
 
 func Info(args ...any) {
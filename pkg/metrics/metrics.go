@@ -0,0 +1,210 @@
+// Package metrics aggregates application metrics in memory and periodically
+// pushes snapshots to configured exporters (see: Setup()). Metrics are recorded
+// through package level functions the same way logs are written with pkg/log, so
+// recording a metric costs nothing but a map update if no exporter is set up.
+//
+// There are three kinds of metrics: counters accumulate values (e.g. bytes sent),
+// gauges keep the last set value, and timings accumulate number and total duration
+// of measured events. A metric is identified by a name and tags given as key-value
+// pairs (e.g. Count("transfers", 1, "role", "sender", "result", "success")).
+
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-backup/pkg/log"
+)
+
+// Prefix is prepended to names of all exported metrics.
+const Prefix = "distributed_backup_"
+
+type Kind int
+
+const (
+	KindCounter Kind = iota
+	KindGauge
+	KindTiming
+)
+
+type Metric struct {
+	Name string
+	Tags []Tag
+	Kind Kind
+
+	// Value is a counter's total, a gauge's value or a timing's total duration
+	// in seconds.
+	Value float64
+	// Count is a number of measured events of a timing.
+	Count int64
+}
+
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Exporter pushes a snapshot of all metrics recorded since the start.
+type Exporter interface {
+	Export(snapshot []Metric) error
+}
+
+var r = &registry{
+	metrics: make(map[string]*Metric),
+	log:     log.New(),
+}
+
+type registry struct {
+	mx      sync.Mutex
+	metrics map[string]*Metric
+
+	exporters []Exporter
+	stopChan  chan struct{}
+	wg        sync.WaitGroup
+
+	log log.Logger
+}
+
+// SetLogger sets a logger export errors are written with, the global logger is
+// used by default. It should be called before Setup().
+func SetLogger(l log.Logger) {
+	r.log = l
+}
+
+// Setup starts pushing snapshots to exporters every interval until Shutdown()
+// is called.
+func Setup(interval time.Duration, exporters ...Exporter) {
+	if len(exporters) == 0 {
+		return
+	}
+
+	r.exporters = exporters
+	r.stopChan = make(chan struct{})
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				r.export()
+			case <-r.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Shutdown stops periodic pushing and pushes the final snapshot.
+func Shutdown() {
+	if r.stopChan == nil {
+		return
+	}
+
+	close(r.stopChan)
+	r.wg.Wait()
+
+	r.export()
+
+	r.stopChan = nil
+}
+
+func Count(name string, value int64, tags ...string) {
+	r.update(name, KindCounter, tags, func(m *Metric) {
+		m.Value += float64(value)
+	})
+}
+
+func SetGauge(name string, value float64, tags ...string) {
+	r.update(name, KindGauge, tags, func(m *Metric) {
+		m.Value = value
+	})
+}
+
+func Timing(name string, d time.Duration, tags ...string) {
+	r.update(name, KindTiming, tags, func(m *Metric) {
+		m.Value += d.Seconds()
+		m.Count++
+	})
+}
+
+// Snapshot returns copies of all recorded metrics sorted by names and tags.
+func Snapshot() []Metric {
+	return r.snapshot()
+}
+
+func (r *registry) update(name string, kind Kind, tags []string, f func(*Metric)) {
+	pairs := make([]Tag, 0, len(tags)/2)
+
+	for i := 0; i+1 < len(tags); i += 2 {
+		pairs = append(pairs, Tag{Key: tags[i], Value: tags[i+1]})
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Key < pairs[j].Key
+	})
+
+	key := metricKey(name, pairs)
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	m, ok := r.metrics[key]
+	if !ok {
+		m = &Metric{
+			Name: name,
+			Tags: pairs,
+			Kind: kind,
+		}
+		r.metrics[key] = m
+	}
+
+	f(m)
+}
+
+func (r *registry) snapshot() []Metric {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	keys := make([]string, 0, len(r.metrics))
+	for key := range r.metrics {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	snapshot := make([]Metric, len(keys))
+	for i, key := range keys {
+		snapshot[i] = *r.metrics[key]
+	}
+
+	return snapshot
+}
+
+func (r *registry) export() {
+	snapshot := r.snapshot()
+
+	for _, e := range r.exporters {
+		if err := e.Export(snapshot); err != nil {
+			r.log.Error("metrics export: ", err)
+		}
+	}
+}
+
+func metricKey(name string, tags []Tag) string {
+	b := strings.Builder{}
+	b.WriteString(name)
+
+	for _, tag := range tags {
+		b.WriteString("," + tag.Key + "=" + tag.Value)
+	}
+
+	return b.String()
+}
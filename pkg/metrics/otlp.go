@@ -0,0 +1,184 @@
+// OTLP exports metrics to an OpenTelemetry collector using the OTLP/HTTP protocol
+// with JSON encoding (POST ${Endpoint}/v1/metrics).
+//
+// Counters are exported as cumulative monotonic sums, gauges as gauges, and timings
+// as two cumulative sums: "${name}_seconds_total" and "${name}_count".
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type OTLP struct {
+	cfg OTLPConfig
+
+	client    *http.Client
+	startTime time.Time
+}
+
+type OTLPConfig struct {
+	Endpoint    string
+	ServiceName string
+}
+
+func NewOTLP(cfg OTLPConfig) (*OTLP, error) {
+	if len(cfg.Endpoint) == 0 {
+		return nil, errors.New("OTLP endpoint is empty")
+	}
+
+	if len(cfg.ServiceName) == 0 {
+		cfg.ServiceName = "distributed-backup"
+	}
+
+	return &OTLP{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		startTime: time.Now(),
+	}, nil
+}
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name  string    `json:"name"`
+	Sum   *otlpSum  `json:"sum,omitempty"`
+	Gauge *otlpData `json:"gauge,omitempty"`
+}
+
+type otlpData struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	otlpData
+	// 2 is AGGREGATION_TEMPORALITY_CUMULATIVE.
+	AggregationTemporality int  `json:"aggregationTemporality"`
+	IsMonotonic            bool `json:"isMonotonic"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsDouble          float64         `json:"asDouble"`
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func (e *OTLP) Export(snapshot []Metric) error {
+	if len(snapshot) == 0 {
+		return nil
+	}
+
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	start := strconv.FormatInt(e.startTime.UnixNano(), 10)
+
+	point := func(m Metric, value float64) otlpDataPoint {
+		return otlpDataPoint{
+			Attributes:        e.attributes(m.Tags),
+			StartTimeUnixNano: start,
+			TimeUnixNano:      now,
+			AsDouble:          value,
+		}
+	}
+
+	sum := func(name string, p otlpDataPoint) otlpMetric {
+		return otlpMetric{
+			Name: name,
+			Sum: &otlpSum{
+				otlpData:               otlpData{DataPoints: []otlpDataPoint{p}},
+				AggregationTemporality: 2,
+				IsMonotonic:            true,
+			},
+		}
+	}
+
+	var metrics []otlpMetric
+
+	for _, m := range snapshot {
+		name := Prefix + m.Name
+
+		switch m.Kind {
+		case KindCounter:
+			metrics = append(metrics, sum(name, point(m, m.Value)))
+		case KindGauge:
+			metrics = append(metrics, otlpMetric{
+				Name:  name,
+				Gauge: &otlpData{DataPoints: []otlpDataPoint{point(m, m.Value)}},
+			})
+		case KindTiming:
+			metrics = append(metrics,
+				sum(name+"_seconds_total", point(m, m.Value)),
+				sum(name+"_count", point(m, float64(m.Count))),
+			)
+		}
+	}
+
+	rm := otlpResourceMetrics{}
+	rm.Resource.Attributes = e.attributes([]Tag{{Key: "service.name", Value: e.cfg.ServiceName}})
+
+	sm := otlpScopeMetrics{Metrics: metrics}
+	sm.Scope.Name = e.cfg.ServiceName
+	rm.ScopeMetrics = []otlpScopeMetrics{sm}
+
+	body, err := json.Marshal(&otlpRequest{ResourceMetrics: []otlpResourceMetrics{rm}})
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimSuffix(e.cfg.Endpoint, "/") + "/v1/metrics"
+
+	resp, err := e.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("response status: %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (e *OTLP) attributes(tags []Tag) []otlpAttribute {
+	attributes := make([]otlpAttribute, len(tags))
+
+	for i, tag := range tags {
+		attributes[i].Key = tag.Key
+		attributes[i].Value.StringValue = tag.Value
+	}
+
+	return attributes
+}
@@ -0,0 +1,109 @@
+// Prometheus exposition presents a snapshot of metrics in the Prometheus text
+// format (version 0.0.4) to be scraped over HTTP rather than pushed.
+//
+// Counters are presented as counters named "${name}_total", gauges as gauges,
+// and timings as summaries without quantiles named "${name}_seconds", i.e. as
+// "${name}_seconds_sum" and "${name}_seconds_count". Tags become labels.
+
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PrometheusContentType is a content type of the Prometheus text format.
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// PrometheusHandler serves metrics recorded since the start in the Prometheus
+// text format.
+func PrometheusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", PrometheusContentType)
+
+		if err := WritePrometheus(w, Snapshot()); err != nil {
+			r.log.Error("metrics exposition: ", err)
+		}
+	})
+}
+
+// WritePrometheus writes a snapshot in the Prometheus text format. Metrics of a
+// snapshot are expected to be sorted by names (see: Snapshot()), so that all
+// series of a metric follow its TYPE line.
+func WritePrometheus(w io.Writer, snapshot []Metric) error {
+	bw := bufio.NewWriter(w)
+
+	var last string
+
+	for _, m := range snapshot {
+		name := Prefix + prometheusName(m.Name)
+
+		var typ string
+
+		switch m.Kind {
+		case KindCounter:
+			name += "_total"
+			typ = "counter"
+		case KindGauge:
+			typ = "gauge"
+		case KindTiming:
+			name += "_seconds"
+			typ = "summary"
+		}
+
+		if name != last {
+			bw.WriteString("# TYPE " + name + " " + typ + "\n")
+			last = name
+		}
+
+		labels := prometheusLabels(m.Tags)
+
+		if m.Kind == KindTiming {
+			bw.WriteString(name + "_sum" + labels + " " + formatPrometheusValue(m.Value) + "\n")
+			bw.WriteString(name + "_count" + labels + " " + strconv.FormatInt(m.Count, 10) + "\n")
+
+			continue
+		}
+
+		bw.WriteString(name + labels + " " + formatPrometheusValue(m.Value) + "\n")
+	}
+
+	return bw.Flush()
+}
+
+// prometheusName replaces characters a metric or a label name can't have with
+// underscores.
+func prometheusName(name string) string {
+	return strings.Map(func(c rune) rune {
+		if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+			return c
+		}
+
+		return '_'
+	}, name)
+}
+
+// prometheusLabels presents tags as "{key="value",...}", it's empty without
+// tags.
+func prometheusLabels(tags []Tag) string {
+	if len(tags) == 0 {
+		return ""
+	}
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+	parts := make([]string, len(tags))
+
+	for i, tag := range tags {
+		parts[i] = prometheusName(tag.Key) + `="` + escaper.Replace(tag.Value) + `"`
+	}
+
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatPrometheusValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPrometheusHandler records a metric of every kind and checks that they're
+// exposed with their TYPE lines and labels of their tags.
+func TestPrometheusHandler(t *testing.T) {
+	Count("test_transfers", 1, "role", "receiver", "result", "success")
+	Count("test_transfers", 2, "role", "receiver", "result", "success")
+	Count("test.sent-bytes", 42)
+	SetGauge("test_last_finished", 1.5, "role", "sender", "result", "success")
+	Timing("test_transfer", 1500*time.Millisecond, "role", "sender", "result", "success")
+	Timing("test_transfer", 500*time.Millisecond, "role", "sender", "result", "success")
+	Count("test_errors", 1, "message", "quoted \"value\"\nand a \\ backslash")
+
+	srv := httptest.NewServer(PrometheusHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ct := resp.Header.Get("Content-Type"); ct != PrometheusContentType {
+		t.Errorf("unexpected content type: %s", ct)
+	}
+
+	for _, series := range []string{
+		"# TYPE distributed_backup_test_transfers_total counter\n",
+		`distributed_backup_test_transfers_total{result="success",role="receiver"} 3` + "\n",
+		"distributed_backup_test_sent_bytes_total 42\n",
+		"# TYPE distributed_backup_test_last_finished gauge\n",
+		`distributed_backup_test_last_finished{result="success",role="sender"} 1.5` + "\n",
+		"# TYPE distributed_backup_test_transfer_seconds summary\n",
+		`distributed_backup_test_transfer_seconds_sum{result="success",role="sender"} 2` + "\n",
+		`distributed_backup_test_transfer_seconds_count{result="success",role="sender"} 2` + "\n",
+		`distributed_backup_test_errors_total{message="quoted \"value\"\nand a \\ backslash"} 1` + "\n",
+	} {
+		if !strings.Contains(string(body), series) {
+			t.Errorf("no %q series in:\n%s", strings.TrimSpace(series), body)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// StatsD exports metrics to a StatsD daemon (or any compatible agent such as
+// Telegraf or the Datadog agent) over UDP. Tags are sent in the DogStatsD
+// "|#key:value" notation which is ignored by agents not supporting it.
+//
+// Since snapshots are cumulative, a counter is sent as a difference from its
+// value in the previous snapshot, and a timing is sent as an average of events
+// measured since the previous snapshot. Unchanged metrics are not sent.
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+type StatsD struct {
+	cfg StatsDConfig
+
+	conn     net.Conn
+	previous map[string]Metric
+}
+
+type StatsDConfig struct {
+	Address string
+}
+
+func NewStatsD(cfg StatsDConfig) (*StatsD, error) {
+	conn, err := net.Dial("udp", cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatsD{
+		cfg:      cfg,
+		conn:     conn,
+		previous: make(map[string]Metric),
+	}, nil
+}
+
+func (e *StatsD) Export(snapshot []Metric) error {
+	// Lines are packed into datagrams that fit a typical MTU.
+	const maxDatagramSize = 1432
+
+	buf := &bytes.Buffer{}
+
+	for _, m := range snapshot {
+		key := metricKey(m.Name, m.Tags)
+		prev := e.previous[key]
+		e.previous[key] = m
+
+		var line string
+
+		switch m.Kind {
+		case KindCounter:
+			if m.Value == prev.Value {
+				continue
+			}
+
+			line = fmt.Sprintf("%s%s:%g|c", Prefix, m.Name, m.Value-prev.Value)
+		case KindGauge:
+			line = fmt.Sprintf("%s%s:%g|g", Prefix, m.Name, m.Value)
+		case KindTiming:
+			if m.Count == prev.Count {
+				continue
+			}
+
+			avg := (m.Value - prev.Value) / float64(m.Count-prev.Count)
+			line = fmt.Sprintf("%s%s:%g|ms", Prefix, m.Name, avg*1000)
+		}
+
+		line += e.formatTags(m.Tags) + "\n"
+
+		if buf.Len()+len(line) > maxDatagramSize && buf.Len() != 0 {
+			if _, err := e.conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+
+			buf.Reset()
+		}
+
+		buf.WriteString(line)
+	}
+
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	_, err := e.conn.Write(buf.Bytes())
+
+	return err
+}
+
+func (e *StatsD) formatTags(tags []Tag) string {
+	if len(tags) == 0 {
+		return ""
+	}
+
+	b := bytes.NewBufferString("|#")
+
+	for i, tag := range tags {
+		if i != 0 {
+			b.WriteByte(',')
+		}
+
+		b.WriteString(tag.Key + ":" + tag.Value)
+	}
+
+	return b.String()
+}
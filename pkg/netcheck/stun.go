@@ -0,0 +1,257 @@
+// Probe sends a STUN binding request to a STUN server and returns an address that
+// the server saw the request coming from (a mapped address) together with a round
+// trip time (see: Probe()).
+//
+// RankServers probes STUN servers concurrently and orders reachable ones by a round
+// trip time, so that unreachable servers don't slow down ICE gathering (see:
+// RankServers()).
+//
+// DetectNAT probes several STUN servers from the same local UDP socket and
+// classifies the NAT in front of the host by comparing mapped addresses (see:
+// DetectNAT()). If all servers see the same mapped address, the NAT keeps the
+// same mapping regardless of a destination (cone NAT) and a direct peer-to-peer
+// connection is likely possible. If mapped addresses differ, the NAT is symmetric
+// and a direct connection is unlikely without TURN.
+//
+// PredictConnectivity tells how likely a direct connection between two hosts is
+// by NAT types of both of them, so that peers which exchange their NAT types
+// before negotiation can warn about a doomed ICE attempt early (see:
+// PredictConnectivity()).
+
+package netcheck
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pkg/errors"
+)
+
+type NATType string
+
+const (
+	NATTypeUnknown             NATType = "unknown"
+	NATTypeNone                NATType = "no NAT"
+	NATTypeEndpointIndependent NATType = "endpoint-independent mapping (cone NAT)"
+	NATTypeSymmetric           NATType = "symmetric NAT"
+)
+
+// Connectivity is a prognosis of a direct connection between two hosts.
+type Connectivity string
+
+const (
+	ConnectivityUnknown  Connectivity = "unknown"
+	ConnectivityLikely   Connectivity = "likely"
+	ConnectivityPossible Connectivity = "possible"
+	ConnectivityUnlikely Connectivity = "unlikely"
+)
+
+type ProbeResult struct {
+	Server     string
+	MappedAddr *net.UDPAddr
+	RTT        time.Duration
+}
+
+// Probe sends a binding request to server ("host:port") from conn and waits for
+// a response at most timeout.
+func Probe(conn net.PacketConn, server string, timeout time.Duration) (*ProbeResult, error) {
+	addr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	// Requests are retransmitted since UDP gives no delivery guarantee.
+	const retransmitInterval = 500 * time.Millisecond
+
+	start := time.Now()
+	deadline := start.Add(timeout)
+	buf := make([]byte, 1500)
+
+	for time.Now().Before(deadline) {
+		if _, err := conn.WriteTo(req.Raw, addr); err != nil {
+			return nil, err
+		}
+
+		readDeadline := time.Now().Add(retransmitInterval)
+		if readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+
+		if err := conn.SetReadDeadline(readDeadline); err != nil {
+			return nil, err
+		}
+
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+
+				return nil, err
+			}
+
+			resp := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+			if err := resp.Decode(); err != nil || resp.TransactionID != req.TransactionID {
+				// Not a response to this request, e.g. a late one to a retransmission.
+				continue
+			}
+
+			var mapped stun.XORMappedAddress
+			if err := mapped.GetFrom(resp); err != nil {
+				return nil, errors.Wrap(err, server)
+			}
+
+			return &ProbeResult{
+				Server: server,
+				MappedAddr: &net.UDPAddr{
+					IP:   mapped.IP,
+					Port: mapped.Port,
+				},
+				RTT: time.Since(start),
+			}, nil
+		}
+	}
+
+	return nil, errors.Errorf("%s: no response within %s", server, timeout)
+}
+
+// RankServers probes servers concurrently, each from its own local socket, and
+// returns reachable ones ordered by RTT. Probes that failed are returned as errors
+// in the same order as servers.
+func RankServers(servers []string, timeout time.Duration) ([]*ProbeResult, []error) {
+	results := make([]*ProbeResult, len(servers))
+	errs := make([]error, len(servers))
+
+	var wg sync.WaitGroup
+
+	for i, server := range servers {
+		wg.Add(1)
+
+		go func(i int, server string) {
+			defer wg.Done()
+
+			conn, err := net.ListenPacket("udp4", ":0")
+			if err != nil {
+				errs[i] = err
+
+				return
+			}
+			defer conn.Close()
+
+			results[i], errs[i] = Probe(conn, server, timeout)
+		}(i, server)
+	}
+
+	wg.Wait()
+
+	var reachable []*ProbeResult
+
+	for _, result := range results {
+		if result != nil {
+			reachable = append(reachable, result)
+		}
+	}
+
+	sort.SliceStable(reachable, func(i, j int) bool {
+		return reachable[i].RTT < reachable[j].RTT
+	})
+
+	return reachable, errs
+}
+
+// DetectNAT probes all servers from the same local socket. Probes that failed are
+// returned as errors in the same order as servers. At least two successful probes
+// are required to tell apart cone and symmetric NAT.
+func DetectNAT(servers []string, timeout time.Duration) (NATType, []*ProbeResult, []error) {
+	results := make([]*ProbeResult, len(servers))
+	errs := make([]error, len(servers))
+
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+
+		return NATTypeUnknown, results, errs
+	}
+	defer conn.Close()
+
+	var succeeded []*ProbeResult
+
+	for i, server := range servers {
+		results[i], errs[i] = Probe(conn, server, timeout)
+		if errs[i] == nil {
+			succeeded = append(succeeded, results[i])
+		}
+	}
+
+	if len(succeeded) == 0 {
+		return NATTypeUnknown, results, errs
+	}
+
+	if isLocalIP(succeeded[0].MappedAddr.IP) {
+		return NATTypeNone, results, errs
+	}
+
+	if len(succeeded) < 2 {
+		return NATTypeUnknown, results, errs
+	}
+
+	for _, result := range succeeded[1:] {
+		if result.MappedAddr.String() != succeeded[0].MappedAddr.String() {
+			return NATTypeSymmetric, results, errs
+		}
+	}
+
+	return NATTypeEndpointIndependent, results, errs
+}
+
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PredictConnectivity returns a prognosis of a direct connection between hosts
+// behind NATs of types local and remote. A host without NAT is reachable by
+// another one unless it's firewalled, and cone NATs let hosts punch holes to each
+// other. A mapping of a symmetric NAT changes per destination, so a hole is
+// punched only if a cone NAT of the other host doesn't filter by a source port,
+// which can't be told by mapped addresses, and never if both NATs are symmetric.
+func PredictConnectivity(local, remote NATType) Connectivity {
+	switch {
+	case local == NATTypeNone || remote == NATTypeNone:
+		return ConnectivityLikely
+	case !isKnownNAT(local) || !isKnownNAT(remote):
+		return ConnectivityUnknown
+	case local == NATTypeSymmetric && remote == NATTypeSymmetric:
+		return ConnectivityUnlikely
+	case local == NATTypeSymmetric || remote == NATTypeSymmetric:
+		return ConnectivityPossible
+	default:
+		return ConnectivityLikely
+	}
+}
+
+func isKnownNAT(t NATType) bool {
+	return t == NATTypeEndpointIndependent || t == NATTypeSymmetric
+}
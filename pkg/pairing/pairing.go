@@ -0,0 +1,131 @@
+// Package pairing makes short human-readable codes peers are paired with
+// instead of a session UUID and an auth secret, magic wormhole style. A code is
+// presented as "${number}-${word}-${word}-${word}", e.g. "417-orbit-candle-tiger".
+// A session ID is derived from its nameplate (the number and the first word),
+// which signaling may expose, and peers authenticate each other with the whole
+// code over a PAKE (see: crypto.SPAKE2), so that the last two words never leave
+// a peer.
+package pairing
+
+import (
+	"crypto/rand"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxNumber bounds a number of a code.
+	maxNumber = 999
+	// codeWords is a number of words of a code.
+	codeWords = 3
+	// sessionLabel binds session IDs derived from nameplates to this protocol.
+	sessionLabel = "distributed-backup pairing v1 "
+)
+
+// words is a list of 256 distinct words, so that each word of a code takes
+// 8 bits.
+var words = []string{
+	"acid", "acorn", "actor", "adobe", "agent", "alarm", "album", "alpha",
+	"amber", "angle", "ankle", "apple", "apron", "arena", "arrow", "aspen",
+	"atlas", "attic", "audio", "bacon", "badge", "bagel", "baker", "bamboo",
+	"banjo", "barn", "basil", "beach", "beacon", "beard", "bench", "berry",
+	"bison", "blade", "blanket", "bonus", "border", "bottle", "boxer", "brick",
+	"bridge", "broom", "bubble", "bucket", "buffalo", "bugle", "cabin", "cactus",
+	"camel", "candle", "canoe", "canyon", "carbon", "cargo", "carpet", "castle",
+	"cedar", "cello", "chalk", "cherry", "chess", "cider", "cinema", "circus",
+	"citrus", "clover", "cobalt", "cocoa", "comet", "copper", "coral", "cotton",
+	"coyote", "crater", "crayon", "cricket", "crystal", "cupid", "dagger", "daisy",
+	"delta", "denim", "desert", "diesel", "dinner", "dolphin", "domino", "donkey",
+	"dragon", "drum", "eagle", "easel", "echo", "eclipse", "elbow", "ember",
+	"emerald", "engine", "falcon", "fender", "ferry", "fiddle", "finch", "flute",
+	"fossil", "fox", "garden", "garlic", "gecko", "geyser", "ginger", "glacier",
+	"goblet", "gopher", "granite", "gravel", "guitar", "hammer", "harbor", "harp",
+	"hazel", "helmet", "hermit", "hippo", "honey", "hornet", "husky", "igloo",
+	"indigo", "island", "ivory", "jacket", "jaguar", "jelly", "jigsaw", "jungle",
+	"kayak", "kernel", "kettle", "kiwi", "koala", "ladder", "lagoon", "lantern",
+	"laser", "lemon", "lentil", "lilac", "lizard", "locket", "lotus", "magnet",
+	"mango", "maple", "marble", "meadow", "melon", "meteor", "mirror", "mocha",
+	"monkey", "mosaic", "muffin", "mustard", "nectar", "needle", "nickel", "noodle",
+	"nutmeg", "oasis", "ocean", "olive", "onion", "opal", "orbit", "orchid",
+	"otter", "oyster", "paddle", "panda", "papaya", "parrot", "peanut", "pebble",
+	"pelican", "pepper", "piano", "pickle", "pillow", "pilot", "pine", "pixel",
+	"planet", "plum", "polar", "poppy", "potato", "prism", "pumpkin", "puzzle",
+	"quartz", "quill", "rabbit", "radar", "radish", "raven", "rhino", "ribbon",
+	"river", "robin", "rocket", "saddle", "salmon", "sandal", "satin", "scarf",
+	"shovel", "silver", "sketch", "sparrow", "spider", "spruce", "squid", "statue",
+	"summit", "sunset", "swan", "tablet", "tango", "teapot", "thistle", "thunder",
+	"tiger", "timber", "tomato", "topaz", "torch", "tractor", "trumpet", "tulip",
+	"tunnel", "turtle", "valley", "velvet", "violin", "volcano", "waffle", "walnut",
+	"walrus", "whale", "willow", "window", "wizard", "yogurt", "zebra", "zipper",
+}
+
+// NewCode generates a random code.
+func NewCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(maxNumber))
+	if err != nil {
+		return "", err
+	}
+
+	parts := []string{strconv.FormatInt(n.Int64()+1, 10)}
+
+	for i := 0; i < codeWords; i++ {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(len(words))))
+		if err != nil {
+			return "", err
+		}
+
+		parts = append(parts, words[j.Int64()])
+	}
+
+	return strings.Join(parts, "-"), nil
+}
+
+// ParseCode checks a code typed by a user and returns its canonical form, it's
+// case-insensitive and words may be separated by spaces as well.
+func ParseCode(s string) (string, error) {
+	parts := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return r == '-' || r == ' '
+	})
+
+	if len(parts) != codeWords+1 {
+		return "", errors.Errorf("pairing code %q: ${number}-${word}-${word}-${word} expected", s)
+	}
+
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n < 1 || n > maxNumber {
+		return "", errors.Errorf("pairing code %q: number from 1 to %d expected", s, maxNumber)
+	}
+
+	parts[0] = strconv.Itoa(n)
+
+	for _, word := range parts[1:] {
+		if !isWord(word) {
+			return "", errors.Errorf("pairing code %q: unknown word %q", s, word)
+		}
+	}
+
+	return strings.Join(parts, "-"), nil
+}
+
+// SessionID returns a session ID peers of a parsed code join.
+func SessionID(code string) string {
+	parts := strings.SplitN(code, "-", 3)
+
+	nameplate := strings.Join(parts[:2], "-")
+
+	return uuid.NewSHA1(uuid.Nil, []byte(sessionLabel+nameplate)).String()
+}
+
+func isWord(word string) bool {
+	for _, w := range words {
+		if w == word {
+			return true
+		}
+	}
+
+	return false
+}
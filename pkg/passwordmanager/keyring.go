@@ -0,0 +1,78 @@
+// Keyring keeps the first password (p1) and the second one (p2) in a credential
+// store of an OS instead of a local file: macOS Keychain, Windows Credential
+// Manager or Secret Service (e.g. GNOME Keyring or KWallet) elsewhere. A store
+// protects them with a login of a user, so no master passphrase is needed.
+//
+// Both passwords are kept in a single entry of Service and Account (a generic
+// password of Keychain, a generic credential of "${Service}:${Account}" of
+// Credential Manager and an item of "service" and "account" attributes of
+// Secret Service), which holds "${len(p1)}${p1}${len(p2)}${p2}" encoded in
+// base64 (see: encodePasswords()).
+
+package passwordmanager
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultKeyringService is a service entries of passwords are kept under.
+const DefaultKeyringService = "distributed-backup"
+
+type Keyring struct {
+	cfg KeyringConfig
+}
+
+type KeyringConfig struct {
+	// Service is DefaultKeyringService if it's empty.
+	Service string
+	// Account tells passwords of different backups apart.
+	Account string
+}
+
+func NewKeyring(cfg KeyringConfig) (*Keyring, error) {
+	if len(cfg.Service) == 0 {
+		cfg.Service = DefaultKeyringService
+	}
+
+	if len(cfg.Account) == 0 {
+		return nil, errors.New("keyring account is empty")
+	}
+
+	// Names are passed to tools of a store (see: keyringSet()), which take them
+	// in quotes or as separate arguments.
+	for _, name := range []string{cfg.Service, cfg.Account} {
+		if strings.ContainsAny(name, "\"\\\r\n") {
+			return nil, errors.Errorf("unsafe keyring name: %q", name)
+		}
+	}
+
+	return &Keyring{cfg: cfg}, nil
+}
+
+func (m *Keyring) SavePasswords(p1, p2 string) error {
+	payload, err := encodePasswords(p1, p2)
+	if err != nil {
+		return err
+	}
+
+	err = keyringSet(m.cfg.Service, m.cfg.Account, base64.StdEncoding.EncodeToString(payload))
+
+	return errors.Wrapf(err, "keyring entry %s", m.cfg.Account)
+}
+
+func (m *Keyring) GetPasswords() (p1, p2 string, err error) {
+	secret, err := keyringGet(m.cfg.Service, m.cfg.Account)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "keyring entry %s", m.cfg.Account)
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(strings.TrimSpace(secret))
+	if err != nil {
+		return "", "", errors.Wrapf(err, "keyring entry %s is malformed", m.cfg.Account)
+	}
+
+	return decodePasswords(payload)
+}
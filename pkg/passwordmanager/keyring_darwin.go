@@ -0,0 +1,47 @@
+package passwordmanager
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// securityItemNotFound is an exit code of security(1) for a missing item.
+const securityItemNotFound = 44
+
+// keyringSet keeps a generic password in the default keychain with security(1).
+// A command is given on its standard input, so that a secret doesn't show up in
+// a process list.
+func keyringSet(service, account, secret string) error {
+	cmd := exec.Command("/usr/bin/security", "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s \"%s\" -a \"%s\" -w \"%s\"\n", service, account, secret))
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrap(err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+func keyringGet(service, account string) (string, error) {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command("/usr/bin/security", "find-generic-password", "-s", service, "-a", account, "-w")
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+
+	var exitErr *exec.ExitError
+
+	switch {
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == securityItemNotFound:
+		return "", ErrNotFound
+	case err != nil:
+		return "", errors.Wrap(err, strings.TrimSpace(stderr.String()))
+	}
+
+	return string(out), nil
+}
@@ -0,0 +1,57 @@
+//go:build !darwin && !windows
+
+package passwordmanager
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// secretTool is a client of Secret Service of libsecret (e.g. the libsecret-tools
+// package), which talks to a keyring daemon over D-Bus.
+const secretTool = "secret-tool"
+
+// keyringSet keeps an item of Secret Service with secret-tool(1), a secret is
+// given on its standard input, so that it doesn't show up in a process list.
+func keyringSet(service, account, secret string) error {
+	cmd := exec.Command(secretTool, "store", "--label="+service+" passwords of "+account, "service", service, "account", account)
+	cmd.Stdin = strings.NewReader(secret)
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return secretToolError(err, out)
+	}
+
+	return nil
+}
+
+func keyringGet(service, account string) (string, error) {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(secretTool, "lookup", "service", service, "account", account)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+
+	var exitErr *exec.ExitError
+
+	switch {
+	// A missing item fails a lookup without telling anything.
+	case errors.As(err, &exitErr) && len(out) == 0 && stderr.Len() == 0:
+		return "", ErrNotFound
+	case err != nil:
+		return "", secretToolError(err, stderr.Bytes())
+	}
+
+	return string(out), nil
+}
+
+func secretToolError(err error, out []byte) error {
+	if errors.Is(err, exec.ErrNotFound) {
+		return errors.Wrap(err, "Secret Service requires secret-tool of libsecret")
+	}
+
+	return errors.Wrap(err, strings.TrimSpace(string(out)))
+}
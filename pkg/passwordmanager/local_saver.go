@@ -5,7 +5,7 @@
 // and p2 (see: GetPasswords()).
 //
 // An encrypted value that is stored in a file named PasswordFile is presented as
-// "${len(p1)}${p1}${len(p2)}${p2}" (see: writePassword() and readPassword()).
+// "${len(p1)}${p1}${len(p2)}${p2}" (see: encodePasswords()).
 
 package passwordmanager
 
@@ -34,17 +34,7 @@ func NewLocalSaver(cfg LocalSaverConfig, crypto Crypto) *LocalSaver {
 }
 
 func (m *LocalSaver) SavePasswords(p1, p2 string) error {
-	buf := &bytes.Buffer{}
-
-	if err := m.writePassword(buf, p1); err != nil {
-		return err
-	}
-
-	if err := m.writePassword(buf, p2); err != nil {
-		return err
-	}
-
-	payload, err := io.ReadAll(buf)
+	payload, err := encodePasswords(p1, p2)
 	if err != nil {
 		return err
 	}
@@ -65,14 +55,33 @@ func (m *LocalSaver) GetPasswords() (p1, p2 string, err error) {
 		return "", "", err
 	}
 
-	buf := bytes.NewBuffer(decrypted)
+	return decodePasswords(decrypted)
+}
+
+// encodePasswords presents p1 and p2 as "${len(p1)}${p1}${len(p2)}${p2}".
+func encodePasswords(p1, p2 string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	if err := writePassword(buf, p1); err != nil {
+		return nil, err
+	}
+
+	if err := writePassword(buf, p2); err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(buf)
+}
+
+func decodePasswords(payload []byte) (p1, p2 string, err error) {
+	buf := bytes.NewBuffer(payload)
 
-	p1, err = m.readPassword(buf)
+	p1, err = readPassword(buf)
 	if err != nil {
 		return "", "", err
 	}
 
-	p2, err = m.readPassword(buf)
+	p2, err = readPassword(buf)
 	if err != nil {
 		return "", "", err
 	}
@@ -80,7 +89,7 @@ func (m *LocalSaver) GetPasswords() (p1, p2 string, err error) {
 	return p1, p2, nil
 }
 
-func (m *LocalSaver) writePassword(w io.Writer, password string) error {
+func writePassword(w io.Writer, password string) error {
 	b := []byte(password)
 	length := uint8(len(b))
 
@@ -91,7 +100,7 @@ func (m *LocalSaver) writePassword(w io.Writer, password string) error {
 	return binary.Write(w, binary.BigEndian, b)
 }
 
-func (m *LocalSaver) readPassword(r io.Reader) (string, error) {
+func readPassword(r io.Reader) (string, error) {
 	var length uint8
 
 	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
@@ -0,0 +1,22 @@
+package passwordmanager
+
+import "github.com/pkg/errors"
+
+// ErrNotFound means that no passwords have been saved to a store yet.
+var ErrNotFound = errors.New("passwords aren't found")
+
+// Manager saves the first password (p1) and the second one (p2) and takes them
+// back, each implementation keeps them in a store of its own (see: LocalSaver,
+// Keyring and Vault).
+type Manager interface {
+	SavePasswords(p1, p2 string) error
+	GetPasswords() (p1, p2 string, err error)
+}
+
+// TransferKeyManager is implemented by a manager which also keeps a pre-shared
+// key of transfers besides passwords, so that peers of a team needn't be given
+// it one by one.
+type TransferKeyManager interface {
+	// TransferKey returns an empty key if none is kept.
+	TransferKey() (string, error)
+}
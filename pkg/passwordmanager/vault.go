@@ -0,0 +1,301 @@
+// Vault keeps the first password (p1), the second one (p2) and optionally a
+// pre-shared transfer key in a secret of a KV version 2 secrets engine of
+// HashiCorp Vault, for teams which keep secrets in one place. Vault protects
+// them with its own policies, so no master passphrase is needed.
+//
+// A secret holds them in the "password1", "password2" and "transfer_key" fields,
+// other fields of it are kept as they are when passwords are saved.
+
+package passwordmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-backup/pkg/proxy"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultVaultAppRoleMount = "approle"
+	defaultVaultTimeout      = 30 * time.Second
+	// maxVaultResponseSize bounds a response of Vault read into memory.
+	maxVaultResponseSize = 1 << 20
+)
+
+// Fields of a secret of Vault.
+const (
+	vaultFieldPassword1   = "password1"
+	vaultFieldPassword2   = "password2"
+	vaultFieldTransferKey = "transfer_key"
+)
+
+type Vault struct {
+	cfg    VaultConfig
+	client *http.Client
+
+	mx    sync.Mutex
+	token string
+}
+
+type VaultConfig struct {
+	// Address is a URL of a Vault server, e.g. "https://vault.example.com:8200".
+	Address string
+	// Path is "${mount}/${path}" of a secret, e.g. "secret/backups/documents"
+	// of a secrets engine mounted at "secret".
+	Path string
+	// Namespace is a namespace of Vault Enterprise a secret is in.
+	Namespace string
+	// Token authenticates requests, AppRole is logged in with otherwise.
+	Token string
+	// RoleID and SecretID are credentials of AppRole mounted at AppRoleMount,
+	// "approle" by default.
+	RoleID       string
+	SecretID     string
+	AppRoleMount string
+	// Timeout bounds a request, default is 30 seconds.
+	Timeout time.Duration
+	// Proxy is a proxy requests are made through, proxy environment variables
+	// are used if nil.
+	Proxy *url.URL
+}
+
+func NewVault(cfg VaultConfig) (*Vault, error) {
+	if len(cfg.Address) == 0 {
+		return nil, errors.New("Vault address is empty")
+	}
+
+	u, err := url.Parse(cfg.Address)
+	if err != nil {
+		return nil, errors.Wrap(err, "Vault address")
+	}
+
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, errors.Errorf("Vault address must be an http:// or https:// URL: %s", cfg.Address)
+	}
+
+	cfg.Path = strings.Trim(cfg.Path, "/")
+
+	if !strings.Contains(cfg.Path, "/") {
+		return nil, errors.Errorf("Vault path must be ${mount}/${path} of a secret: %q", cfg.Path)
+	}
+
+	if len(cfg.Token) == 0 && (len(cfg.RoleID) == 0 || len(cfg.SecretID) == 0) {
+		return nil, errors.New("Vault token or AppRole role and secret IDs required")
+	}
+
+	if len(cfg.AppRoleMount) == 0 {
+		cfg.AppRoleMount = defaultVaultAppRoleMount
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultVaultTimeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy.HTTPProxy(cfg.Proxy)
+
+	return &Vault{
+		cfg:    cfg,
+		client: &http.Client{Transport: transport, Timeout: cfg.Timeout},
+		token:  cfg.Token,
+	}, nil
+}
+
+func (m *Vault) SavePasswords(p1, p2 string) error {
+	// A write replaces a whole secret, so that fields other than passwords
+	// (e.g. a transfer key) are read to be written back.
+	data, err := m.read()
+	if errors.Is(err, ErrNotFound) {
+		data, err = map[string]any{}, nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	data[vaultFieldPassword1] = p1
+	data[vaultFieldPassword2] = p2
+
+	_, err = m.do(http.MethodPost, m.dataPath(), map[string]any{"data": data})
+
+	return errors.Wrapf(err, "Vault secret %s", m.cfg.Path)
+}
+
+func (m *Vault) GetPasswords() (p1, p2 string, err error) {
+	data, err := m.read()
+	if err != nil {
+		return "", "", err
+	}
+
+	p1, _ = data[vaultFieldPassword1].(string)
+	p2, _ = data[vaultFieldPassword2].(string)
+
+	if len(p1) == 0 || len(p2) == 0 {
+		return "", "", errors.Wrapf(ErrNotFound, "Vault secret %s lacks %s or %s", m.cfg.Path, vaultFieldPassword1, vaultFieldPassword2)
+	}
+
+	return p1, p2, nil
+}
+
+func (m *Vault) TransferKey() (string, error) {
+	data, err := m.read()
+	if err != nil {
+		return "", err
+	}
+
+	key, _ := data[vaultFieldTransferKey].(string)
+
+	return key, nil
+}
+
+// read returns fields of the latest version of a secret.
+func (m *Vault) read() (map[string]any, error) {
+	body, err := m.do(http.MethodGet, m.dataPath(), nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Vault secret %s", m.cfg.Path)
+	}
+
+	var resp struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, errors.Wrapf(err, "Vault secret %s is malformed", m.cfg.Path)
+	}
+
+	// Data of a deleted version is null.
+	if resp.Data.Data == nil {
+		return nil, errors.Wrapf(ErrNotFound, "Vault secret %s is deleted", m.cfg.Path)
+	}
+
+	return resp.Data.Data, nil
+}
+
+// dataPath returns a path of an API of a secret, which is "data/" inserted
+// after a mount of a secrets engine.
+func (m *Vault) dataPath() string {
+	mount, path, _ := strings.Cut(m.cfg.Path, "/")
+
+	return mount + "/data/" + path
+}
+
+// do makes a request to an API path of Vault with a token, logging in with
+// AppRole first if there's no token yet, and returns a body of a successful
+// response.
+func (m *Vault) do(method, path string, payload any) ([]byte, error) {
+	token, err := m.authToken()
+	if err != nil {
+		return nil, err
+	}
+
+	return m.request(method, path, token, payload)
+}
+
+func (m *Vault) authToken() (string, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if len(m.token) != 0 {
+		return m.token, nil
+	}
+
+	body, err := m.request(http.MethodPost, "auth/"+m.cfg.AppRoleMount+"/login", "", map[string]string{
+		"role_id":   m.cfg.RoleID,
+		"secret_id": m.cfg.SecretID,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "Vault AppRole login")
+	}
+
+	var resp struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+
+	if err := json.Unmarshal(body, &resp); err != nil || len(resp.Auth.ClientToken) == 0 {
+		return "", errors.New("Vault AppRole login: no client token in a response")
+	}
+
+	m.token = resp.Auth.ClientToken
+
+	return m.token, nil
+}
+
+func (m *Vault) request(method, path, token string, payload any) ([]byte, error) {
+	var body io.Reader
+
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		body = bytes.NewReader(b)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(m.cfg.Address, "/")+"/v1/"+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(token) != 0 {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	if len(m.cfg.Namespace) != 0 {
+		req.Header.Set("X-Vault-Namespace", m.cfg.Namespace)
+	}
+
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxVaultResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound && method == http.MethodGet:
+		return nil, ErrNotFound
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, vaultError(resp.StatusCode, b)
+	}
+
+	return b, nil
+}
+
+// vaultError returns an error of a failed response, telling errors Vault
+// reports in its body.
+func vaultError(status int, body []byte) error {
+	var resp struct {
+		Errors []string `json:"errors"`
+	}
+
+	if json.Unmarshal(body, &resp) == nil && len(resp.Errors) != 0 {
+		return errors.Errorf("%d %s: %s", status, http.StatusText(status), strings.Join(resp.Errors, "; "))
+	}
+
+	return errors.Errorf("%d %s", status, http.StatusText(status))
+}
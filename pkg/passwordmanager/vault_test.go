@@ -0,0 +1,160 @@
+package passwordmanager
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	testVaultToken    = "test-token"
+	testVaultRoleID   = "role"
+	testVaultSecretID = "secret"
+)
+
+// testVault is a Vault server keeping secrets of a KV version 2 secrets engine in
+// memory, which serves requests Vault needs only: reads and writes of secrets
+// with a token, and logins of AppRole.
+type testVault struct {
+	mx      sync.Mutex
+	secrets map[string]map[string]any
+}
+
+func newTestVault(t *testing.T, secrets map[string]map[string]any) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(&testVault{secrets: secrets})
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func (v *testVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mx.Lock()
+	defer v.mx.Unlock()
+
+	if r.URL.Path == "/v1/auth/approle/login" {
+		var creds map[string]string
+		if json.NewDecoder(r.Body).Decode(&creds) != nil || creds["role_id"] != testVaultRoleID || creds["secret_id"] != testVaultSecretID {
+			http.Error(w, `{"errors":["invalid role or secret ID"]}`, http.StatusBadRequest)
+
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{"auth": map[string]any{"client_token": testVaultToken}})
+
+		return
+	}
+
+	if r.Header.Get("X-Vault-Token") != testVaultToken {
+		http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		data, ok := v.secrets[r.URL.Path]
+		if !ok {
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"data": data}})
+	case http.MethodPost:
+		var req struct {
+			Data map[string]any `json:"data"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		v.secrets[r.URL.Path] = req.Data
+	}
+}
+
+// TestVault saves passwords to a secret logged in to with AppRole, and checks
+// that they're taken back along with a transfer key kept in the secret
+// beforehand.
+func TestVault(t *testing.T) {
+	const transferKey = "test-transfer-key"
+
+	server := newTestVault(t, map[string]map[string]any{
+		"/v1/secret/data/backups": {vaultFieldTransferKey: transferKey},
+	})
+
+	m, err := NewVault(VaultConfig{
+		Address:  server.URL,
+		Path:     "secret/backups",
+		RoleID:   testVaultRoleID,
+		SecretID: testVaultSecretID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SavePasswords("password-1", "password-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	p1, p2, err := m.GetPasswords()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p1 != "password-1" || p2 != "password-2" {
+		t.Errorf("GetPasswords() = %q, %q, want saved ones", p1, p2)
+	}
+
+	key, err := m.TransferKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key != transferKey {
+		t.Errorf("TransferKey() = %q, transfer key is lost when passwords are saved", key)
+	}
+}
+
+func TestVaultMissingSecret(t *testing.T) {
+	server := newTestVault(t, map[string]map[string]any{})
+
+	m, err := NewVault(VaultConfig{
+		Address: server.URL,
+		Path:    "secret/missing",
+		Token:   testVaultToken,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := m.GetPasswords(); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetPasswords() = %v, want ErrNotFound", err)
+	}
+}
+
+func TestVaultAppRoleLoginFails(t *testing.T) {
+	server := newTestVault(t, map[string]map[string]any{})
+
+	m, err := NewVault(VaultConfig{
+		Address:  server.URL,
+		Path:     "secret/backups",
+		RoleID:   testVaultRoleID,
+		SecretID: "wrong",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := m.GetPasswords(); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("GetPasswords() = %v, want a login error", err)
+	}
+}
@@ -0,0 +1,206 @@
+package peer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pkg/errors"
+)
+
+// ErrFingerprintMismatch means that a DTLS certificate of the other peer isn't
+// the one of ExpectedFingerprint, e.g. since signaling has substituted its own
+// session description.
+var ErrFingerprintMismatch = errors.New("fingerprint mismatch")
+
+// GenerateDTLSCertificate returns a new PEM encoded DTLS certificate along with
+// its private key, which is long-lived so that the other peer can pin its
+// fingerprint (see: WebRTCConfig.ExpectedFingerprint).
+func GenerateDTLSCertificate() (string, error) {
+	cert, err := newDTLSCertificate()
+	if err != nil {
+		return "", err
+	}
+
+	return cert.PEM()
+}
+
+// newDTLSCertificate generates a self-signed certificate lasting for
+// staticCertificateLifetime.
+func newDTLSCertificate() (*webrtc.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := webrtc.NewCertificate(key, x509.Certificate{
+		Issuer:       pkix.Name{CommonName: "distributed-backup"},
+		Subject:      pkix.Name{CommonName: "distributed-backup"},
+		NotBefore:    time.Now().Add(-24 * time.Hour),
+		NotAfter:     time.Now().Add(staticCertificateLifetime),
+		SerialNumber: serial,
+		Version:      2,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "certificate")
+	}
+
+	return cert, nil
+}
+
+// ParseFingerprint parses a SHA-256 fingerprint of a DTLS certificate as it's
+// presented in a session description, e.g. "sha-256 AB:CD:...", with or without
+// the algorithm, colons and in any case. It returns the form Fingerprint()
+// presents one in.
+func ParseFingerprint(s string) (string, error) {
+	v := strings.TrimSpace(s)
+
+	if algorithm, value, ok := strings.Cut(v, " "); ok {
+		if !strings.EqualFold(algorithm, "sha-256") {
+			return "", errors.Errorf("fingerprint %q: only sha-256 is supported", s)
+		}
+
+		v = strings.TrimSpace(value)
+	}
+
+	b, err := hex.DecodeString(strings.ReplaceAll(v, ":", ""))
+	if err != nil || len(b) != sha256.Size {
+		return "", errors.Errorf("fingerprint %q: %d hex bytes expected", s, sha256.Size)
+	}
+
+	return formatFingerprint(b), nil
+}
+
+// dtlsFingerprint returns a SHA-256 fingerprint of a DER certificate.
+func dtlsFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+
+	return formatFingerprint(sum[:])
+}
+
+// formatFingerprint presents a digest as colon-separated uppercase hex bytes.
+func formatFingerprint(digest []byte) string {
+	parts := make([]string, len(digest))
+
+	for i, b := range digest {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(parts, ":")
+}
+
+// DTLSFingerprint returns a SHA-256 fingerprint of a PEM encoded DTLS
+// certificate (see: GenerateDTLSCertificate()).
+func DTLSFingerprint(pem string) (string, error) {
+	cert, err := webrtc.CertificateFromPEM(pem)
+	if err != nil {
+		return "", errors.Wrap(err, "DTLS certificate")
+	}
+
+	return certificateFingerprint256(cert)
+}
+
+// certificateFingerprint256 returns a SHA-256 fingerprint of a certificate.
+func certificateFingerprint256(cert *webrtc.Certificate) (string, error) {
+	fingerprints, err := cert.GetFingerprints()
+	if err != nil {
+		return "", err
+	}
+
+	for _, f := range fingerprints {
+		if f.Algorithm == "sha-256" {
+			return ParseFingerprint(f.Value)
+		}
+	}
+
+	return "", errors.New("certificate has no sha-256 fingerprint")
+}
+
+// Fingerprint returns a SHA-256 fingerprint of a DTLS certificate of this peer,
+// which the other one pins with ExpectedFingerprint.
+func (p *WebRTC) Fingerprint() string {
+	certs := p.connection().GetConfiguration().Certificates
+	if len(certs) == 0 {
+		return ""
+	}
+
+	fp, err := certificateFingerprint256(&certs[0])
+	if err != nil {
+		p.log.Error(errors.Wrap(err, "certificate fingerprint"))
+	}
+
+	return fp
+}
+
+// CertificateFingerprints returns SHA-256 fingerprints of a DTLS certificate of
+// this peer and one of the other peer an established connection is secured
+// with, which authentication of a transfer is bound to (see:
+// filemanager.ChannelBinder).
+func (p *WebRTC) CertificateFingerprints() (local, remote string, err error) {
+	local = p.Fingerprint()
+	if len(local) == 0 {
+		return "", "", errors.New("no local certificate")
+	}
+
+	der := p.connection().SCTP().Transport().GetRemoteCertificate()
+	if len(der) == 0 {
+		return "", "", errors.New("no remote certificate")
+	}
+
+	return local, dtlsFingerprint(der), nil
+}
+
+// tlsFingerprints returns SHA-256 fingerprints of a certificate of this peer
+// and one of the other peer a TLS connection is secured with.
+func tlsFingerprints(cfg *tls.Config, state tls.ConnectionState) (local, remote string, err error) {
+	if len(cfg.Certificates) == 0 || len(cfg.Certificates[0].Certificate) == 0 {
+		return "", "", errors.New("no local certificate")
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		return "", "", errors.New("no remote certificate")
+	}
+
+	return dtlsFingerprint(cfg.Certificates[0].Certificate[0]), dtlsFingerprint(state.PeerCertificates[0].Raw), nil
+}
+
+// verifyRemoteCertificate checks a DTLS certificate the other peer has
+// presented against ExpectedFingerprint, if it's set. A certificate is the one a
+// connection is secured with rather than one of a session description, which is
+// only as trusted as signaling is.
+func (p *WebRTC) verifyRemoteCertificate() error {
+	if len(p.cfg.ExpectedFingerprint) == 0 {
+		return nil
+	}
+
+	expected, err := ParseFingerprint(p.cfg.ExpectedFingerprint)
+	if err != nil {
+		return err
+	}
+
+	der := p.connection().SCTP().Transport().GetRemoteCertificate()
+	if len(der) == 0 {
+		return errors.Wrap(ErrFingerprintMismatch, "no remote certificate")
+	}
+
+	if actual := dtlsFingerprint(der); actual != expected {
+		return errors.Wrapf(ErrFingerprintMismatch, "remote certificate %s", actual)
+	}
+
+	return nil
+}
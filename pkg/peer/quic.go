@@ -0,0 +1,739 @@
+package peer
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/metrics"
+	"distributed-backup/pkg/signal"
+
+	"github.com/pkg/errors"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// quicALPN is an application protocol peers negotiate, so that a QUIC
+	// endpoint of something else isn't taken for a peer.
+	quicALPN = "distributed-backup"
+	// quicKeepAlivePeriod keeps an idle connection (e.g. while a sender
+	// archives a directory) and NAT mappings of it alive.
+	quicKeepAlivePeriod = 10 * time.Second
+	// quicIdleTimeout is a duration a connection the other peer sends nothing
+	// over is lost after.
+	quicIdleTimeout = 30 * time.Second
+	// quicRedialInterval is an interval a dialing peer connects again at until a
+	// listening one accepts it.
+	quicRedialInterval = 5 * time.Second
+	// quicDialTimeout bounds connecting to addresses the other peer has sent
+	// through signaling.
+	quicDialTimeout = 30 * time.Second
+	// quicOpenTimeout bounds opening streams of a connection once it's made.
+	quicOpenTimeout = 30 * time.Second
+)
+
+// Error codes a connection is closed with, the other peer takes one closed with
+// quicErrNone as shut down rather than failed (see: fail()).
+const (
+	quicErrNone quic.ApplicationErrorCode = iota
+	quicErrFailed
+	quicErrRejected
+)
+
+// QUIC is a connection to a remote peer over QUIC secured with mutual TLS as
+// TCPTLS is, which carries messages over multiplexed streams with their own
+// flow control. One peer listens on a UDP address and accepts a single
+// connection, and the other one connects to it. The address is either given
+// by Addr of QUICConfig, or a peer which finds the other one waiting through
+// signaling listens on a random port and sends its addresses along with a
+// fingerprint of its certificate, and the waiting one connects to them. QUIC
+// doesn't traverse NAT as WebRTC does, so signaled addresses are local ones
+// of a peer (e.g. within a LAN or a VPN).
+type QUIC struct {
+	cfg       QUICConfig
+	log       log.Logger
+	signal    Signal
+	tlsConfig *tls.Config
+	quicCfg   *quic.Config
+
+	mx        sync.Mutex
+	transport *quic.Transport
+	conn      quic.Connection
+	main      *quicStream
+	streams   []*quicStream
+	closed    bool
+	shut      bool
+
+	shutdownChan     chan struct{}
+	shutdownOnce     sync.Once
+	establishHandler func()
+}
+
+type QUICConfig struct {
+	// Addr is a host:port a peer listens on if Listen is set, or connects to
+	// otherwise. Peers exchange addresses through signaling if it's empty.
+	Addr   string
+	Listen bool
+	// Streams is a number of streams a connecting peer opens, the first one is
+	// read and written by Read() and Write(), and others are returned by
+	// Streams(). A single stream is opened if it's 0.
+	Streams int
+	// Certificate and RootCAs are as ones of TCPTLSConfig are.
+	Certificate *tls.Certificate
+	RootCAs     *x509.CertPool
+	// Log is a logger entries are written with (e.g. with session fields attached),
+	// the global logger is used if nil.
+	Log log.Logger
+}
+
+// quicOffer is sent through signaling by a listening peer, so that the other
+// one connects to it.
+type quicOffer struct {
+	Addrs []string `json:"addrs"`
+	// Fingerprint is a hex SHA-256 digest of a certificate of a listening peer,
+	// a connecting one accepts no other.
+	Fingerprint string `json:"fingerprint"`
+}
+
+// NewQUIC makes a connection of cfg, signal is used only if cfg.Addr is empty.
+func NewQUIC(cfg QUICConfig, signal Signal) (*QUIC, error) {
+	if len(cfg.Addr) == 0 && signal == nil {
+		return nil, errors.New("neither address nor signaling is given")
+	}
+
+	if cfg.Streams < 0 || cfg.Streams > MaxStreams {
+		return nil, errors.Errorf("number of streams must be from 1 to %d", MaxStreams)
+	}
+
+	if cfg.Log == nil {
+		cfg.Log = log.New()
+	}
+
+	tlsConfig, err := mutualTLSConfig(cfg.Certificate, cfg.RootCAs)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig.NextProtos = []string{quicALPN}
+
+	p := &QUIC{
+		cfg:       cfg,
+		log:       cfg.Log,
+		tlsConfig: tlsConfig,
+		quicCfg: &quic.Config{
+			KeepAlivePeriod: quicKeepAlivePeriod,
+			MaxIdleTimeout:  quicIdleTimeout,
+		},
+		shutdownChan: make(chan struct{}),
+	}
+
+	if len(cfg.Addr) == 0 {
+		p.signal = signal
+		p.signal.OnSDP(p.onSignalOffer)
+		p.signal.OnCandidate(func([]byte) {})
+	}
+
+	if cfg.RootCAs == nil {
+		p.log.Info("certificate of the other peer isn't verified without a CA")
+	}
+
+	return p, nil
+}
+
+// Dial starts listening for the other peer or connecting to it until it's
+// connected or a connection is closed. Without Addr a peer which finds the
+// other one waiting listens, and a waiting one connects once it gets an offer.
+func (p *QUIC) Dial() error {
+	if len(p.cfg.Addr) != 0 {
+		if !p.cfg.Listen {
+			go p.redial()
+
+			return nil
+		}
+
+		_, err := p.listen(p.cfg.Addr)
+
+		return err
+	}
+
+	if err := p.signal.Ping(); err != nil {
+		if !errors.Is(err, signal.ErrNoCandidatesFound) {
+			return err
+		}
+
+		p.log.Info(err, ", waiting...")
+
+		return nil
+	}
+
+	p.log.Info("candidate found, start connecting...")
+
+	addr, err := p.listen(":0")
+	if err != nil {
+		return err
+	}
+
+	offer, err := p.offer(addr)
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(p.signal.SendSDP(offer), "send offer")
+}
+
+// listen starts accepting connections on addr and returns a local address
+// it listens on.
+func (p *QUIC) listen(addr string) (*net.UDPAddr, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// A transport is kept along with a connection, which is lost once the UDP
+	// socket of a transport is closed.
+	transport := &quic.Transport{Conn: udpConn}
+
+	listener, err := transport.Listen(p.tlsConfig, p.quicCfg)
+	if err != nil {
+		transport.Close()
+		udpConn.Close()
+
+		return nil, err
+	}
+
+	p.mx.Lock()
+	closed := p.closed
+	p.transport = transport
+	p.mx.Unlock()
+
+	if closed {
+		p.Close()
+
+		return nil, errors.New("connection is closed")
+	}
+
+	local := udpConn.LocalAddr().(*net.UDPAddr)
+
+	p.log.WithField(log.FieldAddr, local.String()).Info("listening for the other peer")
+
+	go p.accept(listener)
+
+	return local, nil
+}
+
+// accept accepts connections until a peer is closed, the first one whose
+// streams are opened is kept and others are rejected. A listener is closed
+// along with a transport only (see: Close()), since closing it alone may
+// deadlock closing a transport.
+func (p *QUIC) accept(listener *quic.Listener) {
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			if !p.isClosed() {
+				p.log.Error(err)
+				p.Close()
+			}
+
+			return
+		}
+
+		if _, err := p.mainStream(); err == nil {
+			conn.CloseWithError(quicErrRejected, "already connected")
+
+			continue
+		}
+
+		if err := p.acceptStreams(conn); err != nil {
+			p.log.WithField(log.FieldAddr, conn.RemoteAddr().String()).Debug(errors.Wrap(err, "connection isn't kept"))
+			conn.CloseWithError(quicErrRejected, err.Error())
+		}
+	}
+}
+
+// acceptStreams accepts streams a connecting peer opens (see: openStreams()).
+func (p *QUIC) acceptStreams(conn quic.Connection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), quicOpenTimeout)
+	defer cancel()
+
+	hello := make([]byte, 1)
+
+	s, err := conn.AcceptStream(ctx)
+	if err != nil {
+		return err
+	}
+
+	if n, err := readMessage(s, hello); err != nil || n != 1 {
+		return errors.New("malformed hello of a stream")
+	}
+
+	count := int(hello[0])
+
+	if count < 1 || count > MaxStreams {
+		return errors.Errorf("number of streams must be from 1 to %d", MaxStreams)
+	}
+
+	main := &quicStream{Stream: s, p: p}
+	streams := make([]*quicStream, count-1)
+
+	for range streams {
+		s, err := conn.AcceptStream(ctx)
+		if err != nil {
+			return err
+		}
+
+		if n, err := readMessage(s, hello); err != nil || n != 1 || hello[0] == 0 || int(hello[0]) >= count {
+			return errors.New("malformed hello of a stream")
+		}
+
+		streams[hello[0]-1] = &quicStream{Stream: s, p: p}
+	}
+
+	for _, s := range streams {
+		if s == nil {
+			return errors.New("stream is opened twice")
+		}
+	}
+
+	p.establish(conn, main, streams)
+
+	return nil
+}
+
+// redial connects to Addr, it connects again every quicRedialInterval until
+// streams of a connection are opened, e.g. if the other peer isn't run yet.
+func (p *QUIC) redial() {
+	for {
+		if p.isClosed() {
+			return
+		}
+
+		err := p.dial(context.Background(), p.cfg.Addr, p.tlsConfig)
+		if err == nil {
+			return
+		}
+
+		p.log.WithField(log.FieldAddr, p.cfg.Addr).Debug(errors.Wrap(err, "not connected yet"))
+
+		select {
+		case <-time.After(quicRedialInterval):
+		case <-p.shutdownChan:
+			return
+		}
+	}
+}
+
+// dial connects to addr and opens streams of a connection.
+func (p *QUIC) dial(ctx context.Context, addr string, tlsConfig *tls.Config) error {
+	conn, err := quic.DialAddr(ctx, addr, tlsConfig, p.quicCfg)
+	if err != nil {
+		return err
+	}
+
+	return p.open(conn)
+}
+
+// open opens streams of a connection made by a dialing peer and keeps it.
+func (p *QUIC) open(conn quic.Connection) error {
+	main, streams, err := p.openStreams(conn)
+	if err != nil {
+		conn.CloseWithError(quicErrRejected, err.Error())
+
+		return errors.Wrap(err, "QUIC streams")
+	}
+
+	p.establish(conn, main, streams)
+
+	return nil
+}
+
+// openStreams opens Streams streams of a connection, each of them starts with a
+// hello message, so that a listening peer accepts it at once. A hello of the
+// first one is a number of streams, and ones of others are their indexes.
+func (p *QUIC) openStreams(conn quic.Connection) (*quicStream, []*quicStream, error) {
+	count := p.cfg.Streams
+	if count == 0 {
+		count = 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), quicOpenTimeout)
+	defer cancel()
+
+	var (
+		main    *quicStream
+		streams []*quicStream
+	)
+
+	for i := 0; i < count; i++ {
+		s, err := conn.OpenStreamSync(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		hello := byte(i)
+		if i == 0 {
+			hello = byte(count)
+		}
+
+		if err := writeMessage(s, []byte{hello}); err != nil {
+			return nil, nil, err
+		}
+
+		if i == 0 {
+			main = &quicStream{Stream: s, p: p}
+		} else {
+			streams = append(streams, &quicStream{Stream: s, p: p})
+		}
+	}
+
+	return main, streams, nil
+}
+
+// offer returns an offer of addresses of local interfaces a peer listens on at
+// a port of addr.
+func (p *QUIC) offer(addr *net.UDPAddr) ([]byte, error) {
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, errors.Wrap(err, "interface addresses")
+	}
+
+	port := strconv.Itoa(addr.Port)
+	offer := quicOffer{Fingerprint: certificateFingerprint(p.tlsConfig.Certificates[0].Certificate[0])}
+
+	for _, a := range ifaceAddrs {
+		ipNet, ok := a.(*net.IPNet)
+		// Link-local addresses can't be dialed without a zone of an interface.
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		offer.Addrs = append(offer.Addrs, net.JoinHostPort(ipNet.IP.String(), port))
+	}
+
+	if len(offer.Addrs) == 0 {
+		return nil, errors.New("no local address to offer")
+	}
+
+	return json.Marshal(offer)
+}
+
+// onSignalOffer connects to addresses of an offer, they're dialed at once and
+// streams are opened over the first connection made only, so that both peers
+// keep the same one, and others are closed.
+func (p *QUIC) onSignalOffer(payload []byte) {
+	var offer quicOffer
+
+	if err := json.Unmarshal(payload, &offer); err != nil || len(offer.Addrs) == 0 {
+		p.log.Error(errors.New("malformed QUIC offer"))
+
+		return
+	}
+
+	// Only a certificate of the peer which has sent an offer is accepted, as a
+	// fingerprint of a session description is in WebRTC.
+	tlsConfig := p.tlsConfig.Clone()
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 || subtle.ConstantTimeCompare(
+			[]byte(certificateFingerprint(rawCerts[0])), []byte(offer.Fingerprint)) != 1 {
+			return errors.New("certificate doesn't match fingerprint of an offer")
+		}
+
+		return verifyChain(rawCerts, p.cfg.RootCAs)
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), quicDialTimeout)
+		defer cancel()
+
+		conns := make(chan quic.Connection, len(offer.Addrs))
+
+		for _, addr := range offer.Addrs {
+			addr := addr
+
+			go func() {
+				conn, err := quic.DialAddr(ctx, addr, tlsConfig, p.quicCfg)
+				if err != nil {
+					p.log.WithField(log.FieldAddr, addr).Debug(errors.Wrap(err, "not connected"))
+				}
+
+				conns <- conn
+			}()
+		}
+
+		var kept quic.Connection
+
+		for range offer.Addrs {
+			switch conn := <-conns; {
+			case conn == nil:
+			case kept == nil:
+				kept = conn
+				// Dialing other addresses is given up.
+				cancel()
+			default:
+				conn.CloseWithError(quicErrRejected, "another address is connected")
+			}
+		}
+
+		err := errors.New("no offered address is reachable")
+		if kept != nil {
+			err = p.open(kept)
+		}
+
+		if err != nil && !p.isClosed() {
+			p.log.Error(err)
+			p.Close()
+		}
+	}()
+}
+
+// establish keeps the first connection made, and closes others.
+func (p *QUIC) establish(conn quic.Connection, main *quicStream, streams []*quicStream) {
+	p.mx.Lock()
+
+	if p.closed || p.conn != nil {
+		p.mx.Unlock()
+		conn.CloseWithError(quicErrRejected, "already connected")
+
+		return
+	}
+
+	p.conn, p.main, p.streams = conn, main, streams
+	p.mx.Unlock()
+
+	p.log.WithField(log.FieldAddr, conn.RemoteAddr().String()).Info("connected to the other peer")
+
+	if p.establishHandler != nil {
+		p.establishHandler()
+	}
+}
+
+// Read reads a single message of the first stream, a message which doesn't fit
+// payload is skipped with io.ErrShortBuffer.
+func (p *QUIC) Read(payload []byte) (int, error) {
+	s, err := p.mainStream()
+	if err != nil {
+		return 0, err
+	}
+
+	return s.Read(payload)
+}
+
+// Write writes payload as a single message of the first stream.
+func (p *QUIC) Write(payload []byte) (int, error) {
+	s, err := p.mainStream()
+	if err != nil {
+		return 0, err
+	}
+
+	return s.Write(payload)
+}
+
+// Streams returns streams opened along with the one Read() and Write() use,
+// ordered by their indexes. It's empty unless Streams of a connecting peer is
+// more than 1.
+func (p *QUIC) Streams() []io.ReadWriter {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	streams := make([]io.ReadWriter, len(p.streams))
+
+	for i, s := range p.streams {
+		streams[i] = s
+	}
+
+	return streams
+}
+
+// ConnectionInfo returns addresses of an established connection.
+func (p *QUIC) ConnectionInfo() (*ConnectionInfo, error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if p.conn == nil {
+		return nil, errors.New("not connected")
+	}
+
+	return &ConnectionInfo{
+		LocalCandidate:  p.conn.LocalAddr().String(),
+		RemoteCandidate: p.conn.RemoteAddr().String(),
+		RemoteAddr:      p.conn.RemoteAddr().String(),
+	}, nil
+}
+
+// CertificateFingerprints returns SHA-256 fingerprints of certificates of both
+// peers of an established connection (see: WebRTC.CertificateFingerprints()).
+func (p *QUIC) CertificateFingerprints() (local, remote string, err error) {
+	p.mx.Lock()
+	conn := p.conn
+	p.mx.Unlock()
+
+	if conn == nil {
+		return "", "", errors.New("not connected")
+	}
+
+	return tlsFingerprints(p.tlsConfig, conn.ConnectionState().TLS)
+}
+
+// BufferedAmount returns 0, since writes block until data fits a window of a
+// stream.
+func (p *QUIC) BufferedAmount() uint64 {
+	return 0
+}
+
+func (p *QUIC) mainStream() (*quicStream, error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if p.main == nil {
+		return nil, errors.New("not connected")
+	}
+
+	return p.main, nil
+}
+
+func (p *QUIC) isClosed() bool {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	return p.closed
+}
+
+func (p *QUIC) OnEstablish(h func()) {
+	p.establishHandler = h
+}
+
+func (p *QUIC) Done() <-chan struct{} {
+	return p.shutdownChan
+}
+
+// fail closes a connection which has failed with err, so that Done() tells that
+// it's lost. A connection shut down by either peer isn't failed (see:
+// TCPTLS.fail()), neither is one the other peer has closed with quicErrNone.
+func (p *QUIC) fail(err error) error {
+	p.mx.Lock()
+	conn, shut := p.conn, p.shut
+	p.shut = true
+	p.mx.Unlock()
+
+	var appErr *quic.ApplicationError
+
+	if shut || errors.Is(err, io.EOF) || (errors.As(err, &appErr) && appErr.ErrorCode == quicErrNone) {
+		return err
+	}
+
+	conn.CloseWithError(quicErrFailed, err.Error())
+
+	p.shutdownOnce.Do(func() {
+		close(p.shutdownChan)
+	})
+
+	return err
+}
+
+// Shutdown closes streams, the other peer reads an EOF once it reads all data
+// written before.
+func (p *QUIC) Shutdown() {
+	p.mx.Lock()
+	p.shut = true
+	streams := p.streams
+
+	if p.main != nil {
+		streams = append([]*quicStream{p.main}, streams...)
+	}
+
+	p.mx.Unlock()
+
+	for _, s := range streams {
+		s.Close()
+	}
+}
+
+// Close stops listening or connecting and closes a connection.
+func (p *QUIC) Close() {
+	p.mx.Lock()
+	p.closed = true
+	conn, transport := p.conn, p.transport
+	p.mx.Unlock()
+
+	p.Shutdown()
+
+	if conn != nil {
+		conn.CloseWithError(quicErrNone, "")
+	}
+
+	if transport != nil {
+		transport.Close()
+		transport.Conn.Close()
+	}
+
+	p.shutdownOnce.Do(func() {
+		close(p.shutdownChan)
+	})
+}
+
+// quicStream is a stream of QUIC which carries messages framed with their
+// lengths.
+type quicStream struct {
+	quic.Stream
+	p *QUIC
+
+	// rmx and wmx serialize reads and writes of messages, so that frames of
+	// them aren't interleaved.
+	rmx sync.Mutex
+	wmx sync.Mutex
+}
+
+// Read reads a single message, a message which doesn't fit payload is skipped
+// with io.ErrShortBuffer.
+func (s *quicStream) Read(payload []byte) (int, error) {
+	s.rmx.Lock()
+	defer s.rmx.Unlock()
+
+	n, err := readMessage(s.Stream, payload)
+	if err != nil && err != io.ErrShortBuffer {
+		err = s.p.fail(err)
+	}
+
+	metrics.Count("peer_received_bytes", int64(n))
+
+	return n, err
+}
+
+// Write writes payload as a single message.
+func (s *quicStream) Write(payload []byte) (int, error) {
+	if len(payload) > maxFramedMessageSize {
+		return 0, errors.Errorf("message is too large: %d bytes", len(payload))
+	}
+
+	s.wmx.Lock()
+	defer s.wmx.Unlock()
+
+	if err := writeMessage(s.Stream, payload); err != nil {
+		return 0, s.p.fail(err)
+	}
+
+	metrics.Count("peer_sent_bytes", int64(len(payload)))
+
+	return len(payload), nil
+}
+
+// certificateFingerprint returns a hex SHA-256 digest of a DER certificate.
+func certificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+
+	return hex.EncodeToString(sum[:])
+}
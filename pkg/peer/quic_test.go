@@ -0,0 +1,40 @@
+package peer
+
+import (
+	"testing"
+
+	"distributed-backup/pkg/signal"
+)
+
+// TestQUIC connects peers over QUIC, which exchange their addresses through
+// signaling, and checks every stream of a connection.
+func TestQUIC(t *testing.T) {
+	receiverSignal, senderSignal := signal.NewMemoryPair()
+
+	listenSignals(t, receiverSignal, senderSignal)
+
+	receiver, err := NewQUIC(QUICConfig{Streams: 3}, receiverSignal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	sender, err := NewQUIC(QUICConfig{}, senderSignal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	connect(t, receiver, sender)
+	exchange(t, receiver, sender)
+
+	receiverStreams, senderStreams := receiver.Streams(), sender.Streams()
+
+	if len(receiverStreams) != 2 || len(senderStreams) != 2 {
+		t.Fatalf("peers have %d and %d streams besides the first one, 2 expected", len(receiverStreams), len(senderStreams))
+	}
+
+	for i := range receiverStreams {
+		exchange(t, receiverStreams[i], senderStreams[i])
+	}
+}
@@ -1,5 +1,7 @@
 package peer
 
+import "sync"
+
 type Signal interface {
 	// Ping() is used to detect presence or absence of another candidate peer from
 	// other side of signaling process to make decision whether to make an offer
@@ -20,3 +22,109 @@ type Signal interface {
 	OnSDP(func([]byte))
 	OnCandidate(func([]byte))
 }
+
+// NATSignal is implemented by signaling which lets peers exchange their NAT types
+// before negotiation, so that a doomed connection attempt is told early (see:
+// netcheck.PredictConnectivity()).
+type NATSignal interface {
+	SendNAT([]byte) error
+	OnNAT(func([]byte))
+}
+
+// MessageSignal is implemented by signaling which carries typed messages of
+// higher layers besides SDP and candidates, e.g. capabilities, resume offsets
+// or auth challenges, so that they needn't be smuggled through the SDP channel.
+// A type consists of 1 to 32 lowercase letters, digits and dashes, messages of
+// a type without a handler are dropped.
+type MessageSignal interface {
+	Send(typ string, payload []byte) error
+	On(typ string, h func([]byte))
+}
+
+// WatchSignal returns signaling s which calls h once the other peer is heard
+// from: a message of it is received or a ping finds it, so that one can tell
+// whether the other peer has turned up at all. It implements NATSignal and
+// MessageSignal if s does.
+func WatchSignal(s Signal, h func()) Signal {
+	w := &watchedSignal{Signal: s, h: h}
+
+	nat, isNAT := s.(NATSignal)
+	messages, isMessage := s.(MessageSignal)
+
+	switch {
+	case isNAT && isMessage:
+		return &struct {
+			*watchedSignal
+			watchedNATSignal
+			watchedMessageSignal
+		}{w, watchedNATSignal{w, nat}, watchedMessageSignal{w, messages}}
+	case isNAT:
+		return &struct {
+			*watchedSignal
+			watchedNATSignal
+		}{w, watchedNATSignal{w, nat}}
+	case isMessage:
+		return &struct {
+			*watchedSignal
+			watchedMessageSignal
+		}{w, watchedMessageSignal{w, messages}}
+	}
+
+	return w
+}
+
+type watchedSignal struct {
+	Signal
+	h    func()
+	once sync.Once
+}
+
+func (s *watchedSignal) Ping() error {
+	err := s.Signal.Ping()
+	if err == nil {
+		s.once.Do(s.h)
+	}
+
+	return err
+}
+
+func (s *watchedSignal) OnSDP(h func([]byte)) {
+	s.Signal.OnSDP(s.watch(h))
+}
+
+func (s *watchedSignal) OnCandidate(h func([]byte)) {
+	s.Signal.OnCandidate(s.watch(h))
+}
+
+func (s *watchedSignal) watch(h func([]byte)) func([]byte) {
+	return func(payload []byte) {
+		s.once.Do(s.h)
+		h(payload)
+	}
+}
+
+type watchedNATSignal struct {
+	w   *watchedSignal
+	nat NATSignal
+}
+
+func (s watchedNATSignal) SendNAT(payload []byte) error {
+	return s.nat.SendNAT(payload)
+}
+
+func (s watchedNATSignal) OnNAT(h func([]byte)) {
+	s.nat.OnNAT(s.w.watch(h))
+}
+
+type watchedMessageSignal struct {
+	w        *watchedSignal
+	messages MessageSignal
+}
+
+func (s watchedMessageSignal) Send(typ string, payload []byte) error {
+	return s.messages.Send(typ, payload)
+}
+
+func (s watchedMessageSignal) On(typ string, h func([]byte)) {
+	s.messages.On(typ, s.w.watch(h))
+}
@@ -0,0 +1,203 @@
+package peer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pkg/errors"
+)
+
+const (
+	// staticCertificateLifetime is a lifetime of a certificate of a static
+	// description, which is long since a description is exchanged once.
+	staticCertificateLifetime = 20 * 365 * 24 * time.Hour
+	// staticGatheringTimeout bounds gathering of candidates of a static
+	// description, e.g. if a STUN server doesn't respond.
+	staticGatheringTimeout = 30 * time.Second
+	// staticRedialInterval is an interval an offering peer with a static
+	// description offers again at until it's connected (see: WebRTC.redial()).
+	staticRedialInterval = 10 * time.Second
+)
+
+// StaticDescription is a long-lived session description of a peer, which is
+// exchanged with a fixed remote peer once and is reused by both of them instead of
+// online signaling (see: signal.Static). A peer keeps its ICE credentials, a DTLS
+// certificate and a UDP port of its candidates across runs, so that a remote peer
+// can reach it with the same description.
+type StaticDescription struct {
+	// SDP is a session description with all candidates gathered, which is given
+	// to a remote peer.
+	SDP string `json:"sdp"`
+	// Certificate is a PEM encoded DTLS certificate along with its private key,
+	// it's never given to a remote peer (see: Public()).
+	Certificate string `json:"certificate,omitempty"`
+	// Port is a UDP port of candidates.
+	Port uint16 `json:"port,omitempty"`
+}
+
+// GenerateStaticDescription gathers candidates of a new static description on a
+// UDP port, a random free one is taken if it's 0. STUN servers of cfg are used to
+// gather server reflexive candidates.
+func GenerateStaticDescription(cfg WebRTCConfig, port uint16) (*StaticDescription, error) {
+	if port == 0 {
+		var err error
+
+		if port, err = freeUDPPort(); err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := newDTLSCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	pem, err := cert.PEM()
+	if err != nil {
+		return nil, errors.Wrap(err, "certificate")
+	}
+
+	d := &StaticDescription{
+		Certificate: pem,
+		Port:        port,
+	}
+
+	ufrag, pwd, err := randomICECredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Static = d
+
+	conn, err := newPeerConnection(cfg, ufrag, pwd)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// A data channel makes an offer describe an SCTP association.
+	if _, err := conn.CreateDataChannel("data", nil); err != nil {
+		return nil, err
+	}
+
+	offer, err := conn.CreateOffer(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	gathered := webrtc.GatheringCompletePromise(conn)
+
+	if err := conn.SetLocalDescription(offer); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-gathered:
+	case <-time.After(staticGatheringTimeout):
+		return nil, errors.New("gathering of candidates timed out")
+	}
+
+	d.SDP = conn.LocalDescription().SDP
+
+	return d, nil
+}
+
+// LoadStaticDescription reads a description saved with Save().
+func LoadStaticDescription(path string) (*StaticDescription, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var d StaticDescription
+
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, errors.Wrap(err, "static description")
+	}
+
+	if len(d.SDP) == 0 {
+		return nil, errors.New("static description has no SDP")
+	}
+
+	return &d, nil
+}
+
+// Save writes a description to a file readable by an owner only, it fails if the
+// file exists so that a description a remote peer has is never replaced by
+// mistake.
+func (d *StaticDescription) Save(path string) error {
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(b, '\n'))
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Public returns a description without a certificate, which is given to a remote
+// peer.
+func (d *StaticDescription) Public() *StaticDescription {
+	return &StaticDescription{SDP: d.SDP}
+}
+
+// iceCredentials returns an ICE username fragment and a password of a description.
+func (d *StaticDescription) iceCredentials() (string, string, error) {
+	var ufrag, pwd string
+
+	for _, line := range strings.Split(d.SDP, "\n") {
+		line = strings.TrimSpace(line)
+
+		if v, ok := strings.CutPrefix(line, "a=ice-ufrag:"); ok && len(ufrag) == 0 {
+			ufrag = v
+		}
+
+		if v, ok := strings.CutPrefix(line, "a=ice-pwd:"); ok && len(pwd) == 0 {
+			pwd = v
+		}
+	}
+
+	if len(ufrag) == 0 || len(pwd) == 0 {
+		return "", "", errors.New("static description has no ICE credentials")
+	}
+
+	return ufrag, pwd, nil
+}
+
+// randomICECredentials returns an ICE username fragment and a password of lengths
+// required by RFC 8839.
+func randomICECredentials() (string, string, error) {
+	b := make([]byte, 8+16)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	return hex.EncodeToString(b[:8]), hex.EncodeToString(b[8:]), nil
+}
+
+func freeUDPPort() (uint16, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	return uint16(conn.LocalAddr().(*net.UDPAddr).Port), nil
+}
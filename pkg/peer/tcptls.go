@@ -0,0 +1,524 @@
+package peer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/metrics"
+	"distributed-backup/pkg/proxy"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxFramedMessageSize bounds a message read from a TCP connection or a QUIC
+	// stream, which is framed with a 4-byte length (see: readMessage()).
+	maxFramedMessageSize = 1 << 20
+	// tcpRedialInterval is an interval a dialing peer connects again at until a
+	// listening one accepts it.
+	tcpRedialInterval = 5 * time.Second
+	// tcpHandshakeTimeout bounds a TLS handshake, so that a stalled client
+	// doesn't keep a listening peer from accepting another one.
+	tcpHandshakeTimeout = 30 * time.Second
+	// tcpCertificateLifetime is a lifetime of an ephemeral certificate, which is
+	// generated for a single run.
+	tcpCertificateLifetime = 7 * 24 * time.Hour
+)
+
+// TCPTLS is a direct TCP connection to a remote peer secured with mutual TLS,
+// for peers which can reach each other without NAT traversal (e.g. within a LAN
+// or a VPN), so that neither signaling nor STUN servers are needed. One peer
+// listens on an address and accepts a single connection, and the other one
+// connects to it.
+type TCPTLS struct {
+	cfg       TCPTLSConfig
+	log       log.Logger
+	tlsConfig *tls.Config
+
+	mx       sync.Mutex
+	listener net.Listener
+	conn     *tls.Conn
+	closed   bool
+	shut     bool
+
+	// rmx and wmx serialize reads and writes of messages, so that frames of
+	// them aren't interleaved.
+	rmx sync.Mutex
+	wmx sync.Mutex
+
+	shutdownChan     chan struct{}
+	shutdownOnce     sync.Once
+	establishHandler func()
+}
+
+type TCPTLSConfig struct {
+	// Addr is a host:port a peer listens on if Listen is set, or connects to
+	// otherwise.
+	Addr   string
+	Listen bool
+	// Certificate is a certificate a peer presents to the other one, an
+	// ephemeral self-signed one is generated if nil.
+	Certificate *tls.Certificate
+	// RootCAs verify a certificate of the other peer regardless of its host
+	// name. It isn't verified if nil, a peer is trusted by authentication of a
+	// transfer then (see: filemanager.BackupperConfig.AuthSecret).
+	RootCAs *x509.CertPool
+	// Proxy is a proxy a dialing peer connects through, the ALL_PROXY
+	// environment variable is used if nil.
+	Proxy *url.URL
+	// Log is a logger entries are written with (e.g. with session fields attached),
+	// the global logger is used if nil.
+	Log log.Logger
+}
+
+func NewTCPTLS(cfg TCPTLSConfig) (*TCPTLS, error) {
+	if len(cfg.Addr) == 0 {
+		return nil, errors.New("address is empty")
+	}
+
+	if cfg.Log == nil {
+		cfg.Log = log.New()
+	}
+
+	tlsConfig, err := mutualTLSConfig(cfg.Certificate, cfg.RootCAs)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &TCPTLS{
+		cfg:          cfg,
+		log:          cfg.Log,
+		tlsConfig:    tlsConfig,
+		shutdownChan: make(chan struct{}),
+	}
+
+	if cfg.RootCAs == nil {
+		p.log.Info("certificate of the other peer isn't verified without a CA")
+	}
+
+	return p, nil
+}
+
+// Dial starts listening for the other peer or connecting to it until it's
+// connected or a connection is closed.
+func (p *TCPTLS) Dial() error {
+	if !p.cfg.Listen {
+		go p.dial()
+
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", p.cfg.Addr)
+	if err != nil {
+		return err
+	}
+
+	p.mx.Lock()
+	p.listener = listener
+	p.mx.Unlock()
+
+	p.log.WithField(log.FieldAddr, listener.Addr().String()).Info("listening for the other peer")
+
+	go p.accept(listener)
+
+	return nil
+}
+
+// accept accepts connections until one of them passes a TLS handshake, and
+// stops listening then.
+func (p *TCPTLS) accept(listener net.Listener) {
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			if !p.isClosed() {
+				p.log.Error(err)
+				p.Close()
+			}
+
+			return
+		}
+
+		conn := tls.Server(c, p.tlsConfig)
+
+		if err := p.handshake(conn); err != nil {
+			p.log.WithField(log.FieldAddr, c.RemoteAddr().String()).Error(errors.Wrap(err, "TLS handshake"))
+
+			continue
+		}
+
+		listener.Close()
+
+		p.establish(conn)
+
+		return
+	}
+}
+
+// dial connects to a listening peer, it connects again every tcpRedialInterval
+// until a connection passes a TLS handshake, e.g. if the other peer isn't run
+// yet.
+func (p *TCPTLS) dial() {
+	dialer, err := proxy.NewDialer(p.cfg.Proxy)
+	if err != nil {
+		p.log.Error(errors.Wrap(err, "proxy"))
+		p.Close()
+
+		return
+	}
+
+	for {
+		if p.isClosed() {
+			return
+		}
+
+		c, err := dialer.Dial("tcp", p.cfg.Addr)
+		if err == nil {
+			conn := tls.Client(c, p.tlsConfig)
+
+			if err = p.handshake(conn); err == nil {
+				p.establish(conn)
+
+				return
+			}
+
+			err = errors.Wrap(err, "TLS handshake")
+		}
+
+		p.log.WithField(log.FieldAddr, p.cfg.Addr).Debug(errors.Wrap(err, "not connected yet"))
+
+		select {
+		case <-time.After(tcpRedialInterval):
+		case <-p.shutdownChan:
+			return
+		}
+	}
+}
+
+func (p *TCPTLS) handshake(conn *tls.Conn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), tcpHandshakeTimeout)
+	defer cancel()
+
+	if err := conn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+
+		return err
+	}
+
+	return nil
+}
+
+func (p *TCPTLS) establish(conn *tls.Conn) {
+	p.mx.Lock()
+
+	if p.closed {
+		p.mx.Unlock()
+		conn.Close()
+
+		return
+	}
+
+	p.conn = conn
+	p.mx.Unlock()
+
+	p.log.WithField(log.FieldAddr, conn.RemoteAddr().String()).Info("connected to the other peer")
+
+	if p.establishHandler != nil {
+		p.establishHandler()
+	}
+}
+
+// Read reads a single message, a message which doesn't fit payload is skipped
+// with io.ErrShortBuffer.
+func (p *TCPTLS) Read(payload []byte) (int, error) {
+	conn, err := p.connection()
+	if err != nil {
+		return 0, err
+	}
+
+	p.rmx.Lock()
+	defer p.rmx.Unlock()
+
+	n, err := readMessage(conn, payload)
+	if err != nil && err != io.ErrShortBuffer {
+		err = p.fail(err)
+	}
+
+	metrics.Count("peer_received_bytes", int64(n))
+
+	return n, err
+}
+
+// Write writes payload as a single message.
+func (p *TCPTLS) Write(payload []byte) (int, error) {
+	if len(payload) > maxFramedMessageSize {
+		return 0, errors.Errorf("message is too large: %d bytes", len(payload))
+	}
+
+	conn, err := p.connection()
+	if err != nil {
+		return 0, err
+	}
+
+	p.wmx.Lock()
+	defer p.wmx.Unlock()
+
+	if err := writeMessage(conn, payload); err != nil {
+		return 0, p.fail(err)
+	}
+
+	metrics.Count("peer_sent_bytes", int64(len(payload)))
+
+	return len(payload), nil
+}
+
+// ConnectionInfo returns addresses of an established connection.
+func (p *TCPTLS) ConnectionInfo() (*ConnectionInfo, error) {
+	conn, err := p.connection()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ConnectionInfo{
+		LocalCandidate:  conn.LocalAddr().String(),
+		RemoteCandidate: conn.RemoteAddr().String(),
+		RemoteAddr:      conn.RemoteAddr().String(),
+	}, nil
+}
+
+// CertificateFingerprints returns SHA-256 fingerprints of certificates of both
+// peers of an established connection (see: WebRTC.CertificateFingerprints()).
+func (p *TCPTLS) CertificateFingerprints() (local, remote string, err error) {
+	conn, err := p.connection()
+	if err != nil {
+		return "", "", err
+	}
+
+	return tlsFingerprints(p.tlsConfig, conn.ConnectionState())
+}
+
+// BufferedAmount returns 0, since writes block until data is sent.
+func (p *TCPTLS) BufferedAmount() uint64 {
+	return 0
+}
+
+func (p *TCPTLS) connection() (*tls.Conn, error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if p.conn == nil {
+		return nil, errors.New("not connected")
+	}
+
+	return p.conn, nil
+}
+
+func (p *TCPTLS) isClosed() bool {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	return p.closed
+}
+
+func (p *TCPTLS) OnEstablish(h func()) {
+	p.establishHandler = h
+}
+
+func (p *TCPTLS) Done() <-chan struct{} {
+	return p.shutdownChan
+}
+
+// fail closes a connection which has failed with err, so that Done() tells that
+// it's lost. A connection shut down by either peer (this one reads an EOF then)
+// isn't failed, since a peer shuts it down once a transfer ends, and it's done
+// once it's closed (see: Close()).
+func (p *TCPTLS) fail(err error) error {
+	p.mx.Lock()
+	conn, shut := p.conn, p.shut
+	p.shut = true
+	p.mx.Unlock()
+
+	if shut || errors.Is(err, io.EOF) {
+		return err
+	}
+
+	conn.Close()
+
+	p.shutdownOnce.Do(func() {
+		close(p.shutdownChan)
+	})
+
+	return err
+}
+
+// Shutdown closes a connection, the other peer reads an EOF then.
+func (p *TCPTLS) Shutdown() {
+	p.mx.Lock()
+	conn := p.conn
+	p.shut = true
+	p.mx.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Close stops listening or connecting and closes a connection.
+func (p *TCPTLS) Close() {
+	p.mx.Lock()
+	p.closed = true
+	listener := p.listener
+	p.mx.Unlock()
+
+	if listener != nil {
+		listener.Close()
+	}
+
+	p.Shutdown()
+
+	p.shutdownOnce.Do(func() {
+		close(p.shutdownChan)
+	})
+}
+
+// mutualTLSConfig returns a TLS config of a peer which presents cert, or an
+// ephemeral certificate if it's nil, and requires the other peer to present
+// one verified against roots (see: verifyChain()).
+func mutualTLSConfig(cert *tls.Certificate, roots *x509.CertPool) (*tls.Config, error) {
+	if cert == nil {
+		var err error
+
+		if cert, err = ephemeralCertificate(); err != nil {
+			return nil, errors.Wrap(err, "certificate")
+		}
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		MinVersion:   tls.VersionTLS13,
+		// Peers are identified by a CA which has issued their certificates
+		// rather than by host names.
+		InsecureSkipVerify: true,
+		ClientAuth:         tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, roots)
+		},
+	}, nil
+}
+
+// verifyChain verifies a certificate chain of the other peer against roots,
+// which accept any chain if nil.
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if roots == nil {
+		return nil
+	}
+
+	if len(rawCerts) == 0 {
+		return errors.New("no certificate of the other peer")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+
+		certs[i] = cert
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(opts)
+
+	return err
+}
+
+// readMessage reads a message framed with its 4-byte length from r, a message
+// which doesn't fit payload is skipped with io.ErrShortBuffer.
+func readMessage(r io.Reader, payload []byte) (int, error) {
+	var header [4]byte
+
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+
+	size := int64(binary.BigEndian.Uint32(header[:]))
+
+	if size > maxFramedMessageSize {
+		return 0, errors.Errorf("message is too large: %d bytes", size)
+	}
+
+	if size > int64(len(payload)) {
+		if _, err := io.CopyN(io.Discard, r, size); err != nil {
+			return 0, err
+		}
+
+		return 0, io.ErrShortBuffer
+	}
+
+	return io.ReadFull(r, payload[:size])
+}
+
+// writeMessage writes payload to w framed with its 4-byte length.
+func writeMessage(w io.Writer, payload []byte) error {
+	frame := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+
+	_, err := w.Write(append(frame, payload...))
+
+	return err
+}
+
+// ephemeralCertificate generates a self-signed certificate of a single run.
+func ephemeralCertificate() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		Subject:      pkix.Name{CommonName: "distributed-backup"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(tcpCertificateLifetime),
+		SerialNumber: serial,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
@@ -0,0 +1,32 @@
+package peer
+
+import (
+	"net"
+	"testing"
+)
+
+// TestTCPTLS connects peers directly over TCP with TLS.
+func TestTCPTLS(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr().String()
+	listener.Close()
+
+	receiver, err := NewTCPTLS(TCPTLSConfig{Addr: addr, Listen: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	sender, err := NewTCPTLS(TCPTLSConfig{Addr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	connect(t, receiver, sender)
+	exchange(t, receiver, sender)
+}
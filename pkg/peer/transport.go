@@ -0,0 +1,100 @@
+package peer
+
+import (
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Names of built-in transports (see: NewConn()).
+const (
+	TransportWebRTC = "webrtc"
+	TransportTCPTLS = "tcptls"
+	TransportQUIC   = "quic"
+)
+
+// Conn is a connection to a remote peer a transfer goes over. A single Read()
+// returns a message written by a single Write() of the other peer, so that
+// messages keep their boundaries as data channel ones do.
+type Conn interface {
+	io.ReadWriter
+	// Dial starts connecting to the other peer, a handler of OnEstablish() is
+	// called once a connection is made.
+	Dial() error
+	OnEstablish(func())
+	// Shutdown closes a connection, so that the other peer reads an EOF, and
+	// Close releases everything a connection has set up.
+	Shutdown()
+	Close()
+	// Done is closed once a connection is closed by either peer or fails.
+	Done() <-chan struct{}
+}
+
+// TransportConfig is a config of a connection, a transport takes its own part
+// of it.
+type TransportConfig struct {
+	WebRTC WebRTCConfig
+	// Signal is signaling a WebRTC connection is negotiated through, or QUIC
+	// peers exchange their addresses through.
+	Signal Signal
+	TCPTLS TCPTLSConfig
+	QUIC   QUICConfig
+}
+
+// Transport makes a connection of cfg.
+type Transport func(cfg TransportConfig) (Conn, error)
+
+var (
+	transports = map[string]Transport{
+		TransportWebRTC: func(cfg TransportConfig) (Conn, error) {
+			return NewWebRTC(cfg.WebRTC, cfg.Signal)
+		},
+		TransportTCPTLS: func(cfg TransportConfig) (Conn, error) {
+			return NewTCPTLS(cfg.TCPTLS)
+		},
+		TransportQUIC: func(cfg TransportConfig) (Conn, error) {
+			return NewQUIC(cfg.QUIC, cfg.Signal)
+		},
+	}
+	transportsMx sync.Mutex
+)
+
+// RegisterTransport makes a transport available by name, it replaces one
+// registered by the same name.
+func RegisterTransport(name string, t Transport) {
+	transportsMx.Lock()
+	defer transportsMx.Unlock()
+
+	transports[name] = t
+}
+
+// NewConn makes a connection with a transport registered by name.
+func NewConn(name string, cfg TransportConfig) (Conn, error) {
+	transportsMx.Lock()
+	t, ok := transports[name]
+	transportsMx.Unlock()
+
+	if !ok {
+		return nil, errors.Errorf("unknown transport: %s", name)
+	}
+
+	return t(cfg)
+}
+
+// Transports returns sorted names of registered transports.
+func Transports() []string {
+	transportsMx.Lock()
+	defer transportsMx.Unlock()
+
+	names := make([]string, 0, len(transports))
+
+	for name := range transports {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
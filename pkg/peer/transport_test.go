@@ -0,0 +1,101 @@
+package peer
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listenedSignal is signaling which is listened to for messages of the other
+// peer.
+type listenedSignal interface {
+	Signal
+	Listen(ctx context.Context)
+}
+
+// listenSignals listens to signals until a test finishes.
+func listenSignals(t *testing.T, signals ...listenedSignal) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	for _, s := range signals {
+		s := s
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			s.Listen(ctx)
+		}()
+	}
+}
+
+// connect dials peers and waits for both of them to establish a connection.
+// Peers are connected over the network stack, so a test is skipped in short
+// mode.
+func connect(t *testing.T, receiver, sender Conn) {
+	t.Helper()
+
+	if testing.Short() {
+		t.Skip("peers are connected over the network stack")
+	}
+
+	established := make(chan struct{}, 2)
+
+	for _, p := range []Conn{receiver, sender} {
+		p.OnEstablish(func() { established <- struct{}{} })
+	}
+
+	for _, p := range []Conn{receiver, sender} {
+		if err := p.Dial(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	timeout := time.After(30 * time.Second)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-established:
+		case <-receiver.Done():
+			t.Fatal("receiver's connection is closed before it's established")
+		case <-sender.Done():
+			t.Fatal("sender's connection is closed before it's established")
+		case <-timeout:
+			t.Fatal("connection isn't established")
+		}
+	}
+}
+
+// exchange writes a message to one end of a connection and checks that it's
+// read at the other one, and the same back.
+func exchange(t *testing.T, a, b io.ReadWriter) {
+	t.Helper()
+
+	for _, ends := range [][2]io.ReadWriter{{a, b}, {b, a}} {
+		const message = "message of a test"
+
+		if _, err := ends[0].Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+
+		payload := make([]byte, 64)
+
+		n, err := ends[1].Read(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(payload[:n]) != message {
+			t.Fatalf("read %q, %q expected", payload[:n], message)
+		}
+	}
+}
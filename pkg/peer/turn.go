@@ -0,0 +1,72 @@
+package peer
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pkg/errors"
+)
+
+// Transports a peer reaches a TURN server over. Data is relayed to a remote peer
+// over UDP anyway, a transport only tells how it gets to a server, so TCP and TLS
+// help where UDP is blocked (see: WebRTCConfig.Proxy).
+const (
+	TURNTransportUDP = "udp"
+	TURNTransportTCP = "tcp"
+	TURNTransportTLS = "tls"
+)
+
+// TURNServer is a TURN server relayed candidates are gathered with, which lets
+// peers behind symmetric NAT connect through it.
+type TURNServer struct {
+	// Addr is "host[:port]" of a server, the port is 3478 (5349 for TLS) by default.
+	Addr       string
+	Username   string
+	Credential string
+	// Transport is one of TURNTransportUDP (default), TURNTransportTCP and
+	// TURNTransportTLS.
+	Transport string
+}
+
+// Validate checks that a server is complete and its transport is known.
+func (s TURNServer) Validate() error {
+	if len(s.Addr) == 0 {
+		return errors.New("TURN server address is empty")
+	}
+
+	// A URL would be mangled into a TURN one.
+	if strings.ContainsAny(s.Addr, "/?@ ") || strings.HasPrefix(s.Addr, "turn:") || strings.HasPrefix(s.Addr, "turns:") {
+		return errors.Errorf("TURN server address should be host[:port]: %s", s.Addr)
+	}
+
+	if len(s.Username) == 0 || len(s.Credential) == 0 {
+		return errors.New("TURN server requires a username and a credential")
+	}
+
+	switch s.Transport {
+	case "", TURNTransportUDP, TURNTransportTCP, TURNTransportTLS:
+	default:
+		return errors.Errorf("unsupported TURN transport: %s", s.Transport)
+	}
+
+	return nil
+}
+
+// iceServer returns an ICE server of a TURN URL (RFC 7065).
+func (s TURNServer) iceServer() webrtc.ICEServer {
+	url := "turn:" + s.Addr + "?transport=udp"
+
+	switch s.Transport {
+	case TURNTransportTCP:
+		url = "turn:" + s.Addr + "?transport=tcp"
+	case TURNTransportTLS:
+		url = "turns:" + s.Addr + "?transport=tcp"
+	}
+
+	return webrtc.ICEServer{
+		URLs:           []string{url},
+		Username:       s.Username,
+		Credential:     s.Credential,
+		CredentialType: webrtc.ICECredentialTypePassword,
+	}
+}
@@ -2,10 +2,18 @@ package peer
 
 import (
 	"encoding/json"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/metrics"
+	"distributed-backup/pkg/netcheck"
+	"distributed-backup/pkg/proxy"
 	"distributed-backup/pkg/signal"
 
 	"github.com/pion/datachannel"
@@ -15,46 +23,128 @@ import (
 
 type WebRTC struct {
 	signal Signal
+	log    log.Logger
 
+	cfg         WebRTCConfig
+	ufrag, pwd  string
 	conn        *webrtc.PeerConnection
+	connMx      sync.Mutex
+	closed      bool
 	dataChannel datachannel.ReadWriteCloser
 
+	// streams are data channels opened along with dataChannel, and
+	// streamCount is a number of all of them an offering peer opens.
+	streams     map[int]datachannel.ReadWriteCloser
+	streamCount int
+	established bool
+	channelsMx  sync.Mutex
+
 	candidates   []*webrtc.ICECandidate
 	candidatesMx sync.Mutex
 
+	dialTime time.Time
+	// offering tells whether a peer has made an offer, it restarts ICE then.
+	offering bool
+
+	// restartTimer gives a connection up unless it's restored by an ICE
+	// restart in time (see: restartICE()), it's nil if none is in progress.
+	restartTimer *time.Timer
+	restartMx    sync.Mutex
+
+	remoteNAT   netcheck.NATType
+	remoteNATMx sync.Mutex
+
 	shutdownChan     chan struct{}
+	shutdownOnce     sync.Once
 	establishHandler func()
 }
 
 type WebRTCConfig struct {
 	STUN []string
+	// TURN are TURN servers relayed candidates are gathered with.
+	TURN []TURNServer
+	// RelayOnly makes a peer use relayed candidates only, e.g. to keep its
+	// address from a remote peer or to check a TURN server.
+	RelayOnly bool
+	// Proxy is a proxy TCP connections of ICE (e.g. to TURN servers) are made
+	// through, the ALL_PROXY environment variable is used if nil. UDP traffic
+	// (e.g. STUN requests) is never proxied.
+	Proxy *url.URL
+	// Log is a logger entries are written with (e.g. with session fields attached),
+	// the global logger is used if nil.
+	Log log.Logger
+	// Static is a long-lived description of a peer, which keeps its ICE
+	// credentials, certificate and port for static signaling (see:
+	// signal.Static).
+	Static *StaticDescription
+	// Certificate is a PEM encoded DTLS certificate along with its private key
+	// (see: GenerateDTLSCertificate()), which is kept across runs so that the
+	// other peer can pin it. An ephemeral one is generated if it's empty, and
+	// one of Static is taken with Static.
+	Certificate string
+	// ExpectedFingerprint is a fingerprint (see: ParseFingerprint()) a DTLS
+	// certificate of the other peer must have, a connection to a peer with
+	// another one is shut down before it's established.
+	ExpectedFingerprint string
+	// State is set to a state of a connection on its every change, so that
+	// entries of loggers made with it tell one (see: log.Var).
+	State *log.Var
+	// NAT is a NAT type of a peer detected before negotiation, it's told to the
+	// other peer if signaling supports it (see: NATSignal).
+	NAT netcheck.NATType
+	// Streams is a number of data channels an offering peer opens, so that data
+	// is spread over several SCTP streams (see: Streams()). An answering peer
+	// takes the number of the offering one, 0 means 1.
+	Streams int
+	// ICERestartTimeout is a time a connection which is disconnected after it's
+	// established is given to recover by an ICE restart, which an offering peer
+	// makes over signaling, before it's given up. A connection is given up at
+	// once if 0, and always with static signaling.
+	ICERestartTimeout time.Duration
 }
 
+// Labels of data channels. The first one is labeled dataChannelLabel if it's
+// the only one, and "${dataChannelLabel}:${count}" otherwise, so that an
+// answering peer knows how many channels to wait for, and other ones are
+// "${streamLabel}:${index}".
+const (
+	dataChannelLabel = "data"
+	streamLabel      = "stream"
+)
+
+// MaxStreams bounds Streams of WebRTCConfig and QUICConfig.
+const MaxStreams = 64
+
 func NewWebRTC(cfg WebRTCConfig, signal Signal) (*WebRTC, error) {
-	ice := make([]webrtc.ICEServer, len(cfg.STUN))
+	var ufrag, pwd string
 
-	for i, stun := range cfg.STUN {
-		ice[i] = webrtc.ICEServer{
-			URLs: []string{"stun:" + stun},
-		}
+	if cfg.Streams < 0 || cfg.Streams > MaxStreams {
+		return nil, errors.Errorf("number of streams is out of range: %d", cfg.Streams)
 	}
 
-	settings := webrtc.SettingEngine{}
-
-	settings.DetachDataChannels()
-	settings.SetICETimeouts(15*time.Minute, 25*time.Second, 2*time.Second)
+	if cfg.Static != nil {
+		var err error
 
-	api := webrtc.NewAPI(webrtc.WithSettingEngine(settings))
+		if ufrag, pwd, err = cfg.Static.iceCredentials(); err != nil {
+			return nil, err
+		}
+	}
 
-	conn, err := api.NewPeerConnection(webrtc.Configuration{
-		ICEServers: ice,
-	})
+	conn, err := newPeerConnection(cfg, ufrag, pwd)
 	if err != nil {
 		return nil, err
 	}
 
+	if cfg.Log == nil {
+		cfg.Log = log.New()
+	}
+
 	p := &WebRTC{
 		signal:           signal,
+		log:              cfg.Log,
+		cfg:              cfg,
+		ufrag:            ufrag,
+		pwd:              pwd,
 		conn:             conn,
 		shutdownChan:     make(chan struct{}),
 		establishHandler: func() {},
@@ -63,31 +153,201 @@ func NewWebRTC(cfg WebRTCConfig, signal Signal) (*WebRTC, error) {
 	p.signal.OnSDP(p.onSignalSDP)
 	p.signal.OnCandidate(p.onSignalCandidate)
 
+	if s, ok := p.signal.(NATSignal); ok {
+		s.OnNAT(p.onSignalNAT)
+	}
+
 	p.conn.OnICECandidate(p.onConnICECandidate)
 	p.conn.OnConnectionStateChange(p.onConnStateChange)
+	p.conn.OnICEConnectionStateChange(p.onICEStateChange)
 
 	return p, nil
 }
 
+// connection returns a current connection, which is replaced by redial().
+func (p *WebRTC) connection() *webrtc.PeerConnection {
+	p.connMx.Lock()
+	defer p.connMx.Unlock()
+
+	return p.conn
+}
+
+// newPeerConnection returns a connection with ICE credentials, random ones are
+// generated if they are empty.
+func newPeerConnection(cfg WebRTCConfig, ufrag, pwd string) (*webrtc.PeerConnection, error) {
+	ice := make([]webrtc.ICEServer, 0, len(cfg.STUN)+len(cfg.TURN))
+
+	for _, stun := range cfg.STUN {
+		ice = append(ice, webrtc.ICEServer{
+			URLs: []string{"stun:" + stun},
+		})
+	}
+
+	for _, turn := range cfg.TURN {
+		if err := turn.Validate(); err != nil {
+			return nil, err
+		}
+
+		ice = append(ice, turn.iceServer())
+	}
+
+	settings := webrtc.SettingEngine{}
+
+	settings.DetachDataChannels()
+
+	dialer, err := proxy.NewDialer(cfg.Proxy)
+	if err != nil {
+		return nil, errors.Wrap(err, "proxy")
+	}
+
+	settings.SetICEProxyDialer(dialer)
+	settings.SetICETimeouts(15*time.Minute, 25*time.Second, 2*time.Second)
+
+	config := webrtc.Configuration{
+		ICEServers: ice,
+	}
+
+	if cfg.RelayOnly {
+		if len(cfg.TURN) == 0 {
+			return nil, errors.New("relayed candidates require a TURN server")
+		}
+
+		config.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	}
+
+	if len(ufrag) != 0 {
+		settings.SetICECredentials(ufrag, pwd)
+	}
+
+	if cfg.Static != nil {
+		cert, err := webrtc.CertificateFromPEM(cfg.Static.Certificate)
+		if err != nil {
+			return nil, errors.Wrap(err, "static description certificate")
+		}
+
+		config.Certificates = []webrtc.Certificate{*cert}
+
+		if err := settings.SetEphemeralUDPPortRange(cfg.Static.Port, cfg.Static.Port); err != nil {
+			return nil, errors.Wrap(err, "static description port")
+		}
+	} else if len(cfg.Certificate) != 0 {
+		cert, err := webrtc.CertificateFromPEM(cfg.Certificate)
+		if err != nil {
+			return nil, errors.Wrap(err, "DTLS certificate")
+		}
+
+		config.Certificates = []webrtc.Certificate{*cert}
+	}
+
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(settings))
+
+	return api.NewPeerConnection(config)
+}
+
 func (p *WebRTC) Dial() error {
+	p.dialTime = time.Now()
+
+	if s, ok := p.signal.(NATSignal); ok && len(p.cfg.NAT) != 0 {
+		if err := s.SendNAT([]byte(p.cfg.NAT)); err != nil {
+			// A NAT type only lets peers warn about a connection, so negotiation
+			// goes on without it.
+			p.log.Error(errors.Wrap(err, "NAT type"))
+		}
+	}
+
 	if err := p.signal.Ping(); err != nil {
 		if !errors.Is(err, signal.ErrNoCandidatesFound) {
 			return err
 		}
 
-		log.Infof("%s, waiting...", err)
+		p.log.Info(err, ", waiting...")
 
 		return p.waitOffer()
 	}
 
-	log.Infof("candidate found, start connecting...")
+	p.log.Info("candidate found, start connecting...")
+
+	p.offering = true
+
+	if err := p.offer(); err != nil {
+		return err
+	}
+
+	if p.cfg.Static != nil {
+		go p.redial()
+	}
+
+	return nil
+}
+
+// redial makes an offering peer with a static description offer again with a
+// new connection until it's connected. ICE checks of a controlling agent fail
+// for good once they aren't answered for a couple of seconds, e.g. if a remote
+// peer isn't run yet, and it isn't told to check again without signaling. A
+// controlled agent of a waiting peer answers checks of a new one anytime.
+func (p *WebRTC) redial() {
+	for {
+		select {
+		case <-time.After(staticRedialInterval):
+		case <-p.shutdownChan:
+			return
+		}
+
+		p.connMx.Lock()
+
+		// A connection is kept once ICE checks succeed, even if DTLS isn't done.
+		if state := p.conn.ICEConnectionState(); p.closed ||
+			state == webrtc.ICEConnectionStateConnected ||
+			state == webrtc.ICEConnectionStateCompleted {
+			p.connMx.Unlock()
+
+			return
+		}
+
+		p.log.Debug("not connected yet, offering again")
 
-	return p.offer()
+		// A connection is replaced silently, a new one takes the same port.
+		p.conn.OnICECandidate(func(*webrtc.ICECandidate) {})
+		p.conn.OnConnectionStateChange(func(webrtc.PeerConnectionState) {})
+		p.conn.OnICEConnectionStateChange(func(webrtc.ICEConnectionState) {})
+
+		if err := p.conn.Close(); err != nil {
+			p.log.Error(err)
+		}
+
+		conn, err := newPeerConnection(p.cfg, p.ufrag, p.pwd)
+		if err != nil {
+			p.connMx.Unlock()
+			p.log.Error(err)
+			p.shutdown()
+
+			return
+		}
+
+		p.conn = conn
+		p.connMx.Unlock()
+
+		p.candidatesMx.Lock()
+		p.candidates = nil
+		p.candidatesMx.Unlock()
+
+		conn.OnICECandidate(p.onConnICECandidate)
+		conn.OnConnectionStateChange(p.onConnStateChange)
+		conn.OnICEConnectionStateChange(p.onICEStateChange)
+
+		if err := p.offer(); err != nil {
+			p.log.Error(err)
+		}
+	}
 }
 
 func (p *WebRTC) Close() {
-	if err := p.conn.Close(); err != nil {
-		log.Error(err)
+	p.connMx.Lock()
+	p.closed = true
+	p.connMx.Unlock()
+
+	if err := p.connection().Close(); err != nil {
+		p.log.Error(err)
 
 		return
 	}
@@ -98,16 +358,91 @@ func (p *WebRTC) Done() <-chan struct{} {
 }
 
 func (p *WebRTC) Read(payload []byte) (int, error) {
-	return p.dataChannel.Read(payload)
+	n, err := p.dataChannel.Read(payload)
+
+	metrics.Count("peer_received_bytes", int64(n))
+
+	return n, err
 }
 
 func (p *WebRTC) Write(payload []byte) (int, error) {
-	return p.dataChannel.Write(payload)
+	n, err := p.dataChannel.Write(payload)
+
+	metrics.Count("peer_sent_bytes", int64(n))
+
+	return n, err
+}
+
+// ConnectionInfo describes an established connection.
+type ConnectionInfo struct {
+	// LocalCandidate and RemoteCandidate are a selected ICE candidate pair.
+	LocalCandidate  string
+	RemoteCandidate string
+	// RemoteAddr is a host and a port of the other peer's end of a connection.
+	RemoteAddr string
+}
+
+// ConnectionInfo returns a description of an established connection.
+func (p *WebRTC) ConnectionInfo() (*ConnectionInfo, error) {
+	pair, err := p.connection().SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil {
+		return nil, err
+	}
+
+	if pair == nil {
+		return nil, errors.New("no selected candidate pair")
+	}
+
+	return &ConnectionInfo{
+		LocalCandidate:  pair.Local.String(),
+		RemoteCandidate: pair.Remote.String(),
+		RemoteAddr:      net.JoinHostPort(pair.Remote.Address, strconv.Itoa(int(pair.Remote.Port))),
+	}, nil
+}
+
+// BufferedAmount returns a number of bytes written to a data channel but not sent
+// yet. Writes are never blocked, so a writer which doesn't keep up with a
+// connection should wait for the buffer to drain.
+func (p *WebRTC) BufferedAmount() uint64 {
+	channel, ok := p.dataChannel.(interface{ BufferedAmount() uint64 })
+	if !ok {
+		return 0
+	}
+
+	return channel.BufferedAmount()
+}
+
+// Streams returns data channels opened along with the one Read() and Write()
+// use, ordered by their indexes. It's empty unless Streams of an offering peer
+// is more than 1.
+func (p *WebRTC) Streams() []io.ReadWriter {
+	p.channelsMx.Lock()
+	defer p.channelsMx.Unlock()
+
+	streams := make([]io.ReadWriter, 0, len(p.streams))
+
+	for i := 1; i < p.streamCount; i++ {
+		if stream, ok := p.streams[i]; ok {
+			streams = append(streams, stream)
+		}
+	}
+
+	return streams
 }
 
 func (p *WebRTC) Shutdown() {
+	p.channelsMx.Lock()
+	streams := p.streams
+	p.channelsMx.Unlock()
+
+	for _, stream := range streams {
+		if err := stream.Close(); err != nil {
+			p.log.Error(err)
+		}
+	}
+
 	if err := p.dataChannel.Close(); err != nil {
-		log.Error(err)
+		p.log.Error(err)
 
 		return
 	}
@@ -121,20 +456,23 @@ func (p *WebRTC) onSignalSDP(payload []byte) {
 	sdp := webrtc.SessionDescription{}
 
 	if err := json.Unmarshal(payload, &sdp); err != nil {
-		log.Error(err)
+		p.log.Error(err)
 
 		return
 	}
 
-	if err := p.conn.SetRemoteDescription(sdp); err != nil {
-		log.Error(err)
+	p.log.WithField(log.FieldType, sdp.Type.String()).Debug("remote session description received")
+	p.log.WithField(log.FieldPayload, sdp.SDP).Trace("remote session description")
+
+	if err := p.connection().SetRemoteDescription(sdp); err != nil {
+		p.log.Error(err)
 
 		return
 	}
 
 	if sdp.Type == webrtc.SDPTypeOffer {
 		if err := p.onSignalSDPOffer(); err != nil {
-			log.Error(err)
+			p.log.Error(err)
 
 			return
 		}
@@ -143,11 +481,15 @@ func (p *WebRTC) onSignalSDP(payload []byte) {
 	p.candidatesMx.Lock()
 	defer p.candidatesMx.Unlock()
 
-	for _, candidate := range p.candidates {
+	// Candidates are sent once, an offer of an ICE restart gathers new ones.
+	candidates := p.candidates
+	p.candidates = nil
+
+	for _, candidate := range candidates {
 		payload := []byte(candidate.ToJSON().Candidate)
 
 		if err := p.signalSendCandidate(payload); err != nil {
-			log.Error(err)
+			p.log.Error(err)
 
 			return
 		}
@@ -155,7 +497,7 @@ func (p *WebRTC) onSignalSDP(payload []byte) {
 }
 
 func (p *WebRTC) onSignalSDPOffer() error {
-	answer, err := p.conn.CreateAnswer(nil)
+	answer, err := p.connection().CreateAnswer(nil)
 	if err != nil {
 		return err
 	}
@@ -169,29 +511,70 @@ func (p *WebRTC) onSignalSDPOffer() error {
 		return err
 	}
 
-	return p.conn.SetLocalDescription(answer)
+	return p.connection().SetLocalDescription(answer)
 }
 
 func (p *WebRTC) onSignalCandidate(payload []byte) {
-	err := p.conn.AddICECandidate(webrtc.ICECandidateInit{
+	p.log.WithField(log.FieldPayload, string(payload)).Debug("remote ICE candidate received")
+
+	err := p.connection().AddICECandidate(webrtc.ICECandidateInit{
 		Candidate: string(payload),
 	})
 	if err != nil {
-		log.Error(err)
+		p.log.Error(err)
 
 		return
 	}
 }
 
+// onSignalNAT warns if a direct connection is unlikely with a NAT type of the
+// other peer, since ICE would only time out then.
+func (p *WebRTC) onSignalNAT(payload []byte) {
+	remote := netcheck.NATType(payload)
+
+	p.remoteNATMx.Lock()
+	p.remoteNAT = remote
+	p.remoteNATMx.Unlock()
+
+	prognosis := netcheck.PredictConnectivity(p.cfg.NAT, remote)
+	entry := p.log.WithFields(log.Fields{
+		log.FieldNAT:       p.cfg.NAT,
+		log.FieldRemoteNAT: remote,
+		log.FieldPrognosis: prognosis,
+	})
+
+	metrics.Count("peer_nat_prognosis", 1, "prognosis", string(prognosis))
+
+	switch prognosis {
+	case netcheck.ConnectivityUnlikely:
+		entry.Error("direct connection is unlikely since both peers are behind symmetric NAT, configure a TURN server")
+	case netcheck.ConnectivityPossible:
+		entry.Info("direct connection may fail since a peer is behind symmetric NAT")
+	default:
+		entry.Info("remote NAT type received")
+	}
+}
+
+// RemoteNAT returns a NAT type the other peer has told, or an empty one if it
+// hasn't.
+func (p *WebRTC) RemoteNAT() netcheck.NATType {
+	p.remoteNATMx.Lock()
+	defer p.remoteNATMx.Unlock()
+
+	return p.remoteNAT
+}
+
 func (p *WebRTC) onConnICECandidate(candidate *webrtc.ICECandidate) {
 	if candidate == nil {
 		return
 	}
 
+	p.log.WithField(log.FieldPayload, candidate.String()).Debug("local ICE candidate gathered")
+
 	p.candidatesMx.Lock()
 	defer p.candidatesMx.Unlock()
 
-	if p.conn.RemoteDescription() == nil {
+	if p.connection().RemoteDescription() == nil {
 		p.candidates = append(p.candidates, candidate)
 
 		return
@@ -200,32 +583,153 @@ func (p *WebRTC) onConnICECandidate(candidate *webrtc.ICECandidate) {
 	payload := []byte(candidate.ToJSON().Candidate)
 
 	if err := p.signalSendCandidate(payload); err != nil {
-		log.Error(err)
+		p.log.Error(err)
 
 		return
 	}
 }
 
 func (p *WebRTC) signalSendCandidate(payload []byte) error {
-	if p.conn.ConnectionState() == webrtc.PeerConnectionStateClosed {
+	if p.connection().ConnectionState() == webrtc.PeerConnectionStateClosed {
 		return nil
 	}
 
 	return p.signal.SendCandidate(payload)
 }
 
+// onICEStateChange counts transitions of ICE, which a connection state follows
+// but for ICE restarts and checking of candidates.
+func (p *WebRTC) onICEStateChange(state webrtc.ICEConnectionState) {
+	p.log.WithField(log.FieldState, state.String()).Debug("ICE connection state changed")
+
+	metrics.Count("peer_ice_state_changes", 1, "state", state.String())
+}
+
 func (p *WebRTC) onConnStateChange(state webrtc.PeerConnectionState) {
-	log.Info("connection state changed: ", state)
+	if p.cfg.State != nil {
+		p.cfg.State.Set(state.String())
+	}
+
+	p.log.WithField(log.FieldState, state.String()).Info("connection state changed")
+
+	metrics.Count("peer_state_changes", 1, "state", state.String())
+
+	switch state {
+	case webrtc.PeerConnectionStateConnected:
+		if p.stopRestart() {
+			p.log.Info("connection restored")
+
+			metrics.Count("peer_ice_restarts", 1, "result", "restored")
+
+			return
+		}
+
+		metrics.Timing("peer_connect", time.Since(p.dialTime))
+	case webrtc.PeerConnectionStateDisconnected:
+		p.channelsMx.Lock()
+		established := p.established
+		p.channelsMx.Unlock()
+
+		if established && p.cfg.ICERestartTimeout != 0 && p.cfg.Static == nil {
+			p.restartICE()
+
+			return
+		}
 
-	if state == webrtc.PeerConnectionStateDisconnected ||
-		state == webrtc.PeerConnectionStateFailed ||
-		state == webrtc.PeerConnectionStateClosed {
-		p.shutdownChan <- struct{}{}
+		p.shutdown()
+	case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+		if p.stopRestart() {
+			metrics.Count("peer_ice_restarts", 1, "result", "failed")
+		}
+
+		p.shutdown()
 	}
 }
 
+// shutdown tells a connection is over. The channel is closed rather than written
+// to since nobody might read it after a connection is closed by the other side.
+func (p *WebRTC) shutdown() {
+	p.shutdownOnce.Do(func() {
+		close(p.shutdownChan)
+	})
+}
+
+// restartICE gives a disconnected connection ICERestartTimeout to recover, an
+// offering peer offers again with new ICE credentials meanwhile, so that peers
+// gather candidates again (e.g. once a network has changed), and an answering
+// one answers it as any offer. Data channels are kept, since DTLS and SCTP
+// associations outlive ICE.
+func (p *WebRTC) restartICE() {
+	p.restartMx.Lock()
+	defer p.restartMx.Unlock()
+
+	if p.restartTimer != nil {
+		return
+	}
+
+	p.log.WithField(log.FieldDuration, p.cfg.ICERestartTimeout).Info("connection disconnected, restarting ICE")
+
+	p.restartTimer = time.AfterFunc(p.cfg.ICERestartTimeout, func() {
+		if p.stopRestart() {
+			p.log.Error("connection isn't restored by an ICE restart")
+
+			metrics.Count("peer_ice_restarts", 1, "result", "timeout")
+
+			p.shutdown()
+		}
+	})
+
+	if !p.offering {
+		return
+	}
+
+	go func() {
+		if err := p.offerRestart(); err != nil {
+			p.log.Error(errors.Wrap(err, "ICE restart"))
+		}
+	}()
+}
+
+// stopRestart stops an ICE restart in progress and tells whether there was one.
+func (p *WebRTC) stopRestart() bool {
+	p.restartMx.Lock()
+	defer p.restartMx.Unlock()
+
+	if p.restartTimer == nil {
+		return false
+	}
+
+	p.restartTimer.Stop()
+	p.restartTimer = nil
+
+	return true
+}
+
+// offerRestart offers with new ICE credentials. An offer is sent before it's set
+// as a local description, so that the other peer gets it before candidates
+// gathered for it.
+func (p *WebRTC) offerRestart() error {
+	conn := p.connection()
+
+	offer, err := conn.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(offer)
+	if err != nil {
+		return err
+	}
+
+	if err := p.signal.SendSDP(payload); err != nil {
+		return err
+	}
+
+	return conn.SetLocalDescription(offer)
+}
+
 func (p *WebRTC) waitOffer() error {
-	p.conn.OnDataChannel(func(channel *webrtc.DataChannel) {
+	p.connection().OnDataChannel(func(channel *webrtc.DataChannel) {
 		p.registerDataChannel(channel)
 	})
 
@@ -233,19 +737,35 @@ func (p *WebRTC) waitOffer() error {
 }
 
 func (p *WebRTC) offer() error {
-	dataChannel, err := p.conn.CreateDataChannel("data", nil)
+	conn := p.connection()
+
+	label := dataChannelLabel
+	if p.cfg.Streams > 1 {
+		label += ":" + strconv.Itoa(p.cfg.Streams)
+	}
+
+	dataChannel, err := conn.CreateDataChannel(label, nil)
 	if err != nil {
 		return err
 	}
 
 	p.registerDataChannel(dataChannel)
 
-	offer, err := p.conn.CreateOffer(nil)
+	for i := 1; i < p.cfg.Streams; i++ {
+		stream, err := conn.CreateDataChannel(streamLabel+":"+strconv.Itoa(i), nil)
+		if err != nil {
+			return err
+		}
+
+		p.registerDataChannel(stream)
+	}
+
+	offer, err := conn.CreateOffer(nil)
 	if err != nil {
 		return err
 	}
 
-	if err := p.conn.SetLocalDescription(offer); err != nil {
+	if err := conn.SetLocalDescription(offer); err != nil {
 		return err
 	}
 
@@ -257,12 +777,61 @@ func (p *WebRTC) offer() error {
 	return p.signal.SendSDP(payload)
 }
 
+// registerDataChannel detaches a data channel once it's open. A connection is
+// established once all channels an offering peer opens are open, which an
+// answering peer learns from a label of the first one.
 func (p *WebRTC) registerDataChannel(channel *webrtc.DataChannel) {
+	label := channel.Label()
+
 	channel.OnOpen(func() {
-		var err error
-		p.dataChannel, err = channel.Detach()
+		rw, err := channel.Detach()
 		if err != nil {
-			log.Error(err)
+			p.log.Error(err)
+
+			return
+		}
+
+		p.channelsMx.Lock()
+
+		name, value, _ := strings.Cut(label, ":")
+		n, err := strconv.Atoi(value)
+
+		switch {
+		case name == dataChannelLabel:
+			p.dataChannel = rw
+			p.streamCount = 1
+
+			if err == nil && n > 1 {
+				p.streamCount = n
+			}
+		case name == streamLabel && err == nil && n > 0:
+			if p.streams == nil {
+				p.streams = make(map[int]datachannel.ReadWriteCloser)
+			}
+
+			p.streams[n] = rw
+		default:
+			p.log.Error(errors.Errorf("unknown data channel: %s", label))
+		}
+
+		established := !p.established && p.dataChannel != nil && len(p.streams) >= p.streamCount-1
+		if established {
+			p.established = true
+		}
+
+		p.channelsMx.Unlock()
+
+		if !established {
+			return
+		}
+
+		// Data channels are open once DTLS is done, and nothing is read or
+		// written over them until a connection is established.
+		if err := p.verifyRemoteCertificate(); err != nil {
+			p.log.Error(err)
+			p.shutdown()
+
+			return
 		}
 
 		p.establishHandler()
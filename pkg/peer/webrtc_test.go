@@ -0,0 +1,269 @@
+package peer
+
+import (
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"distributed-backup/pkg/netcheck"
+	"distributed-backup/pkg/signal"
+
+	"github.com/pion/turn/v2"
+)
+
+// newWebRTCPeers makes a receiver's and a sender's peers of configs negotiating
+// through the in-memory signaling. Peers are closed once a test finishes.
+func newWebRTCPeers(t *testing.T, receiverCfg, senderCfg WebRTCConfig) (*WebRTC, *WebRTC) {
+	t.Helper()
+
+	receiverSignal, senderSignal := signal.NewMemoryPair()
+
+	listenSignals(t, receiverSignal, senderSignal)
+
+	return newWebRTCPeer(t, receiverCfg, receiverSignal), newWebRTCPeer(t, senderCfg, senderSignal)
+}
+
+func newWebRTCPeer(t *testing.T, cfg WebRTCConfig, s Signal) *WebRTC {
+	t.Helper()
+
+	p, err := NewWebRTC(cfg, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+// TestWebRTCExchangesNATTypes checks that peers tell each other NAT types they
+// have detected.
+func TestWebRTCExchangesNATTypes(t *testing.T) {
+	receiver, sender := newWebRTCPeers(t,
+		WebRTCConfig{NAT: netcheck.NATTypeEndpointIndependent},
+		WebRTCConfig{NAT: netcheck.NATTypeSymmetric},
+	)
+
+	connect(t, receiver, sender)
+	exchange(t, receiver, sender)
+
+	if nat := receiver.RemoteNAT(); nat != netcheck.NATTypeSymmetric {
+		t.Errorf("receiver got NAT type %q, %q expected", nat, netcheck.NATTypeSymmetric)
+	}
+
+	if nat := sender.RemoteNAT(); nat != netcheck.NATTypeEndpointIndependent {
+		t.Errorf("sender got NAT type %q, %q expected", nat, netcheck.NATTypeEndpointIndependent)
+	}
+}
+
+// TestWebRTCStreams checks that an answering peer takes the number of data
+// channels of an offering one.
+func TestWebRTCStreams(t *testing.T) {
+	receiver, sender := newWebRTCPeers(t, WebRTCConfig{Streams: 3}, WebRTCConfig{Streams: 3})
+
+	connect(t, receiver, sender)
+	exchange(t, receiver, sender)
+
+	receiverStreams, senderStreams := receiver.Streams(), sender.Streams()
+
+	if len(receiverStreams) != 2 || len(senderStreams) != 2 {
+		t.Fatalf("peers have %d and %d streams besides the first one, 2 expected", len(receiverStreams), len(senderStreams))
+	}
+
+	for i := range receiverStreams {
+		exchange(t, receiverStreams[i], senderStreams[i])
+	}
+}
+
+// TestWebRTCThroughTURN makes peers connect through a TURN server run within
+// the process with relayed candidates only.
+func TestWebRTCThroughTURN(t *testing.T) {
+	const (
+		username   = "test"
+		credential = "test-turn-credential"
+		realm      = "distributed-backup"
+	)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm: realm,
+		AuthHandler: func(user, realm string, _ net.Addr) ([]byte, bool) {
+			return turn.GenerateAuthKey(username, realm, credential), user == username
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn: conn,
+			RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+				RelayAddress: net.IPv4(127, 0, 0, 1),
+				Address:      "127.0.0.1",
+			},
+		}},
+	})
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	cfg := WebRTCConfig{
+		TURN: []TURNServer{{
+			Addr:       conn.LocalAddr().String(),
+			Username:   username,
+			Credential: credential,
+		}},
+		RelayOnly: true,
+	}
+
+	receiver, sender := newWebRTCPeers(t, cfg, cfg)
+
+	connect(t, receiver, sender)
+	exchange(t, receiver, sender)
+}
+
+// TestWebRTCStaticDescriptions generates static descriptions of peers, saves
+// and loads them as a user would exchange them, and connects peers with them
+// instead of signaling. Descriptions are used twice to check that they are
+// long-lived.
+func TestWebRTCStaticDescriptions(t *testing.T) {
+	dir := t.TempDir()
+
+	var descriptions [2]*StaticDescription
+
+	for i, name := range []string{"receiver.json", "sender.json"} {
+		d, err := GenerateStaticDescription(WebRTCConfig{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		path := filepath.Join(dir, name)
+
+		if err := d.Save(path); err != nil {
+			t.Fatal(err)
+		}
+
+		if descriptions[i], err = LoadStaticDescription(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		receiverSignal, err := signal.NewStatic(signal.StaticConfig{
+			LocalSDP:  descriptions[0].SDP,
+			RemoteSDP: descriptions[1].SDP,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		senderSignal, err := signal.NewStatic(signal.StaticConfig{
+			LocalSDP:  descriptions[1].SDP,
+			RemoteSDP: descriptions[0].SDP,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		listenSignals(t, receiverSignal, senderSignal)
+
+		receiver := newWebRTCPeer(t, WebRTCConfig{Static: descriptions[0]}, receiverSignal)
+		sender := newWebRTCPeer(t, WebRTCConfig{Static: descriptions[1]}, senderSignal)
+
+		connect(t, receiver, sender)
+		exchange(t, receiver, sender)
+
+		receiver.Close()
+		sender.Close()
+	}
+}
+
+// TestWebRTCPinsFingerprint checks that a receiver pinning a fingerprint of a
+// DTLS certificate of a sender connects to it, and that a connection to a
+// sender with another certificate is dropped before it's established.
+func TestWebRTCPinsFingerprint(t *testing.T) {
+	cert, err := GenerateDTLSCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprint, err := DTLSFingerprint(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, sender := newWebRTCPeers(t,
+		WebRTCConfig{ExpectedFingerprint: fingerprint},
+		WebRTCConfig{Certificate: cert},
+	)
+
+	connect(t, receiver, sender)
+	exchange(t, receiver, sender)
+
+	// The sender has an ephemeral certificate, as if signaling substituted it.
+	receiver, sender = newWebRTCPeers(t, WebRTCConfig{ExpectedFingerprint: fingerprint}, WebRTCConfig{})
+
+	established := make(chan struct{})
+
+	receiver.OnEstablish(func() { close(established) })
+
+	for _, p := range []*WebRTC{receiver, sender} {
+		if err := p.Dial(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-receiver.Done():
+	case <-established:
+		t.Fatal("connection to a peer with another certificate is established")
+	case <-time.After(30 * time.Second):
+		t.Fatal("connection to a peer with another certificate isn't dropped")
+	}
+}
+
+// TestWatchSignal checks that watched signaling tells that the other peer is
+// heard from once a typed message of it is received.
+func TestWatchSignal(t *testing.T) {
+	const typ = "test-offset"
+
+	receiverSignal, senderSignal := signal.NewMemoryPair()
+
+	listenSignals(t, receiverSignal, senderSignal)
+
+	var seen atomic.Bool
+
+	receiver, ok := WatchSignal(receiverSignal, func() { seen.Store(true) }).(MessageSignal)
+	if !ok {
+		t.Fatal("watched signaling doesn't carry typed messages")
+	}
+
+	received := make(chan []byte, 1)
+
+	receiver.On(typ, func(payload []byte) {
+		select {
+		case received <- payload:
+		default:
+		}
+	})
+
+	if err := senderSignal.Send(typ, []byte("42")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case payload := <-received:
+		if string(payload) != "42" {
+			t.Errorf("unexpected payload %q", payload)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("typed message hasn't been received")
+	}
+
+	if !seen.Load() {
+		t.Error("other peer hasn't been heard from")
+	}
+}
@@ -0,0 +1,158 @@
+// Package proxy provides dialers of connections made through SOCKS5 and HTTP(S)
+// proxies, which are used where a connection isn't made by net/http (e.g. TCP
+// connections to TURN servers made by ICE). net/http requests are proxied with
+// http.Transport.Proxy.
+//
+// An HTTP(S) proxy tunnels a connection with the CONNECT method, so it should
+// allow tunneling to ports other than 443 for TURN servers.
+
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+	xproxy "golang.org/x/net/proxy"
+)
+
+func init() {
+	xproxy.RegisterDialerType("http", newConnectDialer)
+	xproxy.RegisterDialerType("https", newConnectDialer)
+}
+
+// Dialer is a dialer of connections made through a proxy.
+type Dialer = xproxy.Dialer
+
+// Parse parses a proxy URL presented as "socks5://[user:password@]host:port",
+// "http://[user:password@]host:port" or "https://[user:password@]host:port".
+func Parse(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h", "http", "https":
+	default:
+		return nil, errors.Errorf("unsupported proxy scheme: %s", u.Scheme)
+	}
+
+	if len(u.Host) == 0 {
+		return nil, errors.New("proxy host is empty")
+	}
+
+	return u, nil
+}
+
+// NewDialer returns a dialer of connections made through a proxy located by u or,
+// if u is nil, by the ALL_PROXY environment variable (connections are made
+// directly if it's not set either).
+func NewDialer(u *url.URL) (Dialer, error) {
+	if u == nil {
+		return xproxy.FromEnvironment(), nil
+	}
+
+	return xproxy.FromURL(u, xproxy.Direct)
+}
+
+// HTTPProxy returns a proxy function of http.Transport using u or, if u is nil,
+// the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+func HTTPProxy(u *url.URL) func(*http.Request) (*url.URL, error) {
+	if u == nil {
+		return http.ProxyFromEnvironment
+	}
+
+	return http.ProxyURL(u)
+}
+
+// connectDialer tunnels connections through an HTTP(S) proxy with the CONNECT method.
+type connectDialer struct {
+	proxyURL *url.URL
+	forward  Dialer
+}
+
+func newConnectDialer(u *url.URL, forward xproxy.Dialer) (xproxy.Dialer, error) {
+	return &connectDialer{
+		proxyURL: u,
+		forward:  forward,
+	}, nil
+}
+
+func (d *connectDialer) Dial(network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, errors.Errorf("network %s can't be tunneled through an HTTP proxy", network)
+	}
+
+	proxyAddr := d.proxyURL.Host
+	if len(d.proxyURL.Port()) == 0 {
+		port := "80"
+		if d.proxyURL.Scheme == "https" {
+			port = "443"
+		}
+
+		proxyAddr = net.JoinHostPort(d.proxyURL.Hostname(), port)
+	}
+
+	conn, err := d.forward.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName: d.proxyURL.Hostname(),
+		})
+
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+
+			return nil, err
+		}
+
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+
+	if user := d.proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	// A tunneled protocol is expected to be started by a client, so nothing but
+	// a response is buffered here.
+	// A response body is not closed, since it would be read until the tunnel is
+	// closed.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+
+		return nil, errors.Errorf("proxy CONNECT response status: %s", resp.Status)
+	}
+
+	return conn, nil
+}
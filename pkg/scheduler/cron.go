@@ -0,0 +1,209 @@
+package scheduler
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cronHorizon bounds a search of the next time of a cron schedule, since some
+// expressions (e.g. "0 0 30 2 *") never match.
+const cronHorizon = 5 * 366 * 24 * time.Hour
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	cronMonths = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronDays   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// cron is a schedule of a standard 5-field cron expression, fields are sets of
+// values as bits.
+type cron struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny tell whether a field starts with "*" (e.g. "*/2"),
+	// since a time matches either of days if both are restricted, as cron does.
+	domAny, dowAny bool
+	loc            *time.Location
+}
+
+// ParseCron parses a cron expression "minute hour day-of-month month day-of-week"
+// or a macro such as "@daily". A field is "*", a value, a range "a-b" or a list of
+// them, each optionally with a step "/n". Months and days of week may be given as
+// names (e.g. "jan", "mon"), Sunday is both 0 and 7. A time matches either of
+// days if both of them are restricted, i.e. don't start with "*". Times are in
+// loc: ones skipped by a change of the clock to daylight saving time are
+// skipped, and ones repeated by a change back match both times.
+func ParseCron(expr string, loc *time.Location) (Schedule, error) {
+	if macro, ok := cronMacros[strings.ToLower(strings.TrimSpace(expr))]; ok {
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.Errorf("cron expression should have 5 fields: %s", expr)
+	}
+
+	c := &cron{loc: loc}
+
+	var err error
+
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, errors.Wrap(err, "minute")
+	}
+
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, errors.Wrap(err, "hour")
+	}
+
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, errors.Wrap(err, "day of month")
+	}
+
+	if c.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, errors.Wrap(err, "month")
+	}
+
+	if c.dow, err = parseCronField(fields[4], 0, 7, cronDays); err != nil {
+		return nil, errors.Wrap(err, "day of week")
+	}
+
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+
+	c.domAny = strings.HasPrefix(fields[2], "*")
+	c.dowAny = strings.HasPrefix(fields[4], "*")
+
+	if c.Next(time.Now()).IsZero() {
+		return nil, errors.Errorf("cron expression never matches: %s", expr)
+	}
+
+	return c, nil
+}
+
+func (c *cron) Next(t time.Time) time.Time {
+	t = t.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+	end := t.Add(cronHorizon)
+
+	for t.Before(end) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = c.date(t.Year(), t.Month()+1, 1, 0)
+		case !c.matchDay(t):
+			t = c.date(t.Year(), t.Month(), t.Day()+1, 0)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = c.date(t.Year(), t.Month(), t.Day(), t.Hour()+1)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// date returns the first time of a wall clock hour or after it. An hour skipped
+// by a change of the clock may be normalized by time.Date() to one before the
+// change, which Next() would never get past.
+func (c *cron) date(year int, month time.Month, day, hour int) time.Time {
+	t := time.Date(year, month, day, hour, 0, 0, 0, c.loc)
+
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+	if expected := time.Date(year, month, day, hour, 0, 0, 0, time.UTC); wall.Before(expected) {
+		t = t.Add(expected.Sub(wall))
+	}
+
+	return t
+}
+
+func (c *cron) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+
+	// A field starting with "*" may still be restricted by a step, so both of
+	// them are matched then.
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+
+	return dom || dow
+}
+
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			rng = part[:i]
+
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, errors.Errorf("invalid step: %s", part)
+			}
+
+			step = n
+		}
+
+		lo, hi := min, max
+
+		if rng != "*" {
+			var err error
+
+			bounds := strings.SplitN(rng, "-", 2)
+
+			if lo, err = parseCronValue(bounds[0], min, max, names); err != nil {
+				return 0, err
+			}
+
+			hi = lo
+
+			if len(bounds) == 2 {
+				if hi, err = parseCronValue(bounds[1], min, max, names); err != nil {
+					return 0, err
+				}
+			} else if step != 1 {
+				// "a/n" means every n-th value starting from a.
+				hi = max
+			}
+
+			if lo > hi {
+				return 0, errors.Errorf("invalid range: %s", rng)
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+func parseCronValue(s string, min, max int, names []string) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(s, name) {
+			return i + min, nil
+		}
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil || v < min || v > max {
+		return 0, errors.Errorf("value should be within %d-%d: %s", min, max, s)
+	}
+
+	return v, nil
+}
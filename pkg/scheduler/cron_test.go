@@ -0,0 +1,209 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+const cronTestLayout = "2006-01-02 15:04:05 -0700"
+
+func parseCronTestTime(t *testing.T, s string) time.Time {
+	t.Helper()
+
+	tm, err := time.Parse(cronTestLayout, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tm
+}
+
+// testCronNext checks that a schedule of expr in loc is due at times of next
+// one by one after from.
+func testCronNext(t *testing.T, loc *time.Location, expr, from string, next ...string) {
+	t.Helper()
+
+	s, err := ParseCron(expr, loc)
+	if err != nil {
+		t.Fatalf("%q: %v", expr, err)
+	}
+
+	tm := parseCronTestTime(t, from)
+
+	for _, n := range next {
+		expected := parseCronTestTime(t, n)
+
+		if tm = s.Next(tm); !tm.Equal(expected) {
+			t.Fatalf("%q is due at %s, %s expected", expr, tm.Format(cronTestLayout), n)
+		}
+	}
+}
+
+func TestCron(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		expr string
+		from string
+		next []string
+	}{
+		{"hourly", "@hourly", "2024-01-01 10:15:00 +0000", []string{
+			"2024-01-01 11:00:00 +0000", "2024-01-01 12:00:00 +0000",
+		}},
+		{"daily", "@daily", "2024-01-01 10:15:00 +0000", []string{
+			"2024-01-02 00:00:00 +0000", "2024-01-03 00:00:00 +0000",
+		}},
+		{"midnight", " @MIDNIGHT ", "2024-01-01 10:15:00 +0000", []string{
+			"2024-01-02 00:00:00 +0000",
+		}},
+		{"weekly", "@weekly", "2024-01-01 10:15:00 +0000", []string{
+			"2024-01-07 00:00:00 +0000", "2024-01-14 00:00:00 +0000",
+		}},
+		{"monthly", "@monthly", "2024-01-31 10:15:00 +0000", []string{
+			"2024-02-01 00:00:00 +0000", "2024-03-01 00:00:00 +0000",
+		}},
+		{"yearly", "@yearly", "2024-01-01 00:00:00 +0000", []string{
+			"2025-01-01 00:00:00 +0000", "2026-01-01 00:00:00 +0000",
+		}},
+		{"annually", "@annually", "2024-06-01 00:00:00 +0000", []string{
+			"2025-01-01 00:00:00 +0000",
+		}},
+		{"strictly after", "15 10 * * *", "2024-01-01 10:15:00 +0000", []string{
+			"2024-01-02 10:15:00 +0000",
+		}},
+		{"seconds", "15 10 * * *", "2024-01-01 10:14:59 +0000", []string{
+			"2024-01-01 10:15:00 +0000",
+		}},
+		{"names", "0 9 * jan-MAR mon,Fri", "2024-03-28 10:00:00 +0000", []string{
+			"2024-03-29 09:00:00 +0000", "2025-01-03 09:00:00 +0000", "2025-01-06 09:00:00 +0000",
+		}},
+		{"7 as Sunday", "0 0 * * 7", "2024-01-01 00:00:00 +0000", []string{
+			"2024-01-07 00:00:00 +0000", "2024-01-14 00:00:00 +0000",
+		}},
+		{"0 as Sunday", "0 0 * * 0", "2024-01-01 00:00:00 +0000", []string{
+			"2024-01-07 00:00:00 +0000",
+		}},
+		{"range to Sunday", "0 0 * * fri-7", "2024-01-01 00:00:00 +0000", []string{
+			"2024-01-05 00:00:00 +0000", "2024-01-06 00:00:00 +0000", "2024-01-07 00:00:00 +0000",
+			"2024-01-12 00:00:00 +0000",
+		}},
+		{"step", "*/15 * * * *", "2024-01-01 10:07:00 +0000", []string{
+			"2024-01-01 10:15:00 +0000", "2024-01-01 10:30:00 +0000", "2024-01-01 10:45:00 +0000",
+			"2024-01-01 11:00:00 +0000",
+		}},
+		{"step from a value", "5/20 * * * *", "2024-01-01 10:00:00 +0000", []string{
+			"2024-01-01 10:05:00 +0000", "2024-01-01 10:25:00 +0000", "2024-01-01 10:45:00 +0000",
+			"2024-01-01 11:05:00 +0000",
+		}},
+		{"step of a range", "0 8-18/4 * * *", "2024-01-01 10:00:00 +0000", []string{
+			"2024-01-01 12:00:00 +0000", "2024-01-01 16:00:00 +0000", "2024-01-02 08:00:00 +0000",
+		}},
+		{"list of steps", "0 0 1-10/3,20 * *", "2024-01-01 00:00:00 +0000", []string{
+			"2024-01-04 00:00:00 +0000", "2024-01-07 00:00:00 +0000", "2024-01-10 00:00:00 +0000",
+			"2024-01-20 00:00:00 +0000", "2024-02-01 00:00:00 +0000",
+		}},
+		{"leap day", "0 0 29 2 *", "2024-03-01 00:00:00 +0000", []string{
+			"2028-02-29 00:00:00 +0000",
+		}},
+		// A day matches either of restricted fields.
+		{"day of month or week", "0 0 13 * fri", "2024-09-01 00:00:00 +0000", []string{
+			"2024-09-06 00:00:00 +0000", "2024-09-13 00:00:00 +0000", "2024-09-20 00:00:00 +0000",
+			"2024-09-27 00:00:00 +0000", "2024-10-04 00:00:00 +0000", "2024-10-11 00:00:00 +0000",
+			"2024-10-13 00:00:00 +0000",
+		}},
+		// A day matches both fields if either of them starts with "*".
+		{"day of week on stepped days", "0 0 */2 * mon", "2024-01-01 00:00:00 +0000", []string{
+			"2024-01-15 00:00:00 +0000", "2024-01-29 00:00:00 +0000", "2024-02-05 00:00:00 +0000",
+		}},
+		{"day of month on stepped days", "0 0 1 * */2", "2024-01-01 00:00:00 +0000", []string{
+			"2024-02-01 00:00:00 +0000", "2024-06-01 00:00:00 +0000", "2024-08-01 00:00:00 +0000",
+		}},
+		{"day of week on any day", "0 0 * * mon", "2024-01-01 00:00:00 +0000", []string{
+			"2024-01-08 00:00:00 +0000",
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testCronNext(t, time.UTC, tt.expr, tt.from, tt.next...)
+		})
+	}
+}
+
+// TestCronDST checks times around changes of the clock in New York, which is
+// moved from 2:00 to 3:00 on 2024-03-10 and back from 2:00 to 1:00 on
+// 2024-11-03.
+func TestCronDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone database: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		expr string
+		from string
+		next []string
+	}{
+		{"skipped time", "30 2 * * *", "2024-03-09 03:00:00 -0500", []string{
+			"2024-03-11 02:30:00 -0400",
+		}},
+		{"every 30 minutes forward", "*/30 * * * *", "2024-03-10 01:15:00 -0500", []string{
+			"2024-03-10 01:30:00 -0500", "2024-03-10 03:00:00 -0400", "2024-03-10 03:30:00 -0400",
+		}},
+		{"time after a skipped one", "0 3 * * *", "2024-03-09 12:00:00 -0500", []string{
+			"2024-03-10 03:00:00 -0400", "2024-03-11 03:00:00 -0400",
+		}},
+		{"repeated time", "30 1 * * *", "2024-11-03 00:00:00 -0400", []string{
+			"2024-11-03 01:30:00 -0400", "2024-11-03 01:30:00 -0500", "2024-11-04 01:30:00 -0500",
+		}},
+		{"every 30 minutes back", "*/30 * * * *", "2024-11-03 01:15:00 -0400", []string{
+			"2024-11-03 01:30:00 -0400", "2024-11-03 01:00:00 -0500", "2024-11-03 01:30:00 -0500",
+			"2024-11-03 02:00:00 -0500",
+		}},
+		{"time after a repeated one", "0 3 * * *", "2024-11-02 12:00:00 -0400", []string{
+			"2024-11-03 03:00:00 -0500", "2024-11-04 03:00:00 -0500",
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testCronNext(t, loc, tt.expr, tt.from, tt.next...)
+		})
+	}
+}
+
+// TestCronMidnightDST checks days around a change of the clock at midnight in
+// Santiago, which is moved from 0:00 to 1:00 on 2024-09-08.
+func TestCronMidnightDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/Santiago")
+	if err != nil {
+		t.Skipf("time zone database: %v", err)
+	}
+
+	testCronNext(t, loc, "0 0 * * *", "2024-09-07 12:00:00 -0400", "2024-09-09 00:00:00 -0300")
+	testCronNext(t, loc, "0 1 * * *", "2024-09-07 12:00:00 -0400", "2024-09-08 01:00:00 -0300")
+	testCronNext(t, loc, "0 12 * * sun", "2024-09-07 12:00:00 -0400", "2024-09-08 12:00:00 -0300")
+}
+
+func TestParseCronRefusesBadExpressions(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@reboot",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"* * * foo *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"1-2-3 * * * *",
+		",1 * * * *",
+		"0 0 30 2 *",
+	} {
+		if _, err := ParseCron(expr, time.UTC); err == nil {
+			t.Errorf("%q is parsed", expr)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Scheduler runs a job at times of a schedule, which is either a cron expression
+// (see: ParseCron()) or a fixed interval (see: Every()), so that a sender runs as
+// a long-lived process pushing a fresh backup on a schedule rather than relying on
+// an external cron. A job may also be run whenever a watched path changes
+// instead (see: Watch()).
+//
+// Runs never overlap: if a run takes longer than the time to the next one, runs
+// missed meanwhile are skipped and the next one is scheduled after the run ends.
+
+package scheduler
+
+import (
+	"context"
+	"time"
+
+	"distributed-backup/pkg/log"
+)
+
+// Schedule tells when a job is due next.
+type Schedule interface {
+	// Next returns the first time a job is due strictly after t, or the zero
+	// time if it's never due.
+	Next(t time.Time) time.Time
+}
+
+type interval time.Duration
+
+// Every returns a schedule of runs starting every d.
+func Every(d time.Duration) Schedule {
+	return interval(d)
+}
+
+func (i interval) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(i))
+}
+
+type Scheduler struct {
+	cfg Config
+	log log.Logger
+}
+
+type Config struct {
+	Schedule Schedule
+	// RunAtStart makes the first run start at once rather than at the first time
+	// of a schedule.
+	RunAtStart bool
+	// Log is a logger entries are written with, the global logger is used if nil.
+	Log log.Logger
+}
+
+func New(cfg Config) *Scheduler {
+	if cfg.Log == nil {
+		cfg.Log = log.New()
+	}
+
+	return &Scheduler{
+		cfg: cfg,
+		log: cfg.Log,
+	}
+}
+
+// Run runs job at times of a schedule until ctx is done, or the schedule has no
+// more times. A context a job is run with is ctx.
+func (s *Scheduler) Run(ctx context.Context, job func(context.Context)) {
+	next := time.Now()
+	if !s.cfg.RunAtStart {
+		next = s.cfg.Schedule.Next(next)
+	}
+
+	for {
+		if next.IsZero() {
+			s.log.Info("no more scheduled runs")
+
+			return
+		}
+
+		s.log.WithField(log.FieldNextRun, next.Format(time.RFC3339)).Info("next run is scheduled")
+
+		timer := time.NewTimer(time.Until(next))
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+
+			return
+		}
+
+		started := next
+
+		job(ctx)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		now := time.Now()
+		next = s.cfg.Schedule.Next(started)
+
+		if !next.IsZero() && next.Before(now) {
+			s.log.WithField(log.FieldDuration, now.Sub(started).Round(time.Second).String()).
+				Info("run took longer than the schedule allows, skipping missed runs")
+
+			next = s.cfg.Schedule.Next(now)
+		}
+	}
+}
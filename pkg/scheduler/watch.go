@@ -0,0 +1,189 @@
+package scheduler
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"distributed-backup/pkg/log"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+type WatchConfig struct {
+	// Path is a file or a directory, which is watched along with its
+	// subdirectories.
+	Path string
+	// Settle is a duration no changes must be made for before a job is run, so
+	// that a burst of changes (e.g. a build or a copy) results in a single run.
+	Settle time.Duration
+	// Log is a logger entries are written with, the global logger is used if nil.
+	Log log.Logger
+}
+
+// Watch runs job at once and then every time changes of a watched path settle
+// until ctx is done. Like runs of a schedule, runs never overlap: changes made
+// while a job runs make the next run start once they settle after it ends.
+func Watch(ctx context.Context, cfg WatchConfig, job func(context.Context)) error {
+	if cfg.Log == nil {
+		cfg.Log = log.New()
+	}
+
+	w, err := newWatcher(cfg)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	changed := make(chan struct{}, 1)
+
+	go w.run(changed)
+
+	for {
+		job(ctx)
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		cfg.Log.Info("waiting for changes")
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil
+		}
+
+		timer := time.NewTimer(cfg.Settle)
+
+	settle:
+		for {
+			select {
+			case <-changed:
+				timer.Reset(cfg.Settle)
+			case <-timer.C:
+				break settle
+			case <-ctx.Done():
+				timer.Stop()
+
+				return nil
+			}
+		}
+
+		cfg.Log.Info("changes have settled")
+	}
+}
+
+// watcher watches a file by its directory, since editors usually replace a
+// file rather than write it, and a directory by it and every subdirectory of it,
+// since fsnotify doesn't watch directories recursively.
+type watcher struct {
+	*fsnotify.Watcher
+
+	cfg WatchConfig
+	// file is a watched file if Path isn't a directory.
+	file string
+}
+
+func newWatcher(cfg WatchConfig) (*watcher, error) {
+	fi, err := os.Stat(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "watcher")
+	}
+
+	w := &watcher{Watcher: fw, cfg: cfg}
+
+	if fi.IsDir() {
+		err = w.addTree(cfg.Path)
+	} else {
+		w.file = filepath.Clean(cfg.Path)
+		err = w.Add(filepath.Dir(w.file))
+	}
+
+	if err != nil {
+		fw.Close()
+
+		return nil, errors.Wrap(err, "watcher")
+	}
+
+	return w, nil
+}
+
+// addTree watches a directory and its subdirectories.
+func (w *watcher) addTree(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// A directory may be removed while it's walked.
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		return w.Add(path)
+	})
+}
+
+// run tells of changes of a watched path through changed until the watcher is
+// closed.
+func (w *watcher) run(changed chan<- struct{}) {
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+
+	for {
+		select {
+		case e, ok := <-w.Events:
+			if !ok {
+				return
+			}
+
+			if len(w.file) != 0 && filepath.Clean(e.Name) != w.file {
+				continue
+			}
+
+			// A created (or moved in) directory may already have contents.
+			if len(w.file) == 0 && e.Has(fsnotify.Create) {
+				if fi, err := os.Lstat(e.Name); err == nil && fi.IsDir() {
+					if err := w.addTree(e.Name); err != nil {
+						w.cfg.Log.Error(errors.Wrap(err, "watcher"))
+					}
+				}
+			}
+
+			w.cfg.Log.WithFields(log.Fields{
+				log.FieldFile: e.Name,
+				log.FieldType: e.Op.String(),
+			}).Trace("change")
+
+			notify()
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+
+			// Changes are lost if events overflow, so a run is made anyway.
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				notify()
+			}
+
+			w.cfg.Log.Error(errors.Wrap(err, "watcher"))
+		}
+	}
+}
@@ -0,0 +1,324 @@
+// Updater checks a release feed located by FeedURL, downloads a new binary for
+// the current platform if the feed announces a version newer than CurrentVersion,
+// verifies its signature with PublicKey and atomically replaces Executable with
+// it (see: Update()).
+//
+// The release feed is a JSON document presented as
+// {"version": "1.2.3", "assets": {"${GOOS}/${GOARCH}": {"url": "...", "signature": "..."}}}
+// where signature is a base64-encoded Ed25519ph signature (Ed25519 over SHA-512)
+// of a release version and a platform followed by a binary (see: Sign()), so
+// that a binary is verified while it is being downloaded without keeping it in
+// memory, and a feed can neither announce a signed binary as another version
+// nor serve one of another platform. A version which isn't newer than the
+// current one is never installed, so an old signed release can't be rolled back
+// to.
+//
+// A downloaded binary is written into a temporary file next to Executable which
+// is renamed over Executable only after the signature is verified, so an
+// interrupted or forged update never leaves a broken executable behind.
+
+package selfupdate
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/proxy"
+
+	"github.com/pkg/errors"
+)
+
+// ErrUpToDate is the error returned by Update() if the release feed does not
+// announce a version newer than the current one.
+var ErrUpToDate = errors.New("already up to date")
+
+// ErrNotRelease is the error returned by NewUpdater() if CurrentVersion isn't a
+// release version (e.g. "dev"), which a version of a feed can't be compared
+// with, so that a downgrade couldn't be told apart from an update.
+var ErrNotRelease = errors.New("current version isn't a release version")
+
+// releaseLabel binds signatures to releases of this application.
+const releaseLabel = "distributed-backup release v2"
+
+type Updater struct {
+	cfg UpdaterConfig
+	log log.Logger
+
+	client *http.Client
+}
+
+type UpdaterConfig struct {
+	FeedURL        string
+	PublicKey      ed25519.PublicKey
+	CurrentVersion string
+	Executable     string
+	// Proxy is a proxy a feed and a binary are downloaded through, proxy
+	// environment variables are used if nil.
+	Proxy *url.URL
+	// Log is a logger entries are written with, the global logger is used if nil.
+	Log log.Logger
+}
+
+func NewUpdater(cfg UpdaterConfig) (*Updater, error) {
+	if len(cfg.FeedURL) == 0 {
+		return nil, errors.New("release feed URL is empty")
+	}
+
+	if len(cfg.PublicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid release public key")
+	}
+
+	if _, ok := parseVersion(cfg.CurrentVersion); !ok {
+		return nil, ErrNotRelease
+	}
+
+	if len(cfg.Executable) == 0 {
+		executable, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.Executable, err = filepath.EvalSymlinks(executable)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Log == nil {
+		cfg.Log = log.New()
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy.HTTPProxy(cfg.Proxy)
+
+	return &Updater{
+		cfg: cfg,
+		log: cfg.Log,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   30 * time.Minute,
+		},
+	}, nil
+}
+
+// Update returns a version the executable has been updated to.
+func (u *Updater) Update() (string, error) {
+	feed, err := u.fetchFeed()
+	if err != nil {
+		return "", errors.Wrap(err, "release feed")
+	}
+
+	if !isNewerVersion(feed.Version, u.cfg.CurrentVersion) {
+		return "", ErrUpToDate
+	}
+
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+
+	asset, ok := feed.Assets[platform]
+	if !ok {
+		return "", errors.Errorf("no release asset for %s", platform)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(asset.Signature)
+	if err != nil {
+		return "", errors.Wrap(err, "release signature")
+	}
+
+	u.log.WithFields(log.Fields{
+		log.FieldVersion: feed.Version,
+		log.FieldURL:     asset.URL,
+	}).Info("downloading release")
+
+	tmpPath, err := u.download(asset.URL, releaseDigest(feed.Version, platform), signature)
+	if err != nil {
+		return "", err
+	}
+
+	if err := u.replaceExecutable(tmpPath); err != nil {
+		os.Remove(tmpPath)
+
+		return "", err
+	}
+
+	return feed.Version, nil
+}
+
+type releaseFeed struct {
+	Version string                  `json:"version"`
+	Assets  map[string]releaseAsset `json:"assets"`
+}
+
+type releaseAsset struct {
+	URL       string `json:"url"`
+	Signature string `json:"signature"`
+}
+
+func (u *Updater) fetchFeed() (*releaseFeed, error) {
+	resp, err := u.client.Get(u.cfg.FeedURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("response status: %s", resp.Status)
+	}
+
+	feed := &releaseFeed{}
+	if err := json.NewDecoder(resp.Body).Decode(feed); err != nil {
+		return nil, err
+	}
+
+	return feed, nil
+}
+
+// download returns a path to a temporary file containing a binary verified to
+// be signed along with what digest has been written with.
+func (u *Updater) download(url string, digest hash.Hash, signature []byte) (string, error) {
+	resp, err := u.client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("response status: %s", resp.Status)
+	}
+
+	// The temporary file is created in the same directory to make the final
+	// rename atomic (the same file system).
+	f, err := os.CreateTemp(filepath.Dir(u.cfg.Executable), ".distributed-backup-update-*")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(io.MultiWriter(f, digest), resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = ed25519.VerifyWithOptions(u.cfg.PublicKey, digest.Sum(nil), signature, &ed25519.Options{
+			Hash: crypto.SHA512,
+		})
+		err = errors.Wrap(err, "release signature")
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// Sign returns an Ed25519ph signature of a binary of a release of version for a
+// platform ("${GOOS}/${GOARCH}") to put into a release feed.
+func Sign(key ed25519.PrivateKey, version, platform string, binary io.Reader) ([]byte, error) {
+	digest := releaseDigest(version, platform)
+
+	if _, err := io.Copy(digest, binary); err != nil {
+		return nil, err
+	}
+
+	return key.Sign(nil, digest.Sum(nil), crypto.SHA512)
+}
+
+// releaseDigest returns a digest of a binary of a release of version for a
+// platform, which the release is written to before the binary.
+func releaseDigest(version, platform string) hash.Hash {
+	digest := sha512.New()
+
+	for _, field := range []string{releaseLabel, version, platform} {
+		digest.Write([]byte(strconv.Itoa(len(field)) + ":" + field + "\n"))
+	}
+
+	return digest
+}
+
+func (u *Updater) replaceExecutable(path string) error {
+	fi, err := os.Stat(u.cfg.Executable)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(path, fi.Mode().Perm()); err != nil {
+		return err
+	}
+
+	// A running executable can not be replaced on Windows but it can be renamed.
+	if runtime.GOOS == "windows" {
+		oldPath := u.cfg.Executable + ".old"
+
+		os.Remove(oldPath)
+
+		if err := os.Rename(u.cfg.Executable, oldPath); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(path, u.cfg.Executable)
+}
+
+// isNewerVersion compares dot-separated numeric versions optionally prefixed
+// with "v". A non-numeric version is never newer, and a current one is checked
+// by NewUpdater().
+func isNewerVersion(version, current string) bool {
+	v1, ok := parseVersion(version)
+	if !ok {
+		return false
+	}
+
+	v2, _ := parseVersion(current)
+
+	for i := 0; i < len(v1) || i < len(v2); i++ {
+		var n1, n2 int
+
+		if i < len(v1) {
+			n1 = v1[i]
+		}
+
+		if i < len(v2) {
+			n2 = v2[i]
+		}
+
+		if n1 != n2 {
+			return n1 > n2
+		}
+	}
+
+	return false
+}
+
+// parseVersion returns numbers of a dot-separated numeric version optionally
+// prefixed with "v", and false if it isn't one.
+func parseVersion(version string) ([]int, bool) {
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	numbers := make([]int, len(parts))
+
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+
+		numbers[i] = n
+	}
+
+	return numbers, true
+}
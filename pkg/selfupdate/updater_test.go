@@ -0,0 +1,156 @@
+package selfupdate
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	testBinary   = []byte("new binary")
+	testPlatform = runtime.GOOS + "/" + runtime.GOARCH
+)
+
+// newTestRelease serves a feed announcing version with a binary signed as a
+// release of signedVersion for signedPlatform, and returns an updater of an
+// executable of version 1.0.0 checking it.
+func newTestRelease(t *testing.T, version, signedVersion, signedPlatform string) (*Updater, string) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature, err := Sign(priv, signedVersion, signedPlatform, bytes.NewReader(testBinary))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	mux.HandleFunc("/feed.json", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(releaseFeed{
+			Version: version,
+			Assets: map[string]releaseAsset{
+				testPlatform: {
+					URL:       server.URL + "/binary",
+					Signature: base64.StdEncoding.EncodeToString(signature),
+				},
+			},
+		})
+	})
+
+	mux.HandleFunc("/binary", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testBinary)
+	})
+
+	executable := filepath.Join(t.TempDir(), "distributed-backup")
+
+	if err := os.WriteFile(executable, []byte("old binary"), 0775); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := NewUpdater(UpdaterConfig{
+		FeedURL:        server.URL + "/feed.json",
+		PublicKey:      pub,
+		CurrentVersion: "1.0.0",
+		Executable:     executable,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u, executable
+}
+
+func assertExecutable(t *testing.T, executable string, content []byte) {
+	t.Helper()
+
+	b, err := os.ReadFile(executable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, content) {
+		t.Errorf("executable is %q, want %q", b, content)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	u, executable := newTestRelease(t, "1.1.0", "1.1.0", testPlatform)
+
+	version, err := u.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != "1.1.0" {
+		t.Errorf("Update() = %s, want 1.1.0", version)
+	}
+
+	assertExecutable(t, executable, testBinary)
+}
+
+func TestUpdateRefusesMismatchingRelease(t *testing.T) {
+	for _, tt := range []struct {
+		name                                   string
+		version, signedVersion, signedPlatform string
+	}{
+		{"binary of another version", "9.9.9", "1.1.0", testPlatform},
+		{"binary of another platform", "1.1.0", "1.1.0", "plan9/mips"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			u, executable := newTestRelease(t, tt.version, tt.signedVersion, tt.signedPlatform)
+
+			if _, err := u.Update(); err == nil {
+				t.Error("mismatching release is installed")
+			}
+
+			assertExecutable(t, executable, []byte("old binary"))
+		})
+	}
+}
+
+func TestUpdateRefusesDowngrade(t *testing.T) {
+	for _, version := range []string{"0.9.0", "1.0.0"} {
+		u, executable := newTestRelease(t, version, version, testPlatform)
+
+		if _, err := u.Update(); !errors.Is(err, ErrUpToDate) {
+			t.Errorf("Update() to %s = %v, want ErrUpToDate", version, err)
+		}
+
+		assertExecutable(t, executable, []byte("old binary"))
+	}
+}
+
+func TestNewUpdaterRefusesDevelopmentBuild(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []string{"dev", "", "1.0.0-rc1", "v1..0"} {
+		_, err := NewUpdater(UpdaterConfig{
+			FeedURL:        "https://example.com/feed.json",
+			PublicKey:      pub,
+			CurrentVersion: version,
+			Executable:     "distributed-backup",
+		})
+		if !errors.Is(err, ErrNotRelease) {
+			t.Errorf("NewUpdater() of version %q = %v, want ErrNotRelease", version, err)
+		}
+	}
+}
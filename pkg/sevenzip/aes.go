@@ -0,0 +1,117 @@
+package sevenzip
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"unicode/utf16"
+)
+
+// aesNumCyclesPower is a binary logarithm of a number of SHA-256 rounds a key is
+// derived from a password with, 7-Zip uses the same one by default.
+const aesNumCyclesPower = 19
+
+// deriveKey returns an AES-256 key of a password as 7-Zip does: the SHA-256 hash
+// of the UTF-16LE password followed by a round counter repeated 2^19 times.
+func deriveKey(password string) []byte {
+	pw := utf16le(password)
+	buf := make([]byte, len(pw)+8)
+	copy(buf, pw)
+
+	h := sha256.New()
+
+	for i := uint64(0); i < 1<<aesNumCyclesPower; i++ {
+		binary.LittleEndian.PutUint64(buf[len(pw):], i)
+		h.Write(buf)
+	}
+
+	return h.Sum(nil)
+}
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+
+	return b
+}
+
+// aesWriter encrypts data with AES-256 in CBC mode. The last block is padded with
+// zeros, an unpacked size stored in a header tells a decoder where data ends.
+type aesWriter struct {
+	w     io.Writer
+	mode  cipher.BlockMode
+	iv    []byte
+	block []byte
+	n     int
+}
+
+func newAESWriter(w io.Writer, key []byte) (*aesWriter, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	return &aesWriter{
+		w:     w,
+		mode:  cipher.NewCBCEncrypter(c, iv),
+		iv:    iv,
+		block: make([]byte, 0, 64<<10),
+	}, nil
+}
+
+// props returns properties of the coder: a number of rounds, a size of an IV
+// and the IV itself, there is no salt.
+func (a *aesWriter) props() []byte {
+	return append([]byte{aesNumCyclesPower | 0x40, byte(len(a.iv) - 1)}, a.iv...)
+}
+
+func (a *aesWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		k := copy(a.block[len(a.block):cap(a.block)], p)
+		a.block = a.block[:len(a.block)+k]
+		p = p[k:]
+
+		if len(a.block) == cap(a.block) {
+			if err := a.writeBlocks(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+func (a *aesWriter) writeBlocks() error {
+	a.mode.CryptBlocks(a.block, a.block)
+	a.n += len(a.block)
+
+	_, err := a.w.Write(a.block)
+	a.block = a.block[:0]
+
+	return err
+}
+
+// Close pads and writes the rest of data. It does not close the underlying
+// writer.
+func (a *aesWriter) Close() error {
+	if pad := len(a.block) % aes.BlockSize; pad != 0 {
+		a.block = append(a.block, make([]byte, aes.BlockSize-pad)...)
+	}
+
+	return a.writeBlocks()
+}
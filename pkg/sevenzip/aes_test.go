@@ -0,0 +1,147 @@
+package sevenzip
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// aesKey derives a key of coder properties and a password as 7-Zip does, with
+// a salt which a writer never sets, and returns an IV of properties.
+func aesKey(props []byte, password string) ([]byte, []byte, error) {
+	if len(props) < 2 || props[0]&0xC0 == 0 {
+		return nil, nil, errors.New("no IV in properties of AES")
+	}
+
+	cycles := props[0] & 0x3F
+	saltSize := int(props[0]>>7) + int(props[1]>>4)
+	ivSize := int(props[0]>>6&1) + int(props[1]&0x0F)
+
+	if cycles >= 0x3F || len(props) != 2+saltSize+ivSize || ivSize > aes.BlockSize {
+		return nil, nil, errors.New("bad properties of AES")
+	}
+
+	salt := props[2 : 2+saltSize]
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, props[2+saltSize:])
+
+	var pw []byte
+	for _, c := range password {
+		pw = binary.LittleEndian.AppendUint16(pw, uint16(c))
+	}
+
+	h := sha256.New()
+	counter := make([]byte, 8)
+
+	for i := uint64(0); i < 1<<cycles; i++ {
+		binary.LittleEndian.PutUint64(counter, i)
+		h.Write(salt)
+		h.Write(pw)
+		h.Write(counter)
+	}
+
+	return h.Sum(nil), iv, nil
+}
+
+func decryptAES(key, iv, data []byte) ([]byte, error) {
+	if len(data)%aes.BlockSize != 0 {
+		return nil, errors.Errorf("%d bytes aren't whole blocks of AES", len(data))
+	}
+
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(c, iv).CryptBlocks(out, data)
+
+	return out, nil
+}
+
+// TestAESWriter encrypts data of sizes around blocks of AES and of a buffer of
+// a writer, and decrypts it with a key and an IV of coder properties.
+func TestAESWriter(t *testing.T) {
+	const password = "pässword"
+
+	key := deriveKey(password)
+
+	for _, size := range []int{0, 1, aes.BlockSize - 1, aes.BlockSize, aes.BlockSize + 1, 64 << 10, 64<<10 + 5, 200 << 10} {
+		data := random(size, int64(size))
+
+		var b bytes.Buffer
+
+		a, err := newAESWriter(&b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Writes of odd sizes cross the buffer of a writer.
+		for p := data; len(p) > 0; {
+			n := 1000
+			if n > len(p) {
+				n = len(p)
+			}
+
+			if _, err := a.Write(p[:n]); err != nil {
+				t.Fatal(err)
+			}
+
+			p = p[n:]
+		}
+
+		if err := a.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if padded := (size + aes.BlockSize - 1) / aes.BlockSize * aes.BlockSize; b.Len() != padded {
+			t.Fatalf("%d bytes are encrypted into %d, %d expected", size, b.Len(), padded)
+		}
+
+		propsKey, iv, err := aesKey(a.props(), password)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(propsKey, key) {
+			t.Fatal("key of a password mismatch")
+		}
+
+		decrypted, err := decryptAES(propsKey, iv, b.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(decrypted[:size], data) {
+			t.Fatalf("%d bytes: decrypted data mismatch", size)
+		}
+
+		if !bytes.Equal(decrypted[size:], make([]byte, len(decrypted)-size)) {
+			t.Fatalf("%d bytes: padding isn't zeros", size)
+		}
+	}
+}
+
+// TestAESWriterIV checks that every writer takes a fresh IV.
+func TestAESWriterIV(t *testing.T) {
+	key := deriveKey("password")
+
+	a, err := newAESWriter(&bytes.Buffer{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := newAESWriter(&bytes.Buffer{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(a.props(), b.props()) {
+		t.Error("writers take the same IV")
+	}
+}
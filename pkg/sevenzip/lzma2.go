@@ -0,0 +1,732 @@
+package sevenzip
+
+import (
+	"io"
+	"math/bits"
+)
+
+// LZMA parameters used by the encoder: 3 literal context bits, 0 literal position
+// bits and 2 position bits, which are defaults of most LZMA implementations.
+const (
+	lzmaLc = 3
+	lzmaLp = 0
+	lzmaPb = 2
+
+	lzmaProps = (lzmaPb*5+lzmaLp)*9 + lzmaLc
+
+	lzmaNumStates         = 12
+	lzmaPosBitsMax        = 4
+	lzmaMatchLenMin       = 2
+	lzmaMatchLenMax       = 273
+	lzmaNumLenToPosStates = 4
+	lzmaEndPosModelIndex  = 14
+	lzmaNumFullDistances  = 1 << (lzmaEndPosModelIndex >> 1)
+	lzmaNumAlignBits      = 4
+
+	lzmaProbInit = 1 << 10
+)
+
+// LZMA2 chunk limits.
+const (
+	lzma2MaxUnpacked = 1 << 21
+	lzma2MaxPacked   = 1 << 16
+	lzma2MaxCopy     = 1 << 16
+	// lzma2PackedMargin is more than a single symbol and a flush of the range
+	// encoder can take, so that an LZMA chunk never exceeds lzma2MaxPacked.
+	lzma2PackedMargin = 64
+)
+
+// Match finder parameters.
+const (
+	hashBits      = 16
+	matchMaxDepth = 24
+	// lazyMaxLen is a match length a lazy evaluation of the next position is
+	// skipped after.
+	lazyMaxLen = 32
+)
+
+type prob uint16
+
+// rangeEncoder is the LZMA range encoder.
+type rangeEncoder struct {
+	low       uint64
+	rng       uint32
+	cache     byte
+	cacheSize int
+	out       []byte
+}
+
+func (e *rangeEncoder) reset() {
+	e.low = 0
+	e.rng = 0xFFFFFFFF
+	e.cache = 0
+	e.cacheSize = 1
+	e.out = e.out[:0]
+}
+
+// pending returns a number of bytes written so far including ones which are
+// not flushed yet.
+func (e *rangeEncoder) pending() int {
+	return len(e.out) + e.cacheSize
+}
+
+func (e *rangeEncoder) encodeBit(p *prob, bit uint32) {
+	bound := (e.rng >> 11) * uint32(*p)
+
+	if bit == 0 {
+		e.rng = bound
+		*p += (1<<11 - *p) >> 5
+	} else {
+		e.low += uint64(bound)
+		e.rng -= bound
+		*p -= *p >> 5
+	}
+
+	for e.rng < 1<<24 {
+		e.rng <<= 8
+		e.shiftLow()
+	}
+}
+
+func (e *rangeEncoder) encodeDirectBits(value uint32, numBits int) {
+	for numBits > 0 {
+		numBits--
+		e.rng >>= 1
+
+		if (value>>numBits)&1 != 0 {
+			e.low += uint64(e.rng)
+		}
+
+		for e.rng < 1<<24 {
+			e.rng <<= 8
+			e.shiftLow()
+		}
+	}
+}
+
+func (e *rangeEncoder) shiftLow() {
+	if uint32(e.low) < 0xFF000000 || e.low>>32 != 0 {
+		carry := byte(e.low >> 32)
+		temp := e.cache
+
+		for {
+			e.out = append(e.out, temp+carry)
+			temp = 0xFF
+
+			if e.cacheSize--; e.cacheSize == 0 {
+				break
+			}
+		}
+
+		e.cache = byte(e.low >> 24)
+	}
+
+	e.cacheSize++
+	e.low = (e.low & 0x00FFFFFF) << 8
+}
+
+func (e *rangeEncoder) flush() {
+	for i := 0; i < 5; i++ {
+		e.shiftLow()
+	}
+}
+
+func (e *rangeEncoder) encodeBitTree(probs []prob, numBits int, symbol uint32) {
+	m := uint32(1)
+
+	for i := numBits - 1; i >= 0; i-- {
+		bit := (symbol >> i) & 1
+		e.encodeBit(&probs[m], bit)
+		m = m<<1 | bit
+	}
+}
+
+func (e *rangeEncoder) encodeReverseBitTree(probs []prob, numBits int, symbol uint32) {
+	m := uint32(1)
+
+	for i := 0; i < numBits; i++ {
+		bit := symbol & 1
+		symbol >>= 1
+		e.encodeBit(&probs[m], bit)
+		m = m<<1 | bit
+	}
+}
+
+type lenEncoder struct {
+	choice  prob
+	choice2 prob
+	low     [1 << lzmaPosBitsMax][1 << 3]prob
+	mid     [1 << lzmaPosBitsMax][1 << 3]prob
+	high    [1 << 8]prob
+}
+
+// encode encodes a match length decreased by lzmaMatchLenMin.
+func (l *lenEncoder) encode(rc *rangeEncoder, length, posState uint32) {
+	switch {
+	case length < 8:
+		rc.encodeBit(&l.choice, 0)
+		rc.encodeBitTree(l.low[posState][:], 3, length)
+	case length < 16:
+		rc.encodeBit(&l.choice, 1)
+		rc.encodeBit(&l.choice2, 0)
+		rc.encodeBitTree(l.mid[posState][:], 3, length-8)
+	default:
+		rc.encodeBit(&l.choice, 1)
+		rc.encodeBit(&l.choice2, 1)
+		rc.encodeBitTree(l.high[:], 8, length-16)
+	}
+}
+
+// lzmaModel is a state of LZMA coding which is reset by an LZMA2 state reset.
+type lzmaModel struct {
+	state uint32
+	// reps are distances of the latest matches decreased by 1.
+	reps [4]uint32
+
+	isMatch    [lzmaNumStates << lzmaPosBitsMax]prob
+	isRep      [lzmaNumStates]prob
+	isRepG0    [lzmaNumStates]prob
+	isRepG1    [lzmaNumStates]prob
+	isRepG2    [lzmaNumStates]prob
+	isRep0Long [lzmaNumStates << lzmaPosBitsMax]prob
+	literal    [0x300 << (lzmaLc + lzmaLp)]prob
+	posSlot    [lzmaNumLenToPosStates][1 << 6]prob
+	posSpecial [1 + lzmaNumFullDistances - lzmaEndPosModelIndex]prob
+	align      [1 << lzmaNumAlignBits]prob
+	lenEnc     lenEncoder
+	repLenEnc  lenEncoder
+}
+
+func (m *lzmaModel) reset() {
+	*m = lzmaModel{}
+
+	for _, probs := range [][]prob{
+		m.isMatch[:], m.isRep[:], m.isRepG0[:], m.isRepG1[:], m.isRepG2[:],
+		m.isRep0Long[:], m.literal[:], m.posSpecial[:], m.align[:],
+	} {
+		initProbs(probs)
+	}
+
+	for i := range m.posSlot {
+		initProbs(m.posSlot[i][:])
+	}
+
+	for _, l := range []*lenEncoder{&m.lenEnc, &m.repLenEnc} {
+		l.choice = lzmaProbInit
+		l.choice2 = lzmaProbInit
+
+		for i := range l.low {
+			initProbs(l.low[i][:])
+			initProbs(l.mid[i][:])
+		}
+
+		initProbs(l.high[:])
+	}
+}
+
+func initProbs(probs []prob) {
+	for i := range probs {
+		probs[i] = lzmaProbInit
+	}
+}
+
+// lzma2Writer compresses data written to it into an LZMA2 stream. Matches are
+// found with hash chains and chosen greedily with a one-step lazy evaluation,
+// which gives a ratio close to the fast modes of other encoders.
+type lzma2Writer struct {
+	w        io.Writer
+	dictSize uint32
+
+	// win is a window of data: history within dictSize before pos and data
+	// which is not encoded yet. winStart is a position of its first byte, and
+	// positions are counted from the beginning of a stream.
+	win      []byte
+	winStart int64
+	pos      int64
+	hashed   int64
+
+	head  []uint32
+	chain []uint32
+
+	model lzmaModel
+	rc    rangeEncoder
+
+	chunks         int
+	propsSet       bool
+	needStateReset bool
+
+	err error
+}
+
+// newLZMA2Writer returns a writer with a dictionary of dictSize which must be a
+// power of 2 (see: lzma2DictProp()).
+func newLZMA2Writer(w io.Writer, dictSize uint32) *lzma2Writer {
+	z := &lzma2Writer{
+		w:        w,
+		dictSize: dictSize,
+		win:      make([]byte, 0, int(dictSize)+2*lzma2MaxUnpacked),
+		head:     make([]uint32, 1<<hashBits),
+		chain:    make([]uint32, dictSize),
+	}
+
+	z.model.reset()
+
+	return z
+}
+
+// lzma2DictProp returns the LZMA2 property byte of a dictionary size which is a
+// power of 2 not less than 4KB.
+func lzma2DictProp(dictSize uint32) byte {
+	return byte(2 * (bits.Len32(dictSize) - 1 - 12))
+}
+
+func (z *lzma2Writer) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+
+	n := len(p)
+
+	for len(p) > 0 {
+		if len(z.win) == cap(z.win) {
+			z.slide()
+		}
+
+		k := copy(z.win[len(z.win):cap(z.win)], p)
+		z.win = z.win[:len(z.win)+k]
+		p = p[k:]
+
+		// A chunk is encoded only when there is enough data for the biggest one.
+		for z.end()-z.pos >= lzma2MaxUnpacked {
+			if z.err = z.writeChunk(false); z.err != nil {
+				return n - len(p), z.err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// Close encodes the rest of data and writes the end of a stream. It does not
+// close the underlying writer.
+func (z *lzma2Writer) Close() error {
+	if z.err != nil {
+		return z.err
+	}
+
+	for z.pos < z.end() {
+		if z.err = z.writeChunk(true); z.err != nil {
+			return z.err
+		}
+	}
+
+	_, z.err = z.w.Write([]byte{0})
+
+	return z.err
+}
+
+func (z *lzma2Writer) end() int64 {
+	return z.winStart + int64(len(z.win))
+}
+
+// slide drops data of the window which is beyond the dictionary.
+func (z *lzma2Writer) slide() {
+	keep := z.pos - int64(z.dictSize)
+	if keep <= z.winStart {
+		return
+	}
+
+	n := copy(z.win, z.win[keep-z.winStart:])
+	z.win = z.win[:n]
+	z.winStart = keep
+}
+
+func (z *lzma2Writer) byteAt(pos int64) byte {
+	return z.win[pos-z.winStart]
+}
+
+// writeChunk encodes data into an LZMA chunk, or stores it in uncompressed chunks
+// if it doesn't compress. A final chunk doesn't wait for data to look ahead.
+func (z *lzma2Writer) writeChunk(final bool) error {
+	start := z.pos
+
+	if z.needStateReset {
+		z.model.reset()
+	}
+
+	z.rc.reset()
+
+	for z.pos-start < lzma2MaxUnpacked-lzmaMatchLenMax && z.rc.pending() < lzma2MaxPacked-lzma2PackedMargin {
+		avail := z.end() - z.pos
+		if avail == 0 || (!final && avail < lzmaMatchLenMax) {
+			break
+		}
+
+		z.encodeNext(avail)
+	}
+
+	z.rc.flush()
+
+	unpacked := int(z.pos - start)
+	if unpacked == 0 {
+		return nil
+	}
+
+	defer func() {
+		z.chunks++
+	}()
+
+	if len(z.rc.out) >= unpacked {
+		return z.writeUncompressed(start, unpacked)
+	}
+
+	var reset byte
+
+	switch {
+	case !z.propsSet && z.chunks == 0:
+		reset = 3
+	case !z.propsSet:
+		reset = 2
+	case z.needStateReset:
+		reset = 1
+	}
+
+	u := unpacked - 1
+	c := len(z.rc.out) - 1
+
+	header := []byte{0x80 | reset<<5 | byte(u>>16), byte(u >> 8), byte(u), byte(c >> 8), byte(c)}
+	if reset >= 2 {
+		header = append(header, lzmaProps)
+	}
+
+	z.propsSet = true
+	z.needStateReset = false
+
+	if _, err := z.w.Write(header); err != nil {
+		return err
+	}
+
+	_, err := z.w.Write(z.rc.out)
+
+	return err
+}
+
+func (z *lzma2Writer) writeUncompressed(start int64, size int) error {
+	// A decoder doesn't know about the LZMA state changed while the chunk was
+	// being encoded.
+	z.needStateReset = true
+
+	for size > 0 {
+		n := size
+		if n > lzma2MaxCopy {
+			n = lzma2MaxCopy
+		}
+
+		control := byte(2)
+		if z.chunks == 0 && start == 0 {
+			// The dictionary is reset by the first chunk of a stream.
+			control = 1
+		}
+
+		header := []byte{control, byte((n - 1) >> 8), byte(n - 1)}
+
+		if _, err := z.w.Write(header); err != nil {
+			return err
+		}
+
+		offset := start - z.winStart
+		if _, err := z.w.Write(z.win[offset : offset+int64(n)]); err != nil {
+			return err
+		}
+
+		start += int64(n)
+		size -= n
+	}
+
+	return nil
+}
+
+// encodeNext encodes a literal or a match at the current position given avail
+// bytes of data left.
+func (z *lzma2Writer) encodeNext(avail int64) {
+	maxLen := int(avail)
+	if maxLen > lzmaMatchLenMax {
+		maxLen = lzmaMatchLenMax
+	}
+
+	if maxLen < lzmaMatchLenMin {
+		z.encodeLiteral()
+
+		return
+	}
+
+	repLen, repIndex := 0, 0
+
+	for i, rep := range z.model.reps {
+		dist := int64(rep) + 1
+		if dist > z.pos {
+			continue
+		}
+
+		if l := z.matchLen(z.pos-dist, z.pos, maxLen); l > repLen {
+			repLen, repIndex = l, i
+		}
+	}
+
+	z.insertUpTo(z.pos)
+	mainLen, mainDist := z.findMatch(z.pos, maxLen)
+
+	// Repeated distances are much cheaper to encode than new ones.
+	if repLen >= lzmaMatchLenMin && (repLen+1 >= mainLen ||
+		(repLen+2 >= mainLen && mainDist > 1<<9) ||
+		(repLen+3 >= mainLen && mainDist > 1<<15)) {
+		z.encodeRep(repIndex, repLen)
+
+		return
+	}
+
+	// A short match of a far distance takes more than literals do.
+	if mainLen < lzmaMatchLenMin || (mainLen == lzmaMatchLenMin && mainDist > 1<<7) {
+		z.encodeLiteral()
+
+		return
+	}
+
+	if mainLen < lazyMaxLen && maxLen > mainLen {
+		z.insertUpTo(z.pos + 1)
+
+		nextLen, _ := z.findMatch(z.pos+1, maxLen-1)
+		if nextLen > mainLen {
+			z.encodeLiteral()
+
+			return
+		}
+	}
+
+	z.encodeMatch(uint32(mainDist-1), mainLen)
+}
+
+func (z *lzma2Writer) posState() uint32 {
+	return uint32(z.pos) & (1<<lzmaPb - 1)
+}
+
+func (z *lzma2Writer) encodeLiteral() {
+	m := &z.model
+	posState := z.posState()
+
+	z.rc.encodeBit(&m.isMatch[m.state<<lzmaPosBitsMax+posState], 0)
+
+	var prevByte byte
+	if z.pos > 0 {
+		prevByte = z.byteAt(z.pos - 1)
+	}
+
+	litState := (uint32(z.pos)&(1<<lzmaLp-1))<<lzmaLc + uint32(prevByte)>>(8-lzmaLc)
+	probs := m.literal[0x300*litState:]
+
+	b := uint32(z.byteAt(z.pos))
+	symbol := uint32(1)
+	i := 7
+
+	// After a match a literal is coded relative to a byte at the last distance.
+	if m.state >= 7 {
+		matchByte := uint32(z.byteAt(z.pos - int64(m.reps[0]) - 1))
+
+		for ; i >= 0; i-- {
+			matchBit := (matchByte >> i) & 1
+			bit := (b >> i) & 1
+
+			z.rc.encodeBit(&probs[(1+matchBit)<<8+symbol], bit)
+			symbol = symbol<<1 | bit
+
+			if matchBit != bit {
+				i--
+
+				break
+			}
+		}
+	}
+
+	for ; i >= 0; i-- {
+		bit := (b >> i) & 1
+
+		z.rc.encodeBit(&probs[symbol], bit)
+		symbol = symbol<<1 | bit
+	}
+
+	switch {
+	case m.state < 4:
+		m.state = 0
+	case m.state < 10:
+		m.state -= 3
+	default:
+		m.state -= 6
+	}
+
+	z.pos++
+}
+
+func (z *lzma2Writer) encodeMatch(dist uint32, length int) {
+	m := &z.model
+	posState := z.posState()
+
+	z.rc.encodeBit(&m.isMatch[m.state<<lzmaPosBitsMax+posState], 1)
+	z.rc.encodeBit(&m.isRep[m.state], 0)
+
+	l := uint32(length - lzmaMatchLenMin)
+	m.lenEnc.encode(&z.rc, l, posState)
+
+	lenState := l
+	if lenState > lzmaNumLenToPosStates-1 {
+		lenState = lzmaNumLenToPosStates - 1
+	}
+
+	slot := posSlot(dist)
+	z.rc.encodeBitTree(m.posSlot[lenState][:], 6, slot)
+
+	if slot >= 4 {
+		footerBits := int(slot>>1) - 1
+		base := (2 | slot&1) << footerBits
+		reduced := dist - base
+
+		if slot < lzmaEndPosModelIndex {
+			z.rc.encodeReverseBitTree(m.posSpecial[base-slot:], footerBits, reduced)
+		} else {
+			z.rc.encodeDirectBits(reduced>>lzmaNumAlignBits, footerBits-lzmaNumAlignBits)
+			z.rc.encodeReverseBitTree(m.align[:], lzmaNumAlignBits, reduced&(1<<lzmaNumAlignBits-1))
+		}
+	}
+
+	m.reps[3], m.reps[2], m.reps[1], m.reps[0] = m.reps[2], m.reps[1], m.reps[0], dist
+
+	if m.state < 7 {
+		m.state = 7
+	} else {
+		m.state = 10
+	}
+
+	z.pos += int64(length)
+}
+
+func (z *lzma2Writer) encodeRep(index, length int) {
+	m := &z.model
+	posState := z.posState()
+
+	z.rc.encodeBit(&m.isMatch[m.state<<lzmaPosBitsMax+posState], 1)
+	z.rc.encodeBit(&m.isRep[m.state], 1)
+
+	if index == 0 {
+		z.rc.encodeBit(&m.isRepG0[m.state], 0)
+		z.rc.encodeBit(&m.isRep0Long[m.state<<lzmaPosBitsMax+posState], 1)
+	} else {
+		z.rc.encodeBit(&m.isRepG0[m.state], 1)
+
+		dist := m.reps[index]
+
+		if index == 1 {
+			z.rc.encodeBit(&m.isRepG1[m.state], 0)
+		} else {
+			z.rc.encodeBit(&m.isRepG1[m.state], 1)
+			z.rc.encodeBit(&m.isRepG2[m.state], uint32(index-2))
+
+			if index == 3 {
+				m.reps[3] = m.reps[2]
+			}
+
+			m.reps[2] = m.reps[1]
+		}
+
+		m.reps[1] = m.reps[0]
+		m.reps[0] = dist
+	}
+
+	m.repLenEnc.encode(&z.rc, uint32(length-lzmaMatchLenMin), posState)
+
+	if m.state < 7 {
+		m.state = 8
+	} else {
+		m.state = 11
+	}
+
+	z.pos += int64(length)
+}
+
+func posSlot(dist uint32) uint32 {
+	if dist < 4 {
+		return dist
+	}
+
+	n := uint32(bits.Len32(dist)) - 1
+
+	return 2*n + (dist>>(n-1))&1
+}
+
+func (z *lzma2Writer) hash(pos int64) uint32 {
+	i := pos - z.winStart
+	v := uint32(z.win[i]) | uint32(z.win[i+1])<<8 | uint32(z.win[i+2])<<16
+
+	return (v * 2654435761) >> (32 - hashBits)
+}
+
+// insertUpTo adds positions before limit to hash chains. Positions which don't
+// have 3 bytes of data yet are added once more data comes.
+func (z *lzma2Writer) insertUpTo(limit int64) {
+	for ; z.hashed < limit && z.hashed+3 <= z.end(); z.hashed++ {
+		h := z.hash(z.hashed)
+		z.chain[uint32(z.hashed)&(z.dictSize-1)] = z.head[h]
+		z.head[h] = uint32(z.hashed) + 1
+	}
+}
+
+// findMatch returns the longest match at pos found in hash chains and its
+// distance. Positions before pos must be added to hash chains.
+func (z *lzma2Writer) findMatch(pos int64, maxLen int) (int, int64) {
+	if maxLen < 3 || pos+3 > z.end() {
+		return 0, 0
+	}
+
+	bestLen, bestDist := 0, int64(0)
+
+	v := z.head[z.hash(pos)]
+
+	for depth := 0; v != 0 && depth < matchMaxDepth; depth++ {
+		// Positions are kept modulo 2^32, which is fine since a candidate is
+		// verified against data anyway.
+		dist := int64(uint32(pos) - (v - 1))
+		if dist == 0 || dist > int64(z.dictSize) || pos-dist < z.winStart {
+			break
+		}
+
+		cand := pos - dist
+
+		if z.byteAt(cand+int64(bestLen)) == z.byteAt(pos+int64(bestLen)) {
+			if l := z.matchLen(cand, pos, maxLen); l > bestLen {
+				bestLen, bestDist = l, dist
+
+				if l == maxLen {
+					break
+				}
+			}
+		}
+
+		v = z.chain[uint32(cand)&(z.dictSize-1)]
+	}
+
+	return bestLen, bestDist
+}
+
+func (z *lzma2Writer) matchLen(from, pos int64, maxLen int) int {
+	a := z.win[from-z.winStart:]
+	b := z.win[pos-z.winStart:]
+
+	if len(b) < maxLen {
+		maxLen = len(b)
+	}
+
+	n := 0
+	for n < maxLen && a[n] == b[n] {
+		n++
+	}
+
+	return n
+}
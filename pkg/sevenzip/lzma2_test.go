@@ -0,0 +1,605 @@
+package sevenzip
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os/exec"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// rangeDecoder is the LZMA range decoder.
+type rangeDecoder struct {
+	b    []byte
+	rng  uint32
+	code uint32
+	err  error
+}
+
+func newRangeDecoder(b []byte) (*rangeDecoder, error) {
+	if len(b) < 5 || b[0] != 0 {
+		return nil, errors.New("bad start of range coding")
+	}
+
+	d := &rangeDecoder{b: b[5:], rng: 0xFFFFFFFF}
+
+	for _, c := range b[1:5] {
+		d.code = d.code<<8 | uint32(c)
+	}
+
+	return d, nil
+}
+
+func (d *rangeDecoder) normalize() {
+	if d.rng >= 1<<24 {
+		return
+	}
+
+	if len(d.b) == 0 {
+		d.err = errors.New("range coding is out of data")
+
+		return
+	}
+
+	d.rng <<= 8
+	d.code = d.code<<8 | uint32(d.b[0])
+	d.b = d.b[1:]
+}
+
+func (d *rangeDecoder) bit(p *prob) uint32 {
+	bound := (d.rng >> 11) * uint32(*p)
+
+	var bit uint32
+
+	if d.code < bound {
+		d.rng = bound
+		*p += (1<<11 - *p) >> 5
+	} else {
+		d.code -= bound
+		d.rng -= bound
+		*p -= *p >> 5
+		bit = 1
+	}
+
+	d.normalize()
+
+	return bit
+}
+
+func (d *rangeDecoder) directBits(n int) uint32 {
+	var v uint32
+
+	for ; n > 0; n-- {
+		d.rng >>= 1
+		v <<= 1
+
+		if d.code >= d.rng {
+			d.code -= d.rng
+			v |= 1
+		}
+
+		d.normalize()
+	}
+
+	return v
+}
+
+func (d *rangeDecoder) bitTree(probs []prob, n int) uint32 {
+	m := uint32(1)
+
+	for i := 0; i < n; i++ {
+		m = m<<1 | d.bit(&probs[m])
+	}
+
+	return m - 1<<n
+}
+
+func (d *rangeDecoder) reverseBitTree(probs []prob, n int) uint32 {
+	m, v := uint32(1), uint32(0)
+
+	for i := 0; i < n; i++ {
+		bit := d.bit(&probs[m])
+		m = m<<1 | bit
+		v |= bit << i
+	}
+
+	return v
+}
+
+type lenDecoder struct {
+	choice, choice2 prob
+	low, mid        [16][8]prob
+	high            [256]prob
+}
+
+func (l *lenDecoder) decode(d *rangeDecoder, posState uint32) uint32 {
+	if d.bit(&l.choice) == 0 {
+		return d.bitTree(l.low[posState][:], 3)
+	}
+
+	if d.bit(&l.choice2) == 0 {
+		return 8 + d.bitTree(l.mid[posState][:], 3)
+	}
+
+	return 16 + d.bitTree(l.high[:], 8)
+}
+
+// lzmaDecoder is a state of LZMA decoding kept across LZMA2 chunks. It's laid
+// out as the LZMA SDK does, independently of the encoder.
+type lzmaDecoder struct {
+	lc, lp, pb int
+
+	state uint32
+	reps  [4]uint32
+
+	isMatch    [12][16]prob
+	isRep      [12]prob
+	isRepG0    [12]prob
+	isRepG1    [12]prob
+	isRepG2    [12]prob
+	isRep0Long [12][16]prob
+	literal    []prob
+	posSlot    [4][64]prob
+	// posSpecial are 114 probabilities of reverse bit trees of distance
+	// slots, which are indexed from 1 as other bit trees are.
+	posSpecial [1 + 114]prob
+	align      [16]prob
+	lenDec     lenDecoder
+	repLenDec  lenDecoder
+}
+
+func (l *lzmaDecoder) resetState() {
+	lc, lp, pb := l.lc, l.lp, l.pb
+	*l = lzmaDecoder{lc: lc, lp: lp, pb: pb, literal: make([]prob, 0x300<<(lc+lp))}
+
+	var probs [][]prob
+
+	for i := 0; i < 12; i++ {
+		probs = append(probs, l.isMatch[i][:], l.isRep0Long[i][:])
+	}
+
+	for i := 0; i < 4; i++ {
+		probs = append(probs, l.posSlot[i][:])
+	}
+
+	for _, ld := range []*lenDecoder{&l.lenDec, &l.repLenDec} {
+		probs = append(probs, []prob{}, ld.high[:])
+		ld.choice, ld.choice2 = 1<<10, 1<<10
+
+		for i := 0; i < 16; i++ {
+			probs = append(probs, ld.low[i][:], ld.mid[i][:])
+		}
+	}
+
+	probs = append(probs, l.isRep[:], l.isRepG0[:], l.isRepG1[:], l.isRepG2[:], l.literal, l.posSpecial[:], l.align[:])
+
+	for _, p := range probs {
+		for i := range p {
+			p[i] = 1 << 10
+		}
+	}
+}
+
+func (l *lzmaDecoder) setProps(b byte) error {
+	if b >= 9*5*5 {
+		return errors.New("bad LZMA properties")
+	}
+
+	l.lc, l.lp, l.pb = int(b%9), int(b/9%5), int(b/45)
+
+	if l.lc+l.lp > 4 {
+		return errors.New("lc + lp of LZMA2 exceed 4")
+	}
+
+	return nil
+}
+
+// decodeChunk decodes size bytes to out. Positions are counted from dictStart,
+// which matches don't reach before, nor farther than dictSize.
+func (l *lzmaDecoder) decodeChunk(d *rangeDecoder, out []byte, dictStart, dictSize, size int) ([]byte, error) {
+	end := len(out) + size
+
+	history := func() int {
+		if n := len(out) - dictStart; n < dictSize {
+			return n
+		}
+
+		return dictSize
+	}
+
+	for len(out) < end && d.err == nil {
+		pos := uint32(len(out) - dictStart)
+		posState := pos & (1<<l.pb - 1)
+
+		if d.bit(&l.isMatch[l.state][posState]) == 0 {
+			var prev uint32
+			if len(out) > dictStart {
+				prev = uint32(out[len(out)-1])
+			}
+
+			litState := (pos&(1<<l.lp-1))<<l.lc + prev>>(8-l.lc)
+			probs := l.literal[0x300*litState:]
+			symbol := uint32(1)
+
+			if l.state >= 7 {
+				matchByte := uint32(out[len(out)-int(l.reps[0])-1])
+
+				for symbol < 0x100 {
+					matchBit := matchByte >> 7 & 1
+					matchByte <<= 1
+
+					bit := d.bit(&probs[(1+matchBit)<<8+symbol])
+					symbol = symbol<<1 | bit
+
+					if bit != matchBit {
+						break
+					}
+				}
+			}
+
+			for symbol < 0x100 {
+				symbol = symbol<<1 | d.bit(&probs[symbol])
+			}
+
+			out = append(out, byte(symbol))
+
+			switch {
+			case l.state < 4:
+				l.state = 0
+			case l.state < 10:
+				l.state -= 3
+			default:
+				l.state -= 6
+			}
+
+			continue
+		}
+
+		var length uint32
+
+		if d.bit(&l.isRep[l.state]) == 0 {
+			length = l.lenDec.decode(d, posState)
+
+			lenState := length
+			if lenState > 3 {
+				lenState = 3
+			}
+
+			dist := d.bitTree(l.posSlot[lenState][:], 6)
+
+			if slot := dist; slot >= 4 {
+				footerBits := int(slot>>1) - 1
+				dist = (2 | slot&1) << footerBits
+
+				if slot < 14 {
+					dist += d.reverseBitTree(l.posSpecial[dist-slot:], footerBits)
+				} else {
+					dist += d.directBits(footerBits-4) << 4
+					dist += d.reverseBitTree(l.align[:], 4)
+				}
+			}
+
+			l.reps[3], l.reps[2], l.reps[1], l.reps[0] = l.reps[2], l.reps[1], l.reps[0], dist
+
+			if l.state < 7 {
+				l.state = 7
+			} else {
+				l.state = 10
+			}
+		} else {
+			if d.bit(&l.isRepG0[l.state]) == 0 {
+				if d.bit(&l.isRep0Long[l.state][posState]) == 0 {
+					if l.state < 7 {
+						l.state = 9
+					} else {
+						l.state = 11
+					}
+
+					if int(l.reps[0]) >= history() {
+						return nil, errors.New("short rep is beyond the dictionary")
+					}
+
+					out = append(out, out[len(out)-int(l.reps[0])-1])
+
+					continue
+				}
+			} else {
+				var dist uint32
+
+				if d.bit(&l.isRepG1[l.state]) == 0 {
+					dist = l.reps[1]
+				} else {
+					if d.bit(&l.isRepG2[l.state]) == 0 {
+						dist = l.reps[2]
+					} else {
+						dist = l.reps[3]
+						l.reps[3] = l.reps[2]
+					}
+
+					l.reps[2] = l.reps[1]
+				}
+
+				l.reps[1] = l.reps[0]
+				l.reps[0] = dist
+			}
+
+			length = l.repLenDec.decode(d, posState)
+
+			if l.state < 7 {
+				l.state = 8
+			} else {
+				l.state = 11
+			}
+		}
+
+		n := int(length) + 2
+		dist := int(l.reps[0]) + 1
+
+		if dist > history() {
+			return nil, errors.Errorf("distance %d is beyond %d bytes of the dictionary", dist, history())
+		}
+
+		if len(out)+n > end {
+			return nil, errors.New("match exceeds a chunk")
+		}
+
+		for i := 0; i < n; i++ {
+			out = append(out, out[len(out)-dist])
+		}
+	}
+
+	return out, d.err
+}
+
+// decodeLZMA2 decodes an LZMA2 stream as the xz file format specification
+// tells, and checks that distances are within the dictionary and that the
+// stream is followed by nothing.
+func decodeLZMA2(b []byte, dictSize int) ([]byte, error) {
+	var (
+		out       []byte
+		dictStart int
+		l         lzmaDecoder
+		propsSet  bool
+	)
+
+	for first := true; ; first = false {
+		if len(b) == 0 {
+			return nil, errors.New("no end of a stream")
+		}
+
+		control := b[0]
+
+		switch {
+		case control == 0:
+			if len(b) != 1 {
+				return nil, errors.Errorf("%d bytes after a stream", len(b)-1)
+			}
+
+			return out, nil
+		case control == 1 || control == 2:
+			if len(b) < 3 {
+				return nil, errors.New("truncated chunk header")
+			}
+
+			if control == 1 {
+				dictStart = len(out)
+			} else if first {
+				return nil, errors.New("no dictionary reset by the first chunk")
+			}
+
+			n := (int(b[1])<<8 | int(b[2])) + 1
+			if len(b) < 3+n {
+				return nil, errors.New("truncated uncompressed chunk")
+			}
+
+			out = append(out, b[3:3+n]...)
+			b = b[3+n:]
+		case control >= 0x80:
+			if len(b) < 5 {
+				return nil, errors.New("truncated chunk header")
+			}
+
+			unpacked := (int(control&0x1F)<<16 | int(b[1])<<8 | int(b[2])) + 1
+			packed := (int(b[3])<<8 | int(b[4])) + 1
+			reset := control >> 5 & 3
+			b = b[5:]
+
+			if first && reset != 3 {
+				return nil, errors.New("no dictionary reset by the first chunk")
+			}
+
+			if reset == 3 {
+				dictStart = len(out)
+			}
+
+			if reset >= 2 {
+				if err := l.setProps(b[0]); err != nil {
+					return nil, err
+				}
+
+				propsSet = true
+				b = b[1:]
+			}
+
+			if !propsSet {
+				return nil, errors.New("no properties of LZMA")
+			}
+
+			if reset >= 1 {
+				l.resetState()
+			}
+
+			if len(b) < packed {
+				return nil, errors.New("truncated LZMA chunk")
+			}
+
+			d, err := newRangeDecoder(b[:packed])
+			if err != nil {
+				return nil, err
+			}
+
+			if out, err = l.decodeChunk(d, out, dictStart, dictSize, unpacked); err != nil {
+				return nil, err
+			}
+
+			if len(d.b) != 0 {
+				return nil, errors.Errorf("%d bytes left of an LZMA chunk", len(d.b))
+			}
+
+			b = b[packed:]
+		default:
+			return nil, errors.Errorf("bad chunk control %#x", control)
+		}
+	}
+}
+
+func compressLZMA2(t *testing.T, data []byte, dictSize uint32, writeSize int) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+
+	z := newLZMA2Writer(&b, dictSize)
+
+	for p := data; len(p) > 0; {
+		n := writeSize
+		if n > len(p) {
+			n = len(p)
+		}
+
+		if _, err := z.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+
+		p = p[n:]
+	}
+
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+// text returns n bytes of lines of words, which are compressed by matches.
+func text(n int, seed int64) []byte {
+	words := []string{"backup", "peer", "archive", "stream", "version", "chunk", "signal", "restore"}
+	r := rand.New(rand.NewSource(seed))
+
+	var b bytes.Buffer
+
+	for b.Len() < n {
+		fmt.Fprintf(&b, "%s %s %d\n", words[r.Intn(len(words))], words[r.Intn(len(words))], r.Intn(1000))
+	}
+
+	return b.Bytes()[:n]
+}
+
+func random(n int, seed int64) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+
+	return b
+}
+
+// lzma2Inputs are inputs of round trips: empty ones, ones at boundaries of
+// chunks, incompressible ones, ones mixing both, and ones repeated farther than
+// a dictionary of 64KB reaches.
+func lzma2Inputs() map[string][]byte {
+	mixed := append(text(lzma2MaxUnpacked, 1), random(lzma2MaxPacked+1, 1)...)
+	mixed = append(mixed, text(100<<10, 2)...)
+
+	far := random(100<<10, 2)
+	far = append(far, far...)
+
+	return map[string][]byte{
+		"empty":               {},
+		"single byte":         {42},
+		"text of a chunk":     text(lzma2MaxUnpacked, 3),
+		"text of a chunk + 1": text(lzma2MaxUnpacked+1, 4),
+		"text of 5 chunks":    text(5*lzma2MaxUnpacked, 5),
+		"random":              random(3*lzma2MaxCopy+1, 3),
+		"zeros":               make([]byte, 3*lzma2MaxUnpacked),
+		"mixed":               mixed,
+		"repeated far":        far,
+	}
+}
+
+// TestLZMA2RoundTrip compresses inputs with a dictionary which matches reach
+// beyond and, unless in short mode, with the one of files.
+func TestLZMA2RoundTrip(t *testing.T) {
+	dictSizes := []uint32{1 << 16}
+	if !testing.Short() {
+		dictSizes = append(dictSizes, dataDictSize)
+	}
+
+	for _, dictSize := range dictSizes {
+		for name, data := range lzma2Inputs() {
+			for _, writeSize := range []int{len(data), 10000} {
+				if writeSize == 0 {
+					continue
+				}
+
+				decoded, err := decodeLZMA2(compressLZMA2(t, data, dictSize, writeSize), int(dictSize))
+				if err != nil {
+					t.Fatalf("%s, dictionary of %d bytes: %v", name, dictSize, err)
+				}
+
+				if !bytes.Equal(decoded, data) {
+					t.Fatalf("%s, dictionary of %d bytes: decoded data mismatch", name, dictSize)
+				}
+			}
+		}
+	}
+}
+
+// TestLZMA2Ratio checks that compressible data is compressed and that
+// incompressible one takes hardly more than it does.
+func TestLZMA2Ratio(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		data []byte
+		max  int
+	}{
+		{"text", text(1<<20, 6), 256 << 10},
+		{"random", random(1<<20, 5), 1<<20 + 256},
+		{"zeros", make([]byte, 1<<20), 1024},
+	} {
+		if n := len(compressLZMA2(t, tt.data, dataDictSize, len(tt.data))); n > tt.max {
+			t.Errorf("%s: %d bytes compressed into %d, %d at most expected", tt.name, len(tt.data), n, tt.max)
+		}
+	}
+}
+
+func TestLZMA2DictProp(t *testing.T) {
+	for _, dictSize := range []uint32{1 << 12, 1 << 16, headerDictSize, dataDictSize, 1 << 30} {
+		p := lzma2DictProp(dictSize)
+
+		if decoded := uint32(2|p&1) << (p/2 + 11); decoded != dictSize {
+			t.Errorf("property %d of a dictionary of %d bytes tells %d bytes", p, dictSize, decoded)
+		}
+	}
+}
+
+// TestLZMA2DecodedByXZ decodes streams with xz if it's installed.
+func TestLZMA2DecodedByXZ(t *testing.T) {
+	path, err := exec.LookPath("xz")
+	if err != nil {
+		t.Skip("xz isn't installed")
+	}
+
+	for name, data := range lzma2Inputs() {
+		cmd := exec.Command(path, "--decompress", "--format=raw", "--lzma2=dict=64KiB", "--stdout")
+		cmd.Stdin = bytes.NewReader(compressLZMA2(t, data, 1<<16, len(data)+1))
+
+		decoded, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if !bytes.Equal(decoded, data) {
+			t.Fatalf("%s: decoded data mismatch", name)
+		}
+	}
+}
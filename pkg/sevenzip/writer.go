@@ -0,0 +1,615 @@
+// Package sevenzip writes 7z archives. Files are compressed with LZMA2 into a
+// single solid block, which is encrypted with AES-256 along with a header
+// listing the files if a password is given. Archives are readable by 7-Zip, p7zip
+// and other tools supporting the format.
+package sevenzip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// dataDictSize is a dictionary size of file content, which takes about 6
+	// times as much memory to compress.
+	dataDictSize   = 1 << 22
+	headerDictSize = 1 << 20
+
+	startHeaderLen = 32
+)
+
+var signature = []byte{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C, 0, 4}
+
+// Property IDs of a header.
+const (
+	idEnd              = 0x00
+	idHeader           = 0x01
+	idMainStreamsInfo  = 0x04
+	idFilesInfo        = 0x05
+	idPackInfo         = 0x06
+	idUnpackInfo       = 0x07
+	idSubStreamsInfo   = 0x08
+	idSize             = 0x09
+	idCRC              = 0x0A
+	idFolder           = 0x0B
+	idCodersUnpackSize = 0x0C
+	idNumUnpackStream  = 0x0D
+	idEmptyStream      = 0x0E
+	idEmptyFile        = 0x0F
+	idName             = 0x11
+	idMTime            = 0x14
+	idWinAttributes    = 0x15
+	idEncodedHeader    = 0x17
+)
+
+var (
+	methodLZMA2 = []byte{0x21}
+	methodAES   = []byte{0x06, 0xF1, 0x07, 0x01}
+)
+
+// Windows file attributes, the high 16 bits keep a Unix mode when
+// attrUnixExtension is set.
+const (
+	attrDirectory     = 0x10
+	attrArchive       = 0x20
+	attrUnixExtension = 0x8000
+
+	unixModeDir     = 0o040000
+	unixModeRegular = 0o100000
+	unixModeSymlink = 0o120000
+)
+
+// filetimeEpochShift is a number of 100ns intervals between 1601-01-01, which
+// FILETIME is counted from, and the Unix epoch.
+const filetimeEpochShift = 116444736000000000
+
+var errClosed = errors.New("7z: writer is closed")
+
+// FileHeader describes a file in an archive. A name ending in a slash is a
+// directory, which has no content. A file with fs.ModeSymlink in its mode is a
+// symbolic link, whose content is a target of it.
+type FileHeader struct {
+	Name     string
+	Modified time.Time
+	Mode     fs.FileMode
+}
+
+type file struct {
+	name     string
+	modified time.Time
+	attrib   uint32
+	dir      bool
+	size     uint64
+	crc      uint32
+}
+
+// folder is a chain of coders a solid block is written through, it is known as
+// a folder in the 7z format.
+type folder struct {
+	lzma2 *lzma2Writer
+	aes   *aesWriter
+	// lzma2Size is a size of an LZMA2 stream, which is encrypted into a packed
+	// stream with padding.
+	lzma2Size *countingWriter
+	packed    *countingWriter
+
+	unpackSize uint64
+	crc        uint32
+}
+
+// Writer writes files of an archive one by one. An archive refers to its header
+// at the end of a file from the beginning of it, so it is written to a seekable
+// stream.
+type Writer struct {
+	w   io.WriteSeeker
+	buf *bufio.Writer
+	pos *countingWriter
+
+	key []byte
+
+	files  []*file
+	folder *folder
+	cur    *fileWriter
+
+	closed bool
+}
+
+// NewWriter returns a writer of an archive encrypted with the password unless
+// it is empty.
+func NewWriter(w io.WriteSeeker, password string) (*Writer, error) {
+	sw := &Writer{
+		w:   w,
+		buf: bufio.NewWriterSize(w, 64<<10),
+	}
+
+	sw.pos = &countingWriter{w: sw.buf}
+
+	if len(password) != 0 {
+		sw.key = deriveKey(password)
+	}
+
+	// The start header is written once the rest of an archive is.
+	if _, err := sw.pos.Write(make([]byte, startHeaderLen)); err != nil {
+		return nil, err
+	}
+
+	return sw, nil
+}
+
+// Create adds a file to an archive and returns a writer its content should be
+// written to before the next call of Create or Close.
+func (w *Writer) Create(fh *FileHeader) (io.Writer, error) {
+	if w.closed {
+		return nil, errClosed
+	}
+
+	w.finishFile()
+
+	f := &file{
+		name:     strings.TrimSuffix(fh.Name, "/"),
+		modified: fh.Modified,
+		dir:      strings.HasSuffix(fh.Name, "/"),
+	}
+
+	if len(f.name) == 0 {
+		return nil, errors.New("7z: empty file name")
+	}
+
+	perm := uint32(fh.Mode.Perm())
+
+	switch {
+	case f.dir:
+		f.attrib = attrDirectory | attrUnixExtension | (unixModeDir|perm)<<16
+	case fh.Mode&fs.ModeSymlink != 0:
+		f.attrib = attrArchive | attrUnixExtension | (unixModeSymlink|perm)<<16
+	default:
+		f.attrib = attrArchive | attrUnixExtension | (unixModeRegular|perm)<<16
+	}
+
+	w.files = append(w.files, f)
+
+	w.cur = &fileWriter{
+		w:   w,
+		f:   f,
+		crc: crc32.NewIEEE(),
+	}
+
+	return w.cur, nil
+}
+
+func (w *Writer) finishFile() {
+	if w.cur == nil {
+		return
+	}
+
+	w.cur.f.crc = w.cur.crc.Sum32()
+	w.cur.closed = true
+	w.cur = nil
+}
+
+// Close writes the header of an archive. It does not close the underlying
+// writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return errClosed
+	}
+
+	w.finishFile()
+	w.closed = true
+
+	var packSize uint64
+
+	if w.folder != nil {
+		if err := w.folder.close(); err != nil {
+			return err
+		}
+
+		packSize = w.folder.packed.n
+	}
+
+	header := w.header()
+
+	if w.key != nil {
+		encoded, err := w.encodeHeader(header, packSize)
+		if err != nil {
+			return err
+		}
+
+		header = encoded
+	}
+
+	offset := w.pos.n - startHeaderLen
+
+	if _, err := w.pos.Write(header); err != nil {
+		return err
+	}
+
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+
+	start := make([]byte, startHeaderLen)
+	copy(start, signature)
+	binary.LittleEndian.PutUint64(start[12:], offset)
+	binary.LittleEndian.PutUint64(start[20:], uint64(len(header)))
+	binary.LittleEndian.PutUint32(start[28:], crc32.ChecksumIEEE(header))
+	binary.LittleEndian.PutUint32(start[8:], crc32.ChecksumIEEE(start[12:]))
+
+	if _, err := w.w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if _, err := w.w.Write(start); err != nil {
+		return err
+	}
+
+	_, err := w.w.Seek(0, io.SeekEnd)
+
+	return err
+}
+
+// newFolder starts a solid block at the current position of an archive.
+func (w *Writer) newFolder(dictSize uint32) (*folder, error) {
+	f := &folder{
+		packed: &countingWriter{w: w.pos},
+	}
+
+	var out io.Writer = f.packed
+
+	if w.key != nil {
+		a, err := newAESWriter(f.packed, w.key)
+		if err != nil {
+			return nil, err
+		}
+
+		f.aes = a
+		out = a
+	}
+
+	f.lzma2Size = &countingWriter{w: out}
+	f.lzma2 = newLZMA2Writer(f.lzma2Size, dictSize)
+
+	return f, nil
+}
+
+func (f *folder) Write(p []byte) (int, error) {
+	f.unpackSize += uint64(len(p))
+	f.crc = crc32.Update(f.crc, crc32.IEEETable, p)
+
+	return f.lzma2.Write(p)
+}
+
+func (f *folder) close() error {
+	if err := f.lzma2.Close(); err != nil {
+		return err
+	}
+
+	if f.aes != nil {
+		return f.aes.Close()
+	}
+
+	return nil
+}
+
+// writeCoders writes a description of coders of a folder. Coders are listed in
+// the order of decoding: AES decrypts a packed stream into an input of LZMA2.
+func (f *folder) writeCoders(b *headerBuffer) {
+	if f.aes == nil {
+		b.writeNumber(1)
+		b.writeCoder(methodLZMA2, []byte{lzma2DictProp(f.lzma2.dictSize)})
+
+		return
+	}
+
+	b.writeNumber(2)
+	b.writeCoder(methodAES, f.aes.props())
+	b.writeCoder(methodLZMA2, []byte{lzma2DictProp(f.lzma2.dictSize)})
+
+	// The input of LZMA2 (stream 1) is bound to the output of AES (stream 0).
+	b.writeNumber(1)
+	b.writeNumber(0)
+}
+
+func (f *folder) writeUnpackSizes(b *headerBuffer) {
+	if f.aes != nil {
+		b.writeNumber(f.lzma2Size.n)
+	}
+
+	b.writeNumber(f.unpackSize)
+}
+
+// writeStreamsInfo writes a description of a single packed stream at packPos
+// decoded by a folder.
+func (f *folder) writeStreamsInfo(b *headerBuffer, packPos uint64, crc bool) {
+	b.WriteByte(idPackInfo)
+	b.writeNumber(packPos)
+	b.writeNumber(1)
+	b.WriteByte(idSize)
+	b.writeNumber(f.packed.n)
+	b.WriteByte(idEnd)
+
+	b.WriteByte(idUnpackInfo)
+	b.WriteByte(idFolder)
+	b.writeNumber(1)
+	b.WriteByte(0)
+	f.writeCoders(b)
+	b.WriteByte(idCodersUnpackSize)
+	f.writeUnpackSizes(b)
+
+	if crc {
+		b.WriteByte(idCRC)
+		b.WriteByte(1)
+		b.writeUint32(f.crc)
+	}
+
+	b.WriteByte(idEnd)
+}
+
+func (w *Writer) header() []byte {
+	b := &headerBuffer{}
+
+	b.WriteByte(idHeader)
+
+	if w.folder != nil {
+		b.WriteByte(idMainStreamsInfo)
+		w.folder.writeStreamsInfo(b, 0, false)
+		w.writeSubStreamsInfo(b)
+		b.WriteByte(idEnd)
+	}
+
+	if len(w.files) != 0 {
+		w.writeFilesInfo(b)
+	}
+
+	b.WriteByte(idEnd)
+
+	return b.Bytes()
+}
+
+// writeSubStreamsInfo writes sizes and checksums of files sharing a solid block.
+func (w *Writer) writeSubStreamsInfo(b *headerBuffer) {
+	var streams []*file
+
+	for _, f := range w.files {
+		if f.size != 0 {
+			streams = append(streams, f)
+		}
+	}
+
+	b.WriteByte(idSubStreamsInfo)
+
+	if len(streams) != 1 {
+		b.WriteByte(idNumUnpackStream)
+		b.writeNumber(uint64(len(streams)))
+	}
+
+	if len(streams) > 1 {
+		// The size of the last one is the rest of the block.
+		b.WriteByte(idSize)
+
+		for _, f := range streams[:len(streams)-1] {
+			b.writeNumber(f.size)
+		}
+	}
+
+	b.WriteByte(idCRC)
+	b.WriteByte(1)
+
+	for _, f := range streams {
+		b.writeUint32(f.crc)
+	}
+
+	b.WriteByte(idEnd)
+}
+
+func (w *Writer) writeFilesInfo(b *headerBuffer) {
+	b.WriteByte(idFilesInfo)
+	b.writeNumber(uint64(len(w.files)))
+
+	var (
+		emptyStreams, emptyFiles []bool
+		anyEmptyFile             bool
+	)
+
+	// Files which are empty have no streams, and ones of them which aren't
+	// directories are marked with another bit field.
+	for _, f := range w.files {
+		empty := f.size == 0
+		emptyStreams = append(emptyStreams, empty)
+
+		if empty {
+			emptyFiles = append(emptyFiles, !f.dir)
+			anyEmptyFile = anyEmptyFile || !f.dir
+		}
+	}
+
+	if len(emptyFiles) != 0 {
+		b.writeProperty(idEmptyStream, bitField(emptyStreams))
+	}
+
+	if anyEmptyFile {
+		b.writeProperty(idEmptyFile, bitField(emptyFiles))
+	}
+
+	names := &headerBuffer{}
+	names.WriteByte(0)
+
+	for _, f := range w.files {
+		names.Write(utf16le(f.name))
+		names.Write([]byte{0, 0})
+	}
+
+	b.writeProperty(idName, names.Bytes())
+
+	times := &headerBuffer{}
+	times.Write([]byte{1, 0})
+
+	for _, f := range w.files {
+		times.writeUint64(uint64(f.modified.UnixNano()/100 + filetimeEpochShift))
+	}
+
+	b.writeProperty(idMTime, times.Bytes())
+
+	attribs := &headerBuffer{}
+	attribs.Write([]byte{1, 0})
+
+	for _, f := range w.files {
+		attribs.writeUint32(f.attrib)
+	}
+
+	b.writeProperty(idWinAttributes, attribs.Bytes())
+
+	b.WriteByte(idEnd)
+}
+
+// encodeHeader compresses and encrypts a header following packed data of files,
+// so that names of files aren't disclosed either.
+func (w *Writer) encodeHeader(header []byte, packPos uint64) ([]byte, error) {
+	f, err := w.newFolder(headerDictSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Write(header); err != nil {
+		return nil, err
+	}
+
+	if err := f.close(); err != nil {
+		return nil, err
+	}
+
+	b := &headerBuffer{}
+
+	b.WriteByte(idEncodedHeader)
+	f.writeStreamsInfo(b, packPos, true)
+	b.WriteByte(idEnd)
+
+	return b.Bytes(), nil
+}
+
+// fileWriter writes content of a file into a solid block.
+type fileWriter struct {
+	w      *Writer
+	f      *file
+	crc    hash.Hash32
+	closed bool
+}
+
+func (fw *fileWriter) Write(p []byte) (int, error) {
+	if fw.closed {
+		return 0, errors.New("7z: write to a file which is closed")
+	}
+
+	if fw.f.dir {
+		return 0, errors.New("7z: write to a directory")
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	w := fw.w
+
+	if w.folder == nil {
+		f, err := w.newFolder(dataDictSize)
+		if err != nil {
+			return 0, err
+		}
+
+		w.folder = f
+	}
+
+	n, err := w.folder.Write(p)
+	fw.f.size += uint64(n)
+	fw.crc.Write(p[:n])
+
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += uint64(n)
+
+	return n, err
+}
+
+type headerBuffer struct {
+	bytes.Buffer
+}
+
+// writeNumber writes a number in the variable length encoding of the format:
+// leading ones of the first byte tell a number of bytes following it.
+func (b *headerBuffer) writeNumber(v uint64) {
+	var (
+		first byte
+		mask  byte = 0x80
+		i     int
+	)
+
+	for i = 0; i < 8; i++ {
+		if v < 1<<(7*(i+1)) {
+			first |= byte(v >> (8 * i))
+
+			break
+		}
+
+		first |= mask
+		mask >>= 1
+	}
+
+	b.WriteByte(first)
+
+	for ; i > 0; i-- {
+		b.WriteByte(byte(v))
+		v >>= 8
+	}
+}
+
+func (b *headerBuffer) writeUint32(v uint32) {
+	b.Write(binary.LittleEndian.AppendUint32(nil, v))
+}
+
+func (b *headerBuffer) writeUint64(v uint64) {
+	b.Write(binary.LittleEndian.AppendUint64(nil, v))
+}
+
+// writeCoder writes a simple coder, which has a single input and output stream.
+func (b *headerBuffer) writeCoder(method, props []byte) {
+	b.WriteByte(byte(len(method)) | 0x20)
+	b.Write(method)
+	b.writeNumber(uint64(len(props)))
+	b.Write(props)
+}
+
+func (b *headerBuffer) writeProperty(id byte, data []byte) {
+	b.WriteByte(id)
+	b.writeNumber(uint64(len(data)))
+	b.Write(data)
+}
+
+// bitField packs bits starting with the most significant one of a byte.
+func bitField(v []bool) []byte {
+	field := make([]byte, (len(v)+7)/8)
+
+	for i, bit := range v {
+		if bit {
+			field[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+
+	return field
+}
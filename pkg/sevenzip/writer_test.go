@@ -0,0 +1,677 @@
+package sevenzip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+)
+
+// archivedFile is a file read from an archive.
+type archivedFile struct {
+	name     string
+	dir      bool
+	modified time.Time
+	attrib   uint32
+	data     []byte
+}
+
+// headerReader reads properties of a header.
+type headerReader struct {
+	b   []byte
+	err error
+}
+
+func (r *headerReader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.b) {
+		r.err = errors.New("truncated header")
+
+		return make([]byte, n&0xFFFF)
+	}
+
+	b := r.b[:n]
+	r.b = r.b[n:]
+
+	return b
+}
+
+func (r *headerReader) byte() byte {
+	return r.bytes(1)[0]
+}
+
+func (r *headerReader) expect(id byte) {
+	if b := r.byte(); r.err == nil && b != id {
+		r.err = errors.Errorf("property %#x, %#x expected", b, id)
+	}
+}
+
+// number reads a number of the variable length encoding: leading ones of the
+// first byte tell a number of bytes following it.
+func (r *headerReader) number() uint64 {
+	first := r.byte()
+
+	var v uint64
+
+	for i, mask := 0, byte(0x80); i < 8; i, mask = i+1, mask>>1 {
+		if first&mask == 0 {
+			return v | uint64(first&(mask-1))<<(8*i)
+		}
+
+		v |= uint64(r.byte()) << (8 * i)
+	}
+
+	return v
+}
+
+func (r *headerReader) int() int {
+	n := r.number()
+	if n > 1<<30 {
+		r.err = errors.New("number is too big")
+	}
+
+	return int(n)
+}
+
+func (r *headerReader) uint32() uint32 {
+	return binary.LittleEndian.Uint32(r.bytes(4))
+}
+
+func (r *headerReader) bits(n int) []bool {
+	field := r.bytes((n + 7) / 8)
+	v := make([]bool, n)
+
+	for i := range v {
+		v[i] = field[i/8]&(0x80>>(i%8)) != 0
+	}
+
+	return v
+}
+
+// testFolder is a solid block of a single packed stream decoded by LZMA2,
+// decrypted by AES before that if there are 2 coders.
+type testFolder struct {
+	packPos    uint64
+	packSize   uint64
+	aesProps   []byte
+	dictProp   byte
+	unpackSize []uint64
+	crc        *uint32
+}
+
+func (r *headerReader) streamsInfo() *testFolder {
+	f := &testFolder{}
+
+	r.expect(idPackInfo)
+	f.packPos = r.number()
+
+	if n := r.number(); n != 1 {
+		r.err = errors.Errorf("%d packed streams", n)
+	}
+
+	r.expect(idSize)
+	f.packSize = r.number()
+	r.expect(idEnd)
+
+	r.expect(idUnpackInfo)
+	r.expect(idFolder)
+
+	if n := r.number(); n != 1 {
+		r.err = errors.Errorf("%d folders", n)
+	}
+
+	r.expect(0)
+
+	coders := r.int()
+	if r.err == nil && coders != 1 && coders != 2 {
+		r.err = errors.Errorf("%d coders", coders)
+	}
+
+	for i := 0; i < coders && r.err == nil; i++ {
+		flags := r.byte()
+		if flags&0x10 != 0 || flags&0x20 == 0 {
+			r.err = errors.Errorf("coder flags %#x", flags)
+		}
+
+		method := r.bytes(int(flags & 0x0F))
+		props := r.bytes(r.int())
+
+		switch {
+		case bytes.Equal(method, methodAES) && i == 0 && coders == 2:
+			f.aesProps = props
+		case bytes.Equal(method, methodLZMA2) && i == coders-1 && len(props) == 1:
+			f.dictProp = props[0]
+		default:
+			r.err = errors.Errorf("coder %x of %d", method, i)
+		}
+	}
+
+	if coders == 2 {
+		// The input of LZMA2 is the output of AES.
+		if in, out := r.number(), r.number(); in != 1 || out != 0 {
+			r.err = errors.Errorf("bind pair %d-%d", in, out)
+		}
+	}
+
+	r.expect(idCodersUnpackSize)
+
+	for i := 0; i < coders; i++ {
+		f.unpackSize = append(f.unpackSize, r.number())
+	}
+
+	if id := r.byte(); id == idCRC {
+		r.expect(1)
+
+		crc := r.uint32()
+		f.crc = &crc
+
+		r.expect(idEnd)
+	} else if r.err == nil && id != idEnd {
+		r.err = errors.Errorf("property %#x of unpack info", id)
+	}
+
+	return f
+}
+
+// decode decodes a folder of an archive with a password.
+func (f *testFolder) decode(archive []byte, password string) ([]byte, error) {
+	start := startHeaderLen + f.packPos
+	if start+f.packSize > uint64(len(archive)) {
+		return nil, errors.New("packed stream is beyond an archive")
+	}
+
+	data := archive[start : start+f.packSize]
+
+	if f.aesProps != nil {
+		key, iv, err := aesKey(f.aesProps, password)
+		if err != nil {
+			return nil, err
+		}
+
+		if data, err = decryptAES(key, iv, data); err != nil {
+			return nil, err
+		}
+
+		if f.unpackSize[0] > uint64(len(data)) {
+			return nil, errors.New("decrypted stream is shorter than its size")
+		}
+
+		data = data[:f.unpackSize[0]]
+	}
+
+	if f.dictProp > 40 {
+		return nil, errors.Errorf("dictionary property %d", f.dictProp)
+	}
+
+	data, err := decodeLZMA2(data, int(2|f.dictProp&1)<<(f.dictProp/2+11))
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(data)) != f.unpackSize[len(f.unpackSize)-1] {
+		return nil, errors.Errorf("%d bytes are decoded, %d expected", len(data), f.unpackSize[len(f.unpackSize)-1])
+	}
+
+	if f.crc != nil && crc32.ChecksumIEEE(data) != *f.crc {
+		return nil, errors.New("CRC of a folder mismatch")
+	}
+
+	return data, nil
+}
+
+// readArchive reads files of an archive, checking CRCs of the start header, of
+// the header and of files.
+func readArchive(archive []byte, password string) ([]archivedFile, error) {
+	if len(archive) < startHeaderLen || !bytes.Equal(archive[:len(signature)], signature) {
+		return nil, errors.New("no signature")
+	}
+
+	if crc32.ChecksumIEEE(archive[12:startHeaderLen]) != binary.LittleEndian.Uint32(archive[8:]) {
+		return nil, errors.New("CRC of the start header mismatch")
+	}
+
+	offset := binary.LittleEndian.Uint64(archive[12:])
+	size := binary.LittleEndian.Uint64(archive[20:])
+
+	if startHeaderLen+offset+size != uint64(len(archive)) {
+		return nil, errors.New("header isn't at the end of an archive")
+	}
+
+	header := archive[startHeaderLen+offset:]
+
+	if crc32.ChecksumIEEE(header) != binary.LittleEndian.Uint32(archive[28:]) {
+		return nil, errors.New("CRC of the header mismatch")
+	}
+
+	r := &headerReader{b: header}
+
+	if header[0] == idEncodedHeader {
+		r.byte()
+		f := r.streamsInfo()
+		r.expect(idEnd)
+
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		if f.crc == nil {
+			return nil, errors.New("no CRC of an encoded header")
+		}
+
+		decoded, err := f.decode(archive, password)
+		if err != nil {
+			return nil, errors.Wrap(err, "encoded header")
+		}
+
+		r = &headerReader{b: decoded}
+	} else if password != "" {
+		return nil, errors.New("header isn't encrypted")
+	}
+
+	r.expect(idHeader)
+
+	var (
+		data  []byte
+		sizes []uint64
+		crcs  []uint32
+	)
+
+	if r.b[0] == idMainStreamsInfo {
+		r.byte()
+
+		f := r.streamsInfo()
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		if (f.aesProps != nil) != (password != "") {
+			return nil, errors.New("files aren't encrypted as expected")
+		}
+
+		var err error
+		if data, err = f.decode(archive, password); err != nil {
+			return nil, errors.Wrap(err, "files")
+		}
+
+		r.expect(idSubStreamsInfo)
+
+		streams := 1
+		if r.b[0] == idNumUnpackStream {
+			r.byte()
+			streams = r.int()
+		}
+
+		var total uint64
+
+		if streams > 1 {
+			r.expect(idSize)
+
+			for i := 0; i < streams-1; i++ {
+				sizes = append(sizes, r.number())
+				total += sizes[i]
+			}
+		}
+
+		if total > uint64(len(data)) {
+			return nil, errors.New("sizes of files exceed a folder")
+		}
+
+		sizes = append(sizes, uint64(len(data))-total)
+
+		r.expect(idCRC)
+		r.expect(1)
+
+		for i := 0; i < streams; i++ {
+			crcs = append(crcs, r.uint32())
+		}
+
+		r.expect(idEnd)
+		r.expect(idEnd)
+	}
+
+	var files []archivedFile
+
+	if r.b[0] == idFilesInfo {
+		r.byte()
+
+		n := r.int()
+		files = make([]archivedFile, n)
+		emptyStreams := make([]bool, n)
+
+		var emptyFiles []bool
+
+		for r.err == nil {
+			id := r.byte()
+			if id == idEnd {
+				break
+			}
+
+			p := &headerReader{b: r.bytes(r.int())}
+
+			switch id {
+			case idEmptyStream:
+				emptyStreams = p.bits(n)
+			case idEmptyFile:
+				empty := 0
+				for _, e := range emptyStreams {
+					if e {
+						empty++
+					}
+				}
+
+				emptyFiles = p.bits(empty)
+			case idName:
+				p.expect(0)
+
+				var name []uint16
+
+				for i := 0; len(p.b) > 1 && i < n; {
+					c := binary.LittleEndian.Uint16(p.bytes(2))
+					if c != 0 {
+						name = append(name, c)
+
+						continue
+					}
+
+					files[i].name = string(utf16.Decode(name))
+					name = nil
+					i++
+				}
+			case idMTime:
+				p.expect(1)
+				p.expect(0)
+
+				for i := range files {
+					t := int64(binary.LittleEndian.Uint64(p.bytes(8))) - filetimeEpochShift
+					files[i].modified = time.Unix(0, t*100)
+				}
+			case idWinAttributes:
+				p.expect(1)
+				p.expect(0)
+
+				for i := range files {
+					files[i].attrib = p.uint32()
+				}
+			}
+
+			if r.err == nil {
+				r.err = p.err
+			}
+		}
+
+		empty := 0
+
+		for i := range files {
+			if !emptyStreams[i] {
+				if len(sizes) == 0 {
+					return nil, errors.New("more files than streams")
+				}
+
+				files[i].data = data[:sizes[0]]
+				data, sizes = data[sizes[0]:], sizes[1:]
+
+				if crc32.ChecksumIEEE(files[i].data) != crcs[0] {
+					return nil, errors.Errorf("CRC of %s mismatch", files[i].name)
+				}
+
+				crcs = crcs[1:]
+
+				continue
+			}
+
+			files[i].dir = empty >= len(emptyFiles) || !emptyFiles[empty]
+			empty++
+		}
+
+		if len(sizes) != 0 {
+			return nil, errors.New("more streams than files")
+		}
+	}
+
+	r.expect(idEnd)
+
+	if r.err == nil && len(r.b) != 0 {
+		r.err = errors.Errorf("%d bytes after a header", len(r.b))
+	}
+
+	return files, r.err
+}
+
+// testEntry is a file written to an archive.
+type testEntry struct {
+	name string
+	mode fs.FileMode
+	data []byte
+}
+
+// testEntries are files of every kind: directories, empty files, a symbolic
+// link, a file of non-ASCII name, and files of contents which are compressed,
+// incompressible and bigger than a chunk of LZMA2.
+func testEntries() []testEntry {
+	return []testEntry{
+		{"dir/", 0o755, nil},
+		{"dir/empty", 0o600, nil},
+		{"dir/text.txt", 0o644, text(10<<10, 1)},
+		{"dir/link", fs.ModeSymlink | 0o777, []byte("text.txt")},
+		{"dir/sub/", 0o700, nil},
+		{"dir/sub/random.bin", 0o640, random(100<<10, 1)},
+		{"dir/sub/файл.txt", 0o644, []byte("content")},
+		{"big.txt", 0o644, text(3*lzma2MaxUnpacked+7, 2)},
+		{"empty", 0o644, nil},
+	}
+}
+
+func writeArchive(t *testing.T, password string, entries []testEntry, modified time.Time) []byte {
+	t.Helper()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "test.7z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w, err := NewWriter(f, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range entries {
+		fw, err := w.Create(&FileHeader{Name: e.name, Modified: modified, Mode: e.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := io.Copy(fw, bytes.NewReader(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return archive
+}
+
+func checkArchive(t *testing.T, archive []byte, password string, entries []testEntry, modified time.Time) {
+	t.Helper()
+
+	files, err := readArchive(archive, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != len(entries) {
+		t.Fatalf("%d files are read, %d expected", len(files), len(entries))
+	}
+
+	for i, e := range entries {
+		f := files[i]
+
+		var (
+			name   = e.name
+			dir    = name[len(name)-1] == '/'
+			attrib uint32
+		)
+
+		switch {
+		case dir:
+			name = name[:len(name)-1]
+			attrib = attrDirectory | attrUnixExtension | (unixModeDir|uint32(e.mode.Perm()))<<16
+		case e.mode&fs.ModeSymlink != 0:
+			attrib = attrArchive | attrUnixExtension | (unixModeSymlink|uint32(e.mode.Perm()))<<16
+		default:
+			attrib = attrArchive | attrUnixExtension | (unixModeRegular|uint32(e.mode.Perm()))<<16
+		}
+
+		if f.name != name || f.dir != dir || f.attrib != attrib {
+			t.Errorf("file %q (directory %t, attributes %#x) is read, %q (%t, %#x) expected", f.name, f.dir, f.attrib, name, dir, attrib)
+		}
+
+		if !f.modified.Equal(modified) {
+			t.Errorf("%s: modification time %v, %v expected", name, f.modified, modified)
+		}
+
+		if !bytes.Equal(f.data, e.data) {
+			t.Errorf("%s: content mismatch", name)
+		}
+	}
+}
+
+// TestWriter writes an archive with files of every kind and reads it back.
+func TestWriter(t *testing.T) {
+	modified := time.Date(2024, 2, 29, 13, 14, 15, 123456700, time.UTC)
+	entries := testEntries()
+
+	checkArchive(t, writeArchive(t, "", entries, modified), "", entries, modified)
+}
+
+// TestWriterEncrypted writes an archive with a password and checks that the
+// header is encrypted, that names of files aren't disclosed, and that the
+// archive isn't read with another password.
+func TestWriterEncrypted(t *testing.T) {
+	const password = "correct horse battery staple"
+
+	modified := time.Date(2024, 2, 29, 13, 14, 15, 0, time.UTC)
+	entries := testEntries()
+
+	archive := writeArchive(t, password, entries, modified)
+
+	checkArchive(t, archive, password, entries, modified)
+
+	offset := binary.LittleEndian.Uint64(archive[12:])
+	if archive[startHeaderLen+offset] != idEncodedHeader {
+		t.Error("header isn't encoded")
+	}
+
+	for _, e := range entries {
+		if bytes.Contains(archive, utf16le(strings.TrimSuffix(e.name, "/"))) {
+			t.Errorf("name %q is disclosed", e.name)
+		}
+	}
+
+	if _, err := readArchive(archive, "wrong password"); err == nil {
+		t.Error("archive is read with a wrong password")
+	}
+}
+
+// TestWriterWithoutContent writes archives with no files at all and with no
+// content of files, which have no folders.
+func TestWriterWithoutContent(t *testing.T) {
+	modified := time.Date(2001, 9, 9, 1, 46, 40, 0, time.UTC)
+
+	for _, entries := range [][]testEntry{
+		nil,
+		{{"dir/", 0o755, nil}, {"dir/empty", 0o644, nil}},
+	} {
+		for _, password := range []string{"", "password"} {
+			checkArchive(t, writeArchive(t, password, entries, modified), password, entries, modified)
+		}
+	}
+}
+
+// TestWriterSingleFile writes an archive with a single file, which has no
+// number of streams in its header.
+func TestWriterSingleFile(t *testing.T) {
+	modified := time.Date(2001, 9, 9, 1, 46, 40, 0, time.UTC)
+	entries := []testEntry{{"file", 0o644, []byte("content")}}
+
+	checkArchive(t, writeArchive(t, "", entries, modified), "", entries, modified)
+}
+
+func TestWriterRefusesMisuse(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "test.7z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w, err := NewWriter(f, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Create(&FileHeader{Name: "/"}); err == nil {
+		t.Error("file of an empty name is created")
+	}
+
+	dir, err := w.Create(&FileHeader{Name: "dir/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dir.Write([]byte("content")); err == nil {
+		t.Error("content of a directory is written")
+	}
+
+	first, err := w.Create(&FileHeader{Name: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Create(&FileHeader{Name: "second"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := first.Write([]byte("content")); err == nil {
+		t.Error("content of a previous file is written")
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Create(&FileHeader{Name: "third"}); !errors.Is(err, errClosed) {
+		t.Errorf("file is created in a closed archive: %v", err)
+	}
+
+	if err := w.Close(); !errors.Is(err, errClosed) {
+		t.Errorf("closed archive is closed again: %v", err)
+	}
+}
+
+func TestNumber(t *testing.T) {
+	for _, v := range []uint64{0, 1, 0x7F, 0x80, 0x3FFF, 0x4000, 1<<21 - 1, 1 << 21, 1<<56 - 1, 1 << 56, 1<<64 - 1} {
+		b := &headerBuffer{}
+		b.writeNumber(v)
+
+		r := &headerReader{b: b.Bytes()}
+
+		if got := r.number(); got != v || r.err != nil || len(r.b) != 0 {
+			t.Errorf("%#x is read as %#x of %d bytes (%v)", v, got, b.Len(), r.err)
+		}
+	}
+}
@@ -23,31 +23,48 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"distributed-backup/pkg/log"
-	"distributed-backup/pkg/sync"
 
 	"github.com/pkg/errors"
 )
 
+const defaultFileIoRequestInterval = 2500 * time.Millisecond
+
 type FileIo struct {
 	cfg FileIoConfig
+	log log.Logger
 
-	requestMx sync.UnlockDelayMutex
+	client *httpClient
 
 	sdpHandler       func([]byte)
 	candidateHandler func([]byte)
+	natHandler       func([]byte)
+	messages         messageHandlers
 }
 
 type FileIoConfig struct {
 	APIKey     string
 	SessionID  string
 	InstanceID string
+	// RequestInterval is a period FILE.io requests are made every at most, default
+	// is defaultFileIoRequestInterval. RequestBurst is a number of requests which
+	// can be made at once, default is 1.
+	RequestInterval time.Duration
+	RequestBurst    int
+	// RequestTimeout bounds a single attempt of a request, default is 30 seconds.
+	RequestTimeout time.Duration
+	// Proxy is a proxy requests are made through, proxy environment variables
+	// are used if nil.
+	Proxy *url.URL
+	// Log is a logger entries are written with (e.g. with session fields attached),
+	// the global logger is used if nil.
+	Log log.Logger
 }
 
 func NewFileIo(cfg FileIoConfig) (*FileIo, error) {
@@ -63,10 +80,32 @@ func NewFileIo(cfg FileIoConfig) (*FileIo, error) {
 		return nil, errors.New("instance ID is empty")
 	}
 
+	if cfg.Log == nil {
+		cfg.Log = log.New()
+	}
+
+	if cfg.RequestInterval == 0 {
+		cfg.RequestInterval = defaultFileIoRequestInterval
+	}
+
 	return &FileIo{
-		cfg:              cfg,
+		cfg: cfg,
+		log: cfg.Log,
+		client: newHTTPClient(httpClientConfig{
+			Backend: "fileio",
+			BaseURL: "https://file.io",
+			Headers: http.Header{
+				"Authorization": []string{cfg.APIKey},
+			},
+			Timeout:         cfg.RequestTimeout,
+			RequestInterval: cfg.RequestInterval,
+			RequestBurst:    cfg.RequestBurst,
+			Proxy:           cfg.Proxy,
+			Log:             cfg.Log,
+		}),
 		sdpHandler:       func([]byte) {},
 		candidateHandler: func([]byte) {},
+		natHandler:       func([]byte) {},
 	}, nil
 }
 
@@ -78,25 +117,31 @@ OUTER:
 	for {
 		select {
 		case <-ticker.C:
-			if err := s.sniffCandidates(); err != nil {
-				log.Error(err)
+			if err := s.sniffCandidates(ctx); err != nil && ctx.Err() == nil {
+				s.log.Error(err)
 			}
 		case <-ctx.Done():
 			break OUTER
 		}
 	}
 
-	s.cleanUp()
+	// Files are cleaned up after ctx is done.
+	cleanUpCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	s.cleanUp(cleanUpCtx)
 }
 
 func (s *FileIo) Ping() error {
-	files, err := s.findPing()
+	ctx := context.Background()
+
+	files, err := s.findPing(ctx)
 	if err != nil {
 		return err
 	}
 
 	if len(files.Nodes) == 0 {
-		if err := s.uploadPing(); err != nil {
+		if err := s.uploadPing(ctx); err != nil {
 			return err
 		}
 
@@ -104,8 +149,8 @@ func (s *FileIo) Ping() error {
 	}
 
 	for _, node := range files.Nodes {
-		if err := s.deleteFile(node.Key); err != nil {
-			log.Error(err)
+		if err := s.deleteFile(ctx, node.Key); err != nil {
+			s.log.Error(err)
 		}
 	}
 
@@ -113,11 +158,17 @@ func (s *FileIo) Ping() error {
 }
 
 func (s *FileIo) SendSDP(payload []byte) error {
-	return s.uploadSDP(payload)
+	return s.uploadSDP(context.Background(), payload)
 }
 
 func (s *FileIo) SendCandidate(payload []byte) error {
-	return s.uploadCandidate(payload)
+	return s.uploadCandidate(context.Background(), payload)
+}
+
+// SendNAT tells the other peer a NAT type of this one, it's uploaded before
+// negotiation and is kept until the other peer downloads it.
+func (s *FileIo) SendNAT(payload []byte) error {
+	return s.uploadNAT(context.Background(), payload)
 }
 
 func (s *FileIo) OnSDP(h func([]byte)) {
@@ -128,6 +179,35 @@ func (s *FileIo) OnCandidate(h func([]byte)) {
 	s.candidateHandler = h
 }
 
+func (s *FileIo) OnNAT(h func([]byte)) {
+	s.natHandler = h
+}
+
+// Send sends the other peer a typed message of type typ (see:
+// peer.MessageSignal), it's delivered as SDP is.
+func (s *FileIo) Send(typ string, payload []byte) error {
+	ct, err := messageContentType(typ)
+	if err != nil {
+		return err
+	}
+
+	return s.uploadMessage(context.Background(), ct, payload)
+}
+
+func (s *FileIo) On(typ string, h func([]byte)) {
+	s.messages.on(typ, h)
+}
+
+// CheckAuth makes a request requiring authorization to make sure APIKey is
+// accepted by FILE.io without uploading anything.
+func (s *FileIo) CheckAuth() error {
+	ctx := context.Background()
+
+	_, err := s.findFiles(ctx, s.cfg.SessionID)
+
+	return err
+}
+
 type fileIoFiles struct {
 	Nodes []struct {
 		Key  string `json:"key"`
@@ -146,10 +226,11 @@ const (
 	fileIoFileContentTypePing      fileIoFileContentType = "ping"
 	fileIoFileContentTypeSDP                             = "sdp"
 	fileIoFileContentTypeCandidate                       = "candidate"
+	fileIoFileContentTypeNAT                             = "nat"
 )
 
-func (s *FileIo) sniffCandidates() error {
-	files, err := s.findFiles(s.cfg.SessionID)
+func (s *FileIo) sniffCandidates(ctx context.Context) error {
+	files, err := s.findFiles(ctx, s.cfg.SessionID)
 	if err != nil {
 		return err
 	}
@@ -159,80 +240,130 @@ func (s *FileIo) sniffCandidates() error {
 			continue
 		}
 
-		content, err := s.downloadFile(node.Key)
+		content, err := s.downloadFile(ctx, node.Key)
 		if err != nil {
-			log.Error(err)
+			s.log.Error(err)
 
 			continue
 		}
 
+		s.log.WithFields(log.Fields{
+			log.FieldType:    content.Type,
+			log.FieldPayload: string(content.Payload),
+		}).Trace("signaling message received")
+
 		switch content.Type {
 		case fileIoFileContentTypeSDP:
 			s.sdpHandler(content.Payload)
 		case fileIoFileContentTypeCandidate:
 			s.candidateHandler(content.Payload)
+		case fileIoFileContentTypeNAT:
+			s.natHandler(content.Payload)
 		default:
-			break
+			s.messages.dispatch(content.Type, content.Payload)
 		}
 	}
 
 	return nil
 }
 
-func (s *FileIo) cleanUp() {
-	log.Info("cleaning up unused signaling files...")
+func (s *FileIo) cleanUp(ctx context.Context) {
+	s.log.Info("cleaning up unused signaling files...")
 
-	files, err := s.findFiles(s.cfg.SessionID)
+	files, err := s.findFiles(ctx, s.cfg.SessionID)
 	if err != nil {
-		log.Error(err)
+		s.log.Error(err)
+
+		return
 	}
 
 	for _, node := range files.Nodes {
-		if err := s.deleteFile(node.Key); err != nil {
-			log.Error(err)
+		if err := s.deleteFile(ctx, node.Key); err != nil {
+			s.log.Error(err)
 		}
 	}
 }
 
-func (s *FileIo) findPing() (*fileIoFiles, error) {
+// CleanUpInstance deletes files uploaded with InstanceID within a session, e.g.
+// left by a previous run that was killed before cleaning up.
+func (s *FileIo) CleanUpInstance() error {
+	ctx := context.Background()
+
+	files, err := s.findFiles(ctx, s.cfg.SessionID)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range files.Nodes {
+		if !strings.Contains(node.Name, s.cfg.InstanceID) {
+			continue
+		}
+
+		if err := s.deleteFile(ctx, node.Key); err != nil {
+			s.log.Error(err)
+		}
+	}
+
+	return nil
+}
+
+func (s *FileIo) findPing(ctx context.Context) (*fileIoFiles, error) {
 	pattern := fmt.Sprintf("%s_%s", s.cfg.SessionID, fileIoFileContentTypePing)
 
-	return s.findFiles(pattern)
+	return s.findFiles(ctx, pattern)
 }
 
-func (s *FileIo) uploadPing() error {
+func (s *FileIo) uploadPing(ctx context.Context) error {
 	filename := fmt.Sprintf("%s_%s_%s.json", s.cfg.SessionID, fileIoFileContentTypePing, s.cfg.InstanceID)
 
-	return s.uploadFile(filename, &fileIoFileContent{
+	return s.uploadFile(ctx, filename, &fileIoFileContent{
 		Type: fileIoFileContentTypePing,
 	})
 }
 
-func (s *FileIo) uploadSDP(payload []byte) error {
+func (s *FileIo) uploadSDP(ctx context.Context, payload []byte) error {
 	filename := fmt.Sprintf("%s_%s_%s.json", s.cfg.SessionID, fileIoFileContentTypeSDP, s.cfg.InstanceID)
 
-	return s.uploadFile(filename, &fileIoFileContent{
+	return s.uploadFile(ctx, filename, &fileIoFileContent{
 		Type:    fileIoFileContentTypeSDP,
 		Payload: payload,
 	})
 }
 
-func (s *FileIo) uploadCandidate(payload []byte) error {
+func (s *FileIo) uploadCandidate(ctx context.Context, payload []byte) error {
 	filename := fmt.Sprintf("%s_%s_%s.json", s.cfg.SessionID, fileIoFileContentTypeCandidate, s.cfg.InstanceID)
 
-	return s.uploadFile(filename, &fileIoFileContent{
+	return s.uploadFile(ctx, filename, &fileIoFileContent{
 		Type:    fileIoFileContentTypeCandidate,
 		Payload: payload,
 	})
 }
 
-func (s *FileIo) findFiles(pattern string) (*fileIoFiles, error) {
+func (s *FileIo) uploadNAT(ctx context.Context, payload []byte) error {
+	filename := fmt.Sprintf("%s_%s_%s.json", s.cfg.SessionID, fileIoFileContentTypeNAT, s.cfg.InstanceID)
+
+	return s.uploadFile(ctx, filename, &fileIoFileContent{
+		Type:    fileIoFileContentTypeNAT,
+		Payload: payload,
+	})
+}
+
+func (s *FileIo) uploadMessage(ctx context.Context, typ fileIoFileContentType, payload []byte) error {
+	filename := fmt.Sprintf("%s_%s_%s.json", s.cfg.SessionID, typ, s.cfg.InstanceID)
+
+	return s.uploadFile(ctx, filename, &fileIoFileContent{
+		Type:    typ,
+		Payload: payload,
+	})
+}
+
+func (s *FileIo) findFiles(ctx context.Context, pattern string) (*fileIoFiles, error) {
 	urn := fmt.Sprintf("/?search=%s&sort=created:asc", pattern)
 	headers := http.Header{
 		"Accept": []string{"application/json"},
 	}
 
-	resp, err := s.request(http.MethodGet, urn, headers, nil)
+	resp, err := s.request(ctx, http.MethodGet, urn, headers, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -250,13 +381,13 @@ func (s *FileIo) findFiles(pattern string) (*fileIoFiles, error) {
 	return files, nil
 }
 
-func (s *FileIo) downloadFile(fileKey string) (*fileIoFileContent, error) {
+func (s *FileIo) downloadFile(ctx context.Context, fileKey string) (*fileIoFileContent, error) {
 	urn := fmt.Sprintf("/%s", fileKey)
 	headers := http.Header{
 		"Accept": []string{"*/*"},
 	}
 
-	resp, err := s.request(http.MethodGet, urn, headers, nil)
+	resp, err := s.request(ctx, http.MethodGet, urn, headers, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -275,13 +406,13 @@ func (s *FileIo) downloadFile(fileKey string) (*fileIoFileContent, error) {
 	return content, nil
 }
 
-func (s *FileIo) deleteFile(fileKey string) error {
+func (s *FileIo) deleteFile(ctx context.Context, fileKey string) error {
 	urn := fmt.Sprintf("/%s", fileKey)
 	headers := http.Header{
 		"Accept": []string{"application/json"},
 	}
 
-	resp, err := s.request(http.MethodDelete, urn, headers, nil)
+	resp, err := s.request(ctx, http.MethodDelete, urn, headers, nil)
 	if err != nil {
 		return err
 	}
@@ -294,7 +425,7 @@ func (s *FileIo) deleteFile(fileKey string) error {
 	return nil
 }
 
-func (s *FileIo) uploadFile(name string, content *fileIoFileContent) error {
+func (s *FileIo) uploadFile(ctx context.Context, name string, content *fileIoFileContent) error {
 	buf := bytes.Buffer{}
 	w := multipart.NewWriter(&buf)
 
@@ -335,7 +466,7 @@ func (s *FileIo) uploadFile(name string, content *fileIoFileContent) error {
 		"Content-Type": []string{"multipart/form-data; boundary=" + boundary},
 	}
 
-	resp, err := s.request(http.MethodPost, "/", headers, &buf)
+	resp, err := s.request(ctx, http.MethodPost, "/", headers, buf.Bytes())
 	if err != nil {
 		return err
 	}
@@ -348,43 +479,6 @@ func (s *FileIo) uploadFile(name string, content *fileIoFileContent) error {
 	return nil
 }
 
-func (s *FileIo) request(method, urn string, headers http.Header, body io.Reader) (resp *http.Response, err error) {
-	const url = "https://file.io"
-
-	req, err := http.NewRequest(method, url+urn, body)
-	if err != nil {
-		return nil, err
-	}
-
-	for k, values := range headers {
-		for _, v := range values {
-			req.Header.Add(k, v)
-		}
-	}
-
-	req.Header.Add("Authorization", s.cfg.APIKey)
-
-	// Requests' frequency limitation.
-	s.requestMx.Lock()
-	defer s.requestMx.DelayUnlock(2500 * time.Millisecond)
-
-	for {
-		resp, err = http.DefaultClient.Do(req)
-		if err != nil {
-			return nil, err
-		}
-
-		if resp.StatusCode == http.StatusTooManyRequests {
-			log.Info("too many requests, retrying...")
-
-			// Requests' frequency reduction.
-			time.Sleep(7500 * time.Millisecond)
-
-			continue
-		}
-
-		break
-	}
-
-	return resp, err
+func (s *FileIo) request(ctx context.Context, method, urn string, headers http.Header, body []byte) (*http.Response, error) {
+	return s.client.Do(ctx, method, urn, headers, body)
 }
@@ -0,0 +1,231 @@
+package signal
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/metrics"
+	"distributed-backup/pkg/proxy"
+	"distributed-backup/pkg/sync"
+)
+
+const (
+	defaultHTTPTimeout    = 30 * time.Second
+	defaultHTTPMaxRetries = 3
+	// defaultHTTPRetryAfter is a delay requests are paused for after a server
+	// responds with the Too Many Requests status without the Retry-After header.
+	defaultHTTPRetryAfter = 7500 * time.Millisecond
+
+	httpBackoffMin = 1 * time.Second
+	httpBackoffMax = 30 * time.Second
+)
+
+// httpClient is an HTTP client shared by HTTP-based signaling backends. Requests
+// are rate limited, bounded by a timeout, retried with an exponential backoff on
+// transient failures and counted in metrics tagged with a backend name.
+type httpClient struct {
+	cfg httpClientConfig
+
+	client  *http.Client
+	limiter *sync.RateLimiter
+}
+
+type httpClientConfig struct {
+	// Backend is a backend name metrics are tagged with.
+	Backend string
+	BaseURL string
+	// Headers are added to every request (e.g. Authorization).
+	Headers http.Header
+	// Timeout bounds a single attempt of a request, default is defaultHTTPTimeout.
+	Timeout time.Duration
+	// MaxRetries is a number of retries of a failed request, default is
+	// defaultHTTPMaxRetries, a negative value disables retries.
+	MaxRetries int
+	// RequestInterval and RequestBurst configure a rate limiter (see:
+	// sync.RateLimiterConfig).
+	RequestInterval time.Duration
+	RequestBurst    int
+	// RetryAfter is a delay requests are paused for after the Too Many Requests
+	// status without the Retry-After header, default is defaultHTTPRetryAfter.
+	RetryAfter time.Duration
+	// Proxy is a proxy requests are made through, proxy environment variables
+	// are used if nil.
+	Proxy *url.URL
+	Log   log.Logger
+}
+
+func newHTTPClient(cfg httpClientConfig) *httpClient {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultHTTPTimeout
+	}
+
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = defaultHTTPMaxRetries
+	}
+
+	if cfg.RetryAfter == 0 {
+		cfg.RetryAfter = defaultHTTPRetryAfter
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy.HTTPProxy(cfg.Proxy),
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          16,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	return &httpClient{
+		cfg: cfg,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.Timeout,
+		},
+		limiter: sync.NewRateLimiter(sync.RateLimiterConfig{
+			Interval: cfg.RequestInterval,
+			Burst:    cfg.RequestBurst,
+		}),
+	}
+}
+
+// Do makes a request to a path relative to BaseURL. A response is returned with
+// any status except Too Many Requests ones which are retried, and so are 5xx
+// ones and network errors of idempotent requests.
+func (c *httpClient) Do(ctx context.Context, method, path string, headers http.Header, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := c.do(ctx, method, path, headers, body)
+
+		retryable := false
+
+		switch {
+		case err != nil:
+			retryable = isIdempotent(method) && ctx.Err() == nil
+		case resp.StatusCode == http.StatusTooManyRequests:
+			resp.Body.Close()
+
+			c.cfg.Log.Info("too many requests, retrying...")
+
+			// Requests' frequency reduction as the server asks, which doesn't
+			// count as a retry since a request has not been processed.
+			c.limiter.Pause(retryAfter(resp.Header, c.cfg.RetryAfter))
+			attempt--
+
+			continue
+		case resp.StatusCode >= http.StatusInternalServerError && isIdempotent(method):
+			if attempt < c.cfg.MaxRetries {
+				resp.Body.Close()
+			}
+
+			retryable = true
+		}
+
+		if !retryable || attempt >= c.cfg.MaxRetries {
+			return resp, err
+		}
+
+		delay := backoff(attempt)
+
+		c.cfg.Log.WithFields(log.Fields{
+			log.FieldMethod:  method,
+			log.FieldURL:     path,
+			log.FieldAttempt: attempt + 1,
+		}).Debug("retrying a failed request")
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *httpClient) do(ctx context.Context, method, path string, headers http.Header, body []byte) (*http.Response, error) {
+	if err := c.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	// A request is built for every attempt since a body is consumed by a previous one.
+	req, err := http.NewRequestWithContext(ctx, method, c.cfg.BaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, h := range []http.Header{c.cfg.Headers, headers} {
+		for k, values := range h {
+			for _, v := range values {
+				req.Header.Add(k, v)
+			}
+		}
+	}
+
+	c.cfg.Log.WithFields(log.Fields{
+		log.FieldMethod: method,
+		log.FieldURL:    path,
+	}).Debug("signaling request")
+
+	start := time.Now()
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		metrics.Count("signal_request_errors", 1, "backend", c.cfg.Backend, "method", method)
+
+		return nil, err
+	}
+
+	metrics.Count("signal_requests", 1, "backend", c.cfg.Backend, "method", method, "status", strconv.Itoa(resp.StatusCode))
+	metrics.Timing("signal_request", time.Since(start), "backend", c.cfg.Backend, "method", method)
+
+	return resp, nil
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
+
+// backoff returns an exponentially growing delay with a jitter, so that peers
+// failed at once don't retry at once.
+func backoff(attempt int) time.Duration {
+	d := httpBackoffMin << attempt
+	if d > httpBackoffMax || d <= 0 {
+		d = httpBackoffMax
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// retryAfter returns a delay of the Retry-After header given either in seconds
+// or as a date, or def if there is no valid one.
+func retryAfter(h http.Header, def time.Duration) time.Duration {
+	v := h.Get("Retry-After")
+	if len(v) == 0 {
+		return def
+	}
+
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+
+	return def
+}
@@ -0,0 +1,346 @@
+// HTTPRendezvous is a p2p signaling implementation that uses a self-hosted
+// rendezvous server (see: HTTPRendezvousServer) over plain HTTP, e.g. where
+// WebSocket connections don't pass through a proxy. Candidate peers of a session
+// post messages to a mailbox of a session and long-poll it for messages of each
+// other, so a message is received as soon as it's posted.
+//
+// Requests are made to "${URL}/sessions/${SessionID}/..." with an "instance"
+// query parameter, and messages are JSON structures with fields "type" and
+// "payload" as in FILE.io files (see: type fileIoFileContentType).
+
+package signal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// httpRendezvousPollWait is a time a poll is held for by a server if there
+	// are no messages, it's bounded by a half of a request timeout.
+	httpRendezvousPollWait = 20 * time.Second
+	// httpRendezvousRetryDelay is a delay a failed poll is made again after.
+	httpRendezvousRetryDelay = time.Second
+)
+
+type HTTPRendezvous struct {
+	cfg HTTPRendezvousConfig
+	log log.Logger
+
+	client *httpClient
+	wait   time.Duration
+
+	mx sync.Mutex
+	// after is a sequence number of the last message received.
+	after int64
+
+	sdpHandler       func([]byte)
+	candidateHandler func([]byte)
+	natHandler       func([]byte)
+	messages         messageHandlers
+}
+
+type HTTPRendezvousConfig struct {
+	// URL is a URL of a rendezvous server presented as "http[s]://host[:port]/path".
+	URL string
+	// Token is sent as a bearer token if a server requires one.
+	Token      string
+	SessionID  string
+	InstanceID string
+	// Timeout bounds a single attempt of a request, default is 30 seconds.
+	Timeout time.Duration
+	// Proxy is a proxy requests are made through, proxy environment variables
+	// are used if nil.
+	Proxy *url.URL
+	// Log is a logger entries are written with (e.g. with session fields attached),
+	// the global logger is used if nil.
+	Log log.Logger
+}
+
+func NewHTTPRendezvous(cfg HTTPRendezvousConfig) (*HTTPRendezvous, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+
+	if len(u.Host) == 0 {
+		return nil, errors.New("host is empty")
+	}
+
+	if len(cfg.SessionID) == 0 {
+		return nil, errors.New("session ID is empty")
+	}
+
+	if len(cfg.InstanceID) == 0 {
+		return nil, errors.New("instance ID is empty")
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultHTTPTimeout
+	}
+
+	if cfg.Log == nil {
+		cfg.Log = log.New()
+	}
+
+	wait := httpRendezvousPollWait
+	if wait > cfg.Timeout/2 {
+		wait = cfg.Timeout / 2
+	}
+
+	headers := http.Header{}
+	if len(cfg.Token) != 0 {
+		headers.Set("Authorization", "Bearer "+cfg.Token)
+	}
+
+	u.RawQuery = ""
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/sessions/" + url.PathEscape(cfg.SessionID)
+
+	return &HTTPRendezvous{
+		cfg: cfg,
+		log: cfg.Log,
+		client: newHTTPClient(httpClientConfig{
+			Backend: "http",
+			BaseURL: u.String(),
+			Headers: headers,
+			Timeout: cfg.Timeout,
+			Proxy:   cfg.Proxy,
+			Log:     cfg.Log,
+		}),
+		wait:             wait,
+		sdpHandler:       func([]byte) {},
+		candidateHandler: func([]byte) {},
+		natHandler:       func([]byte) {},
+	}, nil
+}
+
+// Listen polls a mailbox of a session and dispatches received messages to
+// handlers until ctx is done.
+func (s *HTTPRendezvous) Listen(ctx context.Context) {
+	for ctx.Err() == nil {
+		msgs, err := s.poll(ctx, s.wait)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			s.log.Error(err)
+
+			select {
+			case <-time.After(httpRendezvousRetryDelay):
+			case <-ctx.Done():
+				return
+			}
+
+			continue
+		}
+
+		for _, msg := range msgs {
+			s.log.WithFields(log.Fields{
+				log.FieldType:    msg.Type,
+				log.FieldPayload: string(msg.Payload),
+			}).Trace("signaling message received")
+
+			switch msg.Type {
+			case fileIoFileContentTypeSDP:
+				s.sdpHandler(msg.Payload)
+			case fileIoFileContentTypeCandidate:
+				s.candidateHandler(msg.Payload)
+			case fileIoFileContentTypeNAT:
+				s.natHandler(msg.Payload)
+			default:
+				s.messages.dispatch(msg.Type, msg.Payload)
+			}
+		}
+	}
+}
+
+func (s *HTTPRendezvous) Ping() error {
+	resp, err := s.request(context.Background(), http.MethodPost, "/ping", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var pong httpRendezvousPong
+
+	if err := json.NewDecoder(resp.Body).Decode(&pong); err != nil {
+		return errors.Wrap(err, "HTTP signaling")
+	}
+
+	if !pong.Found {
+		return ErrNoCandidatesFound
+	}
+
+	return nil
+}
+
+func (s *HTTPRendezvous) SendSDP(payload []byte) error {
+	return s.send(fileIoFileContentTypeSDP, payload)
+}
+
+func (s *HTTPRendezvous) SendCandidate(payload []byte) error {
+	return s.send(fileIoFileContentTypeCandidate, payload)
+}
+
+// SendNAT tells the other peer a NAT type of this one, a server keeps it until
+// the other peer polls.
+func (s *HTTPRendezvous) SendNAT(payload []byte) error {
+	return s.send(fileIoFileContentTypeNAT, payload)
+}
+
+func (s *HTTPRendezvous) OnSDP(h func([]byte)) {
+	s.sdpHandler = h
+}
+
+func (s *HTTPRendezvous) OnCandidate(h func([]byte)) {
+	s.candidateHandler = h
+}
+
+func (s *HTTPRendezvous) OnNAT(h func([]byte)) {
+	s.natHandler = h
+}
+
+// Send sends the other peer a typed message of type typ (see:
+// peer.MessageSignal), it's delivered as SDP is.
+func (s *HTTPRendezvous) Send(typ string, payload []byte) error {
+	ct, err := messageContentType(typ)
+	if err != nil {
+		return err
+	}
+
+	return s.send(ct, payload)
+}
+
+func (s *HTTPRendezvous) On(typ string, h func([]byte)) {
+	s.messages.on(typ, h)
+}
+
+// CleanUpInstance drops messages and a ping of InstanceID within a session, e.g.
+// left by a previous run that was killed.
+func (s *HTTPRendezvous) CleanUpInstance() error {
+	resp, err := s.request(context.Background(), http.MethodDelete, "/messages", nil, nil)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	return nil
+}
+
+// CheckAuth polls a mailbox without waiting to make sure Token is accepted.
+func (s *HTTPRendezvous) CheckAuth() error {
+	resp, err := s.request(context.Background(), http.MethodGet, "/messages", url.Values{"wait": {"0"}}, nil)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	return nil
+}
+
+func (s *HTTPRendezvous) send(typ fileIoFileContentType, payload []byte) error {
+	body, err := json.Marshal(&httpRendezvousMessage{
+		Type:    typ,
+		Payload: payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.request(context.Background(), http.MethodPost, "/messages", nil, body)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	return nil
+}
+
+// poll returns messages posted after the last one received, a server holds a
+// request for up to wait if there are none.
+func (s *HTTPRendezvous) poll(ctx context.Context, wait time.Duration) ([]httpRendezvousMessage, error) {
+	s.mx.Lock()
+	after := s.after
+	s.mx.Unlock()
+
+	query := url.Values{
+		"after": {strconv.FormatInt(after, 10)},
+		"wait":  {strconv.Itoa(int(wait / time.Second))},
+	}
+
+	resp, err := s.request(ctx, http.MethodGet, "/messages", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result httpRendezvousMessages
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, errors.Wrap(err, "HTTP signaling")
+	}
+
+	s.mx.Lock()
+	for _, msg := range result.Messages {
+		if msg.Seq > s.after {
+			s.after = msg.Seq
+		}
+	}
+	s.mx.Unlock()
+
+	return result.Messages, nil
+}
+
+// request makes a request of InstanceID to a path relative to a session and
+// returns a successful response.
+func (s *HTTPRendezvous) request(ctx context.Context, method, path string, query url.Values, body []byte) (*http.Response, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+
+	query.Set("instance", s.cfg.InstanceID)
+
+	headers := http.Header{}
+	if body != nil {
+		headers.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.client.Do(ctx, method, path+"?"+query.Encode(), headers, body)
+	if err != nil {
+		return nil, errors.Wrap(err, "HTTP signaling")
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusUnauthorized {
+			return nil, errors.New("HTTP signaling: server rejected a request, check a token")
+		}
+
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+		return nil, errors.Errorf("HTTP signaling: %s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+
+	return resp, nil
+}
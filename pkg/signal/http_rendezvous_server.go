@@ -0,0 +1,357 @@
+package signal
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-backup/pkg/log"
+)
+
+const (
+	// httpRendezvousMaxWait bounds a time a poll of messages is held for if there
+	// are none, so that it fits timeouts of proxies.
+	httpRendezvousMaxWait = 30 * time.Second
+	// httpRendezvousPingTTL is a time a ping of an instance is kept for after it
+	// polls last, so that a gone instance isn't found by the other one.
+	httpRendezvousPingTTL = time.Minute
+	// httpRendezvousMaxMessage bounds a size of a message body.
+	httpRendezvousMaxMessage = 64 << 10
+)
+
+// HTTPRendezvousServer is a rendezvous server of the HTTP signaling (see:
+// HTTPRendezvous), which keeps a mailbox of messages for a session. Candidate
+// peers post messages to it and poll messages of each other, so that nothing
+// but plain HTTP requests is needed. It keeps no state but mailboxes in memory.
+//
+// Requests are made to "${prefix}/sessions/${SessionID}/ping" and
+// "${prefix}/sessions/${SessionID}/messages" with an "instance" query parameter
+// (see: ServeHTTP()).
+type HTTPRendezvousServer struct {
+	cfg HTTPRendezvousServerConfig
+	log log.Logger
+
+	mx       sync.Mutex
+	sessions map[string]*httpRendezvousSession
+	// seq is a sequence number of the last message posted to any session, it's
+	// never reused by a session made again.
+	seq int64
+}
+
+type HTTPRendezvousServerConfig struct {
+	// Token is a bearer token clients are required to send, any client is
+	// accepted if it's empty.
+	Token string
+	// BacklogTTL is a time a message is kept for until it's received, default is
+	// 10 minutes.
+	BacklogTTL time.Duration
+	// Log is a logger entries are written with, the global logger is used if nil.
+	Log log.Logger
+}
+
+type httpRendezvousSession struct {
+	messages []httpRendezvousStoredMessage
+	// pings are times instances which have pinged were seen last at.
+	pings map[string]time.Time
+	// posted is closed and replaced once a message is posted, so that polls
+	// waiting for one return. A session with polls waiting is kept.
+	posted chan struct{}
+	polls  int
+}
+
+type httpRendezvousStoredMessage struct {
+	instance string
+	msg      httpRendezvousMessage
+	sentAt   time.Time
+}
+
+type httpRendezvousMessage struct {
+	Seq     int64                 `json:"seq,omitempty"`
+	Type    fileIoFileContentType `json:"type"`
+	Payload []byte                `json:"payload,omitempty"`
+}
+
+type httpRendezvousMessages struct {
+	Messages []httpRendezvousMessage `json:"messages"`
+}
+
+type httpRendezvousPong struct {
+	// Found tells whether another candidate peer has pinged.
+	Found bool `json:"found"`
+}
+
+func NewHTTPRendezvousServer(cfg HTTPRendezvousServerConfig) *HTTPRendezvousServer {
+	if cfg.BacklogTTL == 0 {
+		cfg.BacklogTTL = defaultWebSocketBacklogTTL
+	}
+
+	if cfg.Log == nil {
+		cfg.Log = log.New()
+	}
+
+	return &HTTPRendezvousServer{
+		cfg:      cfg,
+		log:      cfg.Log,
+		sessions: make(map[string]*httpRendezvousSession),
+	}
+}
+
+// ServeHTTP serves requests of an instance of a session:
+//
+//   - POST .../ping replies whether another instance has pinged and remembers
+//     a ping of this one otherwise;
+//   - POST .../messages posts a message to other instances;
+//   - GET .../messages?after=${seq}&wait=${seconds} returns messages of other
+//     instances posted after seq, waiting for one up to wait seconds if there
+//     are none, and drops messages up to seq as received;
+//   - DELETE .../messages drops messages and a ping of an instance (e.g. left
+//     by a previous run).
+func (s *HTTPRendezvousServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(s.cfg.Token) != 0 {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Token)) != 1 {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+
+			return
+		}
+	}
+
+	i := strings.LastIndex(r.URL.Path, "/sessions/")
+	if i < 0 {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	sessionID, resource, _ := strings.Cut(r.URL.Path[i+len("/sessions/"):], "/")
+	instance := r.URL.Query().Get("instance")
+
+	if len(sessionID) == 0 || len(instance) == 0 {
+		http.Error(w, "session and instance are required", http.StatusBadRequest)
+
+		return
+	}
+
+	switch {
+	case resource == "ping" && r.Method == http.MethodPost:
+		s.writeJSON(w, httpRendezvousPong{Found: s.ping(sessionID, instance)})
+	case resource == "messages" && r.Method == http.MethodPost:
+		var msg httpRendezvousMessage
+
+		if err := json.NewDecoder(io.LimitReader(r.Body, httpRendezvousMaxMessage)).Decode(&msg); err != nil {
+			http.Error(w, "malformed message", http.StatusBadRequest)
+
+			return
+		}
+
+		if !relayedContentType(msg.Type) {
+			http.Error(w, "unknown message type", http.StatusBadRequest)
+
+			return
+		}
+
+		s.post(sessionID, instance, msg)
+		w.WriteHeader(http.StatusNoContent)
+	case resource == "messages" && r.Method == http.MethodGet:
+		after, _ := strconv.ParseInt(r.URL.Query().Get("after"), 10, 64)
+		seconds, _ := strconv.Atoi(r.URL.Query().Get("wait"))
+
+		wait := time.Duration(seconds) * time.Second
+		if wait < 0 || wait > httpRendezvousMaxWait {
+			wait = httpRendezvousMaxWait
+		}
+
+		msgs := s.poll(r, sessionID, instance, after, wait)
+		s.writeJSON(w, httpRendezvousMessages{Messages: msgs})
+	case resource == "messages" && r.Method == http.MethodDelete:
+		s.drop(sessionID, instance)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (s *HTTPRendezvousServer) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.log.Error(err)
+	}
+}
+
+// session returns a session which is made if there is none, s.mx is to be held.
+func (s *HTTPRendezvousServer) session(sessionID string) *httpRendezvousSession {
+	s.expire()
+
+	session, ok := s.sessions[sessionID]
+	if !ok {
+		session = &httpRendezvousSession{
+			pings:  make(map[string]time.Time),
+			posted: make(chan struct{}),
+		}
+		s.sessions[sessionID] = session
+	}
+
+	return session
+}
+
+// ping tells whether another instance of a session has pinged, an instance is
+// remembered as pinged otherwise.
+func (s *HTTPRendezvousServer) ping(sessionID, instance string) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	session := s.session(sessionID)
+
+	for other := range session.pings {
+		if other != instance {
+			return true
+		}
+	}
+
+	session.pings[instance] = time.Now()
+
+	return false
+}
+
+func (s *HTTPRendezvousServer) post(sessionID, instance string, msg httpRendezvousMessage) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	session := s.session(sessionID)
+
+	if len(session.messages) == webSocketBacklogSize {
+		session.messages = session.messages[1:]
+	}
+
+	s.seq++
+	msg.Seq = s.seq
+
+	session.messages = append(session.messages, httpRendezvousStoredMessage{
+		instance: instance,
+		msg:      msg,
+		sentAt:   time.Now(),
+	})
+
+	close(session.posted)
+	session.posted = make(chan struct{})
+}
+
+// poll returns messages of other instances posted after seq, waiting for one up
+// to wait if there are none. Messages up to seq are received, so they're dropped.
+func (s *HTTPRendezvousServer) poll(r *http.Request, sessionID, instance string, after int64, wait time.Duration) []httpRendezvousMessage {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		s.mx.Lock()
+
+		// A sequence number ahead of the server is of a server run before,
+		// whose messages are lost anyway.
+		if after > s.seq {
+			after = 0
+		}
+
+		session := s.session(sessionID)
+
+		if _, ok := session.pings[instance]; ok {
+			session.pings[instance] = time.Now()
+		}
+
+		var msgs []httpRendezvousMessage
+
+		kept := session.messages[:0]
+
+		for _, m := range session.messages {
+			switch {
+			case m.instance == instance:
+				kept = append(kept, m)
+			case m.msg.Seq > after:
+				kept = append(kept, m)
+				msgs = append(msgs, m.msg)
+			}
+		}
+
+		session.messages = kept
+		posted := session.posted
+
+		if len(msgs) == 0 {
+			session.polls++
+		}
+
+		s.mx.Unlock()
+
+		if len(msgs) != 0 {
+			return msgs
+		}
+
+		var done bool
+
+		select {
+		case <-posted:
+		case <-timer.C:
+			done = true
+		case <-r.Context().Done():
+			done = true
+		}
+
+		s.mx.Lock()
+		session.polls--
+		s.mx.Unlock()
+
+		if done {
+			return nil
+		}
+	}
+}
+
+// drop drops messages and a ping of an instance.
+func (s *HTTPRendezvousServer) drop(sessionID, instance string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	session := s.session(sessionID)
+
+	kept := session.messages[:0]
+
+	for _, m := range session.messages {
+		if m.instance != instance {
+			kept = append(kept, m)
+		}
+	}
+
+	session.messages = kept
+	delete(session.pings, instance)
+}
+
+// expire drops messages kept longer than BacklogTTL, pings of instances which
+// haven't polled for httpRendezvousPingTTL and sessions left empty.
+func (s *HTTPRendezvousServer) expire() {
+	for id, session := range s.sessions {
+		messages := session.messages[:0]
+
+		for _, m := range session.messages {
+			if time.Since(m.sentAt) < s.cfg.BacklogTTL {
+				messages = append(messages, m)
+			}
+		}
+
+		session.messages = messages
+
+		for instance, seen := range session.pings {
+			if time.Since(seen) >= httpRendezvousPingTTL {
+				delete(session.pings, instance)
+			}
+		}
+
+		if len(session.messages) == 0 && len(session.pings) == 0 && session.polls == 0 {
+			delete(s.sessions, id)
+		}
+	}
+}
@@ -0,0 +1,741 @@
+// MDNS is a p2p signaling implementation for candidate peers on the same local
+// network, which needs neither an external service nor internet access.
+//
+// Candidate peers of a session discover each other with DNS-SD over multicast
+// DNS. Every instance announces a service "${InstanceID}._distributed-backup._udp.local."
+// of a subtype "_${key}._sub._distributed-backup._udp.local.", where key is a
+// digest of SessionID, so that a ping is a query of instances of a session only.
+// A service points to a UDP socket of an instance, and TXT records of it tell
+// whether an instance is still pinging or waits for an offer.
+//
+// Messages are sent directly to a socket of the other instance once it's found
+// (or once it sends one), as JSON structures with fields "type" and "payload" as
+// in FILE.io files (see: type fileIoFileContentType). Every message is
+// acknowledged and sent again until it is, one at a time, so that messages are
+// delivered in the same order they were sent.
+
+package signal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/metrics"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// DefaultMDNSGroup is the multicast DNS group and port.
+	DefaultMDNSGroup = "224.0.0.251:5353"
+
+	defaultMDNSTimeout = 3 * time.Second
+
+	mdnsService = "_distributed-backup._udp.local."
+	// mdnsQueryInterval is an interval a ping queries instances of a session
+	// at, so that a query which is lost or made before the other instance is
+	// run is made again.
+	mdnsQueryInterval = time.Second
+	// mdnsResendInterval is an interval a message is sent again at until it's
+	// acknowledged, mdnsAckTimeout bounds waiting for an acknowledgement.
+	mdnsResendInterval = 250 * time.Millisecond
+	mdnsAckTimeout     = 10 * time.Second
+	// mdnsTTL is a TTL of records of a response to a one-shot query (see: RFC
+	// 6762, section 6.7).
+	mdnsTTL = 10
+	// mdnsMaxMessageSize bounds a datagram either socket reads.
+	mdnsMaxMessageSize = 1 << 16
+)
+
+const (
+	mdnsStatePinging = "state=pinging"
+	mdnsStateWaiting = "state=waiting"
+)
+
+type MDNS struct {
+	cfg MDNSConfig
+	log log.Logger
+
+	// key identifies a session in names of services and in messages.
+	key      string
+	subtype  dnsmessage.Name
+	instance dnsmessage.Name
+	host     dnsmessage.Name
+	group    *net.UDPAddr
+
+	// conn is a socket messages and responses to queries are received on, and
+	// mconn is a socket of the multicast group queries are received on.
+	conn  *net.UDPConn
+	mconn *net.UDPConn
+
+	mx             sync.Mutex
+	remote         *net.UDPAddr
+	remoteInstance string
+	received       map[uint64]bool
+	waiting        bool
+	closed         bool
+	seq            uint64
+	outbox         []mdnsMessage
+	acks           map[uint64]chan struct{}
+
+	// smx serializes delivery of messages, so that they're delivered in order.
+	smx sync.Mutex
+
+	found chan mdnsInstance
+	inbox chan mdnsMessage
+
+	sdpHandler       func([]byte)
+	candidateHandler func([]byte)
+	natHandler       func([]byte)
+	messages         messageHandlers
+}
+
+type MDNSConfig struct {
+	SessionID  string
+	InstanceID string
+	// Group is a multicast address and port queries are sent to, default is
+	// DefaultMDNSGroup.
+	Group string
+	// Timeout bounds waiting for the other instance to answer a ping, default is
+	// 3 seconds.
+	Timeout time.Duration
+	// Log is a logger entries are written with (e.g. with session fields attached),
+	// the global logger is used if nil.
+	Log log.Logger
+}
+
+type mdnsMessage struct {
+	// Session is a key of a session, messages of other sessions are dropped.
+	Session  string                `json:"session"`
+	Instance string                `json:"instance"`
+	Seq      uint64                `json:"seq"`
+	Type     fileIoFileContentType `json:"type,omitempty"`
+	Payload  []byte                `json:"payload,omitempty"`
+	// Ack tells that a message of Seq is received.
+	Ack bool `json:"ack,omitempty"`
+}
+
+// mdnsInstance is an instance of a session which has answered a ping.
+type mdnsInstance struct {
+	id      string
+	addr    *net.UDPAddr
+	waiting bool
+}
+
+func NewMDNS(cfg MDNSConfig) (*MDNS, error) {
+	if len(cfg.SessionID) == 0 {
+		return nil, errors.New("session ID is empty")
+	}
+
+	if len(cfg.InstanceID) == 0 {
+		return nil, errors.New("instance ID is empty")
+	}
+
+	if len(cfg.Group) == 0 {
+		cfg.Group = DefaultMDNSGroup
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultMDNSTimeout
+	}
+
+	if cfg.Log == nil {
+		cfg.Log = log.New()
+	}
+
+	group, err := net.ResolveUDPAddr("udp4", cfg.Group)
+	if err != nil {
+		return nil, errors.Wrap(err, "multicast group")
+	}
+
+	sum := sha256.Sum256([]byte(cfg.SessionID))
+	key := hex.EncodeToString(sum[:8])
+
+	s := &MDNS{
+		cfg:              cfg,
+		log:              cfg.Log,
+		key:              key,
+		group:            group,
+		received:         map[uint64]bool{},
+		acks:             map[uint64]chan struct{}{},
+		found:            make(chan mdnsInstance, 1),
+		sdpHandler:       func([]byte) {},
+		candidateHandler: func([]byte) {},
+		natHandler:       func([]byte) {},
+	}
+
+	// The inbox is big enough to hold all SDP and ICE candidates of a session
+	// even before Listen() is run.
+	const inboxSize = 256
+
+	s.inbox = make(chan mdnsMessage, inboxSize)
+
+	if s.subtype, err = dnsmessage.NewName("_" + key + "._sub." + mdnsService); err != nil {
+		return nil, err
+	}
+
+	if s.instance, err = dnsmessage.NewName(cfg.InstanceID + "." + mdnsService); err != nil {
+		return nil, err
+	}
+
+	if s.host, err = dnsmessage.NewName(cfg.InstanceID + ".local."); err != nil {
+		return nil, err
+	}
+
+	if s.conn, err = net.ListenUDP("udp4", &net.UDPAddr{}); err != nil {
+		return nil, errors.Wrap(err, "mDNS signaling")
+	}
+
+	if s.mconn, err = net.ListenMulticastUDP("udp4", nil, group); err != nil {
+		s.conn.Close()
+
+		return nil, errors.Wrap(err, "mDNS signaling")
+	}
+
+	go s.readMessages()
+	go s.readQueries()
+
+	return s, nil
+}
+
+// Listen dispatches received messages to handlers, sockets are closed once ctx
+// is done.
+func (s *MDNS) Listen(ctx context.Context) {
+	for {
+		select {
+		case msg := <-s.inbox:
+			switch msg.Type {
+			case fileIoFileContentTypeSDP:
+				s.sdpHandler(msg.Payload)
+			case fileIoFileContentTypeCandidate:
+				s.candidateHandler(msg.Payload)
+			case fileIoFileContentTypeNAT:
+				s.natHandler(msg.Payload)
+			default:
+				s.messages.dispatch(msg.Type, msg.Payload)
+			}
+		case <-ctx.Done():
+			s.Close()
+
+			return
+		}
+	}
+}
+
+// Ping queries instances of a session for Timeout. An instance which waits for
+// an offer is the other candidate peer. Of two instances which ping at once the
+// one with a lesser instance ID gives up and waits, so that only one of them
+// offers.
+func (s *MDNS) Ping() error {
+	query, err := s.query()
+	if err != nil {
+		return err
+	}
+
+	timeout := time.After(s.cfg.Timeout)
+	ticker := time.NewTicker(mdnsQueryInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.conn.WriteToUDP(query, s.group); err != nil {
+			metrics.Count("signal_request_errors", 1, "backend", "mdns", "method", string(fileIoFileContentTypePing))
+
+			return errors.Wrap(err, "mDNS signaling")
+		}
+
+		metrics.Count("signal_requests", 1, "backend", "mdns", "method", string(fileIoFileContentTypePing))
+
+		for queried := true; queried; {
+			select {
+			case inst := <-s.found:
+				if inst.waiting {
+					s.log.WithField(log.FieldAddr, inst.addr.String()).Debug("candidate found on the local network")
+					s.setRemote(inst.id, inst.addr)
+
+					return nil
+				}
+
+				if s.cfg.InstanceID < inst.id {
+					return s.wait()
+				}
+			case <-ticker.C:
+				queried = false
+			case <-timeout:
+				return s.wait()
+			}
+		}
+	}
+}
+
+// wait makes an instance answer queries as one waiting for an offer.
+func (s *MDNS) wait() error {
+	s.mx.Lock()
+	s.waiting = true
+	s.mx.Unlock()
+
+	return ErrNoCandidatesFound
+}
+
+func (s *MDNS) SendSDP(payload []byte) error {
+	return s.send(fileIoFileContentTypeSDP, payload)
+}
+
+func (s *MDNS) SendCandidate(payload []byte) error {
+	return s.send(fileIoFileContentTypeCandidate, payload)
+}
+
+// SendNAT tells the other peer a NAT type of this one, it's kept until the other
+// peer is known.
+func (s *MDNS) SendNAT(payload []byte) error {
+	return s.send(fileIoFileContentTypeNAT, payload)
+}
+
+func (s *MDNS) OnSDP(h func([]byte)) {
+	s.sdpHandler = h
+}
+
+func (s *MDNS) OnCandidate(h func([]byte)) {
+	s.candidateHandler = h
+}
+
+func (s *MDNS) OnNAT(h func([]byte)) {
+	s.natHandler = h
+}
+
+// Send sends the other peer a typed message of type typ (see:
+// peer.MessageSignal), it's delivered as SDP is.
+func (s *MDNS) Send(typ string, payload []byte) error {
+	ct, err := messageContentType(typ)
+	if err != nil {
+		return err
+	}
+
+	return s.send(ct, payload)
+}
+
+func (s *MDNS) On(typ string, h func([]byte)) {
+	s.messages.on(typ, h)
+}
+
+// CleanUpInstance does nothing, since nothing is kept outside an instance.
+func (s *MDNS) CleanUpInstance() error {
+	return nil
+}
+
+// Close closes sockets, an instance isn't found by the other one anymore.
+func (s *MDNS) Close() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+	s.conn.Close()
+	s.mconn.Close()
+}
+
+// send delivers a message to the other instance, or keeps it until the other
+// instance is known.
+func (s *MDNS) send(contentType fileIoFileContentType, payload []byte) error {
+	s.mx.Lock()
+
+	if s.closed {
+		s.mx.Unlock()
+
+		return errors.New("mDNS signaling is closed")
+	}
+
+	s.seq++
+	s.outbox = append(s.outbox, mdnsMessage{
+		Session:  s.key,
+		Instance: s.cfg.InstanceID,
+		Seq:      s.seq,
+		Type:     contentType,
+		Payload:  append([]byte{}, payload...),
+	})
+
+	known := s.remote != nil
+	s.mx.Unlock()
+
+	if !known {
+		return nil
+	}
+
+	return s.flush()
+}
+
+// flush delivers kept messages in order.
+func (s *MDNS) flush() error {
+	s.smx.Lock()
+	defer s.smx.Unlock()
+
+	for {
+		s.mx.Lock()
+
+		if len(s.outbox) == 0 || s.remote == nil {
+			s.mx.Unlock()
+
+			return nil
+		}
+
+		msg, remote := s.outbox[0], s.remote
+		s.outbox = s.outbox[1:]
+		acked := make(chan struct{})
+		s.acks[msg.Seq] = acked
+		s.mx.Unlock()
+
+		err := s.deliver(msg, remote, acked)
+
+		s.mx.Lock()
+		delete(s.acks, msg.Seq)
+		s.mx.Unlock()
+
+		if err != nil {
+			metrics.Count("signal_request_errors", 1, "backend", "mdns", "method", string(msg.Type))
+
+			return errors.Wrap(err, "mDNS signaling")
+		}
+
+		metrics.Count("signal_requests", 1, "backend", "mdns", "method", string(msg.Type))
+	}
+}
+
+// deliver sends a message again every mdnsResendInterval until it's
+// acknowledged.
+func (s *MDNS) deliver(msg mdnsMessage, remote *net.UDPAddr, acked chan struct{}) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	timeout := time.After(mdnsAckTimeout)
+
+	for {
+		if _, err := s.conn.WriteToUDP(b, remote); err != nil {
+			return err
+		}
+
+		select {
+		case <-acked:
+			return nil
+		case <-time.After(mdnsResendInterval):
+		case <-timeout:
+			return errors.Errorf("%s isn't acknowledged", msg.Type)
+		}
+	}
+}
+
+// setRemote makes an instance the other one, messages are sent to addr then,
+// and tells whether the other instance was known before. Messages of an
+// instance are told from ones already received by their sequence numbers.
+func (s *MDNS) setRemote(instance string, addr *net.UDPAddr) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	known := s.remote != nil
+
+	if s.remoteInstance != instance {
+		s.remoteInstance = instance
+		s.received = map[uint64]bool{}
+	}
+
+	s.remote = addr
+
+	return known
+}
+
+// readMessages reads messages of the other instance and responses to queries
+// until a socket is closed.
+func (s *MDNS) readMessages() {
+	buf := make([]byte, mdnsMaxMessageSize)
+
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if n != 0 && buf[0] == '{' {
+			s.receive(buf[:n], addr)
+		} else {
+			s.receiveResponse(buf[:n], addr)
+		}
+	}
+}
+
+// receive acknowledges a message and queues it, unless it's been received.
+func (s *MDNS) receive(b []byte, addr *net.UDPAddr) {
+	var msg mdnsMessage
+
+	if err := json.Unmarshal(b, &msg); err != nil || msg.Session != s.key || msg.Instance == s.cfg.InstanceID {
+		return
+	}
+
+	if msg.Ack {
+		s.mx.Lock()
+		acked, ok := s.acks[msg.Seq]
+		s.mx.Unlock()
+
+		if ok {
+			close(acked)
+		}
+
+		return
+	}
+
+	ack, _ := json.Marshal(mdnsMessage{Session: s.key, Instance: s.cfg.InstanceID, Seq: msg.Seq, Ack: true})
+
+	if _, err := s.conn.WriteToUDP(ack, addr); err != nil {
+		s.log.Error(errors.Wrap(err, "mDNS signaling"))
+	}
+
+	known := s.setRemote(msg.Instance, addr)
+
+	s.mx.Lock()
+	dup := s.received[msg.Seq]
+	s.received[msg.Seq] = true
+	s.mx.Unlock()
+
+	if dup {
+		return
+	}
+
+	s.log.WithFields(log.Fields{
+		log.FieldType:    msg.Type,
+		log.FieldPayload: string(msg.Payload),
+	}).Trace("signaling message received")
+
+	// Messages sent before the other instance was known are delivered now.
+	if !known {
+		go func() {
+			if err := s.flush(); err != nil {
+				s.log.Error(err)
+			}
+		}()
+	}
+
+	s.inbox <- msg
+}
+
+// receiveResponse tells Ping() of an instance of a session a response of addr
+// points to.
+func (s *MDNS) receiveResponse(b []byte, addr *net.UDPAddr) {
+	var p dnsmessage.Parser
+
+	h, err := p.Start(b)
+	if err != nil || !h.Response {
+		return
+	}
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return
+	}
+
+	if err := p.SkipAllAuthorities(); err != nil {
+		return
+	}
+
+	additionals, err := p.AllAdditionals()
+	if err != nil {
+		return
+	}
+
+	var (
+		instance string
+		inst     = mdnsInstance{addr: &net.UDPAddr{IP: addr.IP}}
+	)
+
+	for _, r := range append(answers, additionals...) {
+		switch body := r.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if equalNames(r.Header.Name, s.subtype) {
+				instance = body.PTR.String()
+			}
+		case *dnsmessage.SRVResource:
+			if strings.EqualFold(r.Header.Name.String(), instance) {
+				inst.addr.Port = int(body.Port)
+			}
+		case *dnsmessage.TXTResource:
+			if strings.EqualFold(r.Header.Name.String(), instance) {
+				for _, txt := range body.TXT {
+					inst.waiting = inst.waiting || txt == mdnsStateWaiting
+				}
+			}
+		}
+	}
+
+	inst.id = strings.TrimSuffix(instance, "."+mdnsService)
+
+	if len(instance) == 0 || inst.addr.Port == 0 || inst.id == s.cfg.InstanceID {
+		return
+	}
+
+	select {
+	case s.found <- inst:
+	default:
+	}
+}
+
+// readQueries answers queries of instances of a session until a socket is
+// closed.
+func (s *MDNS) readQueries() {
+	buf := make([]byte, mdnsMaxMessageSize)
+
+	for {
+		n, addr, err := s.mconn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		var p dnsmessage.Parser
+
+		h, err := p.Start(buf[:n])
+		if err != nil || h.Response {
+			continue
+		}
+
+		questions, err := p.AllQuestions()
+		if err != nil {
+			continue
+		}
+
+		for _, q := range questions {
+			if (q.Type != dnsmessage.TypePTR && q.Type != dnsmessage.TypeALL) || !equalNames(q.Name, s.subtype) {
+				continue
+			}
+
+			if err := s.answer(h.ID, q, addr); err != nil {
+				s.log.Error(errors.Wrap(err, "mDNS signaling"))
+			}
+
+			break
+		}
+	}
+}
+
+// answer responds to a query of q from the mDNS port, a response to a one-shot
+// query made from another port is sent to a querier directly (see: RFC 6762,
+// section 6.7).
+func (s *MDNS) answer(id uint16, q dnsmessage.Question, addr *net.UDPAddr) error {
+	s.mx.Lock()
+	state := mdnsStatePinging
+	if s.waiting {
+		state = mdnsStateWaiting
+	}
+	s.mx.Unlock()
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, Authoritative: true})
+	b.EnableCompression()
+
+	port := uint16(s.conn.LocalAddr().(*net.UDPAddr).Port)
+	hdr := func(name dnsmessage.Name) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: mdnsTTL}
+	}
+
+	steps := []func() error{
+		b.StartQuestions,
+		func() error { return b.Question(q) },
+		b.StartAnswers,
+		func() error { return b.PTRResource(hdr(s.subtype), dnsmessage.PTRResource{PTR: s.instance}) },
+		b.StartAdditionals,
+		func() error {
+			return b.SRVResource(hdr(s.instance), dnsmessage.SRVResource{Port: port, Target: s.host})
+		},
+		func() error { return b.TXTResource(hdr(s.instance), dnsmessage.TXTResource{TXT: []string{state}}) },
+	}
+
+	for _, ip := range localIPv4s() {
+		ip := ip
+
+		steps = append(steps, func() error {
+			var a dnsmessage.AResource
+
+			copy(a.A[:], ip)
+
+			return b.AResource(hdr(s.host), a)
+		})
+	}
+
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+
+	msg, err := b.Finish()
+	if err != nil {
+		return err
+	}
+
+	to := addr
+	if addr.Port == s.group.Port {
+		to = s.group
+	}
+
+	_, err = s.mconn.WriteToUDP(msg, to)
+
+	return err
+}
+
+// query returns a one-shot query of instances of a session.
+func (s *MDNS) query() ([]byte, error) {
+	var id [2]byte
+
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:])})
+
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+
+	if err := b.Question(dnsmessage.Question{Name: s.subtype, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+
+	return b.Finish()
+}
+
+// localIPv4s returns IPv4 addresses of local interfaces but loopback ones.
+func localIPv4s() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	var ips []net.IP
+
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+			if ip := ipNet.IP.To4(); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+
+	return ips
+}
+
+// equalNames compares domain names case-insensitively.
+func equalNames(a, b dnsmessage.Name) bool {
+	return strings.EqualFold(a.String(), b.String())
+}
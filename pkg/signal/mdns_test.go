@@ -0,0 +1,40 @@
+package signal
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TestMDNSExchange exchanges messages over multicast DNS on a port other than
+// the mDNS one, so that a test isn't seen by mDNS responders of a network.
+func TestMDNSExchange(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	group := net.JoinHostPort("224.0.0.251", strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port))
+	conn.Close()
+
+	sessionID := uuid.NewString()
+
+	newMDNS := func() *MDNS {
+		s, err := NewMDNS(MDNSConfig{
+			SessionID:  sessionID,
+			InstanceID: uuid.NewString(),
+			Group:      group,
+			Timeout:    time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	}
+
+	testExchange(t, newMDNS(), newMDNS())
+}
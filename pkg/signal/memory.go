@@ -0,0 +1,158 @@
+// Memory is an in-process p2p signaling implementation that connects two peers
+// living in the same process (see: NewMemoryPair()). It lets the whole pipeline
+// (negotiation, transfer, storage) run without any external signaling service,
+// e.g. for self-testing.
+//
+// Messages sent by one side are queued to an inbox of the other side and are
+// dispatched to its handlers one by one by Listen() in the same order they were
+// sent, as it happens with FileIo.
+
+package signal
+
+import (
+	"context"
+	"sync"
+)
+
+type Memory struct {
+	rendezvous *memoryRendezvous
+	remote     *Memory
+	inbox      chan memoryMessage
+
+	sdpHandler       func([]byte)
+	candidateHandler func([]byte)
+	natHandler       func([]byte)
+	messages         messageHandlers
+}
+
+type memoryRendezvous struct {
+	mx     sync.Mutex
+	pinged bool
+}
+
+type memoryMessage struct {
+	contentType fileIoFileContentType
+	payload     []byte
+}
+
+// NewMemoryPair returns two connected signaling sides. The first one that pings
+// gets ErrNoCandidatesFound and waits for an offer of the other one.
+func NewMemoryPair() (*Memory, *Memory) {
+	rendezvous := &memoryRendezvous{}
+
+	// The inbox is big enough to hold all SDP and ICE candidates of a session
+	// even before Listen() is run.
+	const inboxSize = 256
+
+	s1 := &Memory{
+		rendezvous:       rendezvous,
+		inbox:            make(chan memoryMessage, inboxSize),
+		sdpHandler:       func([]byte) {},
+		candidateHandler: func([]byte) {},
+		natHandler:       func([]byte) {},
+	}
+
+	s2 := &Memory{
+		rendezvous:       rendezvous,
+		inbox:            make(chan memoryMessage, inboxSize),
+		sdpHandler:       func([]byte) {},
+		candidateHandler: func([]byte) {},
+		natHandler:       func([]byte) {},
+	}
+
+	s1.remote, s2.remote = s2, s1
+
+	return s1, s2
+}
+
+func (s *Memory) Listen(ctx context.Context) {
+	for {
+		select {
+		case msg := <-s.inbox:
+			switch msg.contentType {
+			case fileIoFileContentTypeSDP:
+				s.sdpHandler(msg.payload)
+			case fileIoFileContentTypeCandidate:
+				s.candidateHandler(msg.payload)
+			case fileIoFileContentTypeNAT:
+				s.natHandler(msg.payload)
+			default:
+				s.messages.dispatch(msg.contentType, msg.payload)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Memory) Ping() error {
+	s.rendezvous.mx.Lock()
+	defer s.rendezvous.mx.Unlock()
+
+	if !s.rendezvous.pinged {
+		s.rendezvous.pinged = true
+
+		return ErrNoCandidatesFound
+	}
+
+	return nil
+}
+
+func (s *Memory) SendSDP(payload []byte) error {
+	s.remote.inbox <- memoryMessage{
+		contentType: fileIoFileContentTypeSDP,
+		payload:     append([]byte{}, payload...),
+	}
+
+	return nil
+}
+
+func (s *Memory) SendCandidate(payload []byte) error {
+	s.remote.inbox <- memoryMessage{
+		contentType: fileIoFileContentTypeCandidate,
+		payload:     append([]byte{}, payload...),
+	}
+
+	return nil
+}
+
+func (s *Memory) SendNAT(payload []byte) error {
+	s.remote.inbox <- memoryMessage{
+		contentType: fileIoFileContentTypeNAT,
+		payload:     append([]byte{}, payload...),
+	}
+
+	return nil
+}
+
+func (s *Memory) OnSDP(h func([]byte)) {
+	s.sdpHandler = h
+}
+
+func (s *Memory) OnCandidate(h func([]byte)) {
+	s.candidateHandler = h
+}
+
+func (s *Memory) OnNAT(h func([]byte)) {
+	s.natHandler = h
+}
+
+// Send sends the other peer a typed message of type typ (see:
+// peer.MessageSignal), it's delivered as SDP is.
+func (s *Memory) Send(typ string, payload []byte) error {
+	ct, err := messageContentType(typ)
+	if err != nil {
+		return err
+	}
+
+	s.remote.inbox <- memoryMessage{
+		contentType: ct,
+		payload:     append([]byte{}, payload...),
+	}
+
+	return nil
+}
+
+func (s *Memory) On(typ string, h func([]byte)) {
+	s.messages.on(typ, h)
+}
@@ -0,0 +1,99 @@
+package signal
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Typed messages carry content of types other than SDP, ICE candidates and NAT
+// types through any signaling but the static one (see: peer.MessageSignal), so
+// that higher layers can exchange e.g. capabilities or resume offsets during
+// negotiation. A content type of a typed message is its type prefixed with
+// messageTypePrefix, so that it never clashes with a built-in one, and it's
+// relayed and stored as SDP is.
+const (
+	messageTypePrefix = "msg-"
+	maxMessageTypeLen = 32
+)
+
+// ErrInvalidMessageType means that a type of a typed message is empty, longer
+// than 32 characters or has characters other than lowercase letters, digits and
+// dashes, so that it's safe in file names, topics and keys of any signaling.
+var ErrInvalidMessageType = errors.New("invalid message type")
+
+// messageContentType returns a content type of typed messages of type typ.
+func messageContentType(typ string) (fileIoFileContentType, error) {
+	if !validMessageType(typ) {
+		return "", errors.Wrap(ErrInvalidMessageType, typ)
+	}
+
+	return fileIoFileContentType(messageTypePrefix + typ), nil
+}
+
+// isMessageContentType tells whether typ is a content type of typed messages.
+func isMessageContentType(typ fileIoFileContentType) bool {
+	t, ok := strings.CutPrefix(string(typ), messageTypePrefix)
+
+	return ok && validMessageType(t)
+}
+
+// relayedContentType tells whether a rendezvous server relays messages of
+// content type typ to other instances of a session.
+func relayedContentType(typ fileIoFileContentType) bool {
+	switch typ {
+	case fileIoFileContentTypeSDP, fileIoFileContentTypeCandidate, fileIoFileContentTypeNAT:
+		return true
+	}
+
+	return isMessageContentType(typ)
+}
+
+func validMessageType(typ string) bool {
+	if len(typ) == 0 || len(typ) > maxMessageTypeLen {
+		return false
+	}
+
+	for _, c := range typ {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// messageHandlers keeps handlers of typed messages by their types, messages of
+// a type without a handler are dropped.
+type messageHandlers struct {
+	mx       sync.Mutex
+	handlers map[string]func([]byte)
+}
+
+func (m *messageHandlers) on(typ string, h func([]byte)) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if m.handlers == nil {
+		m.handlers = make(map[string]func([]byte))
+	}
+
+	m.handlers[typ] = h
+}
+
+// dispatch passes a payload of a message of content type typ to a handler of
+// its type, if it's a typed message.
+func (m *messageHandlers) dispatch(typ fileIoFileContentType, payload []byte) {
+	if !isMessageContentType(typ) {
+		return
+	}
+
+	m.mx.Lock()
+	h := m.handlers[strings.TrimPrefix(string(typ), messageTypePrefix)]
+	m.mx.Unlock()
+
+	if h != nil {
+		h(payload)
+	}
+}
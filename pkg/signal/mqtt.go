@@ -0,0 +1,507 @@
+// MQTT is a p2p signaling implementation that uses any MQTT broker (e.g.
+// Mosquitto or EMQX). Candidate peers of a session subscribe to topics of a
+// session, so messages are pushed to them as soon as they are published.
+//
+// A message is published to "${Prefix}/${Key}/${InstanceID}/${Type}", where Key
+// is derived from SessionID, so that a session UUID isn't revealed to other
+// clients of a broker, and Type is one of the predefined values (see: type
+// fileIoFileContentType). A payload is published as is. Pings and NAT types are
+// retained by a broker, since the other peer may subscribe after they are
+// published, and a will of a client clears its ping if it disconnects
+// unexpectedly, so that a gone peer isn't found.
+
+package signal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/metrics"
+	"distributed-backup/pkg/proxy"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMQTTTimeout     = 30 * time.Second
+	defaultMQTTTopicPrefix = "distributed-backup"
+	// mqttRetainedWait is a time retained pings are waited for after subscribing.
+	mqttRetainedWait = time.Second
+	mqttQoS          = 1
+)
+
+type MQTT struct {
+	cfg    MQTTConfig
+	log    log.Logger
+	broker *url.URL
+	prefix string
+
+	mx        sync.Mutex
+	client    mqtt.Client
+	connected bool
+	// subscribedAt is a time a subscription was made at, retained messages are
+	// received soon after it.
+	subscribedAt time.Time
+	// pings are instances whose retained pings are received.
+	pings  map[string]bool
+	pinged chan struct{}
+
+	inbox chan mqttMessage
+
+	sdpHandler       func([]byte)
+	candidateHandler func([]byte)
+	natHandler       func([]byte)
+	messages         messageHandlers
+}
+
+type MQTTConfig struct {
+	// URL is a URL of a broker presented as "mqtt[s]://[user:password@]host[:port]"
+	// or "ws[s]://[user:password@]host[:port]/path", a topic prefix is taken from
+	// a "topic" query parameter, default is defaultMQTTTopicPrefix.
+	URL        string
+	SessionID  string
+	InstanceID string
+	// Timeout bounds connecting to a broker and publishing a message, default is
+	// 30 seconds.
+	Timeout time.Duration
+	// Proxy is a proxy an mqtt[s]:// connection is made through, the ALL_PROXY
+	// environment variable is used if nil.
+	Proxy *url.URL
+	// Log is a logger entries are written with (e.g. with session fields attached),
+	// the global logger is used if nil.
+	Log log.Logger
+}
+
+type mqttMessage struct {
+	Type    fileIoFileContentType
+	Payload []byte
+}
+
+func NewMQTT(cfg MQTTConfig) (*MQTT, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "mqtt", "mqtts", "ws", "wss":
+	default:
+		return nil, errors.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+
+	if len(u.Host) == 0 {
+		return nil, errors.New("host is empty")
+	}
+
+	if len(cfg.SessionID) == 0 {
+		return nil, errors.New("session ID is empty")
+	}
+
+	if len(cfg.InstanceID) == 0 {
+		return nil, errors.New("instance ID is empty")
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultMQTTTimeout
+	}
+
+	if cfg.Log == nil {
+		cfg.Log = log.New()
+	}
+
+	prefix := strings.Trim(u.Query().Get("topic"), "/")
+	if len(prefix) == 0 {
+		prefix = defaultMQTTTopicPrefix
+	}
+
+	if strings.ContainsAny(prefix, "+#") {
+		return nil, errors.New("topic prefix has wildcards")
+	}
+
+	sum := sha256.Sum256([]byte(cfg.SessionID))
+
+	broker := *u
+	broker.RawQuery = ""
+
+	// The inbox is big enough to hold all SDP and ICE candidates of a session
+	// even before Listen() is run.
+	const inboxSize = 256
+
+	return &MQTT{
+		cfg:              cfg,
+		log:              cfg.Log,
+		broker:           &broker,
+		prefix:           prefix + "/" + hex.EncodeToString(sum[:16]),
+		pings:            make(map[string]bool),
+		pinged:           make(chan struct{}, 1),
+		inbox:            make(chan mqttMessage, inboxSize),
+		sdpHandler:       func([]byte) {},
+		candidateHandler: func([]byte) {},
+		natHandler:       func([]byte) {},
+	}, nil
+}
+
+// Listen dispatches received messages to handlers until ctx is done, retained
+// messages of an instance are cleared and a connection is closed then.
+func (s *MQTT) Listen(ctx context.Context) {
+	for {
+		select {
+		case msg := <-s.inbox:
+			switch msg.Type {
+			case fileIoFileContentTypeSDP:
+				s.sdpHandler(msg.Payload)
+			case fileIoFileContentTypeCandidate:
+				s.candidateHandler(msg.Payload)
+			case fileIoFileContentTypeNAT:
+				s.natHandler(msg.Payload)
+			default:
+				s.messages.dispatch(msg.Type, msg.Payload)
+			}
+		case <-ctx.Done():
+			if err := s.CleanUpInstance(); err != nil {
+				s.log.Error(err)
+			}
+
+			s.Close()
+
+			return
+		}
+	}
+}
+
+// Ping looks for a retained ping of the other candidate peer and clears it, or
+// retains a ping of this one for the other peer to find if there is none.
+func (s *MQTT) Ping() error {
+	client, err := s.connection()
+	if err != nil {
+		return err
+	}
+
+	s.mx.Lock()
+	wait := time.Until(s.subscribedAt.Add(mqttRetainedWait))
+	s.mx.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	others := s.otherPings()
+
+	for len(others) == 0 {
+		select {
+		case <-s.pinged:
+			others = s.otherPings()
+		case <-timer.C:
+			if err := s.publish(client, s.cfg.InstanceID, fileIoFileContentTypePing, []byte("1"), true); err != nil {
+				return err
+			}
+
+			return ErrNoCandidatesFound
+		}
+	}
+
+	for _, instance := range others {
+		if err := s.publish(client, instance, fileIoFileContentTypePing, nil, true); err != nil {
+			s.log.Error(err)
+		}
+	}
+
+	return nil
+}
+
+// otherPings returns instances whose pings are retained.
+func (s *MQTT) otherPings() []string {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	var instances []string
+
+	for instance := range s.pings {
+		instances = append(instances, instance)
+	}
+
+	return instances
+}
+
+func (s *MQTT) SendSDP(payload []byte) error {
+	return s.send(fileIoFileContentTypeSDP, payload, false)
+}
+
+func (s *MQTT) SendCandidate(payload []byte) error {
+	return s.send(fileIoFileContentTypeCandidate, payload, false)
+}
+
+// SendNAT tells the other peer a NAT type of this one, it's retained by a broker
+// until the other peer subscribes.
+func (s *MQTT) SendNAT(payload []byte) error {
+	return s.send(fileIoFileContentTypeNAT, payload, true)
+}
+
+func (s *MQTT) OnSDP(h func([]byte)) {
+	s.sdpHandler = h
+}
+
+func (s *MQTT) OnCandidate(h func([]byte)) {
+	s.candidateHandler = h
+}
+
+func (s *MQTT) OnNAT(h func([]byte)) {
+	s.natHandler = h
+}
+
+// Send sends the other peer a typed message of type typ (see:
+// peer.MessageSignal), it's delivered as SDP is.
+func (s *MQTT) Send(typ string, payload []byte) error {
+	ct, err := messageContentType(typ)
+	if err != nil {
+		return err
+	}
+
+	return s.send(ct, payload, false)
+}
+
+func (s *MQTT) On(typ string, h func([]byte)) {
+	s.messages.on(typ, h)
+}
+
+// CleanUpInstance clears a ping and a NAT type retained for InstanceID, e.g. by
+// a previous run that was killed.
+func (s *MQTT) CleanUpInstance() error {
+	client, err := s.connection()
+	if err != nil {
+		return err
+	}
+
+	for _, typ := range []fileIoFileContentType{fileIoFileContentTypePing, fileIoFileContentTypeNAT} {
+		if err := s.publish(client, s.cfg.InstanceID, typ, nil, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckAuth connects to a broker to make sure credentials are accepted.
+func (s *MQTT) CheckAuth() error {
+	defer s.Close()
+
+	_, err := s.connection()
+
+	return err
+}
+
+// Close disconnects from a broker.
+func (s *MQTT) Close() {
+	s.mx.Lock()
+	client := s.client
+	s.client = nil
+	s.mx.Unlock()
+
+	if client != nil {
+		client.Disconnect(250)
+	}
+}
+
+func (s *MQTT) send(typ fileIoFileContentType, payload []byte, retained bool) error {
+	client, err := s.connection()
+	if err != nil {
+		return err
+	}
+
+	return s.publish(client, s.cfg.InstanceID, typ, payload, retained)
+}
+
+// publish publishes a message of an instance, an empty retained one clears a
+// retained message.
+func (s *MQTT) publish(client mqtt.Client, instance string, typ fileIoFileContentType, payload []byte, retained bool) error {
+	token := client.Publish(s.topic(instance, typ), mqttQoS, retained, payload)
+
+	err := s.wait(token)
+	if err != nil {
+		metrics.Count("signal_request_errors", 1, "backend", "mqtt", "method", string(typ))
+
+		return errors.Wrap(err, "MQTT signaling")
+	}
+
+	metrics.Count("signal_requests", 1, "backend", "mqtt", "method", string(typ))
+
+	return nil
+}
+
+func (s *MQTT) topic(instance string, typ fileIoFileContentType) string {
+	return s.prefix + "/" + instance + "/" + string(typ)
+}
+
+// wait waits for a token to complete for Timeout at most.
+func (s *MQTT) wait(token mqtt.Token) error {
+	if !token.WaitTimeout(s.cfg.Timeout) {
+		return errors.New("timed out")
+	}
+
+	return token.Error()
+}
+
+// connection returns a client connected to a broker and subscribed to a session,
+// which is made if there is none yet. A client reconnects by itself once it's
+// connected, and subscribes again then.
+func (s *MQTT) connection() (mqtt.Client, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(s.broker.String()).
+		SetClientID(s.clientID()).
+		SetCleanSession(true).
+		SetAutoReconnect(true).
+		SetConnectTimeout(s.cfg.Timeout).
+		SetKeepAlive(30*time.Second).
+		SetOrderMatters(true).
+		SetBinaryWill(s.topic(s.cfg.InstanceID, fileIoFileContentTypePing), nil, mqttQoS, true).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			s.mx.Lock()
+			reconnected := s.connected
+			s.connected = true
+			s.mx.Unlock()
+
+			if reconnected {
+				if err := s.wait(c.Subscribe(s.prefix+"/+/+", mqttQoS, s.receive)); err != nil {
+					s.log.Error(errors.Wrap(err, "MQTT signaling"))
+				}
+			}
+		})
+
+	if s.broker.User != nil {
+		password, _ := s.broker.User.Password()
+
+		opts.SetUsername(s.broker.User.Username())
+		opts.SetPassword(password)
+	}
+
+	if s.broker.Scheme == "mqtt" || s.broker.Scheme == "mqtts" {
+		opts.SetCustomOpenConnectionFn(s.dial)
+	}
+
+	client := mqtt.NewClient(opts)
+
+	if err := s.wait(client.Connect()); err != nil {
+		return nil, errors.Wrap(err, "MQTT signaling")
+	}
+
+	if err := s.wait(client.Subscribe(s.prefix+"/+/+", mqttQoS, s.receive)); err != nil {
+		client.Disconnect(0)
+
+		return nil, errors.Wrap(err, "MQTT signaling")
+	}
+
+	s.log.WithField(log.FieldURL, s.broker.Redacted()).Debug("connected to MQTT signaling")
+
+	s.client = client
+	s.subscribedAt = time.Now()
+
+	return client, nil
+}
+
+// clientID returns a client ID unique for a connection, since a broker drops a
+// connection of a client once another one connects with the same ID (e.g. a
+// run resumed from a checkpoint while a previous signaling is closing). It fits
+// 23 characters, which any MQTT 3.1.1 broker accepts.
+func (s *MQTT) clientID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return "db-" + hex.EncodeToString(b)
+}
+
+// dial opens a connection to a broker through Proxy.
+func (s *MQTT) dial(u *url.URL, opts mqtt.ClientOptions) (net.Conn, error) {
+	dialer, err := proxy.NewDialer(s.cfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	if len(u.Port()) == 0 {
+		port := "1883"
+		if u.Scheme == "mqtts" {
+			port = "8883"
+		}
+
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	conn, err := dialer.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "mqtt" {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+
+	conn.SetDeadline(time.Now().Add(s.cfg.Timeout))
+
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+// receive handles a message of a session, messages of this instance are skipped.
+func (s *MQTT) receive(_ mqtt.Client, m mqtt.Message) {
+	parts := strings.Split(strings.TrimPrefix(m.Topic(), s.prefix+"/"), "/")
+	if len(parts) != 2 || parts[0] == s.cfg.InstanceID {
+		return
+	}
+
+	instance, typ := parts[0], fileIoFileContentType(parts[1])
+
+	s.log.WithFields(log.Fields{
+		log.FieldType:    typ,
+		log.FieldPayload: string(m.Payload()),
+	}).Trace("signaling message received")
+
+	switch typ {
+	case fileIoFileContentTypePing:
+		s.mx.Lock()
+		if len(m.Payload()) != 0 {
+			s.pings[instance] = true
+		} else {
+			delete(s.pings, instance)
+		}
+		s.mx.Unlock()
+
+		select {
+		case s.pinged <- struct{}{}:
+		default:
+		}
+	case fileIoFileContentTypeSDP, fileIoFileContentTypeCandidate, fileIoFileContentTypeNAT:
+		// A cleared retained message is empty.
+		if len(m.Payload()) != 0 {
+			s.inbox <- mqttMessage{Type: typ, Payload: m.Payload()}
+		}
+	default:
+		if isMessageContentType(typ) {
+			s.inbox <- mqttMessage{Type: typ, Payload: m.Payload()}
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package signal
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/google/uuid"
+)
+
+// newTestMQTTBroker runs an MQTT broker until a test ends and returns its
+// address.
+func newTestMQTTBroker(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	broker := &testMQTTBroker{
+		clients:  map[*testMQTTClient]struct{}{},
+		retained: map[string][]byte{},
+	}
+
+	go broker.serve(listener)
+
+	return listener.Addr().String()
+}
+
+// testMQTTBroker is an MQTT broker which serves what signaling needs only:
+// subscriptions with wildcards, retained messages and wills. Messages are
+// delivered with QoS 0.
+type testMQTTBroker struct {
+	mx       sync.Mutex
+	clients  map[*testMQTTClient]struct{}
+	retained map[string][]byte
+}
+
+type testMQTTClient struct {
+	mx      sync.Mutex
+	conn    net.Conn
+	filters []string
+}
+
+func (c *testMQTTClient) write(p packets.ControlPacket) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	p.Write(c.conn)
+}
+
+func (b *testMQTTBroker) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go b.serveConn(conn)
+	}
+}
+
+func (b *testMQTTBroker) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	c := &testMQTTClient{conn: conn}
+
+	var will *packets.PublishPacket
+
+	defer func() {
+		b.mx.Lock()
+		delete(b.clients, c)
+		b.mx.Unlock()
+
+		if will != nil {
+			b.publish(will)
+		}
+	}()
+
+	for {
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		switch p := p.(type) {
+		case *packets.ConnectPacket:
+			if p.WillFlag {
+				will = packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				will.TopicName = p.WillTopic
+				will.Payload = p.WillMessage
+				will.Retain = p.WillRetain
+			}
+
+			b.mx.Lock()
+			b.clients[c] = struct{}{}
+			b.mx.Unlock()
+
+			c.write(packets.NewControlPacket(packets.Connack))
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			ack.ReturnCodes = make([]byte, len(p.Topics))
+
+			b.mx.Lock()
+			c.mx.Lock()
+			c.filters = append(c.filters, p.Topics...)
+			c.mx.Unlock()
+
+			var retained []*packets.PublishPacket
+
+			for topic, payload := range b.retained {
+				if testMQTTMatch(p.Topics, topic) {
+					m := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+					m.TopicName = topic
+					m.Payload = payload
+					m.Retain = true
+					retained = append(retained, m)
+				}
+			}
+			b.mx.Unlock()
+
+			c.write(ack)
+
+			for _, m := range retained {
+				c.write(m)
+			}
+		case *packets.PublishPacket:
+			if p.Qos > 0 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				c.write(ack)
+			}
+
+			b.publish(p)
+		case *packets.PingreqPacket:
+			c.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			will = nil
+
+			return
+		}
+	}
+}
+
+// publish retains a message if it's asked to, an empty one clears a retained
+// message, and delivers it to clients subscribed to its topic.
+func (b *testMQTTBroker) publish(p *packets.PublishPacket) {
+	b.mx.Lock()
+
+	if p.Retain && len(p.Payload) == 0 {
+		delete(b.retained, p.TopicName)
+	} else if p.Retain {
+		b.retained[p.TopicName] = p.Payload
+	}
+
+	var subscribers []*testMQTTClient
+
+	for c := range b.clients {
+		c.mx.Lock()
+		if testMQTTMatch(c.filters, p.TopicName) {
+			subscribers = append(subscribers, c)
+		}
+		c.mx.Unlock()
+	}
+
+	b.mx.Unlock()
+
+	for _, c := range subscribers {
+		m := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		m.TopicName = p.TopicName
+		m.Payload = p.Payload
+		c.write(m)
+	}
+}
+
+// testMQTTMatch tells whether a topic matches any of filters with "+" and
+// "#" wildcards.
+func testMQTTMatch(filters []string, topic string) bool {
+	levels := strings.Split(topic, "/")
+
+	for _, filter := range filters {
+		parts := strings.Split(filter, "/")
+
+		for i, part := range parts {
+			if part == "#" {
+				return true
+			}
+
+			if i >= len(levels) || (part != "+" && part != levels[i]) {
+				break
+			}
+
+			if i == len(parts)-1 && i == len(levels)-1 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func TestMQTTExchange(t *testing.T) {
+	addr := newTestMQTTBroker(t)
+	sessionID := uuid.NewString()
+
+	newMQTT := func() *MQTT {
+		s, err := NewMQTT(MQTTConfig{
+			URL:        "mqtt://" + addr + "?topic=test",
+			SessionID:  sessionID,
+			InstanceID: uuid.NewString(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	}
+
+	testExchange(t, newMQTT(), newMQTT())
+}
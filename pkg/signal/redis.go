@@ -0,0 +1,721 @@
+// Redis is a p2p signaling implementation that uses a Redis server a user already
+// runs. Candidate peers of a session subscribe to a pub/sub channel of a session,
+// so messages are pushed to them as soon as they are published.
+//
+// Keys and a channel are named "${Prefix}:${Key}:..." where Key is derived from
+// SessionID, so that a session UUID isn't revealed to other clients of a server.
+// Messages are published to the "${Prefix}:${Key}:messages" channel as JSON
+// structures with fields "instance", "type" and "payload" (see: type
+// fileIoFileContentType). A ping is the "${Prefix}:${Key}:ping" key holding an
+// instance which waits for the other one, and NAT types are kept in the
+// "${Prefix}:${Key}:nat" hash, since pub/sub drops messages published while the
+// other peer isn't subscribed yet. Both expire in 10 minutes, as FILE.io files.
+
+package signal
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/metrics"
+	"distributed-backup/pkg/proxy"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultRedisTimeout   = 30 * time.Second
+	defaultRedisKeyPrefix = "distributed-backup"
+	// redisKeyTTL is a time keys of a session are kept for.
+	redisKeyTTL = 10 * time.Minute
+	// redisKeepAliveInterval is an interval a subscription is pinged at, so
+	// that an idle connection isn't dropped.
+	redisKeepAliveInterval = 30 * time.Second
+	// redisRetryDelay is a delay a dropped subscription is made again after.
+	redisRetryDelay = time.Second
+)
+
+type Redis struct {
+	cfg    RedisConfig
+	log    log.Logger
+	server *url.URL
+	prefix string
+
+	mx  sync.Mutex
+	cmd *redisConn
+	sub *redisConn
+	// subscribed is closed once a channel is subscribed to for the first time.
+	subscribed chan struct{}
+	started    bool
+	closed     bool
+
+	inbox chan redisMessage
+
+	sdpHandler       func([]byte)
+	candidateHandler func([]byte)
+	natHandler       func([]byte)
+	messages         messageHandlers
+}
+
+type RedisConfig struct {
+	// URL is a URL of a server presented as
+	// "redis[s]://[[user]:password@]host[:port][/db]", a key prefix is taken
+	// from a "prefix" query parameter, default is defaultRedisKeyPrefix.
+	URL        string
+	SessionID  string
+	InstanceID string
+	// Timeout bounds connecting to a server and a command, default is 30 seconds.
+	Timeout time.Duration
+	// Proxy is a proxy connections are made through, the ALL_PROXY environment
+	// variable is used if nil.
+	Proxy *url.URL
+	// Log is a logger entries are written with (e.g. with session fields attached),
+	// the global logger is used if nil.
+	Log log.Logger
+}
+
+type redisMessage struct {
+	Instance string                `json:"instance"`
+	Type     fileIoFileContentType `json:"type"`
+	Payload  []byte                `json:"payload,omitempty"`
+}
+
+func NewRedis(cfg RedisConfig) (*Redis, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, errors.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+
+	if len(u.Host) == 0 {
+		return nil, errors.New("host is empty")
+	}
+
+	if db := strings.Trim(u.Path, "/"); len(db) != 0 {
+		if _, err := strconv.Atoi(db); err != nil {
+			return nil, errors.Errorf("invalid database: %s", db)
+		}
+	}
+
+	if len(cfg.SessionID) == 0 {
+		return nil, errors.New("session ID is empty")
+	}
+
+	if len(cfg.InstanceID) == 0 {
+		return nil, errors.New("instance ID is empty")
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultRedisTimeout
+	}
+
+	if cfg.Log == nil {
+		cfg.Log = log.New()
+	}
+
+	prefix := u.Query().Get("prefix")
+	if len(prefix) == 0 {
+		prefix = defaultRedisKeyPrefix
+	}
+
+	sum := sha256.Sum256([]byte(cfg.SessionID))
+
+	// The inbox is big enough to hold all SDP and ICE candidates of a session
+	// even before Listen() is run.
+	const inboxSize = 256
+
+	return &Redis{
+		cfg:              cfg,
+		log:              cfg.Log,
+		server:           u,
+		prefix:           prefix + ":" + hex.EncodeToString(sum[:16]),
+		subscribed:       make(chan struct{}),
+		inbox:            make(chan redisMessage, inboxSize),
+		sdpHandler:       func([]byte) {},
+		candidateHandler: func([]byte) {},
+		natHandler:       func([]byte) {},
+	}, nil
+}
+
+// Listen dispatches received messages to handlers and keeps a subscription
+// alive until ctx is done, a ping and a NAT type of an instance are removed and
+// connections are closed then.
+func (s *Redis) Listen(ctx context.Context) {
+	ticker := time.NewTicker(redisKeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg := <-s.inbox:
+			switch msg.Type {
+			case fileIoFileContentTypeSDP:
+				s.sdpHandler(msg.Payload)
+			case fileIoFileContentTypeCandidate:
+				s.candidateHandler(msg.Payload)
+			case fileIoFileContentTypeNAT:
+				s.natHandler(msg.Payload)
+			default:
+				s.messages.dispatch(msg.Type, msg.Payload)
+			}
+		case <-ticker.C:
+			s.keepAlive()
+		case <-ctx.Done():
+			if err := s.CleanUpInstance(); err != nil {
+				s.log.Error(err)
+			}
+
+			s.Close()
+
+			return
+		}
+	}
+}
+
+// Ping takes a ping of the other candidate peer, or leaves a ping of this one
+// for the other peer to take if there is none. A ping is set only if there is
+// none, so peers pinging at once never both wait.
+func (s *Redis) Ping() error {
+	if err := s.subscribe(); err != nil {
+		return err
+	}
+
+	key := s.key("ping")
+	ttl := strconv.Itoa(int(redisKeyTTL / time.Second))
+
+	reply, err := s.do("set", key, s.cfg.InstanceID, "NX", "EX", ttl)
+	if err != nil {
+		return err
+	}
+
+	if reply != nil {
+		return ErrNoCandidatesFound
+	}
+
+	reply, err = s.do("get", key)
+	if err != nil {
+		return err
+	}
+
+	// A ping left by a previous run of this instance is taken over.
+	if instance, _ := reply.(string); instance == s.cfg.InstanceID {
+		if _, err := s.do("set", key, s.cfg.InstanceID, "EX", ttl); err != nil {
+			return err
+		}
+
+		return ErrNoCandidatesFound
+	}
+
+	if _, err := s.do("del", key); err != nil {
+		s.log.Error(err)
+	}
+
+	return nil
+}
+
+func (s *Redis) SendSDP(payload []byte) error {
+	return s.publish(fileIoFileContentTypeSDP, payload)
+}
+
+func (s *Redis) SendCandidate(payload []byte) error {
+	return s.publish(fileIoFileContentTypeCandidate, payload)
+}
+
+// SendNAT tells the other peer a NAT type of this one, it's kept in a hash for
+// the other peer to read once it subscribes, and is published for one which
+// already has.
+func (s *Redis) SendNAT(payload []byte) error {
+	if err := s.subscribe(); err != nil {
+		return err
+	}
+
+	key := s.key("nat")
+
+	if _, err := s.do("hset", key, s.cfg.InstanceID, string(payload)); err != nil {
+		return err
+	}
+
+	if _, err := s.do("expire", key, strconv.Itoa(int(redisKeyTTL/time.Second))); err != nil {
+		return err
+	}
+
+	return s.publish(fileIoFileContentTypeNAT, payload)
+}
+
+func (s *Redis) OnSDP(h func([]byte)) {
+	s.sdpHandler = h
+}
+
+func (s *Redis) OnCandidate(h func([]byte)) {
+	s.candidateHandler = h
+}
+
+func (s *Redis) OnNAT(h func([]byte)) {
+	s.natHandler = h
+}
+
+// Send sends the other peer a typed message of type typ (see:
+// peer.MessageSignal), it's delivered as SDP is.
+func (s *Redis) Send(typ string, payload []byte) error {
+	ct, err := messageContentType(typ)
+	if err != nil {
+		return err
+	}
+
+	return s.publish(ct, payload)
+}
+
+func (s *Redis) On(typ string, h func([]byte)) {
+	s.messages.on(typ, h)
+}
+
+// CleanUpInstance removes a ping and a NAT type of InstanceID, e.g. left by a
+// previous run that was killed. A ping is removed only if it's of InstanceID.
+func (s *Redis) CleanUpInstance() error {
+	key := s.key("ping")
+
+	reply, err := s.do("get", key)
+	if err != nil {
+		return err
+	}
+
+	if instance, _ := reply.(string); instance == s.cfg.InstanceID {
+		if _, err := s.do("del", key); err != nil {
+			return err
+		}
+	}
+
+	_, err = s.do("hdel", s.key("nat"), s.cfg.InstanceID)
+
+	return err
+}
+
+// CheckAuth pings a server to make sure credentials are accepted.
+func (s *Redis) CheckAuth() error {
+	defer s.Close()
+
+	_, err := s.do("ping")
+
+	return err
+}
+
+// Close closes connections to a server.
+func (s *Redis) Close() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.closed = true
+
+	for _, c := range []*redisConn{s.cmd, s.sub} {
+		if c != nil {
+			c.Close()
+		}
+	}
+
+	s.cmd, s.sub = nil, nil
+}
+
+func (s *Redis) key(name string) string {
+	return s.prefix + ":" + name
+}
+
+func (s *Redis) publish(typ fileIoFileContentType, payload []byte) error {
+	if err := s.subscribe(); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(&redisMessage{
+		Instance: s.cfg.InstanceID,
+		Type:     typ,
+		Payload:  payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.do("publish", s.key("messages"), string(b))
+
+	return err
+}
+
+// do runs a command on a connection which is made if there is none yet or the
+// previous one failed.
+func (s *Redis) do(args ...string) (interface{}, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.cmd == nil {
+		c, err := s.dial()
+		if err != nil {
+			metrics.Count("signal_request_errors", 1, "backend", "redis", "method", args[0])
+
+			return nil, errors.Wrap(err, "Redis signaling")
+		}
+
+		s.cmd = c
+	}
+
+	reply, err := s.cmd.do(s.cfg.Timeout, args...)
+	if err != nil {
+		var redisErr redisError
+		if !errors.As(err, &redisErr) {
+			s.cmd.Close()
+			s.cmd = nil
+		}
+
+		metrics.Count("signal_request_errors", 1, "backend", "redis", "method", args[0])
+
+		return nil, errors.Wrapf(err, "Redis signaling: %s", args[0])
+	}
+
+	metrics.Count("signal_requests", 1, "backend", "redis", "method", args[0])
+
+	return reply, nil
+}
+
+// subscribe starts receiving messages of a session and waits for a channel to
+// be subscribed to for the first time.
+func (s *Redis) subscribe() error {
+	s.mx.Lock()
+	if !s.started {
+		s.started = true
+
+		go s.receive()
+	}
+	s.mx.Unlock()
+
+	select {
+	case <-s.subscribed:
+		return nil
+	case <-time.After(s.cfg.Timeout):
+		return errors.New("Redis signaling: timed out subscribing")
+	}
+}
+
+// receive subscribes to a channel of a session and receives messages until a
+// signaling is closed, a dropped subscription is made again.
+func (s *Redis) receive() {
+	var once sync.Once
+
+	for {
+		err := s.receiveOnce(func() {
+			once.Do(func() { close(s.subscribed) })
+		})
+
+		s.mx.Lock()
+		closed := s.closed
+		s.mx.Unlock()
+
+		if closed {
+			return
+		}
+
+		s.log.Error(errors.Wrap(err, "Redis signaling"))
+
+		time.Sleep(redisRetryDelay)
+	}
+}
+
+func (s *Redis) receiveOnce(subscribed func()) error {
+	c, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	s.mx.Lock()
+	if s.closed {
+		s.mx.Unlock()
+
+		return nil
+	}
+	s.sub = c
+	s.mx.Unlock()
+
+	if err := c.send(s.cfg.Timeout, "subscribe", s.key("messages")); err != nil {
+		return err
+	}
+
+	for {
+		reply, err := c.read(0)
+		if err != nil {
+			return err
+		}
+
+		event, _ := reply.([]interface{})
+		if len(event) < 2 {
+			continue
+		}
+
+		kind, _ := event[0].(string)
+
+		switch {
+		case kind == "subscribe":
+			// NAT types sent before a channel is subscribed to are read from
+			// a hash.
+			s.readNAT()
+
+			subscribed()
+		case kind == "message" && len(event) == 3:
+			payload, _ := event[2].(string)
+
+			var msg redisMessage
+
+			if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+				s.log.Error(errors.Wrap(err, "Redis signaling: malformed message"))
+
+				continue
+			}
+
+			if msg.Instance == s.cfg.InstanceID {
+				continue
+			}
+
+			s.log.WithFields(log.Fields{
+				log.FieldType:    msg.Type,
+				log.FieldPayload: string(msg.Payload),
+			}).Trace("signaling message received")
+
+			s.inbox <- msg
+		}
+	}
+}
+
+// readNAT passes NAT types of other instances kept in a hash to the inbox.
+func (s *Redis) readNAT() {
+	reply, err := s.do("hgetall", s.key("nat"))
+	if err != nil {
+		s.log.Error(err)
+
+		return
+	}
+
+	fields, _ := reply.([]interface{})
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		instance, _ := fields[i].(string)
+		nat, _ := fields[i+1].(string)
+
+		if instance != s.cfg.InstanceID {
+			s.inbox <- redisMessage{Instance: instance, Type: fileIoFileContentTypeNAT, Payload: []byte(nat)}
+		}
+	}
+}
+
+// keepAlive pings a subscription, a reply is read by receive().
+func (s *Redis) keepAlive() {
+	s.mx.Lock()
+	c := s.sub
+	s.mx.Unlock()
+
+	if c != nil {
+		if err := c.send(s.cfg.Timeout, "ping"); err != nil {
+			c.Close()
+		}
+	}
+}
+
+// dial connects to a server, authenticates and selects a database.
+func (s *Redis) dial() (*redisConn, error) {
+	dialer, err := proxy.NewDialer(s.cfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	host := s.server.Host
+	if len(s.server.Port()) == 0 {
+		host = net.JoinHostPort(s.server.Hostname(), "6379")
+	}
+
+	conn, err := dialer.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.server.Scheme == "rediss" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: s.server.Hostname()})
+
+		conn.SetDeadline(time.Now().Add(s.cfg.Timeout))
+
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+
+			return nil, err
+		}
+
+		conn.SetDeadline(time.Time{})
+
+		conn = tlsConn
+	}
+
+	c := newRedisConn(conn)
+
+	if s.server.User != nil {
+		args := []string{"auth"}
+
+		password, ok := s.server.User.Password()
+		if user := s.server.User.Username(); len(user) != 0 && ok {
+			args = append(args, user, password)
+		} else if ok {
+			args = append(args, password)
+		} else {
+			args = append(args, user)
+		}
+
+		if _, err := c.do(s.cfg.Timeout, args...); err != nil {
+			c.Close()
+
+			return nil, err
+		}
+	}
+
+	if db := strings.Trim(s.server.Path, "/"); len(db) != 0 {
+		if _, err := c.do(s.cfg.Timeout, "select", db); err != nil {
+			c.Close()
+
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// redisConn is a connection to a Redis server speaking RESP2.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	wmx  sync.Mutex
+}
+
+// redisError is an error reply of a server.
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+func newRedisConn(conn net.Conn) *redisConn {
+	return &redisConn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+}
+
+// do sends a command and reads a reply within timeout.
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	if err := c.send(timeout, args...); err != nil {
+		return nil, err
+	}
+
+	return c.read(timeout)
+}
+
+// send sends a command as an array of bulk strings.
+func (c *redisConn) send(timeout time.Duration, args ...string) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	c.wmx.Lock()
+	defer c.wmx.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+
+	_, err := io.WriteString(c.conn, b.String())
+
+	return err
+}
+
+// read reads a reply within timeout, or waiting for it as long as it takes if
+// timeout is 0. Simple and bulk strings are returned as strings, integers as
+// int64, arrays as []interface{}, nulls as nil and errors as redisError.
+func (c *redisConn) read(timeout time.Duration) (interface{}, error) {
+	if timeout != 0 {
+		c.conn.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		c.conn.SetReadDeadline(time.Time{})
+	}
+
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("malformed reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.New("malformed reply")
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.New("malformed reply")
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		items := make([]interface{}, n)
+
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+
+		return items, nil
+	default:
+		return nil, errors.Errorf("unexpected reply: %q", line)
+	}
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
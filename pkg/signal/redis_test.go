@@ -0,0 +1,259 @@
+package signal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// newTestRedisServer runs a Redis server until a test ends and returns its
+// address.
+func newTestRedisServer(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &testRedisServer{
+		strings:     map[string]string{},
+		hashes:      map[string]map[string]string{},
+		subscribers: map[string][]*testRedisClient{},
+	}
+
+	go server.serve(listener)
+
+	return listener.Addr().String()
+}
+
+// testRedisServer is a Redis server which serves commands signaling needs
+// only, keys never expire.
+type testRedisServer struct {
+	mx          sync.Mutex
+	strings     map[string]string
+	hashes      map[string]map[string]string
+	subscribers map[string][]*testRedisClient
+}
+
+type testRedisClient struct {
+	mx   sync.Mutex
+	conn net.Conn
+}
+
+// write writes a reply: a string as a bulk string, nil as a null, an int as an
+// integer, a []string as an array, an error as an error.
+func (c *testRedisClient) write(reply interface{}) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	var b strings.Builder
+
+	testRedisReply(&b, reply)
+	io.WriteString(c.conn, b.String())
+}
+
+func testRedisReply(b *strings.Builder, reply interface{}) {
+	switch reply := reply.(type) {
+	case nil:
+		b.WriteString("$-1\r\n")
+	case string:
+		fmt.Fprintf(b, "$%d\r\n%s\r\n", len(reply), reply)
+	case int:
+		fmt.Fprintf(b, ":%d\r\n", reply)
+	case []string:
+		fmt.Fprintf(b, "*%d\r\n", len(reply))
+
+		for _, item := range reply {
+			testRedisReply(b, item)
+		}
+	case error:
+		fmt.Fprintf(b, "-ERR %s\r\n", reply)
+	}
+}
+
+func (s *testRedisServer) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+func (s *testRedisServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	c := &testRedisClient{conn: conn}
+	r := bufio.NewReader(conn)
+
+	defer func() {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+
+		for channel, subscribers := range s.subscribers {
+			kept := subscribers[:0]
+
+			for _, subscriber := range subscribers {
+				if subscriber != c {
+					kept = append(kept, subscriber)
+				}
+			}
+
+			s.subscribers[channel] = kept
+		}
+	}()
+
+	for {
+		args, err := testRedisCommand(r)
+		if err != nil {
+			return
+		}
+
+		c.write(s.do(c, args))
+	}
+}
+
+// do runs a command of a client and returns a reply.
+func (s *testRedisServer) do(c *testRedisClient, args []string) interface{} {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	switch cmd := strings.ToLower(args[0]); {
+	case cmd == "ping":
+		return "PONG"
+	case cmd == "select":
+		return "OK"
+	case cmd == "set" && len(args) >= 3:
+		if _, ok := s.strings[args[1]]; ok && len(args) > 3 && strings.EqualFold(args[3], "NX") {
+			return nil
+		}
+
+		s.strings[args[1]] = args[2]
+
+		return "OK"
+	case cmd == "get" && len(args) == 2:
+		if v, ok := s.strings[args[1]]; ok {
+			return v
+		}
+
+		return nil
+	case cmd == "del" && len(args) == 2:
+		delete(s.strings, args[1])
+		delete(s.hashes, args[1])
+
+		return 1
+	case cmd == "expire":
+		return 1
+	case cmd == "hset" && len(args) == 4:
+		if s.hashes[args[1]] == nil {
+			s.hashes[args[1]] = map[string]string{}
+		}
+
+		s.hashes[args[1]][args[2]] = args[3]
+
+		return 1
+	case cmd == "hdel" && len(args) == 3:
+		delete(s.hashes[args[1]], args[2])
+
+		return 1
+	case cmd == "hgetall" && len(args) == 2:
+		fields := []string{}
+
+		for k, v := range s.hashes[args[1]] {
+			fields = append(fields, k, v)
+		}
+
+		return fields
+	case cmd == "publish" && len(args) == 3:
+		subscribers := s.subscribers[args[1]]
+
+		for _, subscriber := range subscribers {
+			subscriber.write([]string{"message", args[1], args[2]})
+		}
+
+		return len(subscribers)
+	case cmd == "subscribe" && len(args) == 2:
+		s.subscribers[args[1]] = append(s.subscribers[args[1]], c)
+
+		// A confirmation is an array with an integer, which a client doesn't read.
+		return []string{"subscribe", args[1]}
+	default:
+		return errors.Errorf("unknown command %q", cmd)
+	}
+}
+
+// testRedisCommand reads a command sent as an array of bulk strings.
+func testRedisCommand(r *bufio.Reader) ([]string, error) {
+	readLine := func(prefix byte) (int, error) {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+
+		line = strings.TrimSuffix(line, "\r\n")
+		if len(line) == 0 || line[0] != prefix {
+			return 0, errors.Errorf("malformed command: %q", line)
+		}
+
+		return strconv.Atoi(line[1:])
+	}
+
+	n, err := readLine('*')
+	if err != nil {
+		return nil, err
+	}
+
+	if n < 1 {
+		return nil, errors.New("empty command")
+	}
+
+	args := make([]string, n)
+
+	for i := range args {
+		size, err := readLine('$')
+		if err != nil {
+			return nil, err
+		}
+
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+
+		args[i] = string(b[:size])
+	}
+
+	return args, nil
+}
+
+func TestRedisExchange(t *testing.T) {
+	addr := newTestRedisServer(t)
+	sessionID := uuid.NewString()
+
+	newRedis := func() *Redis {
+		s, err := NewRedis(RedisConfig{
+			URL:        "redis://" + addr + "/0?prefix=test",
+			SessionID:  sessionID,
+			InstanceID: uuid.NewString(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	}
+
+	testExchange(t, newRedis(), newRedis())
+}
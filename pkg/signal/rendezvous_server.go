@@ -0,0 +1,48 @@
+package signal
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"distributed-backup/pkg/log"
+)
+
+type RendezvousServerConfig struct {
+	// Token is a bearer token clients are required to send, any client is
+	// accepted if it's empty.
+	Token string
+	// BacklogTTL is a time a message waiting for a peer is kept for, default is
+	// 10 minutes.
+	BacklogTTL time.Duration
+	// Log is a logger entries are written with, the global logger is used if nil.
+	Log log.Logger
+}
+
+// NewRendezvousServer returns a handler serving both the WebSocket signaling
+// (see: WebSocketServer) and the HTTP one (see: HTTPRendezvousServer), so that
+// a single server is run for peers of either of them. Requests to paths having
+// "/sessions/" in them are served by the HTTP server.
+func NewRendezvousServer(cfg RendezvousServerConfig) http.Handler {
+	ws := NewWebSocketServer(WebSocketServerConfig{
+		Token:      cfg.Token,
+		BacklogTTL: cfg.BacklogTTL,
+		Log:        cfg.Log,
+	})
+
+	mailboxes := NewHTTPRendezvousServer(HTTPRendezvousServerConfig{
+		Token:      cfg.Token,
+		BacklogTTL: cfg.BacklogTTL,
+		Log:        cfg.Log,
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/sessions/") {
+			mailboxes.ServeHTTP(w, r)
+
+			return
+		}
+
+		ws.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,80 @@
+package signal
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+const testRendezvousToken = "test-signal-token"
+
+func newTestRendezvousServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(NewRendezvousServer(RendezvousServerConfig{
+		Token: testRendezvousToken,
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestWebSocketExchange(t *testing.T) {
+	server := newTestRendezvousServer(t)
+	sessionID := uuid.NewString()
+
+	newWebSocket := func() *WebSocket {
+		s, err := NewWebSocket(WebSocketConfig{
+			URL:        strings.Replace(server.URL, "http", "ws", 1),
+			Token:      testRendezvousToken,
+			SessionID:  sessionID,
+			InstanceID: uuid.NewString(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	}
+
+	testExchange(t, newWebSocket(), newWebSocket())
+}
+
+func TestHTTPRendezvousExchange(t *testing.T) {
+	server := newTestRendezvousServer(t)
+	sessionID := uuid.NewString()
+
+	newHTTPRendezvous := func() *HTTPRendezvous {
+		s, err := NewHTTPRendezvous(HTTPRendezvousConfig{
+			URL:        server.URL + "/signal/",
+			Token:      testRendezvousToken,
+			SessionID:  sessionID,
+			InstanceID: uuid.NewString(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	}
+
+	testExchange(t, newHTTPRendezvous(), newHTTPRendezvous())
+}
+
+func TestRendezvousRefusesWrongToken(t *testing.T) {
+	server := newTestRendezvousServer(t)
+
+	s, err := NewHTTPRendezvous(HTTPRendezvousConfig{
+		URL:        server.URL + "/signal/",
+		Token:      "wrong-token",
+		SessionID:  uuid.NewString(),
+		InstanceID: uuid.NewString(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Ping(); err == nil {
+		t.Error("peer with a wrong token is let in")
+	}
+}
@@ -0,0 +1,386 @@
+// S3 is a p2p signaling implementation that keeps messages in a bucket of an S3
+// compatible storage (e.g. AWS S3 or MinIO), so that a bucket a user already has
+// replaces a FILE.io account. As with FileIo, a bucket is polled for messages of
+// the other candidate peer.
+//
+// A message is an object named "${SessionID}/${InstanceID}/${Seq}_${Type}.json"
+// under a path of a bucket URL, where Seq is a zero-padded sequence number, so
+// that messages of an instance are listed in the order they are sent, and Type
+// is one of the predefined values (see: type fileIoFileContentType). Content is
+// a JSON structure with fields "type" and "payload" as in FILE.io files. A
+// message is removed once it's received, and all messages of a session are
+// removed once signaling is over.
+
+package signal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/metrics"
+	"distributed-backup/pkg/upload"
+
+	"github.com/pkg/errors"
+)
+
+const defaultS3PollInterval = time.Second
+
+type S3 struct {
+	cfg    S3Config
+	log    log.Logger
+	bucket *upload.Bucket
+
+	mx  sync.Mutex
+	seq int64
+	// received are names of messages which are received but may have failed to
+	// be removed, so that they aren't handled twice.
+	received map[string]bool
+
+	sdpHandler       func([]byte)
+	candidateHandler func([]byte)
+	natHandler       func([]byte)
+	messages         messageHandlers
+}
+
+type S3Config struct {
+	// URL is a location messages are kept in presented as
+	// "s3[+http]://[key:secret@]host[:port]/bucket[/path][?region=region]",
+	// credentials are taken from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+	// environment variables if a URL has none.
+	URL        string
+	SessionID  string
+	InstanceID string
+	// PollInterval is a period a bucket is listed for new messages every, default
+	// is defaultS3PollInterval.
+	PollInterval time.Duration
+	// RequestTimeout bounds waiting for a response, default is 30 seconds.
+	RequestTimeout time.Duration
+	// Proxy is a proxy requests are made through, proxy environment variables
+	// are used if nil.
+	Proxy *url.URL
+	// Log is a logger entries are written with (e.g. with session fields attached),
+	// the global logger is used if nil.
+	Log log.Logger
+}
+
+func NewS3(cfg S3Config) (*S3, error) {
+	if len(cfg.SessionID) == 0 {
+		return nil, errors.New("session ID is empty")
+	}
+
+	if len(cfg.InstanceID) == 0 {
+		return nil, errors.New("instance ID is empty")
+	}
+
+	if cfg.Log == nil {
+		cfg.Log = log.New()
+	}
+
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = defaultS3PollInterval
+	}
+
+	bucket, err := upload.NewBucket(upload.Config{
+		URL:     cfg.URL,
+		Timeout: cfg.RequestTimeout,
+		Proxy:   cfg.Proxy,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3{
+		cfg:              cfg,
+		log:              cfg.Log,
+		bucket:           bucket,
+		received:         map[string]bool{},
+		sdpHandler:       func([]byte) {},
+		candidateHandler: func([]byte) {},
+		natHandler:       func([]byte) {},
+	}, nil
+}
+
+func (s *S3) Listen(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+OUTER:
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.receive(ctx); err != nil && ctx.Err() == nil {
+				s.log.Error(err)
+			}
+		case <-ctx.Done():
+			break OUTER
+		}
+	}
+
+	// Objects are cleaned up after ctx is done.
+	cleanUpCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	s.cleanUp(cleanUpCtx)
+}
+
+// Ping looks for a ping of the other candidate peer and removes it, or leaves a
+// ping of this one for the other peer to find if there is none.
+func (s *S3) Ping() error {
+	ctx := context.Background()
+
+	names, err := s.list(ctx, s.cfg.SessionID+"/")
+	if err != nil {
+		return err
+	}
+
+	var pings []string
+
+	for _, name := range names {
+		instance, typ, ok := s.parseName(name)
+		if ok && instance != s.cfg.InstanceID && typ == fileIoFileContentTypePing {
+			pings = append(pings, name)
+		}
+	}
+
+	if len(pings) == 0 {
+		if err := s.send(ctx, fileIoFileContentTypePing, nil); err != nil {
+			return err
+		}
+
+		return ErrNoCandidatesFound
+	}
+
+	for _, name := range pings {
+		if err := s.remove(ctx, name); err != nil {
+			s.log.Error(err)
+		}
+	}
+
+	return nil
+}
+
+func (s *S3) SendSDP(payload []byte) error {
+	return s.send(context.Background(), fileIoFileContentTypeSDP, payload)
+}
+
+func (s *S3) SendCandidate(payload []byte) error {
+	return s.send(context.Background(), fileIoFileContentTypeCandidate, payload)
+}
+
+// SendNAT tells the other peer a NAT type of this one, it's kept until the other
+// peer receives it.
+func (s *S3) SendNAT(payload []byte) error {
+	return s.send(context.Background(), fileIoFileContentTypeNAT, payload)
+}
+
+func (s *S3) OnSDP(h func([]byte)) {
+	s.sdpHandler = h
+}
+
+func (s *S3) OnCandidate(h func([]byte)) {
+	s.candidateHandler = h
+}
+
+func (s *S3) OnNAT(h func([]byte)) {
+	s.natHandler = h
+}
+
+// Send sends the other peer a typed message of type typ (see:
+// peer.MessageSignal), it's delivered as SDP is.
+func (s *S3) Send(typ string, payload []byte) error {
+	ct, err := messageContentType(typ)
+	if err != nil {
+		return err
+	}
+
+	return s.send(context.Background(), ct, payload)
+}
+
+func (s *S3) On(typ string, h func([]byte)) {
+	s.messages.on(typ, h)
+}
+
+// CheckAuth lists a session to make sure a bucket is reachable with given
+// credentials without storing anything.
+func (s *S3) CheckAuth() error {
+	_, err := s.list(context.Background(), s.cfg.SessionID+"/")
+
+	return err
+}
+
+// CleanUpInstance removes messages sent with InstanceID within a session, e.g.
+// left by a previous run that was killed before cleaning up.
+func (s *S3) CleanUpInstance() error {
+	ctx := context.Background()
+
+	names, err := s.list(ctx, path.Join(s.cfg.SessionID, s.cfg.InstanceID)+"/")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := s.remove(ctx, name); err != nil {
+			s.log.Error(err)
+		}
+	}
+
+	return nil
+}
+
+// send stores a message under a sequence number greater than ones of previous
+// messages, including ones sent by a previous run of an instance.
+func (s *S3) send(ctx context.Context, typ fileIoFileContentType, payload []byte) error {
+	b, err := json.Marshal(&fileIoFileContent{
+		Type:    typ,
+		Payload: payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mx.Lock()
+	s.seq++
+	if now := time.Now().UnixNano(); now > s.seq {
+		s.seq = now
+	}
+	seq := s.seq
+	s.mx.Unlock()
+
+	name := path.Join(s.cfg.SessionID, s.cfg.InstanceID, fmt.Sprintf("%020d_%s.json", seq, typ))
+
+	err = s.bucket.Put(ctx, name, b)
+	s.count("put", string(typ), err)
+
+	return err
+}
+
+// receive handles messages of other instances of a session in the order they
+// were sent, pings are left for Ping().
+func (s *S3) receive(ctx context.Context) error {
+	names, err := s.list(ctx, s.cfg.SessionID+"/")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		instance, typ, ok := s.parseName(name)
+		if !ok || instance == s.cfg.InstanceID || typ == fileIoFileContentTypePing {
+			continue
+		}
+
+		s.mx.Lock()
+		received := s.received[name]
+		s.mx.Unlock()
+
+		if received {
+			continue
+		}
+
+		b, err := s.bucket.Get(ctx, name)
+		s.count("get", string(typ), err)
+
+		if err != nil {
+			s.log.Error(err)
+
+			continue
+		}
+
+		content := &fileIoFileContent{}
+		if err := json.Unmarshal(b, content); err != nil {
+			s.log.Error(errors.Wrapf(err, "malformed message %s", name))
+
+			continue
+		}
+
+		s.mx.Lock()
+		s.received[name] = true
+		s.mx.Unlock()
+
+		if err := s.remove(ctx, name); err != nil {
+			s.log.Error(err)
+		}
+
+		s.log.WithFields(log.Fields{
+			log.FieldType:    content.Type,
+			log.FieldPayload: string(content.Payload),
+		}).Trace("signaling message received")
+
+		switch content.Type {
+		case fileIoFileContentTypeSDP:
+			s.sdpHandler(content.Payload)
+		case fileIoFileContentTypeCandidate:
+			s.candidateHandler(content.Payload)
+		case fileIoFileContentTypeNAT:
+			s.natHandler(content.Payload)
+		default:
+			s.messages.dispatch(content.Type, content.Payload)
+		}
+	}
+
+	return nil
+}
+
+func (s *S3) cleanUp(ctx context.Context) {
+	s.log.Info("cleaning up unused signaling objects...")
+
+	names, err := s.list(ctx, s.cfg.SessionID+"/")
+	if err != nil {
+		s.log.Error(err)
+
+		return
+	}
+
+	for _, name := range names {
+		if err := s.remove(ctx, name); err != nil {
+			s.log.Error(err)
+		}
+	}
+}
+
+// parseName returns an instance and a type of a message named name.
+func (s *S3) parseName(name string) (string, fileIoFileContentType, bool) {
+	parts := strings.Split(strings.TrimPrefix(name, s.cfg.SessionID+"/"), "/")
+	if len(parts) != 2 {
+		return "", "", false
+	}
+
+	_, typ, ok := strings.Cut(strings.TrimSuffix(parts[1], ".json"), "_")
+
+	return parts[0], fileIoFileContentType(typ), ok
+}
+
+func (s *S3) list(ctx context.Context, prefix string) ([]string, error) {
+	names, err := s.bucket.List(ctx, prefix)
+	s.count("list", "", err)
+
+	return names, err
+}
+
+func (s *S3) remove(ctx context.Context, name string) error {
+	err := s.bucket.Remove(ctx, name)
+	s.count("delete", "", err)
+
+	return err
+}
+
+func (s *S3) count(method, typ string, err error) {
+	labels := []string{"backend", "s3", "method", method}
+	if len(typ) != 0 {
+		labels = append(labels, "type", typ)
+	}
+
+	if err != nil {
+		metrics.Count("signal_request_errors", 1, labels...)
+
+		return
+	}
+
+	metrics.Count("signal_requests", 1, labels...)
+}
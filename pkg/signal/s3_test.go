@@ -0,0 +1,100 @@
+package signal
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// testS3Server is an S3 server keeping objects of a single bucket in memory,
+// it serves requests signaling needs only and doesn't check signatures.
+type testS3Server struct {
+	mx      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *testS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	_, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && len(key) == 0:
+		prefix := r.URL.Query().Get("prefix")
+
+		var keys []string
+
+		for k := range s.objects {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, k)
+			}
+		}
+
+		sort.Strings(keys)
+
+		fmt.Fprint(w, "<ListBucketResult><IsTruncated>false</IsTruncated>")
+
+		for _, k := range keys {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key></Contents>", k)
+		}
+
+		fmt.Fprint(w, "</ListBucketResult>")
+	case r.Method == http.MethodGet:
+		b, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>")
+
+			return
+		}
+
+		w.Write(b)
+	case r.Method == http.MethodPut:
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		s.objects[key] = b
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestS3Exchange(t *testing.T) {
+	server := httptest.NewServer(&testS3Server{objects: map[string][]byte{}})
+	t.Cleanup(server.Close)
+
+	bucketURL := strings.Replace(server.URL, "http://", "s3+http://test:test-secret@", 1) + "/bucket/signaling"
+	sessionID := uuid.NewString()
+
+	newS3 := func() *S3 {
+		s, err := NewS3(S3Config{
+			URL:          bucketURL,
+			SessionID:    sessionID,
+			InstanceID:   uuid.NewString(),
+			PollInterval: 100 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	}
+
+	testExchange(t, newS3(), newS3())
+}
@@ -0,0 +1,117 @@
+package signal
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// testSignal is signaling of a session one peer takes part in.
+type testSignal interface {
+	Listen(ctx context.Context)
+	Ping() error
+	SendSDP([]byte) error
+	SendCandidate([]byte) error
+	OnSDP(func([]byte))
+	OnCandidate(func([]byte))
+	Send(typ string, payload []byte) error
+	On(typ string, h func([]byte))
+}
+
+// testExchange makes two peers of a session find each other and exchange a
+// description, a candidate and a typed message through signaling.
+func testExchange(t *testing.T, receiver, sender testSignal) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	var wg sync.WaitGroup
+
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	for _, s := range []testSignal{receiver, sender} {
+		s := s
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			s.Listen(ctx)
+		}()
+	}
+
+	// Peers ping each other before negotiation, which is the first one to find
+	// the other doesn't matter.
+	for _, s := range []testSignal{receiver, sender} {
+		if err := s.Ping(); err != nil && !errors.Is(err, ErrNoCandidatesFound) {
+			t.Fatal(err)
+		}
+	}
+
+	sdp, candidate, message := testReceive(), testReceive(), testReceive()
+
+	receiver.OnSDP(sdp.handle)
+	sender.OnCandidate(candidate.handle)
+	receiver.On("test-offset", message.handle)
+
+	if err := sender.SendSDP([]byte("offer")); err != nil {
+		t.Fatal(err)
+	}
+
+	sdp.expect(ctx, t, "offer")
+
+	if err := receiver.SendCandidate([]byte("candidate")); err != nil {
+		t.Fatal(err)
+	}
+
+	candidate.expect(ctx, t, "candidate")
+
+	if err := sender.Send("Invalid_Type", nil); !errors.Is(err, ErrInvalidMessageType) {
+		t.Errorf("message of an invalid type is sent: %v", err)
+	}
+
+	if err := sender.Send("test-offset", []byte("42")); err != nil {
+		t.Fatal(err)
+	}
+
+	message.expect(ctx, t, "42")
+}
+
+// testReceived takes the first payload passed to its handler.
+type testReceived chan []byte
+
+func testReceive() testReceived {
+	return make(testReceived, 1)
+}
+
+func (r testReceived) handle(payload []byte) {
+	select {
+	case r <- payload:
+	default:
+	}
+}
+
+func (r testReceived) expect(ctx context.Context, t *testing.T, payload string) {
+	t.Helper()
+
+	select {
+	case got := <-r:
+		if string(got) != payload {
+			t.Fatalf("received %q, want %q", got, payload)
+		}
+	case <-ctx.Done():
+		t.Fatalf("%q hasn't been received", payload)
+	}
+}
+
+func TestMemoryExchange(t *testing.T) {
+	receiver, sender := NewMemoryPair()
+
+	testExchange(t, receiver, sender)
+}
@@ -0,0 +1,158 @@
+// Static is a signaling-free implementation for a pair of peers with stable
+// reachability (e.g. over a VPN or through forwarded ports), which exchange their
+// long-lived session descriptions with candidates once out of band. Nothing is
+// sent anywhere: a remote description is dispatched to a peer as if it came from
+// the other side, and trickled candidates are dropped, since both sides have all
+// candidates in their descriptions.
+//
+// Sides agree on roles without talking to each other: a side with the lesser ICE
+// username fragment offers, and a description of the other side is taken as an
+// answer of a DTLS client then. The other side waits for an offer, which is a
+// description of the offering side.
+
+package signal
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+type Static struct {
+	remoteSDP string
+	offerer   bool
+	log       log.Logger
+	inbox     chan []byte
+
+	sdpHandler func([]byte)
+}
+
+type StaticConfig struct {
+	// LocalSDP and RemoteSDP are session descriptions of sides.
+	LocalSDP  string
+	RemoteSDP string
+	Log       log.Logger
+}
+
+// staticDescription is a session description as it's sent by a peer.
+type staticDescription struct {
+	Type string `json:"type"`
+	SDP  string `json:"sdp"`
+}
+
+func NewStatic(cfg StaticConfig) (*Static, error) {
+	local := sdpAttribute(cfg.LocalSDP, "ice-ufrag")
+	remote := sdpAttribute(cfg.RemoteSDP, "ice-ufrag")
+
+	if len(local) == 0 || len(remote) == 0 {
+		return nil, errors.New("session description has no ICE username fragment")
+	}
+
+	if local == remote {
+		return nil, errors.New("local and remote session descriptions are the same")
+	}
+
+	if cfg.Log == nil {
+		cfg.Log = log.New()
+	}
+
+	return &Static{
+		remoteSDP:  cfg.RemoteSDP,
+		offerer:    local < remote,
+		log:        cfg.Log,
+		inbox:      make(chan []byte, 1),
+		sdpHandler: func([]byte) {},
+	}, nil
+}
+
+func (s *Static) Listen(ctx context.Context) {
+	for {
+		select {
+		case payload := <-s.inbox:
+			s.sdpHandler(payload)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Ping tells an offering side that the other one is there, and makes the other
+// side wait for an offer, which is dispatched by Listen().
+func (s *Static) Ping() error {
+	if s.offerer {
+		return nil
+	}
+
+	if err := s.dispatch("offer", s.remoteSDP); err != nil {
+		return err
+	}
+
+	return ErrNoCandidatesFound
+}
+
+// SendSDP answers an offer with a remote description. An answer of a waiting side
+// is dropped.
+func (s *Static) SendSDP([]byte) error {
+	if !s.offerer {
+		return nil
+	}
+
+	// A remote description is an offer of the other side, which acts as a DTLS
+	// client answering it.
+	sdp := strings.Replace(s.remoteSDP, "a=setup:actpass", "a=setup:active", -1)
+
+	return s.dispatch("answer", sdp)
+}
+
+func (s *Static) SendCandidate(payload []byte) error {
+	s.log.WithField(log.FieldPayload, string(payload)).Trace("trickled candidate is dropped by static signaling")
+
+	return nil
+}
+
+func (s *Static) OnSDP(h func([]byte)) {
+	s.sdpHandler = h
+}
+
+// OnCandidate does nothing, since remote candidates come with a description.
+func (s *Static) OnCandidate(func([]byte)) {}
+
+// CleanUpInstance does nothing, since nothing is left anywhere.
+func (s *Static) CleanUpInstance() error {
+	return nil
+}
+
+func (s *Static) dispatch(typ, sdp string) error {
+	payload, err := json.Marshal(&staticDescription{
+		Type: typ,
+		SDP:  sdp,
+	})
+	if err != nil {
+		return err
+	}
+
+	// A side gets a single description per session.
+	select {
+	case s.inbox <- payload:
+	default:
+		return errors.New("session description is already dispatched")
+	}
+
+	return nil
+}
+
+// sdpAttribute returns a value of the first attribute of a session description
+// with a name, or an empty string if there is none.
+func sdpAttribute(sdp, name string) string {
+	for _, line := range strings.Split(sdp, "\n") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(line), "a="+name+":"); ok {
+			return value
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,446 @@
+// WebSocket is a p2p signaling implementation that uses a self-hosted rendezvous
+// server (see: WebSocketServer). Unlike FileIo, nothing is polled: candidate
+// peers of a session keep a WebSocket connection to a server, which relays their
+// messages to each other as soon as they are sent.
+//
+// A connection is made to "${URL}?session=${SessionID}&instance=${InstanceID}",
+// and messages are JSON structures with fields "type" and "payload" as in FILE.io
+// files (see: type fileIoFileContentType). A server replies to a ping with a
+// "pong" message telling whether another candidate peer of a session has pinged,
+// and keeps messages sent while there is no other candidate peer until one
+// connects.
+
+package signal
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"distributed-backup/pkg/log"
+	"distributed-backup/pkg/metrics"
+	"distributed-backup/pkg/proxy"
+
+	"github.com/pkg/errors"
+	xproxy "golang.org/x/net/proxy"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	defaultWebSocketTimeout = 30 * time.Second
+	// webSocketKeepAliveInterval is an interval a client sends keepalive messages
+	// at, so that an idle connection isn't dropped by proxies, and a dropped one
+	// is made again.
+	webSocketKeepAliveInterval = 30 * time.Second
+)
+
+const (
+	webSocketContentTypePong      fileIoFileContentType = "pong"
+	webSocketContentTypeKeepAlive fileIoFileContentType = "keepalive"
+)
+
+type WebSocket struct {
+	cfg WebSocketConfig
+	log log.Logger
+
+	mx     sync.Mutex
+	conn   *websocket.Conn
+	pinged bool
+	closed bool
+
+	inbox chan webSocketMessage
+	pongs chan bool
+
+	sdpHandler       func([]byte)
+	candidateHandler func([]byte)
+	natHandler       func([]byte)
+	messages         messageHandlers
+}
+
+type WebSocketConfig struct {
+	// URL is a URL of a rendezvous server presented as "ws[s]://host[:port]/path".
+	URL string
+	// Token is sent as a bearer token if a server requires one.
+	Token      string
+	SessionID  string
+	InstanceID string
+	// Timeout bounds connecting to a server and waiting for a reply to a ping,
+	// default is 30 seconds.
+	Timeout time.Duration
+	// Proxy is a proxy a connection is made through, the ALL_PROXY environment
+	// variable is used if nil.
+	Proxy *url.URL
+	// Log is a logger entries are written with (e.g. with session fields attached),
+	// the global logger is used if nil.
+	Log log.Logger
+}
+
+type webSocketMessage struct {
+	Type    fileIoFileContentType `json:"type"`
+	Payload []byte                `json:"payload,omitempty"`
+	// Found tells in a pong whether another candidate peer has pinged.
+	Found bool `json:"found,omitempty"`
+}
+
+func NewWebSocket(cfg WebSocketConfig) (*WebSocket, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, errors.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+
+	if len(u.Host) == 0 {
+		return nil, errors.New("host is empty")
+	}
+
+	if len(cfg.SessionID) == 0 {
+		return nil, errors.New("session ID is empty")
+	}
+
+	if len(cfg.InstanceID) == 0 {
+		return nil, errors.New("instance ID is empty")
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultWebSocketTimeout
+	}
+
+	if cfg.Log == nil {
+		cfg.Log = log.New()
+	}
+
+	// The inbox is big enough to hold all SDP and ICE candidates of a session
+	// even before Listen() is run.
+	const inboxSize = 256
+
+	return &WebSocket{
+		cfg:              cfg,
+		log:              cfg.Log,
+		inbox:            make(chan webSocketMessage, inboxSize),
+		pongs:            make(chan bool, 1),
+		sdpHandler:       func([]byte) {},
+		candidateHandler: func([]byte) {},
+		natHandler:       func([]byte) {},
+	}, nil
+}
+
+// Listen dispatches received messages to handlers and keeps a connection alive,
+// it's closed once ctx is done.
+func (s *WebSocket) Listen(ctx context.Context) {
+	ticker := time.NewTicker(webSocketKeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg := <-s.inbox:
+			switch msg.Type {
+			case fileIoFileContentTypeSDP:
+				s.sdpHandler(msg.Payload)
+			case fileIoFileContentTypeCandidate:
+				s.candidateHandler(msg.Payload)
+			case fileIoFileContentTypeNAT:
+				s.natHandler(msg.Payload)
+			default:
+				s.messages.dispatch(msg.Type, msg.Payload)
+			}
+		case <-ticker.C:
+			if err := s.send(webSocketMessage{Type: webSocketContentTypeKeepAlive}); err != nil {
+				s.log.Error(err)
+			}
+		case <-ctx.Done():
+			s.close()
+
+			return
+		}
+	}
+}
+
+func (s *WebSocket) Ping() error {
+	// A pong of a ping made again on reconnecting is stale.
+	select {
+	case <-s.pongs:
+	default:
+	}
+
+	if err := s.send(webSocketMessage{Type: fileIoFileContentTypePing}); err != nil {
+		return err
+	}
+
+	select {
+	case found := <-s.pongs:
+		if found {
+			return nil
+		}
+
+		s.mx.Lock()
+		s.pinged = true
+		s.mx.Unlock()
+
+		return ErrNoCandidatesFound
+	case <-time.After(s.cfg.Timeout):
+		return errors.New("WebSocket signaling: no reply to ping")
+	}
+}
+
+func (s *WebSocket) SendSDP(payload []byte) error {
+	return s.send(webSocketMessage{Type: fileIoFileContentTypeSDP, Payload: payload})
+}
+
+func (s *WebSocket) SendCandidate(payload []byte) error {
+	return s.send(webSocketMessage{Type: fileIoFileContentTypeCandidate, Payload: payload})
+}
+
+// SendNAT tells the other peer a NAT type of this one, a server keeps it until
+// the other peer connects.
+func (s *WebSocket) SendNAT(payload []byte) error {
+	return s.send(webSocketMessage{Type: fileIoFileContentTypeNAT, Payload: payload})
+}
+
+func (s *WebSocket) OnSDP(h func([]byte)) {
+	s.sdpHandler = h
+}
+
+func (s *WebSocket) OnCandidate(h func([]byte)) {
+	s.candidateHandler = h
+}
+
+func (s *WebSocket) OnNAT(h func([]byte)) {
+	s.natHandler = h
+}
+
+// Send sends the other peer a typed message of type typ (see:
+// peer.MessageSignal), it's delivered as SDP is.
+func (s *WebSocket) Send(typ string, payload []byte) error {
+	ct, err := messageContentType(typ)
+	if err != nil {
+		return err
+	}
+
+	return s.send(webSocketMessage{Type: ct, Payload: payload})
+}
+
+func (s *WebSocket) On(typ string, h func([]byte)) {
+	s.messages.on(typ, h)
+}
+
+// CleanUpInstance does nothing, since a server drops messages of an instance
+// which connects again (e.g. a run resumed from a checkpoint).
+func (s *WebSocket) CleanUpInstance() error {
+	return nil
+}
+
+// CheckAuth connects to a server to make sure Token is accepted.
+func (s *WebSocket) CheckAuth() error {
+	defer s.close()
+
+	_, err := s.connection()
+
+	return err
+}
+
+func (s *WebSocket) send(msg webSocketMessage) error {
+	conn, err := s.connection()
+	if err != nil {
+		return err
+	}
+
+	if err := websocket.JSON.Send(conn, msg); err != nil {
+		s.drop(conn)
+
+		metrics.Count("signal_request_errors", 1, "backend", "websocket", "method", string(msg.Type))
+
+		return errors.Wrap(err, "WebSocket signaling")
+	}
+
+	metrics.Count("signal_requests", 1, "backend", "websocket", "method", string(msg.Type))
+
+	return nil
+}
+
+// connection returns a connection to a server, which is made if there is none
+// yet or the previous one is dropped.
+func (s *WebSocket) connection() (*websocket.Conn, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.conn != nil {
+		return s.conn, nil
+	}
+
+	if s.closed {
+		return nil, errors.New("WebSocket signaling is closed")
+	}
+
+	conn, err := s.dial()
+	if err != nil {
+		return nil, errors.Wrap(err, "WebSocket signaling")
+	}
+
+	// A server forgets a ping of a dropped connection, so a peer waiting for an
+	// offer pings again to be found by the other one.
+	if s.pinged {
+		if err := websocket.JSON.Send(conn, webSocketMessage{Type: fileIoFileContentTypePing}); err != nil {
+			conn.Close()
+
+			return nil, errors.Wrap(err, "WebSocket signaling")
+		}
+	}
+
+	s.conn = conn
+
+	go s.read(conn)
+
+	return conn, nil
+}
+
+func (s *WebSocket) dial() (*websocket.Conn, error) {
+	u, _ := url.Parse(s.cfg.URL)
+
+	q := u.Query()
+	q.Set("session", s.cfg.SessionID)
+	q.Set("instance", s.cfg.InstanceID)
+	u.RawQuery = q.Encode()
+
+	origin := url.URL{Scheme: "http", Host: u.Host}
+	port := "80"
+
+	if u.Scheme == "wss" {
+		origin.Scheme = "https"
+		port = "443"
+	}
+
+	cfg, err := websocket.NewConfig(u.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(s.cfg.Token) != 0 {
+		cfg.Header.Set("Authorization", "Bearer "+s.cfg.Token)
+	}
+
+	if len(u.Port()) != 0 {
+		port = u.Port()
+	}
+
+	dialer, err := proxy.NewDialer(s.cfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeout)
+	defer cancel()
+
+	var conn net.Conn
+
+	addr := net.JoinHostPort(u.Hostname(), port)
+
+	if d, ok := dialer.(xproxy.ContextDialer); ok {
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(s.cfg.Timeout))
+
+	if u.Scheme == "wss" {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName: u.Hostname(),
+		})
+
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+
+			return nil, err
+		}
+
+		conn = tlsConn
+	}
+
+	ws, err := websocket.NewClient(cfg, conn)
+	if err != nil {
+		conn.Close()
+
+		if errors.Is(err, websocket.ErrBadStatus) {
+			return nil, errors.New("server rejected connection, check a token")
+		}
+
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	s.log.WithField(log.FieldURL, s.cfg.URL).Debug("connected to WebSocket signaling")
+
+	return ws, nil
+}
+
+// read receives messages of a connection until it fails, a connection is made
+// again on sending the next message then.
+func (s *WebSocket) read(conn *websocket.Conn) {
+	for {
+		var msg webSocketMessage
+
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			if s.drop(conn) {
+				s.log.Error(errors.Wrap(err, "WebSocket signaling"))
+			}
+
+			return
+		}
+
+		s.log.WithFields(log.Fields{
+			log.FieldType:    msg.Type,
+			log.FieldPayload: string(msg.Payload),
+		}).Trace("signaling message received")
+
+		if msg.Type == webSocketContentTypePong {
+			select {
+			case s.pongs <- msg.Found:
+			default:
+			}
+
+			continue
+		}
+
+		s.inbox <- msg
+	}
+}
+
+// drop closes a connection and tells whether it was the current one, rather than
+// one already dropped or closed.
+func (s *WebSocket) drop(conn *websocket.Conn) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	conn.Close()
+
+	if s.conn != conn {
+		return false
+	}
+
+	s.conn = nil
+
+	return true
+}
+
+func (s *WebSocket) close() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.closed = true
+
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
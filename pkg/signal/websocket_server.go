@@ -0,0 +1,273 @@
+package signal
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-backup/pkg/log"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// defaultWebSocketBacklogTTL is a time a message sent while there is no other
+	// candidate peer of a session is kept for, as long as FILE.io files are.
+	defaultWebSocketBacklogTTL = 10 * time.Minute
+	// webSocketBacklogSize bounds a number of messages kept for a session.
+	webSocketBacklogSize = 256
+)
+
+// WebSocketServer is a rendezvous server of the WebSocket signaling (see:
+// WebSocket), which relays messages between candidate peers of a session. It
+// keeps no state but messages waiting for a peer in memory.
+type WebSocketServer struct {
+	cfg WebSocketServerConfig
+	log log.Logger
+
+	mx       sync.Mutex
+	sessions map[string]*webSocketSession
+}
+
+type WebSocketServerConfig struct {
+	// Token is a bearer token clients are required to send, any client is
+	// accepted if it's empty.
+	Token string
+	// BacklogTTL is a time a message sent while there is no other candidate peer
+	// of a session is kept for, default is 10 minutes.
+	BacklogTTL time.Duration
+	// Log is a logger entries are written with, the global logger is used if nil.
+	Log log.Logger
+}
+
+type webSocketSession struct {
+	clients map[*webSocketClient]struct{}
+	backlog []webSocketBacklogMessage
+}
+
+type webSocketClient struct {
+	conn     *websocket.Conn
+	instance string
+	pinged   bool
+}
+
+type webSocketBacklogMessage struct {
+	instance string
+	msg      webSocketMessage
+	sentAt   time.Time
+}
+
+func NewWebSocketServer(cfg WebSocketServerConfig) *WebSocketServer {
+	if cfg.BacklogTTL == 0 {
+		cfg.BacklogTTL = defaultWebSocketBacklogTTL
+	}
+
+	if cfg.Log == nil {
+		cfg.Log = log.New()
+	}
+
+	return &WebSocketServer{
+		cfg:      cfg,
+		log:      cfg.Log,
+		sessions: make(map[string]*webSocketSession),
+	}
+}
+
+func (s *WebSocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	websocket.Server{
+		Handshake: s.handshake,
+		Handler:   s.serve,
+	}.ServeHTTP(w, r)
+}
+
+// handshake checks a token and IDs of a client, an origin isn't checked since
+// clients aren't browsers.
+func (s *WebSocketServer) handshake(_ *websocket.Config, r *http.Request) error {
+	if len(s.cfg.Token) != 0 {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Token)) != 1 {
+			return errors.New("invalid token")
+		}
+	}
+
+	q := r.URL.Query()
+
+	if len(q.Get("session")) == 0 || len(q.Get("instance")) == 0 {
+		return errors.New("session and instance are required")
+	}
+
+	return nil
+}
+
+func (s *WebSocketServer) serve(conn *websocket.Conn) {
+	defer conn.Close()
+
+	q := conn.Request().URL.Query()
+	sessionID := q.Get("session")
+
+	c := &webSocketClient{
+		conn:     conn,
+		instance: q.Get("instance"),
+	}
+
+	logger := s.log.WithFields(log.Fields{
+		log.FieldSessionID:  sessionID,
+		log.FieldInstanceID: c.instance,
+		log.FieldAddr:       conn.Request().RemoteAddr,
+	})
+
+	logger.Debug("signaling client connected")
+	defer logger.Debug("signaling client disconnected")
+
+	for _, msg := range s.join(sessionID, c) {
+		if err := websocket.JSON.Send(conn, msg); err != nil {
+			logger.Error(err)
+
+			return
+		}
+	}
+
+	defer s.leave(sessionID, c)
+
+	for {
+		var msg webSocketMessage
+
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case fileIoFileContentTypePing:
+			found := s.ping(sessionID, c)
+
+			if err := websocket.JSON.Send(conn, webSocketMessage{Type: webSocketContentTypePong, Found: found}); err != nil {
+				return
+			}
+		default:
+			if !relayedContentType(msg.Type) {
+				continue
+			}
+
+			for _, other := range s.relay(sessionID, c, msg) {
+				// A client failing to receive a message is dropped by its own
+				// handler.
+				websocket.JSON.Send(other.conn, msg)
+			}
+		}
+	}
+}
+
+// join adds a client to a session and returns messages sent by other instances
+// before it connected. Messages left by a previous connection of the same
+// instance are dropped.
+func (s *WebSocketServer) join(sessionID string, c *webSocketClient) []webSocketMessage {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.expire()
+
+	session, ok := s.sessions[sessionID]
+	if !ok {
+		session = &webSocketSession{
+			clients: make(map[*webSocketClient]struct{}),
+		}
+		s.sessions[sessionID] = session
+	}
+
+	session.clients[c] = struct{}{}
+
+	var msgs []webSocketMessage
+
+	for _, m := range session.backlog {
+		if m.instance != c.instance {
+			msgs = append(msgs, m.msg)
+		}
+	}
+
+	session.backlog = nil
+
+	return msgs
+}
+
+func (s *WebSocketServer) leave(sessionID string, c *webSocketClient) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	session := s.sessions[sessionID]
+	delete(session.clients, c)
+
+	if len(session.clients) == 0 && len(session.backlog) == 0 {
+		delete(s.sessions, sessionID)
+	}
+}
+
+// ping tells whether another client of a session has pinged, a client is
+// remembered as pinged otherwise.
+func (s *WebSocketServer) ping(sessionID string, c *webSocketClient) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for other := range s.sessions[sessionID].clients {
+		if other != c && other.pinged {
+			return true
+		}
+	}
+
+	c.pinged = true
+
+	return false
+}
+
+// relay returns other clients of a session a message is sent to, it's kept in a
+// backlog if there are none.
+func (s *WebSocketServer) relay(sessionID string, c *webSocketClient, msg webSocketMessage) []*webSocketClient {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	session := s.sessions[sessionID]
+
+	var others []*webSocketClient
+
+	for other := range session.clients {
+		if other != c {
+			others = append(others, other)
+		}
+	}
+
+	if len(others) == 0 {
+		if len(session.backlog) == webSocketBacklogSize {
+			session.backlog = session.backlog[1:]
+		}
+
+		session.backlog = append(session.backlog, webSocketBacklogMessage{
+			instance: c.instance,
+			msg:      msg,
+			sentAt:   time.Now(),
+		})
+	}
+
+	return others
+}
+
+// expire drops messages kept longer than BacklogTTL and sessions left empty.
+func (s *WebSocketServer) expire() {
+	for id, session := range s.sessions {
+		backlog := session.backlog[:0]
+
+		for _, m := range session.backlog {
+			if time.Since(m.sentAt) < s.cfg.BacklogTTL {
+				backlog = append(backlog, m)
+			}
+		}
+
+		session.backlog = backlog
+
+		if len(session.clients) == 0 && len(session.backlog) == 0 {
+			delete(s.sessions, id)
+		}
+	}
+}
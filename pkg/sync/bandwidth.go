@@ -0,0 +1,248 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// bandwidthBurst is a duration of data at a limited rate which can be taken at
+// once, so that short pauses between writes don't lower an average rate.
+const bandwidthBurst = 100 * time.Millisecond
+
+// BandwidthRule limits a rate within a daily window of local time. A window
+// which ends before it starts spans midnight (e.g. 22:00-08:00).
+type BandwidthRule struct {
+	// From and To are times of a day since midnight, To is exclusive.
+	From time.Duration
+	To   time.Duration
+	// Rate is a limit in bytes per second, 0 means no limit.
+	Rate float64
+}
+
+// ParseBandwidthRule parses a rule given as "${from}-${to}=${rate}" where times
+// are "HH:MM" and rate is accepted by ParseRate() (e.g. "08:00-22:00=5Mbit/s").
+func ParseBandwidthRule(s string) (BandwidthRule, error) {
+	window, rate, ok := strings.Cut(s, "=")
+	if !ok {
+		return BandwidthRule{}, errors.Errorf("%q: ${from}-${to}=${rate} expected", s)
+	}
+
+	from, to, ok := strings.Cut(window, "-")
+	if !ok {
+		return BandwidthRule{}, errors.Errorf("%q: window ${from}-${to} expected", s)
+	}
+
+	var (
+		r   BandwidthRule
+		err error
+	)
+
+	if r.From, err = parseTimeOfDay(from); err != nil {
+		return BandwidthRule{}, errors.Wrapf(err, "%q", s)
+	}
+
+	if r.To, err = parseTimeOfDay(to); err != nil {
+		return BandwidthRule{}, errors.Wrapf(err, "%q", s)
+	}
+
+	if r.From == r.To {
+		return BandwidthRule{}, errors.Errorf("%q: empty window", s)
+	}
+
+	if r.Rate, err = ParseRate(rate); err != nil {
+		return BandwidthRule{}, errors.Wrapf(err, "%q", s)
+	}
+
+	return r, nil
+}
+
+// parseTimeOfDay parses "HH:MM", "24:00" is the end of a day.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	h, m, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok || len(m) != 2 {
+		return 0, errors.Errorf("time %q: HH:MM expected", s)
+	}
+
+	hours, err := strconv.Atoi(h)
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, errors.Errorf("time %q: invalid hours", s)
+	}
+
+	minutes, err := strconv.Atoi(m)
+	if err != nil || minutes < 0 || minutes > 59 || (hours == 24 && minutes != 0) {
+		return 0, errors.Errorf("time %q: invalid minutes", s)
+	}
+
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// Units of rates, decimal prefixes are powers of 1000 and binary ones are of 1024.
+var rateUnits = []struct {
+	suffix string
+	bytes  float64
+}{
+	{"Gbit/s", 1e9 / 8},
+	{"Mbit/s", 1e6 / 8},
+	{"Kbit/s", 1e3 / 8},
+	{"kbit/s", 1e3 / 8},
+	{"bit/s", 1.0 / 8},
+	{"GiB/s", 1 << 30},
+	{"MiB/s", 1 << 20},
+	{"KiB/s", 1 << 10},
+	{"GB/s", 1e9},
+	{"MB/s", 1e6},
+	{"KB/s", 1e3},
+	{"kB/s", 1e3},
+	{"B/s", 1},
+}
+
+// ParseRate parses a rate in bits (e.g. "5Mbit/s") or bytes (e.g. "512KiB/s",
+// "1MB/s") per second and returns it in bytes per second. "0" and "unlimited"
+// mean no limit.
+func ParseRate(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+
+	if s == "0" || strings.EqualFold(s, "unlimited") {
+		return 0, nil
+	}
+
+	for _, u := range rateUnits {
+		if !strings.HasSuffix(s, u.suffix) {
+			continue
+		}
+
+		v, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), 64)
+		if err != nil || v <= 0 {
+			return 0, errors.Errorf("rate %q: positive number expected", s)
+		}
+
+		return v * u.bytes, nil
+	}
+
+	return 0, errors.Errorf("rate %q: unit (e.g. Mbit/s, MiB/s) expected", s)
+}
+
+// FormatRate formats a rate in bytes per second, 0 is formatted as "unlimited".
+func FormatRate(rate float64) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+
+	return fmt.Sprintf("%.2fMbit/s", rate*8/1e6)
+}
+
+// BandwidthLimiter is a token bucket of bytes, a rate of which is chosen by
+// rules of a time of day at the moment of every write, so that a limit changes
+// during a running transfer as windows begin and end.
+type BandwidthLimiter struct {
+	cfg BandwidthLimiterConfig
+
+	mx     sync.Mutex
+	tokens float64
+	rate   float64
+	last   time.Time
+}
+
+type BandwidthLimiterConfig struct {
+	// Rules are checked in order and the first one a time falls within is
+	// applied.
+	Rules []BandwidthRule
+	// Rate is a limit in bytes per second outside windows of rules, 0 means no
+	// limit.
+	Rate float64
+}
+
+func NewBandwidthLimiter(cfg BandwidthLimiterConfig) *BandwidthLimiter {
+	return &BandwidthLimiter{
+		cfg:  cfg,
+		last: time.Now(),
+	}
+}
+
+// Rate returns a limit in bytes per second applied at t, 0 means no limit.
+func (l *BandwidthLimiter) Rate(t time.Time) float64 {
+	// A time of day is taken from a wall clock, so windows keep their local
+	// times on days of DST changes.
+	h, m, sec := t.Clock()
+	day := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second
+
+	for _, r := range l.cfg.Rules {
+		var within bool
+
+		if r.From < r.To {
+			within = day >= r.From && day < r.To
+		} else {
+			within = day >= r.From || day < r.To
+		}
+
+		if within {
+			return r.Rate
+		}
+	}
+
+	return l.cfg.Rate
+}
+
+// Wait takes n bytes waiting for them if needed. A number of bytes may exceed
+// a burst of the bucket, then a wait is just as long as sending them takes.
+func (l *BandwidthLimiter) Wait(ctx context.Context, n int) error {
+	delay := l.reserve(n)
+	if delay <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *BandwidthLimiter) reserve(n int) time.Duration {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	now := time.Now()
+
+	rate := l.Rate(now)
+	if rate != l.rate {
+		// A bucket starts empty at a new rate, debts of a previous one are
+		// forgiven.
+		l.rate = rate
+		l.tokens = 0
+		l.last = now
+	}
+
+	if rate == 0 {
+		return 0
+	}
+
+	burst := rate * bandwidthBurst.Seconds()
+
+	if now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+		l.last = now
+
+		if l.tokens > burst {
+			l.tokens = burst
+		}
+	}
+
+	l.tokens -= float64(n)
+
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / rate * float64(time.Second))
+}
@@ -0,0 +1,128 @@
+package sync
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket: a token is added every Interval up to Burst ones,
+// and every event takes a token waiting for it if the bucket is empty. Waiting is
+// cancelled with a context, and nothing is left running in background.
+type RateLimiter struct {
+	cfg RateLimiterConfig
+
+	mx     sync.Mutex
+	tokens float64
+	// last is a time tokens were added at, which is in the future while the
+	// limiter is paused (see: Pause()).
+	last time.Time
+}
+
+type RateLimiterConfig struct {
+	// Interval is a period a token is added every, 0 means no limit.
+	Interval time.Duration
+	// Burst is a maximum number of events which can happen at once, default is 1.
+	Burst int
+}
+
+func NewRateLimiter(cfg RateLimiterConfig) *RateLimiter {
+	if cfg.Burst < 1 {
+		cfg.Burst = 1
+	}
+
+	return &RateLimiter{
+		cfg:    cfg,
+		tokens: float64(cfg.Burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait takes a token waiting for it if needed. A token is not taken if ctx is
+// done before.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	delay := l.reserve()
+	if delay <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.unreserve()
+
+		return ctx.Err()
+	}
+}
+
+// Pause takes tokens away for d so that the next event happens not earlier, e.g.
+// when a server asks to retry after d.
+func (l *RateLimiter) Pause(d time.Duration) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	now := time.Now()
+	l.refill(now)
+
+	if until := now.Add(d); until.After(l.last) {
+		l.last = until
+
+		if l.tokens > 1 {
+			l.tokens = 1
+		}
+	}
+}
+
+// reserve takes a token in advance and returns a delay the token is available
+// after.
+func (l *RateLimiter) reserve() time.Duration {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	now := time.Now()
+	l.refill(now)
+
+	l.tokens--
+
+	delay := l.last.Sub(now)
+	if delay < 0 {
+		delay = 0
+	}
+
+	if l.tokens < 0 {
+		delay += time.Duration(-l.tokens * float64(l.cfg.Interval))
+	}
+
+	return delay
+}
+
+func (l *RateLimiter) unreserve() {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if l.tokens++; l.tokens > float64(l.cfg.Burst) {
+		l.tokens = float64(l.cfg.Burst)
+	}
+}
+
+func (l *RateLimiter) refill(now time.Time) {
+	if !now.After(l.last) {
+		return
+	}
+
+	if l.cfg.Interval <= 0 {
+		l.tokens = float64(l.cfg.Burst)
+	} else {
+		l.tokens += float64(now.Sub(l.last)) / float64(l.cfg.Interval)
+
+		if l.tokens > float64(l.cfg.Burst) {
+			l.tokens = float64(l.cfg.Burst)
+		}
+	}
+
+	l.last = now
+}
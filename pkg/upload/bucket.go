@@ -0,0 +1,83 @@
+package upload
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Bucket keeps small objects (e.g. signaling messages, see: signal.S3) in a
+// bucket of an S3 compatible storage, names are slash-separated keys relative to
+// a path of a URL.
+type Bucket struct {
+	s *s3
+}
+
+// NewBucket returns a bucket located by URL, which is given as
+// "s3[+http]://[key:secret@]host[:port]/bucket[/path][?region=region]" (see:
+// newS3()).
+func NewBucket(cfg Config) (*Bucket, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(u.Host) == 0 {
+		return nil, errors.New("host is empty")
+	}
+
+	if u.Scheme != "s3" && u.Scheme != "s3+http" {
+		return nil, errors.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultTimeout
+	}
+
+	s, err := newS3(u, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Bucket{s: s}, nil
+}
+
+// Put stores an object replacing an existing one.
+func (b *Bucket) Put(ctx context.Context, name string, data []byte) error {
+	_, err := b.s.call(ctx, http.MethodPut, b.s.key(name), nil, nil, data)
+
+	return err
+}
+
+// Get returns content of an object.
+func (b *Bucket) Get(ctx context.Context, name string) ([]byte, error) {
+	return b.s.get(ctx, b.s.key(name))
+}
+
+// List returns names of objects starting with prefix in lexicographical order.
+func (b *Bucket) List(ctx context.Context, prefix string) ([]string, error) {
+	base := b.s.key("")
+	if len(base) != 0 {
+		base += "/"
+	}
+
+	keys, err := b.s.list(ctx, base+prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = strings.TrimPrefix(key, base)
+	}
+
+	return names, nil
+}
+
+// Remove removes an object, it's not an error if there is none.
+func (b *Bucket) Remove(ctx context.Context, name string) error {
+	return b.s.remove(ctx, b.s.key(name))
+}
@@ -0,0 +1,619 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"distributed-backup/pkg/proxy"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	s3DefaultRegion = "us-east-1"
+
+	// s3PartSize is a size of parts an object is uploaded in at first, parts
+	// grow twice every s3PartsPerSize parts, so that the limit of 10000 parts of
+	// an upload is never reached.
+	s3PartSize     = 16 << 20
+	s3PartsPerSize = 1000
+	// s3MaxCopySize is a maximum size of an object copied with a single request,
+	// larger ones are copied in parts of s3CopyPartSize.
+	s3MaxCopySize  = 5 << 30
+	s3CopyPartSize = 1 << 30
+	// s3MaxResponse bounds a response body read.
+	s3MaxResponse = 1 << 20
+)
+
+// s3 uploads objects to a bucket of an S3 compatible storage (e.g. AWS S3 or
+// MinIO) with path-style requests signed with AWS Signature Version 4. An object
+// is uploaded in parts, so that a file is streamed without knowing its size, and
+// appears in a bucket only once an upload completes.
+type s3 struct {
+	scheme    string
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// newS3 takes a bucket and a key prefix from a path of u, credentials from its
+// user info or the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment
+// variables, and a region from a "region" query parameter or the AWS_REGION
+// environment variable. A scheme "s3+http" makes requests unencrypted.
+func newS3(u *url.URL, cfg Config) (*s3, error) {
+	bucket, prefix, _ := strings.Cut(strings.Trim(u.Path, "/"), "/")
+	if len(bucket) == 0 {
+		return nil, errors.New("S3 bucket is empty")
+	}
+
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+
+	if u.User != nil {
+		accessKey = u.User.Username()
+		secretKey, _ = u.User.Password()
+	}
+
+	if len(accessKey) == 0 || len(secretKey) == 0 {
+		return nil, errors.New("S3 access key and secret key are required")
+	}
+
+	region := u.Query().Get("region")
+	if len(region) == 0 {
+		region = os.Getenv("AWS_REGION")
+	}
+
+	if len(region) == 0 {
+		region = s3DefaultRegion
+	}
+
+	scheme := "https"
+	if u.Scheme == "s3+http" {
+		scheme = "http"
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy.HTTPProxy(cfg.Proxy)
+	transport.ResponseHeaderTimeout = cfg.Timeout
+
+	return &s3{
+		scheme: u.Scheme,
+		endpoint: &url.URL{
+			Scheme: scheme,
+			Host:   u.Host,
+		},
+		bucket:    bucket,
+		prefix:    prefix,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Transport: transport},
+	}, nil
+}
+
+// Upload uploads an object which appears only if it's uploaded completely, so
+// a partial one needs no temporary name.
+func (s *s3) Upload(ctx context.Context, name string, r io.Reader) error {
+	w := s.create(ctx, s.key(name))
+
+	if _, err := io.Copy(w, r); err != nil {
+		w.abort()
+
+		return err
+	}
+
+	return w.Close()
+}
+
+func (s *s3) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+func (s *s3) location(name string) string {
+	return fmt.Sprintf("%s://%s/%s/%s", s.scheme, s.endpoint.Host, s.bucket, s.key(name))
+}
+
+// create returns a writer of an object, which is uploaded once it's closed.
+func (s *s3) create(ctx context.Context, key string) *s3Writer {
+	return &s3Writer{
+		ctx: ctx,
+		s:   s,
+		key: key,
+	}
+}
+
+// exists tells whether there is an object.
+func (s *s3) exists(ctx context.Context, key string) (bool, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return true, nil
+	default:
+		return false, errors.Errorf("S3 HEAD: %s", resp.Status)
+	}
+}
+
+// get returns a body of an object, which is expected to be small.
+func (s *s3) get(ctx context.Context, key string) ([]byte, error) {
+	return s.call(ctx, http.MethodGet, key, nil, nil, nil)
+}
+
+// list returns keys of objects starting with prefix in lexicographical order,
+// the way S3 lists them.
+func (s *s3) list(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+	}
+
+	for {
+		b, err := s.call(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+
+		if err := xml.Unmarshal(b, &result); err != nil {
+			return nil, errors.Wrap(err, "S3 list")
+		}
+
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+
+		if !result.IsTruncated || len(result.NextContinuationToken) == 0 {
+			return keys, nil
+		}
+
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *s3) remove(ctx context.Context, key string) error {
+	_, err := s.call(ctx, http.MethodDelete, key, nil, nil, nil)
+
+	return err
+}
+
+// rename copies an object and removes the original one, since S3 can't rename
+// objects.
+func (s *s3) rename(ctx context.Context, oldKey, newKey string) error {
+	resp, err := s.do(ctx, http.MethodHead, oldKey, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("S3 HEAD %s: %s", oldKey, resp.Status)
+	}
+
+	source := http.Header{
+		"X-Amz-Copy-Source": {"/" + s.bucket + "/" + s3Escape(oldKey, false)},
+	}
+
+	if resp.ContentLength <= s3MaxCopySize {
+		_, err = s.call(ctx, http.MethodPut, newKey, nil, source, nil)
+	} else {
+		err = s.copyParts(ctx, newKey, source, resp.ContentLength)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return s.remove(ctx, oldKey)
+}
+
+// copyParts copies an object of size which is too large to be copied at once.
+func (s *s3) copyParts(ctx context.Context, key string, source http.Header, size int64) error {
+	uploadID, err := s.initiate(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	var parts []s3Part
+
+	for offset := int64(0); offset < size; offset += s3CopyPartSize {
+		end := offset + s3CopyPartSize
+		if end > size {
+			end = size
+		}
+
+		header := source.Clone()
+		header.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", offset, end-1))
+
+		b, err := s.call(ctx, http.MethodPut, key, s3PartQuery(uploadID, len(parts)+1), header, nil)
+		if err != nil {
+			s.abort(ctx, key, uploadID)
+
+			return err
+		}
+
+		var result struct {
+			ETag string `xml:"ETag"`
+		}
+
+		if err := xml.Unmarshal(b, &result); err != nil {
+			s.abort(ctx, key, uploadID)
+
+			return errors.Wrap(err, "S3 copy part")
+		}
+
+		parts = append(parts, s3Part{Number: len(parts) + 1, ETag: result.ETag})
+	}
+
+	return s.complete(ctx, key, uploadID, parts)
+}
+
+// initiate starts a multipart upload and returns its ID.
+func (s *s3) initiate(ctx context.Context, key string) (string, error) {
+	b, err := s.call(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+
+	if err := xml.Unmarshal(b, &result); err != nil || len(result.UploadID) == 0 {
+		return "", errors.New("S3: malformed response to multipart upload")
+	}
+
+	return result.UploadID, nil
+}
+
+func (s *s3) complete(ctx context.Context, key, uploadID string, parts []s3Part) error {
+	body, err := xml.Marshal(&struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.call(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body); err != nil {
+		s.abort(ctx, key, uploadID)
+
+		return err
+	}
+
+	return nil
+}
+
+// abort drops parts of an upload which won't complete, so that they aren't
+// stored (and paid for) forever.
+func (s *s3) abort(ctx context.Context, key, uploadID string) {
+	// An upload is aborted even if it's stopped since a context is done.
+	if ctx.Err() != nil {
+		ctx = context.Background()
+	}
+
+	s.call(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+}
+
+type s3Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+func s3PartQuery(uploadID string, number int) url.Values {
+	return url.Values{
+		"partNumber": {strconv.Itoa(number)},
+		"uploadId":   {uploadID},
+	}
+}
+
+// call makes a request and returns a body of a successful response. S3 reports
+// some errors with a successful status and an error body.
+func (s *s3) call(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) ([]byte, error) {
+	resp, err := s.do(ctx, method, key, query, header, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, s3MaxResponse))
+	if err != nil {
+		return nil, err
+	}
+
+	var e struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+
+	if xml.Unmarshal(b, &e) == nil && e.XMLName.Local == "Error" {
+		return nil, errors.Errorf("S3 %s: %s: %s", method, e.Code, e.Message)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, errors.Errorf("S3 %s: %s", method, resp.Status)
+	}
+
+	return b, nil
+}
+
+// do makes a signed request of an object, or of a bucket if key is empty.
+func (s *s3) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = "/" + s.bucket + "/" + key
+	u.RawPath = "/" + s.bucket + "/" + s3Escape(key, false)
+
+	// A bucket itself is requested to list objects.
+	if len(key) == 0 {
+		u.Path = "/" + s.bucket
+		u.RawPath = ""
+	}
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	// An empty body is sent with a zero length rather than chunked.
+	req.ContentLength = int64(len(body))
+	if len(body) == 0 {
+		req.Body = http.NoBody
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	sum := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(sum[:]), time.Now())
+
+	return s.client.Do(req)
+}
+
+// sign signs a request with AWS Signature Version 4, a host and x-amz-* headers
+// are signed.
+func (s *s3) sign(req *http.Request, payloadHash string, now time.Time) {
+	date := now.UTC().Format("20060102T150405Z")
+	day := date[:8]
+
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	names := []string{"host"}
+
+	for k := range req.Header {
+		if k := strings.ToLower(k); strings.HasPrefix(k, "x-amz-") {
+			names = append(names, k)
+		}
+	}
+
+	sort.Strings(names)
+
+	var headers strings.Builder
+
+	for _, name := range names {
+		value := req.URL.Host
+		if name != "host" {
+			value = strings.TrimSpace(req.Header.Get(name))
+		}
+
+		headers.WriteString(name + ":" + value + "\n")
+	}
+
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		headers.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{day, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+// s3CanonicalQuery returns a query with keys sorted and both keys and values
+// escaped as Signature Version 4 requires.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	var pairs []string
+
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape escapes all bytes of s but unreserved characters (RFC 3986), and
+// slashes unless escapeSlash is set.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// s3Writer uploads an object in parts as it's written, an object which fits a
+// single part is uploaded with a single request once a writer is closed.
+type s3Writer struct {
+	ctx      context.Context
+	s        *s3
+	key      string
+	buf      []byte
+	uploadID string
+	parts    []s3Part
+	err      error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n := 0
+
+	for len(p) > 0 {
+		size := w.partSize()
+
+		k := size - len(w.buf)
+		if k > len(p) {
+			k = len(p)
+		}
+
+		w.buf = append(w.buf, p[:k]...)
+		p = p[k:]
+		n += k
+
+		if len(w.buf) == size {
+			if w.err = w.flush(); w.err != nil {
+				return n, w.err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// Close uploads the rest of an object and completes an upload.
+func (w *s3Writer) Close() error {
+	if w.err != nil {
+		w.abort()
+
+		return w.err
+	}
+
+	if len(w.uploadID) == 0 {
+		_, err := w.s.call(w.ctx, http.MethodPut, w.key, nil, nil, w.buf)
+
+		return err
+	}
+
+	if len(w.buf) != 0 {
+		if err := w.flush(); err != nil {
+			w.abort()
+
+			return err
+		}
+	}
+
+	return w.s.complete(w.ctx, w.key, w.uploadID, w.parts)
+}
+
+func (w *s3Writer) partSize() int {
+	return s3PartSize << (len(w.parts) / s3PartsPerSize)
+}
+
+// flush uploads a buffered part.
+func (w *s3Writer) flush() error {
+	if len(w.uploadID) == 0 {
+		uploadID, err := w.s.initiate(w.ctx, w.key)
+		if err != nil {
+			return err
+		}
+
+		w.uploadID = uploadID
+	}
+
+	number := len(w.parts) + 1
+
+	resp, err := w.s.do(w.ctx, http.MethodPut, w.key, s3PartQuery(w.uploadID, number), nil, w.buf)
+	if err != nil {
+		return err
+	}
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, s3MaxResponse))
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("S3 part %d: %s", number, resp.Status)
+	}
+
+	w.parts = append(w.parts, s3Part{Number: number, ETag: resp.Header.Get("ETag")})
+	w.buf = w.buf[:0]
+
+	return nil
+}
+
+// abort drops an upload which won't complete.
+func (w *s3Writer) abort() {
+	if len(w.uploadID) != 0 {
+		w.s.abort(w.ctx, w.key, w.uploadID)
+	}
+}
@@ -0,0 +1,512 @@
+package upload
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"distributed-backup/pkg/proxy"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Packet types and constants of the SFTP protocol version 3
+// (draft-ietf-secsh-filexfer-02), which is the one supported by OpenSSH.
+const (
+	sftpVersion = 3
+
+	sftpInit          = 1
+	sftpVersionPacket = 2
+	sftpOpen          = 3
+	sftpClose         = 4
+	sftpWrite         = 6
+	sftpLstat         = 7
+	sftpRemove        = 13
+	sftpMkdir         = 14
+	sftpRename        = 18
+	sftpStatus        = 101
+	sftpHandle        = 102
+	sftpAttrs         = 105
+
+	sftpFlagWrite    = 0x02
+	sftpFlagCreate   = 0x08
+	sftpFlagTruncate = 0x10
+
+	sftpStatusOK         = 0
+	sftpStatusNoSuchFile = 2
+
+	// sftpChunkSize is a size of data of a single write, which all servers
+	// must accept.
+	sftpChunkSize = 32 << 10
+	// sftpMaxInflight is a number of writes sent without waiting for their
+	// statuses, so that throughput isn't bound by a round trip per chunk.
+	sftpMaxInflight = 16
+	// sftpMaxPacketLen bounds a packet read from a server.
+	sftpMaxPacketLen = 256 << 10
+)
+
+type sftp struct {
+	dir    string
+	addr   string
+	config *ssh.ClientConfig
+	dialer proxy.Dialer
+}
+
+func newSFTP(u *url.URL, cfg Config) (*sftp, error) {
+	if u.User == nil || len(u.User.Username()) == 0 {
+		return nil, errors.New("SFTP user is empty")
+	}
+
+	if len(cfg.HostKey) == 0 {
+		return nil, errors.New("SFTP host key fingerprint is required")
+	}
+
+	var auth []ssh.AuthMethod
+
+	if password, ok := u.User.Password(); ok {
+		auth = append(auth, ssh.Password(password))
+	}
+
+	if len(cfg.KeyFile) != 0 {
+		b, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, errors.Wrap(err, "SSH key")
+		}
+
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+
+	if len(auth) == 0 {
+		return nil, errors.New("either SFTP password or SSH key is required")
+	}
+
+	dialer, err := proxy.NewDialer(cfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := u.Host
+	if len(u.Port()) == 0 {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	return &sftp{
+		dir:  u.Path,
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User: u.User.Username(),
+			Auth: auth,
+			HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+				if ssh.FingerprintSHA256(key) != cfg.HostKey {
+					return errors.Errorf("SFTP host key mismatch: %s", ssh.FingerprintSHA256(key))
+				}
+
+				return nil
+			},
+			Timeout: cfg.Timeout,
+		},
+		dialer: dialer,
+	}, nil
+}
+
+func (s *sftp) Upload(ctx context.Context, name string, r io.Reader) error {
+	c, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// An upload is aborted once a context is done.
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	tmp := path.Join(s.dir, name+partialSuffix)
+
+	if err := c.write(tmp, r); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return err
+	}
+
+	return c.rename(tmp, path.Join(s.dir, name))
+}
+
+// dial connects to a server and starts an SFTP session.
+func (s *sftp) dial() (*sftpConn, error) {
+	conn, err := s.dialer.Dial("tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// A handshake is bounded by a timeout as well as connecting, a server which
+	// accepts a connection but doesn't respond would block it forever otherwise.
+	conn.SetDeadline(time.Now().Add(s.config.Timeout))
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, s.addr, s.config)
+	if err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(sshConn, chans, reqs)
+
+	c, err := newSFTPConn(client)
+	if err != nil {
+		client.Close()
+
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func newSFTPConn(client *ssh.Client) (*sftpConn, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	rd, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return nil, err
+	}
+
+	c := &sftpConn{w: w, r: rd, client: client}
+
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// sftpConn speaks SFTP over an SSH subsystem channel.
+type sftpConn struct {
+	w  io.Writer
+	r  io.Reader
+	id uint32
+
+	client *ssh.Client
+}
+
+// Close closes an SSH connection along with a session.
+func (c *sftpConn) Close() error {
+	return c.client.Close()
+}
+
+func (c *sftpConn) init() error {
+	if err := c.send(sftpInit, binary.BigEndian.AppendUint32(nil, sftpVersion)); err != nil {
+		return err
+	}
+
+	typ, _, err := c.recv()
+	if err != nil {
+		return err
+	}
+
+	if typ != sftpVersionPacket {
+		return errors.Errorf("SFTP: unexpected packet %d", typ)
+	}
+
+	return nil
+}
+
+// write writes content of r to a file at path created or truncated.
+func (c *sftpConn) write(path string, r io.Reader) error {
+	// Attributes are empty (no flags).
+	handle, err := c.open(path, sftpFlagWrite|sftpFlagCreate|sftpFlagTruncate)
+	if err != nil {
+		return err
+	}
+
+	var (
+		offset   uint64
+		inflight int
+		buf      = make([]byte, sftpChunkSize)
+	)
+
+	for {
+		n, readErr := io.ReadFull(r, buf)
+
+		if n > 0 {
+			if inflight == sftpMaxInflight {
+				if err := c.status(); err != nil {
+					return err
+				}
+
+				inflight--
+			}
+
+			c.id++
+
+			payload := binary.BigEndian.AppendUint32(nil, c.id)
+			payload = append(payload, sftpString(handle)...)
+			payload = binary.BigEndian.AppendUint64(payload, offset)
+			payload = append(payload, sftpString(string(buf[:n]))...)
+
+			if err := c.send(sftpWrite, payload); err != nil {
+				return err
+			}
+
+			offset += uint64(n)
+			inflight++
+		}
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if readErr != nil {
+			return readErr
+		}
+	}
+
+	for ; inflight > 0; inflight-- {
+		if err := c.status(); err != nil {
+			return err
+		}
+	}
+
+	return c.request(sftpClose, sftpString(handle))
+}
+
+func (c *sftpConn) open(path string, flags uint32) (string, error) {
+	c.id++
+
+	payload := binary.BigEndian.AppendUint32(nil, c.id)
+	payload = append(payload, sftpString(path)...)
+	payload = binary.BigEndian.AppendUint32(payload, flags)
+	payload = binary.BigEndian.AppendUint32(payload, 0)
+
+	if err := c.send(sftpOpen, payload); err != nil {
+		return "", err
+	}
+
+	typ, b, err := c.recv()
+	if err != nil {
+		return "", err
+	}
+
+	switch typ {
+	case sftpHandle:
+		if len(b) < 8 {
+			return "", errors.New("SFTP: malformed handle")
+		}
+
+		n := binary.BigEndian.Uint32(b[4:])
+		if uint32(len(b)-8) < n {
+			return "", errors.New("SFTP: malformed handle")
+		}
+
+		return string(b[8 : 8+n]), nil
+	case sftpStatus:
+		return "", statusError(b)
+	default:
+		return "", errors.Errorf("SFTP: unexpected packet %d", typ)
+	}
+}
+
+// rename renames a file at oldPath replacing one at newPath.
+func (c *sftpConn) rename(oldPath, newPath string) error {
+	// Version 3 doesn't replace an existing file on renaming.
+	if err := c.remove(newPath); err != nil {
+		return err
+	}
+
+	return c.request(sftpRename, sftpString(oldPath), sftpString(newPath))
+}
+
+// remove removes a file at path, it's not an error if there is none.
+func (c *sftpConn) remove(path string) error {
+	if err := c.request(sftpRemove, sftpString(path)); err != nil && !isNoSuchFile(err) {
+		return err
+	}
+
+	return nil
+}
+
+// mkdirAll creates a directory at dir along with its parents, ones which exist
+// fail to be created and are skipped.
+func (c *sftpConn) mkdirAll(dir string) error {
+	if dir == "/" || dir == "." {
+		return nil
+	}
+
+	if ok, err := c.exists(dir); err != nil || ok {
+		return err
+	}
+
+	if err := c.mkdirAll(path.Dir(dir)); err != nil {
+		return err
+	}
+
+	return c.request(sftpMkdir, sftpString(dir), binary.BigEndian.AppendUint32(nil, 0))
+}
+
+// exists tells whether there is a file or a directory at path.
+func (c *sftpConn) exists(path string) (bool, error) {
+	c.id++
+
+	payload := binary.BigEndian.AppendUint32(nil, c.id)
+	payload = append(payload, sftpString(path)...)
+
+	if err := c.send(sftpLstat, payload); err != nil {
+		return false, err
+	}
+
+	typ, b, err := c.recv()
+	if err != nil {
+		return false, err
+	}
+
+	switch typ {
+	case sftpAttrs:
+		return true, nil
+	case sftpStatus:
+		if err := statusError(b); err != nil && !isNoSuchFile(err) {
+			return false, err
+		}
+
+		return false, nil
+	default:
+		return false, errors.Errorf("SFTP: unexpected packet %d", typ)
+	}
+}
+
+// request sends a request of fields and waits for its status.
+func (c *sftpConn) request(typ byte, fields ...[]byte) error {
+	c.id++
+
+	payload := binary.BigEndian.AppendUint32(nil, c.id)
+	for _, f := range fields {
+		payload = append(payload, f...)
+	}
+
+	if err := c.send(typ, payload); err != nil {
+		return err
+	}
+
+	return c.status()
+}
+
+func (c *sftpConn) status() error {
+	typ, b, err := c.recv()
+	if err != nil {
+		return err
+	}
+
+	if typ != sftpStatus {
+		return errors.Errorf("SFTP: unexpected packet %d", typ)
+	}
+
+	return statusError(b)
+}
+
+func (c *sftpConn) send(typ byte, payload []byte) error {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	b = append(b, typ)
+
+	_, err := c.w.Write(append(b, payload...))
+
+	return err
+}
+
+func (c *sftpConn) recv() (byte, []byte, error) {
+	var header [5]byte
+
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	n := binary.BigEndian.Uint32(header[:4])
+	if n == 0 || n > sftpMaxPacketLen {
+		return 0, nil, errors.New("SFTP: malformed packet")
+	}
+
+	b := make([]byte, n-1)
+
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return 0, nil, err
+	}
+
+	return header[4], b, nil
+}
+
+// sftpStatusError is an error status of a request.
+type sftpStatusError struct {
+	code uint32
+	msg  string
+}
+
+func (e *sftpStatusError) Error() string {
+	return fmt.Sprintf("SFTP: status %d: %s", e.code, e.msg)
+}
+
+func isNoSuchFile(err error) bool {
+	var status *sftpStatusError
+
+	return errors.As(err, &status) && status.code == sftpStatusNoSuchFile
+}
+
+// statusError returns an error of a status payload (a request ID, a code and a
+// message) unless it's OK.
+func statusError(b []byte) error {
+	if len(b) < 8 {
+		return errors.New("SFTP: malformed status")
+	}
+
+	code := binary.BigEndian.Uint32(b[4:])
+	if code == sftpStatusOK {
+		return nil
+	}
+
+	msg := ""
+	if len(b) >= 12 {
+		n := binary.BigEndian.Uint32(b[8:])
+		if uint32(len(b)-12) >= n {
+			msg = string(b[12 : 12+n])
+		}
+	}
+
+	return &sftpStatusError{code: code, msg: msg}
+}
+
+func sftpString(s string) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(s)))
+
+	return append(b, s...)
+}
@@ -0,0 +1,311 @@
+package upload
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Storage stores files of a receiver in a remote directory or a bucket, names are
+// slash-separated paths relative to it (see: filemanager.Storage).
+type Storage interface {
+	// Create returns a writer of a file which replaces an existing one once the
+	// writer is closed.
+	Create(name string) (io.WriteCloser, error)
+	// Rename renames a file replacing an existing one.
+	Rename(oldName, newName string) error
+	// Remove removes a file, it's not an error if there is none.
+	Remove(name string) error
+	// Exists tells whether there is a file.
+	Exists(name string) (bool, error)
+	// Location returns a URL of a file without credentials.
+	Location(name string) string
+	// Close closes connections kept by a storage.
+	Close() error
+}
+
+// NewStorage returns a storage located by URL, which is given as to New().
+func NewStorage(cfg Config) (Storage, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(u.Host) == 0 {
+		return nil, errors.New("host is empty")
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultTimeout
+	}
+
+	switch u.Scheme {
+	case "sftp":
+		s, err := newSFTP(u, cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		return &sftpStorage{sftp: s}, nil
+	case "webdav", "webdavs":
+		return newWebDAV(u, cfg), nil
+	case "s3", "s3+http":
+		s, err := newS3(u, cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		return &s3Storage{s}, nil
+	default:
+		return nil, errors.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+}
+
+// pipeWriter is a writer of a file which is uploaded by a goroutine reading the
+// other end of a pipe, closing it waits for an upload to finish.
+type pipeWriter struct {
+	*io.PipeWriter
+	done chan error
+}
+
+// newPipeWriter runs upload with a reader of data written to a returned writer.
+func newPipeWriter(upload func(r io.Reader) error) *pipeWriter {
+	pr, pw := io.Pipe()
+	w := &pipeWriter{
+		PipeWriter: pw,
+		done:       make(chan error, 1),
+	}
+
+	go func() {
+		err := upload(pr)
+
+		// A writer is unblocked if an upload has failed before reading it all.
+		pr.CloseWithError(errors.Wrap(err, "upload"))
+		w.done <- err
+	}()
+
+	return w
+}
+
+func (w *pipeWriter) Close() error {
+	w.PipeWriter.Close()
+
+	return <-w.done
+}
+
+func (w *webDAV) Create(name string) (io.WriteCloser, error) {
+	if err := w.mkcolAll(path.Dir(name)); err != nil {
+		return nil, err
+	}
+
+	return newPipeWriter(func(r io.Reader) error {
+		return w.do(context.Background(), http.MethodPut, w.fileURL(name), io.NopCloser(r), nil)
+	}), nil
+}
+
+func (w *webDAV) Rename(oldName, newName string) error {
+	if err := w.mkcolAll(path.Dir(newName)); err != nil {
+		return err
+	}
+
+	return w.do(context.Background(), "MOVE", w.fileURL(oldName), nil, http.Header{
+		"Destination": {w.fileURL(newName).String()},
+		"Overwrite":   {"T"},
+	})
+}
+
+func (w *webDAV) Remove(name string) error {
+	status, err := w.request(context.Background(), http.MethodDelete, w.fileURL(name), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	if status != http.StatusNotFound && (status < 200 || status > 299) {
+		return errors.Errorf("WebDAV DELETE: %d %s", status, http.StatusText(status))
+	}
+
+	return nil
+}
+
+// Exists finds properties of a resource rather than gets it, since a collection
+// can't be got from some servers.
+func (w *webDAV) Exists(name string) (bool, error) {
+	status, err := w.request(context.Background(), "PROPFIND", w.fileURL(name), nil, http.Header{
+		"Depth": {"0"},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case status == http.StatusNotFound:
+		return false, nil
+	case status >= 200 && status <= 299:
+		return true, nil
+	default:
+		return false, errors.Errorf("WebDAV PROPFIND: %d %s", status, http.StatusText(status))
+	}
+}
+
+func (w *webDAV) Location(name string) string {
+	return w.fileURL(name).String()
+}
+
+func (w *webDAV) Close() error {
+	return nil
+}
+
+// mkcolAll creates a collection dir relative to a root one along with its parents
+// up to the root one, ones which exist are skipped.
+func (w *webDAV) mkcolAll(dir string) error {
+	if ok, err := w.Exists(dir + "/"); err != nil || ok {
+		return err
+	}
+
+	if dir != "." {
+		if err := w.mkcolAll(path.Dir(dir)); err != nil {
+			return err
+		}
+	}
+
+	return w.do(context.Background(), "MKCOL", w.fileURL(dir+"/"), nil, nil)
+}
+
+// sftpStorage keeps a connection across operations, which is made again once it
+// fails.
+type sftpStorage struct {
+	*sftp
+
+	mx   sync.Mutex
+	conn *sftpConn
+}
+
+func (s *sftpStorage) Create(name string) (io.WriteCloser, error) {
+	p := path.Join(s.dir, name)
+
+	return newPipeWriter(func(r io.Reader) error {
+		return s.do(func(c *sftpConn) error {
+			if err := c.mkdirAll(path.Dir(p)); err != nil {
+				return err
+			}
+
+			return c.write(p, r)
+		})
+	}), nil
+}
+
+func (s *sftpStorage) Rename(oldName, newName string) error {
+	return s.do(func(c *sftpConn) error {
+		newPath := path.Join(s.dir, newName)
+
+		if err := c.mkdirAll(path.Dir(newPath)); err != nil {
+			return err
+		}
+
+		return c.rename(path.Join(s.dir, oldName), newPath)
+	})
+}
+
+func (s *sftpStorage) Remove(name string) error {
+	return s.do(func(c *sftpConn) error {
+		return c.remove(path.Join(s.dir, name))
+	})
+}
+
+func (s *sftpStorage) Exists(name string) (bool, error) {
+	var exists bool
+
+	err := s.do(func(c *sftpConn) (err error) {
+		exists, err = c.exists(path.Join(s.dir, name))
+
+		return err
+	})
+
+	return exists, err
+}
+
+func (s *sftpStorage) Location(name string) string {
+	u := url.URL{
+		Scheme: "sftp",
+		User:   url.User(s.config.User),
+		Host:   s.addr,
+		Path:   path.Join(s.dir, name),
+	}
+
+	return u.String()
+}
+
+func (s *sftpStorage) Close() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+
+	return err
+}
+
+// do runs fn with a connection, which is dropped unless fn fails with a status
+// of a server.
+func (s *sftpStorage) do(fn func(c *sftpConn) error) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.conn == nil {
+		c, err := s.dial()
+		if err != nil {
+			return err
+		}
+
+		s.conn = c
+	}
+
+	err := fn(s.conn)
+
+	var status *sftpStatusError
+
+	if err != nil && !errors.As(err, &status) {
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	return err
+}
+
+// s3Storage has no directories, so they are neither created nor removed.
+type s3Storage struct {
+	*s3
+}
+
+func (s *s3Storage) Create(name string) (io.WriteCloser, error) {
+	return s.create(context.Background(), s.key(name)), nil
+}
+
+func (s *s3Storage) Rename(oldName, newName string) error {
+	return s.rename(context.Background(), s.key(oldName), s.key(newName))
+}
+
+func (s *s3Storage) Remove(name string) error {
+	return s.remove(context.Background(), s.key(name))
+}
+
+func (s *s3Storage) Exists(name string) (bool, error) {
+	return s.exists(context.Background(), s.key(name))
+}
+
+func (s *s3Storage) Location(name string) string {
+	return s.location(name)
+}
+
+func (s *s3Storage) Close() error {
+	return nil
+}
@@ -0,0 +1,103 @@
+package upload
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"distributed-backup/pkg/proxy"
+
+	"github.com/pkg/errors"
+)
+
+// webDAV uploads a file with the PUT method and renames it with the MOVE one
+// (RFC 4918).
+type webDAV struct {
+	dir    *url.URL
+	user   *url.Userinfo
+	client *http.Client
+}
+
+func newWebDAV(u *url.URL, cfg Config) *webDAV {
+	dir := *u
+	dir.Scheme = strings.Replace(u.Scheme, "webdav", "http", 1)
+	// Credentials are sent in a header, and must not leak into a Destination.
+	dir.User = nil
+
+	if !strings.HasSuffix(dir.Path, "/") {
+		dir.Path += "/"
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy.HTTPProxy(cfg.Proxy)
+	transport.ResponseHeaderTimeout = cfg.Timeout
+
+	return &webDAV{
+		dir:  &dir,
+		user: u.User,
+		// A whole upload isn't bounded by a timeout since it's as long as a
+		// backup is large.
+		client: &http.Client{Transport: transport},
+	}
+}
+
+func (w *webDAV) Upload(ctx context.Context, name string, r io.Reader) error {
+	tmp := w.fileURL(name + partialSuffix)
+
+	// A body is wrapped so that it's sent chunked rather than read to learn its
+	// length.
+	if err := w.do(ctx, http.MethodPut, tmp, io.NopCloser(r), nil); err != nil {
+		return err
+	}
+
+	return w.do(ctx, "MOVE", tmp, nil, http.Header{
+		"Destination": {w.fileURL(name).String()},
+		"Overwrite":   {"T"},
+	})
+}
+
+func (w *webDAV) fileURL(name string) *url.URL {
+	return w.dir.JoinPath(name)
+}
+
+func (w *webDAV) do(ctx context.Context, method string, u *url.URL, body io.ReadCloser, header http.Header) error {
+	status, err := w.request(ctx, method, u, body, header)
+	if err != nil {
+		return err
+	}
+
+	if status < 200 || status > 299 {
+		return errors.Errorf("WebDAV %s: %d %s", method, status, http.StatusText(status))
+	}
+
+	return nil
+}
+
+// request makes a request and returns a status of a response whatever it is.
+func (w *webDAV) request(ctx context.Context, method string, u *url.URL, body io.ReadCloser, header http.Header) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return 0, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if w.user != nil {
+		password, _ := w.user.Password()
+		req.SetBasicAuth(w.user.Username(), password)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, resp.Body)
+
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,216 @@
+package zstd
+
+import "math/bits"
+
+// Predefined distributions of literal length, match length and offset codes
+// (see: RFC 8878, section 3.1.1.3.2.2), -1 is a probability "less than 1".
+var (
+	llDefaultNorm = []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}
+	mlDefaultNorm = []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}
+	ofDefaultNorm = []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}
+
+	llEncoder = newFSEEncoder(llDefaultNorm, 6)
+	mlEncoder = newFSEEncoder(mlDefaultNorm, 6)
+	ofEncoder = newFSEEncoder(ofDefaultNorm, 5)
+)
+
+// Baselines and numbers of extra bits of literal length and match length codes
+// (see: RFC 8878, section 3.1.1.3.2.1.1).
+var (
+	llBase = [...]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	llBits = [...]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	mlBase = [...]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	mlBits = [...]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+)
+
+func llCode(litLen uint32) uint8 {
+	if litLen >= 64 {
+		return uint8(bits.Len32(litLen)-1) + 19
+	}
+
+	return lowerCode(llBase[:], litLen)
+}
+
+func mlCode(matchLen uint32) uint8 {
+	if matchLen-3 >= 128 {
+		return uint8(bits.Len32(matchLen-3)-1) + 36
+	}
+
+	return lowerCode(mlBase[:], matchLen)
+}
+
+// lowerCode returns the last code of a baseline not greater than v.
+func lowerCode(base []uint32, v uint32) uint8 {
+	c := 0
+
+	for c+1 < len(base) && base[c+1] <= v {
+		c++
+	}
+
+	return uint8(c)
+}
+
+// bitWriter writes a bitstream which is read backwards by a decoder: bits are
+// packed from the least significant one, and the stream is closed by a set bit
+// marking its end.
+type bitWriter struct {
+	out   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (w *bitWriter) add(v uint32, n uint8) {
+	w.acc |= (uint64(v) & (1<<n - 1)) << w.nbits
+	w.nbits += uint(n)
+
+	for w.nbits >= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+func (w *bitWriter) close() []byte {
+	w.add(1, 1)
+
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.acc))
+	}
+
+	return w.out
+}
+
+type fseSymbol struct {
+	deltaFindState int32
+	deltaNbBits    uint32
+}
+
+// fseEncoder encodes symbols of a distribution with tANS as the reference
+// implementation does, so that a decoder spreading symbols over its table the
+// same way decodes them.
+type fseEncoder struct {
+	tableLog   uint8
+	stateTable []uint16
+	symbols    []fseSymbol
+}
+
+func newFSEEncoder(norm []int16, tableLog uint8) *fseEncoder {
+	size := 1 << tableLog
+	mask := size - 1
+	step := size>>1 + size>>3 + 3
+	high := size - 1
+
+	spread := make([]uint8, size)
+	cumul := make([]int, len(norm)+1)
+
+	// Symbols of "less than 1" probability take the last cells.
+	for s, c := range norm {
+		if c == -1 {
+			cumul[s+1] = cumul[s] + 1
+			spread[high] = uint8(s)
+			high--
+		} else {
+			cumul[s+1] = cumul[s] + int(c)
+		}
+	}
+
+	pos := 0
+
+	for s, c := range norm {
+		for i := 0; i < int(c); i++ {
+			spread[pos] = uint8(s)
+			pos = (pos + step) & mask
+
+			for pos > high {
+				pos = (pos + step) & mask
+			}
+		}
+	}
+
+	e := &fseEncoder{
+		tableLog:   tableLog,
+		stateTable: make([]uint16, size),
+		symbols:    make([]fseSymbol, len(norm)),
+	}
+
+	for u, s := range spread {
+		e.stateTable[cumul[s]] = uint16(size + u)
+		cumul[s]++
+	}
+
+	total := 0
+
+	for s, c := range norm {
+		switch c {
+		case 0:
+		case -1, 1:
+			e.symbols[s] = fseSymbol{
+				deltaFindState: int32(total - 1),
+				deltaNbBits:    uint32(tableLog)<<16 - uint32(size),
+			}
+			total++
+		default:
+			maxBitsOut := uint32(tableLog) - uint32(bits.Len16(uint16(c-1))-1)
+			e.symbols[s] = fseSymbol{
+				deltaFindState: int32(total - int(c)),
+				deltaNbBits:    maxBitsOut<<16 - uint32(c)<<maxBitsOut,
+			}
+			total += int(c)
+		}
+	}
+
+	return e
+}
+
+// fseState is a state of an encoder, its lower tableLog bits are a state of a
+// decoder.
+type fseState uint32
+
+func (e *fseEncoder) init(sym uint8) fseState {
+	s := e.symbols[sym]
+	nbBitsOut := (s.deltaNbBits + 1<<15) >> 16
+	v := nbBitsOut<<16 - s.deltaNbBits
+
+	return fseState(e.stateTable[int32(v>>nbBitsOut)+s.deltaFindState])
+}
+
+func (e *fseEncoder) encode(w *bitWriter, st *fseState, sym uint8) {
+	s := e.symbols[sym]
+	nbBitsOut := (uint32(*st) + s.deltaNbBits) >> 16
+	w.add(uint32(*st), uint8(nbBitsOut))
+	*st = fseState(e.stateTable[int32(uint32(*st)>>nbBitsOut)+s.deltaFindState])
+}
+
+func (e *fseEncoder) flush(w *bitWriter, st fseState) {
+	w.add(uint32(st), e.tableLog)
+}
@@ -0,0 +1,48 @@
+package zstd
+
+import "testing"
+
+// TestCodes checks that a literal length and a match length are encoded with a
+// code whose baseline and extra bits cover them.
+func TestCodes(t *testing.T) {
+	for v := uint32(0); v < 1<<17; v++ {
+		if c := llCode(v); v < llBase[c] || v-llBase[c] >= 1<<llBits[c] {
+			t.Fatalf("literal length %d has code %d", v, c)
+		}
+
+		// A match is 3 bytes long at least.
+		m := v + 3
+
+		if c := mlCode(m); m < mlBase[c] || m-mlBase[c] >= 1<<mlBits[c] {
+			t.Fatalf("match length %d has code %d", m, c)
+		}
+	}
+}
+
+// TestDefaultDistributions checks that predefined distributions fill tables of
+// their accuracy, a probability "less than 1" taking a cell.
+func TestDefaultDistributions(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		norm     []int16
+		tableLog uint8
+	}{
+		{"literal length", llDefaultNorm, 6},
+		{"match length", mlDefaultNorm, 6},
+		{"offset", ofDefaultNorm, 5},
+	} {
+		total := 0
+
+		for _, c := range tt.norm {
+			if c == -1 {
+				c = 1
+			}
+
+			total += int(c)
+		}
+
+		if total != 1<<tt.tableLog {
+			t.Errorf("%s: probabilities sum to %d, want %d", tt.name, total, 1<<tt.tableLog)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+// Package zstd writes Zstandard frames (RFC 8878). Data is split into blocks of
+// literals and LZ77 sequences found by a fast greedy match finder, sequences are
+// encoded with predefined FSE tables and literals are stored raw rather than
+// Huffman coded, which trades some ratio for speed. Frames carry a content
+// checksum and are readable by zstd and other tools supporting the format.
+package zstd
+
+import (
+	"encoding/binary"
+	"io"
+	"math/bits"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	frameMagic = 0xFD2FB528
+
+	// windowLog is a binary logarithm of a window matches refer back to, which
+	// a decoder keeps in memory.
+	windowLog  = 20
+	windowSize = 1 << windowLog
+
+	maxBlockSize = 128 << 10
+
+	blockRaw        = 0
+	blockRLE        = 1
+	blockCompressed = 2
+
+	// Matches are looked up by a hash of 4 bytes.
+	minMatch = 4
+	hashLog  = 16
+	// skipLog makes the match finder step faster over data matches aren't found
+	// in: by a byte more for every 2^skipLog literals in a row.
+	skipLog = 6
+)
+
+type sequence struct {
+	litLen   uint32
+	matchLen uint32
+	offset   uint32
+}
+
+// Writer compresses data written to it into a single frame, Close must be called
+// to write its last block and checksum.
+type Writer struct {
+	w io.Writer
+
+	// hist holds data already compressed up to a window back followed by data
+	// of the next block, which starts at pos.
+	hist  []byte
+	pos   int
+	table []int32
+
+	checksum *xxhash64
+	seqs     []sequence
+	lits     []byte
+	out      []byte
+
+	wroteHeader bool
+	closed      bool
+	err         error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	table := make([]int32, 1<<hashLog)
+	for i := range table {
+		table[i] = -1
+	}
+
+	return &Writer{
+		w:        w,
+		hist:     make([]byte, 0, 2*windowSize+maxBlockSize),
+		table:    table,
+		checksum: newXXHash64(),
+	}
+}
+
+func (z *Writer) Write(p []byte) (int, error) {
+	if z.closed {
+		return 0, errors.New("zstd: write to a closed writer")
+	}
+
+	n := len(p)
+
+	for len(p) > 0 {
+		if z.err != nil {
+			return n - len(p), z.err
+		}
+
+		// A full block is compressed only once more data comes, since the last
+		// one is flagged.
+		if len(z.hist)-z.pos == maxBlockSize {
+			z.err = z.writeBlock(false)
+
+			continue
+		}
+
+		if z.pos == len(z.hist) && z.pos >= 2*windowSize {
+			z.slide()
+		}
+
+		k := copy(z.hist[len(z.hist):z.pos+maxBlockSize], p)
+		z.hist = z.hist[:len(z.hist)+k]
+		p = p[k:]
+	}
+
+	return n, z.err
+}
+
+// Close writes the last block and a checksum of a frame. It does not close the
+// underlying writer.
+func (z *Writer) Close() error {
+	if z.closed {
+		return z.err
+	}
+
+	z.closed = true
+
+	if z.err != nil {
+		return z.err
+	}
+
+	if z.err = z.writeBlock(true); z.err != nil {
+		return z.err
+	}
+
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], uint32(z.checksum.Sum64()))
+
+	_, z.err = z.w.Write(sum[:])
+
+	return z.err
+}
+
+// slide drops data older than a window, so that hist doesn't grow.
+func (z *Writer) slide() {
+	shift := z.pos - windowSize
+
+	copy(z.hist, z.hist[shift:])
+	z.hist = z.hist[:len(z.hist)-shift]
+	z.pos -= shift
+
+	for i, v := range z.table {
+		if int(v) < shift {
+			z.table[i] = -1
+		} else {
+			z.table[i] = v - int32(shift)
+		}
+	}
+}
+
+func (z *Writer) writeHeader() error {
+	var header [6]byte
+	binary.LittleEndian.PutUint32(header[:4], frameMagic)
+	// Content_Checksum_flag is set, a content size is unknown.
+	header[4] = 1 << 2
+	header[5] = (windowLog - 10) << 3
+
+	_, err := z.w.Write(header[:])
+
+	return err
+}
+
+// writeBlock compresses pending data into a block, which is stored raw or as a
+// repeated byte instead if it isn't compressed smaller.
+func (z *Writer) writeBlock(last bool) error {
+	if !z.wroteHeader {
+		if err := z.writeHeader(); err != nil {
+			return err
+		}
+
+		z.wroteHeader = true
+	}
+
+	src := z.hist[z.pos:]
+
+	z.checksum.Write(src)
+
+	z.out = z.out[:0]
+	z.out = append(z.out, 0, 0, 0)
+
+	blockType, size := blockRaw, len(src)
+
+	switch {
+	case len(src) > 1 && isRLE(src):
+		blockType = blockRLE
+		z.out = append(z.out, src[0])
+	case len(src) > 0 && z.compressBlock():
+		blockType, size = blockCompressed, len(z.out)-3
+	default:
+		z.out = append(z.out[:3], src...)
+	}
+
+	header := uint32(size)<<3 | uint32(blockType)<<1
+	if last {
+		header |= 1
+	}
+
+	z.out[0], z.out[1], z.out[2] = byte(header), byte(header>>8), byte(header>>16)
+
+	z.pos = len(z.hist)
+
+	_, err := z.w.Write(z.out)
+
+	return err
+}
+
+func isRLE(b []byte) bool {
+	for _, c := range b[1:] {
+		if c != b[0] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compressBlock appends a compressed block of pending data to out and tells
+// whether it's smaller than the data, out is left unchanged otherwise.
+func (z *Writer) compressBlock() bool {
+	z.findSequences()
+
+	n := len(z.hist) - z.pos
+	start := len(z.out)
+
+	z.writeLiterals()
+	z.writeSequences()
+
+	if len(z.out)-start >= n {
+		z.out = z.out[:start]
+
+		return false
+	}
+
+	return true
+}
+
+// findSequences splits pending data into sequences of literals followed by a
+// match, and literals left after the last match.
+func (z *Writer) findSequences() {
+	z.seqs = z.seqs[:0]
+	z.lits = z.lits[:0]
+
+	h := z.hist
+	end := len(h)
+	litStart := z.pos
+
+	for i := z.pos; i+minMatch <= end; {
+		v := binary.LittleEndian.Uint32(h[i:])
+		slot := hash4(v)
+		cand := int(z.table[slot])
+		z.table[slot] = int32(i)
+
+		if cand < 0 || i-cand >= windowSize || binary.LittleEndian.Uint32(h[cand:]) != v {
+			i += 1 + (i-litStart)>>skipLog
+
+			continue
+		}
+
+		n := minMatch
+		for i+n < end && h[cand+n] == h[i+n] {
+			n++
+		}
+
+		for i > litStart && cand > 0 && h[i-1] == h[cand-1] {
+			i--
+			cand--
+			n++
+		}
+
+		z.lits = append(z.lits, h[litStart:i]...)
+		z.seqs = append(z.seqs, sequence{
+			litLen:   uint32(i - litStart),
+			matchLen: uint32(n),
+			offset:   uint32(i - cand),
+		})
+
+		i += n
+		litStart = i
+
+		// A position inside a match helps to find the next one.
+		if i+minMatch <= end {
+			z.table[hash4(binary.LittleEndian.Uint32(h[i-2:]))] = int32(i - 2)
+		}
+	}
+
+	z.lits = append(z.lits, h[litStart:end]...)
+}
+
+func hash4(v uint32) uint32 {
+	return (v * 2654435761) >> (32 - hashLog)
+}
+
+// writeLiterals appends a raw literals section.
+func (z *Writer) writeLiterals() {
+	n := len(z.lits)
+
+	switch {
+	case n < 1<<5:
+		z.out = append(z.out, byte(n<<3))
+	case n < 1<<12:
+		z.out = append(z.out, byte(1<<2|n<<4), byte(n>>4))
+	default:
+		z.out = append(z.out, byte(3<<2|n<<4), byte(n>>4), byte(n>>12))
+	}
+
+	z.out = append(z.out, z.lits...)
+}
+
+// writeSequences appends a sequences section encoded with predefined tables.
+// Sequences are encoded backwards, since a decoder reads a bitstream from its
+// end.
+func (z *Writer) writeSequences() {
+	n := len(z.seqs)
+
+	switch {
+	case n < 128:
+		z.out = append(z.out, byte(n))
+	case n < 0x7F00:
+		z.out = append(z.out, byte(n>>8+128), byte(n))
+	default:
+		z.out = append(z.out, 255, byte(n-0x7F00), byte((n-0x7F00)>>8))
+	}
+
+	if n == 0 {
+		return
+	}
+
+	// All tables are predefined.
+	z.out = append(z.out, 0)
+
+	bw := &bitWriter{out: z.out}
+
+	codes := func(s sequence) (ll, ml, of uint8, offBase uint32) {
+		// Offsets 1 to 3 are repeated ones, which aren't used.
+		offBase = s.offset + 3
+
+		return llCode(s.litLen), mlCode(s.matchLen), uint8(bits.Len32(offBase) - 1), offBase
+	}
+
+	ll, ml, of, offBase := codes(z.seqs[n-1])
+
+	llState := llEncoder.init(ll)
+	mlState := mlEncoder.init(ml)
+	ofState := ofEncoder.init(of)
+
+	bw.add(z.seqs[n-1].litLen-llBase[ll], llBits[ll])
+	bw.add(z.seqs[n-1].matchLen-mlBase[ml], mlBits[ml])
+	bw.add(offBase, of)
+
+	for i := n - 2; i >= 0; i-- {
+		s := z.seqs[i]
+		ll, ml, of, offBase = codes(s)
+
+		ofEncoder.encode(bw, &ofState, of)
+		mlEncoder.encode(bw, &mlState, ml)
+		llEncoder.encode(bw, &llState, ll)
+
+		bw.add(s.litLen-llBase[ll], llBits[ll])
+		bw.add(s.matchLen-mlBase[ml], mlBits[ml])
+		bw.add(offBase, of)
+	}
+
+	mlEncoder.flush(bw, mlState)
+	ofEncoder.flush(bw, ofState)
+	llEncoder.flush(bw, llState)
+
+	z.out = bw.close()
+}
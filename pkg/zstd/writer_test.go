@@ -0,0 +1,456 @@
+package zstd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"os/exec"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// decodeFrame decodes a single frame of the subset of the format a writer
+// writes: raw, RLE and compressed blocks, raw or RLE literals and sequences of
+// predefined tables (see: RFC 8878). It's written after the RFC rather than
+// after the writer, so that both don't share a misreading. Every block is
+// checked to be within the maximum size.
+func decodeFrame(frame []byte) ([]byte, error) {
+	if len(frame) < 5 || binary.LittleEndian.Uint32(frame) != frameMagic {
+		return nil, errors.New("no frame magic")
+	}
+
+	fhd := frame[4]
+	p := frame[5:]
+
+	singleSegment := fhd>>5&1 == 1
+	hasChecksum := fhd>>2&1 == 1
+
+	if !singleSegment {
+		p = p[1:]
+	}
+
+	p = p[[]int{0, 1, 2, 4}[fhd&3]:]
+
+	fcsSize := []int{0, 2, 4, 8}[fhd>>6]
+	if fcsSize == 0 && singleSegment {
+		fcsSize = 1
+	}
+
+	p = p[fcsSize:]
+
+	var (
+		out  []byte
+		reps = [3]int{1, 4, 8}
+	)
+
+	for last := false; !last; {
+		if len(p) < 3 {
+			return nil, errors.New("truncated block header")
+		}
+
+		header := uint32(p[0]) | uint32(p[1])<<8 | uint32(p[2])<<16
+		p = p[3:]
+
+		last = header&1 == 1
+		size := int(header >> 3)
+
+		if size > maxBlockSize {
+			return nil, errors.Errorf("block of %d bytes", size)
+		}
+
+		switch header >> 1 & 3 {
+		case blockRaw:
+			out = append(out, p[:size]...)
+			p = p[size:]
+		case blockRLE:
+			out = append(out, bytes.Repeat(p[:1], size)...)
+			p = p[1:]
+		case blockCompressed:
+			n := len(out)
+
+			var err error
+			if out, err = decodeBlock(out, p[:size], &reps); err != nil {
+				return nil, err
+			}
+
+			if len(out)-n > maxBlockSize {
+				return nil, errors.Errorf("block of %d decompressed bytes", len(out)-n)
+			}
+
+			p = p[size:]
+		default:
+			return nil, errors.New("reserved block type")
+		}
+	}
+
+	if hasChecksum {
+		h := newXXHash64()
+		h.Write(out)
+
+		if len(p) < 4 || binary.LittleEndian.Uint32(p) != uint32(h.Sum64()) {
+			return nil, errors.New("checksum mismatch")
+		}
+
+		p = p[4:]
+	}
+
+	if len(p) != 0 {
+		return nil, errors.Errorf("%d bytes after a frame", len(p))
+	}
+
+	return out, nil
+}
+
+func decodeBlock(out, p []byte, reps *[3]int) ([]byte, error) {
+	var lits []byte
+
+	size, headerSize := 0, 0
+
+	switch b := p[0]; b >> 2 & 3 {
+	case 0, 2:
+		size, headerSize = int(b>>3), 1
+	case 1:
+		size, headerSize = int(b>>4)|int(p[1])<<4, 2
+	case 3:
+		size, headerSize = int(b>>4)|int(p[1])<<4|int(p[2])<<12, 3
+	}
+
+	switch p[0] & 3 {
+	case 0:
+		lits = p[headerSize : headerSize+size]
+		p = p[headerSize+size:]
+	case 1:
+		lits = bytes.Repeat(p[headerSize:headerSize+1], size)
+		p = p[headerSize+1:]
+	default:
+		return nil, errors.New("literals aren't raw")
+	}
+
+	var nbSeq int
+
+	switch b := int(p[0]); {
+	case b < 128:
+		nbSeq, p = b, p[1:]
+	case b < 255:
+		nbSeq, p = (b-128)<<8|int(p[1]), p[2:]
+	default:
+		nbSeq, p = int(p[1])|int(p[2])<<8+0x7F00, p[3:]
+	}
+
+	if nbSeq == 0 {
+		return append(out, lits...), nil
+	}
+
+	if p[0] != 0 {
+		return nil, errors.New("sequences aren't of predefined tables")
+	}
+
+	br, err := newBackwardReader(p[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	ll := newFSEDecoder(llDefaultNorm, 6)
+	of := newFSEDecoder(ofDefaultNorm, 5)
+	ml := newFSEDecoder(mlDefaultNorm, 6)
+
+	llState, ofState, mlState := br.read(6), br.read(5), br.read(6)
+
+	for i := 0; i < nbSeq; i++ {
+		llc, ofc, mlc := ll.symbol[llState], of.symbol[ofState], ml.symbol[mlState]
+
+		offBase := 1<<ofc + br.read(int(ofc))
+		matchLen := int(mlBase[mlc]) + br.read(int(mlBits[mlc]))
+		litLen := int(llBase[llc]) + br.read(int(llBits[llc]))
+
+		var offset int
+
+		if offBase > 3 {
+			offset = offBase - 3
+			reps[0], reps[1], reps[2] = offset, reps[0], reps[1]
+		} else {
+			idx := offBase
+			if litLen == 0 {
+				idx++
+			}
+
+			switch idx {
+			case 1:
+				offset = reps[0]
+			case 2:
+				offset = reps[1]
+				reps[0], reps[1] = offset, reps[0]
+			case 3:
+				offset = reps[2]
+				reps[0], reps[1], reps[2] = offset, reps[0], reps[1]
+			case 4:
+				offset = reps[0] - 1
+				reps[0], reps[1], reps[2] = offset, reps[0], reps[1]
+			}
+		}
+
+		if litLen > len(lits) {
+			return nil, errors.New("literal length exceeds literals")
+		}
+
+		out = append(out, lits[:litLen]...)
+		lits = lits[litLen:]
+
+		if offset <= 0 || offset > len(out) {
+			return nil, errors.Errorf("offset %d is out of %d bytes", offset, len(out))
+		}
+
+		for j := 0; j < matchLen; j++ {
+			out = append(out, out[len(out)-offset])
+		}
+
+		if i != nbSeq-1 {
+			llState = ll.next(llState, br)
+			mlState = ml.next(mlState, br)
+			ofState = of.next(ofState, br)
+		}
+	}
+
+	if br.pos != 0 {
+		return nil, errors.Errorf("%d bits left of sequences", br.pos)
+	}
+
+	return append(out, lits...), nil
+}
+
+// backwardReader reads a bitstream from its end, which is marked by the highest
+// set bit of the last byte.
+type backwardReader struct {
+	b   []byte
+	pos int
+}
+
+func newBackwardReader(b []byte) (*backwardReader, error) {
+	if len(b) == 0 || b[len(b)-1] == 0 {
+		return nil, errors.New("no end mark of a bitstream")
+	}
+
+	return &backwardReader{b: b, pos: 8*(len(b)-1) + bits.Len8(b[len(b)-1]) - 1}, nil
+}
+
+func (r *backwardReader) read(n int) int {
+	v := 0
+
+	for i := 0; i < n; i++ {
+		r.pos--
+		v = v<<1 | int(r.b[r.pos/8]>>(r.pos%8)&1)
+	}
+
+	return v
+}
+
+// fseDecoder is a decoding table of a distribution built as RFC 8878, section
+// 4.1.1 tells.
+type fseDecoder struct {
+	symbol   []uint8
+	nbBits   []int
+	baseline []int
+}
+
+func newFSEDecoder(norm []int16, accuracyLog int) *fseDecoder {
+	size := 1 << accuracyLog
+
+	d := &fseDecoder{
+		symbol:   make([]uint8, size),
+		nbBits:   make([]int, size),
+		baseline: make([]int, size),
+	}
+
+	high := size - 1
+
+	for s, c := range norm {
+		if c == -1 {
+			d.symbol[high] = uint8(s)
+			high--
+		}
+	}
+
+	pos := 0
+
+	for s, c := range norm {
+		for i := 0; i < int(c); i++ {
+			d.symbol[pos] = uint8(s)
+
+			for pos = (pos + size>>1 + size>>3 + 3) & (size - 1); pos > high; {
+				pos = (pos + size>>1 + size>>3 + 3) & (size - 1)
+			}
+		}
+	}
+
+	next := make([]int, len(norm))
+	for s, c := range norm {
+		next[s] = int(c)
+		if c == -1 {
+			next[s] = 1
+		}
+	}
+
+	for u, s := range d.symbol {
+		x := next[s]
+		next[s]++
+
+		d.nbBits[u] = accuracyLog - (bits.Len(uint(x)) - 1)
+		d.baseline[u] = x<<d.nbBits[u] - size
+	}
+
+	return d
+}
+
+func (d *fseDecoder) next(state int, r *backwardReader) int {
+	return d.baseline[state] + r.read(d.nbBits[state])
+}
+
+func compress(t *testing.T, data []byte, writeSize int) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+
+	z := NewWriter(&b)
+
+	for p := data; len(p) > 0; {
+		n := writeSize
+		if n > len(p) {
+			n = len(p)
+		}
+
+		if _, err := z.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+
+		p = p[n:]
+	}
+
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+// text returns n bytes of lines of words, which are compressed by matches.
+func text(n int, seed int64) []byte {
+	words := []string{"backup", "peer", "archive", "stream", "version", "chunk", "signal", "restore"}
+	r := rand.New(rand.NewSource(seed))
+
+	var b bytes.Buffer
+
+	for b.Len() < n {
+		fmt.Fprintf(&b, "%s %s %d\n", words[r.Intn(len(words))], words[r.Intn(len(words))], r.Intn(1000))
+	}
+
+	return b.Bytes()[:n]
+}
+
+func random(n int, seed int64) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+
+	return b
+}
+
+// testInputs are inputs of round trips: empty ones, ones at the boundary of a
+// block, incompressible ones, ones of a repeated byte and ones spanning several
+// windows, matches of which are found a window back at most.
+func testInputs() map[string][]byte {
+	repeated := random(300<<10, 1)
+	repeated = append(repeated, repeated...)
+
+	return map[string][]byte{
+		"empty":                 {},
+		"single byte":           {42},
+		"text of a block - 1":   text(maxBlockSize-1, 1),
+		"text of a block":       text(maxBlockSize, 2),
+		"text of a block + 1":   text(maxBlockSize+1, 3),
+		"text of 2 blocks":      text(2*maxBlockSize, 4),
+		"random of a block - 1": random(maxBlockSize-1, 2),
+		"random of a block":     random(maxBlockSize, 3),
+		"random of a block + 1": random(maxBlockSize+1, 4),
+		"zeros":                 make([]byte, 3*maxBlockSize+5),
+		"repeated random":       repeated,
+		"text of windows":       text(3*windowSize+12345, 5),
+	}
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	for name, data := range testInputs() {
+		for _, writeSize := range []int{1 << 20, maxBlockSize, 1000} {
+			// Writes of single bytes are only tried on small inputs.
+			if writeSize == 1000 && len(data) > 4*maxBlockSize {
+				continue
+			}
+
+			frame := compress(t, data, writeSize)
+
+			decoded, err := decodeFrame(frame)
+			if err != nil {
+				t.Fatalf("%s, writes of %d bytes: %v", name, writeSize, err)
+			}
+
+			if !bytes.Equal(decoded, data) {
+				t.Fatalf("%s, writes of %d bytes: decoded data mismatch", name, writeSize)
+			}
+		}
+	}
+}
+
+// TestWriterRatio checks that compressible data is compressed and that
+// incompressible one takes hardly more than it does.
+func TestWriterRatio(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		data []byte
+		max  int
+	}{
+		{"text", text(4*maxBlockSize, 6), 2 * maxBlockSize},
+		{"random", random(4*maxBlockSize, 5), 4*maxBlockSize + 64},
+		{"zeros", make([]byte, 4*maxBlockSize), 64},
+		{"repeated random", append(random(maxBlockSize, 6), random(maxBlockSize, 6)...), maxBlockSize + 2048},
+	} {
+		if n := len(compress(t, tt.data, len(tt.data))); n > tt.max {
+			t.Errorf("%s: %d bytes compressed into %d, %d at most expected", tt.name, len(tt.data), n, tt.max)
+		}
+	}
+}
+
+func TestWriterRefusesWriteAfterClose(t *testing.T) {
+	z := NewWriter(&bytes.Buffer{})
+
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := z.Write([]byte("data")); err == nil {
+		t.Error("write to a closed writer succeeded")
+	}
+}
+
+// TestWriterDecodedByZstd decodes frames with the reference implementation if
+// it's installed.
+func TestWriterDecodedByZstd(t *testing.T) {
+	path, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("zstd isn't installed")
+	}
+
+	for name, data := range testInputs() {
+		cmd := exec.Command(path, "-d", "-q", "-c")
+		cmd.Stdin = bytes.NewReader(compress(t, data, len(data)))
+
+		decoded, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if !bytes.Equal(decoded, data) {
+			t.Fatalf("%s: decoded data mismatch", name)
+		}
+	}
+}
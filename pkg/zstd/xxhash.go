@@ -0,0 +1,111 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// xxhash64 is XXH64 with a zero seed, the lower half of which is a content
+// checksum of a frame.
+type xxhash64 struct {
+	v     [4]uint64
+	buf   [32]byte
+	nbuf  int
+	total uint64
+}
+
+func newXXHash64() *xxhash64 {
+	var seed uint64
+
+	return &xxhash64{
+		v: [4]uint64{seed + xxPrime1 + xxPrime2, seed + xxPrime2, seed, seed - xxPrime1},
+	}
+}
+
+func (h *xxhash64) Write(p []byte) {
+	h.total += uint64(len(p))
+
+	if h.nbuf != 0 {
+		n := copy(h.buf[h.nbuf:], p)
+		h.nbuf += n
+		p = p[n:]
+
+		if h.nbuf < len(h.buf) {
+			return
+		}
+
+		h.stripe(h.buf[:])
+		h.nbuf = 0
+	}
+
+	for len(p) >= len(h.buf) {
+		h.stripe(p[:len(h.buf)])
+		p = p[len(h.buf):]
+	}
+
+	h.nbuf = copy(h.buf[:], p)
+}
+
+func (h *xxhash64) stripe(p []byte) {
+	for i := range h.v {
+		h.v[i] = xxRound(h.v[i], binary.LittleEndian.Uint64(p[8*i:]))
+	}
+}
+
+func (h *xxhash64) Sum64() uint64 {
+	var s uint64
+
+	if h.total >= uint64(len(h.buf)) {
+		s = bits.RotateLeft64(h.v[0], 1) + bits.RotateLeft64(h.v[1], 7) +
+			bits.RotateLeft64(h.v[2], 12) + bits.RotateLeft64(h.v[3], 18)
+
+		for _, v := range h.v {
+			s = (s^xxRound(0, v))*xxPrime1 + xxPrime4
+		}
+	} else {
+		s = xxPrime5
+	}
+
+	s += h.total
+
+	p := h.buf[:h.nbuf]
+
+	for ; len(p) >= 8; p = p[8:] {
+		s ^= xxRound(0, binary.LittleEndian.Uint64(p))
+		s = bits.RotateLeft64(s, 27)*xxPrime1 + xxPrime4
+	}
+
+	if len(p) >= 4 {
+		s ^= uint64(binary.LittleEndian.Uint32(p)) * xxPrime1
+		s = bits.RotateLeft64(s, 23)*xxPrime2 + xxPrime3
+		p = p[4:]
+	}
+
+	for _, b := range p {
+		s ^= uint64(b) * xxPrime5
+		s = bits.RotateLeft64(s, 11) * xxPrime1
+	}
+
+	s ^= s >> 33
+	s *= xxPrime2
+	s ^= s >> 29
+	s *= xxPrime3
+	s ^= s >> 32
+
+	return s
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+
+	return acc * xxPrime1
+}
@@ -0,0 +1,53 @@
+package zstd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestXXHash64(t *testing.T) {
+	for _, tt := range []struct {
+		input string
+		sum   uint64
+	}{
+		{"", 0xEF46DB3751D8E999},
+		{"a", 0xD24EC4F1A98C6E5B},
+		{"abc", 0x44BC2CF5AD770999},
+		// Longer than a stripe of 32 bytes, with a tail of 8, 4 and 1 bytes.
+		{"Nobody inspects the spammish repetition", 0xFBCEA83C8A378BF1},
+	} {
+		h := newXXHash64()
+		h.Write([]byte(tt.input))
+
+		if sum := h.Sum64(); sum != tt.sum {
+			t.Errorf("XXH64(%q) = %#x, want %#x", tt.input, sum, tt.sum)
+		}
+	}
+}
+
+// TestXXHash64Split checks that a sum doesn't depend on how data is split into
+// writes, which buffer a partial stripe.
+func TestXXHash64Split(t *testing.T) {
+	data := []byte(strings.Repeat("Nobody inspects the spammish repetition", 10))
+
+	whole := newXXHash64()
+	whole.Write(data)
+
+	for _, size := range []int{1, 7, 31, 32, 33, 100} {
+		h := newXXHash64()
+
+		for p := data; len(p) > 0; {
+			n := size
+			if n > len(p) {
+				n = len(p)
+			}
+
+			h.Write(p[:n])
+			p = p[n:]
+		}
+
+		if h.Sum64() != whole.Sum64() {
+			t.Errorf("sum of writes of %d bytes = %#x, want %#x", size, h.Sum64(), whole.Sum64())
+		}
+	}
+}